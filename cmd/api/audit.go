@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/petrostrak/an-open-movie-database/internal/data"
+	"github.com/petrostrak/an-open-movie-database/internal/validator"
+)
+
+// The recordAudit() helper adds an entry to the audit log for the current request. If
+// the entry doesn't set a UserID we use the authenticated user's. The entry is written
+// asynchronously, so this never fails the request. The method the request was sent
+// with is added to the metadata if methodOverride() changed it.
+func (app *application) recordAudit(r *http.Request, entry data.AuditEntry) {
+	if entry.UserID == 0 {
+		if user := app.contextGetUser(r); !user.IsAnonymous() {
+			entry.UserID = user.ID
+		}
+	}
+
+	entry.IP = app.clientIP(r)
+
+	// Note when the request was sent with another method and X-HTTP-Method-Override.
+	if original := app.contextGetOriginalMethod(r); original != "" {
+		metadata := make(map[string]interface{}, len(entry.Metadata)+1)
+		for key, value := range entry.Metadata {
+			metadata[key] = value
+		}
+		metadata["original_method"] = original
+		entry.Metadata = metadata
+	}
+
+	app.audit.Record(r.Context(), entry)
+}
+
+// The listAuditHandler() returns a page of audit log entries, optionally filtered by
+// user, action and date range.
+func (app *application) listAuditHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		data.AuditFilters
+		data.Filters
+	}
+
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	input.AuditFilters.UserID = int64(app.readInt(qs, "user_id", 0, v))
+	input.AuditFilters.Action = app.readString(qs, "action", "")
+	input.AuditFilters.From = app.readTime(qs, "from", v)
+	input.AuditFilters.To = app.readTime(qs, "to", v)
+
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	input.Filters.Sort = app.readString(qs, "sort", "-occurred_at")
+	input.Filters.SortSafelist = []string{"id", "occurred_at", "-id", "-occurred_at"}
+
+	v.Check(input.AuditFilters.UserID >= 0, "user_id", validator.Msg("positive_integer"))
+
+	if !input.AuditFilters.From.IsZero() && !input.AuditFilters.To.IsZero() {
+		v.Check(!input.AuditFilters.To.Before(input.AuditFilters.From), "to", validator.Msg("not_before_from"))
+	}
+
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	entries, metadata, err := app.models.Audit.GetAll(input.AuditFilters, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	entries, err = limitPage(app, entries, &metadata)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"audit": entries, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"strconv"
+	"time"
+)
+
+// Publish the total numbers of expired tokens and idempotency keys deleted so far.
+// These are package-level, like totalPanicsRecovered, as expvar.NewInt() panics if a
+// name is published twice.
+var (
+	totalTokensDeleted          = expvar.NewInt("total_expired_tokens_deleted")
+	totalIdempotencyKeysDeleted = expvar.NewInt("total_expired_idempotency_keys_deleted")
+)
+
+// The startTokenCleanup() helper starts a background goroutine which deletes expired
+// tokens (and expired idempotency keys, and old watchlist email counts) every cfg.tokens.cleanupInterval, until the
+// context is cancelled. Like the
+// goroutines started by background(), it's tracked by the WaitGroup so that graceful
+// shutdown waits for a cleanup that's in progress. It beats on every tick.
+func (app *application) startTokenCleanup(ctx context.Context) {
+	app.workers.register(workerTokenCleanup, 1, app.config.tokens.cleanupInterval, nil)
+	app.wg.Add(1)
+
+	go func() {
+		defer app.wg.Done()
+
+		ticker := time.NewTicker(app.config.tokens.cleanupInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				app.workers.beat(workerTokenCleanup, 0)
+
+				// A failure is most likely a transient database problem, so we log it
+				// and try again on the next tick.
+				deleted, err := app.models.Tokens.DeleteAllExpired()
+				if err != nil {
+					app.logger.PrintError(err, nil)
+					continue
+				}
+
+				totalTokensDeleted.Add(deleted)
+
+				app.logger.PrintInfo("deleted expired tokens", map[string]string{
+					"count": strconv.FormatInt(deleted, 10),
+				})
+
+				deleted, err = app.models.Idempotency.DeleteAllExpired()
+				if err != nil {
+					app.logger.PrintError(err, nil)
+					continue
+				}
+
+				totalIdempotencyKeysDeleted.Add(deleted)
+
+				app.logger.PrintInfo("deleted expired idempotency keys", map[string]string{
+					"count": strconv.FormatInt(deleted, 10),
+				})
+
+				// The daily counts of watchlist emails are only needed for the day
+				// they're counting.
+				deleted, err = app.models.Watchlist.DeleteOldNotifications()
+				if err != nil {
+					app.logger.PrintError(err, nil)
+					continue
+				}
+
+				app.logger.PrintInfo("deleted old watchlist email counts", map[string]string{
+					"count": strconv.FormatInt(deleted, 10),
+				})
+			}
+		}
+	}()
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/petrostrak/an-open-movie-database/internal/data"
+)
+
+func TestTokenCleanup(t *testing.T) {
+	app := newTestApplication(t)
+	app.config.tokens.cleanupInterval = 10 * time.Millisecond
+
+	user, valid := newTestUser(t, app, "alice", "reader")
+
+	expired, err := app.models.Tokens.New(user.ID, -time.Minute, data.ScopeAuthentication)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, err = app.models.Idempotency.Claim(user.ID, "expired-key", []byte("fingerprint"), -time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tokensBefore, keysBefore := totalTokensDeleted.Value(), totalIdempotencyKeysDeleted.Value()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	app.startTokenCleanup(ctx)
+
+	deadline := time.Now().Add(time.Second)
+	for totalIdempotencyKeysDeleted.Value() == keysBefore && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// Cancelling the context stops the goroutine, which is tracked by the WaitGroup.
+	cancel()
+	app.wg.Wait()
+
+	if got := totalTokensDeleted.Value() - tokensBefore; got != 1 {
+		t.Errorf("got %d tokens deleted; want 1", got)
+	}
+
+	if got := totalIdempotencyKeysDeleted.Value() - keysBefore; got != 1 {
+		t.Errorf("got %d idempotency keys deleted; want 1", got)
+	}
+
+	ts := newTestServer(t)
+
+	tests := []struct {
+		name     string
+		token    string
+		wantCode int
+	}{
+		{"valid token kept", valid, http.StatusOK},
+		{"expired token deleted", expired.Plaintext, http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, _ := ts.do(t, http.MethodGet, "/v1/me", tt.token, nil)
+			if code != tt.wantCode {
+				t.Errorf("got status %d; want %d", code, tt.wantCode)
+			}
+		})
+	}
+}
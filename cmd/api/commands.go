@@ -0,0 +1,499 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	conf "github.com/petrostrak/an-open-movie-database/internal/config"
+	"github.com/petrostrak/an-open-movie-database/internal/data"
+	"github.com/petrostrak/an-open-movie-database/internal/data/seed"
+	"github.com/petrostrak/an-open-movie-database/internal/jsonlog"
+	"github.com/petrostrak/an-open-movie-database/internal/migrate"
+	"github.com/petrostrak/an-open-movie-database/internal/validator"
+	"github.com/petrostrak/an-open-movie-database/migrations"
+)
+
+// The exit codes. A usage error exits with the same code as the flag package uses for
+// an unknown flag.
+const (
+	exitRuntimeError = 1
+	exitUsageError   = 2
+)
+
+// A usageError is returned by a command when it was run with the wrong arguments, so
+// that main() can print the usage and exit with exitUsageError.
+type usageError struct {
+	message string
+}
+
+func (e usageError) Error() string {
+	return e.message
+}
+
+// Define the commands. Each one parses its own flags from the arguments which follow
+// the command name.
+var commands = []struct {
+	name    string
+	usage   string
+	summary string
+	run     func(logger *jsonlog.Logger, args []string) error
+}{
+	{"serve", "serve [flags]", "Run the API server (the default)", serveCommand},
+	{"migrate", "migrate [flags] up|down N|-all|version|force V", "Apply or roll back the database migrations", migrateCommand},
+	{"createsuperuser", "createsuperuser -email EMAIL -name NAME [flags]", "Create an activated user with every permission", createSuperuserCommand},
+	{"seed", "seed [flags]", "Load generated movies, users and ratings for development", seedCommand},
+	{"rotate", "rotate -data-encryption-key KEY [-old-data-encryption-key KEY]", "Re-encrypt the encrypted columns with a new key", rotateCommand},
+}
+
+func printUsage(w io.Writer) {
+	fmt.Fprintf(w, "Usage:\n  %s <command> [flags]\n\nCommands:\n", os.Args[0])
+
+	for _, cmd := range commands {
+		fmt.Fprintf(w, "  %-50s %s\n", cmd.usage, cmd.summary)
+	}
+
+	fmt.Fprintf(w, "\nRun \"%s <command> -h\" to list the flags for a command.\n", os.Args[0])
+}
+
+// The migrateCommand() function applies or rolls back the embedded migrations.
+//
+// go run ./cmd/api migrate up
+// go run ./cmd/api migrate down 1
+func migrateCommand(logger *jsonlog.Logger, args []string) error {
+	var cfg config
+
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	registerDBFlags(fs, &cfg)
+	registerLogFlags(fs, logger)
+
+	err := conf.Load(fs, args)
+	if err != nil {
+		return err
+	}
+
+	// Check the arguments before connecting to the database, so that a typo is
+	// reported as a usage error.
+	action, n, err := parseMigrateArgs(fs.Args())
+	if err != nil {
+		return err
+	}
+
+	db, err := openDB(cfg, logger, nil)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	migrator, err := migrate.NewForDriver(cfg.db.driver, db, migrations.ForDriver(cfg.db.driver))
+	if err != nil {
+		return err
+	}
+
+	switch action {
+	case "up":
+		err = migrator.Up()
+	case "down":
+		err = migrator.Down(n)
+	case "force":
+		err = migrator.Force(uint(n))
+	}
+
+	if err != nil && !errors.Is(err, migrate.ErrNoChange) {
+		return err
+	}
+
+	version, dirty, err := migrator.Version()
+	if err != nil && !errors.Is(err, migrate.ErrNilVersion) {
+		return err
+	}
+
+	logger.PrintInfo("database schema version", map[string]string{
+		"version": strconv.FormatUint(uint64(version), 10),
+		"dirty":   strconv.FormatBool(dirty),
+		"latest":  strconv.FormatUint(uint64(migrator.Latest()), 10),
+	})
+
+	return nil
+}
+
+// The parseMigrateArgs() function checks the arguments of the migrate command, and
+// returns the action along with its number: the steps to roll back (0 for all of
+// them, with down -all) or the version to force. Rolling back every migration drops
+// all the data, so down needs to be told explicitly how far to go.
+func parseMigrateArgs(args []string) (string, int, error) {
+	if len(args) == 0 {
+		return "", 0, usageError{"migrate needs a subcommand: up, down, version or force"}
+	}
+
+	action, rest := args[0], args[1:]
+
+	switch {
+	case action == "up" && len(rest) == 0, action == "version" && len(rest) == 0:
+		return action, 0, nil
+	case action == "down" && len(rest) == 0:
+		return "", 0, usageError{"migrate down needs the number of migrations to roll back, or -all"}
+	case action == "down" && len(rest) == 1 && rest[0] == "-all":
+		return action, 0, nil
+	case action == "down" && len(rest) == 1, action == "force" && len(rest) == 1:
+		n, err := strconv.Atoi(rest[0])
+		if err != nil || n < 0 || (action == "down" && n == 0) {
+			return "", 0, usageError{fmt.Sprintf("invalid number %q for migrate %s", rest[0], action)}
+		}
+		return action, n, nil
+	default:
+		return "", 0, usageError{fmt.Sprintf("invalid arguments for migrate: %s", strings.Join(args, " "))}
+	}
+}
+
+// The createSuperuserCommand() function creates an activated user with the "admin"
+// role and every permission. The password is read from the OMDB_SUPERUSER_PASSWORD
+// environment variable, or prompted for if that isn't set.
+//
+// go run ./cmd/api createsuperuser -email=admin@example.com -name=Admin
+func createSuperuserCommand(logger *jsonlog.Logger, args []string) error {
+	var cfg config
+	var email, name, username string
+
+	fs := flag.NewFlagSet("createsuperuser", flag.ExitOnError)
+	fs.StringVar(&email, "email", "", "Email address of the superuser")
+	fs.StringVar(&name, "name", "", "Name of the superuser")
+	fs.StringVar(&username, "username", "", "Username of the superuser (default derived from the email address)")
+	registerDBFlags(fs, &cfg)
+	registerLogFlags(fs, logger)
+	registerPasswordHashFlags(fs, &cfg)
+
+	// The user's details are only read from the command line, as the same
+	// environment is used for every run.
+	err := conf.Load(fs, args, "email", "name", "username")
+	if err != nil {
+		return err
+	}
+
+	if email == "" || name == "" || fs.NArg() > 0 {
+		return usageError{"createsuperuser needs -email and -name, and no other arguments"}
+	}
+
+	err = setHashingParams(cfg)
+	if err != nil {
+		return err
+	}
+
+	password, ok := os.LookupEnv("OMDB_SUPERUSER_PASSWORD")
+	if !ok {
+		password, err = promptPassword(os.Stdin, os.Stderr)
+		if err != nil {
+			return err
+		}
+	}
+
+	db, err := openDB(cfg, logger, nil)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	models, err := data.NewModelsForDriver(cfg.db.driver, db, nil)
+	if err != nil {
+		return err
+	}
+
+	user := &data.User{
+		Name:      name,
+		Email:     data.NormalizeEmail(email),
+		Locale:    data.DefaultLocale,
+		Activated: true,
+	}
+
+	if username != "" {
+		user.Username = data.NormalizeUsername(username)
+	} else {
+		user.Username, err = models.Users.AvailableUsername(user.Email)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = user.Password.Set(password)
+	if err != nil {
+		return err
+	}
+
+	v := validator.New()
+
+	err = data.ValidateUser(v, user)
+	if err != nil {
+		return err
+	}
+
+	if !v.Valid() {
+		return fmt.Errorf("invalid superuser: %s", formatValidationErrors(v.Errors))
+	}
+
+	err = models.Users.Insert(user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateEmail):
+			return errors.New("a user with this email address already exists")
+		case errors.Is(err, data.ErrDuplicateUsername):
+			return errors.New("a user with this username already exists")
+		default:
+			return err
+		}
+	}
+
+	err = models.Roles.AddForUser(user.ID, "admin")
+	if err != nil {
+		return err
+	}
+
+	err = models.Permissions.AddAllForUser(user.ID)
+	if err != nil {
+		return err
+	}
+
+	logger.PrintInfo("superuser created", map[string]string{
+		"user_id":  strconv.FormatInt(user.ID, 10),
+		"username": user.Username,
+		"email":    user.Email,
+	})
+
+	return nil
+}
+
+// The promptPassword() function asks for the password twice, hiding the input when
+// reading from a terminal, and checks that both match.
+func promptPassword(in *os.File, out io.Writer) (string, error) {
+	reader := bufio.NewReader(in)
+
+	read := func(prompt string) (string, error) {
+		fmt.Fprint(out, prompt)
+		defer fmt.Fprintln(out)
+
+		restore := disableEcho(in)
+		defer restore()
+
+		line, err := reader.ReadString('\n')
+		if err != nil && !(errors.Is(err, io.EOF) && line != "") {
+			return "", fmt.Errorf("reading password: %w", err)
+		}
+
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+
+	password, err := read("Password: ")
+	if err != nil {
+		return "", err
+	}
+
+	confirmation, err := read("Password (again): ")
+	if err != nil {
+		return "", err
+	}
+
+	if password != confirmation {
+		return "", errors.New("the passwords don't match")
+	}
+
+	return password, nil
+}
+
+// The formatValidationErrors() function joins the messages from a validator in a
+// stable order, for reporting on the command line.
+func formatValidationErrors(errs map[string][]validator.Message) string {
+	messages := make([]string, 0, len(errs))
+	for key, keyMessages := range errs {
+		for _, message := range keyMessages {
+			messages = append(messages, key+" "+message.String())
+		}
+	}
+
+	sort.Strings(messages)
+
+	return strings.Join(messages, "; ")
+}
+
+// The seedCommand() function loads a generated catalog of movies for development and
+// CI, along with a few users who have rated, reviewed and added them to their
+// watchlists (see the seed package). It does nothing if there are already movies in
+// the database, so that it's safe to run again, and it refuses to run in production
+// unless it's given -force.
+//
+// go run ./cmd/api seed -seed-movies=5000 -seed-random-seed=42
+func seedCommand(logger *jsonlog.Logger, args []string) error {
+	var cfg config
+	var opts seed.Options
+	var batchSize int
+	var force bool
+
+	fs := flag.NewFlagSet("seed", flag.ExitOnError)
+	fs.StringVar(&cfg.env, "env", "development", "Environment(development|staging|production)")
+	fs.IntVar(&opts.Movies, "seed-movies", seed.DefaultMovies, "Number of movies to generate")
+	fs.Int64Var(&opts.Seed, "seed-random-seed", 0, "Seed for the random generator, so that the same data is generated each time (0 for a random one)")
+	fs.IntVar(&batchSize, "seed-batch-size", 500, "Number of rows to insert in each transaction")
+	fs.BoolVar(&force, "force", false, "Seed the database even when -env is production")
+	registerDBFlags(fs, &cfg)
+	registerLogFlags(fs, logger)
+	registerPasswordHashFlags(fs, &cfg)
+
+	// -force is only read from the command line, so that it can't be left set in the
+	// environment of a production deployment.
+	err := conf.Load(fs, args, "force")
+	if err != nil {
+		return err
+	}
+
+	if fs.NArg() > 0 {
+		return usageError{"seed doesn't take any arguments"}
+	}
+
+	err = checkSeedArgs(cfg.env, force, opts.Movies, batchSize)
+	if err != nil {
+		return err
+	}
+
+	if opts.Seed == 0 {
+		opts.Seed = time.Now().UnixNano()
+	}
+
+	err = setHashingParams(cfg)
+	if err != nil {
+		return err
+	}
+
+	db, err := openDB(cfg, logger, nil)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	models, err := data.NewModelsForDriver(cfg.db.driver, db, nil)
+	if err != nil {
+		return err
+	}
+
+	_, metadata, err := models.Movies.GetAll(data.MovieFilters{}, data.Filters{
+		Page:         1,
+		PageSize:     1,
+		Sort:         "id",
+		SortSafelist: data.MovieSortSafelist,
+	})
+	if err != nil {
+		return err
+	}
+
+	if metadata.TotalRecords > 0 {
+		logger.PrintInfo("database already has movies, skipping seed", map[string]string{
+			"movies": strconv.Itoa(metadata.TotalRecords),
+		})
+		return nil
+	}
+
+	set := seed.Generate(opts)
+
+	err = set.Load(context.Background(), cfg.db.driver, db, batchSize)
+	if err != nil {
+		return err
+	}
+
+	// The random seed is logged, so that a randomly seeded database can be generated
+	// again with -seed-random-seed.
+	logger.PrintInfo("database seeded", map[string]string{
+		"random_seed": strconv.FormatInt(opts.Seed, 10),
+		"movies":      strconv.Itoa(len(set.Movies)),
+		"users":       strconv.Itoa(len(set.Users)),
+		"ratings":     strconv.Itoa(len(set.Ratings)),
+		"reviews":     strconv.Itoa(len(set.Reviews)),
+		"watchlist":   strconv.Itoa(len(set.Watchlist)),
+	})
+
+	return nil
+}
+
+// The maxSeedBatchSize keeps the multi-row inserts of the seed command within
+// PostgreSQL's limit of 65535 parameters in a statement.
+const maxSeedBatchSize = 10000
+
+// The checkSeedArgs() function checks the flags of the seed command before it connects
+// to the database. Seeding adds made-up users with published passwords, so it's
+// refused in production unless forced.
+func checkSeedArgs(env string, force bool, movies, batchSize int) error {
+	if env == "production" && !force {
+		return errors.New("refusing to seed a production database without -force")
+	}
+
+	if movies < 1 {
+		return usageError{"-seed-movies must be at least 1"}
+	}
+
+	if batchSize < 1 || batchSize > maxSeedBatchSize {
+		return usageError{fmt.Sprintf("-seed-batch-size must be between 1 and %d", maxSeedBatchSize)}
+	}
+
+	return nil
+}
+
+// The rotateCommand() function re-encrypts every encrypted column with the key given
+// by -data-encryption-key, reading values encrypted with -old-data-encryption-key too.
+// Values stored before encryption was turned on are encrypted as well, so it's also
+// run once after setting a key for the first time.
+//
+// go run ./cmd/api rotate -data-encryption-key=NEW -old-data-encryption-key=OLD
+func rotateCommand(logger *jsonlog.Logger, args []string) error {
+	var cfg config
+
+	fs := flag.NewFlagSet("rotate", flag.ExitOnError)
+	registerDBFlags(fs, &cfg)
+	registerLogFlags(fs, logger)
+	registerEncryptionFlags(fs, &cfg)
+
+	err := conf.Load(fs, args)
+	if err != nil {
+		return err
+	}
+
+	if cfg.encryption.key == "" || fs.NArg() > 0 {
+		return usageError{"rotate needs -data-encryption-key, and no other arguments"}
+	}
+
+	err = setEncryptionKeyring(cfg)
+	if err != nil {
+		return err
+	}
+
+	db, err := openDB(cfg, logger, nil)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	models, err := data.NewModelsForDriver(cfg.db.driver, db, nil)
+	if err != nil {
+		return err
+	}
+
+	return rotateEncryptedColumns(logger, models)
+}
+
+// The rotateEncryptedColumns() function re-encrypts the encrypted columns of the models
+// with the current key, and logs how many values were changed.
+func rotateEncryptedColumns(logger *jsonlog.Logger, models data.Models) error {
+	webhooks, err := models.Webhooks.ReencryptSecrets()
+	if err != nil {
+		return err
+	}
+
+	logger.PrintInfo("encrypted columns rotated", map[string]string{
+		"webhook_secrets": strconv.Itoa(webhooks),
+	})
+
+	return nil
+}
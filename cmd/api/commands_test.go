@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/petrostrak/an-open-movie-database/internal/crypto"
+	"github.com/petrostrak/an-open-movie-database/internal/data"
+	"github.com/petrostrak/an-open-movie-database/internal/jsonlog"
+)
+
+func TestParseMigrateArgs(t *testing.T) {
+	tests := []struct {
+		name       string
+		args       []string
+		wantAction string
+		wantN      int
+		wantErr    bool
+	}{
+		{"up", []string{"up"}, "up", 0, false},
+		{"version", []string{"version"}, "version", 0, false},
+		{"down n", []string{"down", "2"}, "down", 2, false},
+		{"down all", []string{"down", "-all"}, "down", 0, false},
+		{"force", []string{"force", "0"}, "force", 0, false},
+		{"no subcommand", nil, "", 0, true},
+		{"down without n", []string{"down"}, "", 0, true},
+		{"down zero", []string{"down", "0"}, "", 0, true},
+		{"down negative", []string{"down", "-1"}, "", 0, true},
+		{"down not a number", []string{"down", "all"}, "", 0, true},
+		{"force without version", []string{"force"}, "", 0, true},
+		{"up with n", []string{"up", "1"}, "", 0, true},
+		{"unknown", []string{"sideways"}, "", 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			action, n, err := parseMigrateArgs(tt.args)
+
+			if tt.wantErr {
+				var usageErr usageError
+				if !errors.As(err, &usageErr) {
+					t.Errorf("got error %v; want a usage error", err)
+				}
+				return
+			}
+
+			if err != nil || action != tt.wantAction || n != tt.wantN {
+				t.Errorf("got %q, %d and error %v; want %q and %d", action, n, err, tt.wantAction, tt.wantN)
+			}
+		})
+	}
+}
+
+func TestCheckSeedArgs(t *testing.T) {
+	tests := []struct {
+		name      string
+		env       string
+		force     bool
+		movies    int
+		batchSize int
+		wantErr   bool
+	}{
+		{"development", "development", false, 1000, 500, false},
+		{"staging", "staging", false, 1000, 500, false},
+		{"production", "production", false, 1000, 500, true},
+		{"production forced", "production", true, 1000, 500, false},
+		{"no movies", "development", false, 0, 500, true},
+		{"no batch size", "development", false, 1000, 0, true},
+		{"batch too large", "development", false, 1000, maxSeedBatchSize + 1, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkSeedArgs(tt.env, tt.force, tt.movies, tt.batchSize)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("got error %v; want error %t", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// The rotate command re-encrypts the webhook secrets, both those stored without
+// encryption and those under the old key, so that the old key can then be dropped.
+func TestRotateEncryptedColumns(t *testing.T) {
+	t.Cleanup(func() { data.SetEncryptionKeyring(nil) })
+
+	logger := jsonlog.New(io.Discard, jsonlog.LevelOff)
+	models := data.NewMockModels()
+
+	oldKey := base64.StdEncoding.EncodeToString([]byte(strings.Repeat("o", crypto.KeySize)))
+	newKey := base64.StdEncoding.EncodeToString([]byte(strings.Repeat("n", crypto.KeySize)))
+
+	setKeys := func(key, oldKey string) {
+		t.Helper()
+
+		var cfg config
+		cfg.encryption.key = key
+		cfg.encryption.oldKey = oldKey
+
+		err := setEncryptionKeyring(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	insert := func(secret string) {
+		t.Helper()
+
+		err := models.Webhooks.Insert(&data.Webhook{URL: "https://example.com/hook", Secret: secret, Events: []string{data.WebhookMovieCreated}, Active: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// One webhook from before encryption was turned on, and one under the old key.
+	setKeys("", "")
+	insert("stored before encryption")
+
+	setKeys(oldKey, "")
+	insert("encrypted with the old key")
+
+	// Without a key, the server refuses to start.
+	setKeys("", "")
+	if err := checkEncryptedColumns(models); !errors.Is(err, data.ErrEncryptionKeyMissing) {
+		t.Errorf("got error %v without a key; want ErrEncryptionKeyMissing", err)
+	}
+
+	// With only the new key, it doesn't know the old one.
+	setKeys(newKey, "")
+	if err := checkEncryptedColumns(models); !errors.Is(err, crypto.ErrUnknownKey) {
+		t.Errorf("got error %v without the old key; want ErrUnknownKey", err)
+	}
+
+	setKeys(newKey, oldKey)
+
+	err := rotateEncryptedColumns(logger, models)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Everything can now be read with the new key alone, and a second run has
+	// nothing to do.
+	setKeys(newKey, "")
+
+	err = checkEncryptedColumns(models)
+	if err != nil {
+		t.Fatalf("got error %v after rotating", err)
+	}
+
+	webhooks, err := models.Webhooks.GetAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(webhooks) != 2 || webhooks[0].Secret != "stored before encryption" || webhooks[1].Secret != "encrypted with the old key" {
+		t.Errorf("got webhooks %+v; want both secrets intact", webhooks)
+	}
+
+	changed, err := models.Webhooks.ReencryptSecrets()
+	if err != nil || changed != 0 {
+		t.Errorf("got %d changed and error %v on a second run; want 0", changed, err)
+	}
+
+	// The keys are checked before connecting to the database.
+	var usageErr usageError
+	if err := rotateCommand(logger, nil); !errors.As(err, &usageErr) {
+		t.Errorf("got error %v without a key; want a usage error", err)
+	}
+
+	if err := rotateCommand(logger, []string{"-data-encryption-key=short"}); !errors.Is(err, crypto.ErrInvalidKey) {
+		t.Errorf("got error %v for an invalid key; want ErrInvalidKey", err)
+	}
+}
@@ -2,7 +2,11 @@ package main
 
 import (
 	"context"
+	"net"
 	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
 
 	"github.com/petrostrak/an-open-movie-database/internal/data"
 )
@@ -15,14 +19,195 @@ type contextKey string
 // in the request context.
 const userContextKey = contextKey("user")
 
+// Convert the string "route" to a contextKey type, for the routeRecorder of a request.
+const routeContextKey = contextKey("route")
+
+// Convert the string "conn" to a contextKey type, for the connection which a request
+// arrived on.
+const connContextKey = contextKey("conn")
+
+// Define a routeRecorder type which holds the route matched for a request. The
+// metrics() middleware adds one to the context before the router runs, and the
+// router fills it in, so that the route is known on the way back up the chain. The
+// handler may run in another goroutine (see requestTimeout()), so the route is
+// stored atomically.
+type routeRecorder struct {
+	route atomic.Value
+}
+
+// The get() method returns the recorded route, or "unmatched" if the router didn't
+// match one (for a 404 or 405 response).
+func (rr *routeRecorder) get() string {
+	route, ok := rr.route.Load().(string)
+	if !ok {
+		return "unmatched"
+	}
+
+	return route
+}
+
+// The contextWithRouteRecorder() returns a new copy of the request with an empty
+// routeRecorder added to the context.
+func (app *application) contextWithRouteRecorder(r *http.Request) (*http.Request, *routeRecorder) {
+	rr := &routeRecorder{}
+	return r.WithContext(context.WithValue(r.Context(), routeContextKey, rr)), rr
+}
+
+// The contextSetRoute() records the matched route in the request's routeRecorder, if
+// it has one.
+func (app *application) contextSetRoute(r *http.Request, route string) {
+	if rr, ok := r.Context().Value(routeContextKey).(*routeRecorder); ok {
+		rr.route.Store(route)
+	}
+}
+
+// The contextWithConn() method adds the connection to the context of each request
+// which arrives on it. It's the server's ConnContext hook.
+func (app *application) contextWithConn(ctx context.Context, c net.Conn) context.Context {
+	return context.WithValue(ctx, connContextKey, c)
+}
+
+// The contextGetConn() method returns the connection which the request arrived on, if
+// the server recorded it. It isn't there for a request which didn't come through
+// serve(), such as one made with httptest.NewRecorder().
+func (app *application) contextGetConn(r *http.Request) (net.Conn, bool) {
+	conn, ok := r.Context().Value(connContextKey).(net.Conn)
+	return conn, ok
+}
+
 // The contextSetUser() returns a new copy of the request with the provided
 // User struct added to the context. Note that we use our userContextKey
 // constant as the key.
+//
+// The user's ID is also recorded in the request's userRecorder, if it has one.
 func (app *application) contextSetUser(r *http.Request, user *data.User) *http.Request {
+	if ur, ok := r.Context().Value(userRecorderContextKey).(*userRecorder); ok && !user.IsAnonymous() {
+		ur.id.Store(user.ID)
+	}
+
 	ctx := context.WithValue(r.Context(), userContextKey, user)
 	return r.WithContext(ctx)
 }
 
+// Convert the string "user_recorder" to a contextKey type, for the userRecorder of a
+// request.
+const userRecorderContextKey = contextKey("user_recorder")
+
+// Define a userRecorder type which holds the ID of the user who made a request, for
+// middleware which runs before authenticate() (like recoverPanic()). It works the same
+// way as the routeRecorder.
+type userRecorder struct {
+	id atomic.Int64
+}
+
+// The get() method returns the recorded user ID, or the empty string for an anonymous
+// request.
+func (ur *userRecorder) get() string {
+	id := ur.id.Load()
+	if id == 0 {
+		return ""
+	}
+
+	return strconv.FormatInt(id, 10)
+}
+
+// The contextWithUserRecorder() returns a new copy of the request with an empty
+// userRecorder added to the context.
+func (app *application) contextWithUserRecorder(r *http.Request) (*http.Request, *userRecorder) {
+	ur := &userRecorder{}
+	return r.WithContext(context.WithValue(r.Context(), userRecorderContextKey, ur)), ur
+}
+
+// The contextSetRequestID() returns a new copy of the request with the request ID
+// added to the context. The ID is stored under the data package's key, so that the
+// data layer can read it too.
+func (app *application) contextSetRequestID(r *http.Request, requestID string) *http.Request {
+	return r.WithContext(data.ContextWithRequestID(r.Context(), requestID))
+}
+
+// The contextGetRequestID() retrieves the request ID from the request context. Unlike
+// contextGetUser(), a missing ID isn't unexpected (the request may have failed before
+// the requestID() middleware ran), so it just returns the empty string.
+func (app *application) contextGetRequestID(r *http.Request) string {
+	return data.RequestIDFromContext(r.Context())
+}
+
+// Convert the string "request_start" to a contextKey type, for the time the request
+// arrived.
+const requestStartContextKey = contextKey("request_start")
+
+// The contextSetRequestStart() returns a new copy of the request with the time it
+// arrived added to the context.
+func (app *application) contextSetRequestStart(r *http.Request, start time.Time) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), requestStartContextKey, start))
+}
+
+// The contextGetRequestStart() retrieves the time the request arrived, or the zero
+// time if the requestID() middleware didn't run.
+func (app *application) contextGetRequestStart(r *http.Request) time.Time {
+	start, _ := r.Context().Value(requestStartContextKey).(time.Time)
+	return start
+}
+
+// Convert the string "original_method" to a contextKey type, for the method a
+// request was sent with before methodOverride() changed it.
+const originalMethodContextKey = contextKey("original_method")
+
+// The contextSetOriginalMethod() returns a new copy of the request with its original
+// method added to the context.
+func (app *application) contextSetOriginalMethod(r *http.Request, method string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), originalMethodContextKey, method))
+}
+
+// The contextGetOriginalMethod() retrieves the method the request was sent with, if
+// methodOverride() changed it, or the empty string otherwise.
+func (app *application) contextGetOriginalMethod(r *http.Request) string {
+	method, _ := r.Context().Value(originalMethodContextKey).(string)
+	return method
+}
+
+// Convert the string "api_version" to a contextKey type, for the version of the API
+// that a request is served under.
+const apiVersionContextKey = contextKey("api_version")
+
+// The contextSetAPIVersion() returns a new copy of the request with the version of the
+// API it's served under added to the context.
+func (app *application) contextSetAPIVersion(r *http.Request, version string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), apiVersionContextKey, version))
+}
+
+// The contextGetAPIVersion() retrieves the version of the API the request is served
+// under, which is v1 if the apiVersion() middleware didn't run.
+func (app *application) contextGetAPIVersion(r *http.Request) string {
+	version, ok := r.Context().Value(apiVersionContextKey).(string)
+	if !ok {
+		return apiV1
+	}
+
+	return version
+}
+
+// Convert the string "read_primary" to a contextKey type, for marking requests whose
+// reads must go to the primary database.
+const readPrimaryContextKey = contextKey("read_primary")
+
+// The contextSetReadPrimary() returns a new copy of the request which reads from the
+// primary database rather than the read replica. Handlers call it after a write, so
+// that reading the data back isn't affected by replication lag.
+func (app *application) contextSetReadPrimary(r *http.Request) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), readPrimaryContextKey, true))
+}
+
+// The modelsFor() helper returns the models to use for a request, which only differ
+// from app.models after contextSetReadPrimary() has been called.
+func (app *application) modelsFor(r *http.Request) data.Models {
+	if readPrimary, _ := r.Context().Value(readPrimaryContextKey).(bool); readPrimary {
+		return app.models.Primary()
+	}
+
+	return app.models
+}
+
 // The contextGetUser() retrieves the User struct from the request context. The only
 // time that we'll use this helper is when we logically expect there to be User struct
 // value in the context, and if it doesn't exist it will firmly be an 'unexpected' error.
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestMatchOrigin(t *testing.T) {
+	tests := []struct {
+		pattern string
+		origin  string
+		want    bool
+	}{
+		{"https://example.com", "https://example.com", true},
+		{"https://example.com", "https://example.com.evil.com", false},
+		{"https://*.example.com", "https://api.example.com", true},
+		{"https://*.example.com", "https://a.b.example.com", true},
+		{"https://*.example.com", "https://example.com", false},
+		{"https://*.example.com", "https://.example.com", false},
+		{"https://*.example.com", "https://evil.com/.example.com", false},
+		{"https://*.example.com", "https://example.com:8080.example.com", false},
+		{"https://*.example.com", "https://user@api.example.com", false},
+		{"https://*.example.com", "http://api.example.com", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.origin, func(t *testing.T) {
+			if got := matchOrigin(tt.pattern, tt.origin); got != tt.want {
+				t.Errorf("matchOrigin(%q, %q) = %t; want %t", tt.pattern, tt.origin, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEnableCORS(t *testing.T) {
+	tests := []struct {
+		name        string
+		trusted     []string
+		credentials bool
+		method      string
+		headers     map[string]string
+		want        map[string]string
+	}{
+		{
+			name:    "trusted origin",
+			trusted: []string{"https://example.com"},
+			method:  http.MethodGet,
+			headers: map[string]string{"Origin": "https://example.com"},
+			want:    map[string]string{"Access-Control-Allow-Origin": "https://example.com", "Access-Control-Allow-Credentials": ""},
+		},
+		{
+			name:    "untrusted origin",
+			trusted: []string{"https://example.com"},
+			method:  http.MethodGet,
+			headers: map[string]string{"Origin": "https://evil.com"},
+			want:    map[string]string{"Access-Control-Allow-Origin": ""},
+		},
+		{
+			name:    "wildcard subdomain",
+			trusted: []string{"https://*.example.com"},
+			method:  http.MethodGet,
+			headers: map[string]string{"Origin": "https://app.example.com"},
+			want:    map[string]string{"Access-Control-Allow-Origin": "https://app.example.com"},
+		},
+		{
+			name:    "any origin",
+			trusted: []string{"*"},
+			method:  http.MethodGet,
+			headers: map[string]string{"Origin": "https://anything.com"},
+			want:    map[string]string{"Access-Control-Allow-Origin": "*"},
+		},
+		{
+			name:        "credentials",
+			trusted:     []string{"https://example.com"},
+			credentials: true,
+			method:      http.MethodGet,
+			headers:     map[string]string{"Origin": "https://example.com"},
+			want:        map[string]string{"Access-Control-Allow-Credentials": "true"},
+		},
+		{
+			name:    "preflight",
+			trusted: []string{"https://example.com"},
+			method:  http.MethodOptions,
+			headers: map[string]string{
+				"Origin":                         "https://example.com",
+				"Access-Control-Request-Method":  "PATCH",
+				"Access-Control-Request-Headers": "Authorization, X-Unknown",
+			},
+			want: map[string]string{
+				"Access-Control-Allow-Methods": "GET, POST, PUT, PATCH, DELETE",
+				"Access-Control-Allow-Headers": "Authorization",
+				"Access-Control-Max-Age":       "3600",
+			},
+		},
+		{
+			name:    "preflight disallowed method",
+			trusted: []string{"https://example.com"},
+			method:  http.MethodOptions,
+			headers: map[string]string{
+				"Origin":                        "https://example.com",
+				"Access-Control-Request-Method": "TRACE",
+			},
+			want: map[string]string{"Access-Control-Allow-Methods": "", "Access-Control-Max-Age": ""},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t)
+			ts := newTestServer(t)
+
+			app.config.cors.trustedOrigins = tt.trusted
+			app.config.cors.allowCredentials = tt.credentials
+			app.config.cors.allowedMethods = []string{"GET", "POST", "PUT", "PATCH", "DELETE"}
+			app.config.cors.allowedHeaders = []string{"Authorization", "Content-Type", "X-Request-ID"}
+			app.config.cors.maxAge = time.Hour
+			app.live.Store(newDynamicConfig(app.config))
+
+			req, err := http.NewRequest(tt.method, ts.URL+"/v1/healthcheck", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for key, value := range tt.headers {
+				req.Header.Set(key, value)
+			}
+
+			res, err := ts.Client().Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+
+			for key, want := range tt.want {
+				if got := res.Header.Get(key); got != want {
+					t.Errorf("got %s header %q; want %q", key, got, want)
+				}
+			}
+
+			// Every response varies by origin, whether or not it's trusted.
+			if vary := res.Header.Values("Vary"); !containsFold(vary, "Origin") {
+				t.Errorf("got Vary headers %q; want Origin among them", vary)
+			}
+		})
+	}
+}
+
+func TestValidateCORSConfig(t *testing.T) {
+	tests := []struct {
+		name        string
+		trusted     []string
+		credentials bool
+		maxAge      time.Duration
+		wantErr     bool
+	}{
+		{"exact origins", []string{"https://example.com", "https://*.example.com"}, true, time.Hour, false},
+		{"any origin", []string{"*"}, false, 0, false},
+		{"any origin with credentials", []string{"*"}, true, 0, true},
+		{"two wildcards", []string{"https://*.*.example.com"}, false, 0, true},
+		{"negative max age", nil, false, -time.Second, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var cfg config
+			cfg.cors.trustedOrigins = tt.trusted
+			cfg.cors.allowCredentials = tt.credentials
+			cfg.cors.maxAge = tt.maxAge
+
+			err := validateCORSConfig(cfg)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("got error %v; want error %t", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"expvar"
+	"net/http"
+	"net/http/pprof"
+)
+
+// The debugRoutes() method returns the handler for the /debug/ endpoints: the expvar
+// metrics at /debug/vars, and the pprof profiles under /debug/pprof/ when
+// -debug-endpoints-enabled is set. Every endpoint requires debug access.
+//
+// go run ./cmd/api -debug-user=admin -debug-pass=pa55word -debug-endpoints-enabled
+func (app *application) debugRoutes() http.Handler {
+	mux := http.NewServeMux()
+
+	// Anything else under /debug/ (including pprof, when it's disabled) is a 404.
+	mux.HandleFunc("/debug/", app.notFoundResponse)
+
+	mux.Handle("/debug/vars", expvar.Handler())
+
+	if app.config.debug.endpointsEnabled {
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	}
+
+	return app.requireDebugAccess(mux)
+}
+
+// The requireDebugAccess() middleware allows requests which either carry the basic
+// auth credentials from -debug-user and -debug-pass, or are authenticated as a user
+// with the "users:admin" permission. Anything else gets the standard 401 response.
+func (app *application) requireDebugAccess(next http.Handler) http.Handler {
+	admin := app.authenticate(app.requirePermission("users:admin", next.ServeHTTP))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if app.config.debug.username != "" {
+			if username, password, ok := r.BasicAuth(); ok {
+				if !app.debugCredentialsMatch(username, password) {
+					w.Header().Set("WWW-Authenticate", `Basic realm="debug", charset="UTF-8"`)
+					app.invalidCredentialsResponse(w, r)
+					return
+				}
+
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+
+		admin.ServeHTTP(w, r)
+	})
+}
+
+// The debugCredentialsMatch() method checks basic auth credentials against the
+// configured ones. Hashing both sides first means the comparisons take the same time
+// whatever the lengths, and subtle.ConstantTimeCompare() means they don't leak how
+// much of a value matched.
+func (app *application) debugCredentialsMatch(username, password string) bool {
+	usernameHash := sha256.Sum256([]byte(username))
+	passwordHash := sha256.Sum256([]byte(password))
+	expectedUsernameHash := sha256.Sum256([]byte(app.config.debug.username))
+	expectedPasswordHash := sha256.Sum256([]byte(app.config.debug.password))
+
+	usernameMatch := subtle.ConstantTimeCompare(usernameHash[:], expectedUsernameHash[:]) == 1
+	passwordMatch := subtle.ConstantTimeCompare(passwordHash[:], expectedPasswordHash[:]) == 1
+
+	return usernameMatch && passwordMatch
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// The /debug/ endpoints are open to the basic auth credentials and to users with the
+// "users:admin" permission, and the pprof ones only exist when they're enabled.
+func TestDebugRoutes(t *testing.T) {
+	app := newTestApplication(t)
+	app.config.debug.username = "debug"
+	app.config.debug.password = "pa55word"
+
+	_, readerToken := newTestUser(t, app, "reader", "reader")
+	_, adminToken := newTestUser(t, app, "admin", "admin")
+
+	type credentials struct {
+		username, password, token string
+	}
+
+	var (
+		none      = credentials{}
+		basicAuth = credentials{username: "debug", password: "pa55word"}
+		wrongPass = credentials{username: "debug", password: "wrong"}
+		reader    = credentials{token: readerToken}
+		admin     = credentials{token: adminToken}
+	)
+
+	tests := []struct {
+		name     string
+		enabled  bool
+		path     string
+		creds    credentials
+		wantCode int
+	}{
+		{"vars anonymous", false, "/debug/vars", none, http.StatusUnauthorized},
+		{"vars basic auth", false, "/debug/vars", basicAuth, http.StatusOK},
+		{"vars wrong password", false, "/debug/vars", wrongPass, http.StatusUnauthorized},
+		{"vars reader", false, "/debug/vars", reader, http.StatusForbidden},
+		{"vars admin", false, "/debug/vars", admin, http.StatusOK},
+		{"pprof disabled anonymous", false, "/debug/pprof/", none, http.StatusUnauthorized},
+		{"pprof disabled basic auth", false, "/debug/pprof/", basicAuth, http.StatusNotFound},
+		{"pprof disabled admin", false, "/debug/pprof/cmdline", admin, http.StatusNotFound},
+		{"pprof enabled anonymous", true, "/debug/pprof/", none, http.StatusUnauthorized},
+		{"pprof enabled reader", true, "/debug/pprof/", reader, http.StatusForbidden},
+		{"pprof enabled basic auth", true, "/debug/pprof/", basicAuth, http.StatusOK},
+		{"pprof enabled admin", true, "/debug/pprof/cmdline", admin, http.StatusOK},
+		{"pprof enabled wrong password", true, "/debug/pprof/cmdline", wrongPass, http.StatusUnauthorized},
+		{"vars with pprof enabled", true, "/debug/vars", basicAuth, http.StatusOK},
+		{"unknown", true, "/debug/nothing", admin, http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The pprof endpoints are registered when debugRoutes() is called, so it's
+			// called again for each test with the setting in place.
+			app.config.debug.endpointsEnabled = tt.enabled
+			handler := app.debugRoutes()
+
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.creds.username != "" {
+				req.SetBasicAuth(tt.creds.username, tt.creds.password)
+			}
+			if tt.creds.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.creds.token)
+			}
+
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+
+			if w.Code != tt.wantCode {
+				t.Fatalf("got status %d; want %d (body %s)", w.Code, tt.wantCode, w.Body)
+			}
+
+			if tt.creds == wrongPass && w.Header().Get("WWW-Authenticate") == "" {
+				t.Error("got no WWW-Authenticate header for the wrong password")
+			}
+
+			if tt.path == "/debug/vars" && w.Code == http.StatusOK {
+				var vars map[string]interface{}
+
+				err := json.NewDecoder(w.Body).Decode(&vars)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if vars["memstats"] == nil || vars["total_requests_received"] == nil {
+					t.Error("got vars without the memstats or our own metrics")
+				}
+			}
+		})
+	}
+
+	// Without -debug-user set, basic auth isn't accepted at all.
+	app.config.debug.username, app.config.debug.password = "", ""
+
+	req := httptest.NewRequest(http.MethodGet, "/debug/vars", nil)
+	req.SetBasicAuth("", "")
+
+	w := httptest.NewRecorder()
+	app.debugRoutes().ServeHTTP(w, req)
+
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("got status %d for basic auth with no credentials configured; want 401", w.Code)
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/petrostrak/an-open-movie-database/internal/data"
+	"github.com/petrostrak/an-open-movie-database/internal/validator"
+)
+
+// The number of subscribers the digest is sent to at a time, and the most new movies
+// listed in a digest.
+const (
+	digestBatchSize = 100
+	digestMaxMovies = 50
+)
+
+// Define a digestSubscription struct to hold a user's daily digest settings, as set and
+// returned by PUT /v1/me/digest.
+type digestSubscription struct {
+	Enabled bool     `json:"enabled"`
+	Genres  []string `json:"genres"`
+}
+
+// The updateDigestHandler() handler for the "PUT /v1/me/digest" endpoint subscribes the
+// authenticated user to the daily digest of new movies, or unsubscribes them, with a
+// body such as {"enabled": true, "genres": ["drama", "comedy"]}. The genres limit the
+// digest to movies with at least one of them; without any, every new movie is listed.
+// As it's a PUT, the genres are replaced rather than added to.
+func (app *application) updateDigestHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Enabled *bool    `json:"enabled"`
+		Genres  []string `json:"genres"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	if input.Genres == nil {
+		input.Genres = []string{}
+	}
+
+	preferences := &data.Preferences{Digest: input.Enabled, DigestGenres: &input.Genres}
+
+	v := validator.New()
+
+	v.Check(input.Enabled != nil, "enabled", validator.Msg("required"))
+
+	if data.ValidatePreferences(v, preferences); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	_, err = app.models.Preferences.Update(user.ID, preferences)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	env := envelope{"digest": digestSubscription{Enabled: *input.Enabled, Genres: input.Genres}}
+
+	err = app.writeResponse(w, r, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The lastDigestRun() function returns the most recent time, at or before now, that
+// the digest was due to be sent: the start of the given hour in UTC, today or
+// yesterday.
+func lastDigestRun(now time.Time, hour int) time.Time {
+	now = now.UTC()
+
+	due := time.Date(now.Year(), now.Month(), now.Day(), hour, 0, 0, 0, time.UTC)
+	if due.After(now) {
+		due = due.AddDate(0, 0, -1)
+	}
+
+	return due
+}
+
+// The startDigestScheduler() helper starts a background goroutine which sends the
+// daily digest at cfg.digest.hour, until the context is cancelled. It's tracked by the
+// WaitGroup, so graceful shutdown waits for a digest that's being queued.
+func (app *application) startDigestScheduler(ctx context.Context) {
+	app.workers.register(workerDigestScheduler, 1, 24*time.Hour, nil)
+	app.wg.Add(1)
+
+	go func() {
+		defer app.wg.Done()
+
+		app.runDigestScheduler(ctx, time.Now, time.After)
+	}()
+}
+
+// The runDigestScheduler() helper sends the digest which was last due straight away,
+// in case it was missed while the API wasn't running, and then each time the next one
+// is due, until the context is cancelled. The now and after functions are time.Now()
+// and time.After() outside of the tests, which replace them with a fake clock.
+func (app *application) runDigestScheduler(ctx context.Context, now func() time.Time, after func(time.Duration) <-chan time.Time) {
+	for {
+		t := now()
+
+		queued, err := app.sendDigests(ctx, t)
+		if err != nil {
+			app.logger.PrintError(err, nil)
+		} else {
+			app.logger.PrintInfo("digest emails queued", map[string]string{
+				"count": strconv.Itoa(queued),
+			})
+		}
+
+		app.workers.beat(workerDigestScheduler, 0)
+
+		next := lastDigestRun(t, app.config.digest.hour).Add(24 * time.Hour)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-after(next.Sub(t)):
+		}
+	}
+}
+
+// The sendDigests() helper queues the digest which was last due at the given time for
+// each subscriber who hasn't had it yet, listing the movies created in the 24 hours up
+// to when it was due. Subscribers with no new movies in their genres are skipped. It
+// returns the number of emails queued.
+//
+// Only one instance of the API sends the digest at a time: the others find the
+// advisory lock taken, and queue nothing. The time each user was last sent the digest
+// is recorded with their email, so that an instance which takes the lock later, or
+// after a restart, doesn't send it again.
+func (app *application) sendDigests(ctx context.Context, now time.Time) (int, error) {
+	release, acquired, err := app.models.Locks.TryLock(ctx, data.LockDigest)
+	if err != nil {
+		return 0, err
+	}
+
+	if !acquired {
+		app.logger.PrintInfo("digest is being sent by another instance", nil)
+		return 0, nil
+	}
+	defer release()
+
+	due := lastDigestRun(now, app.config.digest.hour)
+	since := due.Add(-24 * time.Hour)
+
+	var queued int
+	var afterUserID int64
+
+	for ctx.Err() == nil {
+		subscribers, err := app.models.Digests.GetSubscribers(due, afterUserID, digestBatchSize)
+		if err != nil {
+			return queued, err
+		}
+
+		for _, subscriber := range subscribers {
+			movies, err := app.models.Digests.GetNewMovies(since, due, subscriber.Genres, digestMaxMovies)
+			if err != nil {
+				return queued, err
+			}
+
+			if len(movies) == 0 {
+				continue
+			}
+
+			payloadMovies := make([]map[string]interface{}, len(movies))
+			for i, movie := range movies {
+				payloadMovies[i] = map[string]interface{}{
+					"id":     movie.ID,
+					"title":  movie.Title,
+					"year":   movie.Year,
+					"genres": strings.Join(movie.Genres, ", "),
+				}
+			}
+
+			sent := false
+
+			// Record the digest as sent and queue the email together, so that neither
+			// happens without the other.
+			err = app.models.WithTx(ctx, func(m data.Models) error {
+				claimed, err := m.Digests.ClaimSent(subscriber.UserID, due, now)
+				if err != nil || !claimed {
+					return err
+				}
+
+				sent = true
+
+				return m.EmailJobs.Insert(&data.EmailJob{
+					Recipient: subscriber.Email,
+					Locale:    subscriber.Locale,
+					Template:  "new_movies_digest.tmpl",
+					Payload: map[string]interface{}{
+						"name":   subscriber.Name,
+						"count":  len(movies),
+						"movies": payloadMovies,
+					},
+				})
+			})
+			if err != nil {
+				return queued, err
+			}
+
+			if sent {
+				queued++
+			}
+		}
+
+		app.outbox.notify()
+
+		if len(subscribers) < digestBatchSize {
+			break
+		}
+
+		afterUserID = subscribers[len(subscribers)-1].UserID
+	}
+
+	return queued, ctx.Err()
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/petrostrak/an-open-movie-database/internal/data"
+)
+
+func TestUpdateDigestHandler(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t)
+
+	user, token := newTestUser(t, app, "alice", "reader")
+
+	tests := []struct {
+		name      string
+		token     string
+		body      map[string]interface{}
+		wantCode  int
+		wantError string
+	}{
+		{"anonymous", "", map[string]interface{}{"enabled": true}, http.StatusUnauthorized, ""},
+		{"missing enabled", token, map[string]interface{}{"genres": []string{"drama"}}, http.StatusUnprocessableEntity, "enabled"},
+		{"empty genre", token, map[string]interface{}{"enabled": true, "genres": []string{"drama", " "}}, http.StatusUnprocessableEntity, "genres[1]"},
+		{"duplicate genres", token, map[string]interface{}{"enabled": true, "genres": []string{"drama", "Drama"}}, http.StatusUnprocessableEntity, "genres"},
+		{"subscribe", token, map[string]interface{}{"enabled": true, "genres": []string{"drama", "comedy"}}, http.StatusOK, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, body := ts.do(t, http.MethodPut, "/v1/me/digest", tt.token, tt.body)
+			if code != tt.wantCode {
+				t.Fatalf("got status %d and body %v; want %d", code, body, tt.wantCode)
+			}
+
+			if details, _ := body["details"].(map[string]interface{}); tt.wantError != "" && details[tt.wantError] == nil {
+				t.Errorf("got body %v; want an error for %s", body, tt.wantError)
+			}
+		})
+	}
+
+	preferences, err := app.models.Preferences.Get(user.ID)
+	if err != nil || preferences.Digest == nil || !*preferences.Digest || fmt.Sprint(*preferences.DigestGenres) != "[drama comedy]" {
+		t.Fatalf("got preferences %+v and error %v; want the subscription stored", preferences, err)
+	}
+
+	// The genres are replaced, so leaving them out means every genre.
+	code, body := ts.do(t, http.MethodPut, "/v1/me/digest", token, map[string]interface{}{"enabled": false})
+	if got := fmt.Sprint(body["digest"]); code != http.StatusOK || got != "map[enabled:false genres:[]]" {
+		t.Errorf("got status %d and digest %s; want it turned off for every genre", code, got)
+	}
+}
+
+func TestLastDigestRun(t *testing.T) {
+	tests := []struct {
+		name string
+		now  time.Time
+		want time.Time
+	}{
+		{"after the hour", time.Date(2026, 10, 16, 12, 30, 0, 0, time.UTC), time.Date(2026, 10, 16, 8, 0, 0, 0, time.UTC)},
+		{"on the hour", time.Date(2026, 10, 16, 8, 0, 0, 0, time.UTC), time.Date(2026, 10, 16, 8, 0, 0, 0, time.UTC)},
+		{"before the hour", time.Date(2026, 10, 16, 7, 59, 0, 0, time.UTC), time.Date(2026, 10, 15, 8, 0, 0, 0, time.UTC)},
+		{"another time zone", time.Date(2026, 10, 16, 10, 30, 0, 0, time.FixedZone("EEST", 3*60*60)), time.Date(2026, 10, 15, 8, 0, 0, 0, time.UTC)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := lastDigestRun(tt.now, 8); !got.Equal(tt.want) {
+				t.Errorf("got %s; want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+// The newDigestTestApplication() helper returns a test application with the fake
+// mailer, subscribers alice (to dramas), bob (to every genre) and carol (to horror),
+// dave who doesn't subscribe, and two new movies. The digest is due on the hour after
+// the current one, so that the movies fall in the day before it.
+func newDigestTestApplication(t *testing.T, mailer *fakeMailer) (*application, time.Time) {
+	t.Helper()
+
+	app := newOutboxTestApplication(t, mailer, 0)
+
+	on := true
+	subscriptions := map[string][]string{"alice": {"Drama"}, "bob": {}, "carol": {"horror"}, "dave": nil}
+
+	for name, genres := range subscriptions {
+		user, _ := newTestUser(t, app, name, "reader")
+
+		if genres == nil {
+			continue
+		}
+
+		_, err := app.models.Preferences.Update(user.ID, &data.Preferences{Digest: &on, DigestGenres: &genres})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, movie := range []*data.Movie{
+		{Title: "Moana", Year: 2016, Runtime: 107, Genres: []string{"animation"}},
+		{Title: "Black Panther", Year: 2018, Runtime: 134, Genres: []string{"sci-fi", "drama"}},
+	} {
+		err := app.models.Movies.Insert(movie)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	now := time.Now().Add(time.Hour).UTC()
+	app.config.digest.hour = now.Hour()
+
+	return app, now
+}
+
+func TestSendDigests(t *testing.T) {
+	mailer := &fakeMailer{}
+	app, now := newDigestTestApplication(t, mailer)
+
+	ctx := context.Background()
+
+	queued, err := app.sendDigests(ctx, now)
+	if err != nil || queued != 2 {
+		t.Fatalf("got %d emails queued and error %v; want 2", queued, err)
+	}
+
+	// After a restart, the digest which is due has already been sent.
+	queued, err = app.sendDigests(ctx, now)
+	if err != nil || queued != 0 {
+		t.Errorf("got %d emails queued and error %v after a restart; want none", queued, err)
+	}
+
+	runOutbox(t, app, func() bool {
+		return emailJobCount(t, app, data.EmailJobSent) == 2
+	})
+
+	sent := append([]string{}, mailer.sent...)
+	sort.Strings(sent)
+
+	if got := fmt.Sprint(sent); got != "[alice@example.com bob@example.com]" {
+		t.Fatalf("got digests sent to %s; want alice and bob", got)
+	}
+
+	for i, recipient := range mailer.sent {
+		payload, _ := mailer.data[i].(map[string]interface{})
+		movies := fmt.Sprint(payload["movies"])
+
+		want := map[string]int{"alice@example.com": 1, "bob@example.com": 2}[recipient]
+		if fmt.Sprint(payload["count"]) != fmt.Sprint(want) || strings.Contains(movies, "Moana") != (want == 2) || !strings.Contains(movies, "Black Panther") {
+			t.Errorf("got payload %v for %s; want %d movies", payload, recipient, want)
+		}
+	}
+
+	// The next day there's nothing new, so nobody is sent a digest.
+	queued, err = app.sendDigests(ctx, now.Add(24*time.Hour))
+	if err != nil || queued != 0 {
+		t.Errorf("got %d emails queued and error %v the next day; want none", queued, err)
+	}
+}
+
+// While another instance holds the lock, the digest isn't sent, and it's sent by the
+// next run once the lock is released.
+func TestSendDigestsLeaderElection(t *testing.T) {
+	app, now := newDigestTestApplication(t, &fakeMailer{})
+
+	ctx := context.Background()
+
+	release, acquired, err := app.models.Locks.TryLock(ctx, data.LockDigest)
+	if err != nil || !acquired {
+		t.Fatalf("got %t and error %v; want the lock", acquired, err)
+	}
+
+	queued, err := app.sendDigests(ctx, now)
+	if err != nil || queued != 0 {
+		t.Errorf("got %d emails queued and error %v with the lock held; want none", queued, err)
+	}
+
+	release()
+
+	queued, err = app.sendDigests(ctx, now)
+	if err != nil || queued != 2 {
+		t.Errorf("got %d emails queued and error %v once the lock was released; want 2", queued, err)
+	}
+}
+
+// The scheduler sends the digest which is due when it starts, and then sleeps until
+// the same hour each day, on a fake clock.
+func TestDigestScheduler(t *testing.T) {
+	app, start := newDigestTestApplication(t, &fakeMailer{})
+
+	var mu sync.Mutex
+	clock := start
+
+	now := func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+
+		return clock
+	}
+
+	sleeps := make(chan time.Duration)
+	wake := make(chan time.Time)
+
+	after := func(d time.Duration) <-chan time.Time {
+		sleeps <- d
+		return wake
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		app.runDigestScheduler(ctx, now, after)
+	}()
+
+	next := lastDigestRun(start, app.config.digest.hour).Add(24 * time.Hour)
+
+	if got := <-sleeps; got != next.Sub(start) {
+		t.Errorf("got a first sleep of %s; want %s", got, next.Sub(start))
+	}
+
+	if got := emailJobCount(t, app, data.EmailJobPending); got != 2 {
+		t.Errorf("got %d digests queued at startup; want 2", got)
+	}
+
+	mu.Lock()
+	clock = next
+	mu.Unlock()
+	wake <- next
+
+	if got := <-sleeps; got != 24*time.Hour {
+		t.Errorf("got a second sleep of %s; want 24h", got)
+	}
+
+	cancel()
+	<-done
+
+	if got := emailJobCount(t, app, data.EmailJobPending); got != 2 {
+		t.Errorf("got %d digests queued after the second day; want still 2", got)
+	}
+}
@@ -0,0 +1,473 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/petrostrak/an-open-movie-database/internal/data"
+	"github.com/petrostrak/an-open-movie-database/internal/validator"
+)
+
+// The version of the database dump format, the number of movies read from the
+// database at a time while exporting, and the limit on the size of an import once it's
+// decompressed.
+const (
+	dumpVersion    = 1
+	dumpBatchSize  = 500
+	maxImportBytes = 1 << 30
+)
+
+// The ways an import can handle a movie which is already in the database: leave it as
+// it is, or replace it with the one in the dump.
+const (
+	importModeSkip      = "skip"
+	importModeOverwrite = "overwrite"
+)
+
+// Define a dumpMovie struct to hold a movie in a database dump. Movies are identified
+// by their title and year rather than their ID, so that a dump can be imported into
+// another database.
+type dumpMovie struct {
+	Title           string               `json:"title"`
+	Year            int32                `json:"year"`
+	Runtime         data.Runtime         `json:"runtime"`
+	Genres          []string             `json:"genres"`
+	Awards          data.Awards          `json:"awards"`
+	ExternalRatings data.ExternalRatings `json:"external_ratings"`
+	Plot            string               `json:"plot,omitempty"`
+	Poster          string               `json:"poster,omitempty"`
+}
+
+// Define an invalidDumpError type for a dump which can't be read, as opposed to an
+// error importing one of its movies. Handlers send it to badRequestResponse().
+type invalidDumpError struct {
+	err error
+}
+
+func (e invalidDumpError) Error() string {
+	return "invalid dump: " + e.err.Error()
+}
+
+func (e invalidDumpError) Unwrap() error {
+	return e.err
+}
+
+// Define a dumpWriter type which writes a database dump a movie at a time, so that the
+// memory used doesn't grow with the size of the catalog. The dump is a JSON object:
+//
+//	{"version": 1, "exported_at": "...", "movies": [{...}, {...}]}
+type dumpWriter struct {
+	w     io.Writer
+	enc   *json.Encoder
+	count int
+}
+
+// The newDumpWriter() function writes the start of a dump to w, and returns a
+// dumpWriter to write its movies.
+func newDumpWriter(w io.Writer, exportedAt time.Time) (*dumpWriter, error) {
+	_, err := fmt.Fprintf(w, `{"version":%d,"exported_at":%q,"movies":[`, dumpVersion, exportedAt.UTC().Format(time.RFC3339))
+	if err != nil {
+		return nil, err
+	}
+
+	return &dumpWriter{w: w, enc: json.NewEncoder(w)}, nil
+}
+
+// The writeMovie() method adds a movie to the dump.
+func (d *dumpWriter) writeMovie(movie dumpMovie) error {
+	if d.count > 0 {
+		if _, err := io.WriteString(d.w, ","); err != nil {
+			return err
+		}
+	}
+
+	d.count++
+
+	return d.enc.Encode(movie)
+}
+
+// The close() method writes the end of the dump.
+func (d *dumpWriter) close() error {
+	_, err := io.WriteString(d.w, "]}\n")
+	return err
+}
+
+// The readDump() function reads a dump written by dumpWriter a movie at a time, calling
+// fn with each movie and its index. The version has to come before the movies, so that
+// a dump in another format is rejected before any of it is imported. Errors reading the
+// dump are returned as an invalidDumpError, and errors from fn as they are.
+func readDump(r io.Reader, fn func(i int, movie dumpMovie) error) error {
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+
+	invalid := func(err error) error {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+
+		if isCorruptGzip(err) {
+			err = errCorruptGzip
+		}
+
+		return invalidDumpError{err}
+	}
+
+	if err := expectDelim(dec, '{'); err != nil {
+		return invalid(err)
+	}
+
+	version := 0
+
+	for dec.More() {
+		token, err := dec.Token()
+		if err != nil {
+			return invalid(err)
+		}
+
+		switch key, _ := token.(string); key {
+		case "version":
+			err = dec.Decode(&version)
+			if err != nil {
+				return invalid(err)
+			}
+
+			if version != dumpVersion {
+				return invalid(fmt.Errorf("version %d is not supported, only version %d", version, dumpVersion))
+			}
+		case "exported_at":
+			var exportedAt time.Time
+
+			err = dec.Decode(&exportedAt)
+			if err != nil {
+				return invalid(err)
+			}
+		case "movies":
+			if version == 0 {
+				return invalid(errors.New("version must come before the movies"))
+			}
+
+			if err := expectDelim(dec, '['); err != nil {
+				return invalid(err)
+			}
+
+			for i := 0; dec.More(); i++ {
+				var movie dumpMovie
+
+				err = dec.Decode(&movie)
+				if err != nil {
+					return invalid(fmt.Errorf("movies[%d]: %w", i, err))
+				}
+
+				err = fn(i, movie)
+				if err != nil {
+					return err
+				}
+			}
+
+			if err := expectDelim(dec, ']'); err != nil {
+				return invalid(err)
+			}
+		default:
+			return invalid(fmt.Errorf("unknown key %q", key))
+		}
+	}
+
+	if err := expectDelim(dec, '}'); err != nil {
+		return invalid(err)
+	}
+
+	if version == 0 {
+		return invalid(errors.New("version must be provided"))
+	}
+
+	return nil
+}
+
+// The expectDelim() helper reads the next token, and returns an error if it isn't the
+// given delimiter.
+func expectDelim(dec *json.Decoder, delim json.Delim) error {
+	token, err := dec.Token()
+	if err != nil {
+		return err
+	}
+
+	if token != delim {
+		return fmt.Errorf("expected %q, found %v", delim, token)
+	}
+
+	return nil
+}
+
+// The exportDatabaseHandler() handler for the "GET /v1/admin/export" endpoint streams
+// a dump of the catalog, for backups and for seeding other environments. Users and
+// their tokens aren't included. The dump is gzipped if the client accepts it.
+//
+// Once the first movies have been written the status can't be changed, so an error
+// after that cuts the dump short. It's then not valid JSON, and can't be imported.
+//
+// With ?format=ndjson, or an Accept header asking for application/x-ndjson, the movies
+// are sent as NDJSON instead, one per line without the version and exported_at, for
+// pipelines to consume. The number of movies is sent in the X-Total-Records trailer,
+// as it isn't known until the end, and an error part way through is sent as a final
+// line with an "error" field. An NDJSON export can't be imported.
+func (app *application) exportDatabaseHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+
+	ndjson := app.readNDJSON(r, r.URL.Query(), v)
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	if !app.dumpMu.TryLock() {
+		app.jobConflictResponse(w, r, "the database is already being exported or imported", nil)
+		return
+	}
+	defer app.dumpMu.Unlock()
+
+	// Read the first batch before sending the status, so that an error reaching the
+	// database gets the usual 500 response.
+	movies, err := app.models.Movies.GetBatch(0, dumpBatchSize)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	exportedAt := time.Now()
+
+	contentType, extension := "application/json", "json"
+	if ndjson {
+		contentType, extension = ndjsonMediaType, "ndjson"
+		w.Header().Set("Trailer", "X-Total-Records")
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="omdb-%s.%s"`, exportedAt.UTC().Format("20060102T150405Z"), extension))
+	w.Header().Add("Vary", "Accept")
+	w.Header().Add("Vary", "Accept-Encoding")
+
+	var out io.Writer = w
+	flush := flusher(w)
+
+	if acceptsGzip(r.Header.Get("Accept-Encoding")) {
+		w.Header().Set("Content-Encoding", "gzip")
+
+		zw := gzip.NewWriter(w)
+		defer zw.Close()
+
+		out = zw
+
+		// Flush what's been compressed so far before flushing the response.
+		flushResponse := flush
+		flush = func() {
+			zw.Flush()
+			flushResponse()
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+
+	var count int
+
+	if ndjson {
+		nw := newNDJSONWriter(out, flush)
+
+		err = app.eachDumpMovie(movies, func(movie dumpMovie) error {
+			count++
+			return nw.write(movie)
+		})
+		if err != nil {
+			app.ndjsonError(r, nw, err)
+			return
+		}
+
+		w.Header().Set("X-Total-Records", strconv.Itoa(count))
+	} else {
+		count, err = app.writeDump(out, exportedAt, movies)
+		if err != nil {
+			app.logError(r, err)
+			return
+		}
+	}
+
+	app.recordAudit(r, data.AuditEntry{
+		Action:       "database.export",
+		ResourceType: "database",
+		Metadata:     map[string]interface{}{"movies": count},
+	})
+}
+
+// The writeDump() helper writes a dump of every movie to w, starting with the batch
+// which has already been read, and returns how many there were.
+func (app *application) writeDump(w io.Writer, exportedAt time.Time, movies []*data.Movie) (int, error) {
+	dw, err := newDumpWriter(w, exportedAt)
+	if err != nil {
+		return 0, err
+	}
+
+	err = app.eachDumpMovie(movies, dw.writeMovie)
+	if err != nil {
+		return 0, err
+	}
+
+	return dw.count, dw.close()
+}
+
+// The eachDumpMovie() helper calls fn with every movie in turn, as it's written to a
+// dump, starting with the batch which has already been read and then reading the rest
+// dumpBatchSize at a time.
+func (app *application) eachDumpMovie(movies []*data.Movie, fn func(movie dumpMovie) error) error {
+	for {
+		for _, movie := range movies {
+			err := fn(dumpMovie{
+				Title:           movie.Title,
+				Year:            movie.Year,
+				Runtime:         movie.Runtime,
+				Genres:          movie.Genres,
+				Awards:          movie.Awards,
+				ExternalRatings: movie.ExternalRatings,
+				Plot:            movie.Plot,
+				Poster:          movie.Poster,
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		if len(movies) < dumpBatchSize {
+			return nil
+		}
+
+		var err error
+
+		movies, err = app.models.Movies.GetBatch(movies[len(movies)-1].ID, dumpBatchSize)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Define the error returned by the import transaction when a movie in the dump is
+// invalid, so that nothing is imported.
+var errInvalidImport = errors.New("the dump contains invalid movies")
+
+// The importDatabaseHandler() handler for the "POST /v1/admin/import" endpoint loads a
+// dump written by exportDatabaseHandler, in a single transaction so that a dump is
+// imported in full or not at all. A movie with the same title and year as one in the
+// database is skipped, or with ?mode=overwrite replaces it. Imported movies are
+// attributed to the admin importing them.
+func (app *application) importDatabaseHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+
+	mode := app.readString(r.URL.Query(), "mode", importModeSkip)
+	v.Check(validator.In(mode, importModeSkip, importModeOverwrite), "mode", validator.Msg("import_mode"))
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	if !app.dumpMu.TryLock() {
+		app.jobConflictResponse(w, r, "the database is already being exported or imported", nil)
+		return
+	}
+	defer app.dumpMu.Unlock()
+
+	err := app.limitBody(w, r, maxImportBytes)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	user := app.contextGetUser(r)
+	created, updated, skipped := 0, 0, 0
+
+	err = app.models.WithTx(r.Context(), func(m data.Models) error {
+		err := readDump(r.Body, func(i int, input dumpMovie) error {
+			movie := &data.Movie{
+				Title:           input.Title,
+				Year:            input.Year,
+				Runtime:         input.Runtime,
+				Genres:          input.Genres,
+				Awards:          input.Awards,
+				ExternalRatings: input.ExternalRatings,
+				Plot:            input.Plot,
+				Poster:          input.Poster,
+			}
+
+			// Check every movie, so that all the problems with a dump are reported
+			// at once, but don't write the invalid ones.
+			if data.ValidateMovie(v.Child(fmt.Sprintf("movies[%d]", i)), movie); !v.Valid() {
+				return nil
+			}
+
+			existing, err := m.Movies.GetByTitleYear(movie.Title, movie.Year)
+
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				movie.CreatedBy = &data.UserRef{ID: user.ID, Name: user.Name}
+				created++
+
+				return m.Movies.Insert(movie)
+			case err != nil:
+				return err
+			case mode == importModeSkip:
+				skipped++
+
+				return nil
+			default:
+				existing.Runtime = movie.Runtime
+				existing.Genres = movie.Genres
+				existing.Awards = movie.Awards
+				existing.ExternalRatings = movie.ExternalRatings
+				existing.Plot = movie.Plot
+				existing.Poster = movie.Poster
+				existing.UpdatedBy = &data.UserRef{ID: user.ID, Name: user.Name}
+				updated++
+
+				return m.Movies.Update(existing)
+			}
+		})
+		if err != nil {
+			return err
+		}
+
+		if !v.Valid() {
+			return errInvalidImport
+		}
+
+		return nil
+	})
+
+	var dumpErr invalidDumpError
+
+	switch {
+	case errors.Is(err, errInvalidImport):
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	case errors.As(err, &dumpErr):
+		app.badRequestResponse(w, r, err)
+		return
+	case err != nil:
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.recordAudit(r, data.AuditEntry{
+		Action:       "database.import",
+		ResourceType: "database",
+		Metadata:     map[string]interface{}{"mode": mode, "created": created, "updated": updated, "skipped": skipped},
+	})
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"import": envelope{"created": created, "updated": updated, "skipped": skipped}}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/petrostrak/an-open-movie-database/internal/data"
+)
+
+// The exportDump() helper downloads a database dump, asking for it gzipped if gzipped
+// is true, and returns it decompressed.
+func exportDump(t *testing.T, ts *testServer, token string, gzipped bool) []byte {
+	t.Helper()
+
+	req, err := http.NewRequest(http.MethodGet, ts.URL+"/v1/admin/export", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	// Setting Accept-Encoding stops the client from decompressing the response itself.
+	req.Header.Set("Accept-Encoding", "identity")
+	if gzipped {
+		req.Header.Set("Accept-Encoding", "gzip")
+	}
+
+	res, err := ts.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d; want %d", res.StatusCode, http.StatusOK)
+	}
+
+	if got := res.Header.Get("Content-Encoding") == "gzip"; got != gzipped {
+		t.Fatalf("got Content-Encoding %q; want gzipped to be %t", res.Header.Get("Content-Encoding"), gzipped)
+	}
+
+	var body io.Reader = res.Body
+	if gzipped {
+		body, err = gzip.NewReader(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dump, err := io.ReadAll(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return dump
+}
+
+// The dumpedMovies() helper returns the movies in a dump.
+func dumpedMovies(t *testing.T, dump []byte) []interface{} {
+	t.Helper()
+
+	var decoded map[string]interface{}
+
+	err := json.Unmarshal(dump, &decoded)
+	if err != nil {
+		t.Fatalf("dump isn't valid JSON: %v", err)
+	}
+
+	movies, _ := decoded["movies"].([]interface{})
+
+	return movies
+}
+
+// A dump imported into an empty database gives back the same catalog.
+func TestDatabaseExportImport(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t)
+
+	_, editorToken := newTestUser(t, app, "editor", "editor")
+	admin, adminToken := newTestUser(t, app, "admin", "admin")
+
+	// More than a batch, so that the export has to read the movies in batches.
+	ids := seedMovies(t, app, dumpBatchSize+2)
+
+	awarded := &data.Movie{
+		Title: "Moana", Year: 2016, Runtime: 107, Genres: []string{"animation", "adventure"},
+		Awards:          data.Awards{{Name: "Annie Awards", Category: "Best Music", Year: 2017, Won: true}},
+		ExternalRatings: data.ExternalRatings{{Source: "IMDb", Score: 7.6, Scale: 10}},
+	}
+
+	err := app.models.Movies.Insert(awarded)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ids = append(ids, awarded.ID)
+
+	code, _ := ts.do(t, http.MethodGet, "/v1/admin/export", editorToken, nil)
+	if code != http.StatusForbidden {
+		t.Errorf("got status %d exporting as an editor; want %d", code, http.StatusForbidden)
+	}
+
+	dump := exportDump(t, ts, adminToken, false)
+
+	if gzipped := exportDump(t, ts, adminToken, true); !reflect.DeepEqual(dumpedMovies(t, gzipped), dumpedMovies(t, dump)) {
+		t.Error("the gzipped dump has different movies")
+	}
+
+	movies := dumpedMovies(t, dump)
+	if len(movies) != len(ids) {
+		t.Fatalf("got %d movies in the dump; want %d", len(movies), len(ids))
+	}
+
+	for _, id := range ids {
+		_, err := app.models.Movies.Delete(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	code, body := ts.do(t, http.MethodPost, "/v1/admin/import", adminToken, dump)
+	if result, _ := body["import"].(map[string]interface{}); code != http.StatusOK || result["created"] != float64(len(ids)) {
+		t.Fatalf("got status %d and body %v; want %d movies created", code, body, len(ids))
+	}
+
+	if got := dumpedMovies(t, exportDump(t, ts, adminToken, false)); !reflect.DeepEqual(got, movies) {
+		t.Errorf("got movies %v after the round trip; want %v", got[len(got)-1], movies[len(movies)-1])
+	}
+
+	imported, err := app.models.Movies.GetByTitleYear("Moana", 2016)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if movie, err := app.models.Movies.Get(imported.ID); err != nil || movie.CreatedBy == nil || movie.CreatedBy.ID != admin.ID {
+		t.Errorf("got movie %+v and error %v; want it created by the admin", movie, err)
+	}
+
+	// Importing the dump again skips every movie, unless they're overwritten.
+	code, body = ts.do(t, http.MethodPost, "/v1/admin/import", adminToken, dump)
+	if result, _ := body["import"].(map[string]interface{}); code != http.StatusOK || result["skipped"] != float64(len(ids)) {
+		t.Errorf("got status %d and body %v; want %d movies skipped", code, body, len(ids))
+	}
+
+	changed := bytes.Replace(dump, []byte(`"runtime":"107 mins"`), []byte(`"runtime":"108 mins"`), 1)
+
+	code, body = ts.do(t, http.MethodPost, "/v1/admin/import?mode=overwrite", adminToken, changed)
+	if result, _ := body["import"].(map[string]interface{}); code != http.StatusOK || result["updated"] != float64(len(ids)) {
+		t.Errorf("got status %d and body %v; want %d movies updated", code, body, len(ids))
+	}
+
+	if movie, err := app.models.Movies.Get(imported.ID); err != nil || movie.Runtime != 108 || movie.Version != 2 {
+		t.Errorf("got movie %+v and error %v; want it overwritten", movie, err)
+	}
+}
+
+// A dump which can't be read, or has an invalid movie in it, isn't imported at all.
+func TestDatabaseImportErrors(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t)
+
+	_, adminToken := newTestUser(t, app, "admin", "admin")
+
+	valid := `{"title": "Moana", "year": 2016, "runtime": "107 mins", "genres": ["animation"]}`
+
+	tests := []struct {
+		name     string
+		query    string
+		body     string
+		wantCode int
+		wantKey  string
+	}{
+		{"bad mode", "?mode=replace", `{"version": 1, "movies": []}`, http.StatusUnprocessableEntity, "mode"},
+		{"not JSON", "", `movies`, http.StatusBadRequest, ""},
+		{"truncated", "", `{"version": 1, "movies": [` + valid, http.StatusBadRequest, ""},
+		{"no version", "", `{"movies": [` + valid + `]}`, http.StatusBadRequest, ""},
+		{"other version", "", `{"version": 2, "movies": [` + valid + `]}`, http.StatusBadRequest, ""},
+		{"unknown key", "", `{"version": 1, "users": []}`, http.StatusBadRequest, ""},
+		{"unknown field", "", `{"version": 1, "movies": [{"title": "Moana", "director": "Musker"}]}`, http.StatusBadRequest, ""},
+		{"invalid movie", "", `{"version": 1, "movies": [` + valid + `, {"title": "", "year": 2016, "runtime": 90, "genres": ["drama"]}]}`, http.StatusUnprocessableEntity, "movies[1].title"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, body := ts.do(t, http.MethodPost, "/v1/admin/import"+tt.query, adminToken, []byte(tt.body))
+			if code != tt.wantCode {
+				t.Errorf("got status %d; want %d (body %v)", code, tt.wantCode, body)
+			}
+
+			if details, _ := body["details"].(map[string]interface{}); tt.wantKey != "" && details[tt.wantKey] == nil {
+				t.Errorf("got details %v; want an error for %q", details, tt.wantKey)
+			}
+		})
+	}
+
+	// The valid movie before the invalid one was rolled back.
+	if _, err := app.models.Movies.GetByTitleYear("Moana", 2016); err == nil {
+		t.Error("got the valid movie from the invalid dump; want nothing imported")
+	}
+}
+
+// Only one export or import can run at a time.
+func TestDatabaseDumpConflict(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t)
+
+	_, adminToken := newTestUser(t, app, "admin", "admin")
+
+	app.dumpMu.Lock()
+
+	for _, tt := range []struct{ method, path string }{
+		{http.MethodGet, "/v1/admin/export"},
+		{http.MethodPost, "/v1/admin/import"},
+	} {
+		code, body := ts.do(t, tt.method, tt.path, adminToken, []byte(`{"version": 1, "movies": []}`))
+		if code != http.StatusConflict || !strings.Contains(fmt.Sprint(body["error"]), "already being exported or imported") {
+			t.Errorf("%s %s: got status %d and body %v; want %d", tt.method, tt.path, code, body, http.StatusConflict)
+		}
+	}
+
+	app.dumpMu.Unlock()
+
+	code, _ := ts.do(t, http.MethodPost, "/v1/admin/import", adminToken, []byte(`{"version": 1, "movies": []}`))
+	if code != http.StatusOK {
+		t.Errorf("got status %d once the lock was released; want %d", code, http.StatusOK)
+	}
+}
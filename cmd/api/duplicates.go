@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/petrostrak/an-open-movie-database/internal/data"
+	"github.com/petrostrak/an-open-movie-database/internal/validator"
+)
+
+// The most candidate duplicates returned for a movie.
+const maxDuplicateCandidates = 5
+
+// The formatCandidates() helper formats the movies in a list of candidate duplicates
+// for the API version and runtime format, like formatMovies().
+func formatCandidates(candidates []*data.MovieCandidate, version, format string) []envelope {
+	formatted := make([]envelope, len(candidates))
+
+	for i, candidate := range candidates {
+		formatted[i] = envelope{"movie": formatMovie(candidate.Movie, version, format), "score": candidate.Score}
+	}
+
+	return formatted
+}
+
+// The findDuplicatesHandler() handler for the "POST /v1/movies/duplicates" endpoint
+// takes a title and an optional year, such as {"title": "Matrix, The", "year": 1999},
+// and returns up to 5 existing movies which it may be a duplicate of, the most alike
+// first, so that an editor can be asked "did you mean" before adding it.
+func (app *application) findDuplicatesHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Title string `json:"title"`
+		Year  int32  `json:"year"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	runtimeFormat := app.readRuntimeFormat(r.URL.Query(), v)
+
+	v.Check(input.Title != "", "title", validator.Msg("required"))
+	v.Check(validator.MaxBytes(input.Title, 500), "title", validator.Msg("max_bytes", "n", 500))
+	v.Check(input.Year == 0 || input.Year >= 1888, "year", validator.Msg("greater_than", "n", 1888))
+	v.Check(input.Year <= int32(time.Now().Year()), "year", validator.Msg("not_in_future"))
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	candidates, err := app.models.Movies.FindSimilarCandidates(input.Title, input.Year, maxDuplicateCandidates)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"candidates": formatCandidates(candidates, app.contextGetAPIVersion(r), runtimeFormat)}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The findDuplicates() helper returns the existing movies which score at least
+// -duplicates-threshold against a new movie, for createMovieHandler to refuse it with
+// ?strict=true.
+func (app *application) findDuplicates(movie *data.Movie) ([]*data.MovieCandidate, error) {
+	candidates, err := app.models.Movies.FindSimilarCandidates(movie.Title, movie.Year, maxDuplicateCandidates)
+	if err != nil {
+		return nil, err
+	}
+
+	var duplicates []*data.MovieCandidate
+
+	for _, candidate := range candidates {
+		if candidate.Score >= app.config.duplicates.threshold {
+			duplicates = append(duplicates, candidate)
+		}
+	}
+
+	return duplicates, nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/petrostrak/an-open-movie-database/internal/data"
+)
+
+func TestFindDuplicatesHandler(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t)
+
+	_, readerToken := newTestUser(t, app, "reader", "reader")
+	_, editorToken := newTestUser(t, app, "editor", "editor")
+
+	matrix := &data.Movie{Title: "The Matrix", Year: 1999, Runtime: 136, Genres: []string{"sci-fi"}}
+	if err := app.models.Movies.Insert(matrix); err != nil {
+		t.Fatal(err)
+	}
+
+	code, _ := ts.do(t, http.MethodPost, "/v1/movies/duplicates", readerToken, map[string]interface{}{"title": "Matrix, The"})
+	if code != http.StatusForbidden {
+		t.Errorf("got status %d for a reader; want %d", code, http.StatusForbidden)
+	}
+
+	code, body := ts.do(t, http.MethodPost, "/v1/movies/duplicates", editorToken, map[string]interface{}{"title": "Matrix, The", "year": 1999})
+	candidates, _ := body["candidates"].([]interface{})
+	if code != http.StatusOK || len(candidates) != 1 {
+		t.Fatalf("got status %d and body %v; want one candidate", code, body)
+	}
+
+	candidate, _ := candidates[0].(map[string]interface{})
+	movie, _ := candidate["movie"].(map[string]interface{})
+	if movie["id"] != float64(matrix.ID) || candidate["score"] != float64(1) {
+		t.Errorf("got candidate %v; want The Matrix with a score of 1", candidate)
+	}
+
+	code, body = ts.do(t, http.MethodPost, "/v1/movies/duplicates", editorToken, map[string]interface{}{"title": "Casablanca", "year": 1942})
+	if candidates, _ := body["candidates"].([]interface{}); code != http.StatusOK || len(candidates) != 0 {
+		t.Errorf("got status %d and body %v; want no candidates", code, body)
+	}
+
+	code, body = ts.do(t, http.MethodPost, "/v1/movies/duplicates", editorToken, map[string]interface{}{"year": 1999})
+	if details, _ := body["details"].(map[string]interface{}); code != http.StatusUnprocessableEntity || details["title"] == nil {
+		t.Errorf("got status %d and body %v; want an error for the title", code, body)
+	}
+
+	// The validate route shares the :id parameter, and still works.
+	code, _ = ts.do(t, http.MethodPost, "/v1/movies/validate", editorToken, map[string]interface{}{"title": "Up", "year": 2009, "runtime": 96, "genres": []string{"animation"}})
+	if code != http.StatusOK {
+		t.Errorf("got status %d validating a movie; want %d", code, http.StatusOK)
+	}
+}
+
+// With ?strict=true, a movie which scores at least -duplicates-threshold against an
+// existing one is refused with the candidates, while a distinct one is created.
+func TestCreateMovieStrict(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t)
+
+	_, token := newTestUser(t, app, "editor", "editor")
+
+	matrix := &data.Movie{Title: "The Matrix", Year: 1999, Runtime: 136, Genres: []string{"sci-fi"}}
+	if err := app.models.Movies.Insert(matrix); err != nil {
+		t.Fatal(err)
+	}
+
+	movie := func(title string, year int) map[string]interface{} {
+		return map[string]interface{}{"title": title, "year": year, "runtime": 120, "genres": []string{"sci-fi"}}
+	}
+
+	code, body := ts.do(t, http.MethodPost, "/v1/movies?strict=true", token, movie("Matrix, The", 1999))
+	details, _ := body["details"].(map[string]interface{})
+	candidates, _ := details["candidates"].([]interface{})
+	if code != http.StatusConflict || body["code"] != errCodeDuplicateMovie || len(candidates) != 1 {
+		t.Fatalf("got status %d and body %v; want a duplicate_movie conflict with one candidate", code, body)
+	}
+
+	tests := []struct {
+		name  string
+		query string
+		movie map[string]interface{}
+	}{
+		{"sequel", "?strict=true", movie("The Matrix Reloaded", 2003)},
+		{"not strict", "", movie("Matrix, The", 1999)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, body := ts.do(t, http.MethodPost, "/v1/movies"+tt.query, token, tt.movie)
+			if code != http.StatusCreated {
+				t.Errorf("got status %d and body %v; want %d", code, body, http.StatusCreated)
+			}
+		})
+	}
+
+	app.config.duplicates.threshold = 0.5
+
+	// The Matrix Reloaded, created above, scores 0.547 against it.
+	code, _ = ts.do(t, http.MethodPost, "/v1/movies?strict=true", token, movie("The Matrix Revolutions", 2003))
+	if code != http.StatusConflict {
+		t.Errorf("got status %d with a lower threshold; want %d", code, http.StatusConflict)
+	}
+}
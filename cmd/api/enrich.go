@@ -0,0 +1,191 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/petrostrak/an-open-movie-database/internal/data"
+	"github.com/petrostrak/an-open-movie-database/internal/enrich"
+	"github.com/petrostrak/an-open-movie-database/internal/validator"
+)
+
+// The codes which identify each kind of enrichment warning. Like the error codes, a
+// code must never change once it has been released.
+const (
+	warnCodeEnrichmentDisabled = "enrichment_disabled"
+	warnCodeEnrichmentNotFound = "enrichment_not_found"
+	warnCodeEnrichmentFailed   = "enrichment_failed"
+)
+
+// Define a warning struct to hold a problem which didn't stop a request from
+// succeeding, such as the enrichment provider being unavailable, for the "warnings"
+// key of the response.
+type warning struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// The enrichMovie() helper fills in the runtime, genres, plot and poster of a movie
+// from the enrichment provider, where they're empty, and returns the names of the
+// fields it filled in. A value the client gave is never replaced, and nor is one from
+// the provider used if it would fail validation. If the provider can't be used, the
+// movie is left as it was and a warning for the response is returned instead.
+func (app *application) enrichMovie(r *http.Request, movie *data.Movie) ([]string, *warning) {
+	enriched := []string{}
+
+	// Without a title there's nothing to look up, and validation will say so.
+	if strings.TrimSpace(movie.Title) == "" {
+		return enriched, nil
+	}
+
+	found, err := app.enricher.Lookup(r.Context(), movie.Title, movie.Year)
+	if err != nil {
+		switch {
+		case errors.Is(err, enrich.ErrDisabled):
+			return enriched, &warning{Code: warnCodeEnrichmentDisabled, Message: "enrichment is not configured on this server"}
+		case errors.Is(err, enrich.ErrNotFound):
+			return enriched, &warning{Code: warnCodeEnrichmentNotFound, Message: "the enrichment provider has no match for this movie"}
+		default:
+			app.logError(r, err)
+			return enriched, &warning{Code: warnCodeEnrichmentFailed, Message: "the enrichment provider could not be reached"}
+		}
+	}
+
+	// Fill in a copy of the movie and validate it, so that each field can be checked
+	// by the same rules as a client's value would be.
+	candidate := *movie
+
+	if candidate.Runtime == 0 {
+		candidate.Runtime = data.Runtime(found.Runtime)
+	}
+
+	if len(candidate.Genres) == 0 && len(found.Genres) > 0 {
+		candidate.Genres = found.Genres
+	}
+
+	if candidate.Plot == "" {
+		candidate.Plot = found.Plot
+	}
+
+	if candidate.Poster == "" {
+		candidate.Poster = found.Poster
+	}
+
+	v := validator.New()
+	data.ValidateMovie(v, &candidate)
+
+	fields := []struct {
+		name    string
+		changed bool
+		apply   func()
+	}{
+		{"runtime", candidate.Runtime != movie.Runtime, func() { movie.Runtime = candidate.Runtime }},
+		{"genres", len(candidate.Genres) != len(movie.Genres), func() { movie.Genres = candidate.Genres }},
+		{"plot", candidate.Plot != movie.Plot, func() { movie.Plot = candidate.Plot }},
+		{"poster", candidate.Poster != movie.Poster, func() { movie.Poster = candidate.Poster }},
+	}
+
+	for _, field := range fields {
+		if field.changed && !hasFieldErrors(v, field.name) {
+			field.apply()
+			enriched = append(enriched, field.name)
+		}
+	}
+
+	return enriched, nil
+}
+
+// The hasFieldErrors() helper reports whether a validator has any errors for a field,
+// including those for its elements, such as "genres[2]".
+func hasFieldErrors(v *validator.Validator, field string) bool {
+	for key := range v.Errors {
+		if key == field || strings.HasPrefix(key, field+"[") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// The enrichmentEnvelope() helper adds the fields which were enriched, and the
+// warning if there is one, to a response.
+func enrichmentEnvelope(env envelope, enriched []string, warn *warning) envelope {
+	env["enriched"] = enriched
+
+	if warn != nil {
+		env["warnings"] = []warning{*warn}
+	}
+
+	return env
+}
+
+// The enrichMovieHandler() handler for the "POST /v1/movies/:id/enrich" endpoint fills
+// in the empty runtime, genres, plot and poster of an existing movie from the
+// enrichment provider, as ?enrich=true does when a movie is created. The movie is only
+// updated if something was filled in; otherwise it's returned as it was, with a
+// warning if the provider couldn't be used.
+func (app *application) enrichMovieHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.invalidParamResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	runtimeFormat := app.readRuntimeFormat(r.URL.Query(), v)
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	movie, err := app.models.Movies.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	before := *movie
+
+	enriched, warn := app.enrichMovie(r, movie)
+
+	if len(enriched) > 0 {
+		user := app.contextGetUser(r)
+		movie.UpdatedBy = &data.UserRef{ID: user.ID, Name: user.Name}
+
+		err = app.models.Movies.Update(movie)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrEditConflict):
+				app.editConflictResponse(w, r)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+
+		app.recordAudit(r, data.AuditEntry{
+			Action:       "movie.enrich",
+			ResourceType: "movie",
+			ResourceID:   strconv.FormatInt(movie.ID, 10),
+			Metadata:     map[string]interface{}{"version": movie.Version, "fields": enriched},
+		})
+
+		app.fireWebhook(data.WebhookMovieUpdated, envelope{"movie": formatMovie(movie, apiV1, app.config.runtimeFormat)})
+		app.notifyWatchers(&before, movie)
+	}
+
+	env := enrichmentEnvelope(envelope{"movie": formatMovie(movie, app.contextGetAPIVersion(r), runtimeFormat)}, enriched, warn)
+
+	err = app.writeResponse(w, r, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
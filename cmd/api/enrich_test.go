@@ -0,0 +1,229 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/petrostrak/an-open-movie-database/internal/data"
+	"github.com/petrostrak/an-open-movie-database/internal/enrich"
+)
+
+// The godfatherStub() helper returns a stub provider which knows one movie.
+func godfatherStub() enrich.Stub {
+	return enrich.Stub{Movies: map[string]*enrich.EnrichedMovie{
+		enrich.StubKey("The Godfather", 1972): {
+			Runtime: 175,
+			Genres:  []string{"crime", "drama"},
+			Plot:    "The aging patriarch of an organized crime dynasty transfers control to his son.",
+			Poster:  "https://example.com/godfather.jpg",
+		},
+	}}
+}
+
+func TestCreateMovieEnrichment(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t)
+
+	_, token := newTestUser(t, app, "editor", "editor")
+
+	tests := []struct {
+		name         string
+		provider     enrich.Provider
+		query        string
+		body         map[string]interface{}
+		wantCode     int
+		wantEnriched string
+		wantWarning  string
+		wantRuntime  string
+		wantGenres   string
+	}{
+		{
+			name:     "not asked for",
+			provider: godfatherStub(),
+			body:     map[string]interface{}{"title": "The Godfather", "year": 1972},
+			wantCode: http.StatusUnprocessableEntity,
+		},
+		{
+			name:         "fills the empty fields",
+			provider:     godfatherStub(),
+			query:        "?enrich=true",
+			body:         map[string]interface{}{"title": "The Godfather", "year": 1972},
+			wantCode:     http.StatusCreated,
+			wantEnriched: "[runtime genres plot poster]",
+			wantRuntime:  "175 mins",
+			wantGenres:   "[crime drama]",
+		},
+		{
+			name:         "keeps the client's values",
+			provider:     godfatherStub(),
+			query:        "?enrich=true",
+			body:         map[string]interface{}{"title": "The Godfather", "year": 1972, "runtime": 177, "genres": []string{"classic"}},
+			wantCode:     http.StatusCreated,
+			wantEnriched: "[plot poster]",
+			wantRuntime:  "177 mins",
+			wantGenres:   "[classic]",
+		},
+		{
+			name:         "no match",
+			provider:     godfatherStub(),
+			query:        "?enrich=true",
+			body:         map[string]interface{}{"title": "Moana", "year": 2016, "runtime": 107, "genres": []string{"animation"}},
+			wantCode:     http.StatusCreated,
+			wantEnriched: "[]",
+			wantWarning:  "enrichment_not_found",
+			wantRuntime:  "107 mins",
+			wantGenres:   "[animation]",
+		},
+		{
+			name:         "provider failure",
+			provider:     enrich.Stub{Err: errors.New("connection refused")},
+			query:        "?enrich=true",
+			body:         map[string]interface{}{"title": "Moana", "year": 2016, "runtime": 107, "genres": []string{"animation"}},
+			wantCode:     http.StatusCreated,
+			wantEnriched: "[]",
+			wantWarning:  "enrichment_failed",
+			wantRuntime:  "107 mins",
+			wantGenres:   "[animation]",
+		},
+		{
+			name:         "disabled",
+			provider:     enrich.Disabled{},
+			query:        "?enrich=true",
+			body:         map[string]interface{}{"title": "Moana", "year": 2016, "runtime": 107, "genres": []string{"animation"}},
+			wantCode:     http.StatusCreated,
+			wantEnriched: "[]",
+			wantWarning:  "enrichment_disabled",
+			wantRuntime:  "107 mins",
+			wantGenres:   "[animation]",
+		},
+		{
+			name:     "failure still validates",
+			provider: enrich.Stub{Err: errors.New("connection refused")},
+			query:    "?enrich=true",
+			body:     map[string]interface{}{"title": "The Godfather", "year": 1972},
+			wantCode: http.StatusUnprocessableEntity,
+		},
+		{
+			name:     "bad parameter",
+			provider: godfatherStub(),
+			query:    "?enrich=maybe",
+			body:     map[string]interface{}{"title": "The Godfather", "year": 1972},
+			wantCode: http.StatusUnprocessableEntity,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app.enricher = tt.provider
+
+			code, body := ts.do(t, http.MethodPost, "/v1/movies"+tt.query, token, tt.body)
+			if code != tt.wantCode {
+				t.Fatalf("got status %d and body %v; want %d", code, body, tt.wantCode)
+			}
+
+			if code != http.StatusCreated {
+				return
+			}
+
+			if got := fmt.Sprint(body["enriched"]); got != tt.wantEnriched {
+				t.Errorf("got enriched %s; want %s", got, tt.wantEnriched)
+			}
+
+			warnings, _ := body["warnings"].([]interface{})
+			if tt.wantWarning == "" && len(warnings) != 0 {
+				t.Errorf("got warnings %v; want none", warnings)
+			}
+
+			if tt.wantWarning != "" {
+				warning, _ := warnings[0].(map[string]interface{})
+				if len(warnings) != 1 || warning["code"] != tt.wantWarning {
+					t.Errorf("got warnings %v; want %s", warnings, tt.wantWarning)
+				}
+			}
+
+			movie, _ := body["movie"].(map[string]interface{})
+			if movie["runtime"] != tt.wantRuntime || fmt.Sprint(movie["genres"]) != tt.wantGenres {
+				t.Errorf("got movie %v; want runtime %s and genres %s", movie, tt.wantRuntime, tt.wantGenres)
+			}
+		})
+	}
+}
+
+// A value from the provider which would fail validation, such as a poster which isn't
+// an http URL, is left out rather than failing the request.
+func TestEnrichMovieSkipsInvalidValues(t *testing.T) {
+	app := newTestApplication(t)
+
+	app.enricher = enrich.Stub{Movies: map[string]*enrich.EnrichedMovie{
+		enrich.StubKey("Moana", 2016): {Runtime: 107, Genres: []string{"a", "b", "c", "d", "e", "f"}, Poster: "ftp://example.com/moana.jpg"},
+	}}
+
+	movie := &data.Movie{Title: "Moana", Year: 2016}
+
+	r, err := http.NewRequest(http.MethodPost, "/v1/movies?enrich=true", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	enriched, warn := app.enrichMovie(r, movie)
+	if fmt.Sprint(enriched) != "[runtime]" || warn != nil {
+		t.Errorf("got enriched %v and warning %v; want only the runtime", enriched, warn)
+	}
+
+	if movie.Runtime != 107 || movie.Genres != nil || movie.Poster != "" {
+		t.Errorf("got movie %+v; want only the runtime filled in", movie)
+	}
+}
+
+func TestEnrichMovieHandler(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t)
+
+	_, readerToken := newTestUser(t, app, "reader", "reader")
+	_, editorToken := newTestUser(t, app, "editor", "editor")
+
+	movie := &data.Movie{Title: "The Godfather", Year: 1972, Runtime: 177, Genres: []string{"crime"}}
+	if err := app.models.Movies.Insert(movie); err != nil {
+		t.Fatal(err)
+	}
+
+	path := fmt.Sprintf("/v1/movies/%d/enrich", movie.ID)
+	app.enricher = godfatherStub()
+
+	code, _ := ts.do(t, http.MethodPost, path, readerToken, nil)
+	if code != http.StatusForbidden {
+		t.Errorf("got status %d for a reader; want %d", code, http.StatusForbidden)
+	}
+
+	code, body := ts.do(t, http.MethodPost, path, editorToken, nil)
+	got, _ := body["movie"].(map[string]interface{})
+	if code != http.StatusOK || fmt.Sprint(body["enriched"]) != "[plot poster]" || got["runtime"] != "177 mins" || got["version"] != float64(2) {
+		t.Fatalf("got status %d and body %v; want the plot and poster filled in", code, body)
+	}
+
+	stored, err := app.models.Movies.Get(movie.ID)
+	if err != nil || stored.Plot == "" || stored.Poster != "https://example.com/godfather.jpg" || stored.UpdatedBy == nil {
+		t.Errorf("got movie %+v and error %v; want the plot and poster saved", stored, err)
+	}
+
+	// Nothing is left to fill in, so the movie isn't updated again.
+	code, body = ts.do(t, http.MethodPost, path, editorToken, nil)
+	got, _ = body["movie"].(map[string]interface{})
+	if code != http.StatusOK || fmt.Sprint(body["enriched"]) != "[]" || got["version"] != float64(2) {
+		t.Errorf("got status %d and body %v; want the movie unchanged", code, body)
+	}
+
+	app.enricher = enrich.Stub{Err: errors.New("connection refused")}
+
+	code, body = ts.do(t, http.MethodPost, path, editorToken, nil)
+	if warnings, _ := body["warnings"].([]interface{}); code != http.StatusOK || len(warnings) != 1 {
+		t.Errorf("got status %d and body %v; want a warning", code, body)
+	}
+
+	code, _ = ts.do(t, http.MethodPost, "/v1/movies/9999/enrich", editorToken, nil)
+	if code != http.StatusNotFound {
+		t.Errorf("got status %d for a missing movie; want %d", code, http.StatusNotFound)
+	}
+}
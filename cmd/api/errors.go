@@ -1,31 +1,125 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/petrostrak/an-open-movie-database/internal/data"
+	"github.com/petrostrak/an-open-movie-database/internal/validator"
 )
 
 // The logError() method is a generic helper for logging an error message.
 func (app *application) logError(r *http.Request, err error) {
 	// Use the PrintErr() to log the error message and include the current
 	// request method and URL as properties in the log entry.
-	app.logger.PrintError(err, map[string]string{
+	app.logger.PrintError(err, app.logProperties(r, map[string]string{
 		"request_method": r.Method,
 		"request_url":    r.URL.String(),
-	})
+		"client_ip":      app.clientIP(r),
+	}))
+}
+
+// The logProperties() method adds the request ID to the properties of a log entry, so
+// that every entry logged while handling a request can be found from its ID.
+func (app *application) logProperties(r *http.Request, properties map[string]string) map[string]string {
+	if properties == nil {
+		properties = make(map[string]string)
+	}
+
+	if requestID := app.contextGetRequestID(r); requestID != "" {
+		properties["request_id"] = requestID
+	}
+
+	return properties
+}
+
+// The reportError() method sends an unexpected error to the error reporter, along with
+// the request method, path and ID, and the ID of the user who made the request (taken
+// from the userRecorder, so that it's known even when authenticate() hasn't run). Any
+// extra context, such as a panic's stack trace, is added too.
+func (app *application) reportError(r *http.Request, err error, extra map[string]string) {
+	context := map[string]string{
+		"request_method": r.Method,
+		"request_path":   r.URL.Path,
+		"request_id":     app.contextGetRequestID(r),
+	}
+
+	if ur, ok := r.Context().Value(userRecorderContextKey).(*userRecorder); ok {
+		if userID := ur.get(); userID != "" {
+			context["user_id"] = userID
+		}
+	}
+
+	for k, v := range extra {
+		context[k] = v
+	}
+
+	app.reporter.Report(err, context)
+}
+
+// The codes which identify each kind of error response. Clients should match on these
+// rather than on the messages, which may be reworded, so a code must never change once
+// it has been released.
+const (
+	errCodeServerError              = "server_error"
+	errCodeTimeout                  = "timeout"
+	errCodeNotFound                 = "not_found"
+	errCodeMethodNotAllowed         = "method_not_allowed"
+	errCodeNotAcceptable            = "not_acceptable"
+	errCodeBadRequest               = "bad_request"
+	errCodeUnsupportedMediaType     = "unsupported_media_type"
+	errCodeBodyTooLarge             = "body_too_large"
+	errCodeValidationFailed         = "validation_failed"
+	errCodeEditConflict             = "edit_conflict"
+	errCodeRateLimited              = "rate_limited"
+	errCodeIdempotencyKeyMismatch   = "idempotency_key_mismatch"
+	errCodeIdempotencyKeyInProgress = "idempotency_key_in_progress"
+	errCodeInvalidCredentials       = "invalid_credentials"
+	errCodeInvalidToken             = "invalid_token"
+	errCodeAuthenticationRequired   = "authentication_required"
+	errCodeInactiveAccount          = "inactive_account"
+	errCodeNotPermitted             = "not_permitted"
+	errCodeMaintenance              = "maintenance"
+	errCodeInvalidConfig            = "invalid_config"
+	errCodeDatabaseUnavailable      = "database_unavailable"
+	errCodeHTTPSRequired            = "https_required"
+	errCodeInvalidMethodOverride    = "invalid_method_override"
+	errCodeJobConflict              = "job_conflict"
+	errCodeDuplicateMovie           = "duplicate_movie"
+	errCodeResourceInUse            = "resource_in_use"
+)
+
+// The errorCodes slice lists every code, for the OpenAPI document.
+var errorCodes = []string{
+	errCodeServerError, errCodeTimeout, errCodeNotFound, errCodeMethodNotAllowed,
+	errCodeNotAcceptable, errCodeBadRequest, errCodeUnsupportedMediaType, errCodeBodyTooLarge,
+	errCodeValidationFailed, errCodeEditConflict, errCodeRateLimited,
+	errCodeIdempotencyKeyMismatch, errCodeIdempotencyKeyInProgress, errCodeInvalidCredentials,
+	errCodeInvalidToken, errCodeAuthenticationRequired, errCodeInactiveAccount, errCodeNotPermitted,
+	errCodeMaintenance, errCodeInvalidConfig, errCodeDatabaseUnavailable, errCodeHTTPSRequired,
+	errCodeInvalidMethodOverride, errCodeJobConflict, errCodeDuplicateMovie,
+	errCodeResourceInUse,
 }
 
-// The errorResponse() method is a generic helper for sending JSON-formatted error
-// messages to the client with a given status code. Note that we're using an interface{}
-// type for the message parameter, rather than just a string type, as this gives us
-// more flexibility over the values that we can include in the response.
-func (app *application) errorResponse(w http.ResponseWriter, r *http.Request, status int, message interface{}) {
-	env := envelope{"error": message}
+// The errorResponse() method is the helper which every error response goes through,
+// so that they all have the same shape: the human-readable message under "error", one
+// of the codes above under "code", and any details, such as the per-field messages for
+// a validation failure, under "details". The details are left out when they're nil.
+// The response is JSON or XML depending on the Accept header.
+func (app *application) errorResponse(w http.ResponseWriter, r *http.Request, status int, code, message string, details interface{}) {
+	env := envelope{"error": message, "code": code}
+	if details != nil {
+		env["details"] = details
+	}
 
-	// Write the response using the writeJSON() helper. If this happens to return an error
-	// then log it, and fall back to sending the client an empty response with a 500
-	// internal server error status code.
-	if err := app.writeJSON(w, status, env, nil); err != nil {
+	// Write the response using the writeResponse() helper. If this happens to return an
+	// error then log it, and fall back to sending the client an empty response with a
+	// 500 internal server error status code.
+	if err := app.writeResponse(w, r, status, env, nil); err != nil {
 		app.logError(r, err)
 		w.WriteHeader(http.StatusInternalServerError)
 	}
@@ -34,71 +128,262 @@ func (app *application) errorResponse(w http.ResponseWriter, r *http.Request, st
 // The serverErrorResponse() method will be used when our application encounters an
 // unexpected problem at runtime. It logs the detailed error message, then uses the
 // errorResponse() helper to send a 500 Internal Server Error status code and JSON
-// response (containing a generic error message) to the client.
+// response (containing a generic error message) to the client. The error is also sent
+// to the error reporter.
+//
+// The details include the request ID, so that a user reporting the error can give us
+// something to find the log entry with.
+//
+// An error from a database whose circuit breaker is open isn't unexpected, and would
+// flood the logs during an outage, so it gets a 503 response instead.
 func (app *application) serverErrorResponse(w http.ResponseWriter, r *http.Request, err error) {
+	var unavailableErr *data.UnavailableError
+	if errors.As(err, &unavailableErr) {
+		app.databaseUnavailableResponse(w, r, unavailableErr.RetryAfter)
+		return
+	}
+
 	app.logError(r, err)
+	app.reportError(r, err, nil)
+
 	message := "the server encountered a problem and could not process your request"
-	app.errorResponse(w, r, http.StatusInternalServerError, message)
+	details := envelope{"request_id": app.contextGetRequestID(r)}
+	app.errorResponse(w, r, http.StatusInternalServerError, errCodeServerError, message, details)
+}
+
+// The timeoutResponse() method sends a 503 Service Unavailable response when a request
+// takes longer than its timeout, including the request ID so the slow request can be
+// found in the logs.
+func (app *application) timeoutResponse(w http.ResponseWriter, r *http.Request) {
+	message := "the server took too long to process your request, please try again"
+	details := envelope{"request_id": app.contextGetRequestID(r)}
+	app.errorResponse(w, r, http.StatusServiceUnavailable, errCodeTimeout, message, details)
+}
+
+// The databaseUnavailableResponse() method sends a 503 Service Unavailable response
+// while the database's circuit breaker is open, with a Retry-After header saying when
+// the breaker will next try the database.
+func (app *application) databaseUnavailableResponse(w http.ResponseWriter, r *http.Request, retryAfter time.Duration) {
+	seconds := ceilSeconds(retryAfter)
+
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+
+	message := "the database is unavailable, please try again later"
+	app.errorResponse(w, r, http.StatusServiceUnavailable, errCodeDatabaseUnavailable, message, envelope{"retry_after": seconds})
+}
+
+// The maintenanceResponse() method sends a 503 Service Unavailable response while the
+// server is in maintenance mode.
+func (app *application) maintenanceResponse(w http.ResponseWriter, r *http.Request) {
+	message := "the server is down for maintenance, please try again later"
+	app.errorResponse(w, r, http.StatusServiceUnavailable, errCodeMaintenance, message, nil)
+}
+
+// The httpsRequiredResponse() method is used for a request over plain HTTP, which
+// can't be redirected to HTTPS without the client resending its body, when HTTPS is
+// enforced. The details hold the URL to send it to instead.
+func (app *application) httpsRequiredResponse(w http.ResponseWriter, r *http.Request, httpsURL string) {
+	message := "this API must be accessed over HTTPS"
+	app.errorResponse(w, r, http.StatusForbidden, errCodeHTTPSRequired, message, envelope{"https_url": httpsURL})
+}
+
+// The panicResponse() method sends a 500 Internal Server Error response after a panic,
+// which has already been logged. In development the details include the stack trace,
+// to speed up debugging; anywhere else the client gets the usual generic message.
+func (app *application) panicResponse(w http.ResponseWriter, r *http.Request, stack []byte) {
+	message := "the server encountered a problem and could not process your request"
+	details := envelope{"request_id": app.contextGetRequestID(r)}
+
+	if app.config.env == "development" {
+		details["stack"] = string(stack)
+	}
+
+	app.errorResponse(w, r, http.StatusInternalServerError, errCodeServerError, message, details)
 }
 
 // The notFoundResponse() method will be used to send a 404 Not Found status code and
 // JSON response to the client.
 func (app *application) notFoundResponse(w http.ResponseWriter, r *http.Request) {
 	message := "the requested resource could not be found"
-	app.errorResponse(w, r, http.StatusNotFound, message)
+	app.errorResponse(w, r, http.StatusNotFound, errCodeNotFound, message, nil)
+}
+
+// The invalidParamResponse() method sends a 404 Not Found response for a URL parameter
+// which can't identify anything, as readIDParam() and readUUIDParam() report, with the
+// format the parameter should have in the details, so that clients can tell a
+// malformed identifier from one which doesn't exist.
+func (app *application) invalidParamResponse(w http.ResponseWriter, r *http.Request, err error) {
+	var paramErr *invalidParamError
+	if !errors.As(err, &paramErr) {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	message := "the requested resource could not be found"
+	details := envelope{paramErr.name: "must be " + paramErr.format}
+	app.errorResponse(w, r, http.StatusNotFound, errCodeNotFound, message, details)
 }
 
 // The methodNotAllowedResponse() method will be used to send a 405 Method Not Allowed
 // status code and JSON response to the client.
 func (app *application) methodNotAllowedResponse(w http.ResponseWriter, r *http.Request) {
 	message := fmt.Sprintf("the %s method is not supported for this resource", r.Method)
-	app.errorResponse(w, r, http.StatusMethodNotAllowed, message)
+	app.errorResponse(w, r, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, message, nil)
+}
+
+// The notAcceptableResponse() method sends a 406 Not Acceptable response, listing the
+// media types we can send. writeResponse() sends it as JSON, as the client has already
+// told us that it won't accept anything we support.
+func (app *application) notAcceptableResponse(w http.ResponseWriter, r *http.Request) {
+	message := "the requested resource is not available in any of the media types in the Accept header"
+	details := envelope{"supported_types": supportedMediaTypes}
+	app.errorResponse(w, r, http.StatusNotAcceptable, errCodeNotAcceptable, message, details)
 }
 
 // badRequestResponse sends to the client a 400 Bad Request response along with the errpr message.
+//
+// A body sent with an encoding we can't decompress gets a 415 Unsupported Media Type
+// instead, and a body over the size limit a 413 Request Entity Too Large, so that
+// handlers can pass any readJSON() error straight through.
 func (app *application) badRequestResponse(w http.ResponseWriter, r *http.Request, err error) {
-	app.errorResponse(w, r, http.StatusBadRequest, err.Error())
+	var maxBytesError *http.MaxBytesError
+
+	switch {
+	case errors.Is(err, errUnsupportedEncoding):
+		app.errorResponse(w, r, http.StatusUnsupportedMediaType, errCodeUnsupportedMediaType, err.Error(), nil)
+		return
+	case errors.As(err, &maxBytesError):
+		app.maxBytesResponse(w, r, maxBytesError.Limit)
+		return
+	}
+
+	app.errorResponse(w, r, http.StatusBadRequest, errCodeBadRequest, err.Error(), nil)
+}
+
+// The invalidMethodOverrideResponse() method is used for an X-HTTP-Method-Override
+// header which isn't allowed, with a message saying why.
+func (app *application) invalidMethodOverrideResponse(w http.ResponseWriter, r *http.Request, message string) {
+	app.errorResponse(w, r, http.StatusBadRequest, errCodeInvalidMethodOverride, message, nil)
+}
+
+// The maxBytesResponse() method sends a 413 Request Entity Too Large response, including
+// the limit which the body exceeded.
+func (app *application) maxBytesResponse(w http.ResponseWriter, r *http.Request, limit int64) {
+	message := fmt.Sprintf("body must not be larger than %d bytes", limit)
+	app.errorResponse(w, r, http.StatusRequestEntityTooLarge, errCodeBodyTooLarge, message, nil)
 }
 
 // failedValidationResponse writes a 422 Unprocessable Entity and the contents of the
-// errors map from the Validator type as a JSON response Body
-func (app *application) failedValidationResponse(w http.ResponseWriter, r *http.Request, errors map[string]string) {
-	app.errorResponse(w, r, http.StatusUnprocessableEntity, errors)
+// errors map from the Validator type as the details of the response, which hold a
+// list of messages for each key. The messages are in the language that the request's
+// Accept-Language header prefers, out of the ones we have translations for.
+func (app *application) failedValidationResponse(w http.ResponseWriter, r *http.Request, errors map[string][]validator.Message) {
+	locale := negotiateLanguage(r.Header.Get("Accept-Language"), validator.Locales(), app.config.defaultLocale)
+
+	// The messages depend on the Accept-Language header, so caches mustn't send them
+	// in reply to requests with a different one.
+	w.Header().Add("Vary", "Accept-Language")
+	w.Header().Set("Content-Language", locale)
+
+	message := "the request failed validation"
+	app.errorResponse(w, r, http.StatusUnprocessableEntity, errCodeValidationFailed, message, validator.Render(errors, locale))
+}
+
+// The invalidConfigResponse() method sends a 422 Unprocessable Entity response when a
+// reloaded configuration is invalid, with the problem as the message.
+func (app *application) invalidConfigResponse(w http.ResponseWriter, r *http.Request, err error) {
+	app.errorResponse(w, r, http.StatusUnprocessableEntity, errCodeInvalidConfig, err.Error(), nil)
 }
 
 func (app *application) editConflictResponse(w http.ResponseWriter, r *http.Request) {
 	message := "unable to update the record due to an edit conflict, please try again"
-	app.errorResponse(w, r, http.StatusConflict, message)
+	app.errorResponse(w, r, http.StatusConflict, errCodeEditConflict, message, nil)
 }
 
-func (app *application) rateLimitExceededResponse(w http.ResponseWriter, r *http.Request) {
+// The rateLimitExceededResponse() method sends a 429 Too Many Requests response, with a
+// Retry-After header, and the time at which the client may try again in the details.
+// When it was the limit of a route class that was exceeded, rather than the limit on
+// all routes, the class is given too.
+func (app *application) rateLimitExceededResponse(w http.ResponseWriter, r *http.Request, class string, retryAfter time.Duration) {
+	seconds := ceilSeconds(retryAfter)
+
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+
+	details := envelope{
+		"retry_after": seconds,
+		"retry_at":    time.Now().Add(retryAfter).UTC().Truncate(time.Second),
+	}
+
 	message := "rate limit exceeded"
-	app.errorResponse(w, r, http.StatusTooManyRequests, message)
+	if class != "" {
+		details["class"] = class
+		message = fmt.Sprintf("rate limit exceeded for %s requests", class)
+	}
+
+	app.errorResponse(w, r, http.StatusTooManyRequests, errCodeRateLimited, message, details)
+}
+
+// The jobConflictResponse() method sends a 409 Conflict response for a job which is
+// already running, or has already finished. The running job's ID is included in the
+// details, if there is one.
+func (app *application) jobConflictResponse(w http.ResponseWriter, r *http.Request, message string, job *data.Job) {
+	var details interface{}
+	if job != nil {
+		details = envelope{"job_id": job.ID}
+	}
+
+	app.errorResponse(w, r, http.StatusConflict, errCodeJobConflict, message, details)
+}
+
+// The duplicateMovieResponse() method sends a 409 Conflict response when a movie
+// created with ?strict=true looks like one which already exists, with the existing
+// movies which are too alike in the details.
+func (app *application) duplicateMovieResponse(w http.ResponseWriter, r *http.Request, candidates interface{}) {
+	message := "the movie looks like one which already exists; create it without ?strict=true if it's really new"
+	app.errorResponse(w, r, http.StatusConflict, errCodeDuplicateMovie, message, envelope{"candidates": candidates})
+}
+
+// The resourceInUseResponse() method sends a 409 Conflict response when a record can't
+// be deleted because rows in another table still refer to it. The table is named in
+// the message and the details.
+func (app *application) resourceInUseResponse(w http.ResponseWriter, r *http.Request, table string) {
+	message := fmt.Sprintf("this resource can't be deleted while there are %s which refer to it", strings.ReplaceAll(table, "_", " "))
+	app.errorResponse(w, r, http.StatusConflict, errCodeResourceInUse, message, envelope{"resource": table})
+}
+
+func (app *application) idempotencyKeyMismatchResponse(w http.ResponseWriter, r *http.Request) {
+	message := "this idempotency key was already used with a different request"
+	app.errorResponse(w, r, http.StatusUnprocessableEntity, errCodeIdempotencyKeyMismatch, message, nil)
+}
+
+func (app *application) idempotencyKeyInProgressResponse(w http.ResponseWriter, r *http.Request) {
+	message := "a request with this idempotency key is still being processed, please try again"
+	app.errorResponse(w, r, http.StatusConflict, errCodeIdempotencyKeyInProgress, message, nil)
 }
 
 func (app *application) invalidCredentialsResponse(w http.ResponseWriter, r *http.Request) {
 	message := "invalid authentication credentials"
-	app.errorResponse(w, r, http.StatusUnauthorized, message)
+	app.errorResponse(w, r, http.StatusUnauthorized, errCodeInvalidCredentials, message, nil)
 }
 
 func (app *application) invalidAuthenticationTokenResponse(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("WWW-Authenticate", "Bearer")
 
 	message := "invalid or missing authentication token"
-	app.errorResponse(w, r, http.StatusUnauthorized, message)
+	app.errorResponse(w, r, http.StatusUnauthorized, errCodeInvalidToken, message, nil)
 }
 
 func (app *application) authenticationRequiredResponse(w http.ResponseWriter, r *http.Request) {
 	message := "you must be authenticated to access this resource"
-	app.errorResponse(w, r, http.StatusUnauthorized, message)
+	app.errorResponse(w, r, http.StatusUnauthorized, errCodeAuthenticationRequired, message, nil)
 }
 
 func (app *application) inactiveAccountResponse(w http.ResponseWriter, r *http.Request) {
 	message := "your user account must be activated to access this resource"
-	app.errorResponse(w, r, http.StatusForbidden, message)
+	app.errorResponse(w, r, http.StatusForbidden, errCodeInactiveAccount, message, nil)
 }
 
 func (app *application) notPermittedResponse(w http.ResponseWriter, r *http.Request) {
 	message := "your user account doesn't have the necessary permissions to access this resource"
-	app.errorResponse(w, r, http.StatusForbidden, message)
+	app.errorResponse(w, r, http.StatusForbidden, errCodeNotPermitted, message, nil)
 }
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/petrostrak/an-open-movie-database/internal/data"
+	"github.com/petrostrak/an-open-movie-database/internal/validator"
+)
+
+func TestErrorResponses(t *testing.T) {
+	app := newTestApplication(t)
+
+	tests := []struct {
+		name        string
+		send        func(w http.ResponseWriter, r *http.Request)
+		wantStatus  int
+		wantCode    string
+		wantDetails []string
+	}{
+		{"server error", func(w http.ResponseWriter, r *http.Request) { app.serverErrorResponse(w, r, errors.New("boom")) },
+			http.StatusInternalServerError, errCodeServerError, []string{"request_id"}},
+		{"timeout", app.timeoutResponse, http.StatusServiceUnavailable, errCodeTimeout, []string{"request_id"}},
+		{"panic", func(w http.ResponseWriter, r *http.Request) { app.panicResponse(w, r, []byte("stack")) },
+			http.StatusInternalServerError, errCodeServerError, []string{"request_id"}},
+		{"not found", app.notFoundResponse, http.StatusNotFound, errCodeNotFound, nil},
+		{"invalid id", func(w http.ResponseWriter, r *http.Request) {
+			app.invalidParamResponse(w, r, &invalidParamError{name: "id", format: "a positive integer"})
+		}, http.StatusNotFound, errCodeNotFound, []string{"id"}},
+		{"method not allowed", app.methodNotAllowedResponse, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, nil},
+		{"not acceptable", app.notAcceptableResponse, http.StatusNotAcceptable, errCodeNotAcceptable, []string{"supported_types"}},
+		{"bad request", func(w http.ResponseWriter, r *http.Request) {
+			app.badRequestResponse(w, r, errors.New("body must not be empty"))
+		}, http.StatusBadRequest, errCodeBadRequest, nil},
+		{"unsupported encoding", func(w http.ResponseWriter, r *http.Request) { app.badRequestResponse(w, r, errUnsupportedEncoding) },
+			http.StatusUnsupportedMediaType, errCodeUnsupportedMediaType, nil},
+		{"body too large", func(w http.ResponseWriter, r *http.Request) {
+			app.badRequestResponse(w, r, &http.MaxBytesError{Limit: 1024})
+		}, http.StatusRequestEntityTooLarge, errCodeBodyTooLarge, nil},
+		{"validation failed", func(w http.ResponseWriter, r *http.Request) {
+			app.failedValidationResponse(w, r, map[string][]validator.Message{"title": {validator.Msg("required")}})
+		}, http.StatusUnprocessableEntity, errCodeValidationFailed, []string{"title"}},
+		{"edit conflict", app.editConflictResponse, http.StatusConflict, errCodeEditConflict, nil},
+		{"rate limited", func(w http.ResponseWriter, r *http.Request) {
+			app.rateLimitExceededResponse(w, r, "", 1500*time.Millisecond)
+		}, http.StatusTooManyRequests, errCodeRateLimited, []string{"retry_after", "retry_at"}},
+		{"rate limited for a class", func(w http.ResponseWriter, r *http.Request) {
+			app.rateLimitExceededResponse(w, r, routeClassWrite, 1500*time.Millisecond)
+		}, http.StatusTooManyRequests, errCodeRateLimited, []string{"retry_after", "retry_at", "class"}},
+		{"idempotency key mismatch", app.idempotencyKeyMismatchResponse, http.StatusUnprocessableEntity, errCodeIdempotencyKeyMismatch, nil},
+		{"idempotency key in progress", app.idempotencyKeyInProgressResponse, http.StatusConflict, errCodeIdempotencyKeyInProgress, nil},
+		{"invalid credentials", app.invalidCredentialsResponse, http.StatusUnauthorized, errCodeInvalidCredentials, nil},
+		{"invalid token", app.invalidAuthenticationTokenResponse, http.StatusUnauthorized, errCodeInvalidToken, nil},
+		{"authentication required", app.authenticationRequiredResponse, http.StatusUnauthorized, errCodeAuthenticationRequired, nil},
+		{"inactive account", app.inactiveAccountResponse, http.StatusForbidden, errCodeInactiveAccount, nil},
+		{"not permitted", app.notPermittedResponse, http.StatusForbidden, errCodeNotPermitted, nil},
+		{"maintenance", app.maintenanceResponse, http.StatusServiceUnavailable, errCodeMaintenance, nil},
+		{"invalid config", func(w http.ResponseWriter, r *http.Request) {
+			app.invalidConfigResponse(w, r, errors.New("port must be between 1 and 65535, not 0"))
+		}, http.StatusUnprocessableEntity, errCodeInvalidConfig, nil},
+		{"database unavailable", func(w http.ResponseWriter, r *http.Request) {
+			app.serverErrorResponse(w, r, fmt.Errorf("get movie: %w", &data.UnavailableError{RetryAfter: 1500 * time.Millisecond}))
+		}, http.StatusServiceUnavailable, errCodeDatabaseUnavailable, []string{"retry_after"}},
+		{"https required", func(w http.ResponseWriter, r *http.Request) {
+			app.httpsRequiredResponse(w, r, "https://example.com/v1/movies")
+		}, http.StatusForbidden, errCodeHTTPSRequired, []string{"https_url"}},
+		{"invalid method override", func(w http.ResponseWriter, r *http.Request) {
+			app.invalidMethodOverrideResponse(w, r, "X-HTTP-Method-Override must be PATCH, PUT or DELETE")
+		}, http.StatusBadRequest, errCodeInvalidMethodOverride, nil},
+		{"job conflict", func(w http.ResponseWriter, r *http.Request) {
+			app.jobConflictResponse(w, r, "the movies are already being re-indexed", &data.Job{ID: 1})
+		}, http.StatusConflict, errCodeJobConflict, []string{"job_id"}},
+		{"duplicate movie", func(w http.ResponseWriter, r *http.Request) {
+			app.duplicateMovieResponse(w, r, []data.MovieCandidate{{Movie: &data.Movie{ID: 1, Title: "The Matrix"}, Score: 1}})
+		}, http.StatusConflict, errCodeDuplicateMovie, []string{"candidates"}},
+		{"resource in use", func(w http.ResponseWriter, r *http.Request) {
+			app.resourceInUseResponse(w, r, "credits")
+		}, http.StatusConflict, errCodeResourceInUse, []string{"resource"}},
+	}
+
+	codes := make(map[string]bool)
+	for _, code := range errorCodes {
+		codes[code] = true
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			tt.send(rr, httptest.NewRequest(http.MethodGet, "/", nil))
+
+			if rr.Code != tt.wantStatus {
+				t.Errorf("got status %d; want %d", rr.Code, tt.wantStatus)
+			}
+
+			var body map[string]json.RawMessage
+			err := json.Unmarshal(rr.Body.Bytes(), &body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Every error has the same shape: a message, a code, optional details and the
+			// meta object.
+			for key := range body {
+				if key != "error" && key != "code" && key != "details" && key != "meta" {
+					t.Errorf("got unexpected key %q in %s", key, rr.Body)
+				}
+			}
+
+			var message, code string
+			if json.Unmarshal(body["error"], &message) != nil || message == "" {
+				t.Errorf("got error %s; want a message", body["error"])
+			}
+
+			if json.Unmarshal(body["code"], &code) != nil || code != tt.wantCode {
+				t.Errorf("got code %s; want %q", body["code"], tt.wantCode)
+			}
+
+			if !codes[code] {
+				t.Errorf("code %q is missing from errorCodes", code)
+			}
+
+			if tt.wantDetails == nil {
+				if _, found := body["details"]; found {
+					t.Errorf("got details %s; want none", body["details"])
+				}
+				return
+			}
+
+			var details map[string]interface{}
+			err = json.Unmarshal(body["details"], &details)
+			if err != nil {
+				t.Fatalf("got details %s: %v", body["details"], err)
+			}
+
+			for _, key := range tt.wantDetails {
+				if _, found := details[key]; !found {
+					t.Errorf("details %v have no %q key", details, key)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// How long a finished export is kept before it has to be requested again.
+const exportTTL = time.Hour
+
+// Define an exportJob struct to hold the state of a single data export.
+type exportJob struct {
+	ID        string
+	UserID    int64
+	CreatedAt time.Time
+	Done      bool
+	Payload   []byte
+	Err       error
+}
+
+// Define an exportRegistry type which holds the export jobs in memory. Jobs are
+// removed once they're older than exportTTL.
+type exportRegistry struct {
+	mu   sync.Mutex
+	jobs map[string]*exportJob
+	// The now field is replaced in the tests, to move the clock forward.
+	now func() time.Time
+}
+
+func newExportRegistry() *exportRegistry {
+	return &exportRegistry{
+		jobs: make(map[string]*exportJob),
+		now:  time.Now,
+	}
+}
+
+// The start() method returns the user's existing unexpired job if there is one, and
+// otherwise registers a new pending job. The created return value reports which.
+func (e *exportRegistry) start(userID int64) (job *exportJob, created bool, err error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.sweep()
+
+	for _, job := range e.jobs {
+		if job.UserID == userID && job.Err == nil {
+			return job, false, nil
+		}
+	}
+
+	randomBytes := make([]byte, 16)
+
+	_, err = rand.Read(randomBytes)
+	if err != nil {
+		return nil, false, err
+	}
+
+	job = &exportJob{
+		ID:        base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes),
+		UserID:    userID,
+		CreatedAt: e.now(),
+	}
+
+	e.jobs[job.ID] = job
+
+	return job, true, nil
+}
+
+// The finish() method stores the result of a job.
+func (e *exportRegistry) finish(id string, payload []byte, err error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if job, found := e.jobs[id]; found {
+		job.Done = true
+		job.Payload = payload
+		job.Err = err
+	}
+}
+
+// The get() method returns a copy of a user's job, or false if there's no such
+// unexpired job for that user.
+func (e *exportRegistry) get(userID int64, id string) (exportJob, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.sweep()
+
+	job, found := e.jobs[id]
+	if !found || job.UserID != userID {
+		return exportJob{}, false
+	}
+
+	return *job, true
+}
+
+// The deleteForUser() method removes all of a user's jobs, finished or not. A job
+// which is still running is dropped when it finishes, as finish() ignores unknown IDs.
+func (e *exportRegistry) deleteForUser(userID int64) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for id, job := range e.jobs {
+		if job.UserID == userID {
+			delete(e.jobs, id)
+		}
+	}
+}
+
+// The sweep() method removes expired jobs. The mutex must be held by the caller.
+func (e *exportRegistry) sweep() {
+	for id, job := range e.jobs {
+		if e.now().Sub(job.CreatedAt) > exportTTL {
+			delete(e.jobs, id)
+		}
+	}
+}
+
+// The createExportHandler() starts building an export of everything we store about
+// the authenticated user, and returns the ID of the job to poll.
+func (app *application) createExportHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	job, created, err := app.exports.start(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// Build the export in the background, as aggregating everything can take a
+	// while.
+	if created {
+		requestID := app.contextGetRequestID(r)
+
+		app.background(func() {
+			payload, err := app.buildExport(user.ID)
+			if err != nil {
+				app.logger.PrintError(err, map[string]string{
+					"export_job_id": job.ID,
+					"request_id":    requestID,
+				})
+			}
+
+			app.exports.finish(job.ID, payload, err)
+		})
+	}
+
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/me/export/%s", job.ID))
+
+	err = app.writeResponse(w, r, http.StatusAccepted, envelope{"export": envelope{"id": job.ID, "created_at": job.CreatedAt}}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The showExportHandler() returns the export as a JSON attachment once it's ready, and
+// a 202 Accepted response while it's still being built.
+func (app *application) showExportHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	id := httprouter.ParamsFromContext(r.Context()).ByName("job_id")
+
+	job, found := app.exports.get(user.ID, id)
+	if !found {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	switch {
+	case !job.Done:
+		err := app.writeResponse(w, r, http.StatusAccepted, envelope{"export": envelope{"id": job.ID, "created_at": job.CreatedAt}}, nil)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
+	case job.Err != nil:
+		app.serverErrorResponse(w, r, job.Err)
+	default:
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="export-%d.json"`, user.ID))
+		w.WriteHeader(http.StatusOK)
+		w.Write(job.Payload)
+	}
+}
+
+// The buildExport() helper gathers everything we store about a user into a single
+// JSON document.
+func (app *application) buildExport(userID int64) ([]byte, error) {
+	user, err := app.models.Users.Get(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	permissions, err := app.models.Permissions.GetAllForUser(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	roles, err := app.models.Roles.GetAllForUser(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	logins, err := app.models.Logins.GetAllForUser(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	searches, err := app.models.SavedSearches.GetAllForUser(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	watchlist, err := app.models.Watchlist.GetAllForUser(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	reports, err := app.models.Reports.GetAllForUser(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	export := envelope{
+		"exported_at":    time.Now().UTC(),
+		"user":           user,
+		"permissions":    permissions,
+		"roles":          roles,
+		"logins":         logins,
+		"saved_searches": searches,
+		"watchlist":      watchlist,
+		"reports":        reports,
+	}
+
+	js, err := json.MarshalIndent(export, "", "\t")
+	if err != nil {
+		return nil, err
+	}
+
+	return append(js, '\n'), nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// An export is pending until its job finishes, is downloaded once it's ready, and is
+// gone once it's older than exportTTL, after which asking again starts a new job.
+func TestExportHandlers(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t)
+
+	now := time.Date(2027, 1, 2, 15, 4, 0, 0, time.UTC)
+	app.exports.now = func() time.Time { return now }
+
+	user, token := newTestUser(t, app, "alice")
+	_, otherToken := newTestUser(t, app, "bob")
+
+	// Register the job ourselves, so that it stays pending until we finish it.
+	job, _, err := app.exports.start(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code, body := ts.do(t, http.MethodGet, "/v1/me/export", token, nil)
+	if code != http.StatusAccepted || body["export"].(map[string]interface{})["id"] != job.ID {
+		t.Fatalf("got %d %v; want 202 and the pending job %s", code, body, job.ID)
+	}
+
+	code, body = ts.do(t, http.MethodGet, "/v1/me/export/"+job.ID, token, nil)
+	if code != http.StatusAccepted || body["export"] == nil {
+		t.Fatalf("got %d %v for the pending job; want 202", code, body)
+	}
+
+	// Another user can't see the job.
+	code, _ = ts.do(t, http.MethodGet, "/v1/me/export/"+job.ID, otherToken, nil)
+	if code != http.StatusNotFound {
+		t.Errorf("got %d for another user's job; want 404", code)
+	}
+
+	payload, err := app.buildExport(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.exports.finish(job.ID, payload, nil)
+
+	res, err := ts.Client().Get(ts.URL + "/v1/me/export/" + job.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("got %d without a token; want 401", res.StatusCode)
+	}
+
+	now = now.Add(exportTTL)
+
+	code, body = ts.do(t, http.MethodGet, "/v1/me/export/"+job.ID, token, nil)
+	if code != http.StatusOK || body["user"] == nil || body["exported_at"] == nil {
+		t.Fatalf("got %d %v for the finished job; want 200 and the export", code, body)
+	}
+
+	// Just past the TTL the job has expired.
+	now = now.Add(time.Second)
+
+	code, _ = ts.do(t, http.MethodGet, "/v1/me/export/"+job.ID, token, nil)
+	if code != http.StatusNotFound {
+		t.Fatalf("got %d for the expired job; want 404", code)
+	}
+
+	code, body = ts.do(t, http.MethodGet, "/v1/me/export", token, nil)
+	if code != http.StatusAccepted {
+		t.Fatalf("got %d %v; want 202", code, body)
+	}
+
+	id, _ := body["export"].(map[string]interface{})["id"].(string)
+	if id == "" || id == job.ID {
+		t.Fatalf("got job %q after the first expired; want a new one", id)
+	}
+
+	// Wait for the background job to build the new export.
+	app.wg.Wait()
+
+	code, body = ts.do(t, http.MethodGet, "/v1/me/export/"+id, token, nil)
+	if code != http.StatusOK || body["user"].(map[string]interface{})["email"] != "alice@example.com" {
+		t.Errorf("got %d %v for the new job; want 200 and alice's export", code, body)
+	}
+}
+
+// A job which failed is reported as a server error, and asking for an export again
+// starts a new job rather than returning the failed one.
+func TestExportFailed(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t)
+
+	user, token := newTestUser(t, app, "alice")
+
+	job, _, err := app.exports.start(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.exports.finish(job.ID, nil, errors.New("database is down"))
+
+	code, body := ts.do(t, http.MethodGet, "/v1/me/export/"+job.ID, token, nil)
+	if code != http.StatusInternalServerError || body["error"] == nil {
+		t.Errorf("got %d %v for the failed job; want 500", code, body)
+	}
+
+	code, body = ts.do(t, http.MethodGet, "/v1/me/export", token, nil)
+	if code != http.StatusAccepted || body["export"].(map[string]interface{})["id"] == job.ID {
+		t.Errorf("got %d %v; want 202 and a new job", code, body)
+	}
+
+	app.wg.Wait()
+}
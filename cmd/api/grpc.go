@@ -0,0 +1,564 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"runtime/debug"
+	"strconv"
+	"strings"
+
+	"github.com/petrostrak/an-open-movie-database/internal/data"
+	"github.com/petrostrak/an-open-movie-database/internal/grpc/moviepb"
+	"github.com/petrostrak/an-open-movie-database/internal/validator"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// The permission each MovieService method needs, as for the matching REST endpoint.
+var grpcPermissions = map[string]string{
+	moviepb.MovieService_GetMovie_FullMethodName:    "movies:read",
+	moviepb.MovieService_ListMovies_FullMethodName:  "movies:read",
+	moviepb.MovieService_CreateMovie_FullMethodName: "movies:write",
+	moviepb.MovieService_UpdateMovie_FullMethodName: "movies:write",
+	moviepb.MovieService_DeleteMovie_FullMethodName: "movies:write",
+}
+
+// The fields of a movie which UpdateMovie's update mask can name.
+var movieUpdateFields = []string{"title", "year", "runtime", "genres", "awards", "external_ratings", "plot", "poster"}
+
+// The newGRPCServer() method returns a gRPC server with the MovieService registered,
+// for internal consumers such as the recommendation service. It shares the models with
+// the REST API, so both see the same movies.
+func (app *application) newGRPCServer() *grpc.Server {
+	srv := grpc.NewServer(grpc.UnaryInterceptor(app.grpcInterceptor))
+	moviepb.RegisterMovieServiceServer(srv, &movieServer{app: app})
+
+	return srv
+}
+
+// The serveGRPC() method starts the gRPC server on -grpc-port, if it's set, and returns
+// a function which stops it gracefully, waiting for the calls in progress until ctx is
+// done. The function does nothing if the server wasn't started.
+func (app *application) serveGRPC() (func(ctx context.Context), error) {
+	if app.config.grpc.port == 0 {
+		return func(ctx context.Context) {}, nil
+	}
+
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", app.config.grpc.port))
+	if err != nil {
+		return nil, err
+	}
+
+	srv := app.newGRPCServer()
+
+	app.logger.PrintInfo("starting gRPC server", map[string]string{
+		"addr": listener.Addr().String(),
+	})
+
+	go func() {
+		err := srv.Serve(listener)
+		if err != nil {
+			app.logger.PrintError(err, map[string]string{"addr": listener.Addr().String()})
+		}
+	}()
+
+	return func(ctx context.Context) { stopGRPCServer(ctx, srv) }, nil
+}
+
+// The stopGRPCServer() function stops the server accepting calls and waits for those in
+// progress to finish. If ctx is done first, it stops the server straight away, cancelling
+// the calls which are left.
+func stopGRPCServer(ctx context.Context, srv *grpc.Server) {
+	stopped := make(chan struct{})
+
+	go func() {
+		srv.GracefulStop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		srv.Stop()
+		<-stopped
+	}
+}
+
+// The grpcInterceptor() method runs before each gRPC call, doing what the middleware does
+// for a REST request: it recovers a panic, authenticates the caller from the bearer token
+// in the "authorization" metadata, and checks that they're activated and have the
+// permission the method needs.
+//
+// The call is described by an *http.Request, carrying the metadata as headers and the
+// user in its context, so that the helpers the REST handlers use for logging, auditing
+// and reading a movie listing work unchanged.
+func (app *application) grpcInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
+	r, err := grpcRequest(ctx, info.FullMethod)
+	if err != nil {
+		return nil, app.grpcServerError(r, err)
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			totalPanicsRecovered.Add(1)
+
+			app.logPanic(r, p, debug.Stack(), "")
+			resp, err = nil, status.Error(codes.Internal, "the server encountered a problem and could not process your request")
+		}
+	}()
+
+	user, err := app.grpcAuthenticate(r)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case user.IsAnonymous():
+		return nil, status.Error(codes.Unauthenticated, "you must be authenticated to access this resource")
+	case !user.Activated:
+		return nil, status.Error(codes.PermissionDenied, "your user account must be activated to access this resource")
+	}
+
+	permissions, err := app.userPermissions(user.ID)
+	if err != nil {
+		return nil, app.grpcServerError(r, err)
+	}
+
+	if !permissions.Include(grpcPermissions[info.FullMethod]) {
+		return nil, status.Error(codes.PermissionDenied, "your user account doesn't have the necessary permissions to access this resource")
+	}
+
+	r = app.contextSetUser(r, user)
+
+	return handler(r.Context(), req)
+}
+
+// The grpcRequest() function returns an *http.Request describing a gRPC call, with the
+// call's metadata as its headers and the caller's address as its RemoteAddr.
+func grpcRequest(ctx context.Context, method string) (*http.Request, error) {
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, method, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		for key, values := range md {
+			// Leave out the pseudo-headers, such as ":authority".
+			if !strings.HasPrefix(key, ":") {
+				r.Header[http.CanonicalHeaderKey(key)] = values
+			}
+		}
+	}
+
+	if p, ok := peer.FromContext(ctx); ok {
+		r.RemoteAddr = p.Addr.String()
+	}
+
+	return r, nil
+}
+
+// The grpcAuthenticate() method returns the user for the bearer token in a call's
+// "authorization" metadata, in the same way as the authenticate() middleware, or the
+// AnonymousUser if there isn't one.
+func (app *application) grpcAuthenticate(r *http.Request) (*data.User, error) {
+	authorization := r.Header.Get("Authorization")
+	if authorization == "" {
+		return data.AnonymousUser, nil
+	}
+
+	invalidToken := status.Error(codes.Unauthenticated, "invalid or missing authentication token")
+
+	headerParts := strings.Split(authorization, " ")
+	if len(headerParts) != 2 || headerParts[0] != "Bearer" {
+		return nil, invalidToken
+	}
+
+	token := headerParts[1]
+
+	var (
+		user *data.User
+		err  error
+	)
+
+	if app.jwt != nil {
+		user, err = app.userForJWT(token)
+	} else {
+		v := validator.New()
+		if data.ValidateTokenPlaintext(v, token); !v.Valid() {
+			return nil, invalidToken
+		}
+
+		user, err = app.userForToken(token)
+	}
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			return nil, invalidToken
+		default:
+			return nil, app.grpcServerError(r, err)
+		}
+	}
+
+	return user, nil
+}
+
+// The grpcServerError() method logs and reports an unexpected error, as the
+// serverErrorResponse() helper does, and returns the Internal status to send instead.
+// An open database circuit breaker is Unavailable, so that the client knows to retry.
+func (app *application) grpcServerError(r *http.Request, err error) error {
+	var unavailableErr *data.UnavailableError
+	if errors.As(err, &unavailableErr) {
+		return status.Error(codes.Unavailable, "the database is unavailable, please try again later")
+	}
+
+	if r != nil {
+		app.logError(r, err)
+		app.reportError(r, err, nil)
+	} else {
+		app.logger.PrintError(err, nil)
+	}
+
+	return status.Error(codes.Internal, "the server encountered a problem and could not process your request")
+}
+
+// The grpcValidationError() method returns the InvalidArgument status for failed
+// validation, with the messages for each field in a ValidationErrors message in its
+// details. The messages are in the language from the "accept-language" metadata, as
+// for the REST API's validation_failed responses.
+func (app *application) grpcValidationError(r *http.Request, errors map[string][]validator.Message) error {
+	locale := negotiateLanguage(r.Header.Get("Accept-Language"), validator.Locales(), app.config.defaultLocale)
+
+	details := &moviepb.ValidationErrors{Fields: make(map[string]*moviepb.FieldErrors)}
+	for field, messages := range validator.Render(errors, locale) {
+		details.Fields[field] = &moviepb.FieldErrors{Messages: messages}
+	}
+
+	st, err := status.New(codes.InvalidArgument, "the request failed validation").WithDetails(details)
+	if err != nil {
+		return app.grpcServerError(r, err)
+	}
+
+	return st.Err()
+}
+
+// Define a movieServer type which implements the MovieService. Its methods mirror the
+// handlers of the movie endpoints, and are only called once grpcInterceptor() has
+// authenticated the caller.
+type movieServer struct {
+	moviepb.UnimplementedMovieServiceServer
+	app *application
+}
+
+func (s *movieServer) GetMovie(ctx context.Context, req *moviepb.GetMovieRequest) (*moviepb.Movie, error) {
+	r := s.request(ctx, moviepb.MovieService_GetMovie_FullMethodName)
+
+	movie, err := s.app.models.Movies.Get(req.GetId())
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows), errors.Is(err, data.ErrRecordNotFound):
+			return nil, status.Error(codes.NotFound, "the requested resource could not be found")
+		default:
+			return nil, s.app.grpcServerError(r, err)
+		}
+	}
+
+	// Count the view towards the movie's popularity, as for GET /v1/movies/:id.
+	s.app.views.add(movie.ID, 1)
+
+	return moviePB(movie), nil
+}
+
+func (s *movieServer) ListMovies(ctx context.Context, req *moviepb.ListMoviesRequest) (*moviepb.ListMoviesResponse, error) {
+	r := s.request(ctx, moviepb.MovieService_ListMovies_FullMethodName)
+
+	// Build the query string of the matching GET /v1/movies request, so that the
+	// listing gets exactly the same defaults and checks. A zero value is left out, to
+	// take the default.
+	qs := make(url.Values)
+
+	if req.GetTitle() != "" {
+		qs.Set("title", req.GetTitle())
+	}
+
+	if len(req.GetGenres()) > 0 {
+		qs.Set("genres", strings.Join(req.GetGenres(), ","))
+	}
+
+	if req.HasAwards != nil {
+		qs.Set("has_awards", strconv.FormatBool(req.GetHasAwards()))
+	}
+
+	if req.GetCreatedBy() != 0 {
+		qs.Set("created_by", strconv.FormatInt(req.GetCreatedBy(), 10))
+	}
+
+	if req.GetPage() != 0 {
+		qs.Set("page", strconv.Itoa(int(req.GetPage())))
+	}
+
+	if req.GetPageSize() != 0 {
+		qs.Set("page_size", strconv.Itoa(int(req.GetPageSize())))
+	}
+
+	if req.GetSort() != "" {
+		qs.Set("sort", req.GetSort())
+	}
+
+	v := validator.New()
+
+	input, err := s.app.readMovieListing(r, qs, v)
+	if err != nil {
+		return nil, s.app.grpcServerError(r, err)
+	}
+
+	if !v.Valid() {
+		return nil, s.app.grpcValidationError(r, v.Errors)
+	}
+
+	movies, metadata, err := s.app.models.Movies.GetAll(input.MovieFilters, input.Filters)
+	if err != nil {
+		return nil, s.app.grpcServerError(r, err)
+	}
+
+	res := &moviepb.ListMoviesResponse{
+		Movies: make([]*moviepb.Movie, len(movies)),
+		Metadata: &moviepb.Metadata{
+			CurrentPage:  int32(metadata.CurrentPage),
+			PageSize:     int32(metadata.PageSize),
+			FirstPage:    int32(metadata.FirstPage),
+			LastPage:     int32(metadata.LastPage),
+			TotalRecords: int32(metadata.TotalRecords),
+		},
+	}
+
+	for i, movie := range movies {
+		res.Movies[i] = moviePB(movie)
+	}
+
+	return res, nil
+}
+
+func (s *movieServer) CreateMovie(ctx context.Context, req *moviepb.CreateMovieRequest) (*moviepb.Movie, error) {
+	r := s.request(ctx, moviepb.MovieService_CreateMovie_FullMethodName)
+
+	input := req.GetMovie()
+
+	movie := &data.Movie{
+		Title:           input.GetTitle(),
+		Year:            input.GetYear(),
+		Runtime:         data.Runtime(input.GetRuntime()),
+		Genres:          input.GetGenres(),
+		Awards:          awardsFromPB(input.GetAwards()),
+		ExternalRatings: externalRatingsFromPB(input.GetExternalRatings()),
+		Plot:            input.GetPlot(),
+		Poster:          input.GetPoster(),
+	}
+
+	v := validator.New()
+
+	if data.ValidateMovie(v, movie); !v.Valid() {
+		return nil, s.app.grpcValidationError(r, v.Errors)
+	}
+
+	user := s.app.contextGetUser(r)
+	movie.CreatedBy = &data.UserRef{ID: user.ID, Name: user.Name}
+
+	err := s.app.models.Movies.Insert(movie)
+	if err != nil {
+		return nil, s.app.grpcServerError(r, err)
+	}
+
+	s.app.recordAudit(r, data.AuditEntry{
+		Action:       "movie.create",
+		ResourceType: "movie",
+		ResourceID:   strconv.FormatInt(movie.ID, 10),
+	})
+
+	s.app.fireWebhook(data.WebhookMovieCreated, envelope{"movie": formatMovie(movie, apiV1, s.app.config.runtimeFormat)})
+
+	return moviePB(movie), nil
+}
+
+func (s *movieServer) UpdateMovie(ctx context.Context, req *moviepb.UpdateMovieRequest) (*moviepb.Movie, error) {
+	r := s.request(ctx, moviepb.MovieService_UpdateMovie_FullMethodName)
+
+	movie, err := s.app.models.Movies.Get(req.GetId())
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows), errors.Is(err, data.ErrRecordNotFound):
+			return nil, status.Error(codes.NotFound, "the requested resource could not be found")
+		default:
+			return nil, s.app.grpcServerError(r, err)
+		}
+	}
+
+	editConflict := status.Error(codes.FailedPrecondition, "unable to update the record due to an edit conflict, please try again")
+
+	if req.GetExpectedVersion() != 0 && req.GetExpectedVersion() != movie.Version {
+		return nil, editConflict
+	}
+
+	before := *movie
+
+	// Copy the fields named in the update mask, as a PATCH request copies the fields
+	// present in its body.
+	input := req.GetMovie()
+	v := validator.New()
+
+	for _, field := range req.GetUpdateMask() {
+		switch field {
+		case "title":
+			movie.Title = input.GetTitle()
+		case "year":
+			movie.Year = input.GetYear()
+		case "runtime":
+			movie.Runtime = data.Runtime(input.GetRuntime())
+		case "genres":
+			movie.Genres = input.GetGenres()
+		case "awards":
+			movie.Awards = awardsFromPB(input.GetAwards())
+		case "external_ratings":
+			movie.ExternalRatings = externalRatingsFromPB(input.GetExternalRatings())
+		case "plot":
+			movie.Plot = input.GetPlot()
+		case "poster":
+			movie.Poster = input.GetPoster()
+		default:
+			v.AddError("update_mask", validator.Msg("unknown_field", "field", field, "fields", strings.Join(movieUpdateFields, ", ")))
+		}
+	}
+
+	if data.ValidateMovie(v, movie); !v.Valid() {
+		return nil, s.app.grpcValidationError(r, v.Errors)
+	}
+
+	user := s.app.contextGetUser(r)
+	movie.UpdatedBy = &data.UserRef{ID: user.ID, Name: user.Name}
+
+	err = s.app.models.Movies.Update(movie)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			return nil, editConflict
+		default:
+			return nil, s.app.grpcServerError(r, err)
+		}
+	}
+
+	s.app.recordAudit(r, data.AuditEntry{
+		Action:       "movie.update",
+		ResourceType: "movie",
+		ResourceID:   strconv.FormatInt(movie.ID, 10),
+		Metadata:     map[string]interface{}{"version": movie.Version},
+	})
+
+	s.app.fireWebhook(data.WebhookMovieUpdated, envelope{"movie": formatMovie(movie, apiV1, s.app.config.runtimeFormat)})
+	s.app.notifyWatchers(&before, movie)
+
+	return moviePB(movie), nil
+}
+
+func (s *movieServer) DeleteMovie(ctx context.Context, req *moviepb.DeleteMovieRequest) (*moviepb.DeleteMovieResponse, error) {
+	r := s.request(ctx, moviepb.MovieService_DeleteMovie_FullMethodName)
+
+	deletion, err := s.app.models.Movies.Delete(req.GetId())
+	if err != nil {
+		var inUse *data.InUseError
+
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			return nil, status.Error(codes.NotFound, "the requested resource could not be found")
+		case errors.As(err, &inUse):
+			return nil, status.Errorf(codes.FailedPrecondition, "this resource can't be deleted while there are %s which refer to it", strings.ReplaceAll(inUse.Table, "_", " "))
+		default:
+			return nil, s.app.grpcServerError(r, err)
+		}
+	}
+
+	s.app.recordAudit(r, data.AuditEntry{
+		Action:       "movie.delete",
+		ResourceType: "movie",
+		ResourceID:   strconv.FormatInt(req.GetId(), 10),
+		Metadata:     map[string]interface{}{"deleted": deletion},
+	})
+
+	s.app.fireWebhook(data.WebhookMovieDeleted, envelope{"movie": envelope{"id": req.GetId()}})
+
+	return &moviepb.DeleteMovieResponse{
+		Ratings:          deletion.Ratings,
+		Reviews:          deletion.Reviews,
+		WatchlistEntries: deletion.WatchlistEntries,
+		Reports:          deletion.Reports,
+	}, nil
+}
+
+// The request() method returns the *http.Request describing a call, with the user
+// which grpcInterceptor() authenticated in its context.
+func (s *movieServer) request(ctx context.Context, method string) *http.Request {
+	r, _ := grpcRequest(ctx, method)
+	return r
+}
+
+// The moviePB() function converts a movie to its protobuf message.
+func moviePB(movie *data.Movie) *moviepb.Movie {
+	pb := &moviepb.Movie{
+		Id:        movie.ID,
+		Title:     movie.Title,
+		Year:      movie.Year,
+		Runtime:   int32(movie.Runtime),
+		Genres:    movie.Genres,
+		Version:   movie.Version,
+		UpdatedAt: timestamppb.New(movie.UpdatedAt),
+		Plot:      movie.Plot,
+		Poster:    movie.Poster,
+	}
+
+	for _, award := range movie.Awards {
+		pb.Awards = append(pb.Awards, &moviepb.Award{Name: award.Name, Category: award.Category, Year: award.Year, Won: award.Won})
+	}
+
+	for _, rating := range movie.ExternalRatings {
+		pb.ExternalRatings = append(pb.ExternalRatings, &moviepb.ExternalRating{Source: rating.Source, Score: rating.Score, Scale: rating.Scale})
+	}
+
+	if movie.CreatedBy != nil {
+		pb.CreatedBy = &moviepb.UserRef{Id: movie.CreatedBy.ID, Name: movie.CreatedBy.Name}
+	}
+
+	if movie.UpdatedBy != nil {
+		pb.UpdatedBy = &moviepb.UserRef{Id: movie.UpdatedBy.ID, Name: movie.UpdatedBy.Name}
+	}
+
+	return pb
+}
+
+// The awardsFromPB() function converts the awards of a MovieInput message, leaving them
+// nil if there are none, as for a JSON body without any.
+func awardsFromPB(pbs []*moviepb.Award) data.Awards {
+	var awards data.Awards
+	for _, pb := range pbs {
+		awards = append(awards, data.Award{Name: pb.GetName(), Category: pb.GetCategory(), Year: pb.GetYear(), Won: pb.GetWon()})
+	}
+
+	return awards
+}
+
+// The externalRatingsFromPB() function converts the external ratings of a MovieInput
+// message, leaving them nil if there are none.
+func externalRatingsFromPB(pbs []*moviepb.ExternalRating) data.ExternalRatings {
+	var ratings data.ExternalRatings
+	for _, pb := range pbs {
+		ratings = append(ratings, data.ExternalRating{Source: pb.GetSource(), Score: pb.GetScore(), Scale: pb.GetScale()})
+	}
+
+	return ratings
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/petrostrak/an-open-movie-database/internal/grpc/moviepb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// The newTestGRPCClient() helper serves the MovieService over an in-memory listener,
+// and returns a client connected to it.
+func newTestGRPCClient(t *testing.T, app *application) moviepb.MovieServiceClient {
+	t.Helper()
+
+	lis := bufconn.Listen(1 << 20)
+	srv := app.newGRPCServer()
+
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return moviepb.NewMovieServiceClient(conn)
+}
+
+// The withToken() helper returns a context which sends token as the bearer token,
+// along with any other metadata given as key/value pairs.
+func withToken(token string, kv ...string) context.Context {
+	ctx := context.Background()
+	if token != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+token)
+	}
+
+	return metadata.AppendToOutgoingContext(ctx, kv...)
+}
+
+func assertCode(t *testing.T, err error, want codes.Code) {
+	t.Helper()
+
+	if got := status.Code(err); got != want {
+		t.Fatalf("got code %s; want %s (%v)", got, want, err)
+	}
+}
+
+func TestGRPCAuthentication(t *testing.T) {
+	app := newTestApplication(t)
+	client := newTestGRPCClient(t, app)
+
+	_, reader := newTestUser(t, app, "reader", "reader")
+	ids := seedMovies(t, app, 1)
+
+	_, err := client.GetMovie(withToken(""), &moviepb.GetMovieRequest{Id: ids[0]})
+	assertCode(t, err, codes.Unauthenticated)
+
+	_, err = client.GetMovie(withToken("ABCDEFGHIJKLMNOPQRSTUVWXYZ"), &moviepb.GetMovieRequest{Id: ids[0]})
+	assertCode(t, err, codes.Unauthenticated)
+
+	movie, err := client.GetMovie(withToken(reader), &moviepb.GetMovieRequest{Id: ids[0]})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if movie.GetTitle() != "Movie 1" {
+		t.Errorf("got title %q; want %q", movie.GetTitle(), "Movie 1")
+	}
+
+	_, err = client.ListMovies(withToken(reader), &moviepb.ListMoviesRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = client.CreateMovie(withToken(reader), &moviepb.CreateMovieRequest{
+		Movie: &moviepb.MovieInput{Title: "Moana", Year: 2016, Runtime: 107, Genres: []string{"animation"}},
+	})
+	assertCode(t, err, codes.PermissionDenied)
+}
+
+func TestGRPCMovies(t *testing.T) {
+	app := newTestApplication(t)
+	client := newTestGRPCClient(t, app)
+
+	_, editor := newTestUser(t, app, "editor", "editor")
+	ctx := withToken(editor)
+
+	created, err := client.CreateMovie(ctx, &moviepb.CreateMovieRequest{
+		Movie: &moviepb.MovieInput{Title: "Moana", Year: 2016, Runtime: 107, Genres: []string{"animation", "adventure"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if created.GetCreatedBy().GetName() != "editor" {
+		t.Errorf("got created_by %v; want the editor", created.GetCreatedBy())
+	}
+
+	got, err := client.GetMovie(ctx, &moviepb.GetMovieRequest{Id: created.GetId()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got.GetTitle() != "Moana" || got.GetRuntime() != 107 {
+		t.Errorf("got %q (%d mins); want %q (107 mins)", got.GetTitle(), got.GetRuntime(), "Moana")
+	}
+
+	updated, err := client.UpdateMovie(ctx, &moviepb.UpdateMovieRequest{
+		Id:              created.GetId(),
+		Movie:           &moviepb.MovieInput{Title: "Moana 2", Year: 1900},
+		UpdateMask:      []string{"title"},
+		ExpectedVersion: created.GetVersion(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if updated.GetTitle() != "Moana 2" || updated.GetYear() != 2016 {
+		t.Errorf("got %q (%d); want only the title updated", updated.GetTitle(), updated.GetYear())
+	}
+
+	if updated.GetVersion() != created.GetVersion()+1 {
+		t.Errorf("got version %d; want %d", updated.GetVersion(), created.GetVersion()+1)
+	}
+
+	_, err = client.UpdateMovie(ctx, &moviepb.UpdateMovieRequest{
+		Id:              created.GetId(),
+		Movie:           &moviepb.MovieInput{Title: "Moana 3"},
+		UpdateMask:      []string{"title"},
+		ExpectedVersion: created.GetVersion(),
+	})
+	assertCode(t, err, codes.FailedPrecondition)
+
+	_, err = client.UpdateMovie(ctx, &moviepb.UpdateMovieRequest{
+		Id:         created.GetId(),
+		Movie:      &moviepb.MovieInput{},
+		UpdateMask: []string{"director"},
+	})
+	assertCode(t, err, codes.InvalidArgument)
+
+	res, err := client.DeleteMovie(ctx, &moviepb.DeleteMovieRequest{Id: created.GetId()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.GetRatings() != 0 || res.GetReviews() != 0 {
+		t.Errorf("got %v; want nothing else deleted", res)
+	}
+
+	_, err = client.GetMovie(ctx, &moviepb.GetMovieRequest{Id: created.GetId()})
+	assertCode(t, err, codes.NotFound)
+
+	_, err = client.DeleteMovie(ctx, &moviepb.DeleteMovieRequest{Id: created.GetId()})
+	assertCode(t, err, codes.NotFound)
+}
+
+func TestGRPCListMovies(t *testing.T) {
+	app := newTestApplication(t)
+	client := newTestGRPCClient(t, app)
+
+	_, reader := newTestUser(t, app, "reader", "reader")
+	seedMovies(t, app, 5)
+
+	res, err := client.ListMovies(withToken(reader), &moviepb.ListMoviesRequest{PageSize: 2, Page: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(res.GetMovies()) != 2 || res.GetMovies()[0].GetTitle() != "Movie 3" {
+		t.Errorf("got %v; want movies 3 and 4", res.GetMovies())
+	}
+
+	want := &moviepb.Metadata{CurrentPage: 2, PageSize: 2, FirstPage: 1, LastPage: 3, TotalRecords: 5}
+	if got := res.GetMetadata(); got.String() != want.String() {
+		t.Errorf("got metadata %v; want %v", got, want)
+	}
+
+	_, err = client.ListMovies(withToken(reader), &moviepb.ListMoviesRequest{Sort: "director"})
+	assertCode(t, err, codes.InvalidArgument)
+}
+
+func TestGRPCValidationError(t *testing.T) {
+	app := newTestApplication(t)
+	client := newTestGRPCClient(t, app)
+
+	_, editor := newTestUser(t, app, "editor", "editor")
+
+	tests := []struct {
+		name   string
+		locale string
+		want   string
+	}{
+		{"Default", "", "must be provided"},
+		{"Greek", "el", "πρέπει να δοθεί"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := withToken(editor)
+			if tt.locale != "" {
+				ctx = withToken(editor, "accept-language", tt.locale)
+			}
+
+			_, err := client.CreateMovie(ctx, &moviepb.CreateMovieRequest{
+				Movie: &moviepb.MovieInput{Year: 2016, Runtime: 107, Genres: []string{"animation"}},
+			})
+			assertCode(t, err, codes.InvalidArgument)
+
+			var details *moviepb.ValidationErrors
+			for _, detail := range status.Convert(err).Details() {
+				if d, ok := detail.(*moviepb.ValidationErrors); ok {
+					details = d
+				}
+			}
+
+			if details == nil {
+				t.Fatalf("got details %v; want a ValidationErrors message", status.Convert(err).Details())
+			}
+
+			messages := details.GetFields()["title"].GetMessages()
+			if len(messages) == 0 || messages[0] != tt.want {
+				t.Errorf("got title messages %q; want %q", messages, tt.want)
+			}
+		})
+	}
+}
+
+func TestStopGRPCServer(t *testing.T) {
+	app := newTestApplication(t)
+
+	lis := bufconn.Listen(1 << 20)
+	srv := app.newGRPCServer()
+
+	served := make(chan struct{})
+	go func() {
+		srv.Serve(lis)
+		close(served)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	stopGRPCServer(ctx, srv)
+
+	select {
+	case <-served:
+	case <-time.After(time.Second):
+		t.Fatal("the server is still serving after stopGRPCServer() returned")
+	}
+}
@@ -1,7 +1,12 @@
 package main
 
 import (
+	"errors"
 	"net/http"
+	"strconv"
+
+	"github.com/petrostrak/an-open-movie-database/internal/data"
+	"github.com/petrostrak/an-open-movie-database/internal/migrate"
 )
 
 // Declare a handler which writes a plain-text response with information about the
@@ -13,14 +18,134 @@ func (app *application) healthcheckHandler(w http.ResponseWriter, r *http.Reques
 	env := envelope{
 		"status": "available",
 		"system_info": map[string]string{
-			"environment": app.config.env,
-			"version":     version,
+			"environment":           app.config.env,
+			"version":               build.Version,
+			"revision":              build.Revision,
+			"modified":              strconv.FormatBool(build.Modified),
+			"commit_time":           build.CommitTime,
+			"build_time":            build.BuildTime,
+			"go_version":            build.GoVersion,
+			"token_auth_ttl":        app.config.tokens.authTTL.String(),
+			"token_activation_ttl":  app.config.tokens.activationTTL.String(),
+			"token_unsubscribe_ttl": app.config.tokens.unsubscribeTTL.String(),
+			"token_length":          strconv.Itoa(app.config.tokens.length),
 		},
 	}
 
-	if err := app.writeJSON(w, http.StatusOK, env, nil); err != nil {
+	// While the primary database's circuit breaker is open, report the application as
+	// unavailable with a 503 response, so that a load balancer using this as its
+	// readiness check stops sending us requests until the breaker lets one through.
+	status := http.StatusOK
+
+	if app.breakers.primary != nil {
+		state := app.breakers.primary.State()
+		env["database_breaker"] = state.String()
+
+		if state == data.BreakerOpen {
+			env["status"] = "unavailable"
+			status = http.StatusServiceUnavailable
+		}
+	}
+
+	// Likewise while a critical background worker is stale, as the emails it should be
+	// sending, say, are piling up.
+	if stale := app.workers.staleCritical(app.config.criticalWorkers); len(stale) > 0 {
+		env["status"] = "unavailable"
+		env["stale_workers"] = stale
+		status = http.StatusServiceUnavailable
+	}
+
+	// With ?verbose=true, administrators also get a summary of the database
+	// connection pool, which shows whether requests are waiting for a connection,
+	// the schema version, and the status of the background workers. Anyone else gets
+	// the usual response.
+	if verbose, _ := strconv.ParseBool(r.URL.Query().Get("verbose")); verbose {
+		admin, err := app.isAdmin(r)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		if admin {
+			stats := app.db.Stats()
+
+			database := map[string]interface{}{
+				"open_connections": stats.OpenConnections,
+				"in_use":           stats.InUse,
+				"idle":             stats.Idle,
+				"wait_count":       stats.WaitCount,
+				"wait_duration":    stats.WaitDuration.String(),
+				// The effective pool settings, which the read replica pool shares.
+				// Zero means no limit.
+				"max_open_connections": stats.MaxOpenConnections,
+				"max_idle_connections": app.config.db.maxIdleConns,
+				"max_idle_time":        app.config.db.maxIdleTime.String(),
+				"max_lifetime":         app.config.db.maxLifetime.String(),
+			}
+
+			// The schema version is null until the first migration is applied.
+			version, dirty, err := app.migrator.Version()
+			switch {
+			case err == nil:
+				database["schema_version"] = version
+				database["schema_dirty"] = dirty
+			case errors.Is(err, migrate.ErrNilVersion):
+				database["schema_version"] = nil
+			default:
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+
+			database["schema_latest"] = app.migrator.Latest()
+
+			if app.breakers.primary != nil {
+				database["breaker"] = app.breakers.primary.Stats()
+			}
+
+			env["database"] = database
+
+			// Include the read replica's pool, when there is one.
+			if app.readDB != nil {
+				stats := app.readDB.Stats()
+
+				databaseRead := map[string]interface{}{
+					"open_connections": stats.OpenConnections,
+					"in_use":           stats.InUse,
+					"idle":             stats.Idle,
+					"wait_count":       stats.WaitCount,
+					"wait_duration":    stats.WaitDuration.String(),
+				}
+
+				if app.breakers.read != nil {
+					databaseRead["breaker"] = app.breakers.read.Stats()
+				}
+
+				env["database_read"] = databaseRead
+			}
+
+			env["workers"] = app.workers.status(app.config.criticalWorkers)
+		}
+	}
+
+	if err := app.writeResponse(w, r, status, env, nil); err != nil {
 		// Use the serverErrorResponse() helper func.
 		app.serverErrorResponse(w, r, err)
 	}
+}
+
+// The isAdmin() helper reports whether the request was made by an activated user with
+// the "users:admin" permission.
+func (app *application) isAdmin(r *http.Request) (bool, error) {
+	user := app.contextGetUser(r)
+
+	if user.IsAnonymous() || !user.Activated {
+		return false, nil
+	}
+
+	permissions, err := app.userPermissions(user.ID)
+	if err != nil {
+		return false, err
+	}
 
+	return permissions.Include("users:admin"), nil
 }
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"net"
+	"net/http"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/petrostrak/an-open-movie-database/internal/data"
+)
+
+// The healthcheck reports the build details from the vcs package.
+func TestHealthcheckBuildInfo(t *testing.T) {
+	newTestApplication(t)
+	ts := newTestServer(t)
+
+	code, body := ts.do(t, http.MethodGet, "/v1/healthcheck", "", nil)
+	if code != http.StatusOK {
+		t.Fatalf("got status %d; want %d", code, http.StatusOK)
+	}
+
+	info, _ := body["system_info"].(map[string]interface{})
+
+	for key, want := range map[string]string{
+		"version":     build.Version,
+		"revision":    build.Revision,
+		"commit_time": build.CommitTime,
+		"build_time":  build.BuildTime,
+		"go_version":  build.GoVersion,
+	} {
+		if info[key] != want {
+			t.Errorf("got %s %v; want %q", key, info[key], want)
+		}
+	}
+
+	if _, ok := info["modified"]; !ok {
+		t.Errorf("system_info %v has no modified key", info)
+	}
+}
+
+// Define a refusingConnector which fails every connection attempt, as if the database
+// were down.
+type refusingConnector struct{}
+
+func (refusingConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	return nil, &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}
+}
+
+func (refusingConnector) Driver() driver.Driver { return nil }
+
+// While the primary database's circuit breaker is open, the healthcheck reports the
+// application as unavailable, so that a load balancer stops sending it requests.
+func TestHealthcheckBreakerOpen(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t)
+
+	app.breakers.primary = data.NewBreaker(1, time.Hour)
+
+	code, body := ts.do(t, http.MethodGet, "/v1/healthcheck", "", nil)
+	if code != http.StatusOK || body["database_breaker"] != "closed" {
+		t.Fatalf("got status %d and breaker %v; want %d and closed", code, body["database_breaker"], http.StatusOK)
+	}
+
+	db := sql.OpenDB(app.breakers.primary.Connector(refusingConnector{}))
+	defer db.Close()
+
+	db.Ping()
+
+	err := db.Ping()
+	if !errors.Is(err, data.ErrUnavailable) {
+		t.Fatalf("got %v from the second ping; want data.ErrUnavailable", err)
+	}
+
+	code, body = ts.do(t, http.MethodGet, "/v1/healthcheck", "", nil)
+	if code != http.StatusServiceUnavailable || body["status"] != "unavailable" || body["database_breaker"] != "open" {
+		t.Errorf("got status %d, %v and breaker %v; want %d, unavailable and open", code, body["status"], body["database_breaker"], http.StatusServiceUnavailable)
+	}
+}
@@ -1,43 +1,120 @@
 package main
 
 import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
 	"encoding/json"
 	"errors"
+	"expvar"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/url"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/julienschmidt/httprouter"
+	"github.com/petrostrak/an-open-movie-database/internal/data"
 	"github.com/petrostrak/an-open-movie-database/internal/validator"
 )
 
 type envelope map[string]interface{}
 
+// Define an invalidParamError type for a URL parameter which isn't a valid identifier.
+// No resource can have such an identifier, so handlers send a 404 Not Found response
+// for it, as they do for an identifier which isn't found, noting the format it should
+// have.
+type invalidParamError struct {
+	name   string
+	format string
+}
+
+func (e *invalidParamError) Error() string {
+	return fmt.Sprintf("invalid %s parameter", e.name)
+}
+
+// The readParam() helper returns the named URL parameter. When httprouter is parsing a
+// request, any interpolated URL parameters will be stored in the request context. We
+// can use the ParamsFromContext() function to retrieve a slice containing these
+// parameter names and values, and the ByName() method to get the value of one of
+// them, which is always a string.
+func (app *application) readParam(r *http.Request, name string) string {
+	return httprouter.ParamsFromContext(r.Context()).ByName(name)
+}
+
 // Retrieve the "id" URL parameter from the current request context, then convert it to
 // an integer are return it. If the operation isn't successful, return 0 and an error.
 func (app *application) readIDParam(r *http.Request) (int64, error) {
-	// When httprouter is parsing a request, any interpolated URL parameters will be
-	// stored in the request context. We can use the ParamsFromContext() function to
-	// retrieve a slice containing these parameter names and values.
-	params := httprouter.ParamsFromContext(r.Context())
-
-	// We can then use the ByName() method to get the value of the "id" parameter from
-	// the slice. In our project all movies will have a unique positive integer ID, but
-	// the value returned by ByName() is always a string. So we try to convert it to a
-	// base 10 integer (with a bit size of 64). If the parameter couldn't be converted,
-	// or is less than 1, we know the ID is invalid so we use the http.NotFound()
-	// function to return a 404 Not Found response.
-	id, err := strconv.ParseInt(params.ByName("id"), 10, 64)
+	// In our project all movies will have a unique positive integer ID, so we try to
+	// convert the parameter to a base 10 integer (with a bit size of 64). If the
+	// parameter couldn't be converted, or is less than 1, we know the ID is invalid
+	// and return an *invalidParamError.
+	id, err := strconv.ParseInt(app.readParam(r, "id"), 10, 64)
 	if err != nil || id < 1 {
-		return 0, errors.New("invalid id parameter")
+		return 0, &invalidParamError{name: "id", format: "a positive integer"}
+	}
+
+	return id, nil
+}
+
+// The readUUIDParam() helper is the equivalent of readIDParam() for the resources which
+// are identified by a UUID, in the named URL parameter. The nil UUID is invalid too, as
+// it never identifies anything.
+func (app *application) readUUIDParam(r *http.Request, name string) (data.UUID, error) {
+	id, err := data.ParseUUID(app.readParam(r, name))
+	if err != nil || id.IsNil() {
+		return data.NilUUID, &invalidParamError{name: name, format: "a UUID"}
 	}
 
 	return id, nil
 }
 
+// The notModified() helper sets the Last-Modified header, and checks it against the
+// request's If-Modified-Since header. HTTP dates only have a resolution of one second,
+// so lastModified is truncated to the second before comparing them. If the client's
+// copy is still current, it sends a 304 Not Modified response and returns true.
+func (app *application) notModified(w http.ResponseWriter, r *http.Request, lastModified time.Time) bool {
+	lastModified = lastModified.Truncate(time.Second)
+	w.Header().Set("Last-Modified", lastModified.UTC().Format(http.TimeFormat))
+
+	// An If-Modified-Since header which can't be parsed is ignored, as RFC 7232 requires.
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil || lastModified.After(since) {
+		return false
+	}
+
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// The withMeta() helper returns a copy of the envelope with a "meta" object added,
+// holding the request ID, the version of the server and how long the request has
+// taken so far, in milliseconds. The request ID and duration are left out if the
+// requestID() middleware didn't run. The handler's envelope isn't changed, as it may
+// be shared with a webhook, say.
+func (app *application) withMeta(r *http.Request, data envelope) envelope {
+	meta := envelope{"version": build.Version}
+
+	if requestID := app.contextGetRequestID(r); requestID != "" {
+		meta["request_id"] = requestID
+	}
+
+	if start := app.contextGetRequestStart(r); !start.IsZero() {
+		meta["duration_ms"] = float64(time.Since(start).Microseconds()) / 1000
+	}
+
+	withMeta := make(envelope, len(data)+1)
+	for key, value := range data {
+		withMeta[key] = value
+	}
+	withMeta["meta"] = meta
+
+	return withMeta
+}
+
 // Define a writeJSON() helper for sending responses. This takes the destination
 // http.ResponseWriter, the HTTP status code to send, the data to encode to JSON, and a
 // header map containing any additional HTTP headers we want to include in the response.
@@ -63,29 +140,98 @@ func (app *application) writeJSON(w http.ResponseWriter, status int, data envelo
 		w.Header()[key] = value
 	}
 
-	// Add the "Content-Type: application/json" header, then write the status code and
-	// JSON response.
-	w.Header().Set("Content-Type", "application/json")
+	// Add the "Content-Type: application/json" header, unless the headers set another
+	// JSON media type, then write the status code and JSON response.
+	if headers.Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", "application/json")
+	}
 	w.WriteHeader(status)
 	w.Write(js)
 
 	return nil
 }
 
+// Count the pages of records which were cut short by limitPage().
+var totalOversizedResponses = expvar.NewInt("total_oversized_responses")
+
+// The limitPage() function cuts a page of records short once their JSON encodings add
+// up to more than -max-response-bytes, so that a list endpoint never sends a response
+// much larger than that. When it does, it sets Truncated in the metadata, along with how
+// many records were sent and how many were dropped, as the next page starts after the
+// dropped ones. The first record is always kept, so that a page isn't empty only
+// because that record is large.
+// It's a function rather than a method, as methods can't have type parameters.
+func limitPage[T any](app *application, records []T, metadata *data.Metadata) ([]T, error) {
+	maxBytes := app.config.maxResponseBytes
+	if maxBytes == 0 {
+		return records, nil
+	}
+
+	size := 0
+	for i, record := range records {
+		js, err := json.Marshal(record)
+		if err != nil {
+			return nil, err
+		}
+
+		size += len(js)
+		if size > maxBytes && i > 0 {
+			totalOversizedResponses.Add(1)
+			metadata.Truncated = true
+			metadata.ReturnedRecords = i
+			metadata.DroppedRecords = len(records) - i
+
+			return records[:i], nil
+		}
+	}
+
+	return records, nil
+}
+
 func (app *application) readJSON(w http.ResponseWriter, r *http.Request, dst interface{}) error {
-	// Use http.MaxBytesReader() to limit the size of the request body  to 1MB
-	maxBytes := 1_048_576
-	r.Body = http.MaxBytesReader(w, r.Body, int64(maxBytes))
+	return app.readJSONWithLimit(w, r, dst, app.config.maxRequestBody)
+}
+
+// The readJSONWithLimit() helper is readJSON() with an endpoint-specific limit on the
+// size of the body, in place of the -max-request-body default.
+func (app *application) readJSONWithLimit(w http.ResponseWriter, r *http.Request, dst interface{}, maxBytes int64) error {
+	// Decompress the body if it was sent gzipped. The limit applies to the
+	// decompressed body, so a small compressed body can't expand to exhaust memory.
+	err := app.limitBody(w, r, maxBytes)
+	if err != nil {
+		return err
+	}
+
+	// Read the whole body, which the limit keeps to a reasonable size, so that we can
+	// go back over it to explain a decoding error.
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		var maxBytesError *http.MaxBytesError
+
+		switch {
+		// If the request body exceeds the limit the read will fail with an
+		// *http.MaxBytesError. We return it as-is, and badRequestResponse() turns it
+		// into a 413 Request Entity Too Large response.
+		case errors.As(err, &maxBytesError):
+			return maxBytesError
+		// A gzipped body which can't be decompressed. The checksum is verified at the
+		// end of the stream, so this covers a corrupt body as well as a bad header.
+		case isCorruptGzip(err):
+			return errCorruptGzip
+		default:
+			return err
+		}
+	}
 
 	// Initialize the json.Decoder and call the DisallowUnknownFields() method on it
 	// before decoding. This means that if the JSON from the client now includes any
 	// field which cannot be mapped to the target destination, the decoder will return
 	// an error instead of just ignoring the field.
-	dec := json.NewDecoder(r.Body)
+	dec := json.NewDecoder(bytes.NewReader(body))
 	dec.DisallowUnknownFields()
 
 	// Decode the request body to the destination.
-	err := dec.Decode(dst)
+	err = dec.Decode(dst)
 
 	if err != nil {
 		// If there is an error during decoding, start the triage
@@ -95,29 +241,38 @@ func (app *application) readJSON(w http.ResponseWriter, r *http.Request, dst int
 
 		switch {
 		// Use the errors.As() to check whether the error has the type
-		// *json.SyntaxError. If it does, then return  a plain-text error
-		// message which includes the location of the problem
+		// *json.SyntaxError. If it does, then return a plain-text error message which
+		// includes the line and column of the character which the decoder stopped at.
 		case errors.As(err, &syntaxError):
-			return fmt.Errorf("body contains badly-formed JSON (at character %d)", syntaxError.Offset)
+			line, column := jsonPosition(body, syntaxError.Offset-1)
+			return fmt.Errorf("body contains badly-formed JSON (at line %d, column %d)", line, column)
 		// In some circumstances Decode() may also return an io.ErrUnexpectedEOF error
-		// for syntax errors in the JSON.
+		// for syntax errors in the JSON, when the body ends part way through a value.
+		case errors.Is(err, io.ErrUnexpectedEOF):
+			line, column := jsonPosition(body, int64(len(body)))
+			return fmt.Errorf("body contains badly-formed JSON (unexpected end at line %d, column %d)", line, column)
+		// The error only names the struct field, so go back over the body to find the
+		// full path of the value, including the indexes of any arrays it's in.
 		case errors.As(err, &unmarshalTypeError):
-			if unmarshalTypeError.Field != "" {
-				return fmt.Errorf("body contains incorrect JSON type for field %q", unmarshalTypeError.Field)
+			scan := scanJSON(body, dst, unmarshalTypeError.Offset)
+			if scan.offsetPath != "" {
+				return fmt.Errorf("body contains incorrect JSON type for field %q", scan.offsetPath)
 			}
-			return fmt.Errorf("body contains incorrect JSON type (at character %d)", unmarshalTypeError.Offset)
+			line, column := jsonPosition(body, unmarshalTypeError.Offset-1)
+			return fmt.Errorf("body contains incorrect JSON type (at line %d, column %d)", line, column)
 		// An io.EOF error will be returned by Decode() if the request body is empty.
 		case errors.Is(err, io.EOF):
 			return errors.New("body must not be empty")
 		// If the JSON contains a field which cannot be mapped to the target destination
-		// then Decode() will now return an error message.
+		// then Decode() will now return an error message. It only names the key, so go
+		// back over the body to find its path and the keys which are allowed there.
 		case strings.HasPrefix(err.Error(), "json: unknown field"):
-			fieldName := strings.TrimPrefix(err.Error(), "json: unknown field")
+			scan := scanJSON(body, dst, -1)
+			if scan.unknownPath != "" {
+				return fmt.Errorf("body contains unknown key %q (allowed keys are: %s)", scan.unknownPath, strings.Join(scan.allowed, ", "))
+			}
+			fieldName := strings.TrimPrefix(err.Error(), "json: unknown field ")
 			return fmt.Errorf("body contains unknown key %s", fieldName)
-		// If the request body exceeds 1MB in size the decode will now fail with the
-		// error "http: request body too large".
-		case err.Error() == "http: request body too large":
-			return fmt.Errorf("body must not be larger than %d bytes", maxBytes)
 		// A json.InvalidUnmarshalError error will be returned if we pass a non-nil
 		// pointer to Decode(). We catch this and panic, rather than returning an error
 		// to our handler.
@@ -137,9 +292,55 @@ func (app *application) readJSON(w http.ResponseWriter, r *http.Request, dst int
 		return errors.New("body must only contain a single JSON value")
 	}
 
+	// The decoder lets a later key silently overwrite an earlier one, which usually
+	// means the client has made a mistake, so check for duplicates.
+	if scan := scanJSON(body, dst, -1); scan.duplicatePath != "" {
+		return fmt.Errorf("body contains duplicate key %q", scan.duplicatePath)
+	}
+
 	return nil
 }
 
+// Define the errors returned when a request body can't be decompressed. Handlers pass
+// them to badRequestResponse() like any other body error, which sends a 415 for an
+// unsupported encoding.
+var (
+	errCorruptGzip         = errors.New("body contains a corrupt gzip stream")
+	errUnsupportedEncoding = errors.New("body must be sent with gzip or identity content encoding")
+)
+
+// The limitBody() helper replaces the request body with one limited to maxBytes. If
+// the body was sent with Content-Encoding: gzip it's decompressed first, so the limit
+// applies to the decompressed size.
+func (app *application) limitBody(w http.ResponseWriter, r *http.Request, maxBytes int64) error {
+	switch strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding"))) {
+	case "", "identity":
+		r.Body = http.MaxBytesReader(w, r.Body, maxBytes)
+	case "gzip":
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return errors.New("body must not be empty")
+			}
+			return errCorruptGzip
+		}
+
+		r.Body = http.MaxBytesReader(w, zr, maxBytes)
+	default:
+		return errUnsupportedEncoding
+	}
+
+	return nil
+}
+
+// The isCorruptGzip() helper reports whether an error came from decompressing a
+// corrupt or truncated gzip stream.
+func isCorruptGzip(err error) bool {
+	var corruptInputError flate.CorruptInputError
+
+	return errors.Is(err, gzip.ErrHeader) || errors.Is(err, gzip.ErrChecksum) || errors.As(err, &corruptInputError)
+}
+
 // The readString() helper returns a string value from the query string, or the provided
 // default value if no matching key coyld be found.
 func (app *application) readString(qs url.Values, key, defaultValue string) string {
@@ -172,6 +373,24 @@ func (app *application) readCSV(qs url.Values, key string, defaultValue []string
 	return strings.Split(csv, ",")
 }
 
+// The readBool() helper reads a boolean value from the query string. It returns nil
+// if the key isn't there, so that "not given" can be told apart from false, and records
+// an error in the Validator if the value isn't a boolean.
+func (app *application) readBool(qs url.Values, key string, v *validator.Validator) *bool {
+	s := qs.Get(key)
+	if s == "" {
+		return nil
+	}
+
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		v.AddError(key, validator.Msg("boolean"))
+		return nil
+	}
+
+	return &b
+}
+
 // The readInt() helper reads a string value from the query string and converts it to an
 // integer before returning. If no matching key could be found it returns the provided
 // defaultValue. If the value couldn't be converted to an integer, then we record an
@@ -189,7 +408,7 @@ func (app *application) readInt(qs url.Values, key string, defaultValue int, v *
 	// validator instance and return the default value.
 	i, err := strconv.Atoi(s)
 	if err != nil {
-		v.AddError(key, "must be an integer value")
+		v.AddError(key, validator.Msg("integer"))
 		return defaultValue
 	}
 
@@ -197,6 +416,133 @@ func (app *application) readInt(qs url.Values, key string, defaultValue int, v *
 	return i
 }
 
+// The clientIP() helper returns the IP address of the client which made the request.
+//
+// If the request came directly from a trusted proxy (see -trusted-proxies), the
+// client is the rightmost address in the X-Forwarded-For header which isn't itself a
+// trusted proxy, or else the X-Real-IP header. Those headers are ignored for requests
+// from anyone else, as a client can set them to anything it likes.
+func (app *application) clientIP(r *http.Request) string {
+	peer := parseIP(r.RemoteAddr)
+	if peer == nil {
+		return r.RemoteAddr
+	}
+
+	if !app.isTrustedProxy(peer) {
+		return peer.String()
+	}
+
+	// Walk the X-Forwarded-For entries from right to left, as each proxy appends the
+	// address it received the request from. The first untrusted address is the
+	// client; everything to its left could have been forged by that client.
+	var forwarded []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		forwarded = append(forwarded, strings.Split(header, ",")...)
+	}
+
+	hop := peer
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		ip := parseIP(forwarded[i])
+		if ip == nil {
+			// A malformed entry means we can't trust anything further left, so we
+			// settle for the last address we know is genuine.
+			return hop.String()
+		}
+
+		hop = ip
+		if !app.isTrustedProxy(hop) {
+			return hop.String()
+		}
+	}
+
+	if len(forwarded) > 0 {
+		return hop.String()
+	}
+
+	if ip := parseIP(r.Header.Get("X-Real-IP")); ip != nil {
+		return ip.String()
+	}
+
+	return peer.String()
+}
+
+// The isHTTPS() helper reports whether the client sent the request over HTTPS: either
+// straight to us over TLS, or to a trusted proxy which says so in the
+// X-Forwarded-Proto header. Only the last value of that header is believed, as that's
+// the one set by the proxy the request came from, and anything before it could have
+// been sent by the client.
+func (app *application) isHTTPS(r *http.Request) bool {
+	if r.TLS != nil {
+		return true
+	}
+
+	peer := parseIP(r.RemoteAddr)
+	if peer == nil || !app.isTrustedProxy(peer) {
+		return false
+	}
+
+	values := r.Header.Values("X-Forwarded-Proto")
+	if len(values) == 0 {
+		return false
+	}
+
+	protos := strings.Split(values[len(values)-1], ",")
+
+	return strings.EqualFold(strings.TrimSpace(protos[len(protos)-1]), "https")
+}
+
+// The isTrustedProxy() helper reports whether an IP address is within one of the
+// trusted proxy ranges.
+func (app *application) isTrustedProxy(ip net.IP) bool {
+	for _, network := range app.config.trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// The parseIP() function parses an IP address, with or without a port, returning nil
+// if it isn't valid. IPv4-mapped IPv6 addresses are returned in their IPv4 form, so
+// that they're matched consistently.
+func parseIP(s string) net.IP {
+	s = strings.TrimSpace(s)
+
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		s = host
+	}
+
+	ip := net.ParseIP(strings.Trim(s, "[]"))
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+
+	return ip
+}
+
+// The readTime() helper reads a timestamp from the query string, accepting either an
+// RFC 3339 timestamp or a plain date (which is taken as midnight UTC). If no matching
+// key could be found it returns the zero time. If the value couldn't be parsed, then
+// we record an error message in the provided Validator instance.
+func (app *application) readTime(qs url.Values, key string, v *validator.Validator) time.Time {
+	s := qs.Get(key)
+
+	if s == "" {
+		return time.Time{}
+	}
+
+	for _, layout := range []string{time.RFC3339, "2006-01-02"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t
+		}
+	}
+
+	v.AddError(key, validator.Msg("date_format"))
+
+	return time.Time{}
+}
+
 // The background() helper accepts an arbitrary function as a parameter.
 func (app *application) background(fn func()) {
 	// Increment the WaitGroup counter.
@@ -218,3 +564,15 @@ func (app *application) background(fn func()) {
 		fn()
 	}()
 }
+
+// The frontendURL() helper returns the URL of a page on the web frontend, with the
+// given query string.
+func (app *application) frontendURL(path string, qs url.Values) string {
+	return strings.TrimSuffix(app.config.frontend.baseURL, "/") + path + "?" + qs.Encode()
+}
+
+// The apiURL() helper returns the public URL of one of our own endpoints, with the
+// given query string, for links in emails.
+func (app *application) apiURL(path string, qs url.Values) string {
+	return strings.TrimSuffix(app.config.api.baseURL, "/") + path + "?" + qs.Encode()
+}
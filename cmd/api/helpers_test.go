@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/petrostrak/an-open-movie-database/internal/data"
+)
+
+// The gzipBytes() helper compresses s.
+func gzipBytes(t *testing.T, s string) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+
+	zw := gzip.NewWriter(&buf)
+
+	_, err := zw.Write([]byte(s))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = zw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func TestReadJSON(t *testing.T) {
+	valid := gzipBytes(t, `{"title":"Moana"}`)
+
+	// Flip a byte of the CRC-32 in the trailer, which is only checked at the end of the
+	// stream.
+	badChecksum := append([]byte(nil), valid...)
+	badChecksum[len(badChecksum)-8] ^= 0xff
+
+	// A body which decompresses to well over the limit.
+	bomb := gzipBytes(t, `{"title":"`+strings.Repeat("a", 10_000)+`"}`)
+
+	tests := []struct {
+		name      string
+		encoding  string
+		body      []byte
+		wantTitle string
+		wantCode  int
+	}{
+		{"plain", "", []byte(`{"title":"Moana"}`), "Moana", 0},
+		{"identity", "identity", []byte(`{"title":"Moana"}`), "Moana", 0},
+		{"gzip", "gzip", valid, "Moana", 0},
+		{"gzip mixed case", "GZip", valid, "Moana", 0},
+		{"gzip not compressed", "gzip", []byte(`{"title":"Moana"}`), "", http.StatusBadRequest},
+		{"gzip truncated", "gzip", valid[:len(valid)-10], "", http.StatusBadRequest},
+		{"gzip bad checksum", "gzip", badChecksum, "", http.StatusBadRequest},
+		{"gzip empty", "gzip", nil, "", http.StatusBadRequest},
+		{"gzip too large", "gzip", bomb, "", http.StatusRequestEntityTooLarge},
+		{"plain too large", "", []byte(`{"title":"` + strings.Repeat("a", 10_000) + `"}`), "", http.StatusRequestEntityTooLarge},
+		{"unsupported encoding", "br", valid, "", http.StatusUnsupportedMediaType},
+		{"unknown field", "", []byte(`{"name":"Moana"}`), "", http.StatusBadRequest},
+		{"two values", "", []byte(`{"title":"Moana"}{}`), "", http.StatusBadRequest},
+		{"empty", "", nil, "", http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t)
+			app.config.maxRequestBody = 1024
+
+			r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(tt.body))
+			if tt.encoding != "" {
+				r.Header.Set("Content-Encoding", tt.encoding)
+			}
+			w := httptest.NewRecorder()
+
+			var input struct {
+				Title string `json:"title"`
+			}
+
+			err := app.readJSON(w, r, &input)
+			if tt.wantCode == 0 {
+				if err != nil {
+					t.Fatalf("got error %v; want none", err)
+				}
+
+				if input.Title != tt.wantTitle {
+					t.Errorf("got title %q; want %q", input.Title, tt.wantTitle)
+				}
+				return
+			}
+
+			if err == nil {
+				t.Fatal("got no error")
+			}
+
+			// Handlers pass body errors to badRequestResponse(), which picks the status.
+			app.badRequestResponse(w, r, err)
+			if w.Code != tt.wantCode {
+				t.Errorf("got status %d for error %q; want %d", w.Code, err, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestReadJSONErrors(t *testing.T) {
+	type movie struct {
+		Title   string       `json:"title"`
+		Year    int32        `json:"year"`
+		Runtime data.Runtime `json:"runtime"`
+		Genres  []string     `json:"genres"`
+	}
+
+	// A batch of movies, as a batch endpoint would decode it.
+	type batch struct {
+		Movies []movie `json:"movies"`
+	}
+
+	tests := []struct {
+		name    string
+		dst     func() interface{}
+		body    string
+		wantErr string
+	}{
+		{"valid", func() interface{} { return &movie{} }, `{"title":"Moana","year":2016}`, ""},
+		{"valid batch", func() interface{} { return &batch{} }, `{"movies":[{"title":"Moana"},{"title":"Up"}]}`, ""},
+		{"string for number", func() interface{} { return &movie{} }, `{"year": "1999"}`, `body contains incorrect JSON type for field "year"`},
+		{"number overflow", func() interface{} { return &movie{} }, `{"year": 99999999999}`, `body contains incorrect JSON type for field "year"`},
+		{"array for string", func() interface{} { return &movie{} }, `{"title": ["Moana"]}`, `body contains incorrect JSON type for field "title"`},
+		{"object for string", func() interface{} { return &movie{} }, `{"title": {"en": "Moana"}}`, `body contains incorrect JSON type for field "title"`},
+		{"array element", func() interface{} { return &movie{} }, `{"genres": ["animation", 2]}`, `body contains incorrect JSON type for field "genres[1]"`},
+		{"batch element", func() interface{} { return &batch{} }, `{"movies": [{}, {}, {"title": "Up", "year": 20.5}]}`, `body contains incorrect JSON type for field "movies[2].year"`},
+		{"batch nested array", func() interface{} { return &batch{} }, `{"movies": [{"genres": []}, {"genres": ["drama", false]}]}`, `body contains incorrect JSON type for field "movies[1].genres[1]"`},
+		{"top-level array", func() interface{} { return &[]movie{} }, `[{"title": "Up"}, {"title": 1}]`, `body contains incorrect JSON type for field "[1].title"`},
+		{"wrong top-level type", func() interface{} { return &movie{} }, `["Moana"]`, `body contains incorrect JSON type (at line 1, column 1)`},
+		{"syntax error", func() interface{} { return &movie{} }, "{\n  \"title\": \"Moana\",\n  \"year\" 2016\n}", `body contains badly-formed JSON (at line 3, column 10)`},
+		{"syntax error after multibyte", func() interface{} { return &movie{} }, `{"title": "Amélie" x}`, `body contains badly-formed JSON (at line 1, column 20)`},
+		{"trailing comma", func() interface{} { return &movie{} }, `{"title": "Moana",}`, `body contains badly-formed JSON (at line 1, column 19)`},
+		{"truncated", func() interface{} { return &movie{} }, "{\"title\":\n\"Moa", `body contains badly-formed JSON (unexpected end at line 2, column 5)`},
+		{"unknown key", func() interface{} { return &movie{} }, `{"title": "Moana", "rating": 5}`, `body contains unknown key "rating" (allowed keys are: title, year, runtime, genres)`},
+		{"unknown key in batch", func() interface{} { return &batch{} }, `{"movies": [{"title": "Up"}, {"name": "Moana"}]}`, `body contains unknown key "movies[1].name" (allowed keys are: title, year, runtime, genres)`},
+		{"unknown top-level key", func() interface{} { return &batch{} }, `{"films": []}`, `body contains unknown key "films" (allowed keys are: movies)`},
+		{"duplicate key", func() interface{} { return &movie{} }, `{"title": "Moana", "year": 2016, "title": "Up"}`, `body contains duplicate key "title"`},
+		{"duplicate key differing in case", func() interface{} { return &movie{} }, `{"title": "Moana", "Title": "Up"}`, `body contains duplicate key "Title"`},
+		{"duplicate key in batch", func() interface{} { return &batch{} }, `{"movies": [{"title": "Up"}, {"year": 2009, "year": 2010}]}`, `body contains duplicate key "movies[1].year"`},
+		{"duplicate map key", func() interface{} { return &map[string]json.RawMessage{} }, `{"a": {"b": 1, "b": 2}}`, `body contains duplicate key "a.b"`},
+		{"map keys differing in case", func() interface{} { return &map[string]int{} }, `{"a": 1, "A": 2}`, ""},
+		{"two values", func() interface{} { return &movie{} }, `{"title": "Moana"} {"title": "Up"}`, "body must only contain a single JSON value"},
+		{"whitespace only", func() interface{} { return &movie{} }, " \n ", "body must not be empty"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t)
+
+			r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tt.body))
+			w := httptest.NewRecorder()
+
+			err := app.readJSON(w, r, tt.dst())
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("got error %q; want none", err)
+				}
+				return
+			}
+
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("got error %v; want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// Successful and error responses alike carry the meta object, unless it's turned off.
+func TestResponseMeta(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t)
+
+	_, token := newTestUser(t, app, "reader", "reader")
+
+	checkMeta := func(t *testing.T, body map[string]interface{}) {
+		t.Helper()
+
+		meta, ok := body["meta"].(map[string]interface{})
+		if !ok {
+			t.Fatalf("got no meta object in %v", body)
+		}
+
+		if id, _ := meta["request_id"].(string); id == "" {
+			t.Errorf("got request_id %v; want one", meta["request_id"])
+		}
+
+		if version, _ := meta["version"].(string); version != build.Version {
+			t.Errorf("got version %v; want %q", meta["version"], build.Version)
+		}
+
+		if duration, ok := meta["duration_ms"].(float64); !ok || duration < 0 {
+			t.Errorf("got duration_ms %v; want a number of milliseconds", meta["duration_ms"])
+		}
+	}
+
+	t.Run("success", func(t *testing.T) {
+		code, body := ts.do(t, http.MethodGet, "/v1/healthcheck", "", nil)
+		if code != http.StatusOK {
+			t.Fatalf("got status %d; want %d", code, http.StatusOK)
+		}
+
+		checkMeta(t, body)
+	})
+
+	t.Run("validation failure", func(t *testing.T) {
+		code, body := ts.do(t, http.MethodGet, "/v1/movies?sort=nope", token, nil)
+		if code != http.StatusUnprocessableEntity {
+			t.Fatalf("got status %d; want %d", code, http.StatusUnprocessableEntity)
+		}
+
+		checkMeta(t, body)
+	})
+
+	t.Run("server error", func(t *testing.T) {
+		h := app.requestID(app.recoverPanic(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			panic("oops")
+		})))
+
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/v1/movies", nil))
+
+		if rr.Code != http.StatusInternalServerError {
+			t.Fatalf("got status %d; want %d", rr.Code, http.StatusInternalServerError)
+		}
+
+		var body map[string]interface{}
+		err := json.Unmarshal(rr.Body.Bytes(), &body)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		checkMeta(t, body)
+
+		// The meta object has the same request ID as the header and the details.
+		meta := body["meta"].(map[string]interface{})
+		details, _ := body["details"].(map[string]interface{})
+		if meta["request_id"] != rr.Header().Get("X-Request-ID") || meta["request_id"] != details["request_id"] {
+			t.Errorf("got request IDs %v, %q and %v; want them all the same", meta["request_id"], rr.Header().Get("X-Request-ID"), details["request_id"])
+		}
+	})
+
+	t.Run("turned off", func(t *testing.T) {
+		app.config.responseMeta = false
+
+		_, body := ts.do(t, http.MethodGet, "/v1/healthcheck", "", nil)
+		if _, found := body["meta"]; found {
+			t.Errorf("got meta %v with -response-meta=false; want none", body["meta"])
+		}
+
+		_, body = ts.do(t, http.MethodGet, "/v1/movies?sort=nope", token, nil)
+		if _, found := body["meta"]; found {
+			t.Errorf("got meta %v on an error with -response-meta=false; want none", body["meta"])
+		}
+	})
+}
+
+// A forwarding header is only believed when the request came from a trusted proxy, and
+// then only as far left as the addresses are trusted proxies too.
+func TestClientIP(t *testing.T) {
+	app := newTestApplication(t)
+
+	for _, cidr := range []string{"10.0.0.0/8", "fd00::/8"} {
+		_, proxy, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		app.config.trustedProxies = append(app.config.trustedProxies, proxy)
+	}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		forwarded  []string
+		realIP     string
+		want       string
+	}{
+		{"direct", "192.0.2.1:1234", nil, "", "192.0.2.1"},
+		{"spoofed forwarded-for", "192.0.2.1:1234", []string{"203.0.113.9"}, "", "192.0.2.1"},
+		{"spoofed real-ip", "192.0.2.1:1234", nil, "203.0.113.9", "192.0.2.1"},
+		{"one proxy", "10.0.0.5:1234", []string{"203.0.113.9"}, "", "203.0.113.9"},
+		{"trusted hops", "10.0.0.5:1234", []string{"203.0.113.9, 10.0.0.7, 10.0.0.6"}, "", "203.0.113.9"},
+		{"forged entry on the left", "10.0.0.5:1234", []string{"198.51.100.1, 203.0.113.9, 10.0.0.6"}, "", "203.0.113.9"},
+		{"several headers", "10.0.0.5:1234", []string{"198.51.100.1", "203.0.113.9", "10.0.0.6"}, "", "203.0.113.9"},
+		{"all trusted", "10.0.0.5:1234", []string{"10.0.0.8, 10.0.0.7"}, "", "10.0.0.8"},
+		{"malformed entry", "10.0.0.5:1234", []string{"203.0.113.9, not-an-ip, 10.0.0.6"}, "", "10.0.0.6"},
+		{"malformed last entry", "10.0.0.5:1234", []string{"203.0.113.9, not-an-ip"}, "", "10.0.0.5"},
+		{"entry with a port", "10.0.0.5:1234", []string{"203.0.113.9:5678"}, "", "203.0.113.9"},
+		{"forwarded-for over real-ip", "10.0.0.5:1234", []string{"203.0.113.9"}, "198.51.100.1", "203.0.113.9"},
+		{"real-ip", "10.0.0.5:1234", nil, "203.0.113.9", "203.0.113.9"},
+		{"malformed real-ip", "10.0.0.5:1234", nil, "not-an-ip", "10.0.0.5"},
+		{"ipv6 direct", "[2001:db8::1]:1234", []string{"203.0.113.9"}, "", "2001:db8::1"},
+		{"ipv6 proxy", "[fd00::1]:443", []string{"2001:db8::9"}, "", "2001:db8::9"},
+		{"ipv6 trusted hops", "[fd00::1]:443", []string{"2001:db8::9, [fd00::2]:8080, 10.0.0.6"}, "", "2001:db8::9"},
+		{"ipv4-mapped entry", "[fd00::1]:443", []string{"::ffff:203.0.113.9"}, "", "203.0.113.9"},
+		{"unparsable remote address", "@unix", []string{"203.0.113.9"}, "", "@unix"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/v1/movies", nil)
+			r.RemoteAddr = tt.remoteAddr
+			for _, value := range tt.forwarded {
+				r.Header.Add("X-Forwarded-For", value)
+			}
+			if tt.realIP != "" {
+				r.Header.Set("X-Real-IP", tt.realIP)
+			}
+
+			if got := app.clientIP(r); got != tt.want {
+				t.Errorf("got %q; want %q", got, tt.want)
+			}
+		})
+	}
+}
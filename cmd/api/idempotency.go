@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/felixge/httpsnoop"
+	"github.com/petrostrak/an-open-movie-database/internal/data"
+)
+
+// Idempotency keys are kept for 24 hours, which is plenty of time for a client to
+// retry a request.
+const idempotencyKeyTTL = 24 * time.Hour
+
+// The headers which are stored with a response and replayed with it. Anything else is
+// set by the middleware, and is set again on the replayed response.
+var idempotentResponseHeaders = []string{"Content-Type", "Location"}
+
+// The idempotent() middleware lets clients safely retry a mutating request by sending
+// an Idempotency-Key header. The first request with a key is processed as usual, and
+// its response stored; a retry with the same key (by the same user) gets the stored
+// response replayed without the handler running again. Keys are matched against a
+// fingerprint of the method, path and body, so reusing a key for a different request
+// gets a 422 response.
+//
+// Requests without the header are processed as usual.
+//
+// Keys are scoped to the user who sent them. Anonymous users all have the user ID 0,
+// so their keys are also scoped to the client IP address; otherwise one client could
+// guess another's key and be replayed their response.
+func (app *application) idempotent(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if len(key) > 255 {
+			app.badRequestResponse(w, r, errors.New("idempotency key must not be more than 255 bytes long"))
+			return
+		}
+
+		// Read the body so it can be fingerprinted, and then put it back for the
+		// handler.
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, app.config.maxRequestBody))
+		if err != nil {
+			app.badRequestResponse(w, r, err)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		hash := sha256.New()
+		io.WriteString(hash, r.Method+" "+r.URL.Path+"\n")
+		hash.Write(body)
+		fingerprint := hash.Sum(nil)
+
+		// The user ID is 0 for anonymous requests, such as registering a user.
+		userID := app.contextGetUser(r).ID
+		if userID == 0 {
+			key = app.clientIP(r) + " " + key
+		}
+
+		// Claim the key. If it has been used before, replay the stored response, or
+		// explain why we can't.
+		existing, claimed, err := app.models.Idempotency.Claim(userID, key, fingerprint, idempotencyKeyTTL)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrIdempotencyKeyMismatch):
+				app.idempotencyKeyMismatchResponse(w, r)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+
+		if !claimed {
+			// The first request is still being processed.
+			if existing.StatusCode == 0 {
+				app.idempotencyKeyInProgressResponse(w, r)
+				return
+			}
+
+			for name, values := range existing.ResponseHeaders {
+				w.Header()[name] = values
+			}
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(existing.StatusCode)
+			w.Write(existing.ResponseBody)
+			return
+		}
+
+		// Process the request, keeping a copy of the response.
+		var (
+			status    = http.StatusOK
+			buf       bytes.Buffer
+			completed bool
+		)
+
+		// Release the key if we never get to record a response: if the handler
+		// panics, or the request times out and the handler gives up. Otherwise the
+		// key would stay claimed until it expires, and every retry would be told the
+		// request is still in progress.
+		defer func() {
+			if completed {
+				return
+			}
+
+			err := app.models.Idempotency.Release(userID, key)
+			if err != nil {
+				app.logger.PrintError(err, app.logProperties(r, map[string]string{
+					"idempotency_key": key,
+					"user_id":         strconv.FormatInt(userID, 10),
+				}))
+			}
+		}()
+
+		rw := httpsnoop.Wrap(w, httpsnoop.Hooks{
+			WriteHeader: func(next httpsnoop.WriteHeaderFunc) httpsnoop.WriteHeaderFunc {
+				return func(code int) {
+					status = code
+					next(code)
+				}
+			},
+			Write: func(next httpsnoop.WriteFunc) httpsnoop.WriteFunc {
+				return func(b []byte) (int, error) {
+					buf.Write(b)
+					return next(b)
+				}
+			},
+		})
+
+		next.ServeHTTP(rw, r)
+
+		// Server errors are likely to be temporary, so release the key to let the
+		// client retry, rather than replaying the error. A handler which gives up when
+		// the request times out responds with a server error too. If it finished its
+		// work despite the timeout, the response is stored, so that the retry is
+		// replayed the real outcome rather than repeating it.
+		if status >= http.StatusInternalServerError {
+			return
+		}
+
+		completed = true
+
+		headers := make(http.Header)
+		for _, name := range idempotentResponseHeaders {
+			if values := w.Header().Values(name); len(values) > 0 {
+				headers[name] = values
+			}
+		}
+
+		// The response has already been sent, so all we can do is log the error.
+		err = app.models.Idempotency.Complete(userID, key, status, headers, buf.Bytes())
+		if err != nil {
+			app.logger.PrintError(err, app.logProperties(r, map[string]string{
+				"idempotency_key": key,
+				"user_id":         strconv.FormatInt(userID, 10),
+			}))
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/petrostrak/an-open-movie-database/internal/data"
+)
+
+// The idempotentRequest() helper sends a request with an Idempotency-Key header
+// straight to h, as an anonymous user from the given IP address.
+func idempotentRequest(app *application, h http.Handler, ip, key, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, "/v1/users", strings.NewReader(body))
+	r.RemoteAddr = ip + ":1234"
+	r.Header.Set("Idempotency-Key", key)
+	r = app.contextSetUser(r, data.AnonymousUser)
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+
+	return w
+}
+
+func TestIdempotent(t *testing.T) {
+	app := newTestApplication(t)
+
+	var calls int
+
+	h := app.idempotent(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Location", "/v1/users/1")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"call":` + strconv.Itoa(calls) + `}`))
+	})
+
+	tests := []struct {
+		name         string
+		ip           string
+		key          string
+		body         string
+		wantCode     int
+		wantCalls    int
+		wantReplayed bool
+	}{
+		{"first use", "192.0.2.1", "key-1", `{"a":1}`, http.StatusCreated, 1, false},
+		{"retry", "192.0.2.1", "key-1", `{"a":1}`, http.StatusCreated, 1, true},
+		{"different body", "192.0.2.1", "key-1", `{"a":2}`, http.StatusUnprocessableEntity, 1, false},
+		{"new key", "192.0.2.1", "key-2", `{"a":1}`, http.StatusCreated, 2, false},
+		// Anonymous keys are scoped to the client IP address, so another client
+		// using the same key isn't replayed the first client's response.
+		{"same key from another ip", "198.51.100.7", "key-1", `{"a":2}`, http.StatusCreated, 3, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := idempotentRequest(app, h, tt.ip, tt.key, tt.body)
+
+			if w.Code != tt.wantCode {
+				t.Errorf("got status %d; want %d", w.Code, tt.wantCode)
+			}
+
+			if calls != tt.wantCalls {
+				t.Errorf("got %d calls to the handler; want %d", calls, tt.wantCalls)
+			}
+
+			if replayed := w.Header().Get("Idempotent-Replayed") == "true"; replayed != tt.wantReplayed {
+				t.Errorf("got replayed %t; want %t", replayed, tt.wantReplayed)
+			}
+
+			if tt.wantReplayed && (w.Header().Get("Location") != "/v1/users/1" || w.Body.String() != `{"call":1}`) {
+				t.Errorf("got Location %q and body %q; want the first response", w.Header().Get("Location"), w.Body.String())
+			}
+		})
+	}
+}
+
+// A server error, or a panic in the handler, releases the key so that the client can
+// retry, rather than leaving it claimed until it expires.
+func TestIdempotentRelease(t *testing.T) {
+	tests := []struct {
+		name  string
+		first func(w http.ResponseWriter, r *http.Request)
+	}{
+		{"server error", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusInternalServerError)
+		}},
+		{"panic", func(w http.ResponseWriter, r *http.Request) {
+			panic("boom")
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t)
+
+			var calls int
+
+			h := app.recoverPanic(app.idempotent(func(w http.ResponseWriter, r *http.Request) {
+				calls++
+				if calls == 1 {
+					tt.first(w, r)
+					return
+				}
+				w.WriteHeader(http.StatusCreated)
+			}))
+
+			w := idempotentRequest(app, h, "192.0.2.1", "key", "{}")
+			if w.Code != http.StatusInternalServerError {
+				t.Fatalf("got status %d for the first request; want %d", w.Code, http.StatusInternalServerError)
+			}
+
+			w = idempotentRequest(app, h, "192.0.2.1", "key", "{}")
+			if w.Code != http.StatusCreated || calls != 2 {
+				t.Errorf("got status %d after %d calls for the retry; want %d after 2", w.Code, calls, http.StatusCreated)
+			}
+		})
+	}
+}
+
+// Retrying a registration through the full middleware chain creates one user.
+func TestIdempotentRegistration(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t)
+
+	body := []byte(`{"name":"Alice","username":"alice","email":"alice@example.com","password":"correct horse battery"}`)
+
+	for i := 0; i < 2; i++ {
+		req, err := http.NewRequest(http.MethodPost, ts.URL+"/v1/users", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Idempotency-Key", "register-alice")
+
+		res, err := ts.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+
+		if res.StatusCode != http.StatusAccepted {
+			t.Fatalf("got status %d for request %d; want %d", res.StatusCode, i+1, http.StatusAccepted)
+		}
+	}
+
+	jobs, _, err := app.models.EmailJobs.GetAll(data.EmailJobPending, data.Filters{Page: 1, PageSize: 20, Sort: "id", SortSafelist: []string{"id"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(jobs) != 1 {
+		t.Errorf("got %d welcome emails queued; want 1", len(jobs))
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/petrostrak/an-open-movie-database/internal/data"
+)
+
+// The number of movies re-indexed in each transaction, and how long a running job can
+// go without making progress before it's assumed that the process running it died,
+// and it can be resumed.
+const (
+	reindexBatchSize = 500
+	jobLease         = 5 * time.Minute
+)
+
+// Define a jobRunner type which holds the contexts of the admin jobs running in this
+// process, so that they can be stopped when they're canceled or the server shuts down.
+// The jobs' progress is kept in the database, so it can be polled from any instance.
+type jobRunner struct {
+	ctx  context.Context
+	stop context.CancelFunc
+
+	mu      sync.Mutex
+	cancels map[int64]context.CancelFunc
+}
+
+func newJobRunner() *jobRunner {
+	ctx, stop := context.WithCancel(context.Background())
+
+	return &jobRunner{
+		ctx:     ctx,
+		stop:    stop,
+		cancels: make(map[int64]context.CancelFunc),
+	}
+}
+
+// The cancel() method stops a job if it's running in this process. It's a no-op
+// otherwise.
+func (j *jobRunner) cancel(id int64) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if cancel, ok := j.cancels[id]; ok {
+		cancel()
+	}
+}
+
+// The runJob() helper runs fn in the background, and records how the job finished.
+// fn's context is canceled when the job is canceled through the API or the server
+// shuts down. A job stopped by a shutdown is left running in the database, and can be
+// resumed once its lease has passed.
+func (app *application) runJob(job *data.Job, fn func(ctx context.Context, job *data.Job) error) {
+	ctx, cancel := context.WithCancel(app.jobs.ctx)
+
+	app.jobs.mu.Lock()
+	app.jobs.cancels[job.ID] = cancel
+	app.jobs.mu.Unlock()
+
+	properties := map[string]string{"job_id": strconv.FormatInt(job.ID, 10), "kind": job.Kind}
+
+	app.background(func() {
+		defer func() {
+			app.jobs.mu.Lock()
+			delete(app.jobs.cancels, job.ID)
+			app.jobs.mu.Unlock()
+
+			cancel()
+		}()
+
+		err := fn(ctx, job)
+
+		switch {
+		case err == nil:
+			err = app.models.Jobs.Finish(job.ID, data.JobCompleted, "")
+			if err != nil {
+				app.logger.PrintError(err, properties)
+				return
+			}
+
+			app.logger.PrintInfo("job completed", properties)
+		case errors.Is(err, data.ErrJobNotRunning), errors.Is(err, context.Canceled):
+			app.logger.PrintInfo("job stopped", properties)
+		default:
+			app.logger.PrintError(err, properties)
+
+			err = app.models.Jobs.Finish(job.ID, data.JobFailed, err.Error())
+			if err != nil {
+				app.logger.PrintError(err, properties)
+			}
+		}
+	})
+}
+
+// The reindexMovies() helper rebuilds the movies' derived columns in batches of
+// reindexBatchSize, starting after the job's cursor. Each batch is rebuilt in the same
+// transaction that moves the cursor on, so an interrupted job carries on from the last
+// batch it finished. It pauses for -job-batch-delay between batches, so that it
+// doesn't tie up the connection pool.
+func (app *application) reindexMovies(ctx context.Context, job *data.Job) error {
+	cursor := job.Cursor
+
+	for {
+		var (
+			lastID int64
+			count  int
+		)
+
+		err := app.models.WithTx(ctx, func(m data.Models) error {
+			var err error
+
+			lastID, count, err = m.Movies.ReindexBatch(cursor, reindexBatchSize)
+			if err != nil || count == 0 {
+				return err
+			}
+
+			return m.Jobs.Advance(job.ID, lastID, count)
+		})
+		if err != nil {
+			return err
+		}
+
+		if count < reindexBatchSize {
+			return nil
+		}
+
+		cursor = lastID
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(app.config.jobs.batchDelay):
+		}
+	}
+}
+
+// The reindexMoviesHandler() handler for the "POST /v1/admin/movies/reindex" endpoint
+// starts rebuilding the movies' derived columns in the background, and returns the job
+// to poll. A re-index which failed or was interrupted is resumed rather than started
+// again.
+func (app *application) reindexMoviesHandler(w http.ResponseWriter, r *http.Request) {
+	job, resumed, err := app.models.Jobs.Start(data.JobReindexMovies, jobLease)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrJobRunning):
+			app.jobConflictResponse(w, r, "the movies are already being re-indexed", job)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.runJob(job, app.reindexMovies)
+
+	app.recordAudit(r, data.AuditEntry{
+		Action:       "movies.reindex",
+		ResourceType: "job",
+		ResourceID:   strconv.FormatInt(job.ID, 10),
+		Metadata:     map[string]interface{}{"resumed": resumed},
+	})
+
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/admin/jobs/%d", job.ID))
+
+	err = app.writeResponse(w, r, http.StatusAccepted, envelope{"job": job}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The showJobHandler() handler for the "GET /v1/admin/jobs/:id" endpoint returns the
+// status and progress of a job.
+func (app *application) showJobHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.invalidParamResponse(w, r, err)
+		return
+	}
+
+	job, err := app.models.Jobs.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"job": job}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The cancelJobHandler() handler for the "POST /v1/admin/jobs/:id/cancel" endpoint
+// stops a running job. The batch in progress is rolled back, so a canceled job's
+// progress is exactly what its cursor says.
+func (app *application) cancelJobHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.invalidParamResponse(w, r, err)
+		return
+	}
+
+	job, err := app.models.Jobs.Cancel(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		case errors.Is(err, data.ErrJobNotRunning):
+			app.jobConflictResponse(w, r, "the job has already finished", nil)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// Stop the job straight away if it's running in this process. Otherwise the
+	// process running it stops when it next tries to move the cursor on.
+	app.jobs.cancel(job.ID)
+
+	app.recordAudit(r, data.AuditEntry{
+		Action:       "job.cancel",
+		ResourceType: "job",
+		ResourceID:   strconv.FormatInt(job.ID, 10),
+	})
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"job": job}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
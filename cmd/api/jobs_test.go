@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/petrostrak/an-open-movie-database/internal/data"
+)
+
+// The seedMovies() helper inserts n movies, and returns their IDs in order.
+func seedMovies(t *testing.T, app *application, n int) []int64 {
+	t.Helper()
+
+	ids := make([]int64, n)
+
+	for i := range ids {
+		movie := &data.Movie{Title: fmt.Sprintf("Movie %d", i+1), Year: 2000, Runtime: 90, Genres: []string{"drama"}}
+
+		err := app.models.Movies.Insert(movie)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ids[i] = movie.ID
+	}
+
+	return ids
+}
+
+// The waitForJob() helper polls a job until done returns true for it, and returns it.
+func waitForJob(t *testing.T, app *application, id int64, done func(job *data.Job) bool) *data.Job {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+
+	for {
+		job, err := app.models.Jobs.Get(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if done(job) {
+			return job
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("job %d didn't get there in time; it's %s, having processed %d", id, job.Status, job.Processed)
+		}
+
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// The startReindex() helper starts a re-index through the API, and returns the job's
+// ID.
+func startReindex(t *testing.T, ts *testServer, token string) int64 {
+	t.Helper()
+
+	code, body := ts.do(t, http.MethodPost, "/v1/admin/movies/reindex", token, nil)
+	if code != http.StatusAccepted {
+		t.Fatalf("got status %d; want %d (body %v)", code, http.StatusAccepted, body)
+	}
+
+	job, _ := body["job"].(map[string]interface{})
+	id, _ := job["id"].(float64)
+
+	return int64(id)
+}
+
+func TestReindexMovies(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t)
+
+	_, editorToken := newTestUser(t, app, "editor", "editor")
+	_, adminToken := newTestUser(t, app, "admin", "admin")
+
+	ids := seedMovies(t, app, 2*reindexBatchSize+34)
+
+	code, _ := ts.do(t, http.MethodPost, "/v1/admin/movies/reindex", editorToken, nil)
+	if code != http.StatusForbidden {
+		t.Errorf("got status %d for an editor; want %d", code, http.StatusForbidden)
+	}
+
+	id := startReindex(t, ts, adminToken)
+
+	job := waitForJob(t, app, id, func(job *data.Job) bool { return job.Status != data.JobRunning })
+
+	if job.Status != data.JobCompleted || job.Processed != int64(len(ids)) || job.Cursor != ids[len(ids)-1] {
+		t.Errorf("got job %+v; want it completed, having processed %d up to movie %d", job, len(ids), ids[len(ids)-1])
+	}
+
+	code, body := ts.do(t, http.MethodGet, fmt.Sprintf("/v1/admin/jobs/%d", id), adminToken, nil)
+	if shown, _ := body["job"].(map[string]interface{}); code != http.StatusOK || shown["status"] != data.JobCompleted {
+		t.Errorf("got status %d and body %v; want the completed job", code, body)
+	}
+
+	code, _ = ts.do(t, http.MethodGet, "/v1/admin/jobs/999999", adminToken, nil)
+	if code != http.StatusNotFound {
+		t.Errorf("got status %d for an unknown job; want %d", code, http.StatusNotFound)
+	}
+}
+
+// A canceled job stops after the batch it's on, and only one re-index can run at a
+// time.
+func TestCancelReindex(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t)
+
+	_, adminToken := newTestUser(t, app, "admin", "admin")
+
+	seedMovies(t, app, 3*reindexBatchSize)
+
+	// Pause for long enough after the first batch to cancel the job.
+	app.config.jobs.batchDelay = time.Hour
+
+	id := startReindex(t, ts, adminToken)
+
+	waitForJob(t, app, id, func(job *data.Job) bool { return job.Processed == reindexBatchSize })
+
+	code, body := ts.do(t, http.MethodPost, "/v1/admin/movies/reindex", adminToken, nil)
+	if details, _ := body["details"].(map[string]interface{}); code != http.StatusConflict || details["job_id"] != float64(id) {
+		t.Errorf("got status %d and body %v for a second re-index; want %d with the running job's ID", code, body, http.StatusConflict)
+	}
+
+	code, body = ts.do(t, http.MethodPost, fmt.Sprintf("/v1/admin/jobs/%d/cancel", id), adminToken, nil)
+	if job, _ := body["job"].(map[string]interface{}); code != http.StatusOK || job["status"] != data.JobCanceled {
+		t.Fatalf("got status %d and body %v; want the canceled job", code, body)
+	}
+
+	// The runner stops straight away, rather than after the hour's pause.
+	app.wg.Wait()
+
+	job, err := app.models.Jobs.Get(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if job.Status != data.JobCanceled || job.Processed != reindexBatchSize {
+		t.Errorf("got job %+v; want it canceled after %d movies", job, reindexBatchSize)
+	}
+
+	code, _ = ts.do(t, http.MethodPost, fmt.Sprintf("/v1/admin/jobs/%d/cancel", id), adminToken, nil)
+	if code != http.StatusConflict {
+		t.Errorf("got status %d canceling a canceled job; want %d", code, http.StatusConflict)
+	}
+}
+
+// A re-index which failed part way through carries on from its last batch.
+func TestResumeReindex(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t)
+
+	_, adminToken := newTestUser(t, app, "admin", "admin")
+
+	ids := seedMovies(t, app, 2*reindexBatchSize+1)
+
+	failed, _, err := app.models.Jobs.Start(data.JobReindexMovies, jobLease)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = app.models.Jobs.Advance(failed.ID, ids[reindexBatchSize-1], reindexBatchSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = app.models.Jobs.Finish(failed.ID, data.JobFailed, "connection reset by peer")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id := startReindex(t, ts, adminToken)
+	if id != failed.ID {
+		t.Fatalf("got job %d; want the failed job %d to be resumed", id, failed.ID)
+	}
+
+	job := waitForJob(t, app, id, func(job *data.Job) bool { return job.Status != data.JobRunning })
+
+	// The movies before the cursor aren't processed again.
+	if job.Status != data.JobCompleted || job.Processed != int64(len(ids)) || fmt.Sprint(job.Errors) != "[connection reset by peer]" {
+		t.Errorf("got job %+v; want it completed, having processed %d movies in all", job, len(ids))
+	}
+}
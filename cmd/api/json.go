@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Define a jsonScan struct to hold what scanJSON() found out about a request body: the
+// path of the innermost value around an offset, and the first unknown and duplicate
+// keys, in document order.
+type jsonScan struct {
+	offset     int64
+	offsetPath string
+	found      bool
+
+	unknownPath string
+	allowed     []string
+
+	duplicatePath string
+}
+
+// The scanJSON() helper walks the tokens of the first JSON value in body alongside the
+// type it's being decoded into, which encoding/json doesn't tell us enough about to
+// explain an error. Paths are written like "movies[2].runtime", using the keys as the
+// client sent them. The offset is from a *json.UnmarshalTypeError, or -1 if there
+// isn't one.
+//
+// Keys aren't checked against the subtrees of the body which are decoded into a map,
+// an interface{} or a type with its own UnmarshalJSON() method, and for the keys of a
+// struct, duplicates are found ignoring case, as encoding/json matches them that way.
+func scanJSON(body []byte, dst interface{}, offset int64) *jsonScan {
+	s := &jsonScan{offset: offset}
+
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+
+	// The body has already been decoded once, so the only error we can get here is from
+	// a body which isn't valid JSON, and then we just stop with what we've found.
+	_ = s.value(dec, "", reflect.TypeOf(dst))
+
+	return s
+}
+
+// The value() method scans the next value, which is decoded into t.
+func (s *jsonScan) value(dec *json.Decoder, path string, t reflect.Type) error {
+	t = jsonTarget(t)
+
+	start := dec.InputOffset()
+
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+
+	switch tok {
+	case json.Delim('{'):
+		err = s.object(dec, path, t)
+	case json.Delim('['):
+		err = s.array(dec, path, t)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Values are finished innermost first, so the first one whose span contains the
+	// offset is the one the error is about. The span starts after the previous token,
+	// and the offset of a type error is just after the opening delimiter of an object
+	// or array, or just after the end of any other value.
+	if !s.found && start < s.offset && s.offset <= dec.InputOffset() {
+		s.offsetPath = path
+		s.found = true
+	}
+
+	return nil
+}
+
+// The object() method scans the keys and values of an object, after its opening brace.
+func (s *jsonScan) object(dec *json.Decoder, path string, t reflect.Type) error {
+	isStruct := t != nil && t.Kind() == reflect.Struct
+
+	var fields []jsonField
+	if isStruct {
+		fields = jsonFields(t)
+	}
+
+	seen := make(map[string]bool)
+
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+
+		key, _ := tok.(string)
+		keyPath := key
+		if path != "" {
+			keyPath = path + "." + key
+		}
+
+		name := key
+		if isStruct {
+			name = strings.ToLower(key)
+		}
+
+		if seen[name] && s.duplicatePath == "" {
+			s.duplicatePath = keyPath
+		}
+		seen[name] = true
+
+		var elem reflect.Type
+
+		switch {
+		case isStruct:
+			field, ok := lookupJSONField(fields, key)
+			if !ok {
+				if s.unknownPath == "" {
+					s.unknownPath = keyPath
+					for _, f := range fields {
+						s.allowed = append(s.allowed, f.name)
+					}
+				}
+				break
+			}
+			elem = field.typ
+		case t != nil && t.Kind() == reflect.Map:
+			elem = t.Elem()
+		}
+
+		err = s.value(dec, keyPath, elem)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Read the closing brace.
+	_, err := dec.Token()
+	return err
+}
+
+// The array() method scans the elements of an array, after its opening bracket.
+func (s *jsonScan) array(dec *json.Decoder, path string, t reflect.Type) error {
+	var elem reflect.Type
+	if t != nil && (t.Kind() == reflect.Slice || t.Kind() == reflect.Array) {
+		elem = t.Elem()
+	}
+
+	for i := 0; dec.More(); i++ {
+		err := s.value(dec, path+"["+strconv.Itoa(i)+"]", elem)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Read the closing bracket.
+	_, err := dec.Token()
+	return err
+}
+
+// The jsonTarget() helper returns the type a value is decoded into once pointers are
+// followed, or nil if its keys can't be checked.
+func jsonTarget(t reflect.Type) reflect.Type {
+	unmarshaler := reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+
+	for t != nil {
+		if t.Implements(unmarshaler) || reflect.PointerTo(t).Implements(unmarshaler) {
+			return nil
+		}
+
+		switch t.Kind() {
+		case reflect.Pointer:
+			t = t.Elem()
+		case reflect.Interface:
+			return nil
+		default:
+			return t
+		}
+	}
+
+	return nil
+}
+
+// Define a jsonField struct to hold the key and type of a struct field.
+type jsonField struct {
+	name string
+	typ  reflect.Type
+}
+
+// The jsonFields() helper returns the fields of a struct which encoding/json decodes
+// into, in the order they're declared, by their json tag names. The fields of embedded
+// structs without a tag name are promoted, as they are by encoding/json.
+func jsonFields(t reflect.Type) []jsonField {
+	var fields []jsonField
+
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+
+		name, _, _ := strings.Cut(tag, ",")
+
+		if f.Anonymous && name == "" {
+			ft := f.Type
+			if ft.Kind() == reflect.Pointer {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				fields = append(fields, jsonFields(ft)...)
+				continue
+			}
+		}
+
+		if !f.IsExported() {
+			continue
+		}
+
+		if name == "" {
+			name = f.Name
+		}
+
+		fields = append(fields, jsonField{name: name, typ: f.Type})
+	}
+
+	return fields
+}
+
+// The lookupJSONField() helper returns the field a key is decoded into, preferring an
+// exact match and then ignoring case, as encoding/json does.
+func lookupJSONField(fields []jsonField, key string) (jsonField, bool) {
+	for _, f := range fields {
+		if f.name == key {
+			return f, true
+		}
+	}
+
+	for _, f := range fields {
+		if strings.EqualFold(f.name, key) {
+			return f, true
+		}
+	}
+
+	return jsonField{}, false
+}
+
+// The jsonPosition() helper returns the line and column, both counted from 1, of the
+// byte at index i of body. Columns count characters rather than bytes.
+func jsonPosition(body []byte, i int64) (line, column int) {
+	if i < 0 {
+		i = 0
+	}
+	if i > int64(len(body)) {
+		i = int64(len(body))
+	}
+
+	before := body[:i]
+
+	line = 1 + bytes.Count(before, []byte("\n"))
+	column = 1 + utf8.RuneCount(before[bytes.LastIndexByte(before, '\n')+1:])
+
+	return line, column
+}
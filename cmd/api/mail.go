@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/petrostrak/an-open-movie-database/internal/data"
+)
+
+// Define a mailQueue type which hands the jobs claimed from the outbox to the mail
+// workers. Bounding the number of workers bounds the number of connections we open to
+// the email provider, however many emails are due at once.
+type mailQueue struct {
+	jobs chan *data.EmailJob
+	wg   sync.WaitGroup
+}
+
+// Define a mailQueueStats struct to hold the counters which we publish via expvar.
+type mailQueueStats struct {
+	Depth    int `json:"depth"`
+	Capacity int `json:"capacity"`
+}
+
+func newMailQueue(capacity int) *mailQueue {
+	return &mailQueue{
+		jobs: make(chan *data.EmailJob, capacity),
+	}
+}
+
+func (q *mailQueue) stats() mailQueueStats {
+	return mailQueueStats{
+		Depth:    len(q.jobs),
+		Capacity: cap(q.jobs),
+	}
+}
+
+// The startMailWorkers() helper starts cfg.mailer.workers goroutines which send the
+// queued outbox jobs until the queue is closed by stopMailWorkers(). Each beats after
+// every email, and every workerHeartbeatInterval while the queue is empty.
+func (app *application) startMailWorkers() {
+	app.workers.register(workerMail, app.config.mailer.workers, workerHeartbeatInterval, func() int {
+		return len(app.mailQueue.jobs)
+	})
+
+	for i := 0; i < app.config.mailer.workers; i++ {
+		app.mailQueue.wg.Add(1)
+
+		go func(i int) {
+			defer app.mailQueue.wg.Done()
+
+			heartbeat := time.NewTicker(workerHeartbeatInterval)
+			defer heartbeat.Stop()
+
+			for {
+				select {
+				case job, ok := <-app.mailQueue.jobs:
+					if !ok {
+						return
+					}
+
+					app.sendEmailJob(job)
+				case <-heartbeat.C:
+				}
+
+				app.workers.beat(workerMail, i)
+			}
+		}(i)
+	}
+}
+
+// The stopMailWorkers() helper closes the queue and waits for the workers to send
+// everything that was already queued. It must only be called once the outbox poller,
+// which is the only thing that queues jobs, has stopped.
+func (app *application) stopMailWorkers() {
+	close(app.mailQueue.jobs)
+	app.mailQueue.wg.Wait()
+}
+
+// The enqueueEmail() helper queues a claimed outbox job for the mail workers. When the
+// queue is full it blocks, which stops the poller claiming more jobs than the workers
+// can send before their lease runs out. It returns false if the context is cancelled
+// first; the job is then left claimed, and is picked up again once its lease expires.
+func (app *application) enqueueEmail(ctx context.Context, job *data.EmailJob) bool {
+	select {
+	case app.mailQueue.jobs <- job:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// The recordFailedEmail() helper logs an email which couldn't be sent, and records it
+// in the failed_emails table so that operators can follow up.
+func (app *application) recordFailedEmail(recipient, templateFile string, err error) {
+	app.logger.PrintError(err, map[string]string{
+		"recipient": recipient,
+		"template":  templateFile,
+	})
+
+	err = app.models.FailedEmails.Insert(&data.FailedEmail{
+		Recipient: recipient,
+		Template:  templateFile,
+		Error:     err.Error(),
+	})
+	if err != nil {
+		app.logger.PrintError(err, nil)
+	}
+}
@@ -3,23 +3,62 @@ package main
 import (
 	"context"
 	"database/sql"
+	"database/sql/driver"
+	"encoding/base64"
+	"errors"
 	"expvar"
 	"flag"
+	"fmt"
+	"io"
+	"net"
 	"os"
 	"runtime"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	_ "github.com/lib/pq"
+	"github.com/petrostrak/an-open-movie-database/internal/audit"
+	conf "github.com/petrostrak/an-open-movie-database/internal/config"
+	"github.com/petrostrak/an-open-movie-database/internal/crypto"
 	"github.com/petrostrak/an-open-movie-database/internal/data"
+	"github.com/petrostrak/an-open-movie-database/internal/enrich"
+	"github.com/petrostrak/an-open-movie-database/internal/errreport"
+	"github.com/petrostrak/an-open-movie-database/internal/httpclient"
 	"github.com/petrostrak/an-open-movie-database/internal/jsonlog"
+	"github.com/petrostrak/an-open-movie-database/internal/jwt"
 	"github.com/petrostrak/an-open-movie-database/internal/mailer"
+	"github.com/petrostrak/an-open-movie-database/internal/migrate"
+	"github.com/petrostrak/an-open-movie-database/internal/oauth"
+	"github.com/petrostrak/an-open-movie-database/internal/ratelimit"
+	"github.com/petrostrak/an-open-movie-database/internal/redis"
+	"github.com/petrostrak/an-open-movie-database/internal/usage"
+	"github.com/petrostrak/an-open-movie-database/internal/validator"
+	"github.com/petrostrak/an-open-movie-database/internal/vcs"
+	"github.com/petrostrak/an-open-movie-database/migrations"
 )
 
-const (
-	version = "1.0.0"
-)
+// The build variable holds the version and VCS details of the binary, which can be
+// overridden with -ldflags (see the vcs package and "make build/api").
+var build = vcs.Get()
+
+// Define a classLimit struct to hold the requests-per-second and burst of a route
+// class. A zero rps means the class has no limit of its own.
+type classLimit struct {
+	rps   float64
+	burst int
+}
+
+// The classLimits() function returns the limits of each route class, by its name.
+func classLimits(cfg config) map[string]classLimit {
+	return map[string]classLimit{
+		routeClassRead:      cfg.limiter.read,
+		routeClassWrite:     cfg.limiter.write,
+		routeClassAuth:      cfg.limiter.auth,
+		routeClassAnonymous: cfg.limiter.anonymous,
+	}
+}
 
 // Define a config struct to hold all the configuration settings for our application.
 //
@@ -29,18 +68,159 @@ type config struct {
 	port int
 	env  string
 	db   struct {
-		dsn          string
-		maxOpenConns int
-		maxIdleConns int
-		maxIdleTime  string
+		driver         string
+		dsn            string
+		readDSN        string
+		maxOpenConns   int
+		maxIdleConns   int
+		maxIdleTime    time.Duration
+		maxLifetime    time.Duration
+		autoMigrate    bool
+		connectTimeout time.Duration
+		// The circuit breaker opens after breakerThreshold consecutive connection
+		// errors, for breakerCooldown. A threshold of 0 disables it.
+		breakerThreshold int
+		breakerCooldown  time.Duration
+	}
+	// Add a maxRequestBody field to hold the default limit on the size of JSON
+	// request bodies, in bytes.
+	maxRequestBody int64
+	// Add a maxPageSize field to hold the largest page size of a list endpoint, and a
+	// maxResponseBytes field to hold roughly how large a page of records may be, in
+	// bytes, before it's cut short. Zero disables the response size limit.
+	maxPageSize      int
+	maxResponseBytes int
+	// Add a runtimeFormat field to hold how movie runtimes are sent when the request
+	// doesn't ask for a format: "string" for "107 mins", or "minutes" for 107.
+	runtimeFormat string
+	// Add a v1 struct to hold the date that v1 of the API was deprecated on, and the
+	// date it will stop being served on, which responses under v1 carry in their
+	// Deprecation and Sunset headers. Each is the zero time when it isn't set.
+	v1 struct {
+		deprecation time.Time
+		sunset      time.Time
 	}
+	// Add a defaultLocale field to hold the language of validation error messages for
+	// requests whose Accept-Language header doesn't match a supported one.
+	defaultLocale string
+	// Add a responseMeta field to hold whether responses carry a "meta" object with
+	// the request ID, the version and the processing time.
+	responseMeta bool
+	// Add a methodOverrideEnabled field to hold whether authenticated POST requests
+	// may be treated as PATCH, PUT or DELETE requests, as the X-HTTP-Method-Override
+	// header asks.
+	methodOverrideEnabled bool
+	// Add a maintenanceMode field to hold whether requests are refused with a 503
+	// Service Unavailable response, while the database is being worked on, say.
+	maintenanceMode bool
+	// Add an anonymousReads field to hold whether clients without a token may list and
+	// show movies, as if they had the movies:read permission.
+	anonymousReads bool
+	// Add a requestTimeout field to hold how long a request may take before the
+	// client gets a 503 Service Unavailable response. Zero disables the timeout.
+	requestTimeout time.Duration
 	// Add a new limiter struct containing fields for the requests-per-second and burst
 	// values, and a boolean field which we can ust to enable/disable rate limiting
 	// altogether.
+	//
+	// The userRPS and userBurst fields hold the separate settings for authenticated
+	// users, who are limited per user rather than per IP address.
+	//
+	// The store field selects where the token buckets are kept ("memory" or "redis"),
+	// and failOpen whether requests are allowed when the store is unavailable.
+	//
+	// The read, write and auth fields hold the limits of each route class, which
+	// apply on top of the limits above.
+	//
+	// The maxClients, cleanupInterval and maxIdle fields limit the clients the memory
+	// store keeps: at most maxClients of each kind, with those not seen for maxIdle
+	// removed every cleanupInterval.
 	limiter struct {
-		rps    float64
-		burst  int
-		enable bool
+		rps             float64
+		burst           int
+		userRPS         float64
+		userBurst       int
+		enable          bool
+		store           string
+		failOpen        bool
+		maxClients      int
+		cleanupInterval time.Duration
+		maxIdle         time.Duration
+		read            classLimit
+		write           classLimit
+		auth            classLimit
+		anonymous       classLimit
+	}
+	// Add a grpc struct to hold the port of the gRPC server for internal consumers, which
+	// isn't started when it's 0.
+	grpc struct {
+		port int
+	}
+	// Add a redis struct to hold the address and password of the Redis server used by
+	// the redis limiter store.
+	redis struct {
+		addr     string
+		password string
+	}
+	// Add a mailer struct to hold the email provider ("smtp", "mailgun" or "console"),
+	// the number of mail workers and the size of their queue, and the settings for the
+	// Mailgun HTTP API.
+	mailer struct {
+		provider  string
+		workers   int
+		queueSize int
+		mailgun   struct {
+			baseURL string
+			domain  string
+			apiKey  string
+		}
+	}
+	// Add a webhooks struct to hold the number of goroutines delivering webhooks, and
+	// the size of their queue.
+	webhooks struct {
+		workers   int
+		queueSize int
+	}
+	// Add an outbox struct to hold how often the outbox of emails is polled, and how
+	// many times an email is attempted before it's marked as failed.
+	outbox struct {
+		pollInterval time.Duration
+		maxAttempts  int
+	}
+	// Add a jobs struct to hold the pause between the batches of the admin jobs, such as
+	// re-indexing the movies.
+	jobs struct {
+		batchDelay time.Duration
+	}
+	// Add a usage struct to hold how often the per-user request counts are written to
+	// the database.
+	usage struct {
+		flushInterval time.Duration
+	}
+	// Add a frontend struct to hold the base URL of the web frontend, which we use to
+	// build links in emails.
+	frontend struct {
+		baseURL string
+	}
+	// Add an api struct to hold the public base URL of the API itself, which we use to
+	// build links in emails to endpoints that the API serves, such as unsubscribing.
+	api struct {
+		baseURL string
+	}
+	// Add a duplicates struct to hold the score at which an existing movie counts as
+	// a duplicate of one created with ?strict=true.
+	duplicates struct {
+		threshold float64
+	}
+	// Add a watchlist struct to hold the most emails about updates to the movies on
+	// their watchlist that a user is sent each day.
+	watchlist struct {
+		dailyEmailCap int
+	}
+	// Add a digest struct to hold the hour of the day, in UTC, at which the daily digest
+	// of new movies is sent.
+	digest struct {
+		hour int
 	}
 	// Update the config struct to hold the SMTP server settings.
 	smtp struct {
@@ -50,9 +230,129 @@ type config struct {
 		password string
 		sender   string
 	}
+	// Add a debug struct to hold the basic auth credentials for the /debug/ endpoints,
+	// and whether the pprof endpoints are enabled.
+	debug struct {
+		username         string
+		password         string
+		endpointsEnabled bool
+	}
+	// Add a trustedProxies field to hold the address ranges of the proxies (such as a
+	// load balancer) whose X-Forwarded-For and X-Real-IP headers we believe.
+	trustedProxies []*net.IPNet
+	// Add an https struct to hold whether plain HTTP requests are refused, the paths
+	// which are exempt (such as the healthcheck, for load balancer probes), and
+	// whether we were told that enforcing HTTPS in development is intended.
+	https struct {
+		enforce          bool
+		exemptPaths      []string
+		iKnowWhatImDoing bool
+	}
+	// Add a criticalWorkers field to hold the names of the background workers which
+	// make the healthcheck report the application as unavailable when they're stale.
+	criticalWorkers []string
+	// Add a popularity struct to hold how often the movies' popularity scores are
+	// refreshed, and the weights they're computed with, and a defaultSort field to hold
+	// the sort of a movie listing which doesn't ask for one.
+	popularity struct {
+		interval time.Duration
+		weights  data.PopularityWeights
+	}
+	defaultSort string
 	// Add a cors struct and trustedOrigins field with the type []string.
+	//
+	// The allowedMethods and allowedHeaders fields hold what a preflight request may
+	// ask for, allowCredentials whether cookies and Authorization headers are allowed
+	// on cross-origin requests, and maxAge how long browsers may cache a preflight
+	// response.
 	cors struct {
-		trustedOrigins []string
+		trustedOrigins   []string
+		allowedMethods   []string
+		allowedHeaders   []string
+		allowCredentials bool
+		maxAge           time.Duration
+	}
+	// Add a google struct to hold the OAuth client credentials and the redirect URL
+	// registered in the Google Cloud console.
+	google struct {
+		clientID     string
+		clientSecret string
+		redirectURL  string
+	}
+	// Add an enrich struct to hold the OMDb API key, base URL and request timeout used
+	// to fill in the details missing from a new movie. Enrichment is off when the key
+	// is empty.
+	enrich struct {
+		apiKey  string
+		baseURL string
+		timeout time.Duration
+	}
+	// Add a passwordHash struct to hold the password hashing algorithm and its cost
+	// settings.
+	passwordHash struct {
+		algorithm   string
+		cost        int
+		memory      uint
+		time        uint
+		parallelism uint
+	}
+	// Add a movieCache struct to control the cache of movies, which is kept either in
+	// memory or in Redis ("memory" or "redis"). The size and staleness fields only
+	// apply to the in-memory cache.
+	movieCache struct {
+		enabled   bool
+		store     string
+		ttl       time.Duration
+		size      int
+		staleness time.Duration
+	}
+	// Add a permissionsCache struct to control the in-memory cache of user
+	// permissions.
+	permissionsCache struct {
+		enabled bool
+		ttl     time.Duration
+	}
+	// Add a userCache struct to control the in-memory cache of users for
+	// authentication tokens.
+	userCache struct {
+		enabled        bool
+		size           int
+		ttl            time.Duration
+		verifyInterval time.Duration
+	}
+	// Add a sentry struct to hold the DSN of the Sentry project which unexpected errors
+	// are reported to. Reporting is off when it's empty.
+	sentry struct {
+		dsn string
+	}
+	// Add an auth struct to hold the authentication token mode ("stateful" or "jwt")
+	// and, for jwt mode, the signing algorithm and key.
+	auth struct {
+		mode   string
+		jwtAlg string
+		jwtKey string
+	}
+	// Add an encryption struct to hold the base64-encoded key which sensitive columns,
+	// such as webhook secrets, are encrypted with, and the previous key, which values
+	// are still decrypted with until the rotate command has re-encrypted them.
+	encryption struct {
+		key    string
+		oldKey string
+	}
+	// Add a users struct to hold whether a deleted user's reviews are kept, without
+	// an author, rather than deleted along with the account.
+	users struct {
+		deleteAnonymizesReviews bool
+	}
+	// Add a tokens struct to hold the lifetimes of each kind of token, the number of
+	// random bytes in a token, and the interval of the background job which removes
+	// expired tokens.
+	tokens struct {
+		authTTL         time.Duration
+		activationTTL   time.Duration
+		unsubscribeTTL  time.Duration
+		length          int
+		cleanupInterval time.Duration
 	}
 }
 
@@ -70,74 +370,235 @@ type application struct {
 	config config
 	logger *jsonlog.Logger
 	models data.Models
+	db     *sql.DB
+	readDB *sql.DB
 	mailer mailer.Mailer
+
+	// stopMailRetries stops the mailer backing off between retries, when the server
+	// starts shutting down. It's nil in the tests.
+	stopMailRetries context.CancelFunc
+
+	// reporter sends unexpected errors and panics to an error tracking service.
+	reporter errreport.Reporter
+
+	google oauth.Google
+	jwt    *jwt.Signer
 	wg     sync.WaitGroup
+
+	// enricher looks up the details missing from a new movie. It's enrich.Disabled
+	// when no provider is configured.
+	enricher enrich.Provider
+
+	// httpClient makes the requests to other services, such as webhook deliveries.
+	httpClient *httpclient.Client
+
+	// audit writes the audit log, exports holds the user data export jobs, jobs the
+	// admin jobs running in this process, mailQueue holds the emails waiting to be
+	// sent, webhookQueue the webhook deliveries waiting to be made, outbox wakes the
+	// outbox poller, usage counts the requests made by each user, workers holds the
+	// heartbeats of the background workers, and views counts the views of each movie
+	// until the popularity scores are next refreshed.
+	audit        *audit.Logger
+	exports      *exportRegistry
+	jobs         *jobRunner
+	mailQueue    *mailQueue
+	webhookQueue *webhookQueue
+	outbox       *outbox
+	usage        *usage.Meter
+	workers      *workerRegistry
+	views        *viewCounter
+
+	// dumpMu is held while the database is being exported or imported, so that only
+	// one runs at a time.
+	dumpMu sync.Mutex
+
+	// limiters holds the rate limiters for anonymous clients (by IP address) and
+	// for authenticated users (by user ID), and those for each route class, by its
+	// name, which count both.
+	limiters struct {
+		ip      ratelimit.RateLimiter
+		user    ratelimit.RateLimiter
+		classes map[string]ratelimit.RateLimiter
+	}
+
+	// permissionsCache and userCache are nil when the corresponding cache is
+	// disabled.
+	permissionsCache *data.PermissionsCache
+	userCache        *data.UserCache
+
+	// breakers holds the circuit breakers of the primary and read replica pools, which
+	// are nil when the breakers are disabled or there's no replica.
+	breakers struct {
+		primary *data.Breaker
+		read    *data.Breaker
+	}
+
+	// migrator reports the schema version in the verbose healthcheck.
+	migrator *migrate.Migrator
+
+	// live holds the settings which can be changed by reloading the configuration,
+	// which the middleware reads on every request instead of app.config. reload holds
+	// what's needed to read the configuration again (see reload.go).
+	live   atomic.Pointer[dynamicConfig]
+	reload struct {
+		mu       sync.Mutex
+		args     []string
+		settings map[string]string
+	}
 }
 
-// go run ./cmd/api -port=3030 -env=production
+// go run ./cmd/api serve -port=3030 -env=production
 func main() {
+	// Initialize a new jsonlog.Logger which writes any message -at or above- the INFO
+	// severity level to the standart out stream.
+	logger := jsonlog.New(os.Stdout, jsonlog.LevelInfo)
+
+	err := run(logger, os.Args[1:])
+	if err != nil {
+		var usageErr usageError
+
+		switch {
+		case errors.As(err, &usageErr):
+			fmt.Fprintf(os.Stderr, "%s\n\n", err)
+			printUsage(os.Stderr)
+			os.Exit(exitUsageError)
+		default:
+			// PrintFatal() exits with exitRuntimeError.
+			logger.PrintFatal(err, nil)
+		}
+	}
+}
+
+// The run() function runs the command named by the first argument. Without a command,
+// or when the first argument is a flag, we run the server, so that existing
+// invocations such as "api -port=4000" keep working.
+func run(logger *jsonlog.Logger, args []string) error {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return serveCommand(logger, args)
+	}
+
+	if args[0] == "help" {
+		printUsage(os.Stdout)
+		return nil
+	}
+
+	for _, cmd := range commands {
+		if cmd.name == args[0] {
+			return cmd.run(logger, args[1:])
+		}
+	}
+
+	return usageError{fmt.Sprintf("unknown command %q", args[0])}
+}
+
+// The serveCommand() function runs the API server, with all of the settings read from
+// command-line flags, OMDB_ environment variables or a config file.
+func serveCommand(logger *jsonlog.Logger, args []string) error {
 	// Declare an instance of the config struct.
 	var cfg config
 
-	// Read the value of the port and env command-line flags into the config struct. We
-	// default to using the port number 4000 and the environment "development" if no
-	// corresponding flags are provided.
-	flag.IntVar(&cfg.port, "port", 4000, "API server port")
-	flag.StringVar(&cfg.env, "env", "development", "Environment(development|staging|production)")
+	fs := serveFlags(&cfg, logger, flag.ExitOnError)
 
-	// Read the DSN value from the db-dsn command-line flag into the config struct.
-	// We default to using our development DSN if no flag is provided.
-	//
-	// Use the value of the OMDB_DB_DSN environment variable as the default value
-	// for the db-dsn command-line flag.
-	flag.StringVar(&cfg.db.dsn, "db-dsn", os.Getenv("OMDB_DB_DSN"), "PostgreSQL DSN")
+	// Print the version information and exit, rather than starting the server.
+	displayVersion := fs.Bool("version", false, "Display version information and exit")
 
-	// Read the connection pool settings from command-line flags into the config struct
-	flag.IntVar(&cfg.db.maxOpenConns, "db-max-open-conns", 25, "PostgreSQL max open connections")
-	flag.IntVar(&cfg.db.maxIdleConns, "db-max-idle-conns", 25, "PostgreSQL max idle connections")
-	flag.StringVar(&cfg.db.maxIdleTime, "db-max-idle-time", "15m", "PostgreSQL mac connection idle time")
+	// Parse the command-line flags, and then fill in the rest from the OMDB_
+	// environment variables and the -config file. -version is only read from the
+	// command line.
+	err := conf.Load(fs, args, "version")
+	if err != nil {
+		return err
+	}
 
-	// Create command line flags to read the setting values into the config struct.
-	// We use true as the default for the enabled setting
-	flag.Float64Var(&cfg.limiter.rps, "limiter-rps", 2, "Rate limiter maximum requests per second")
-	flag.IntVar(&cfg.limiter.burst, "limiter-burst", 4, "Rate limiter maximum burst")
-	flag.BoolVar(&cfg.limiter.enable, "limiter-enable", true, "Enable rate limiter")
+	if *displayVersion {
+		printVersion(os.Stdout)
+		return nil
+	}
 
-	// Read the SMTP server configuration settings into the config struct, using the
-	// Mailtrap settings as the default values. IMPORTANT: If you're following along,
-	// make sure to replace the default values for smtp-username and smtp-password
-	// with your own Mailtrap credentials.
-	flag.StringVar(&cfg.smtp.host, "smtp-host", "    smtp.mailtrap.io", "SMTP host")
-	flag.IntVar(&cfg.smtp.port, "smtp-port", 25, "SMTP port")
-	flag.StringVar(&cfg.smtp.username, "smtp-username", "a8c6ea4f80cc3f", "SMTP username")
-	flag.StringVar(&cfg.smtp.password, "smtp-password", "e6231e9d245f54", "SMTP password")
-	flag.StringVar(&cfg.smtp.sender, "smtp-sender", "Online Movie DB <no-reply@omdb.net", "SMTP sender")
+	err = validateConfig(cfg)
+	if err != nil {
+		return err
+	}
 
-	// Use the flag.Func() to process the -cors-trusted-origins command line
-	// flag. In this we use the strings.Fields() to split the flag value into a
-	// slice based on whitespace characters and assign it to our config struct.
-	// Importantly, if the -cors-trusted-origins flag is not present, contains
-	// the empty string, or contains only whitespace, then strings.Fields() will
-	// return an empty []string slice.
-	flag.Func("cors-trusted-origins", "Trusted CORS origin (space separated)", func(s string) error {
-		cfg.cors.trustedOrigins = strings.Fields(s)
-		return nil
-	})
+	err = data.SetTokenLength(cfg.tokens.length)
+	if err != nil {
+		return err
+	}
 
-	flag.Parse()
+	err = data.SetMaxPageSize(cfg.maxPageSize)
+	if err != nil {
+		return err
+	}
 
-	// Initialize a new jsonlog.Logger which writes any message -at or above- the INFO
-	// severity level to the standart out stream.
-	logger := jsonlog.New(os.Stdout, jsonlog.LevelInfo)
+	// Install the password hashing parameters for the data package.
+	err = setHashingParams(cfg)
+	if err != nil {
+		return err
+	}
+
+	// Install the keys which sensitive columns are encrypted with.
+	err = setEncryptionKeyring(cfg)
+	if err != nil {
+		return err
+	}
+
+	// Log the settings we're starting with, leaving out the secrets.
+	logger.PrintInfo("configuration", effectiveConfig(fs, cfg))
+
+	// Parse the email templates, so that a malformed template is reported straight
+	// away rather than when an email is sent.
+	err = mailer.LoadTemplates()
+	if err != nil {
+		return err
+	}
+
+	// Create the mailer for the configured email provider.
+	mail, err := openMailer(cfg, logger)
+	if err != nil {
+		return err
+	}
+
+	// Retry sends which fail with a temporary error, backing off between attempts. The
+	// backoff is cut short by stopMailRetries() once the server starts shutting down, so
+	// that an email which keeps failing doesn't hold the shutdown up.
+	mailCtx, stopMailRetries := context.WithCancel(context.Background())
+	defer stopMailRetries()
+
+	retryMailer := mailer.NewRetry(mailCtx, mail, mailer.DefaultRetryDelays)
+
+	// Create the error reporter, which is a no-op unless a Sentry DSN is given.
+	reporter, err := openReporter(cfg, logger)
+	if err != nil {
+		return err
+	}
+
+	// Create the rate limiters for the configured store.
+	newLimiter, err := openRateLimiters(cfg, logger)
+	if err != nil {
+		return err
+	}
+
+	// Create the JWT signer if we're running in jwt mode. Doing this before opening
+	// the database means a bad key is reported straight away.
+	signer, err := openJWTSigner(cfg)
+	if err != nil {
+		return err
+	}
 
 	// Call the openDB() helper function to create the connection pool,
 	// passing in the config struct. If this returns an error, we log it and exit the
 	// application.
-	db, err := openDB(cfg)
+	//
+	// Each pool gets its own circuit breaker, unless -db-breaker-threshold is 0.
+	var dbBreaker, readDBBreaker *data.Breaker
+	if cfg.db.breakerThreshold > 0 {
+		dbBreaker = data.NewBreaker(cfg.db.breakerThreshold, cfg.db.breakerCooldown)
+		readDBBreaker = data.NewBreaker(cfg.db.breakerThreshold, cfg.db.breakerCooldown)
+	}
+
+	db, err := openDB(cfg, logger, dbBreaker)
 	if err != nil {
-		// Use the PrintFatal() to write a log entry containing the error at the
-		// FATAL level and exit.
-		logger.PrintFatal(err, nil)
+		return err
 	}
 
 	// Defer a call to db.Close() so that the connection pool is closed before the
@@ -148,20 +609,70 @@ func main() {
 	// established.
 	logger.PrintInfo("database connection pool established", nil)
 
+	// Open the read replica pool, if one is configured. readDB is nil otherwise, and
+	// the models read from the primary.
+	readDB, err := openReadDB(cfg, logger, readDBBreaker)
+	if err != nil {
+		return err
+	}
+
+	if readDB != nil {
+		defer readDB.Close()
+
+		logger.PrintInfo("read replica connection pool established", nil)
+	}
+
+	migrator, err := migrate.NewForDriver(cfg.db.driver, db, migrations.ForDriver(cfg.db.driver))
+	if err != nil {
+		return err
+	}
+
+	// Apply any pending migrations before the server starts accepting requests, so
+	// that a new version is never served against an old schema.
+	if cfg.db.autoMigrate {
+		err = autoMigrate(logger, migrator)
+		if err != nil {
+			return err
+		}
+	}
+
 	// Publish a new "version" variable in the expvar handler containing our application
-	// version number
-	expvar.NewString("version").Set(version)
+	// version number, along with the rest of the build details.
+	expvar.Publish("version", expvar.Func(func() interface{} {
+		return build
+	}))
 
 	// Publish the number of active goroutines.
 	expvar.Publish("goroutines", expvar.Func(func() interface{} {
 		return runtime.NumGoroutine()
 	}))
 
-	// Publish the database connection pool statistics.
+	// Publish the database connection pool statistics. The expvar.Func is called on
+	// each request to /debug/vars, so they're always current, and include
+	// OpenConnections, InUse, Idle, WaitCount, WaitDuration, MaxIdleClosed and
+	// MaxLifetimeClosed.
 	expvar.Publish("database", expvar.Func(func() interface{} {
 		return db.Stats()
 	}))
 
+	// Publish the read replica's connection pool statistics too, when there is one.
+	if readDB != nil {
+		expvar.Publish("database_read", expvar.Func(func() interface{} {
+			return readDB.Stats()
+		}))
+	}
+
+	// Publish the state of the circuit breakers.
+	if dbBreaker != nil {
+		expvar.Publish("database_breaker", expvar.Func(func() interface{} {
+			breakers := map[string]interface{}{"primary": dbBreaker.Stats()}
+			if readDB != nil {
+				breakers["read"] = readDBBreaker.Stats()
+			}
+			return breakers
+		}))
+	}
+
 	// Publish the current Unix timestamp.
 	expvar.Publish("timestamp", expvar.Func(func() interface{} {
 		return time.Now().Unix()
@@ -170,76 +681,1244 @@ func main() {
 	// Declare an instance of the application struct, containing the config struct and
 	// the logger.
 	//
-	// Use the data.NewModels() to initialize a Models struct, passing in the
-	// connection pool as a parameter.
+	// Use the data.NewModelsForDriver() to initialize a Models struct, passing in the
+	// database driver and the connection pool as parameters.
 	//
-	// Initialize a new Mailer instance using the settings from the command line
-	// flags, and add it to the application struct.
-	app := &application{
-		config: cfg,
-		logger: logger,
-		models: data.NewModels(db),
-		mailer: mailer.New(cfg.smtp.host, cfg.smtp.port, cfg.smtp.username, cfg.smtp.username, cfg.smtp.sender),
+	// Read-only queries use the read replica pool, or the primary if readDB is nil.
+	//
+	// Add the Mailer for the configured email provider to the application struct.
+	models, err := data.NewModelsForDriver(cfg.db.driver, db, readDB)
+	if err != nil {
+		return err
 	}
 
-	// Call app.serve() to start the server.
-	err = app.serve()
+	err = checkEncryptedColumns(models)
 	if err != nil {
-		logger.PrintFatal(err, nil)
+		return err
 	}
-}
 
-// The openDB() function returns a sql.DB connection pool.
-func openDB(cfg config) (*sql.DB, error) {
-	// Use sql.Open() to create an empty connection pool, using the DSN from the config
-	// struct.
-	db, err := sql.Open("postgres", cfg.db.dsn)
-	if err != nil {
-		return nil, err
+	// Share the database query between concurrent reads of the same movie, and publish
+	// how many were shared. The cache goes in front, so that its misses are shared too.
+	coalescer := data.NewMovieCoalescer(models.Movies)
+	models.Movies = coalescer
+
+	expvar.Publish("movie_coalescing", expvar.Func(func() interface{} {
+		return coalescer.Stats()
+	}))
+
+	// Put the cache in front of the movies, if it's enabled, and publish its counters.
+	if cfg.movieCache.enabled {
+		cache, stats, err := openMovieCache(cfg, logger, models.Movies)
+		if err != nil {
+			return err
+		}
+
+		models.Movies = cache
+		expvar.Publish("movie_cache", expvar.Func(stats))
 	}
 
-	// Set the maximum number of open (in-use + idle) connections in the pool.
-	// Note that passing a value less than or equal to 0 will mean there is no
-	// limit.
-	//
-	// As a rule of thumb, you should explicitly set a MaxOpenConns value.
-	// Set a MaxOpenConns limit of 25 connections as it happens to be a
-	// reasonable starting point for small-to- medium web applications and APIs.
-	db.SetMaxOpenConns(cfg.db.maxOpenConns)
+	// Create the client shared by the webhooks and enrichment for calling other
+	// services, and publish its counters for each host.
+	httpClient := httpclient.New(httpclient.Options{})
 
-	// Set the maximum number of idle connections in the pool. Again, passing a value
-	// less that or equal to 0 will mean there is no limit.
-	//
-	// In general, higher MaxOpenConns and MaxIdleConns values will lead to better
-	// performance. Because MaxIdleConns should always be less than or equal to
-	// MaxOpenConns, we’ll also limit MaxIdleConns to 25 connections.
-	db.SetMaxIdleConns(cfg.db.maxIdleConns)
+	expvar.Publish("http_client", expvar.Func(func() interface{} {
+		return httpClient.Stats()
+	}))
 
-	// Use the time.ParseDuration() to convert the idle timeout duration string
-	// to a time.Duration type.
-	duration, err := time.ParseDuration(cfg.db.maxIdleTime)
-	if err != nil {
-		return nil, err
+	app := &application{
+		config:   cfg,
+		logger:   logger,
+		models:   models,
+		db:       db,
+		readDB:   readDB,
+		mailer:   retryMailer,
+		reporter: reporter,
+		google:   oauth.NewGoogle(cfg.google.clientID, cfg.google.clientSecret, cfg.google.redirectURL),
+		enricher: openEnricher(cfg, httpClient),
+		jwt:      signer,
+		audit:    audit.New(models.Audit, logger, 1024),
+		exports:  newExportRegistry(),
+		jobs:     newJobRunner(),
+
+		mailQueue:       newMailQueue(cfg.mailer.queueSize),
+		stopMailRetries: stopMailRetries,
+		webhookQueue:    newWebhookQueue(cfg.webhooks.queueSize),
+		usage:           usage.New(models.Usage, logger, cfg.usage.flushInterval),
+		outbox:          newOutbox(),
+		workers:         newWorkerRegistry(),
+		views:           newViewCounter(),
+		migrator:        migrator,
+		httpClient:      httpClient,
 	}
 
-	// Set the maximum idle timeout.
-	//
-	// You should set generally a ConnMaxIdleTime value to remove idle
-	// connections thathaven’t been used for a long time. In this project
-	// we’ll set a ConnMaxIdleTime duration of 15 minutes.
-	db.SetConnMaxIdleTime(duration)
+	app.limiters.ip = newLimiter("ip", cfg.limiter.rps, cfg.limiter.burst)
+	app.limiters.user = newLimiter("user", cfg.limiter.userRPS, cfg.limiter.userBurst)
+	app.limiters.classes = make(map[string]ratelimit.RateLimiter)
+
+	for class, limits := range classLimits(cfg) {
+		app.limiters.classes[class] = newLimiter(class, limits.rps, limits.burst)
+	}
 
-	// Create a context with a 5-second timeout deadline.
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
+	// Publish the number of clients the memory limiters hold, and how many they've
+	// evicted and expired.
+	if cfg.limiter.store == "memory" {
+		expvar.Publish("rate_limiter", expvar.Func(func() interface{} {
+			stats := map[string]interface{}{
+				"ip":   app.limiters.ip.(*ratelimit.Memory).Stats(),
+				"user": app.limiters.user.(*ratelimit.Memory).Stats(),
+			}
 
-	// Use PingContext() to establish a new connection to the database, passing in the
-	// context we created above as a parameter. If the connection couldn't be
-	// established successfully within the 5 second deadline, then this will return an// error.
-	if err := db.PingContext(ctx); err != nil {
-		return nil, err
+			for class, limiter := range app.limiters.classes {
+				stats[class] = limiter.(*ratelimit.Memory).Stats()
+			}
+
+			return stats
+		}))
 	}
 
-	// Return the sql.DB connection pool
-	return db, nil
+	app.breakers.primary = dbBreaker
+	if readDB != nil {
+		app.breakers.read = readDBBreaker
+	}
+
+	app.live.Store(newDynamicConfig(cfg))
+	app.reload.args = args
+	app.reload.settings = settingValues(fs, cfg)
+
+	// Publish the email queue depth and the sent, retry and failure counters.
+	expvar.Publish("emails", expvar.Func(func() interface{} {
+		return map[string]interface{}{
+			"queue":  app.mailQueue.stats(),
+			"sender": retryMailer.Stats(),
+		}
+	}))
+
+	// Publish the status of each background worker, as the verbose healthcheck reports
+	// it.
+	expvar.Publish("workers", expvar.Func(func() interface{} {
+		return app.workers.status(cfg.criticalWorkers)
+	}))
+
+	if cfg.permissionsCache.enabled {
+		app.permissionsCache = data.NewPermissionsCache(cfg.permissionsCache.ttl)
+	}
+
+	if cfg.userCache.enabled {
+		app.userCache = data.NewUserCache(cfg.userCache.size, cfg.userCache.ttl, cfg.userCache.verifyInterval)
+
+		// Publish the user cache size and hit/miss counters.
+		expvar.Publish("user_cache", expvar.Func(func() interface{} {
+			return app.userCache.Stats()
+		}))
+	}
+
+	// Call app.serve() to start the server.
+	return app.serve()
+}
+
+// The serveFlags() function defines the flags of the serve command, which read the
+// settings into cfg. It's used to read the configuration again when it's reloaded, too.
+func serveFlags(cfg *config, logger *jsonlog.Logger, errorHandling flag.ErrorHandling) *flag.FlagSet {
+	fs := flag.NewFlagSet("serve", errorHandling)
+
+	// Read the value of the port and env command-line flags into the config struct. We
+	// default to using the port number 4000 and the environment "development" if no
+	// corresponding flags are provided.
+	fs.IntVar(&cfg.port, "port", 4000, "API server port")
+	fs.StringVar(&cfg.env, "env", "development", "Environment(development|staging|production)")
+	fs.IntVar(&cfg.grpc.port, "grpc-port", 0, "gRPC server port for internal consumers (0 to disable)")
+	fs.DurationVar(&cfg.requestTimeout, "request-timeout", 10*time.Second, "Maximum time to process a request (0 to disable)")
+	fs.Int64Var(&cfg.maxRequestBody, "max-request-body", 1_048_576, "Maximum size of a JSON request body in bytes")
+	fs.IntVar(&cfg.maxPageSize, "max-page-size", data.DefaultMaxPageSize, "Maximum number of records on a page of a list endpoint")
+	fs.IntVar(&cfg.maxResponseBytes, "max-response-bytes", 1_048_576, "Maximum size of the records on a page of a list endpoint in bytes, beyond which the page is cut short (0 to disable)")
+	fs.StringVar(&cfg.runtimeFormat, "runtime-format", runtimeFormatString, "Default format of movie runtimes in responses (string|minutes)")
+	fs.Func("v1-deprecation", "Date that v1 of the API was deprecated on, sent in the Deprecation header of v1 responses (YYYY-MM-DD)", func(s string) error {
+		return parseDateFlag(s, &cfg.v1.deprecation)
+	})
+	fs.Func("v1-sunset", "Date that v1 of the API will stop being served on, sent in the Sunset header of v1 responses (YYYY-MM-DD)", func(s string) error {
+		return parseDateFlag(s, &cfg.v1.sunset)
+	})
+	fs.BoolVar(&cfg.methodOverrideEnabled, "method-override-enabled", false, "Let authenticated clients send PATCH, PUT and DELETE requests as POST requests with X-HTTP-Method-Override")
+	fs.BoolVar(&cfg.responseMeta, "response-meta", true, "Add a meta object with the request ID, version and processing time to responses")
+	fs.StringVar(&cfg.defaultLocale, "default-locale", validator.DefaultLocale, "Language of validation error messages when the request doesn't ask for a supported one ("+strings.Join(validator.Locales(), "|")+")")
+
+	registerDBFlags(fs, cfg)
+	registerLogFlags(fs, logger)
+	fs.BoolVar(&cfg.db.autoMigrate, "db-auto-migrate", false, "Apply pending database migrations at startup")
+
+	// Read the DSN of an optional read replica. When it's set, read-only queries use
+	// a second connection pool with the same settings as the primary.
+	fs.StringVar(&cfg.db.readDSN, "db-read-dsn", "", "Read replica DSN, for the same driver as -db-dsn (optional)")
+
+	// Read the circuit breaker settings. Each connection pool has its own breaker.
+	fs.IntVar(&cfg.db.breakerThreshold, "db-breaker-threshold", 5, "Consecutive connection errors which open the database circuit breaker (0 to disable)")
+	fs.DurationVar(&cfg.db.breakerCooldown, "db-breaker-cooldown", 10*time.Second, "How long the database circuit breaker stays open before a request is let through to test the database")
+
+	// Create command line flags to read the setting values into the config struct.
+	// We use true as the default for the enabled setting
+	//
+	// The IP address limit applies to every request, including authenticated ones, so
+	// it's no lower than the limit for each user by default.
+	fs.Float64Var(&cfg.limiter.rps, "limiter-rps", 4, "Rate limiter maximum requests per second for each IP address")
+	fs.IntVar(&cfg.limiter.burst, "limiter-burst", 8, "Rate limiter maximum burst for each IP address")
+	fs.Float64Var(&cfg.limiter.userRPS, "limiter-user-rps", 4, "Rate limiter maximum requests per second for each authenticated user")
+	fs.IntVar(&cfg.limiter.userBurst, "limiter-user-burst", 8, "Rate limiter maximum burst for each authenticated user")
+	fs.BoolVar(&cfg.limiter.enable, "limiter-enable", true, "Enable rate limiter")
+	fs.StringVar(&cfg.limiter.store, "limiter-store", "memory", "Rate limiter store (memory|redis)")
+	fs.BoolVar(&cfg.limiter.failOpen, "limiter-fail-open", true, "Allow requests when the rate limiter store is unavailable")
+	fs.Float64Var(&cfg.limiter.read.rps, "limiter-read-rps", 0, "Rate limiter maximum read requests per second for each client (0 = no separate limit)")
+	fs.IntVar(&cfg.limiter.read.burst, "limiter-read-burst", 0, "Rate limiter maximum burst of read requests for each client")
+	fs.Float64Var(&cfg.limiter.write.rps, "limiter-write-rps", 0, "Rate limiter maximum write requests per second for each client (0 = no separate limit)")
+	fs.IntVar(&cfg.limiter.write.burst, "limiter-write-burst", 0, "Rate limiter maximum burst of write requests for each client")
+	fs.Float64Var(&cfg.limiter.auth.rps, "limiter-auth-rps", 0, "Rate limiter maximum sign in and sign up requests per second for each client (0 = no separate limit)")
+	fs.IntVar(&cfg.limiter.auth.burst, "limiter-auth-burst", 0, "Rate limiter maximum burst of sign in and sign up requests for each client")
+	fs.Float64Var(&cfg.limiter.anonymous.rps, "limiter-anonymous-rps", 1, "Rate limiter maximum anonymous read requests per second for each IP address, with -anonymous-reads (0 = no separate limit)")
+	fs.IntVar(&cfg.limiter.anonymous.burst, "limiter-anonymous-burst", 5, "Rate limiter maximum burst of anonymous read requests for each IP address")
+	fs.IntVar(&cfg.limiter.maxClients, "limiter-max-clients", ratelimit.DefaultMaxEntries, "Rate limiter maximum clients kept in memory, for each of IP addresses and users")
+	fs.DurationVar(&cfg.limiter.cleanupInterval, "limiter-cleanup-interval", ratelimit.DefaultCleanupInterval, "Rate limiter interval between removing idle clients from memory")
+	fs.DurationVar(&cfg.limiter.maxIdle, "limiter-max-idle", ratelimit.DefaultMaxIdle, "Rate limiter time after which an unseen client is removed from memory")
+
+	// Read the Redis settings, which are used when -limiter-store=redis, so that the
+	// limits are shared between every instance of the API, and by the movie cache.
+	fs.StringVar(&cfg.redis.addr, "redis-addr", "localhost:6379", "Redis address")
+	fs.StringVar(&cfg.redis.password, "redis-password", "", "Redis password")
+
+	// Read the SMTP server configuration settings into the config struct, using the
+	// Mailtrap settings as the default values. IMPORTANT: If you're following along,
+	// make sure to replace the default values for smtp-username and smtp-password
+	// with your own Mailtrap credentials.
+	fs.StringVar(&cfg.smtp.host, "smtp-host", "    smtp.mailtrap.io", "SMTP host")
+	fs.IntVar(&cfg.smtp.port, "smtp-port", 25, "SMTP port")
+	fs.StringVar(&cfg.smtp.username, "smtp-username", "a8c6ea4f80cc3f", "SMTP username")
+	fs.StringVar(&cfg.smtp.password, "smtp-password", "e6231e9d245f54", "SMTP password")
+	fs.StringVar(&cfg.smtp.sender, "smtp-sender", "Online Movie DB <no-reply@omdb.net", "SMTP sender")
+
+	// Read the email provider settings. The sender from -smtp-sender is used by every
+	// provider.
+	fs.StringVar(&cfg.mailer.provider, "mailer-provider", "smtp", "Email provider (smtp|mailgun|console)")
+	fs.StringVar(&cfg.frontend.baseURL, "frontend-base-url", "http://localhost:3000", "Base URL of the web frontend, used for links in emails")
+	fs.StringVar(&cfg.api.baseURL, "api-base-url", "http://localhost:4000", "Public base URL of the API, used for links in emails to API endpoints")
+	fs.IntVar(&cfg.watchlist.dailyEmailCap, "watchlist-daily-email-cap", 10, "Maximum number of watchlist update emails sent to a user each day")
+	fs.IntVar(&cfg.digest.hour, "digest-hour", 8, "Hour of the day (0-23, UTC) at which the daily digest of new movies is sent")
+	fs.Float64Var(&cfg.duplicates.threshold, "duplicates-threshold", 0.8, "Score (0-1] at which POST /v1/movies?strict=true refuses a movie as a duplicate")
+	fs.IntVar(&cfg.mailer.workers, "mailer-workers", 3, "Number of goroutines sending email")
+	fs.IntVar(&cfg.mailer.queueSize, "mailer-queue-size", 10, "Maximum number of outbox emails waiting for a mail worker")
+	fs.IntVar(&cfg.webhooks.workers, "webhook-workers", 4, "Number of goroutines delivering webhooks")
+	fs.IntVar(&cfg.webhooks.queueSize, "webhook-queue-size", 100, "Maximum number of webhook deliveries waiting for a worker")
+	fs.DurationVar(&cfg.usage.flushInterval, "usage-flush-interval", 30*time.Second, "Interval between writes of the per-user request counts to the database")
+	fs.DurationVar(&cfg.outbox.pollInterval, "outbox-poll-interval", 10*time.Second, "Interval between polls of the email outbox")
+	fs.IntVar(&cfg.outbox.maxAttempts, "outbox-max-attempts", 8, "Number of attempts to send an email before it's marked as failed")
+	fs.DurationVar(&cfg.popularity.interval, "popularity-interval", 10*time.Minute, "Interval between refreshes of the movies' popularity scores")
+	fs.Float64Var(&cfg.popularity.weights.Views, "popularity-view-weight", 1, "Weight of the (logarithm of the) views in a movie's popularity score")
+	fs.Float64Var(&cfg.popularity.weights.Ratings, "popularity-rating-weight", 3, "Weight of the ratings in a movie's popularity score")
+	fs.Float64Var(&cfg.popularity.weights.Recency, "popularity-recency-weight", 2, "Weight of how recently a movie was added in its popularity score")
+	fs.DurationVar(&cfg.popularity.weights.HalfLife, "popularity-half-life", 30*24*time.Hour, "Time after which the recency part of a movie's popularity score has halved")
+	fs.StringVar(&cfg.defaultSort, "default-sort", "-popularity", "Sort of a movie listing which doesn't ask for one, unless the user has a preference")
+	fs.DurationVar(&cfg.jobs.batchDelay, "job-batch-delay", 100*time.Millisecond, "Pause between the batches of admin jobs such as re-indexing the movies")
+	fs.StringVar(&cfg.mailer.mailgun.baseURL, "mailgun-base-url", mailer.MailgunDefaultBaseURL, "Mailgun API base URL")
+	fs.StringVar(&cfg.mailer.mailgun.domain, "mailgun-domain", "", "Mailgun sending domain")
+	fs.StringVar(&cfg.mailer.mailgun.apiKey, "mailgun-api-key", "", "Mailgun API key")
+
+	// Read the DSN of the Sentry project to report unexpected errors to.
+	fs.StringVar(&cfg.sentry.dsn, "sentry-dsn", "", "Sentry DSN for error reporting (disabled if empty)")
+
+	// Use the fs.Func() to process the -cors-trusted-origins command line
+	// flag. In this we use the strings.Fields() to split the flag value into a
+	// slice based on whitespace characters and assign it to our config struct.
+	// Importantly, if the -cors-trusted-origins flag is not present, contains
+	// the empty string, or contains only whitespace, then strings.Fields() will
+	// return an empty []string slice.
+	//
+	// An origin may contain a single "*" wildcard, such as https://*.example.com,
+	// which matches any subdomain. An origin of "*" on its own matches every origin.
+	fs.Func("cors-trusted-origins", "Trusted CORS origin (space separated)", func(s string) error {
+		cfg.cors.trustedOrigins = strings.Fields(s)
+		return nil
+	})
+
+	// Read the rest of the CORS settings. The methods and headers which a preflight
+	// request may ask for default to what the API uses.
+	cfg.cors.allowedMethods = []string{"GET", "POST", "PUT", "PATCH", "DELETE"}
+	cfg.cors.allowedHeaders = []string{"Authorization", "Content-Type", "X-Request-ID"}
+
+	fs.Func("cors-allowed-methods", "Methods allowed in CORS requests (space separated)", func(s string) error {
+		cfg.cors.allowedMethods = strings.Fields(strings.ToUpper(s))
+		return nil
+	})
+	fs.Func("cors-allowed-headers", "Request headers allowed in CORS requests (space separated)", func(s string) error {
+		cfg.cors.allowedHeaders = strings.Fields(s)
+		return nil
+	})
+	fs.BoolVar(&cfg.cors.allowCredentials, "cors-allow-credentials", false, "Allow credentials in CORS requests")
+	fs.DurationVar(&cfg.cors.maxAge, "cors-max-age", time.Hour, "How long browsers may cache CORS preflight responses")
+
+	// Read whether plain HTTP requests are redirected to HTTPS or refused. A request
+	// counts as HTTPS if it came over TLS, or through a trusted proxy which says so in
+	// X-Forwarded-Proto.
+	fs.BoolVar(&cfg.https.enforce, "enforce-https", false, "Redirect GET and HEAD requests over plain HTTP to HTTPS, and refuse the rest")
+	cfg.https.exemptPaths = []string{"/v1/healthcheck"}
+	fs.Func("enforce-https-exempt", "Paths which may be requested over plain HTTP with -enforce-https (comma separated, default /v1/healthcheck)", func(s string) error {
+		cfg.https.exemptPaths = nil
+		for _, path := range strings.Split(s, ",") {
+			if path = strings.TrimSpace(path); path != "" {
+				cfg.https.exemptPaths = append(cfg.https.exemptPaths, path)
+			}
+		}
+		return nil
+	})
+	fs.BoolVar(&cfg.https.iKnowWhatImDoing, "i-know-what-im-doing", false, "Allow -enforce-https in the development environment")
+
+	// Read the background workers which must be running for the application to be
+	// ready to serve requests.
+	cfg.criticalWorkers = []string{workerOutboxPoller, workerMail}
+	fs.Func("critical-workers", "Background workers which make the healthcheck fail when they're stale (comma separated, default "+workerOutboxPoller+","+workerMail+"; one of "+strings.Join(workerNames, ", ")+")", func(s string) error {
+		cfg.criticalWorkers = nil
+		for _, name := range strings.Split(s, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				cfg.criticalWorkers = append(cfg.criticalWorkers, name)
+			}
+		}
+		return nil
+	})
+
+	// Use the fs.Func() to process the -trusted-proxies command line flag, which is
+	// a comma separated list of CIDR ranges. A plain IP address is treated as a range
+	// containing just that address.
+	fs.Func("trusted-proxies", "Trusted proxy address ranges in CIDR notation (comma separated)", func(s string) error {
+		for _, value := range strings.Split(s, ",") {
+			value = strings.TrimSpace(value)
+			if value == "" {
+				continue
+			}
+
+			if !strings.Contains(value, "/") {
+				ip := net.ParseIP(value)
+				if ip == nil {
+					return fmt.Errorf("invalid IP address %q", value)
+				}
+
+				bits := 128
+				if ip.To4() != nil {
+					bits = 32
+				}
+
+				value = fmt.Sprintf("%s/%d", value, bits)
+			}
+
+			_, network, err := net.ParseCIDR(value)
+			if err != nil {
+				return err
+			}
+
+			cfg.trustedProxies = append(cfg.trustedProxies, network)
+		}
+
+		return nil
+	})
+
+	// Read the debug endpoint settings. The /debug/ endpoints are open to users with
+	// the "users:admin" permission, and to basic auth with these credentials if
+	// they're set.
+	fs.StringVar(&cfg.debug.username, "debug-user", "", "Basic auth username for the debug endpoints")
+	fs.StringVar(&cfg.debug.password, "debug-pass", "", "Basic auth password for the debug endpoints")
+	fs.BoolVar(&cfg.debug.endpointsEnabled, "debug-endpoints-enabled", false, "Enable the pprof endpoints under /debug/pprof/")
+
+	// Read the Google OAuth settings. Sign-in with Google is only enabled when both the
+	// client ID and secret are provided.
+	fs.StringVar(&cfg.google.clientID, "google-client-id", "", "Google OAuth client ID")
+	fs.StringVar(&cfg.google.clientSecret, "google-client-secret", "", "Google OAuth client secret")
+	fs.StringVar(&cfg.google.redirectURL, "google-redirect-url", "http://localhost:4000/v1/auth/google/callback", "Google OAuth redirect URL")
+
+	// Read the movie enrichment settings. ?enrich=true on POST /v1/movies only looks
+	// movies up in OMDb when an API key is provided.
+	fs.StringVar(&cfg.enrich.apiKey, "enrich-api-key", "", "OMDb API key for enriching new movies (disabled if empty)")
+	fs.StringVar(&cfg.enrich.baseURL, "enrich-base-url", enrich.OMDbBaseURL, "OMDb API base URL")
+	fs.DurationVar(&cfg.enrich.timeout, "enrich-timeout", 3*time.Second, "Timeout for each OMDb lookup")
+
+	registerPasswordHashFlags(fs, cfg)
+	registerEncryptionFlags(fs, cfg)
+
+	// Read the movie cache settings. With -cache-store=redis the movies are cached in
+	// the Redis server given by -redis-addr, and shared by every instance of the API.
+	// The in-memory cache checks an entry's version against the database once it's
+	// older than -cache-staleness, to notice updates made by other instances.
+	fs.BoolVar(&cfg.movieCache.enabled, "cache-enabled", false, "Enable the movie cache")
+	fs.StringVar(&cfg.movieCache.store, "cache-store", "memory", "Movie cache store (memory|redis)")
+	fs.DurationVar(&cfg.movieCache.ttl, "cache-ttl", time.Minute, "How long movies are cached for")
+	fs.IntVar(&cfg.movieCache.size, "cache-size", 1024, "Maximum number of movies in the in-memory cache")
+	fs.DurationVar(&cfg.movieCache.staleness, "cache-staleness", 5*time.Second, "Age after which an in-memory cache entry's version is checked")
+
+	// Read the permissions cache settings.
+	fs.BoolVar(&cfg.permissionsCache.enabled, "permissions-cache-enabled", true, "Enable the user permissions cache")
+	fs.DurationVar(&cfg.permissionsCache.ttl, "permissions-cache-ttl", 30*time.Second, "User permissions cache TTL")
+
+	// Read the user cache settings.
+	fs.BoolVar(&cfg.userCache.enabled, "user-cache-enabled", true, "Enable the authenticated user cache")
+	fs.IntVar(&cfg.userCache.size, "user-cache-size", 10_000, "Authenticated user cache capacity")
+	fs.DurationVar(&cfg.userCache.ttl, "user-cache-ttl", 15*time.Minute, "Authenticated user cache entry lifetime")
+	fs.DurationVar(&cfg.userCache.verifyInterval, "user-cache-verify-interval", 30*time.Second, "Interval after which cached users are re-verified")
+
+	// Read the authentication token settings. In jwt mode the key is the shared secret
+	// for HS256, or the base64-encoded 32-byte Ed25519 seed for EdDSA.
+	fs.StringVar(&cfg.auth.mode, "auth-mode", "stateful", "Authentication token mode (stateful|jwt)")
+	fs.StringVar(&cfg.auth.jwtAlg, "jwt-alg", jwt.AlgHS256, "JWT signing algorithm (HS256|EdDSA)")
+	fs.StringVar(&cfg.auth.jwtKey, "jwt-key", "", "JWT signing key")
+
+	// Read the token settings. Changing a TTL only affects tokens issued afterwards,
+	// as the expiry is stored with each token.
+	//
+	// There's deliberately no -token-reset-ttl yet: the API has no password reset
+	// endpoints, so no reset tokens are ever issued, and a flag for them would do
+	// nothing. It should be added, along with a check in validateTokenConfig() and a
+	// healthcheck field, together with those endpoints.
+	fs.DurationVar(&cfg.tokens.authTTL, "token-auth-ttl", 24*time.Hour, "Authentication token lifetime")
+	fs.DurationVar(&cfg.tokens.activationTTL, "token-activation-ttl", 3*24*time.Hour, "Activation token lifetime")
+	fs.DurationVar(&cfg.tokens.unsubscribeTTL, "token-unsubscribe-ttl", 30*24*time.Hour, "Lifetime of the unsubscribe links in watchlist emails")
+	fs.IntVar(&cfg.tokens.length, "token-length", data.MinTokenLength, "Number of random bytes in a token")
+
+	// Read how often expired tokens are removed from the database.
+	fs.DurationVar(&cfg.tokens.cleanupInterval, "token-cleanup-interval", time.Hour, "Interval between expired token cleanups")
+
+	// Read whether deleting a user keeps their reviews.
+	fs.BoolVar(&cfg.users.deleteAnonymizesReviews, "delete-anonymizes-reviews", false, "Keep a deleted user's reviews without an author instead of deleting them")
+
+	// Read whether the server starts in maintenance mode, refusing requests with a 503
+	// Service Unavailable response.
+	fs.BoolVar(&cfg.maintenanceMode, "maintenance-mode", false, "Refuse requests with 503 Service Unavailable, apart from the healthcheck")
+
+	// Read whether the movies can be listed and shown without a token.
+	fs.BoolVar(&cfg.anonymousReads, "anonymous-reads", false, "Let clients without a token list and show movies")
+
+	return fs
+}
+
+// The autoMigrate() function applies any pending migrations, logging the schema version
+// before and after. A dirty schema, left behind by a migration which failed part way
+// through, has to be repaired by hand, so it stops the server from starting.
+func autoMigrate(logger *jsonlog.Logger, migrator *migrate.Migrator) error {
+	before, err := schemaVersion(migrator)
+	if err != nil {
+		return err
+	}
+
+	logger.PrintInfo("applying database migrations", map[string]string{
+		"version": before,
+		"latest":  strconv.FormatUint(uint64(migrator.Latest()), 10),
+	})
+
+	err = migrator.Up()
+	if err != nil {
+		var dirtyErr migrate.DirtyError
+
+		switch {
+		case errors.Is(err, migrate.ErrNoChange):
+		case errors.As(err, &dirtyErr):
+			return fmt.Errorf("database schema is dirty at version %d: repair it and run \"migrate force <version>\" before starting the server", dirtyErr.Version)
+		default:
+			return fmt.Errorf("applying database migrations: %w", err)
+		}
+	}
+
+	after, err := schemaVersion(migrator)
+	if err != nil {
+		return err
+	}
+
+	logger.PrintInfo("database migrations applied", map[string]string{
+		"from_version": before,
+		"version":      after,
+	})
+
+	return nil
+}
+
+// The schemaVersion() helper returns the current schema version as a string, which is
+// "none" if no migrations have been applied.
+func schemaVersion(migrator *migrate.Migrator) (string, error) {
+	version, _, err := migrator.Version()
+	if err != nil {
+		switch {
+		case errors.Is(err, migrate.ErrNilVersion):
+			return "none", nil
+		default:
+			return "", err
+		}
+	}
+
+	return strconv.FormatUint(uint64(version), 10), nil
+}
+
+// The printVersion() function writes the build details, for the -version flag.
+func printVersion(w io.Writer) {
+	fmt.Fprintf(w, "Version:\t%s\n", build.Version)
+	fmt.Fprintf(w, "Revision:\t%s\n", build.Revision)
+	fmt.Fprintf(w, "Modified:\t%t\n", build.Modified)
+	fmt.Fprintf(w, "Commit time:\t%s\n", build.CommitTime)
+	fmt.Fprintf(w, "Build time:\t%s\n", build.BuildTime)
+	fmt.Fprintf(w, "Go version:\t%s\n", build.GoVersion)
+}
+
+// The registerDBFlags() function defines the database flags, which are shared by every
+// command.
+func registerDBFlags(fs *flag.FlagSet, cfg *config) {
+	// Read the database driver, and the DSN value from the db-dsn command-line flag,
+	// into the config struct. Like every flag, they can also be set with environment
+	// variables, such as OMDB_DB_DSN, or in the config file (see the config package).
+	//
+	// SQLite is for running the API locally without PostgreSQL. Its driver needs cgo,
+	// so it's only built in with -tags sqlite and CGO_ENABLED=1.
+	fs.StringVar(&cfg.db.driver, "db-driver", data.DriverPostgres, "Database driver (postgres|sqlite)")
+	fs.StringVar(&cfg.db.dsn, "db-dsn", "", "Database DSN: a PostgreSQL DSN, or the SQLite database's file name")
+
+	// Read the connection pool settings from command-line flags into the config struct
+	fs.IntVar(&cfg.db.maxOpenConns, "db-max-open-conns", 25, "PostgreSQL max open connections")
+	fs.IntVar(&cfg.db.maxIdleConns, "db-max-idle-conns", 25, "PostgreSQL max idle connections")
+	fs.DurationVar(&cfg.db.maxIdleTime, "db-max-idle-time", 15*time.Minute, "PostgreSQL max connection idle time (0 for no limit)")
+	fs.DurationVar(&cfg.db.maxLifetime, "db-max-conn-lifetime", 0, "PostgreSQL max connection lifetime (0 for no limit)")
+
+	// Read how long to keep retrying the initial connection while the database starts.
+	fs.DurationVar(&cfg.db.connectTimeout, "db-connect-timeout", 30*time.Second, "How long to retry the initial PostgreSQL connection")
+}
+
+// The registerLogFlags() function defines the logging flags, which are shared by every
+// command. They change the logger directly when they're parsed, as it's created before
+// the command runs, so that it can report a failure to start.
+func registerLogFlags(fs *flag.FlagSet, logger *jsonlog.Logger) {
+	fs.Func("log-level", "Minimum level of the log entries to write (debug|info|error|fatal|off) (default info)", func(s string) error {
+		level, err := jsonlog.ParseLevel(s)
+		if err != nil {
+			return err
+		}
+
+		logger.SetLevel(level)
+		return nil
+	})
+
+	fs.Func("log-format", "Format of the log entries (json|text) (default json)", func(s string) error {
+		format, err := jsonlog.ParseFormat(s)
+		if err != nil {
+			return err
+		}
+
+		logger.SetFormat(format)
+		return nil
+	})
+}
+
+// The registerPasswordHashFlags() function defines the password hashing flags, which are
+// shared by the commands which set passwords.
+func registerPasswordHashFlags(fs *flag.FlagSet, cfg *config) {
+	// Read the password hashing settings. New hashes use the configured algorithm,
+	// and existing hashes are upgraded when their owner next logs in.
+	fs.StringVar(&cfg.passwordHash.algorithm, "password-hash-algo", data.HashBcrypt, "Password hashing algorithm (bcrypt|argon2id)")
+	fs.IntVar(&cfg.passwordHash.cost, "password-hash-cost", 12, "bcrypt cost")
+	fs.UintVar(&cfg.passwordHash.memory, "password-hash-memory", 64*1024, "argon2id memory in KiB")
+	fs.UintVar(&cfg.passwordHash.time, "password-hash-time", 3, "argon2id iterations")
+	fs.UintVar(&cfg.passwordHash.parallelism, "password-hash-parallelism", 2, "argon2id parallelism")
+}
+
+// The registerEncryptionFlags() function defines the data encryption key flags, which
+// are shared by the commands which read or write the encrypted columns.
+func registerEncryptionFlags(fs *flag.FlagSet, cfg *config) {
+	// Read the keys which sensitive columns are encrypted with: 32 random bytes,
+	// base64-encoded, as from "openssl rand -base64 32".
+	fs.StringVar(&cfg.encryption.key, "data-encryption-key", "", "Base64-encoded 32-byte key which sensitive columns are encrypted with")
+	fs.StringVar(&cfg.encryption.oldKey, "old-data-encryption-key", "", "Previous data encryption key, which is still accepted for decryption during a rotation")
+}
+
+// The setEncryptionKeyring() function installs the data encryption keys for the data
+// package. Without -data-encryption-key new values are stored unencrypted.
+func setEncryptionKeyring(cfg config) error {
+	if cfg.encryption.key == "" {
+		if cfg.encryption.oldKey != "" {
+			return errors.New("old-data-encryption-key needs data-encryption-key to be set too")
+		}
+
+		data.SetEncryptionKeyring(nil)
+		return nil
+	}
+
+	key, err := crypto.ParseKey(cfg.encryption.key)
+	if err != nil {
+		return fmt.Errorf("data-encryption-key: %w", err)
+	}
+
+	var old [][]byte
+
+	if cfg.encryption.oldKey != "" {
+		oldKey, err := crypto.ParseKey(cfg.encryption.oldKey)
+		if err != nil {
+			return fmt.Errorf("old-data-encryption-key: %w", err)
+		}
+
+		old = append(old, oldKey)
+	}
+
+	keyring, err := crypto.NewKeyring(key, old...)
+	if err != nil {
+		return err
+	}
+
+	data.SetEncryptionKeyring(keyring)
+
+	return nil
+}
+
+// The checkEncryptedColumns() function reads every encrypted value, so that the server
+// refuses to start without the key they were encrypted with, rather than failing the
+// requests which need them. Any other error, such as the migrations not having been
+// applied yet, is left for those requests to report.
+func checkEncryptedColumns(models data.Models) error {
+	_, err := models.Webhooks.GetAll()
+
+	switch {
+	case errors.Is(err, data.ErrEncryptionKeyMissing):
+		return fmt.Errorf("%w: set -data-encryption-key", err)
+	case errors.Is(err, crypto.ErrUnknownKey), errors.Is(err, crypto.ErrTampered):
+		return fmt.Errorf("%w: set -old-data-encryption-key to the previous key, or run the rotate command with it", err)
+	default:
+		return nil
+	}
+}
+
+// The setHashingParams() function installs the password hashing settings for the data
+// package.
+func setHashingParams(cfg config) error {
+	return data.SetHashingParams(data.HashingParams{
+		Algorithm:         cfg.passwordHash.algorithm,
+		BcryptCost:        cfg.passwordHash.cost,
+		Argon2Memory:      uint32(cfg.passwordHash.memory),
+		Argon2Time:        uint32(cfg.passwordHash.time),
+		Argon2Parallelism: uint8(cfg.passwordHash.parallelism),
+	})
+}
+
+// The validateConfig() function checks the settings of the serve command, at startup
+// and whenever the configuration is reloaded.
+func validateConfig(cfg config) error {
+	err := validateServerConfig(cfg)
+	if err != nil {
+		return err
+	}
+
+	// Check the token settings. The ticker in startTokenCleanup() panics on a
+	// non-positive interval, so that's checked up front too.
+	err = validateTokenConfig(cfg)
+	if err != nil {
+		return err
+	}
+
+	// Browsers refuse credentialed responses for an origin of "*", and reflecting any
+	// origin with credentials would let every site act as the user, so forbid it.
+	err = validateCORSConfig(cfg)
+	if err != nil {
+		return err
+	}
+
+	if cfg.maxRequestBody < 1 {
+		return errors.New("max-request-body must be at least 1")
+	}
+
+	for _, name := range cfg.criticalWorkers {
+		if !validator.In(name, workerNames...) {
+			return fmt.Errorf("unknown critical worker %q; must be one of %s", name, strings.Join(workerNames, ", "))
+		}
+	}
+
+	if cfg.maxPageSize < 1 || cfg.maxResponseBytes < 0 {
+		return errors.New("max-page-size must be at least 1, and max-response-bytes must not be negative")
+	}
+
+	if cfg.popularity.interval <= 0 || cfg.popularity.weights.HalfLife <= 0 {
+		return errors.New("popularity-interval and popularity-half-life must be greater than zero")
+	}
+
+	if cfg.popularity.weights.Views < 0 || cfg.popularity.weights.Ratings < 0 || cfg.popularity.weights.Recency < 0 {
+		return errors.New("popularity-view-weight, popularity-rating-weight and popularity-recency-weight must not be negative")
+	}
+
+	if !validator.In(cfg.defaultSort, data.MovieSortSafelist...) {
+		return fmt.Errorf("default-sort must be one of %s", strings.Join(data.MovieSortSafelist, ", "))
+	}
+
+	for class, limits := range classLimits(cfg) {
+		if limits.rps < 0 || (limits.rps > 0 && limits.burst < 1) {
+			return fmt.Errorf("limiter-%s-rps must not be negative, and limiter-%s-burst must be at least 1 when it's set", class, class)
+		}
+	}
+
+	if cfg.limiter.maxClients < 1 || cfg.limiter.cleanupInterval <= 0 || cfg.limiter.maxIdle <= 0 {
+		return errors.New("limiter-max-clients must be at least 1, and limiter-cleanup-interval and limiter-max-idle greater than zero")
+	}
+
+	switch cfg.runtimeFormat {
+	case runtimeFormatString, runtimeFormatMinutes:
+	default:
+		return fmt.Errorf("unknown runtime format %q", cfg.runtimeFormat)
+	}
+
+	if !cfg.v1.deprecation.IsZero() && !cfg.v1.sunset.IsZero() && cfg.v1.sunset.Before(cfg.v1.deprecation) {
+		return errors.New("v1-sunset must not be before v1-deprecation")
+	}
+
+	if !validator.In(cfg.defaultLocale, validator.Locales()...) {
+		return fmt.Errorf("unsupported default locale %q (supported locales are: %s)", cfg.defaultLocale, strings.Join(validator.Locales(), ", "))
+	}
+
+	if cfg.debug.username != "" && cfg.debug.password == "" {
+		return errors.New("debug-pass must be set when debug-user is")
+	}
+
+	// Check the mail worker settings.
+	if cfg.mailer.workers < 1 || cfg.mailer.queueSize < 0 {
+		return errors.New("mailer-workers must be at least 1 and mailer-queue-size must not be negative")
+	}
+
+	// A rate of zero would stop the buckets ever refilling.
+	if cfg.limiter.enable && (cfg.limiter.rps <= 0 || cfg.limiter.userRPS <= 0 || cfg.limiter.burst < 1 || cfg.limiter.userBurst < 1) {
+		return errors.New("limiter-rps and limiter-user-rps must be greater than zero, and limiter-burst and limiter-user-burst at least 1")
+	}
+
+	if cfg.webhooks.workers < 1 || cfg.webhooks.queueSize < 0 {
+		return errors.New("webhook-workers must be at least 1 and webhook-queue-size must not be negative")
+	}
+
+	if cfg.outbox.pollInterval <= 0 || cfg.outbox.maxAttempts < 1 {
+		return errors.New("outbox-poll-interval must be greater than zero and outbox-max-attempts must be at least 1")
+	}
+
+	// The job's lease is renewed after each batch, so a longer pause would let another
+	// request resume a job which is still running.
+	if cfg.jobs.batchDelay < 0 || cfg.jobs.batchDelay >= time.Minute {
+		return errors.New("job-batch-delay must be between 0 and 1m")
+	}
+
+	if cfg.watchlist.dailyEmailCap < 1 {
+		return errors.New("watchlist-daily-email-cap must be at least 1")
+	}
+
+	if cfg.digest.hour < 0 || cfg.digest.hour > 23 {
+		return errors.New("digest-hour must be between 0 and 23")
+	}
+
+	if cfg.duplicates.threshold <= 0 || cfg.duplicates.threshold > 1 {
+		return errors.New("duplicates-threshold must be greater than 0 and at most 1")
+	}
+
+	if cfg.enrich.timeout <= 0 {
+		return errors.New("enrich-timeout must be greater than zero")
+	}
+
+	if cfg.usage.flushInterval <= 0 {
+		return errors.New("usage-flush-interval must be greater than zero")
+	}
+
+	if cfg.db.breakerThreshold < 0 || (cfg.db.breakerThreshold > 0 && cfg.db.breakerCooldown <= 0) {
+		return errors.New("db-breaker-threshold must not be negative, and db-breaker-cooldown must be greater than zero when it's set")
+	}
+
+	return nil
+}
+
+// The validateServerConfig() helper checks the environment name and the ports, and
+// that HTTPS is only enforced in development on purpose.
+func validateServerConfig(cfg config) error {
+	switch cfg.env {
+	case "development", "staging", "production":
+	default:
+		return fmt.Errorf("env must be development, staging or production, not %q", cfg.env)
+	}
+
+	if cfg.port < 1 || cfg.port > 65535 {
+		return fmt.Errorf("port must be between 1 and 65535, not %d", cfg.port)
+	}
+
+	if cfg.grpc.port < 0 || cfg.grpc.port > 65535 {
+		return fmt.Errorf("grpc-port must be between 1 and 65535 (0 to disable), not %d", cfg.grpc.port)
+	}
+
+	if cfg.grpc.port == cfg.port {
+		return fmt.Errorf("grpc-port must not be the same as port (%d)", cfg.port)
+	}
+
+	// Developers usually run the server over plain HTTP, so enforcing HTTPS there
+	// would lock them out, unless they really mean it.
+	if cfg.https.enforce && cfg.env == "development" && !cfg.https.iKnowWhatImDoing {
+		return errors.New("enforce-https would refuse plain HTTP requests in the development environment; pass -i-know-what-im-doing as well if that's intended")
+	}
+
+	return nil
+}
+
+// The effectiveConfig() function returns the non-secret settings of the serve command,
+// for logging at startup. The logging flags, which only change the logger, are left
+// out.
+func effectiveConfig(fs *flag.FlagSet, cfg config) map[string]string {
+	values := conf.Effective(fs, "version", "log-level", "log-format")
+
+	for name, value := range listSettings(cfg) {
+		values[name] = value
+	}
+
+	return values
+}
+
+// The settingValues() function returns the value of every flag of the serve command,
+// secrets included, so that a reload can tell which settings have changed. The -version
+// flag isn't a setting, and may or may not be defined on fs, so it's left out; otherwise
+// a reload would report it as changed.
+func settingValues(fs *flag.FlagSet, cfg config) map[string]string {
+	values := make(map[string]string)
+
+	fs.VisitAll(func(f *flag.Flag) {
+		if f.Name == "version" {
+			return
+		}
+
+		values[f.Name] = f.Value.String()
+	})
+
+	for name, value := range listSettings(cfg) {
+		values[name] = value
+	}
+
+	return values
+}
+
+// The dateFlagLayout constant is the layout of the flags which hold a date.
+const dateFlagLayout = "2006-01-02"
+
+// The parseDateFlag() helper parses the value of a flag holding a date, such as
+// "2027-06-30", into t. An empty value leaves t as the zero time.
+func parseDateFlag(s string, t *time.Time) error {
+	if s == "" {
+		*t = time.Time{}
+		return nil
+	}
+
+	date, err := time.Parse(dateFlagLayout, s)
+	if err != nil {
+		return fmt.Errorf("invalid date %q (want YYYY-MM-DD)", s)
+	}
+
+	*t = date
+	return nil
+}
+
+// The formatDateFlag() helper is the reverse of parseDateFlag().
+func formatDateFlag(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+
+	return t.Format(dateFlagLayout)
+}
+
+// The listSettings() function returns the values of the flags defined with fs.Func(),
+// which don't keep their value, from the config struct instead.
+func listSettings(cfg config) map[string]string {
+	proxies := make([]string, len(cfg.trustedProxies))
+	for i, network := range cfg.trustedProxies {
+		proxies[i] = network.String()
+	}
+
+	return map[string]string{
+		"trusted-proxies":      strings.Join(proxies, ","),
+		"enforce-https-exempt": strings.Join(cfg.https.exemptPaths, ","),
+		"critical-workers":     strings.Join(cfg.criticalWorkers, ","),
+		"cors-trusted-origins": strings.Join(cfg.cors.trustedOrigins, " "),
+		"cors-allowed-methods": strings.Join(cfg.cors.allowedMethods, " "),
+		"cors-allowed-headers": strings.Join(cfg.cors.allowedHeaders, " "),
+		"v1-deprecation":       formatDateFlag(cfg.v1.deprecation),
+		"v1-sunset":            formatDateFlag(cfg.v1.sunset),
+	}
+}
+
+// The validateTokenConfig() helper checks that the token lifetimes are between one
+// minute and 30 days, and that the cleanup interval is positive.
+func validateTokenConfig(cfg config) error {
+	ttls := []struct {
+		flag string
+		ttl  time.Duration
+	}{
+		{"token-auth-ttl", cfg.tokens.authTTL},
+		{"token-activation-ttl", cfg.tokens.activationTTL},
+		{"token-unsubscribe-ttl", cfg.tokens.unsubscribeTTL},
+	}
+
+	for _, t := range ttls {
+		if t.ttl < time.Minute || t.ttl > 30*24*time.Hour {
+			return fmt.Errorf("%s must be between 1m and 720h", t.flag)
+		}
+	}
+
+	if cfg.tokens.cleanupInterval <= 0 {
+		return errors.New("token-cleanup-interval must be greater than zero")
+	}
+
+	return nil
+}
+
+// The validateDBConfig() helper checks the connection pool settings. Zero means no
+// limit for each of them, but negative values and more idle than open connections
+// are rejected.
+func validateDBConfig(cfg config) error {
+	switch cfg.db.driver {
+	case data.DriverPostgres, data.DriverSQLite:
+	default:
+		return fmt.Errorf("unknown database driver %q", cfg.db.driver)
+	}
+
+	if cfg.db.maxOpenConns < 0 {
+		return errors.New("db-max-open-conns must not be negative (0 for no limit)")
+	}
+
+	if cfg.db.maxIdleConns < 0 {
+		return errors.New("db-max-idle-conns must not be negative")
+	}
+
+	if cfg.db.maxOpenConns > 0 && cfg.db.maxIdleConns > cfg.db.maxOpenConns {
+		return fmt.Errorf("db-max-idle-conns (%d) must not be greater than db-max-open-conns (%d)", cfg.db.maxIdleConns, cfg.db.maxOpenConns)
+	}
+
+	durations := []struct {
+		flag     string
+		duration time.Duration
+	}{
+		{"db-max-idle-time", cfg.db.maxIdleTime},
+		{"db-max-conn-lifetime", cfg.db.maxLifetime},
+		{"db-connect-timeout", cfg.db.connectTimeout},
+	}
+
+	for _, d := range durations {
+		if d.duration < 0 {
+			return fmt.Errorf("%s must not be negative", d.flag)
+		}
+	}
+
+	return nil
+}
+
+// The validateCORSConfig() helper checks the trusted origins. Each may contain at most
+// one wildcard, and the "*" origin can't be combined with credentials.
+func validateCORSConfig(cfg config) error {
+	for _, origin := range cfg.cors.trustedOrigins {
+		if origin == "*" {
+			if cfg.cors.allowCredentials {
+				return errors.New(`the "*" CORS origin can't be used with -cors-allow-credentials`)
+			}
+			continue
+		}
+
+		if strings.Count(origin, "*") > 1 {
+			return fmt.Errorf("CORS origin %q has more than one wildcard", origin)
+		}
+	}
+
+	if cfg.cors.maxAge < 0 {
+		return errors.New("cors-max-age must not be negative")
+	}
+
+	return nil
+}
+
+// The openMailer() function returns the Mailer for the configured email provider.
+func openMailer(cfg config, logger *jsonlog.Logger) (mailer.Mailer, error) {
+	switch cfg.mailer.provider {
+	case "smtp":
+		return mailer.NewSMTP(cfg.smtp.host, cfg.smtp.port, cfg.smtp.username, cfg.smtp.password, cfg.smtp.sender), nil
+	case "mailgun":
+		if cfg.mailer.mailgun.domain == "" || cfg.mailer.mailgun.apiKey == "" {
+			return nil, errors.New("mailgun-domain and mailgun-api-key must be provided for the mailgun provider")
+		}
+		return mailer.NewMailgun(cfg.mailer.mailgun.baseURL, cfg.mailer.mailgun.domain, cfg.mailer.mailgun.apiKey, cfg.smtp.sender), nil
+	case "console":
+		return mailer.NewConsole(logger, cfg.smtp.sender), nil
+	default:
+		return nil, fmt.Errorf("unknown mailer provider %q", cfg.mailer.provider)
+	}
+}
+
+// The openReporter() function returns the Reporter for unexpected errors: Sentry if a
+// DSN is configured, and otherwise one which discards them. Identical errors are only
+// reported once a minute, so that a failing endpoint doesn't flood Sentry.
+// The openEnricher() function returns the provider which new movies are enriched
+// from, which looks nothing up unless an OMDb API key is configured.
+func openEnricher(cfg config, client *httpclient.Client) enrich.Provider {
+	if cfg.enrich.apiKey == "" {
+		return enrich.Disabled{}
+	}
+
+	return enrich.NewOMDb(cfg.enrich.apiKey, cfg.enrich.baseURL, cfg.enrich.timeout, client)
+}
+
+func openReporter(cfg config, logger *jsonlog.Logger) (errreport.Reporter, error) {
+	if cfg.sentry.dsn == "" {
+		return errreport.Nop{}, nil
+	}
+
+	sentry, err := errreport.NewSentry(cfg.sentry.dsn, cfg.env, build.Version, 100, func(err error) {
+		logger.PrintError(err, nil)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return errreport.NewDeduplicator(sentry, time.Minute), nil
+}
+
+// The openRateLimiters() function returns a function which creates a rate limiter,
+// for the named bucket, in the configured store. When the store is Redis, the server is
+// pinged first; if it's unreachable we only carry on if the limiter fails open.
+func openRateLimiters(cfg config, logger *jsonlog.Logger) (func(name string, rps float64, burst int) ratelimit.RateLimiter, error) {
+	switch cfg.limiter.store {
+	case "memory":
+		opts := ratelimit.MemoryOptions{
+			MaxEntries:      cfg.limiter.maxClients,
+			CleanupInterval: cfg.limiter.cleanupInterval,
+			MaxIdle:         cfg.limiter.maxIdle,
+		}
+
+		return func(name string, rps float64, burst int) ratelimit.RateLimiter {
+			return ratelimit.NewMemory(rps, burst, opts)
+		}, nil
+	case "redis":
+		client := redis.NewClient(cfg.redis.addr, cfg.redis.password, 25, time.Second)
+
+		err := client.Ping()
+		if err != nil {
+			if !cfg.limiter.failOpen {
+				return nil, fmt.Errorf("redis: %w", err)
+			}
+
+			logger.PrintInfo("redis unavailable, rate limiter will fail open", map[string]string{
+				"error": err.Error(),
+			})
+		}
+
+		return func(name string, rps float64, burst int) ratelimit.RateLimiter {
+			return ratelimit.NewRedis(client, "ratelimit:"+name+":", rps, burst)
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown limiter store %q", cfg.limiter.store)
+	}
+}
+
+// The openMovieCache() function returns the configured cache in front of the movie
+// store, along with a function returning its counters. Redis being unavailable doesn't
+// stop the server from starting, as the cache falls through to the database until it
+// comes back.
+func openMovieCache(cfg config, logger *jsonlog.Logger, store data.MovieStore) (data.MovieStore, func() interface{}, error) {
+	if cfg.movieCache.ttl < time.Millisecond {
+		return nil, nil, errors.New("cache-ttl must be at least 1ms")
+	}
+
+	switch cfg.movieCache.store {
+	case "memory":
+		if cfg.movieCache.size < 1 {
+			return nil, nil, errors.New("cache-size must be at least 1")
+		}
+
+		if cfg.movieCache.staleness < 0 {
+			return nil, nil, errors.New("cache-staleness must not be negative")
+		}
+
+		cache := data.NewMovieLRUCache(store, cfg.movieCache.size, cfg.movieCache.ttl, cfg.movieCache.staleness)
+		return cache, func() interface{} { return cache.Stats() }, nil
+	case "redis":
+		client := redis.NewClient(cfg.redis.addr, cfg.redis.password, 25, time.Second)
+
+		err := client.Ping()
+		if err != nil {
+			logger.PrintInfo("redis unavailable, movies won't be cached until it's back", map[string]string{
+				"error": err.Error(),
+			})
+		}
+
+		cache := data.NewRedisMovieCache(store, client, cfg.movieCache.ttl, func(err error) {
+			logger.PrintError(err, map[string]string{"cache": "movies"})
+		})
+		return cache, func() interface{} { return cache.Stats() }, nil
+	default:
+		return nil, nil, fmt.Errorf("unknown cache store %q", cfg.movieCache.store)
+	}
+}
+
+// The openJWTSigner() function returns the signer for jwt mode, or nil when running in
+// the default stateful mode.
+func openJWTSigner(cfg config) (*jwt.Signer, error) {
+	switch cfg.auth.mode {
+	case "stateful":
+		return nil, nil
+	case "jwt":
+	default:
+		return nil, fmt.Errorf("invalid auth mode %q", cfg.auth.mode)
+	}
+
+	switch cfg.auth.jwtAlg {
+	case jwt.AlgHS256:
+		return jwt.NewHS256([]byte(cfg.auth.jwtKey))
+	case jwt.AlgEdDSA:
+		seed, err := base64.StdEncoding.DecodeString(cfg.auth.jwtKey)
+		if err != nil {
+			return nil, err
+		}
+		return jwt.NewEdDSA(seed)
+	default:
+		return nil, fmt.Errorf("invalid jwt algorithm %q", cfg.auth.jwtAlg)
+	}
+}
+
+// The openDB() function returns a sql.DB connection pool. If breaker isn't nil, the
+// pool's connections are made through it.
+func openDB(cfg config, logger *jsonlog.Logger, breaker *data.Breaker) (*sql.DB, error) {
+	// Check the pool settings first, as database/sql quietly treats odd values (such
+	// as more idle than open connections) as something else.
+	err := validateDBConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	// Use data.NewConnector() to parse the DSN from the config struct with the
+	// configured driver, so that a malformed DSN is reported straight away rather than
+	// retried by pingDB(), and then sql.OpenDB() to create an empty connection pool.
+	// The connector is declared as a driver.Connector, so that it can be replaced by
+	// the breaker's.
+	var connector driver.Connector
+
+	connector, err = data.NewConnector(cfg.db.driver, cfg.db.dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	if breaker != nil {
+		connector = breaker.Connector(connector)
+	}
+
+	db := sql.OpenDB(connector)
+
+	// Set the maximum number of open (in-use + idle) connections in the pool.
+	// Note that passing a value less than or equal to 0 will mean there is no
+	// limit.
+	//
+	// As a rule of thumb, you should explicitly set a MaxOpenConns value.
+	// Set a MaxOpenConns limit of 25 connections as it happens to be a
+	// reasonable starting point for small-to- medium web applications and APIs.
+	db.SetMaxOpenConns(cfg.db.maxOpenConns)
+
+	// Set the maximum number of idle connections in the pool. Again, passing a value
+	// less that or equal to 0 will mean there is no limit.
+	//
+	// In general, higher MaxOpenConns and MaxIdleConns values will lead to better
+	// performance. Because MaxIdleConns should always be less than or equal to
+	// MaxOpenConns, we’ll also limit MaxIdleConns to 25 connections.
+	db.SetMaxIdleConns(cfg.db.maxIdleConns)
+
+	// Set the maximum idle timeout.
+	//
+	// You should set generally a ConnMaxIdleTime value to remove idle
+	// connections thathaven’t been used for a long time. In this project
+	// we’ll set a ConnMaxIdleTime duration of 15 minutes.
+	db.SetConnMaxIdleTime(cfg.db.maxIdleTime)
+
+	// Set the maximum lifetime of a connection. It's unlimited by default, but behind
+	// a pooler like PgBouncer a limit makes sure that connections are rotated.
+	db.SetConnMaxLifetime(cfg.db.maxLifetime)
+
+	// Establish a connection to the database, retrying for up to -db-connect-timeout
+	// while the database is starting up.
+	err = pingDB(db, cfg.db.connectTimeout, logger)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	// Return the sql.DB connection pool
+	return db, nil
+}
+
+// The openReadDB() function returns a connection pool for the read replica, or nil if
+// -db-read-dsn isn't set. It uses the same pool settings as the primary.
+func openReadDB(cfg config, logger *jsonlog.Logger, breaker *data.Breaker) (*sql.DB, error) {
+	if cfg.db.readDSN == "" {
+		return nil, nil
+	}
+
+	cfg.db.dsn = cfg.db.readDSN
+
+	return openDB(cfg, logger, breaker)
+}
+
+// Define the delays between attempts to connect to the database. The first retry is
+// after dbConnectInitialBackoff, and the delay doubles each time up to dbConnectMaxBackoff.
+const (
+	dbConnectInitialBackoff = 500 * time.Millisecond
+	dbConnectMaxBackoff     = 8 * time.Second
+)
+
+// The pingDB() function pings the database until it responds or the timeout runs out.
+// In docker-compose or Kubernetes the API often starts before PostgreSQL is ready, so
+// we retry, backing off between attempts, rather than exiting straight away. Errors
+// which retrying can't fix, such as a wrong password or a malformed DSN, are returned
+// straight away.
+func pingDB(db *sql.DB, timeout time.Duration, logger *jsonlog.Logger) error {
+	deadline := time.Now().Add(timeout)
+	backoff := dbConnectInitialBackoff
+
+	for attempt := 1; ; attempt++ {
+		// Give each attempt up to 5 seconds, but no longer than the time we have left,
+		// apart from leaving the final attempt at the deadline a second to connect.
+		attemptTimeout := time.Until(deadline)
+		switch {
+		case attemptTimeout > 5*time.Second:
+			attemptTimeout = 5 * time.Second
+		case attemptTimeout < time.Second:
+			attemptTimeout = time.Second
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), attemptTimeout)
+		err := db.PingContext(ctx)
+		cancel()
+
+		if err == nil {
+			return nil
+		}
+
+		if !isTemporaryDBError(err) {
+			return err
+		}
+
+		// Make the last attempt at the deadline, rather than giving up early when the
+		// next backoff would take us past it.
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return fmt.Errorf("database unavailable after %d attempts in %s: %w", attempt, timeout, err)
+		}
+
+		delay := backoff
+		if delay > remaining {
+			delay = remaining
+		}
+
+		logger.PrintInfo("database unavailable, retrying", map[string]string{
+			"attempt":  strconv.Itoa(attempt),
+			"retry_in": delay.String(),
+			"error":    err.Error(),
+		})
+
+		time.Sleep(delay)
+
+		backoff *= 2
+		if backoff > dbConnectMaxBackoff {
+			backoff = dbConnectMaxBackoff
+		}
+	}
+}
+
+// The isTemporaryDBError() function reports whether a failed connection attempt is
+// worth retrying. That's network errors, such as the connection being refused while
+// PostgreSQL starts, and PostgreSQL telling us it isn't accepting connections yet, as
+// well as the circuit breaker having opened after too many of them.
+func isTemporaryDBError(err error) bool {
+	return data.IsConnectionError(err) || errors.Is(err, data.ErrUnavailable)
 }
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/petrostrak/an-open-movie-database/internal/data"
+	"github.com/petrostrak/an-open-movie-database/internal/jsonlog"
+)
+
+func TestValidateTokenConfig(t *testing.T) {
+	valid := func() config {
+		var cfg config
+		cfg.tokens.authTTL = 24 * time.Hour
+		cfg.tokens.activationTTL = 72 * time.Hour
+		cfg.tokens.unsubscribeTTL = 30 * 24 * time.Hour
+		cfg.tokens.cleanupInterval = time.Hour
+		return cfg
+	}
+
+	tests := []struct {
+		name    string
+		modify  func(cfg *config)
+		wantErr bool
+	}{
+		{"defaults", func(cfg *config) {}, false},
+		{"minimum ttl", func(cfg *config) { cfg.tokens.authTTL = time.Minute }, false},
+		{"maximum ttl", func(cfg *config) { cfg.tokens.activationTTL = 30 * 24 * time.Hour }, false},
+		{"auth ttl too short", func(cfg *config) { cfg.tokens.authTTL = 59 * time.Second }, true},
+		{"activation ttl too long", func(cfg *config) { cfg.tokens.activationTTL = 30*24*time.Hour + time.Second }, true},
+		{"zero cleanup interval", func(cfg *config) { cfg.tokens.cleanupInterval = 0 }, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := valid()
+			tt.modify(&cfg)
+
+			err := validateTokenConfig(cfg)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("got error %v; want error %t", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestOpenMovieCache(t *testing.T) {
+	app := newTestApplication(t)
+
+	valid := func() config {
+		var cfg config
+		cfg.movieCache.store = "memory"
+		cfg.movieCache.ttl = time.Minute
+		cfg.movieCache.size = 1024
+		cfg.movieCache.staleness = 5 * time.Second
+		return cfg
+	}
+
+	tests := []struct {
+		name    string
+		modify  func(cfg *config)
+		wantErr bool
+	}{
+		{"memory", func(cfg *config) {}, false},
+		{"redis", func(cfg *config) { cfg.movieCache.store = "redis"; cfg.redis.addr = "127.0.0.1:1" }, false},
+		{"unknown store", func(cfg *config) { cfg.movieCache.store = "memcached" }, true},
+		{"zero ttl", func(cfg *config) { cfg.movieCache.ttl = 0 }, true},
+		{"zero size", func(cfg *config) { cfg.movieCache.size = 0 }, true},
+		{"negative staleness", func(cfg *config) { cfg.movieCache.staleness = -time.Second }, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := valid()
+			tt.modify(&cfg)
+
+			_, _, err := openMovieCache(cfg, app.logger, app.models.Movies)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("got error %v; want error %t", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRegisterLogFlags(t *testing.T) {
+	var buf bytes.Buffer
+	logger := jsonlog.New(&buf, jsonlog.LevelInfo)
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	registerLogFlags(fs, logger)
+
+	err := fs.Parse([]string{"-log-level=debug", "-log-format=text"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logger.PrintDebug("hello", nil)
+	if !bytes.Contains(buf.Bytes(), []byte("[DEBUG] hello")) {
+		t.Errorf("got %q; want a debug entry in the text format", buf.String())
+	}
+
+	for _, args := range [][]string{{"-log-level=verbose"}, {"-log-format=yaml"}} {
+		err := fs.Parse(args)
+		if err == nil {
+			t.Errorf("parsing %q succeeded", args)
+		}
+	}
+}
+
+func TestPrintVersion(t *testing.T) {
+	var buf bytes.Buffer
+	printVersion(&buf)
+
+	for _, want := range []string{
+		"Version:\t" + build.Version + "\n",
+		"Revision:\t" + build.Revision + "\n",
+		"Go version:\t" + build.GoVersion + "\n",
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("got %q; want it to contain %q", buf.String(), want)
+		}
+	}
+}
+
+func TestValidateServerConfig(t *testing.T) {
+	tests := []struct {
+		name     string
+		env      string
+		port     int
+		grpcPort int
+		wantErr  bool
+	}{
+		{"development", "development", 4000, 0, false},
+		{"production", "production", 65535, 0, false},
+		{"unknown env", "prod", 4000, 0, true},
+		{"zero port", "staging", 0, 0, true},
+		{"port too high", "staging", 65536, 0, true},
+		{"grpc port", "staging", 4000, 4001, false},
+		{"grpc port too high", "staging", 4000, 65536, true},
+		{"grpc port clashes", "staging", 4000, 4000, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var cfg config
+			cfg.env = tt.env
+			cfg.port = tt.port
+			cfg.grpc.port = tt.grpcPort
+
+			err := validateServerConfig(cfg)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("got error %v; want error %t", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// Enforcing HTTPS in development has to be asked for twice.
+func TestValidateServerConfigEnforceHTTPS(t *testing.T) {
+	tests := []struct {
+		env              string
+		iKnowWhatImDoing bool
+		wantErr          bool
+	}{
+		{"production", false, false},
+		{"staging", false, false},
+		{"development", false, true},
+		{"development", true, false},
+	}
+
+	for _, tt := range tests {
+		var cfg config
+		cfg.env = tt.env
+		cfg.port = 4000
+		cfg.https.enforce = true
+		cfg.https.iKnowWhatImDoing = tt.iKnowWhatImDoing
+
+		err := validateServerConfig(cfg)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("got error %v in %s with -i-know-what-im-doing=%t; want error %t", err, tt.env, tt.iKnowWhatImDoing, tt.wantErr)
+		}
+	}
+}
+
+// The closedPortDSN() helper returns a DSN for a port which nothing is listening on, so
+// that connecting to it is refused.
+func closedPortDSN(t *testing.T) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	return fmt.Sprintf("postgres://omdb:pa55word@%s/omdb?sslmode=disable", addr)
+}
+
+// A database which refuses connections is retried with backoff until the timeout, with
+// the last attempt made at the deadline, and then reported with the number of attempts.
+func TestPingDBRetries(t *testing.T) {
+	db, err := sql.Open("postgres", closedPortDSN(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var buf bytes.Buffer
+	logger := jsonlog.New(&buf, jsonlog.LevelInfo)
+
+	// Attempts at 0s, after the 500ms backoff, and at the deadline 700ms later, when
+	// the next 1s backoff would take us past it.
+	timeout := 1200 * time.Millisecond
+
+	start := time.Now()
+	err = pingDB(db, timeout, logger)
+	elapsed := time.Since(start)
+
+	if err == nil || !strings.Contains(err.Error(), "database unavailable after 3 attempts in 1.2s") {
+		t.Fatalf("got error %v; want it to report 3 attempts", err)
+	}
+
+	if !isTemporaryDBError(errors.Unwrap(err)) {
+		t.Errorf("got error %v; want it to wrap the connection error", err)
+	}
+
+	if elapsed < timeout || elapsed > timeout+time.Second {
+		t.Errorf("took %s; want about %s", elapsed, timeout)
+	}
+
+	// Each retry is logged, with its attempt number and the delay before it.
+	if got := strings.Count(buf.String(), "database unavailable, retrying"); got != 2 {
+		t.Errorf("got %d retries logged; want 2\n%s", got, buf.String())
+	}
+
+	// The second delay is whatever was left of the timeout, so it isn't checked.
+	for _, want := range []string{`"attempt":"1"`, `"retry_in":"500ms"`, `"attempt":"2"`} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("got log %q; want it to contain %s", buf.String(), want)
+		}
+	}
+}
+
+// A DSN which can't be parsed is reported straight away rather than retried.
+func TestOpenDBMalformedDSN(t *testing.T) {
+	var cfg config
+	cfg.db.driver = data.DriverPostgres
+	cfg.db.dsn = "postgres://omdb@localhost:notaport/omdb"
+	cfg.db.connectTimeout = time.Minute
+
+	start := time.Now()
+
+	_, err := openDB(cfg, jsonlog.New(io.Discard, jsonlog.LevelOff), nil)
+	if err == nil {
+		t.Fatal("got no error for a malformed DSN")
+	}
+
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("took %s; want the error straight away", elapsed)
+	}
+}
+
+func TestValidateDBConfig(t *testing.T) {
+	valid := func() config {
+		var cfg config
+		cfg.db.driver = data.DriverPostgres
+		cfg.db.maxOpenConns = 25
+		cfg.db.maxIdleConns = 25
+		cfg.db.maxIdleTime = 15 * time.Minute
+		cfg.db.connectTimeout = 30 * time.Second
+		return cfg
+	}
+
+	tests := []struct {
+		name    string
+		modify  func(cfg *config)
+		wantErr bool
+	}{
+		{"defaults", func(cfg *config) {}, false},
+		{"fewer idle than open", func(cfg *config) { cfg.db.maxIdleConns = 5 }, false},
+		{"no open limit", func(cfg *config) { cfg.db.maxOpenConns = 0; cfg.db.maxIdleConns = 100 }, false},
+		{"no limits", func(cfg *config) { cfg.db.maxIdleTime, cfg.db.maxLifetime = 0, 0 }, false},
+		{"lifetime", func(cfg *config) { cfg.db.maxLifetime = time.Hour }, false},
+		{"sqlite", func(cfg *config) { cfg.db.driver = data.DriverSQLite }, false},
+		{"unknown driver", func(cfg *config) { cfg.db.driver = "mysql" }, true},
+		{"negative open", func(cfg *config) { cfg.db.maxOpenConns = -1 }, true},
+		{"negative idle", func(cfg *config) { cfg.db.maxIdleConns = -1 }, true},
+		{"more idle than open", func(cfg *config) { cfg.db.maxIdleConns = 26 }, true},
+		{"negative idle time", func(cfg *config) { cfg.db.maxIdleTime = -time.Second }, true},
+		{"negative lifetime", func(cfg *config) { cfg.db.maxLifetime = -time.Second }, true},
+		{"negative connect timeout", func(cfg *config) { cfg.db.connectTimeout = -time.Second }, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := valid()
+			tt.modify(&cfg)
+
+			err := validateDBConfig(cfg)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("got error %v; want error %t", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRegisterDBFlags(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		want    func(cfg config) bool
+		wantErr bool
+	}{
+		{"defaults", nil, func(cfg config) bool {
+			return cfg.db.driver == data.DriverPostgres && cfg.db.maxOpenConns == 25 && cfg.db.maxIdleConns == 25 && cfg.db.maxIdleTime == 15*time.Minute &&
+				cfg.db.maxLifetime == 0 && cfg.db.connectTimeout == 30*time.Second
+		}, false},
+		{"pool settings", []string{"-db-max-open-conns=50", "-db-max-idle-conns=10", "-db-max-idle-time=5m", "-db-max-conn-lifetime=1h30m", "-db-connect-timeout=10s"}, func(cfg config) bool {
+			return cfg.db.maxOpenConns == 50 && cfg.db.maxIdleConns == 10 && cfg.db.maxIdleTime == 5*time.Minute &&
+				cfg.db.maxLifetime == 90*time.Minute && cfg.db.connectTimeout == 10*time.Second
+		}, false},
+		{"sqlite", []string{"-db-driver=sqlite", "-db-dsn=omdb.db"}, func(cfg config) bool { return cfg.db.driver == data.DriverSQLite && cfg.db.dsn == "omdb.db" }, false},
+		{"no lifetime limit", []string{"-db-max-conn-lifetime=0"}, func(cfg config) bool { return cfg.db.maxLifetime == 0 }, false},
+		{"lifetime without a unit", []string{"-db-max-conn-lifetime=30"}, nil, true},
+		{"open conns not a number", []string{"-db-max-open-conns=lots"}, nil, true},
+		{"idle time not a duration", []string{"-db-max-idle-time=forever"}, nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var cfg config
+
+			fs := flag.NewFlagSet("test", flag.ContinueOnError)
+			fs.SetOutput(io.Discard)
+			registerDBFlags(fs, &cfg)
+
+			err := fs.Parse(tt.args)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v; want error %t", err, tt.wantErr)
+			}
+
+			if tt.want != nil && !tt.want(cfg) {
+				t.Errorf("got db config %+v", cfg.db)
+			}
+		})
+	}
+}
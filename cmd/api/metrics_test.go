@@ -0,0 +1,121 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/petrostrak/an-open-movie-database/internal/data"
+)
+
+// The routeCount() helper returns a counter from the published route metrics, or 0 if
+// the route hasn't been recorded yet.
+func routeCount(route, key string) int64 {
+	routes := expvar.Get("total_requests_by_route").(*expvar.Map)
+
+	vars, ok := routes.Get(route).(*expvar.Map)
+	if !ok {
+		return 0
+	}
+
+	if key == "requests" {
+		return vars.Get("requests").(*expvar.Int).Value()
+	}
+
+	count, ok := vars.Get("responses_by_status").(*expvar.Map).Get(key).(*expvar.Int)
+	if !ok {
+		return 0
+	}
+
+	return count.Value()
+}
+
+func TestRouteMetrics(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t)
+
+	_, token := newTestUser(t, app, "reader", "reader")
+
+	movie := &data.Movie{Title: "Casablanca", Year: 1942, Runtime: 102, Genres: []string{"drama"}}
+	err := app.models.Movies.Insert(movie)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		path      string
+		token     string
+		wantRoute string
+		wantClass string
+	}{
+		{"matched", "/v1/healthcheck", "", "GET /v1/healthcheck", "2xx"},
+		{"pattern", fmt.Sprintf("/v1/movies/%d", movie.ID), token, "GET /v1/movies/:id", "2xx"},
+		{"unauthorized", "/v1/movies", "", "GET /v1/movies", "4xx"},
+		{"unmatched", "/v1/nope", "", "unmatched", "4xx"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requests := routeCount(tt.wantRoute, "requests")
+			class := routeCount(tt.wantRoute, tt.wantClass)
+
+			ts.do(t, http.MethodGet, tt.path, tt.token, nil)
+
+			if got := routeCount(tt.wantRoute, "requests") - requests; got != 1 {
+				t.Errorf("got %d more requests for %q; want 1", got, tt.wantRoute)
+			}
+
+			if got := routeCount(tt.wantRoute, tt.wantClass) - class; got != 1 {
+				t.Errorf("got %d more %s responses for %q; want 1", got, tt.wantClass, tt.wantRoute)
+			}
+		})
+	}
+}
+
+// Run with -race. The first request for each route creates its counters, so many
+// goroutines recording new routes at once must not race or lose counts.
+func TestRouteMetricsConcurrent(t *testing.T) {
+	m := newRouteMetrics("test_requests_by_route")
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+
+			for j := 0; j < 50; j++ {
+				m.record("GET /route/"+strconv.Itoa(j%5), 200+(i%2)*300, time.Millisecond)
+			}
+
+			// Reading the published map at the same time must be safe too.
+			_ = m.published.String()
+		}(i)
+	}
+
+	wg.Wait()
+
+	for j := 0; j < 5; j++ {
+		route := fmt.Sprintf("GET /route/%d", j)
+		vars := m.published.Get(route).(*expvar.Map)
+
+		if got := vars.Get("requests").(*expvar.Int).Value(); got != 200 {
+			t.Errorf("got %d requests for %q; want 200", got, route)
+		}
+
+		responses := vars.Get("responses_by_status").(*expvar.Map)
+		if ok, failed := responses.Get("2xx").(*expvar.Int).Value(), responses.Get("5xx").(*expvar.Int).Value(); ok != 100 || failed != 100 {
+			t.Errorf("got %d 2xx and %d 5xx responses for %q; want 100 of each", ok, failed, route)
+		}
+
+		if got := vars.Get("average_processing_time_μs").(expvar.Func).Value(); got != int64(1000) {
+			t.Errorf("got average processing time %v for %q; want 1000", got, route)
+		}
+	}
+}
@@ -1,46 +1,129 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"expvar"
 	"fmt"
-	"net"
+	"io"
 	"net/http"
+	"os"
+	"runtime/debug"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/felixge/httpsnoop"
 	"github.com/petrostrak/an-open-movie-database/internal/data"
+	"github.com/petrostrak/an-open-movie-database/internal/jsonlog"
+	"github.com/petrostrak/an-open-movie-database/internal/ratelimit"
 	"github.com/petrostrak/an-open-movie-database/internal/validator"
-	"golang.org/x/time/rate"
 )
 
+// Publish the number of panics recovered by the recoverPanic() middleware. This is a
+// package-level variable, as the middleware is used by more than one chain and an
+// expvar can only be published once.
+var totalPanicsRecovered = expvar.NewInt("total_panics_recovered")
+
+// Define a handlerPanic type to carry a panic from a handler running in another
+// goroutine (see requestTimeout()) to recoverPanic(), along with the stack trace of the
+// goroutine where it happened.
+type handlerPanic struct {
+	value interface{}
+	stack []byte
+}
+
+// The logPanic() helper logs a recovered panic at the ERROR level, along with the
+// stack and the request details, and sends it to the error reporter. The value
+// returned by recover() has the type interface{}, so we use fmt.Errorf() to normalize
+// it into an error.
+func (app *application) logPanic(r *http.Request, value interface{}, stack []byte, userID string) {
+	err := fmt.Errorf("%s", value)
+
+	app.reportError(r, err, map[string]string{"stack": string(stack)})
+
+	app.logger.PrintError(err, app.logProperties(r, map[string]string{
+		"request_method": r.Method,
+		"request_url":    r.URL.String(),
+		"client_ip":      app.clientIP(r),
+		"user_id":        userID,
+		"stack":          string(stack),
+	}))
+}
+
 func (app *application) recoverPanic(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Keep track of whether the response has been started, as we can't send an
+		// error response once it has.
+		var started atomic.Bool
+
+		sw := httpsnoop.Wrap(w, httpsnoop.Hooks{
+			WriteHeader: func(next httpsnoop.WriteHeaderFunc) httpsnoop.WriteHeaderFunc {
+				return func(code int) {
+					started.Store(true)
+					next(code)
+				}
+			},
+			Write: func(next httpsnoop.WriteFunc) httpsnoop.WriteFunc {
+				return func(b []byte) (int, error) {
+					started.Store(true)
+					return next(b)
+				}
+			},
+		})
+
+		// Add a userRecorder to the request context, so that we know which user made
+		// the request even though authenticate() runs further down the chain.
+		r, userRecorder := app.contextWithUserRecorder(r)
+
 		// Create a deferred function (which will always be run in the event of a panic
 		// as Go unwinds the stack).
 		defer func() {
 			// Use the buildin recover function to check if there has been
 			// a panic or not.
 			if err := recover(); err != nil {
+				// http.ErrAbortHandler is used to abort a response on purpose, and
+				// the server handles it quietly, so pass it on.
+				if err == http.ErrAbortHandler {
+					panic(err)
+				}
+
+				totalPanicsRecovered.Add(1)
+
+				// Capture the stack trace. Deferred functions run on top of the
+				// panicking stack, so it shows where the panic happened; a panic from
+				// another goroutine brings its own.
+				stack := debug.Stack()
+				if hp, ok := err.(handlerPanic); ok {
+					err, stack = hp.value, hp.stack
+				}
+
+				app.logPanic(r, err, stack, userRecorder.get())
+
+				// If the handler had already started the response, the status has
+				// been sent and we can't replace it, so there's nothing more to do.
+				if started.Load() {
+					return
+				}
+
 				// If there was a panic, set a "Connection: close" header on the
 				// response. This acts as a trigger to make Go's HTTP server
 				// automatically close the current connection after a response has
 				// been sent.
 				w.Header().Set("Connection", "close")
 
-				// The value returned by recover() has the type interface{}, so we use
-				// fmt.Errorf() to normalize it into an error and call our
-				// serverErrorResponse() helper. In return, this will log the error using
-				// our custom Logger type at the ERROR level and send the client a 500
-				// Internal Server Error response.
-				app.serverErrorResponse(w, r, fmt.Errorf("%s", err))
+				// Send the client a 500 Internal Server Error response.
+				app.panicResponse(w, r, stack)
 			}
 		}()
 
-		next.ServeHTTP(w, r)
+		next.ServeHTTP(sw, r)
 	})
 }
 
@@ -48,94 +131,141 @@ func (app *application) recoverPanic(next http.Handler) http.Handler {
 //
 // go run ./cmd/api/ -limiter-burst=2
 // go run ./cmd/api/ -limiter-enabled=false
-func (app *application) rateLimit(next http.Handler) http.Handler {
-	// Any code here will run only once, when we wrap something with this middleware.
-
-	// Define a client struct to hold the rate limiter and last seen time for each client
-	type client struct {
-		limiter  *rate.Limiter
-		lastSeen time.Time
-	}
-
-	// Declare a mutex and a map to hold the clients' IP addresses and rate limiters.
-	var (
-		mu      sync.Mutex
-		clients = make(map[string]*client)
-	)
-
-	// Launch a background goroutine which removes old entries from the clients map once
-	// every minute.
-	go func() {
-		for {
-			time.Sleep(time.Minute)
-
-			// Lock the mutex to prevent any rate limiter checks from happening while
-			// the cleanup is taking place.
-			mu.Lock()
-
-			// Loop through all clients. If they haven;t been seen within the last thee
-			// minutes, delete the corresponding entry from the map.
-			for ip, client := range clients {
-				if time.Since(client.lastSeen) > 3*time.Minute {
-					delete(clients, ip)
-				}
+// The rateLimitIP() and rateLimitUser() middleware limit requests per client.
+// rateLimitIP() runs before authenticate(), and limits every request by IP address, so
+// that a client can't make unlimited guesses at authentication tokens, or make us look
+// up unlimited tokens, by sending an Authorization header. rateLimitUser() runs after
+// authenticate(), and also limits authenticated users by user ID, with their own rps
+// and burst settings; rotating IP addresses then doesn't get around a user's limit.
+//
+// Every response includes the X-RateLimit-Limit (the burst size),
+// X-RateLimit-Remaining and X-RateLimit-Reset (seconds until the bucket is full)
+// headers, so that clients can pace themselves. For authenticated users they describe
+// the user's bucket.
+//
+// The limiters are only used through the ratelimit.RateLimiter interface, so the
+// buckets can be kept in memory or in Redis. If the store fails, the request is
+// allowed when -limiter-fail-open is set, and refused otherwise.
+func (app *application) rateLimitIP(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Only carry out the check if rate limitting is enabled. The settings are read
+		// for each request, as they can be changed by reloading the configuration.
+		if limiter := app.live.Load().limiter; limiter.enable {
+			if !app.allowRequest(w, r, "ip", app.clientIP(r), app.limiters.ip, limiter.rps, limiter.burst) {
+				return
 			}
-
-			// Importantly, unlock the mutex when the cleanup is complete.
-			mu.Unlock()
 		}
-	}()
 
-	// The function we are returning is a closure, which 'closes over' the limiter
-	// variable.
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (app *application) rateLimitUser(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Any code here will run for every request this middleware handles.
+		limiter := app.live.Load().limiter
 
-		// Only carry out the check if rate limitting is enabled.
-		if app.config.limiter.enable {
-			// Extract the client's IP address from the request.
-			ip, _, err := net.SplitHostPort(r.RemoteAddr)
-			if err != nil {
-				app.serverErrorResponse(w, r, err)
+		if user := app.contextGetUser(r); limiter.enable && !user.IsAnonymous() {
+			if !app.allowRequest(w, r, "user", strconv.FormatInt(user.ID, 10), app.limiters.user, limiter.userRPS, limiter.userBurst) {
 				return
 			}
+		}
 
-			// Lock the mutex to prevent this code from being executed concurrently.
-			mu.Lock()
-
-			// Check to see if the IP address already exists in the map. If it doesn't, then
-			// initialize a new rate limiter and add the IP address and limiter to the map.
-			if _, found := clients[ip]; !found {
-				// Create and add a new client struct to the map if it doesn't already exist.
-				clients[ip] = &client{
-					// Use the request-per-second and burst values from the config
-					// struct.
-					limiter: rate.NewLimiter(rate.Limit(app.config.limiter.rps), app.config.limiter.burst),
-				}
-			}
+		next.ServeHTTP(w, r)
+	})
+}
 
-			// Update the last seen time from the client.
-			clients[ip].lastSeen = time.Now()
+// The rateLimitClass() middleware limits the requests to the routes of a class, if
+// the class has limits of its own, by user ID for authenticated users and by IP address
+// otherwise. It wraps each route's handler, as the route isn't known until the router
+// has matched it, and so it comes after the limits for all routes.
+func (app *application) rateLimitClass(class string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		limiter := app.live.Load().limiter
 
-			// Call the Allow() on the rate limiter for the current IP address. If
-			// the request isn't allowed, unlock the mutex and send a 429 Too Many Requests
-			// response.
-			if !clients[ip].limiter.Allow() {
-				mu.Unlock()
-				app.rateLimitExceededResponse(w, r)
+		if limits := limiter.classes[class]; limiter.enable && limits.rps > 0 {
+			key := "ip:" + app.clientIP(r)
+			if user := app.contextGetUser(r); !user.IsAnonymous() {
+				key = "user:" + strconv.FormatInt(user.ID, 10)
+			}
+
+			if !app.allowRequest(w, r, class, key, app.limiters.classes[class], limits.rps, limits.burst) {
 				return
 			}
+		}
 
-			// Very importantly, unlock the mutex before calling the next handler in the
-			// chain. Notice that we DON'T use defer to unlock the mutex, as that would mean
-			// that the mutex isn't unlocked until all the handlers downstrea, of this
-			// middleware have also returned.
-			mu.Unlock()
+		next.ServeHTTP(w, r)
+	}
+}
+
+// The meterUsage() middleware counts the requests made by each authenticated user,
+// for the usage endpoints. It comes after rateLimitUser(), so that requests which
+// were turned away aren't counted.
+func (app *application) meterUsage(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user := app.contextGetUser(r); !user.IsAnonymous() {
+			app.usage.Increment(user.ID)
 		}
 
 		next.ServeHTTP(w, r)
 	})
+}
+
+// The allowRequest() helper takes a token from the client's bucket and sets the rate
+// limit headers. If the request isn't allowed, it sends the response and returns false.
+// The bucket is "ip" or "user" for the limits on all routes, or the name of a route
+// class.
+func (app *application) allowRequest(w http.ResponseWriter, r *http.Request, bucket, key string, limiter ratelimit.RateLimiter, rps float64, burst int) bool {
+	allowed, remaining, retryAfter, err := limiter.Allow(key)
+	if err != nil {
+		if !app.config.limiter.failOpen {
+			app.serverErrorResponse(w, r, err)
+			return false
+		}
+
+		app.logger.PrintInfo("rate limiter unavailable, allowing request", app.logProperties(r, map[string]string{
+			"error":          err.Error(),
+			"bucket":         bucket,
+			"request_method": r.Method,
+			"request_url":    r.URL.String(),
+		}))
+
+		return true
+	}
+
+	// The bucket is full again once the missing tokens have been refilled.
+	var reset time.Duration
+	if rps > 0 {
+		reset = time.Duration(float64(burst-remaining) / rps * float64(time.Second))
+	}
+
+	w.Header().Set("X-RateLimit-Limit", strconv.Itoa(burst))
+	w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(remaining))
+	w.Header().Set("X-RateLimit-Reset", strconv.Itoa(ceilSeconds(reset)))
+
+	// If the request isn't allowed, log which bucket it exceeded and send a 429 Too
+	// Many Requests response.
+	if !allowed {
+		app.logger.PrintInfo("rate limit exceeded", app.logProperties(r, map[string]string{
+			"bucket":         bucket,
+			"key":            key,
+			"request_method": r.Method,
+			"request_url":    r.URL.String(),
+		}))
+		class := bucket
+		if bucket == "ip" || bucket == "user" {
+			class = ""
+		}
+
+		app.rateLimitExceededResponse(w, r, class, retryAfter)
+		return false
+	}
+
+	return true
+}
 
+// The ceilSeconds() function rounds a duration up to whole seconds.
+func ceilSeconds(d time.Duration) int {
+	return int((d + time.Second - 1) / time.Second)
 }
 
 func (app *application) authenticate(next http.Handler) http.Handler {
@@ -171,22 +301,33 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 		// Extract the actual authentication token from the header parts.
 		token := headerParts[1]
 
-		// Validate the token to make sure it is in a sensible format.
-		v := validator.New()
+		var (
+			user *data.User
+			err  error
+		)
 
-		// If the token isn't valid, use the invalidAuthenticationTokenResponse()
-		// helper to send a response, rather than the failedValidationResponse()
-		// that we'd normally use.
-		if data.ValidateTokenPlaintext(v, token); !v.Valid() {
-			app.invalidAuthenticationTokenResponse(w, r)
-			return
-		}
+		// In jwt mode the token carries the user ID, so we verify it and load the user
+		// by ID rather than looking the token up in the database.
+		if app.jwt != nil {
+			user, err = app.userForJWT(token)
+		} else {
+			// Validate the token to make sure it is in a sensible format.
+			v := validator.New()
+
+			// If the token isn't valid, use the invalidAuthenticationTokenResponse()
+			// helper to send a response, rather than the failedValidationResponse()
+			// that we'd normally use.
+			if data.ValidateTokenPlaintext(v, token); !v.Valid() {
+				app.invalidAuthenticationTokenResponse(w, r)
+				return
+			}
 
-		// Retrieve the details of the user associated with the authentication token,
-		// again calling the invalidAuthenticationTokenResponse() helper if no
-		// matching record was found. IMPORTANT: Notice that we are using
-		// ScopeAuthentication as the first parameter here.
-		user, err := app.models.Users.GetForToken(data.ScopeAuthentication, token)
+			// Retrieve the details of the user associated with the authentication token,
+			// again calling the invalidAuthenticationTokenResponse() helper if no
+			// matching record was found. IMPORTANT: Notice that we are using
+			// ScopeAuthentication as the first parameter here.
+			user, err = app.userForToken(token)
+		}
 		if err != nil {
 			switch {
 			case errors.Is(err, data.ErrRecordNotFound):
@@ -206,6 +347,59 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 	})
 }
 
+// The userForToken() helper returns the user for a stateful authentication token,
+// using the user cache (if it's enabled) to avoid a database query on every request.
+func (app *application) userForToken(token string) (*data.User, error) {
+	if app.userCache == nil {
+		return app.models.Users.GetForToken(data.ScopeAuthentication, token)
+	}
+
+	hash := sha256.Sum256([]byte(token))
+
+	user, stale, found := app.userCache.Get(hash)
+	if found && !stale {
+		app.userCache.RecordHit()
+		return user, nil
+	}
+
+	// If the entry is due to be re-verified, check that the token still exists and
+	// that the user record hasn't changed since we cached it. If both are true we can
+	// carry on using the cached user.
+	if found {
+		version, err := app.models.Users.GetVersionForToken(data.ScopeAuthentication, hash)
+		if err != nil {
+			app.userCache.Delete(hash)
+			return nil, err
+		}
+
+		if version == user.Version {
+			app.userCache.Touch(hash)
+			app.userCache.RecordHit()
+			return user, nil
+		}
+	}
+
+	app.userCache.RecordMiss()
+
+	user, err := app.models.Users.GetForToken(data.ScopeAuthentication, token)
+	if err != nil {
+		app.userCache.Delete(hash)
+		return nil, err
+	}
+
+	app.userCache.Set(hash, user)
+
+	return user, nil
+}
+
+// The invalidateUser() helper drops any cached entries for a user. It must be called
+// whenever the user record is changed.
+func (app *application) invalidateUser(userID int64) {
+	if app.userCache != nil {
+		app.userCache.DeleteUser(userID)
+	}
+}
+
 // requireActivatedUser() has a slightly different signature to the other middlewares. It accepts and
 // returns a http.HandleFunc so that it's easier to wrap our /v1/movie** handler functions directly.
 //
@@ -249,7 +443,7 @@ func (app *application) requirePermission(code string, next http.HandlerFunc) ht
 		user := app.contextGetUser(r)
 
 		// Get the slice of permissions for the user.
-		permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+		permissions, err := app.userPermissions(user.ID)
 		if err != nil {
 			app.serverErrorResponse(w, r, err)
 			return
@@ -271,41 +465,363 @@ func (app *application) requirePermission(code string, next http.HandlerFunc) ht
 	return app.requireActivatedUser(fn)
 }
 
+// The requirePermissionOrAnonymousRead() middleware is a variant of requirePermission()
+// for the catalog's read-only routes. When -anonymous-reads is set, it also lets through
+// clients without a token, whose requests are limited by IP address in the anonymous
+// route class on top of the route's own limits. They aren't counted in the per-user
+// usage, as meterUsage() skips anonymous requests. Authenticated users still need the
+// permission, so an inactive or unprivileged account is refused as before.
+func (app *application) requirePermissionOrAnonymousRead(code string, next http.HandlerFunc) http.HandlerFunc {
+	permitted := app.requirePermission(code, next)
+	anonymous := app.rateLimitClass(routeClassAnonymous, next)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		// The setting is read for each request, as it can be changed by reloading
+		// the configuration.
+		if app.contextGetUser(r).IsAnonymous() && app.live.Load().anonymousReads {
+			anonymous(w, r)
+			return
+		}
+
+		permitted(w, r)
+	}
+}
+
+// The userPermissions() helper returns the permissions for a user, using the
+// permissions cache (if it's enabled) to avoid a database query on every request.
+func (app *application) userPermissions(userID int64) (data.Permissions, error) {
+	if app.permissionsCache != nil {
+		if permissions, found := app.permissionsCache.Get(userID); found {
+			return permissions, nil
+		}
+	}
+
+	permissions, err := app.models.Permissions.GetAllForUser(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	if app.permissionsCache != nil {
+		app.permissionsCache.Set(userID, permissions)
+	}
+
+	return permissions, nil
+}
+
+// The invalidatePermissions() helper drops any cached permissions for a user. It must
+// be called whenever the user's permissions or roles change.
+func (app *application) invalidatePermissions(userID int64) {
+	if app.permissionsCache != nil {
+		app.permissionsCache.Delete(userID)
+	}
+}
+
+// The requestTimeout() middleware gives each request a deadline, so that a slow
+// handler can't hold on to a connection until the client gives up. The handler runs in
+// its own goroutine with a context derived using context.WithTimeout(), so anything
+// which respects the context (such as a database query) is cancelled too.
+//
+// If the deadline passes before the handler has finished, the client gets a 503
+// Service Unavailable response. Like http.TimeoutHandler, the handler writes into a
+// buffer, guarded by a mutex, which is only copied to the real response if it finishes
+// in time; this means the handler and the timeout can never both write the response.
+func (app *application) requestTimeout(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		timeout := app.timeoutFor(r)
+		if timeout <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+
+		r = r.WithContext(ctx)
+
+		tw := &timeoutWriter{w: w, h: make(http.Header)}
+		done := make(chan struct{})
+		panicChan := make(chan handlerPanic, 1)
+
+		go func() {
+			// Pass a panic in the handler back to this goroutine, so that it reaches
+			// the recoverPanic() middleware. Once the request has timed out nothing is
+			// waiting for it, so we log and count the panic here instead of losing it.
+			defer func() {
+				if err := recover(); err != nil {
+					stack := debug.Stack()
+
+					tw.mu.Lock()
+					defer tw.mu.Unlock()
+
+					if !tw.timedOut {
+						panicChan <- handlerPanic{value: err, stack: stack}
+						return
+					}
+
+					if err != http.ErrAbortHandler {
+						totalPanicsRecovered.Add(1)
+
+						var userID string
+						if ur, ok := r.Context().Value(userRecorderContextKey).(*userRecorder); ok {
+							userID = ur.get()
+						}
+
+						app.logPanic(r, err, stack, userID)
+					}
+				}
+			}()
+
+			next.ServeHTTP(tw, r)
+			close(done)
+		}()
+
+		select {
+		case err := <-panicChan:
+			panic(err)
+		case <-done:
+			tw.mu.Lock()
+			defer tw.mu.Unlock()
+
+			dst := w.Header()
+			for key, values := range tw.h {
+				dst[key] = values
+			}
+
+			if !tw.wroteHeader {
+				tw.code = http.StatusOK
+			}
+
+			w.WriteHeader(tw.code)
+			w.Write(tw.buf.Bytes())
+		case <-ctx.Done():
+			tw.mu.Lock()
+			defer tw.mu.Unlock()
+
+			tw.timedOut = true
+
+			// The handler may have panicked just as the deadline passed, in which case
+			// the panic is waiting for us.
+			select {
+			case err := <-panicChan:
+				panic(err)
+			default:
+			}
+
+			// Only respond if the deadline passed; if the client went away there's no
+			// one to respond to.
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				app.timeoutResponse(w, r)
+			}
+		}
+	})
+}
+
+// The timeoutFor() method returns the timeout for a request, using the override for
+// its route if there is one.
+func (app *application) timeoutFor(r *http.Request) time.Duration {
+	for _, override := range requestTimeoutOverrides {
+		if r.Method == override.method && strings.HasPrefix(r.URL.Path, override.pathPrefix) {
+			return override.timeout
+		}
+	}
+
+	return app.config.requestTimeout
+}
+
+// Define a timeoutWriter type which buffers the response of a handler running under
+// the requestTimeout() middleware. Once the request has timed out, writes fail with
+// http.ErrHandlerTimeout.
+type timeoutWriter struct {
+	w http.ResponseWriter
+	h http.Header
+
+	mu          sync.Mutex
+	buf         bytes.Buffer
+	code        int
+	wroteHeader bool
+	timedOut    bool
+}
+
+func (tw *timeoutWriter) Header() http.Header {
+	return tw.h
+}
+
+func (tw *timeoutWriter) Write(p []byte) (int, error) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+
+	if tw.timedOut {
+		return 0, http.ErrHandlerTimeout
+	}
+
+	if !tw.wroteHeader {
+		tw.writeHeaderLocked(http.StatusOK)
+	}
+
+	return tw.buf.Write(p)
+}
+
+func (tw *timeoutWriter) WriteHeader(code int) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+
+	if tw.timedOut || tw.wroteHeader {
+		return
+	}
+
+	tw.writeHeaderLocked(code)
+}
+
+func (tw *timeoutWriter) writeHeaderLocked(code int) {
+	tw.wroteHeader = true
+	tw.code = code
+}
+
+// The streaming() middleware is for the routes which stream a large response or
+// request body, such as the database export and import. The server's WriteTimeout and
+// ReadTimeout would cut them off part way through, and as the status has already been
+// sent, the client would be left with a truncated body. So each write to the response
+// pushes the connection's write deadline back by WriteTimeout, and each read of the
+// request body pushes its read deadline back by ReadTimeout. A handler which keeps
+// writing can take as long as it needs, while one which stalls for longer than the
+// timeout is still cut off.
+//
+// The routes need no -request-timeout (see requestTimeoutOverrides), as the
+// requestTimeout() middleware would buffer the response rather than streaming it. The
+// deadlines are the connection's, which is fine for HTTP/1; the server doesn't serve
+// HTTP/2, which multiplexes requests over a connection.
+func (app *application) streaming(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		conn, ok := app.contextGetConn(r)
+		srv, _ := r.Context().Value(http.ServerContextKey).(*http.Server)
+		if !ok || srv == nil {
+			next(w, r)
+			return
+		}
+
+		if srv.WriteTimeout > 0 {
+			w = &deadlineWriter{ResponseWriter: w, deadline: newRollingDeadline(conn.SetWriteDeadline, srv.WriteTimeout)}
+		}
+
+		if srv.ReadTimeout > 0 && r.Body != nil {
+			r.Body = &deadlineReader{ReadCloser: r.Body, deadline: newRollingDeadline(conn.SetReadDeadline, srv.ReadTimeout)}
+		}
+
+		next(w, r)
+	}
+}
+
+// Define a rollingDeadline type which pushes one of a connection's deadlines back by
+// the timeout each time the transfer makes progress, for the streaming() middleware.
+type rollingDeadline struct {
+	set      func(time.Time) error
+	timeout  time.Duration
+	deadline time.Time
+}
+
+// The newRollingDeadline() function sets the first deadline, a timeout from now.
+func newRollingDeadline(set func(time.Time) error, timeout time.Duration) *rollingDeadline {
+	d := &rollingDeadline{set: set, timeout: timeout, deadline: time.Now().Add(timeout)}
+	set(d.deadline)
+
+	return d
+}
+
+// The extend() method pushes the deadline back by the timeout. Once the deadline has
+// passed it returns os.ErrDeadlineExceeded instead, so that a transfer which stalled
+// for longer than the timeout isn't revived by its next write.
+func (d *rollingDeadline) extend() error {
+	now := time.Now()
+	if now.After(d.deadline) {
+		return os.ErrDeadlineExceeded
+	}
+
+	d.deadline = now.Add(d.timeout)
+
+	return d.set(d.deadline)
+}
+
+// Define a deadlineWriter type which extends the connection's write deadline before
+// each write of a response.
+type deadlineWriter struct {
+	http.ResponseWriter
+	deadline *rollingDeadline
+}
+
+func (dw *deadlineWriter) Write(p []byte) (int, error) {
+	err := dw.deadline.extend()
+	if err != nil {
+		return 0, err
+	}
+
+	return dw.ResponseWriter.Write(p)
+}
+
+// The Flush() method sends the buffered response to the client, so that a handler can
+// stream it in pieces. It does nothing if the underlying ResponseWriter can't flush, or
+// the deadline has passed.
+func (dw *deadlineWriter) Flush() {
+	if f, ok := dw.ResponseWriter.(http.Flusher); ok && dw.deadline.extend() == nil {
+		f.Flush()
+	}
+}
+
+// Define a deadlineReader type which extends the connection's read deadline before
+// each read of a request body.
+type deadlineReader struct {
+	io.ReadCloser
+	deadline *rollingDeadline
+}
+
+func (dr *deadlineReader) Read(p []byte) (int, error) {
+	err := dr.deadline.extend()
+	if err != nil {
+		return 0, err
+	}
+
+	return dr.ReadCloser.Read(p)
+}
+
 func (app *application) enableCORS(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Add the "Vary: Origin" header.
+		// Add the "Vary: Origin" header. It's set on every response, whether or not
+		// the origin is trusted, so that caches never serve a response meant for one
+		// origin to another.
 		w.Header().Add("Vary", "Origin")
 
-		// Add the "Vary: Access-Control-Request-Method" header.
+		// Add the "Vary: Access-Control-Request-Method" and
+		// "Vary: Access-Control-Request-Headers" headers, as preflight responses
+		// depend on them too.
 		w.Header().Add("Vary", "Access-Control-Request-Method")
+		w.Header().Add("Vary", "Access-Control-Request-Headers")
 
 		// Get tge value of the request's Origin header.
 		origin := r.Header.Get("Origin")
 
 		// Only run this if there's an Origin request header present AND at
-		// least one trusted origin is configured.
-		if origin != "" && len(app.config.cors.trustedOrigins) != 0 {
-			// Loop through the list of trusted origins, checking to see if
-			// the request origin exactly matches on of them.
-			for i := range app.config.cors.trustedOrigins {
-				if origin == app.config.cors.trustedOrigins[i] {
-					// If there is a match, then set a "Access-Control-Allow-Origin"
-					// response header with the request origin as the value.
-					w.Header().Set("Access-Control-Allow-Origin", origin)
-
-					// Check if the request has the HTTP method OPTIONS and contains the
-					// "Access-Control-Request-Method" header. If it does, then we treat
-					// it as a preflight request.
-					if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
-						// Set the necessary preflight response headers
-						w.Header().Set("Access-Control-Request-Methods", "OPTIONS, PUT, PATCH, DELETE")
-						w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
-
-						// Write the headers along with a 200 status ok and return from
-						// the middleware with no further actions.
-						w.WriteHeader(http.StatusOK)
-						return
-					}
+		// least one trusted origin is configured. The trusted origins can be
+		// changed by reloading the configuration.
+		trustedOrigins := app.live.Load().trustedOrigins
+
+		if origin != "" && len(trustedOrigins) != 0 {
+			allowOrigin := corsAllowOrigin(trustedOrigins, origin)
+
+			if allowOrigin != "" {
+				// If there is a match, then set a "Access-Control-Allow-Origin"
+				// response header with the request origin as the value (or "*" if
+				// every origin is trusted).
+				w.Header().Set("Access-Control-Allow-Origin", allowOrigin)
+
+				if app.config.cors.allowCredentials {
+					w.Header().Set("Access-Control-Allow-Credentials", "true")
+				}
+
+				// Check if the request has the HTTP method OPTIONS and contains the
+				// "Access-Control-Request-Method" header. If it does, then we treat
+				// it as a preflight request.
+				if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+					app.corsPreflight(w, r)
+					return
 				}
 			}
 		}
@@ -314,6 +830,207 @@ func (app *application) enableCORS(next http.Handler) http.Handler {
 	})
 }
 
+// The corsAllowOrigin() function returns the value for the Access-Control-Allow-Origin
+// header, or the empty string if the origin isn't trusted. Exact matches are
+// reflected, and so are matches against a wildcard such as https://*.example.com. If
+// the "*" origin is trusted, then "*" is returned for any other origin.
+func corsAllowOrigin(trustedOrigins []string, origin string) string {
+	anyOrigin := false
+
+	for _, trusted := range trustedOrigins {
+		if trusted == "*" {
+			anyOrigin = true
+			continue
+		}
+
+		if matchOrigin(trusted, origin) {
+			return origin
+		}
+	}
+
+	if anyOrigin {
+		return "*"
+	}
+
+	return ""
+}
+
+// The matchOrigin() function reports whether origin matches the trusted origin
+// pattern. The "*" wildcard stands for one or more subdomain labels, so
+// https://*.example.com matches https://api.example.com but not https://example.com,
+// https://evil.com/.example.com or https://example.com:8080.example.com.
+func matchOrigin(pattern, origin string) bool {
+	i := strings.IndexByte(pattern, '*')
+	if i < 0 {
+		return pattern == origin
+	}
+
+	prefix, suffix := pattern[:i], pattern[i+1:]
+
+	if len(origin) <= len(prefix)+len(suffix) || !strings.HasPrefix(origin, prefix) || !strings.HasSuffix(origin, suffix) {
+		return false
+	}
+
+	wildcard := origin[len(prefix) : len(origin)-len(suffix)]
+
+	return !strings.ContainsAny(wildcard, "/:@") && !strings.HasPrefix(wildcard, ".") && !strings.HasSuffix(wildcard, ".")
+}
+
+// The corsPreflight() method answers a preflight request from a trusted origin. The
+// requested method must be in the allowed methods, and the requested headers are
+// echoed back if they're in the allowed headers; anything else is left out, so the
+// browser blocks the actual request.
+func (app *application) corsPreflight(w http.ResponseWriter, r *http.Request) {
+	method := strings.ToUpper(r.Header.Get("Access-Control-Request-Method"))
+
+	if containsFold(app.config.cors.allowedMethods, method) {
+		w.Header().Set("Access-Control-Allow-Methods", strings.Join(app.config.cors.allowedMethods, ", "))
+
+		var headers []string
+		for _, header := range strings.Split(r.Header.Get("Access-Control-Request-Headers"), ",") {
+			header = strings.TrimSpace(header)
+			if header != "" && containsFold(app.config.cors.allowedHeaders, header) {
+				headers = append(headers, header)
+			}
+		}
+
+		if len(headers) > 0 {
+			w.Header().Set("Access-Control-Allow-Headers", strings.Join(headers, ", "))
+		}
+
+		if app.config.cors.maxAge > 0 {
+			w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(app.config.cors.maxAge.Seconds())))
+		}
+	}
+
+	// Write the headers along with a 200 status ok and return from the middleware
+	// with no further actions.
+	w.WriteHeader(http.StatusOK)
+}
+
+// The containsFold() function reports whether values contains s, ignoring case.
+func containsFold(values []string, s string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// The maintenance() middleware sends a 503 Service Unavailable response to every
+// request while the server is in maintenance mode, apart from the healthcheck, so that
+// load balancers don't take the instance out of service, and the configuration reload
+// endpoint, which is one way of turning maintenance mode off again.
+func (app *application) maintenance(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if app.live.Load().maintenanceMode && r.URL.Path != "/v1/healthcheck" && r.URL.Path != "/v1/admin/config/reload" {
+			app.maintenanceResponse(w, r)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// The methods which X-HTTP-Method-Override can ask for. Overriding to GET or POST is
+// never needed, as any client can send those.
+var overridableMethods = []string{http.MethodPatch, http.MethodPut, http.MethodDelete}
+
+// The methodOverride() middleware, which only does anything with
+// -method-override-enabled, lets clients which can only send GET and POST requests
+// call our other endpoints: an authenticated POST request with an
+// X-HTTP-Method-Override header of PATCH, PUT or DELETE is routed as if it had been
+// sent with that method. Any other use of the header gets a 400 Bad Request, rather
+// than the header being ignored and the request doing something the client didn't
+// mean. The original method is logged, and kept in the context for the audit log.
+//
+// It comes after authenticate(), so that it knows who the user is, and before the
+// router, which routes on the overridden method.
+func (app *application) methodOverride(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		override := r.Header.Get("X-HTTP-Method-Override")
+		if !app.config.methodOverrideEnabled || override == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		override = strings.ToUpper(strings.TrimSpace(override))
+
+		switch {
+		case r.Method != http.MethodPost:
+			app.invalidMethodOverrideResponse(w, r, "X-HTTP-Method-Override can only be sent with POST requests")
+			return
+		case !validator.In(override, overridableMethods...):
+			app.invalidMethodOverrideResponse(w, r, "X-HTTP-Method-Override must be PATCH, PUT or DELETE")
+			return
+		case app.contextGetUser(r).IsAnonymous():
+			app.invalidMethodOverrideResponse(w, r, "X-HTTP-Method-Override can only be sent by authenticated users")
+			return
+		}
+
+		app.logger.PrintInfo("method overridden", app.logProperties(r, map[string]string{
+			"original_method": r.Method,
+			"request_method":  override,
+			"request_url":     r.URL.String(),
+			"user_id":         strconv.FormatInt(app.contextGetUser(r).ID, 10),
+		}))
+
+		r = app.contextSetOriginalMethod(r, r.Method)
+		r.Method = override
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// The enforceHTTPS() middleware, which only does anything with -enforce-https,
+// redirects GET and HEAD requests made over plain HTTP to the same URL over HTTPS
+// with a 301 Moved Permanently, and refuses any other plain HTTP request with a 403
+// Forbidden, as following a redirect would mean sending its body in the clear again.
+// The paths in -enforce-https-exempt, such as the healthcheck, are let through so
+// that load balancers can probe the server directly.
+func (app *application) enforceHTTPS(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !app.config.https.enforce || app.isHTTPS(r) || validator.In(r.URL.Path, app.config.https.exemptPaths...) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		httpsURL := "https://" + r.Host + r.URL.RequestURI()
+
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			app.httpsRequiredResponse(w, r, httpsURL)
+			return
+		}
+
+		http.Redirect(w, r, httpsURL, http.StatusMovedPermanently)
+	})
+}
+
+// The logRequests() middleware logs every request at the DEBUG level once its response
+// has been sent, with the status code and how long it took. It's off at the default
+// -log-level=info, as it would write an entry for every request.
+func (app *application) logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !app.logger.Enabled(jsonlog.LevelDebug) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		metrics := httpsnoop.CaptureMetrics(next, w, r)
+
+		app.logger.PrintDebug("request completed", app.logProperties(r, map[string]string{
+			"request_method": r.Method,
+			"request_url":    r.URL.String(),
+			"client_ip":      app.clientIP(r),
+			"status":         strconv.Itoa(metrics.Code),
+			"duration":       metrics.Duration.String(),
+			"bytes_written":  strconv.FormatInt(metrics.Written, 10),
+		}))
+	})
+}
+
 func (app *application) metrics(next http.Handler) http.Handler {
 	// Initialize the new expvar variables when the middleware chain is first built.
 	totalRequestsReceived := expvar.NewInt("total_requests_received")
@@ -324,15 +1041,25 @@ func (app *application) metrics(next http.Handler) http.Handler {
 	// code.
 	totalResponsesSentByStatus := expvar.NewMap("total_responses_sent_by_status")
 
+	// Declare a new expvar map to hold the metrics for each route, keyed by method
+	// and route pattern (such as "GET /v1/movies/:id").
+	totalRequestsByRoute := newRouteMetrics("total_requests_by_route")
+
 	// The following code will be run for every request...
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Use the Add() to increment the number of requests received by 1.
 		totalRequestsReceived.Add(1)
 
+		// Add a routeRecorder to the request context, which the router fills in
+		// with the matched route.
+		r, rr := app.contextWithRouteRecorder(r)
+
 		// Call the httpsnoop.CaptureMetrics(), passing in the next handler in
 		// the chain along with the existing http.ResponseWriter and http.Request.
 		metrics := httpsnoop.CaptureMetrics(next, w, r)
 
+		totalRequestsByRoute.record(rr.get(), metrics.Code, metrics.Duration)
+
 		// On the way back up the middleware chain, increment the number of responses
 		// sent by 1.
 		totalResponsesSent.Add(1)
@@ -347,3 +1074,88 @@ func (app *application) metrics(next http.Handler) http.Handler {
 		totalResponsesSentByStatus.Add(strconv.Itoa(metrics.Code), 1)
 	})
 }
+
+// Define a routeMetrics type which publishes, for each route, the number of requests,
+// the cumulative and average processing time, and the number of responses in each
+// status code class (2xx, 4xx, 5xx and so on).
+type routeMetrics struct {
+	published *expvar.Map
+
+	mu     sync.Mutex
+	routes map[string]*routeCounters
+}
+
+type routeCounters struct {
+	requests       expvar.Int
+	processingTime expvar.Int
+	responses      expvar.Map
+}
+
+func newRouteMetrics(name string) *routeMetrics {
+	return &routeMetrics{
+		published: expvar.NewMap(name),
+		routes:    make(map[string]*routeCounters),
+	}
+}
+
+// The record() method adds a response to the counters for its route, creating and
+// publishing them the first time the route is seen. The counters themselves are
+// expvar types, which are safe for concurrent use.
+func (m *routeMetrics) record(route string, code int, duration time.Duration) {
+	m.mu.Lock()
+	counters, found := m.routes[route]
+	if !found {
+		counters = &routeCounters{}
+		counters.responses.Init()
+
+		vars := new(expvar.Map).Init()
+		vars.Set("requests", &counters.requests)
+		vars.Set("processing_time_μs", &counters.processingTime)
+		vars.Set("average_processing_time_μs", expvar.Func(func() interface{} {
+			requests := counters.requests.Value()
+			if requests == 0 {
+				return 0
+			}
+			return counters.processingTime.Value() / requests
+		}))
+		vars.Set("responses_by_status", &counters.responses)
+
+		m.routes[route] = counters
+		m.published.Set(route, vars)
+	}
+	m.mu.Unlock()
+
+	counters.requests.Add(1)
+	counters.processingTime.Add(duration.Microseconds())
+	counters.responses.Add(fmt.Sprintf("%dxx", code/100), 1)
+}
+
+// The requestID() middleware makes sure every request has an ID, so that it can be
+// correlated with the logs and the audit log. We reuse an X-Request-ID sent by the
+// client (or a proxy in front of us) if it's at most 64 safe characters, and otherwise
+// generate a random one. Either way the ID is echoed back in the response headers.
+func (app *application) requestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Record when the request arrived, for the processing time in the responses'
+		// meta objects.
+		r = app.contextSetRequestStart(r, time.Now())
+
+		id := r.Header.Get("X-Request-ID")
+
+		if !validator.Matches(id, validator.RequestIDRX) {
+			randomBytes := make([]byte, 16)
+
+			_, err := rand.Read(randomBytes)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+
+			id = hex.EncodeToString(randomBytes)
+		}
+
+		w.Header().Set("X-Request-ID", id)
+
+		next.ServeHTTP(w, app.contextSetRequestID(r, id))
+	})
+}
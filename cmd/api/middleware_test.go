@@ -0,0 +1,540 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/petrostrak/an-open-movie-database/internal/data"
+	"github.com/petrostrak/an-open-movie-database/internal/jsonlog"
+	"github.com/petrostrak/an-open-movie-database/internal/ratelimit"
+)
+
+// A cached user is re-verified once the verify interval has passed, so a change made
+// without invalidating the cache is picked up then, and a deleted token stops working.
+func TestUserCacheReverification(t *testing.T) {
+	app := newTestApplication(t)
+	app.userCache = data.NewUserCache(10, time.Hour, 20*time.Millisecond)
+	ts := newTestServer(t)
+
+	user, token := newTestUser(t, app, "alice", "reader")
+
+	name := func() string {
+		t.Helper()
+
+		code, body := ts.do(t, http.MethodGet, "/v1/me", token, nil)
+		if code != http.StatusOK {
+			t.Fatalf("got status %d; want %d", code, http.StatusOK)
+		}
+
+		return body["user"].(map[string]interface{})["name"].(string)
+	}
+
+	if got := name(); got != "alice" {
+		t.Fatalf("got name %q; want %q", got, "alice")
+	}
+
+	user.Name = "Alice Liddell"
+
+	err := app.models.Users.Update(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := name(); got != "alice" {
+		t.Errorf("got name %q before re-verification; want the cached %q", got, "alice")
+	}
+
+	time.Sleep(30 * time.Millisecond)
+
+	if got := name(); got != "Alice Liddell" {
+		t.Errorf("got name %q after re-verification; want %q", got, "Alice Liddell")
+	}
+
+	err = app.models.Tokens.DeleteAllForUser(data.ScopeAuthentication, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(30 * time.Millisecond)
+
+	code, _ := ts.do(t, http.MethodGet, "/v1/me", token, nil)
+	if code != http.StatusUnauthorized {
+		t.Errorf("got status %d after deleting the token; want %d", code, http.StatusUnauthorized)
+	}
+}
+
+// Requests are only logged at the DEBUG level, with the status code and duration.
+func TestLogRequests(t *testing.T) {
+	app := newTestApplication(t)
+	logs := captureLogs(t, app)
+
+	handler := app.requestID(app.logRequests(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})))
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/v1/movies", nil))
+
+	if got := logs.String(); got != "" {
+		t.Fatalf("got log output %q at the INFO level; want none", got)
+	}
+
+	app.logger.SetLevel(jsonlog.LevelDebug)
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/v1/movies", nil))
+
+	var entry struct {
+		Level      string            `json:"level"`
+		Message    string            `json:"message"`
+		Properties map[string]string `json:"properties"`
+	}
+
+	err := json.Unmarshal([]byte(strings.TrimSpace(logs.String())), &entry)
+	if err != nil {
+		t.Fatalf("%v decoding %q", err, logs.String())
+	}
+
+	if entry.Level != "[DEBUG]" || entry.Message != "request completed" {
+		t.Errorf("got level %q and message %q", entry.Level, entry.Message)
+	}
+
+	for key, want := range map[string]string{"request_method": "GET", "request_url": "/v1/movies", "status": "418"} {
+		if entry.Properties[key] != want {
+			t.Errorf("got %s %q; want %q", key, entry.Properties[key], want)
+		}
+	}
+
+	for _, key := range []string{"duration", "request_id"} {
+		if entry.Properties[key] == "" {
+			t.Errorf("properties %v have no %s", entry.Properties, key)
+		}
+	}
+}
+
+// A panicking handler is reported exactly once, with the request details, even though
+// the panic crosses the requestTimeout() goroutine on its way to recoverPanic().
+func TestRecoverPanicReportsError(t *testing.T) {
+	app := newTestApplication(t)
+	app.config.requestTimeout = time.Second
+
+	reporter := &fakeReporter{}
+	app.reporter = reporter
+
+	user, token := newTestUser(t, app, "alice")
+
+	handler := app.requestID(app.recoverPanic(app.requestTimeout(app.authenticate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	})))))
+
+	req := httptest.NewRequest(http.MethodGet, "/v1/movies/1?fields=title", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("got status %d; want %d", w.Code, http.StatusInternalServerError)
+	}
+
+	reports := reporter.get()
+	if len(reports) != 1 {
+		t.Fatalf("got %d reports; want 1", len(reports))
+	}
+
+	if reports[0].err.Error() != "boom" {
+		t.Errorf("got error %q; want boom", reports[0].err)
+	}
+
+	context := reports[0].context
+	for key, want := range map[string]string{
+		"request_method": http.MethodGet,
+		"request_path":   "/v1/movies/1",
+		"user_id":        strconv.FormatInt(user.ID, 10),
+		"request_id":     w.Header().Get("X-Request-ID"),
+	} {
+		if context[key] != want {
+			t.Errorf("got %s %q; want %q", key, context[key], want)
+		}
+	}
+
+	if !strings.Contains(context["stack"], "goroutine") {
+		t.Errorf("got stack %q; want the stack trace", context["stack"])
+	}
+}
+
+// The response to a panic includes the stack trace in development only, and is the
+// generic server error everywhere else.
+func TestRecoverPanicResponse(t *testing.T) {
+	app := newTestApplication(t)
+
+	handler := app.requestID(app.recoverPanic(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	})))
+
+	tests := []struct {
+		env       string
+		wantStack bool
+	}{
+		{"development", true},
+		{"staging", false},
+		{"production", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.env, func(t *testing.T) {
+			app.config.env = tt.env
+
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/v1/movies/1", nil))
+
+			if w.Code != http.StatusInternalServerError {
+				t.Fatalf("got status %d; want %d", w.Code, http.StatusInternalServerError)
+			}
+
+			if got := w.Header().Get("Connection"); got != "close" {
+				t.Errorf("got Connection %q; want close", got)
+			}
+
+			var body struct {
+				Error   string                 `json:"error"`
+				Code    string                 `json:"code"`
+				Details map[string]interface{} `json:"details"`
+			}
+
+			err := json.NewDecoder(w.Body).Decode(&body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if body.Code != errCodeServerError || body.Error != "the server encountered a problem and could not process your request" {
+				t.Errorf("got code %q and error %q; want the generic server error", body.Code, body.Error)
+			}
+
+			if body.Details["request_id"] != w.Header().Get("X-Request-ID") {
+				t.Errorf("got request_id %v; want %q", body.Details["request_id"], w.Header().Get("X-Request-ID"))
+			}
+
+			stack, found := body.Details["stack"].(string)
+			if found != tt.wantStack {
+				t.Fatalf("got details %v; want a stack trace: %t", body.Details, tt.wantStack)
+			}
+
+			// The stack shows where the panic happened, in the handler.
+			if found && !strings.Contains(stack, "TestRecoverPanicResponse") {
+				t.Errorf("got stack %q; want it to include the panicking handler", stack)
+			}
+		})
+	}
+}
+
+func TestEnforceHTTPS(t *testing.T) {
+	app := newTestApplication(t)
+	app.config.https.enforce = true
+	app.config.https.exemptPaths = []string{"/v1/healthcheck"}
+
+	_, proxy, err := net.ParseCIDR("10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.config.trustedProxies = []*net.IPNet{proxy}
+
+	handler := app.enforceHTTPS(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	tests := []struct {
+		name         string
+		method       string
+		path         string
+		remoteAddr   string
+		tls          bool
+		proto        []string
+		wantStatus   int
+		wantLocation string
+	}{
+		{"direct TLS", http.MethodGet, "/v1/movies", "192.0.2.1:1234", true, nil, http.StatusOK, ""},
+		{"direct TLS post", http.MethodPost, "/v1/movies", "192.0.2.1:1234", true, nil, http.StatusOK, ""},
+		{"plain get", http.MethodGet, "/v1/movies?page=2", "192.0.2.1:1234", false, nil, http.StatusMovedPermanently, "https://api.example.com/v1/movies?page=2"},
+		{"plain head", http.MethodHead, "/v1/movies", "192.0.2.1:1234", false, nil, http.StatusMovedPermanently, "https://api.example.com/v1/movies"},
+		{"plain post", http.MethodPost, "/v1/movies", "192.0.2.1:1234", false, nil, http.StatusForbidden, ""},
+		{"proxied https", http.MethodPost, "/v1/movies", "10.0.0.5:1234", false, []string{"https"}, http.StatusOK, ""},
+		{"proxied https, any case", http.MethodGet, "/v1/movies", "10.0.0.5:1234", false, []string{"HTTPS"}, http.StatusOK, ""},
+		{"proxied http", http.MethodGet, "/v1/movies", "10.0.0.5:1234", false, []string{"http"}, http.StatusMovedPermanently, "https://api.example.com/v1/movies"},
+		{"proxied without header", http.MethodGet, "/v1/movies", "10.0.0.5:1234", false, nil, http.StatusMovedPermanently, "https://api.example.com/v1/movies"},
+		{"proxy appended http", http.MethodPost, "/v1/movies", "10.0.0.5:1234", false, []string{"https, http"}, http.StatusForbidden, ""},
+		{"proxy appended http header", http.MethodPost, "/v1/movies", "10.0.0.5:1234", false, []string{"https", "http"}, http.StatusForbidden, ""},
+		{"spoofed header", http.MethodGet, "/v1/movies", "192.0.2.1:1234", false, []string{"https"}, http.StatusMovedPermanently, "https://api.example.com/v1/movies"},
+		{"spoofed header post", http.MethodDelete, "/v1/movies/1", "192.0.2.1:1234", false, []string{"https"}, http.StatusForbidden, ""},
+		{"exempt path", http.MethodGet, "/v1/healthcheck", "192.0.2.1:1234", false, nil, http.StatusOK, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "http://api.example.com"+tt.path, nil)
+			req.RemoteAddr = tt.remoteAddr
+			if tt.tls {
+				req.TLS = &tls.ConnectionState{}
+			}
+			for _, proto := range tt.proto {
+				req.Header.Add("X-Forwarded-Proto", proto)
+			}
+
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("got status %d; want %d (body %s)", w.Code, tt.wantStatus, w.Body)
+			}
+
+			if got := w.Header().Get("Location"); got != tt.wantLocation {
+				t.Errorf("got Location %q; want %q", got, tt.wantLocation)
+			}
+
+			if tt.wantStatus == http.StatusForbidden {
+				var body struct {
+					Code    string `json:"code"`
+					Details struct {
+						HTTPSURL string `json:"https_url"`
+					} `json:"details"`
+				}
+
+				err := json.Unmarshal(w.Body.Bytes(), &body)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if body.Code != errCodeHTTPSRequired || body.Details.HTTPSURL != "https://api.example.com"+tt.path {
+					t.Errorf("got code %q and https_url %q; want %q and the https URL", body.Code, body.Details.HTTPSURL, errCodeHTTPSRequired)
+				}
+			}
+		})
+	}
+
+	// Nothing is enforced without -enforce-https.
+	app.config.https.enforce = false
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "http://api.example.com/v1/movies", nil))
+
+	if w.Code != http.StatusOK {
+		t.Errorf("got status %d without -enforce-https; want %d", w.Code, http.StatusOK)
+	}
+}
+
+// With -method-override-enabled, an authenticated POST request with
+// X-HTTP-Method-Override is routed as the method it names, and the audit log records
+// the method it was sent with. Any other use of the header is refused.
+func TestMethodOverride(t *testing.T) {
+	app := newTestApplication(t)
+	app.config.methodOverrideEnabled = true
+
+	_, editorToken := newTestUser(t, app, "editor", "editor")
+
+	movie := &data.Movie{Title: "Casablanca", Year: 1942, Runtime: 102, Genres: []string{"drama", "romance"}}
+	err := app.models.Movies.Insert(movie)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	moviePath := "/v1/movies/" + strconv.FormatInt(movie.ID, 10)
+
+	send := func(method, path, token, override string) *httptest.ResponseRecorder {
+		t.Helper()
+
+		req := httptest.NewRequest(method, path, strings.NewReader(`{"title": "Casablanca (restored)"}`))
+		req.Header.Set("Content-Type", "application/json")
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		if override != "" {
+			req.Header.Set("X-HTTP-Method-Override", override)
+		}
+
+		w := httptest.NewRecorder()
+		testHandler.ServeHTTP(w, req)
+
+		return w
+	}
+
+	tests := []struct {
+		name     string
+		method   string
+		token    string
+		override string
+	}{
+		{"sent with GET", http.MethodGet, editorToken, http.MethodPatch},
+		{"sent with PUT", http.MethodPut, editorToken, http.MethodDelete},
+		{"override to GET", http.MethodPost, editorToken, http.MethodGet},
+		{"override to POST", http.MethodPost, editorToken, http.MethodPost},
+		{"unknown method", http.MethodPost, editorToken, "PURGE"},
+		{"anonymous", http.MethodPost, "", http.MethodPatch},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := send(tt.method, moviePath, tt.token, tt.override)
+
+			if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), errCodeInvalidMethodOverride) {
+				t.Errorf("got status %d and body %s; want %d and %q", w.Code, w.Body, http.StatusBadRequest, errCodeInvalidMethodOverride)
+			}
+		})
+	}
+
+	w := send(http.MethodPost, moviePath, editorToken, "patch")
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d for an overridden PATCH; want %d (body %s)", w.Code, http.StatusOK, w.Body)
+	}
+
+	updated, err := app.models.Movies.Get(movie.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if updated.Title != "Casablanca (restored)" {
+		t.Errorf("got title %q; want the updated title", updated.Title)
+	}
+
+	// Wait for the audit entry to be written.
+	app.audit.Close()
+
+	entries, _, err := app.models.Audit.GetAll(data.AuditFilters{Action: "movie.update"}, data.Filters{Page: 1, PageSize: 20, Sort: "id", SortSafelist: []string{"id"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 1 || entries[0].Metadata["original_method"] != http.MethodPost {
+		t.Errorf("got audit entries %+v; want one with original_method POST", entries)
+	}
+
+	// Without -method-override-enabled the header is ignored, and the router sees a POST.
+	app.config.methodOverrideEnabled = false
+
+	w = send(http.MethodPost, moviePath, editorToken, http.MethodPatch)
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("got status %d with the override disabled; want %d", w.Code, http.StatusMethodNotAllowed)
+	}
+}
+
+// Turning on -anonymous-reads only opens the movie listing and details to clients
+// without a token. Every other route responds to them as it did before, so the writes
+// still get a 401, and authenticated users still need the movies:read permission.
+func TestAnonymousReads(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t)
+
+	_, noRolesToken := newTestUser(t, app, "nobody")
+
+	movie := &data.Movie{Title: "Moana", Year: 2016, Runtime: 107, Genres: []string{"animation"}}
+	err := app.models.Movies.Insert(movie)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opened := map[string]bool{
+		"GET /v1/movies":     true,
+		"GET /v1/movies/:id": true,
+		"GET /v2/movies":     true,
+		"GET /v2/movies/:id": true,
+	}
+
+	// Don't follow the redirect to Google from the OAuth login route.
+	client := ts.Client()
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+
+	statuses := func(anonymousReads bool) map[string]int {
+		app.config.anonymousReads = anonymousReads
+		app.live.Store(newDynamicConfig(app.config))
+
+		got := make(map[string]int)
+
+		for _, route := range registeredRoutes {
+			method, pattern, _ := strings.Cut(route, " ")
+			path := httprouterParamRX.ReplaceAllString(pattern, strconv.FormatInt(movie.ID, 10))
+
+			req, err := http.NewRequest(method, ts.URL+path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			res, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+
+			got[route] = res.StatusCode
+		}
+
+		return got
+	}
+
+	off, on := statuses(false), statuses(true)
+
+	for _, route := range registeredRoutes {
+		switch {
+		case opened[route] && (off[route] != http.StatusUnauthorized || on[route] != http.StatusOK):
+			t.Errorf("%s: got status %d without anonymous reads and %d with them; want 401 and 200", route, off[route], on[route])
+		case !opened[route] && off[route] != on[route]:
+			t.Errorf("%s: got status %d without anonymous reads and %d with them; want no change", route, off[route], on[route])
+		}
+	}
+
+	if on["POST /v1/movies"] != http.StatusUnauthorized {
+		t.Errorf("POST /v1/movies: got status %d with anonymous reads; want 401", on["POST /v1/movies"])
+	}
+
+	if code, _ := ts.do(t, http.MethodGet, "/v1/movies", noRolesToken, nil); code != http.StatusForbidden {
+		t.Errorf("got status %d for a user without movies:read; want 403", code)
+	}
+}
+
+// Anonymous reads are limited by IP address in their own class, which doesn't affect
+// authenticated users from the same address.
+func TestAnonymousReadsRateLimit(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t)
+
+	_, readerToken := newTestUser(t, app, "reader", "reader")
+
+	enableRateLimits(app, 100, 100)
+	app.config.anonymousReads = true
+	app.config.limiter.anonymous = classLimit{rps: 0.001, burst: 1}
+	app.limiters.classes = map[string]ratelimit.RateLimiter{
+		routeClassAnonymous: ratelimit.NewMemory(0.001, 1, ratelimit.MemoryOptions{}),
+	}
+	app.live.Store(newDynamicConfig(app.config))
+	t.Cleanup(func() { app.live.Store(newDynamicConfig(config{})) })
+
+	tests := []struct {
+		name      string
+		token     string
+		wantCode  int
+		wantClass string
+	}{
+		{"first anonymous read", "", http.StatusOK, ""},
+		{"second anonymous read", "", http.StatusTooManyRequests, routeClassAnonymous},
+		{"authenticated read", readerToken, http.StatusOK, ""},
+		{"authenticated read again", readerToken, http.StatusOK, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, body := ts.do(t, http.MethodGet, "/v1/movies", tt.token, nil)
+			if code != tt.wantCode {
+				t.Fatalf("got status %d and body %v; want %d", code, body, tt.wantCode)
+			}
+
+			details, _ := body["details"].(map[string]interface{})
+			if tt.wantClass != "" && details["class"] != tt.wantClass {
+				t.Errorf("got details %v; want the %s class", details, tt.wantClass)
+			}
+		})
+	}
+}
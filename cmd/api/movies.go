@@ -5,6 +5,11 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/petrostrak/an-open-movie-database/internal/data"
 	"github.com/petrostrak/an-open-movie-database/internal/validator"
@@ -13,53 +18,67 @@ import (
 // Add a createMovieHandler for the "POST /v1/movies" endpoint. For now we simply
 // return a plain-text placeholder response.
 func (app *application) createMovieHandler(w http.ResponseWriter, r *http.Request) {
-	// Declare an anonymous struct to hold the information that we expect to be in the
-	// HTTP request body. This struct will be our target decode destination.
-	var input struct {
-		Title   string       `json:"title"`
-		Year    int32        `json:"year"`
-		Runtime data.Runtime `json:"runtime"`
-		Genres  []string     `json	:"genres"`
-	}
-
-	// Initialize a new json.Decoder instance which reads from the request body, and
-	// then use the Decode() method to decode the body contents into the input struct.
-	// Importantly, notice that when we call Decode() we pass a *pointer* to the input
-	// struct as the target decode destination. If there was an error during decoding,
-	// we also use our generic errorResponse() helper to send the client a 400 Bad
-	// Request response containing the error message.
-	//
-	// Use the new readJSON() helper to decode the request body into the input struct.
-	// If this returns an error we send the client the error message along with a 400
-	// Bad Request status code.
-	if err := app.readJSON(w, r, &input); err != nil {
-		// Use the badRequestResponse() helper.
-		app.badRequestResponse(w, r, err)
+	// Initialize a new Validator instance.
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	// With ?enrich=true, the details the client left out are looked up before the
+	// movie is validated.
+	enrichNew := app.readBool(qs, "enrich", v)
+
+	// With ?strict=true, a movie which looks like one that already exists is refused.
+	strict := app.readBool(qs, "strict", v)
+
+	// Use the decodeNewMovie() helper to decode the movie. If the body couldn't be
+	// decoded, it has already sent the 400 response.
+	movie, ok := app.decodeNewMovie(w, r)
+	if !ok {
 		return
 	}
 
-	// Copy the values from the input struct to a new Movie struct.
-	movie := &data.Movie{
-		Title:   input.Title,
-		Year:    input.Year,
-		Runtime: input.Runtime,
-		Genres:  input.Genres,
+	// A provider which can't be used doesn't stop the movie being created; the
+	// response carries a warning instead.
+	var (
+		enriched []string
+		warn     *warning
+	)
+
+	if enrichNew != nil && *enrichNew {
+		enriched, warn = app.enrichMovie(r, movie)
 	}
 
-	// Initialize a new Validator instance.
-	v := validator.New()
+	data.ValidateMovie(v, movie)
+
+	// Read the runtime format for the response along with the movie, so that a bad
+	// runtime_format parameter is reported before anything is created.
+	runtimeFormat := app.readRuntimeFormat(qs, v)
 
 	// Use the Valid() method to see if any of the checks failed. If they did, then use
 	// the failedValidationResponse() helper to send a response to the client, passing
 	// in the v.Errors map.
-	//
-	// Call the ValidateMovie() function and return a response containing the errors if
-	// any of the checks fail.
-	if data.ValidateMovie(v, movie); !v.Valid() {
+	if !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
 
+	if strict != nil && *strict {
+		duplicates, err := app.findDuplicates(movie)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		if len(duplicates) > 0 {
+			app.duplicateMovieResponse(w, r, formatCandidates(duplicates, app.contextGetAPIVersion(r), runtimeFormat))
+			return
+		}
+	}
+
+	// Record the user adding the movie as its creator.
+	user := app.contextGetUser(r)
+	movie.CreatedBy = &data.UserRef{ID: user.ID, Name: user.Name}
+
 	// Call the Insert() method on our movies model, passing in a pointer to the
 	// validated movie struct. This will create a record in the database and update
 	// the movie struct with the system-generated information.
@@ -68,30 +87,119 @@ func (app *application) createMovieHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
+	app.recordAudit(r, data.AuditEntry{
+		Action:       "movie.create",
+		ResourceType: "movie",
+		ResourceID:   strconv.FormatInt(movie.ID, 10),
+	})
+
+	app.fireWebhook(data.WebhookMovieCreated, envelope{"movie": formatMovie(movie, apiV1, app.config.runtimeFormat)})
+
 	// When sending a HTTP response, we want to include a Location header to let the
 	// client know which URL they can find the newly-created resource at. We make an
 	// empty http.Header map and then use the Set() method to add a new Location header,
 	// interpolating the system-generated ID for our new movie in the URL.
 	headers := make(http.Header)
-	headers.Set("Location", fmt.Sprintf("/v1/movies/%d", movie.ID))
+	headers.Set("Location", fmt.Sprintf("/%s/movies/%d", app.contextGetAPIVersion(r), movie.ID))
 
 	// Write a JSON response with a 201 Created status code, the movie data in the
-	// response body, and the Location header.
-	if err := app.writeJSON(w, http.StatusCreated, envelope{"movie": movie}, headers); err != nil {
-		app.serverErrorResponse(w, r, err)
+	// response body, and the Location header. An enriched movie's response also lists
+	// the fields which were filled in.
+	env := envelope{"movie": formatMovie(movie, app.contextGetAPIVersion(r), runtimeFormat)}
+	if enrichNew != nil && *enrichNew {
+		env = enrichmentEnvelope(env, enriched, warn)
 	}
 
-	// Dump the contents of the input struct in a HTTP response.
-	fmt.Fprintf(w, "%+v\n", input)
+	if err := app.writeResponse(w, r, http.StatusCreated, env, headers); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
 }
 
 // Add a showMovieHandler for the "GET /v1/movies/:id" endpoint. For now, we retrieve
 // the interpolated "id" parameter from the current URL and include it in a placeholder
 // response.
+// The validateMovieHandler() handler for the "POST /v1/movies/validate" endpoint checks
+// a movie exactly as createMovieHandler would, without creating it, so that a form can
+// be validated before it's saved. It doesn't enrich the movie.
+func (app *application) validateMovieHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+
+	movie, ok := app.decodeNewMovie(w, r)
+	if !ok {
+		return
+	}
+
+	if data.ValidateMovie(v, movie); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err := app.writeResponse(w, r, http.StatusOK, envelope{"valid": true}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The decodeNewMovie() helper decodes a new movie from the request body. Both
+// createMovieHandler and validateMovieHandler use it, so that a dry run checks exactly
+// what creating the movie would. If the body can't be decoded, it sends a 400 response
+// and returns false.
+func (app *application) decodeNewMovie(w http.ResponseWriter, r *http.Request) (*data.Movie, bool) {
+	// Declare an anonymous struct to hold the information that we expect to be in the
+	// HTTP request body. This struct will be our target decode destination.
+	var input struct {
+		Title           string               `json:"title"`
+		Year            int32                `json:"year"`
+		Runtime         data.Runtime         `json:"runtime"`
+		Genres          []string             `json:"genres"`
+		Awards          data.Awards          `json:"awards"`
+		ExternalRatings data.ExternalRatings `json:"external_ratings"`
+		Plot            string               `json:"plot"`
+		Poster          string               `json:"poster"`
+	}
+
+	// Use the readJSON() helper to decode the request body into the input struct. If
+	// this returns an error we send the client the error message along with a 400 Bad
+	// Request status code.
+	if err := app.readJSON(w, r, &input); err != nil {
+		app.badRequestResponse(w, r, err)
+		return nil, false
+	}
+
+	// Copy the values from the input struct to a new Movie struct.
+	movie := &data.Movie{
+		Title:           input.Title,
+		Year:            input.Year,
+		Runtime:         input.Runtime,
+		Genres:          input.Genres,
+		Awards:          input.Awards,
+		ExternalRatings: input.ExternalRatings,
+		Plot:            input.Plot,
+		Poster:          input.Poster,
+	}
+
+	return movie, true
+}
+
 func (app *application) showMovieHandler(w http.ResponseWriter, r *http.Request) {
 	id, err := app.readIDParam(r)
 	if err != nil {
-		app.notFoundResponse(w, r)
+		app.invalidParamResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	runtimeFormat := app.readRuntimeFormat(r.URL.Query(), v)
+
+	debugScore, err := app.readDebugScore(r, r.URL.Query(), v)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
 
@@ -109,10 +217,25 @@ func (app *application) showMovieHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	// Count the view towards the movie's popularity, even if the client already has
+	// the movie.
+	app.views.add(movie.ID, 1)
+
+	// Send a 304 Not Modified response, with no body, if the client already has the
+	// current version of the movie.
+	if app.notModified(w, r, movie.UpdatedAt) {
+		return
+	}
+
+	if debugScore {
+		movie = withScores([]*data.Movie{movie})[0]
+	}
+
 	// Encode the struct to JSON and send it as the HTTP response.
 	//
-	// Create an envelope{"movie":movie} instance and pass it to writeJSON()
-	if err := app.writeJSON(w, http.StatusOK, envelope{"movie": movie}, nil); err != nil {
+	// Create an envelope{"movie":movie} instance and pass it to writeResponse(), which
+	// sends it as XML instead if the client asked for that.
+	if err := app.writeResponse(w, r, http.StatusOK, envelope{"movie": formatMovie(movie, app.contextGetAPIVersion(r), runtimeFormat)}, nil); err != nil {
 		// Use the new serverErrorResponse() helper.
 		app.serverErrorResponse(w, r, err)
 	}
@@ -123,7 +246,7 @@ func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Reques
 	// Extract the movie ID from the URL
 	id, err := app.readIDParam(r)
 	if err != nil {
-		app.notFoundResponse(w, r)
+		app.invalidParamResponse(w, r, err)
 		return
 	}
 
@@ -140,17 +263,28 @@ func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
+	// Keep a copy of the movie as it was, to tell its watchers what changed. The
+	// fields below are replaced rather than modified, so a shallow copy is enough.
+	before := *movie
+
 	// Declare an input struct to hold the expected data from the client.
 	//
 	// Use pointers for the Title, Year and Runtime fields. Then to see
 	// if a client has provided a particular key/value pair in the JSON,
 	// we can simply check whether the corresponding field in the input
 	// struct equals nil or not.
+	//
+	// The awards and external ratings are replaced as a whole, like the genres, and
+	// sending an empty array removes them.
 	var input struct {
-		Title   *string       `json:"title"`
-		Year    *int32        `json:"year"`
-		Runtime *data.Runtime `json:"runtime"`
-		Genres  []string      `json:"genres"`
+		Title           *string              `json:"title"`
+		Year            *int32               `json:"year"`
+		Runtime         *data.Runtime        `json:"runtime"`
+		Genres          []string             `json:"genres"`
+		Awards          data.Awards          `json:"awards"`
+		ExternalRatings data.ExternalRatings `json:"external_ratings"`
+		Plot            *string              `json:"plot"`
+		Poster          *string              `json:"poster"`
 	}
 
 	// Read the JSON request body data into the input struct.
@@ -181,15 +315,38 @@ func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Reques
 		movie.Genres = input.Genres
 	}
 
+	if input.Awards != nil {
+		movie.Awards = input.Awards
+	}
+
+	if input.ExternalRatings != nil {
+		movie.ExternalRatings = input.ExternalRatings
+	}
+
+	// The plot and poster are removed by sending an empty string.
+	if input.Plot != nil {
+		movie.Plot = *input.Plot
+	}
+
+	if input.Poster != nil {
+		movie.Poster = *input.Poster
+	}
+
 	// Validate the updated movie record, sending the client a 422 Unprocessable Entity
 	// response in any checks fail.
 	v := validator.New()
 
+	runtimeFormat := app.readRuntimeFormat(r.URL.Query(), v)
+
 	if data.ValidateMovie(v, movie); !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
 
+	// Record the user making the update. The movie's creator is left as it was.
+	user := app.contextGetUser(r)
+	movie.UpdatedBy = &data.UserRef{ID: user.ID, Name: user.Name}
+
 	// Pass the unpdated movie record to our new Update() method.
 	//
 	// Intercept any ErrEditConflict error and call the new editConflictResponse()
@@ -204,8 +361,18 @@ func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
+	app.recordAudit(r, data.AuditEntry{
+		Action:       "movie.update",
+		ResourceType: "movie",
+		ResourceID:   strconv.FormatInt(movie.ID, 10),
+		Metadata:     map[string]interface{}{"version": movie.Version},
+	})
+
+	app.fireWebhook(data.WebhookMovieUpdated, envelope{"movie": formatMovie(movie, apiV1, app.config.runtimeFormat)})
+	app.notifyWatchers(&before, movie)
+
 	// Write the update movie record in a JSON response.
-	if err = app.writeJSON(w, http.StatusOK, envelope{"movie": movie}, nil); err != nil {
+	if err = app.writeResponse(w, r, http.StatusOK, envelope{"movie": formatMovie(movie, app.contextGetAPIVersion(r), runtimeFormat)}, nil); err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
 }
@@ -214,43 +381,71 @@ func (app *application) deleteMovieHandler(w http.ResponseWriter, r *http.Reques
 	// Extract the movie ID from the URL
 	id, err := app.readIDParam(r)
 	if err != nil {
-		app.notFoundResponse(w, r)
+		app.invalidParamResponse(w, r, err)
 		return
 	}
 
-	// Delete the movie from the database, sending a 404 Not Found response to the
-	// client if there isn't a matching record.
-	err = app.models.Movies.Delete(id)
+	// Delete the movie from the database, along with the ratings, reviews, watchlist
+	// entries and reports which refer to it. Send a 404 Not Found response to the client
+	// if there isn't a matching record, and a 409 Conflict if something else still
+	// refers to it.
+	deletion, err := app.models.Movies.Delete(id)
 	if err != nil {
+		var inUse *data.InUseError
+
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
 			app.notFoundResponse(w, r)
+		case errors.As(err, &inUse):
+			app.resourceInUseResponse(w, r, inUse.Table)
 		default:
 			app.serverErrorResponse(w, r, err)
 		}
 		return
 	}
 
-	// Return a 200 OK status code along with a success message.
-	if err = app.writeJSON(w, http.StatusOK, envelope{"message": "movie successfully deleted"}, nil); err != nil {
+	app.recordAudit(r, data.AuditEntry{
+		Action:       "movie.delete",
+		ResourceType: "movie",
+		ResourceID:   strconv.FormatInt(id, 10),
+		Metadata:     map[string]interface{}{"deleted": deletion},
+	})
+
+	// The movie has gone, so the event only carries its ID.
+	app.fireWebhook(data.WebhookMovieDeleted, envelope{"movie": envelope{"id": id}})
+
+	// Return a 200 OK status code along with a success message, and the number of rows
+	// of each kind which were deleted with the movie.
+	env := envelope{"message": "movie successfully deleted", "deleted": deletion}
+
+	if err = app.writeResponse(w, r, http.StatusOK, env, nil); err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
 }
 
 func (app *application) listMoviesHandler(w http.ResponseWriter, r *http.Request) {
-	// To keep things consistent with our other handlers, we'll define an input struct
-	// to hold the expected values from the request query string.
-	var input struct {
-		Title  string
-		Genres []string
-		data.Filters
-	}
+	// Call r.URL.Query to get the url.Values map containing the query string data.
+	app.listMovies(w, r, r.URL.Query())
+}
 
-	// Initialize a new Validator instance.
-	v := validator.New()
+// Define a movieListing struct to hold the parameters of a movie listing.
+type movieListing struct {
+	data.MovieFilters
+	data.Filters
+	facets        []string
+	runtimeFormat string
+	debugScore    bool
+	ndjson        bool
+}
 
-	// Call r.URL.Query to get the url.Values map containing the query string data.
-	qs := r.URL.Query()
+// The readMovieListing() helper reads the parameters of a movie listing from qs,
+// adding any problems to v. It takes the values rather than reading the request's
+// query string, so that a saved search's stored query goes through exactly the same
+// checks as the query string of GET /v1/movies.
+func (app *application) readMovieListing(r *http.Request, qs url.Values, v *validator.Validator) (*movieListing, error) {
+	// To keep things consistent with our other handlers, we'll define an input struct
+	// to hold the expected values from the request query string.
+	var input movieListing
 
 	// Use our helpers to extract the title and genres query string values, falling back
 	// to defaults of an empty string and an empty slice respectively if they are not
@@ -258,44 +453,275 @@ func (app *application) listMoviesHandler(w http.ResponseWriter, r *http.Request
 	input.Title = app.readString(qs, "title", "")
 	input.Genres = app.readCSV(qs, "genres", []string{})
 
+	// Read whether to list only the movies with awards (true) or without them (false).
+	input.HasAwards = app.readBool(qs, "has_awards", v)
+
+	// Read the ID of the user whose movies to list, if any.
+	input.CreatedBy = int64(app.readInt(qs, "created_by", 0, v))
+	v.Check(input.CreatedBy >= 0, "created_by", validator.Msg("positive_integer"))
+
+	// Read which facet counts to include in the metadata, if any.
+	input.facets = app.readCSV(qs, "facets", []string{})
+	for _, facet := range input.facets {
+		v.Check(validator.In(facet, data.MovieFacets...), "facets", validator.Msg("unknown_facet", "facet", facet, "facets", strings.Join(data.MovieFacets, ", ")))
+	}
+
 	// Get the page and page_size query string values as integers. Notice that we set
 	// the default page value to 1 and default page_size to 20, and that we pass the
 	// validator instance as the final argument here.
+	//
+	// If the client is authenticated and hasn't provided a page_size or sort, we use
+	// their stored preferences as the defaults instead.
+	defaultPageSize, defaultSort, err := app.movieListDefaults(r, qs)
+	if err != nil {
+		return nil, err
+	}
+
 	input.Filters.Page = app.readInt(qs, "page", 1, v)
-	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", defaultPageSize, v)
 
-	// Extract the sort query string value, falling back to "id" if it is not provided
-	// by the client (which will imply a ascending sort on movie ID)
-	input.Filters.Sort = app.readString(qs, "sort", "id")
+	// Extract the sort query string value, falling back to cfg.defaultSort ("-popularity"
+	// unless it's been changed) if it is not provided by the client.
+	input.Filters.Sort = app.readString(qs, "sort", defaultSort)
 
 	// Add the supported sort values for this endpoint to the sort safelist.
-	input.Filters.SortSafelist = []string{"id", "title", "year", "runtime", "-id", "-title", "-year", "-runtime"}
+	input.Filters.SortSafelist = data.MovieSortSafelist
+
+	input.runtimeFormat = app.readRuntimeFormat(qs, v)
+
+	input.debugScore, err = app.readDebugScore(r, qs, v)
+	if err != nil {
+		return nil, err
+	}
+
+	input.ndjson = app.readNDJSON(r, qs, v)
+
+	// Execute the validation checks on the Filters struct.
+	data.ValidateFilters(v, input.Filters)
+
+	return &input, nil
+}
+
+// The listMovies() helper sends the page of movies listed by the parameters in qs. It
+// serves GET /v1/movies, and the results of saved searches.
+func (app *application) listMovies(w http.ResponseWriter, r *http.Request, qs url.Values) {
+	// Initialize a new Validator instance.
+	v := validator.New()
+
+	input, err := app.readMovieListing(r, qs, v)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
 
 	// Check the Validator instance for any errors and use the failedValidationResponse()
 	// helper to send the client a response if necessary.
-	//
-	// Execute the validation checks on the Filters struct and send a response
-	// containing the errors if necessary.
-	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+	if !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
 
+	// Count the facets while the movies are being fetched, so that asking for them
+	// doesn't add the time of more queries to the response.
+	waitForFacets := app.countFacets(input.MovieFilters, input.facets)
+
 	// Call the GetAll() method to retrieve the movies, passing in the various filter
 	// parameters.
 	//
 	// Accept the metadata struct as a return value.
-	movies, metadata, err := app.models.Movies.GetAll(input.Title, input.Genres, input.Filters)
+	movies, metadata, err := app.models.Movies.GetAll(input.MovieFilters, input.Filters)
+
+	facetCounts, facetsErr := waitForFacets()
+	if err == nil {
+		err = facetsErr
+	}
+
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
+	metadata.Facets = facetCounts
+
+	if input.debugScore {
+		movies = withScores(movies)
+	}
+
+	movies, err = limitPage(app, movies, &metadata)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// Set the Last-Modified header to the time of the most recent update to any of the
+	// movies on this page. It doesn't account for movies being added to or removed from
+	// the listing, so the listing doesn't answer If-Modified-Since.
+	headers := make(http.Header)
+
+	var lastModified time.Time
+	for _, movie := range movies {
+		if movie.UpdatedAt.After(lastModified) {
+			lastModified = movie.UpdatedAt
+		}
+	}
+
+	if !lastModified.IsZero() {
+		headers.Set("Last-Modified", lastModified.Truncate(time.Second).UTC().Format(http.TimeFormat))
+	}
+
+	// Send the movies a line at a time if the client asked for NDJSON, with the
+	// metadata in the headers instead. The facet counts have no header, so they're left
+	// out.
+	if input.ndjson {
+		for key, values := range paginationHeaders(metadata) {
+			headers[key] = values
+		}
+
+		app.writeMoviesNDJSON(w, r, movies, headers, input.runtimeFormat)
+		return
+	}
+
 	// Send a JSON response containing the movie data.
 	//
 	// Include the metadata in the response envelope.
-	if err = app.writeJSON(w, http.StatusOK, envelope{"movies": movies, "metadata": metadata}, nil); err != nil {
+	if err = app.writeResponse(w, r, http.StatusOK, envelope{"movies": formatMovies(movies, app.contextGetAPIVersion(r), input.runtimeFormat), "metadata": metadata}, headers); err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
+}
+
+// The runtime formats which movies can be sent with: "string" for the "<runtime> mins"
+// format, and "minutes" for a plain number, for clients which want to do arithmetic.
+const (
+	runtimeFormatString  = "string"
+	runtimeFormatMinutes = "minutes"
+)
+
+// The countFacets() helper starts counting the requested facets of the movies matching
+// the filters, with a query for each running concurrently, and returns a function which
+// waits for them. The facets are nil if none were requested, and otherwise only the
+// requested ones are set.
+func (app *application) countFacets(movieFilters data.MovieFilters, facets []string) func() (*data.Facets, error) {
+	if len(facets) == 0 {
+		return func() (*data.Facets, error) { return nil, nil }
+	}
+
+	var (
+		wg        sync.WaitGroup
+		counts    data.Facets
+		genresErr error
+		yearsErr  error
+	)
+
+	if validator.In(data.FacetGenres, facets...) {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			genres, err := app.models.Movies.GenreFacets(movieFilters)
+			counts.Genres, genresErr = &genres, err
+		}()
+	}
+
+	if validator.In(data.FacetYears, facets...) {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			years, err := app.models.Movies.YearFacets(movieFilters)
+			counts.Years, yearsErr = &years, err
+		}()
+	}
+
+	return func() (*data.Facets, error) {
+		wg.Wait()
+
+		for _, err := range []error{genresErr, yearsErr} {
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		return &counts, nil
+	}
+}
+
+// The readRuntimeFormat() helper returns the runtime format from the runtime_format
+// query string parameter, falling back to the -runtime-format setting. If it isn't
+// one of the runtime formats, an error is recorded in the Validator.
+func (app *application) readRuntimeFormat(qs url.Values, v *validator.Validator) string {
+	format := app.readString(qs, "runtime_format", app.config.runtimeFormat)
+
+	v.Check(validator.In(format, runtimeFormatString, runtimeFormatMinutes), "runtime_format", validator.Msg("runtime_format"))
+
+	return format
+}
+
+// Define a minutesMovie struct which encodes a movie with its runtime as a plain number
+// of minutes. Its Runtime field hides the one of the embedded movie.
+type minutesMovie struct {
+	*data.Movie
+	Runtime int32 `json:"runtime,omitempty" xml:"runtime,omitempty"`
+}
+
+// Define a movieV2 struct which encodes a movie in its v2 representation, in which
+// the runtime is always a plain number of minutes, and each genre is an object rather
+// than a string, so that more can be said about a genre later without breaking
+// clients again. Its fields hide those of the embedded movie, as minutesMovie's does.
+type movieV2 struct {
+	*data.Movie
+	Runtime int32        `json:"runtime,omitempty" xml:"runtime,omitempty"`
+	Genres  []movieGenre `json:"genres,omitempty" xml:"genres>genre"`
+}
+
+// Define a movieGenre struct to hold a genre in the v2 representation of a movie.
+type movieGenre struct {
+	Name string `json:"name" xml:"name"`
+}
 
+// The newMovieV2() function returns the v2 representation of a movie.
+func newMovieV2(movie *data.Movie) movieV2 {
+	var genres []movieGenre
+	for _, genre := range movie.Genres {
+		genres = append(genres, movieGenre{Name: genre})
+	}
+
+	return movieV2{Movie: movie, Runtime: int32(movie.Runtime), Genres: genres}
+}
+
+// The formatMovie() helper returns the movie ready to be encoded in the representation
+// of the API version. The v1 representation depends on the runtime format, which v2
+// ignores.
+func formatMovie(movie *data.Movie, version, format string) interface{} {
+	switch {
+	case version == apiV2:
+		return newMovieV2(movie)
+	case format == runtimeFormatMinutes:
+		return minutesMovie{Movie: movie, Runtime: int32(movie.Runtime)}
+	default:
+		return movie
+	}
+}
+
+// The formatMovies() helper is formatMovie() for a slice of movies.
+func formatMovies(movies []*data.Movie, version, format string) interface{} {
+	switch {
+	case version == apiV2:
+		formatted := make([]movieV2, len(movies))
+		for i, movie := range movies {
+			formatted[i] = newMovieV2(movie)
+		}
+
+		return formatted
+	case format == runtimeFormatMinutes:
+		formatted := make([]minutesMovie, len(movies))
+		for i, movie := range movies {
+			formatted[i] = minutesMovie{Movie: movie, Runtime: int32(movie.Runtime)}
+		}
+
+		return formatted
+	default:
+		return movies
+	}
 }
@@ -0,0 +1,984 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/petrostrak/an-open-movie-database/internal/data"
+)
+
+func TestMovieHandlers(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t)
+
+	_, readerToken := newTestUser(t, app, "reader", "reader")
+	_, editorToken := newTestUser(t, app, "editor", "editor")
+
+	movie := &data.Movie{Title: "Casablanca", Year: 1942, Runtime: 102, Genres: []string{"drama", "romance"}}
+	err := app.models.Movies.Insert(movie)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	moviePath := fmt.Sprintf("/v1/movies/%d", movie.ID)
+
+	validMovie := map[string]interface{}{
+		"title":   "Moana",
+		"year":    2016,
+		"runtime": "107 mins",
+		"genres":  []string{"animation", "adventure"},
+	}
+
+	tests := []struct {
+		name     string
+		method   string
+		path     string
+		token    string
+		body     interface{}
+		wantCode int
+		wantKey  string
+	}{
+		{"list anonymous", http.MethodGet, "/v1/movies", "", nil, http.StatusUnauthorized, "error"},
+		{"list reader", http.MethodGet, "/v1/movies", readerToken, nil, http.StatusOK, "movies"},
+		{"list invalid sort", http.MethodGet, "/v1/movies?sort=nope", readerToken, nil, http.StatusUnprocessableEntity, "error"},
+		{"show reader", http.MethodGet, moviePath, readerToken, nil, http.StatusOK, "movie"},
+		{"show invalid id", http.MethodGet, "/v1/movies/abc", readerToken, nil, http.StatusNotFound, "error"},
+		{"create reader", http.MethodPost, "/v1/movies", readerToken, validMovie, http.StatusForbidden, "error"},
+		{"create editor", http.MethodPost, "/v1/movies", editorToken, validMovie, http.StatusCreated, "movie"},
+		{"create invalid", http.MethodPost, "/v1/movies", editorToken, map[string]interface{}{"title": ""}, http.StatusUnprocessableEntity, "error"},
+		{"update editor", http.MethodPatch, moviePath, editorToken, map[string]interface{}{"year": 1943}, http.StatusOK, "movie"},
+		{"delete missing", http.MethodDelete, "/v1/movies/999999", editorToken, nil, http.StatusNotFound, "error"},
+		{"delete editor", http.MethodDelete, moviePath, editorToken, nil, http.StatusOK, "message"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, body := ts.do(t, tt.method, tt.path, tt.token, tt.body)
+
+			if code != tt.wantCode {
+				t.Errorf("got status %d; want %d (body %v)", code, tt.wantCode, body)
+			}
+
+			if _, ok := body[tt.wantKey]; !ok {
+				t.Errorf("response body %v has no %q key", body, tt.wantKey)
+			}
+		})
+	}
+}
+
+// Deleting a movie deletes the watchlist entries and reports which refer to it, and
+// the response counts them.
+func TestDeleteMovieRelated(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t)
+
+	alice, _ := newTestUser(t, app, "alice", "reader")
+	_, editorToken := newTestUser(t, app, "editor", "editor")
+
+	movies := seedMovies(t, app, 2)
+
+	for _, movieID := range movies {
+		_, err := app.models.Watchlist.Add(alice.ID, movieID, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := app.models.Reports.Insert(&data.Report{MovieID: movies[0], UserID: alice.ID, Field: "year", Message: "Wrong year."})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code, body := ts.do(t, http.MethodDelete, fmt.Sprintf("/v1/movies/%d", movies[0]), editorToken, nil)
+	if got := fmt.Sprint(body["deleted"]); code != http.StatusOK || got != "map[ratings:0 reports:1 reviews:0 watchlist_entries:1]" {
+		t.Fatalf("got status %d and deleted %s; want one watchlist entry and one report", code, got)
+	}
+
+	entries, err := app.models.Watchlist.GetAllForUser(alice.ID)
+	if err != nil || len(entries) != 1 || entries[0].MovieID != movies[1] {
+		t.Errorf("got watchlist %v and error %v; want only the other movie", entries, err)
+	}
+
+	reports, err := app.models.Reports.GetAllForUser(alice.ID)
+	if err != nil || len(reports) != 0 {
+		t.Errorf("got reports %v and error %v; want none", reports, err)
+	}
+}
+
+func TestListMoviesFilters(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t)
+
+	_, token := newTestUser(t, app, "reader", "reader")
+
+	for _, movie := range []*data.Movie{
+		{Title: "The Breakfast Club", Year: 1985, Runtime: 97, Genres: []string{"comedy", "drama"}},
+		{Title: "Black Panther", Year: 2018, Runtime: 134, Genres: []string{"action", "adventure"}, Awards: data.Awards{{Name: "Academy Awards", Category: "Best Original Score", Year: 2019, Won: true}}},
+		{Title: "Deadpool", Year: 2016, Runtime: 108, Genres: []string{"action", "comedy"}},
+	} {
+		err := app.models.Movies.Insert(movie)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name       string
+		query      string
+		wantTitles []string
+	}{
+		{"all by id", "", []string{"The Breakfast Club", "Black Panther", "Deadpool"}},
+		{"genre", "?genres=action", []string{"Black Panther", "Deadpool"}},
+		{"title words", "?title=club+breakfast", []string{"The Breakfast Club"}},
+		{"sort descending", "?sort=-year", []string{"Black Panther", "Deadpool", "The Breakfast Club"}},
+		{"page size", "?sort=title&page_size=2&page=2", []string{"The Breakfast Club"}},
+		{"with awards", "?has_awards=true", []string{"Black Panther"}},
+		{"without awards", "?has_awards=false&genres=action", []string{"Deadpool"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, body := ts.do(t, http.MethodGet, "/v1/movies"+tt.query, token, nil)
+			if code != http.StatusOK {
+				t.Fatalf("got status %d; want %d (body %v)", code, http.StatusOK, body)
+			}
+
+			movies, _ := body["movies"].([]interface{})
+
+			var titles []string
+			for _, movie := range movies {
+				titles = append(titles, movie.(map[string]interface{})["title"].(string))
+			}
+
+			if fmt.Sprint(titles) != fmt.Sprint(tt.wantTitles) {
+				t.Errorf("got titles %q; want %q", titles, tt.wantTitles)
+			}
+		})
+	}
+}
+
+// A page of movies is cut short when it would be larger than -max-response-bytes, and
+// the metadata says so.
+func TestListMoviesTruncated(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t)
+
+	_, token := newTestUser(t, app, "reader", "reader")
+
+	var size int
+	for _, title := range []string{"Alien", "Brazil", "Cobra"} {
+		movie := &data.Movie{Title: title, Year: 1985, Runtime: 97, Genres: []string{"drama"}}
+
+		err := app.models.Movies.Insert(movie)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		js, err := json.Marshal(movie)
+		if err != nil {
+			t.Fatal(err)
+		}
+		size = len(js)
+	}
+
+	tests := []struct {
+		name          string
+		maxBytes      int
+		wantMovies    int
+		wantTruncated bool
+		wantDropped   int
+	}{
+		{"disabled", 0, 3, false, 0},
+		{"room for all", 4 * size, 3, false, 0},
+		{"room for two", 2*size + size/2, 2, true, 1},
+		{"too small for one", 1, 1, true, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app.config.maxResponseBytes = tt.maxBytes
+			before := totalOversizedResponses.Value()
+
+			code, body := ts.do(t, http.MethodGet, "/v1/movies", token, nil)
+			if code != http.StatusOK {
+				t.Fatalf("got status %d; want %d (body %v)", code, http.StatusOK, body)
+			}
+
+			movies, _ := body["movies"].([]interface{})
+			metadata, _ := body["metadata"].(map[string]interface{})
+			truncated, _ := metadata["truncated"].(bool)
+
+			if len(movies) != tt.wantMovies || truncated != tt.wantTruncated {
+				t.Errorf("got %d movies and truncated %t; want %d and %t", len(movies), truncated, tt.wantMovies, tt.wantTruncated)
+			}
+
+			// The current page and page size stay as asked for, so the metadata says how
+			// many movies were sent and how many were left off.
+			returned, _ := metadata["returned_records"].(float64)
+			dropped, _ := metadata["dropped_records"].(float64)
+
+			var wantReturned int
+			if tt.wantTruncated {
+				wantReturned = tt.wantMovies
+			}
+
+			if int(returned) != wantReturned || int(dropped) != tt.wantDropped || metadata["page_size"] != float64(20) {
+				t.Errorf("got metadata %v; want %d returned and %d dropped of a page of 20", metadata, wantReturned, tt.wantDropped)
+			}
+
+			var wantCounted int64
+			if tt.wantTruncated {
+				wantCounted = 1
+			}
+
+			if counted := totalOversizedResponses.Value() - before; counted != wantCounted {
+				t.Errorf("got %d oversized responses counted; want %d", counted, wantCounted)
+			}
+		})
+	}
+}
+
+// The next page after a truncated one starts a full page size on, and the movies which
+// were dropped can be fetched with a smaller page size, from the position the metadata
+// gives.
+func TestListMoviesTruncatedNextPage(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t)
+
+	_, token := newTestUser(t, app, "reader", "reader")
+
+	var size int
+	for _, title := range []string{"Alien", "Brazil", "Cobra", "Dune"} {
+		movie := &data.Movie{Title: title, Year: 1985, Runtime: 97, Genres: []string{"drama"}}
+
+		err := app.models.Movies.Insert(movie)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		js, err := json.Marshal(movie)
+		if err != nil {
+			t.Fatal(err)
+		}
+		size = len(js)
+	}
+
+	app.config.maxResponseBytes = size + size/2
+
+	titles := func(path string) ([]string, map[string]interface{}) {
+		t.Helper()
+
+		code, body := ts.do(t, http.MethodGet, path, token, nil)
+		if code != http.StatusOK {
+			t.Fatalf("got status %d for %s; want %d (body %v)", code, path, http.StatusOK, body)
+		}
+
+		var titles []string
+		for _, movie := range body["movies"].([]interface{}) {
+			titles = append(titles, movie.(map[string]interface{})["title"].(string))
+		}
+
+		metadata, _ := body["metadata"].(map[string]interface{})
+
+		return titles, metadata
+	}
+
+	got, metadata := titles("/v1/movies?sort=title&page_size=2&page=1")
+	if strings.Join(got, ",") != "Alien" || metadata["returned_records"] != float64(1) || metadata["dropped_records"] != float64(1) {
+		t.Fatalf("got %q and metadata %v; want Alien, with 1 returned and 1 dropped", got, metadata)
+	}
+
+	got, _ = titles("/v1/movies?sort=title&page_size=2&page=2")
+	if strings.Join(got, ",") != "Cobra" {
+		t.Errorf("got %q for the next page; want Cobra, after the dropped Brazil", got)
+	}
+
+	// The first dropped movie is record (1 - 1) * 2 + 1 + 1 = 2.
+	got, _ = titles("/v1/movies?sort=title&page_size=1&page=2")
+	if strings.Join(got, ",") != "Brazil" {
+		t.Errorf("got %q for the dropped record; want Brazil", got)
+	}
+}
+
+// A page size over -max-page-size is rejected.
+func TestListMoviesMaxPageSize(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t)
+
+	_, token := newTestUser(t, app, "reader", "reader")
+
+	err := data.SetMaxPageSize(5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { data.SetMaxPageSize(data.DefaultMaxPageSize) })
+
+	for query, wantCode := range map[string]int{"?page_size=5": http.StatusOK, "?page_size=6": http.StatusUnprocessableEntity} {
+		code, body := ts.do(t, http.MethodGet, "/v1/movies"+query, token, nil)
+		if code != wantCode {
+			t.Errorf("%s: got status %d; want %d (body %v)", query, code, wantCode, body)
+		}
+	}
+}
+
+// The facet counts follow the listing's filters over every page, and are only included
+// when they're asked for.
+func TestListMoviesFacets(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t)
+
+	_, token := newTestUser(t, app, "reader", "reader")
+
+	for _, movie := range []*data.Movie{
+		{Title: "The Breakfast Club", Year: 1985, Runtime: 97, Genres: []string{"comedy", "drama"}},
+		{Title: "Black Panther", Year: 2018, Runtime: 134, Genres: []string{"action", "adventure"}},
+		{Title: "Deadpool", Year: 2016, Runtime: 108, Genres: []string{"action", "comedy"}},
+	} {
+		err := app.models.Movies.Insert(movie)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The years span more than 30 years, so they're counted by decade, unless the
+	// filters narrow them down.
+	decades := "[map[count:1 from:1980 to:1989] map[count:0 from:1990 to:1999] map[count:0 from:2000 to:2009] map[count:2 from:2010 to:2019]]"
+
+	tests := []struct {
+		query     string
+		wantGenre string
+		wantYears string
+	}{
+		{"?facets=genres&page_size=1", "[map[count:2 value:action] map[count:2 value:comedy] map[count:1 value:adventure] map[count:1 value:drama]]", "<nil>"},
+		{"?facets=genres&title=deadpool", "[map[count:1 value:action] map[count:1 value:comedy]]", "<nil>"},
+		{"?facets=genres&genres=comedy", "[map[count:2 value:comedy] map[count:1 value:action] map[count:1 value:drama]]", "<nil>"},
+		{"?facets=genres&title=casablanca", "[]", "<nil>"},
+		{"?facets=years", "<nil>", decades},
+		{"?facets=years&genres=action", "<nil>", "[map[count:1 from:2016 to:2016] map[count:0 from:2017 to:2017] map[count:1 from:2018 to:2018]]"},
+		{"?facets=years&title=casablanca", "<nil>", "[]"},
+		{"?facets=genres,years&genres=drama", "[map[count:1 value:comedy] map[count:1 value:drama]]", "[map[count:1 from:1985 to:1985]]"},
+	}
+
+	for _, tt := range tests {
+		code, body := ts.do(t, http.MethodGet, "/v1/movies"+tt.query, token, nil)
+
+		metadata, _ := body["metadata"].(map[string]interface{})
+		facets, _ := metadata["facets"].(map[string]interface{})
+
+		if got := fmt.Sprint(facets["genres"]); code != http.StatusOK || got != tt.wantGenre {
+			t.Errorf("%q: got status %d and genre facets %s; want %s", tt.query, code, got, tt.wantGenre)
+		}
+
+		if got := fmt.Sprint(facets["years"]); code != http.StatusOK || got != tt.wantYears {
+			t.Errorf("%q: got status %d and year facets %s; want %s", tt.query, code, got, tt.wantYears)
+		}
+	}
+
+	code, body := ts.do(t, http.MethodGet, "/v1/movies", token, nil)
+	if metadata, _ := body["metadata"].(map[string]interface{}); code != http.StatusOK || metadata["facets"] != nil {
+		t.Errorf("got status %d and metadata %v; want no facets", code, body["metadata"])
+	}
+
+	code, body = ts.do(t, http.MethodGet, "/v1/movies?facets=genres,directors", token, nil)
+	if details, _ := body["details"].(map[string]interface{}); code != http.StatusUnprocessableEntity || fmt.Sprint(details["facets"]) != `[unknown facet "directors" (supported facets are: genres, years)]` {
+		t.Errorf("got status %d and body %v for an unknown facet; want %d listing the supported facets", code, body, http.StatusUnprocessableEntity)
+	}
+}
+
+// Movies record who added them and who last updated them, and can be listed by who
+// added them.
+func TestMovieCreatedBy(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t)
+
+	alice, aliceToken := newTestUser(t, app, "alice", "editor")
+	bob, bobToken := newTestUser(t, app, "bob", "editor")
+
+	// A movie added before the creator was recorded has no creator.
+	legacy := &data.Movie{Title: "Casablanca", Year: 1942, Runtime: 102, Genres: []string{"drama"}}
+
+	err := app.models.Movies.Insert(legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code, body := ts.do(t, http.MethodPost, "/v1/movies", aliceToken, map[string]interface{}{
+		"title": "Moana", "year": 2016, "runtime": "107 mins", "genres": []string{"animation"},
+	})
+	movie, _ := body["movie"].(map[string]interface{})
+	if code != http.StatusCreated || fmt.Sprint(movie["created_by"]) != fmt.Sprintf("map[id:%d name:alice]", alice.ID) || movie["updated_by"] != nil {
+		t.Fatalf("got status %d and movie %v; want it created by alice", code, movie)
+	}
+
+	id, _ := movie["id"].(float64)
+
+	code, body = ts.do(t, http.MethodPatch, fmt.Sprintf("/v1/movies/%d", int64(id)), bobToken, map[string]interface{}{"runtime": 108})
+	movie, _ = body["movie"].(map[string]interface{})
+	if code != http.StatusOK || fmt.Sprint(movie["created_by"]) != fmt.Sprintf("map[id:%d name:alice]", alice.ID) || fmt.Sprint(movie["updated_by"]) != fmt.Sprintf("map[id:%d name:bob]", bob.ID) {
+		t.Errorf("got status %d and movie %v; want it still created by alice, and updated by bob", code, movie)
+	}
+
+	code, body = ts.do(t, http.MethodGet, fmt.Sprintf("/v1/movies/%d", legacy.ID), bobToken, nil)
+	movie, _ = body["movie"].(map[string]interface{})
+	if created, ok := movie["created_by"]; code != http.StatusOK || !ok || created != nil {
+		t.Errorf("got status %d and movie %v; want a null created_by", code, movie)
+	}
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"", []string{"Casablanca", "Moana"}},
+		{fmt.Sprintf("?created_by=%d", alice.ID), []string{"Moana"}},
+		{fmt.Sprintf("?created_by=%d", bob.ID), []string{}},
+	}
+
+	for _, tt := range tests {
+		code, body := ts.do(t, http.MethodGet, "/v1/movies"+tt.query, bobToken, nil)
+
+		movies, _ := body["movies"].([]interface{})
+		titles := []string{}
+		for _, movie := range movies {
+			titles = append(titles, movie.(map[string]interface{})["title"].(string))
+		}
+
+		if code != http.StatusOK || fmt.Sprint(titles) != fmt.Sprint(tt.want) {
+			t.Errorf("%q: got status %d and titles %v; want %v", tt.query, code, titles, tt.want)
+		}
+	}
+
+	code, _ = ts.do(t, http.MethodGet, "/v1/movies?created_by=-1", bobToken, nil)
+	if code != http.StatusUnprocessableEntity {
+		t.Errorf("got status %d for a negative created_by; want %d", code, http.StatusUnprocessableEntity)
+	}
+
+	// Once the creator's account is deleted, the movie has no creator.
+	err = app.models.Users.Delete(alice.ID, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code, body = ts.do(t, http.MethodGet, fmt.Sprintf("/v1/movies/%d", int64(id)), bobToken, nil)
+	movie, _ = body["movie"].(map[string]interface{})
+	if code != http.StatusOK || movie["created_by"] != nil || movie["updated_by"] == nil {
+		t.Errorf("got status %d and movie %v; want no creator, but still the updater", code, movie)
+	}
+}
+
+// A movie's awards and external ratings are sent back as they were given, and invalid
+// ones are reported against their index.
+func TestMovieAwardsAndRatings(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t)
+
+	_, token := newTestUser(t, app, "editor", "editor")
+
+	movie := map[string]interface{}{
+		"title":   "Moana",
+		"year":    2016,
+		"runtime": 107,
+		"genres":  []string{"animation"},
+		"awards": []map[string]interface{}{
+			{"name": "Academy Awards", "category": "Best Animated Feature", "year": 2017, "won": false},
+		},
+		"external_ratings": []map[string]interface{}{
+			{"source": "IMDb", "score": 7.6, "scale": 10},
+			{"source": "Rotten Tomatoes", "score": 95, "scale": 100},
+		},
+	}
+
+	code, body := ts.do(t, http.MethodPost, "/v1/movies", token, movie)
+	if code != http.StatusCreated {
+		t.Fatalf("got status %d; want %d (body %v)", code, http.StatusCreated, body)
+	}
+
+	created := body["movie"].(map[string]interface{})
+
+	if got := fmt.Sprint(created["awards"], created["external_ratings"]); got != fmt.Sprint(movie["awards"], movie["external_ratings"]) {
+		t.Errorf("got %s; want the awards and ratings that were sent", got)
+	}
+
+	// Sending empty arrays removes them, and they're then left out of the response.
+	moviePath := fmt.Sprintf("/v1/movies/%v", created["id"])
+
+	code, body = ts.do(t, http.MethodPatch, moviePath, token, map[string]interface{}{"awards": []string{}, "external_ratings": []string{}})
+	if code != http.StatusOK {
+		t.Fatalf("got status %d; want %d (body %v)", code, http.StatusOK, body)
+	}
+
+	updated := body["movie"].(map[string]interface{})
+	if _, ok := updated["awards"]; ok {
+		t.Errorf("got awards %v after removing them", updated["awards"])
+	}
+
+	code, body = ts.do(t, http.MethodPatch, moviePath, token, map[string]interface{}{
+		"awards":           []map[string]interface{}{{"name": "Academy Awards", "year": 1990}},
+		"external_ratings": []map[string]interface{}{{"source": "IMDb", "score": 12, "scale": 10}},
+	})
+	if code != http.StatusUnprocessableEntity {
+		t.Fatalf("got status %d; want %d (body %v)", code, http.StatusUnprocessableEntity, body)
+	}
+
+	details, _ := body["details"].(map[string]interface{})
+	if len(details) != 2 || details["awards[0].year"] == nil || details["external_ratings[0].score"] == nil {
+		t.Errorf("got details %v; want errors for awards[0].year and external_ratings[0].score", details)
+	}
+
+	code, body = ts.do(t, http.MethodGet, "/v1/movies?has_awards=maybe", token, nil)
+	if details, _ := body["details"].(map[string]interface{}); code != http.StatusUnprocessableEntity || details["has_awards"] == nil {
+		t.Errorf("got status %d and body %v for has_awards=maybe; want a validation error", code, body)
+	}
+}
+
+// Malformed bodies get a 400 response whose message says where the problem is.
+func TestCreateMovieMalformedBody(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t)
+
+	_, token := newTestUser(t, app, "editor", "editor")
+
+	tests := []struct {
+		name      string
+		body      string
+		wantError string
+	}{
+		{"quoted year", `{"title": "Moana", "year": "2016"}`, `body contains incorrect JSON type for field "year"`},
+		{"number for genre", `{"title": "Moana", "genres": ["animation", 7]}`, `body contains incorrect JSON type for field "genres[1]"`},
+		{"object for genres", `{"title": "Moana", "genres": {"0": "animation"}}`, `body contains incorrect JSON type for field "genres"`},
+		{"missing colon", "{\n\t\"title\" \"Moana\"\n}", `body contains badly-formed JSON (at line 2, column 10)`},
+		{"missing quote", `{"title": Moana}`, `body contains badly-formed JSON (at line 1, column 11)`},
+		{"truncated", `{"title": "Moana", "genres": [`, `body contains badly-formed JSON (unexpected end at line 1, column 31)`},
+		{"unknown key", `{"title": "Moana", "director": "Musker"}`, `body contains unknown key "director" (allowed keys are: title, year, runtime, genres, awards, external_ratings, plot, poster)`},
+		{"duplicate key", `{"title": "Moana", "year": 2016, "year": 2017}`, `body contains duplicate key "year"`},
+		{"two values", `{"title": "Moana"}[]`, "body must only contain a single JSON value"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, body := ts.do(t, http.MethodPost, "/v1/movies", token, []byte(tt.body))
+
+			if code != http.StatusBadRequest {
+				t.Errorf("got status %d; want %d (body %v)", code, http.StatusBadRequest, body)
+			}
+
+			if body["error"] != tt.wantError {
+				t.Errorf("got error %q; want %q", body["error"], tt.wantError)
+			}
+		})
+	}
+}
+
+// Validation errors are reported per field, with the index of an invalid genre.
+func TestCreateMovieValidationErrors(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t)
+
+	_, token := newTestUser(t, app, "editor", "editor")
+
+	code, body := ts.do(t, http.MethodPost, "/v1/movies", token, map[string]interface{}{
+		"title":   "Moana",
+		"year":    2016,
+		"runtime": 107,
+		"genres":  []string{"animation", " "},
+	})
+	if code != http.StatusUnprocessableEntity {
+		t.Fatalf("got status %d; want %d (body %v)", code, http.StatusUnprocessableEntity, body)
+	}
+
+	details, _ := body["details"].(map[string]interface{})
+	messages, _ := details["genres[1]"].([]interface{})
+
+	if len(details) != 1 || len(messages) != 1 || messages[0] != "must not be empty" {
+		t.Errorf("got details %v; want genres[1] must not be empty", details)
+	}
+}
+
+// A dry run reports the same errors as creating the movie would, and never creates it.
+func TestValidateMovie(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t)
+
+	_, readerToken := newTestUser(t, app, "reader", "reader")
+	_, editorToken := newTestUser(t, app, "editor", "editor")
+
+	valid := map[string]interface{}{"title": "Moana", "year": 2016, "runtime": "107 mins", "genres": []string{"animation"}}
+
+	tests := []struct {
+		name     string
+		token    string
+		body     interface{}
+		wantCode int
+		wantKey  string
+	}{
+		{"valid", editorToken, valid, http.StatusOK, "valid"},
+		{"invalid", editorToken, map[string]interface{}{"title": "Moana", "year": 2016, "runtime": 107, "genres": []string{"animation", " "}}, http.StatusUnprocessableEntity, "details"},
+		{"malformed", editorToken, []byte(`{"title": "Moana", "director": "Musker"}`), http.StatusBadRequest, "error"},
+		{"reader", readerToken, valid, http.StatusForbidden, "error"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, body := ts.do(t, http.MethodPost, "/v1/movies/validate", tt.token, tt.body)
+
+			if code != tt.wantCode {
+				t.Errorf("got status %d; want %d (body %v)", code, tt.wantCode, body)
+			}
+
+			if _, ok := body[tt.wantKey]; !ok {
+				t.Errorf("response body %v has no %q key", body, tt.wantKey)
+			}
+		})
+	}
+
+	code, body := ts.do(t, http.MethodGet, "/v1/movies", readerToken, nil)
+	if movies, _ := body["movies"].([]interface{}); code != http.StatusOK || len(movies) != 0 {
+		t.Errorf("got status %d and movies %v; want no movies created", code, body["movies"])
+	}
+}
+
+// Validation messages are sent in the language of the request's Accept-Language
+// header, if it's one we have translations for, and in English otherwise.
+func TestValidationErrorLanguage(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t)
+
+	_, token := newTestUser(t, app, "editor", "editor")
+
+	tests := []struct {
+		acceptLanguage string
+		want           string
+		wantLanguage   string
+	}{
+		{"", "must be provided", "en"},
+		{"el-GR,el;q=0.9,en;q=0.8", "πρέπει να δοθεί", "el"},
+		{"fr-FR", "must be provided", "en"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.acceptLanguage, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodPost, ts.URL+"/v1/movies", strings.NewReader(`{"year": 2016, "runtime": 107, "genres": ["animation"]}`))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req.Header.Set("Authorization", "Bearer "+token)
+			if tt.acceptLanguage != "" {
+				req.Header.Set("Accept-Language", tt.acceptLanguage)
+			}
+
+			res, err := ts.Client().Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer res.Body.Close()
+
+			var body struct {
+				Details map[string][]string `json:"details"`
+			}
+
+			err = json.NewDecoder(res.Body).Decode(&body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if res.StatusCode != http.StatusUnprocessableEntity {
+				t.Fatalf("got status %d; want %d", res.StatusCode, http.StatusUnprocessableEntity)
+			}
+
+			if got := body.Details["title"]; len(got) != 1 || got[0] != tt.want {
+				t.Errorf("got title errors %q; want %q", got, tt.want)
+			}
+
+			if got := res.Header.Get("Content-Language"); got != tt.wantLanguage {
+				t.Errorf("got Content-Language %q; want %q", got, tt.wantLanguage)
+			}
+
+			if vary := res.Header.Values("Vary"); !containsFold(vary, "Accept-Language") {
+				t.Errorf("got Vary headers %q; want Accept-Language among them", vary)
+			}
+		})
+	}
+}
+
+func TestMovieRuntimeFormat(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t)
+
+	_, token := newTestUser(t, app, "editor", "editor")
+
+	movie := &data.Movie{Title: "Casablanca", Year: 1942, Runtime: 102, Genres: []string{"drama", "romance"}}
+	err := app.models.Movies.Insert(movie)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	moviePath := fmt.Sprintf("/v1/movies/%d", movie.ID)
+
+	// The runtime of the movie in a response, or of the first movie in a listing.
+	runtimeOf := func(body map[string]interface{}) interface{} {
+		if movies, ok := body["movies"].([]interface{}); ok && len(movies) > 0 {
+			return movies[0].(map[string]interface{})["runtime"]
+		}
+		if movie, ok := body["movie"].(map[string]interface{}); ok {
+			return movie["runtime"]
+		}
+		return nil
+	}
+
+	tests := []struct {
+		name        string
+		defaultFmt  string
+		method      string
+		path        string
+		body        interface{}
+		wantCode    int
+		wantRuntime interface{}
+	}{
+		{"show", "string", http.MethodGet, moviePath, nil, http.StatusOK, "102 mins"},
+		{"show minutes", "string", http.MethodGet, moviePath + "?runtime_format=minutes", nil, http.StatusOK, 102.0},
+		{"show string", "string", http.MethodGet, moviePath + "?runtime_format=string", nil, http.StatusOK, "102 mins"},
+		{"show invalid", "string", http.MethodGet, moviePath + "?runtime_format=hours", nil, http.StatusUnprocessableEntity, nil},
+		{"show minutes by default", "minutes", http.MethodGet, moviePath, nil, http.StatusOK, 102.0},
+		{"show string overriding default", "minutes", http.MethodGet, moviePath + "?runtime_format=string", nil, http.StatusOK, "102 mins"},
+		{"list minutes", "string", http.MethodGet, "/v1/movies?runtime_format=minutes", nil, http.StatusOK, 102.0},
+		{"list invalid", "string", http.MethodGet, "/v1/movies?runtime_format=seconds", nil, http.StatusUnprocessableEntity, nil},
+		{"update minutes", "string", http.MethodPatch, moviePath + "?runtime_format=minutes", map[string]interface{}{"runtime": 103}, http.StatusOK, 103.0},
+		{"update quoted integer", "string", http.MethodPatch, moviePath, map[string]interface{}{"runtime": "104"}, http.StatusOK, "104 mins"},
+		{"update negative", "string", http.MethodPatch, moviePath, map[string]interface{}{"runtime": -5}, http.StatusBadRequest, nil},
+		{"update fraction", "string", http.MethodPatch, moviePath, map[string]interface{}{"runtime": 104.5}, http.StatusBadRequest, nil},
+		{"create minutes", "string", http.MethodPost, "/v1/movies?runtime_format=minutes", map[string]interface{}{
+			"title": "Moana", "year": 2016, "runtime": 107, "genres": []string{"animation"},
+		}, http.StatusCreated, 107.0},
+		{"create invalid format", "string", http.MethodPost, "/v1/movies?runtime_format=hours", map[string]interface{}{
+			"title": "Up", "year": 2009, "runtime": "96 mins", "genres": []string{"animation"},
+		}, http.StatusUnprocessableEntity, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app.config.runtimeFormat = tt.defaultFmt
+
+			code, body := ts.do(t, tt.method, tt.path, token, tt.body)
+			if code != tt.wantCode {
+				t.Fatalf("got status %d; want %d (body %v)", code, tt.wantCode, body)
+			}
+
+			if tt.wantRuntime != nil && runtimeOf(body) != tt.wantRuntime {
+				t.Errorf("got runtime %#v; want %#v", runtimeOf(body), tt.wantRuntime)
+			}
+		})
+	}
+
+	// The movie with an invalid runtime format wasn't created.
+	_, metadata, err := app.models.Movies.GetAll(data.MovieFilters{Title: "Up"}, data.Filters{Page: 1, PageSize: 20, Sort: "id", SortSafelist: data.MovieSortSafelist})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if metadata.TotalRecords != 0 {
+		t.Errorf("got %d movies titled Up; want none", metadata.TotalRecords)
+	}
+}
+
+func TestMovieLastModified(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t)
+
+	_, token := newTestUser(t, app, "reader", "reader")
+
+	movie := &data.Movie{Title: "Casablanca", Year: 1942, Runtime: 102, Genres: []string{"drama", "romance"}}
+	err := app.models.Movies.Insert(movie)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	moviePath := fmt.Sprintf("/v1/movies/%d", movie.ID)
+
+	get := func(t *testing.T, path, ifModifiedSince string) *http.Response {
+		t.Helper()
+
+		req, err := http.NewRequest(http.MethodGet, ts.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req.Header.Set("Authorization", "Bearer "+token)
+		if ifModifiedSince != "" {
+			req.Header.Set("If-Modified-Since", ifModifiedSince)
+		}
+
+		res, err := ts.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+
+		return res
+	}
+
+	res := get(t, moviePath, "")
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d; want %d", res.StatusCode, http.StatusOK)
+	}
+
+	lastModified := res.Header.Get("Last-Modified")
+	if want := movie.UpdatedAt.UTC().Format(http.TimeFormat); lastModified != want {
+		t.Fatalf("got Last-Modified %q; want %q", lastModified, want)
+	}
+
+	since, _ := http.ParseTime(lastModified)
+
+	tests := []struct {
+		name            string
+		ifModifiedSince string
+		wantCode        int
+	}{
+		// The stored timestamp has a fractional second, which mustn't stop the client's
+		// copy from being current.
+		{"same second", lastModified, http.StatusNotModified},
+		{"later", since.Add(time.Hour).Format(http.TimeFormat), http.StatusNotModified},
+		{"earlier", since.Add(-time.Second).Format(http.TimeFormat), http.StatusOK},
+		{"invalid", "yesterday", http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := get(t, moviePath, tt.ifModifiedSince)
+			if res.StatusCode != tt.wantCode {
+				t.Errorf("got status %d; want %d", res.StatusCode, tt.wantCode)
+			}
+
+			if got := res.Header.Get("Last-Modified"); got != lastModified {
+				t.Errorf("got Last-Modified %q; want %q", got, lastModified)
+			}
+		})
+	}
+
+	// Update the movie within the same second as it was created. The client's copy is
+	// then out of date, even though an HTTP date can't tell the two times apart, so the
+	// update has to move updated_at on to the next second.
+	t.Run("updated in the same second", func(t *testing.T) {
+		err := app.models.Movies.Update(movie)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		res := get(t, moviePath, lastModified)
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("got status %d; want %d", res.StatusCode, http.StatusOK)
+		}
+
+		updated := res.Header.Get("Last-Modified")
+		if updated == lastModified {
+			t.Fatalf("got the same Last-Modified %q after the update", updated)
+		}
+
+		res = get(t, moviePath, updated)
+		if res.StatusCode != http.StatusNotModified {
+			t.Errorf("got status %d; want %d", res.StatusCode, http.StatusNotModified)
+		}
+	})
+
+	t.Run("list", func(t *testing.T) {
+		other := &data.Movie{Title: "Moana", Year: 2016, Runtime: 107, Genres: []string{"animation"}}
+		err := app.models.Movies.Insert(other)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		stored, err := app.models.Movies.Get(movie.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		latest := stored.UpdatedAt
+		if other.UpdatedAt.After(latest) {
+			latest = other.UpdatedAt
+		}
+
+		res := get(t, "/v1/movies", "")
+		if want := latest.UTC().Format(http.TimeFormat); res.Header.Get("Last-Modified") != want {
+			t.Errorf("got Last-Modified %q; want %q", res.Header.Get("Last-Modified"), want)
+		}
+
+		res = get(t, "/v1/movies?title=nothing", "")
+		if got := res.Header.Get("Last-Modified"); got != "" {
+			t.Errorf("got Last-Modified %q for an empty page; want none", got)
+		}
+	})
+}
+
+// Define a blockingMovieStore type which wraps a MovieStore, counting the calls to
+// Get() and holding them until release is closed.
+type blockingMovieStore struct {
+	data.MovieStore
+	calls   int64
+	release chan struct{}
+}
+
+func (s *blockingMovieStore) Get(id int64) (*data.Movie, error) {
+	atomic.AddInt64(&s.calls, 1)
+	<-s.release
+
+	return s.MovieStore.Get(id)
+}
+
+// Concurrent requests for the same movie share one query. The store is held until
+// every request but the first is waiting on it, so that they all arrive together.
+func TestShowMovieCoalescing(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t)
+
+	_, token := newTestUser(t, app, "alice", "reader")
+	movieID := seedMovies(t, app, 1)[0]
+
+	store := &blockingMovieStore{MovieStore: app.models.Movies, release: make(chan struct{})}
+	coalescer := data.NewMovieCoalescer(store)
+	app.models.Movies = coalescer
+
+	const requests = 50
+
+	var (
+		wg sync.WaitGroup
+		ok int64
+	)
+
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			code, body := ts.do(t, http.MethodGet, fmt.Sprintf("/v1/movies/%d", movieID), token, nil)
+			if movie, _ := body["movie"].(map[string]interface{}); code == http.StatusOK && movie["id"] == float64(movieID) {
+				atomic.AddInt64(&ok, 1)
+			}
+		}()
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for coalescer.Stats().Coalesced < requests-1 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	close(store.release)
+	wg.Wait()
+
+	if ok != requests {
+		t.Errorf("got %d requests which returned the movie; want %d", ok, requests)
+	}
+
+	if calls := atomic.LoadInt64(&store.calls); calls != 1 {
+		t.Errorf("got %d queries; want 1", calls)
+	}
+
+	if stats := coalescer.Stats(); stats.Fetches != 1 || stats.Coalesced != requests-1 {
+		t.Errorf("got stats %+v; want 1 fetch and %d coalesced", stats, requests-1)
+	}
+}
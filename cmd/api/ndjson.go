@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/petrostrak/an-open-movie-database/internal/data"
+	"github.com/petrostrak/an-open-movie-database/internal/validator"
+)
+
+// The media type of newline-delimited JSON, which GET /v1/movies and GET
+// /v1/admin/export send a record per line of when it's asked for, and the number of
+// lines written between flushes of the stream.
+const (
+	ndjsonMediaType  = "application/x-ndjson"
+	ndjsonFlushLines = 100
+)
+
+// The response formats which can be asked for with ?format=.
+const (
+	responseFormatJSON   = "json"
+	responseFormatNDJSON = "ndjson"
+)
+
+// The readNDJSON() helper reports whether the response should be NDJSON: the format
+// query string parameter is "ndjson", or the Accept header prefers application/x-ndjson
+// to the media types writeResponse() supports. It's offered last, so it has to be asked
+// for by name; a client which accepts anything still gets the JSON envelope. If the
+// format isn't one of the response formats, an error is recorded in the Validator.
+func (app *application) readNDJSON(r *http.Request, qs url.Values, v *validator.Validator) bool {
+	format := app.readString(qs, "format", "")
+
+	v.Check(validator.In(format, "", responseFormatJSON, responseFormatNDJSON), "format", validator.Msg("response_format"))
+
+	if format != "" {
+		return format == responseFormatNDJSON
+	}
+
+	mediaType, _ := negotiateMediaType(r.Header.Get("Accept"), append(supportedMediaTypes[:len(supportedMediaTypes):len(supportedMediaTypes)], ndjsonMediaType))
+
+	return mediaType == ndjsonMediaType
+}
+
+// Define an ndjsonWriter type which writes records as NDJSON, one JSON object per line.
+// The flush function sends what's been written so far to the client, and is called
+// every ndjsonFlushLines lines.
+type ndjsonWriter struct {
+	enc   *json.Encoder
+	flush func()
+	lines int
+}
+
+// The newNDJSONWriter() function returns an ndjsonWriter which writes to w, and flushes
+// with flush.
+func newNDJSONWriter(w io.Writer, flush func()) *ndjsonWriter {
+	return &ndjsonWriter{enc: json.NewEncoder(w), flush: flush}
+}
+
+// The write() method writes a record as a line of its own.
+func (nw *ndjsonWriter) write(record interface{}) error {
+	err := nw.enc.Encode(record)
+	if err != nil {
+		return err
+	}
+
+	nw.lines++
+	if nw.lines%ndjsonFlushLines == 0 {
+		nw.flush()
+	}
+
+	return nil
+}
+
+// The ndjsonError() helper is for an error which happens once an NDJSON response has
+// been started, when the status can't be changed any more. It logs and reports the
+// error, as serverErrorResponse() would, and writes it as a final line such as
+// {"error": "...", "code": "server_error", "details": {"request_id": "..."}}, so that
+// the client can tell a stream which was cut short from a complete one.
+func (app *application) ndjsonError(r *http.Request, nw *ndjsonWriter, err error) {
+	app.logError(r, err)
+	app.reportError(r, err, nil)
+
+	nw.write(envelope{
+		"error":   "the server encountered a problem and could not process your request",
+		"code":    errCodeServerError,
+		"details": envelope{"request_id": app.contextGetRequestID(r)},
+	})
+	nw.flush()
+}
+
+// The writeMoviesNDJSON() helper sends a page of movies as NDJSON, each formatted as
+// formatMovie() would for the request, with the given headers.
+func (app *application) writeMoviesNDJSON(w http.ResponseWriter, r *http.Request, movies []*data.Movie, headers http.Header, runtimeFormat string) {
+	for key, values := range headers {
+		w.Header()[key] = values
+	}
+
+	w.Header().Set("Content-Type", ndjsonMediaType)
+	w.Header().Add("Vary", "Accept")
+	w.WriteHeader(http.StatusOK)
+
+	nw := newNDJSONWriter(w, flusher(w))
+	version := app.contextGetAPIVersion(r)
+
+	for _, movie := range movies {
+		err := nw.write(formatMovie(movie, version, runtimeFormat))
+		if err != nil {
+			app.ndjsonError(r, nw, err)
+			return
+		}
+	}
+
+	nw.flush()
+}
+
+// The flusher() function returns a function which flushes w, or does nothing if w
+// can't be flushed, as when the requestTimeout() middleware buffers the response.
+func flusher(w http.ResponseWriter) func() {
+	if f, ok := w.(http.Flusher); ok {
+		return f.Flush
+	}
+
+	return func() {}
+}
+
+// The paginationHeaders() function returns the metadata of a page as the X-Current-Page,
+// X-Page-Size, X-Last-Page and X-Total-Records headers, for an NDJSON response, whose
+// body has nowhere to put it.
+func paginationHeaders(metadata data.Metadata) http.Header {
+	headers := make(http.Header)
+
+	headers.Set("X-Current-Page", strconv.Itoa(metadata.CurrentPage))
+	headers.Set("X-Page-Size", strconv.Itoa(metadata.PageSize))
+	headers.Set("X-Last-Page", strconv.Itoa(metadata.LastPage))
+	headers.Set("X-Total-Records", strconv.Itoa(metadata.TotalRecords))
+
+	if metadata.Truncated {
+		headers.Set("X-Truncated", "true")
+		headers.Set("X-Returned-Records", strconv.Itoa(metadata.ReturnedRecords))
+		headers.Set("X-Dropped-Records", strconv.Itoa(metadata.DroppedRecords))
+	}
+
+	return headers
+}
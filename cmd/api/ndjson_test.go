@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/petrostrak/an-open-movie-database/internal/data"
+)
+
+// The getNDJSON() helper sends a GET request with the given Accept header and bearer
+// token, and returns the response along with each line of an NDJSON body decoded as a
+// JSON object, or any other body decoded as a single one. A gzipped body is
+// decompressed first.
+func (ts *testServer) getNDJSON(t *testing.T, path, accept, token string) (*http.Response, []map[string]interface{}) {
+	t.Helper()
+
+	req, err := http.NewRequest(http.MethodGet, ts.URL+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Accept-Encoding", "gzip")
+
+	res, err := ts.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	var body io.Reader = res.Body
+	if res.Header.Get("Content-Encoding") == "gzip" {
+		body, err = gzip.NewReader(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var lines []map[string]interface{}
+
+	if res.Header.Get("Content-Type") != ndjsonMediaType {
+		var js map[string]interface{}
+
+		err = json.NewDecoder(body).Decode(&js)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return res, append(lines, js)
+	}
+
+	scanner := bufio.NewScanner(body)
+	for scanner.Scan() {
+		var line map[string]interface{}
+
+		err := json.Unmarshal(scanner.Bytes(), &line)
+		if err != nil {
+			t.Fatalf("got line %q, which isn't a JSON object: %v", scanner.Text(), err)
+		}
+
+		lines = append(lines, line)
+	}
+
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	return res, lines
+}
+
+// The listing is sent a movie per line when NDJSON is asked for, with its metadata in
+// the headers, and as the usual envelope otherwise.
+func TestListMoviesNDJSON(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t)
+
+	_, token := newTestUser(t, app, "reader", "reader")
+	seedMovies(t, app, 5)
+
+	tests := []struct {
+		name       string
+		path       string
+		accept     string
+		wantNDJSON bool
+	}{
+		{"accept", "/v1/movies?page=2&page_size=2", ndjsonMediaType, true},
+		{"accept preferred", "/v1/movies?page=2&page_size=2", "application/json;q=0.5, application/x-ndjson", true},
+		{"format", "/v1/movies?page=2&page_size=2&format=ndjson", "", true},
+		{"format json", "/v1/movies?page=2&page_size=2&format=json", "", false},
+		{"any", "/v1/movies?page=2&page_size=2", "*/*", false},
+		{"json", "/v1/movies?page=2&page_size=2", "application/json", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, lines := ts.getNDJSON(t, tt.path, tt.accept, token)
+			if res.StatusCode != http.StatusOK {
+				t.Fatalf("got status %d; want %d", res.StatusCode, http.StatusOK)
+			}
+
+			if !tt.wantNDJSON {
+				if len(lines) != 1 || lines[0]["movies"] == nil || lines[0]["metadata"] == nil {
+					t.Errorf("got %d lines (%v); want the envelope", len(lines), lines)
+				}
+				return
+			}
+
+			if ct := res.Header.Get("Content-Type"); ct != ndjsonMediaType {
+				t.Errorf("got Content-Type %q; want %q", ct, ndjsonMediaType)
+			}
+
+			if len(lines) != 2 || lines[0]["title"] != "Movie 3" || lines[1]["title"] != "Movie 4" {
+				t.Errorf("got lines %v; want movies 3 and 4", lines)
+			}
+
+			for header, want := range map[string]string{"X-Current-Page": "2", "X-Page-Size": "2", "X-Last-Page": "3", "X-Total-Records": "5"} {
+				if got := res.Header.Get(header); got != want {
+					t.Errorf("got %s %q; want %q", header, got, want)
+				}
+			}
+		})
+	}
+
+	// A page cut short says so, and how many movies were dropped, in the headers.
+	app.config.maxResponseBytes = 1
+
+	res, lines := ts.getNDJSON(t, "/v1/movies?page=2&page_size=2", ndjsonMediaType, token)
+	if len(lines) != 1 || lines[0]["title"] != "Movie 3" {
+		t.Errorf("got lines %v for a truncated page; want movie 3", lines)
+	}
+
+	for header, want := range map[string]string{"X-Page-Size": "2", "X-Truncated": "true", "X-Returned-Records": "1", "X-Dropped-Records": "1"} {
+		if got := res.Header.Get(header); got != want {
+			t.Errorf("got %s %q for a truncated page; want %q", header, got, want)
+		}
+	}
+
+	app.config.maxResponseBytes = 0
+
+	code, _ := ts.do(t, http.MethodGet, "/v1/movies?format=csv", token, nil)
+	if code != http.StatusUnprocessableEntity {
+		t.Errorf("got status %d for format=csv; want %d", code, http.StatusUnprocessableEntity)
+	}
+}
+
+// Define a failingBatchStore type which wraps a MovieStore, failing GetBatch() for any
+// batch after the first.
+type failingBatchStore struct {
+	data.MovieStore
+}
+
+func (s failingBatchStore) GetBatch(afterID int64, limit int) ([]*data.Movie, error) {
+	if afterID > 0 {
+		return nil, errors.New("connection reset")
+	}
+
+	return s.MovieStore.GetBatch(afterID, limit)
+}
+
+// The export is sent a movie per line when NDJSON is asked for, with the count in a
+// trailer, and an error part way through ends it with an error line.
+func TestDatabaseExportNDJSON(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t)
+
+	_, adminToken := newTestUser(t, app, "admin", "admin")
+
+	// More than a batch, so that the movies are read, and flushed, in batches.
+	seedMovies(t, app, dumpBatchSize+2)
+
+	res, lines := ts.getNDJSON(t, "/v1/admin/export?format=ndjson", "", adminToken)
+	if res.StatusCode != http.StatusOK || res.Header.Get("Content-Type") != ndjsonMediaType {
+		t.Fatalf("got status %d and Content-Type %q; want %d and %q", res.StatusCode, res.Header.Get("Content-Type"), http.StatusOK, ndjsonMediaType)
+	}
+
+	if len(lines) != dumpBatchSize+2 || lines[0]["title"] != "Movie 1" || lines[len(lines)-1]["title"] != "Movie 502" {
+		t.Errorf("got %d lines; want %d, from Movie 1 to Movie 502", len(lines), dumpBatchSize+2)
+	}
+
+	if got := res.Trailer.Get("X-Total-Records"); got != "502" {
+		t.Errorf("got X-Total-Records trailer %q; want 502", got)
+	}
+
+	app.models.Movies = failingBatchStore{app.models.Movies}
+
+	res, lines = ts.getNDJSON(t, "/v1/admin/export", ndjsonMediaType, adminToken)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d; want %d once the stream has started", res.StatusCode, http.StatusOK)
+	}
+
+	if len(lines) != dumpBatchSize+1 || lines[len(lines)-1]["error"] == nil || lines[len(lines)-1]["code"] != errCodeServerError {
+		t.Errorf("got %d lines ending with %v; want the first batch and then an error", len(lines), lines[len(lines)-1])
+	}
+
+	if got := res.Trailer.Get("X-Total-Records"); got != "" {
+		t.Errorf("got X-Total-Records trailer %q for a failed export; want none", got)
+	}
+}
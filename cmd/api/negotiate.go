@@ -0,0 +1,355 @@
+package main
+
+import (
+	"encoding/xml"
+	"mime"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The media types which writeResponse() can encode a response as, in order of
+// preference. JSON comes first, so it's used when the client doesn't mind which it gets.
+// The vendor media types in versionMediaTypes are JSON too, and come last, so that they
+// are only used when they're asked for by name.
+var supportedMediaTypes = []string{"application/json", "application/xml", "application/vnd.omdb.v1+json", "application/vnd.omdb.v2+json"}
+
+// Define a writeResponse() helper, which sends the response in whichever of the
+// supported media types the request's Accept header prefers. A request without an
+// Accept header gets JSON.
+//
+// If the client won't accept any of them, a successful response is replaced with a 406
+// Not Acceptable response. An error response is sent as JSON instead, so that the
+// client still learns what the error was.
+//
+// Every response, error responses included, also gets a "meta" object from withMeta(),
+// unless that's turned off with -response-meta=false.
+func (app *application) writeResponse(w http.ResponseWriter, r *http.Request, status int, data envelope, headers http.Header) error {
+	if app.config.responseMeta {
+		data = app.withMeta(r, data)
+	}
+
+	mediaType, ok := negotiateMediaType(r.Header.Get("Accept"), supportedMediaTypes)
+	if !ok {
+		if status < http.StatusBadRequest {
+			app.notAcceptableResponse(w, r)
+			return nil
+		}
+
+		mediaType = "application/json"
+	}
+
+	// The response depends on the Accept header, so caches mustn't send it in reply to
+	// requests with a different one.
+	w.Header().Add("Vary", "Accept")
+
+	if mediaType == "application/xml" {
+		return app.writeXML(w, status, data, headers)
+	}
+
+	// A response in one of the vendor media types is labelled with it, so that the
+	// client can tell which version it was given.
+	if _, ok := versionMediaTypes[mediaType]; ok {
+		headers = headers.Clone()
+		if headers == nil {
+			headers = make(http.Header)
+		}
+		headers.Set("Content-Type", mediaType)
+	}
+
+	return app.writeJSON(w, status, data, headers)
+}
+
+// The writeXML() helper is the XML equivalent of writeJSON(). The envelope is encoded
+// as a <response> element, with a child element for each of its keys.
+func (app *application) writeXML(w http.ResponseWriter, status int, data envelope, headers http.Header) error {
+	x, err := xml.MarshalIndent(data, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	x = append([]byte(xml.Header), x...)
+	x = append(x, '\n')
+
+	for key, value := range headers {
+		w.Header()[key] = value
+	}
+
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	w.Write(x)
+
+	return nil
+}
+
+// The negotiateMediaType() function returns the offered media type which the Accept
+// header gives the highest quality value, with ties going to the earlier offer. Each
+// offer takes its quality from the most specific media range which matches it, so
+// "application/xml;q=0" rules XML out even alongside "*/*". It returns false if none
+// of the offers are acceptable.
+func negotiateMediaType(accept string, offers []string) (string, bool) {
+	if strings.TrimSpace(accept) == "" {
+		return offers[0], true
+	}
+
+	type mediaRange struct {
+		mediaType string
+		q         float64
+	}
+
+	var ranges []mediaRange
+
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(part)
+		if err != nil {
+			continue
+		}
+
+		q := 1.0
+		if value, found := params["q"]; found {
+			q, err = strconv.ParseFloat(value, 64)
+			if err != nil || q < 0 || q > 1 {
+				continue
+			}
+		}
+
+		ranges = append(ranges, mediaRange{mediaType, q})
+	}
+
+	best, bestQ := "", 0.0
+
+	for _, offer := range offers {
+		// The specificity of the best matching range so far: 1 for "*/*", 2 for
+		// "type/*" and 3 for an exact match.
+		specificity, q := 0, 0.0
+
+		for _, rng := range ranges {
+			s := 0
+			switch {
+			case rng.mediaType == offer:
+				s = 3
+			case strings.HasSuffix(rng.mediaType, "/*") && strings.HasPrefix(offer, strings.TrimSuffix(rng.mediaType, "*")):
+				s = 2
+			case rng.mediaType == "*/*":
+				s = 1
+			}
+
+			if s > specificity {
+				specificity, q = s, rng.q
+			}
+		}
+
+		if q > bestQ {
+			best, bestQ = offer, q
+		}
+	}
+
+	return best, bestQ > 0
+}
+
+// The negotiateLanguage() function returns the offered language which the
+// Accept-Language header gives the highest quality value. A language range matches an
+// offer which is the same or which it starts with, so "el-GR" matches "el", and the
+// most specific matching range sets the offer's quality. Ties, including a header of
+// just "*", go to the fallback, which is also returned if the header is missing or
+// none of the offers are acceptable.
+func negotiateLanguage(acceptLanguage string, offers []string, fallback string) string {
+	type languageRange struct {
+		tag string
+		q   float64
+	}
+
+	var ranges []languageRange
+
+	for _, part := range strings.Split(acceptLanguage, ",") {
+		tag, params, _ := strings.Cut(part, ";")
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" {
+			continue
+		}
+
+		q := 1.0
+		if params = strings.TrimSpace(params); strings.HasPrefix(params, "q=") {
+			var err error
+			q, err = strconv.ParseFloat(strings.TrimPrefix(params, "q="), 64)
+			if err != nil || q < 0 || q > 1 {
+				continue
+			}
+		}
+
+		ranges = append(ranges, languageRange{tag, q})
+	}
+
+	best, bestQ := fallback, 0.0
+
+	for _, offer := range append([]string{fallback}, offers...) {
+		// The specificity of the best matching range so far: 1 for "*", and otherwise
+		// one more than the length of the range, so longer ranges are more specific.
+		specificity, q := 0, 0.0
+
+		for _, rng := range ranges {
+			s := 0
+			switch {
+			case rng.tag == strings.ToLower(offer) || strings.HasPrefix(rng.tag, strings.ToLower(offer)+"-"):
+				s = 1 + len(rng.tag)
+			case rng.tag == "*":
+				s = 1
+			}
+
+			if s > specificity {
+				specificity, q = s, rng.q
+			}
+		}
+
+		if q > bestQ {
+			best, bestQ = offer, q
+		}
+	}
+
+	return best
+}
+
+// The acceptsGzip() function reports whether the Accept-Encoding header allows a gzipped
+// response, either by naming gzip or with "*", and without a q=0 ruling it out.
+func acceptsGzip(acceptEncoding string) bool {
+	accepted := false
+
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		coding, params, _ := strings.Cut(part, ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+
+		q := 1.0
+		if params = strings.TrimSpace(params); strings.HasPrefix(params, "q=") {
+			var err error
+			q, err = strconv.ParseFloat(strings.TrimPrefix(params, "q="), 64)
+			if err != nil {
+				continue
+			}
+		}
+
+		switch coding {
+		case "gzip":
+			return q > 0
+		case "*":
+			accepted = q > 0
+		}
+	}
+
+	return accepted
+}
+
+// MarshalXML encodes the envelope as a <response> element. Maps are encoded as an
+// element per key, in sorted order (or an <entry key="..."> element for a key which
+// isn't a valid element name, such as "genres[1]"), and slices as an element per
+// item, named after the item's XMLName field if it has one.
+func (env envelope) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	start.Name = xml.Name{Local: "response"}
+
+	return encodeXMLValue(e, start, reflect.ValueOf(map[string]interface{}(env)))
+}
+
+// The encodeXMLValue() function encodes a value as the given element. It handles the
+// maps and slices which encoding/xml doesn't support, and leaves everything else,
+// including structs, to the Encoder.
+func encodeXMLValue(e *xml.Encoder, start xml.StartElement, v reflect.Value) error {
+	for v.Kind() == reflect.Interface {
+		v = v.Elem()
+	}
+
+	switch {
+	case !v.IsValid() || (v.Kind() == reflect.Ptr && v.IsNil()):
+		// Encode nil as an empty element.
+		err := e.EncodeToken(start)
+		if err != nil {
+			return err
+		}
+		return e.EncodeToken(start.End())
+	case v.Kind() == reflect.Map:
+		err := e.EncodeToken(start)
+		if err != nil {
+			return err
+		}
+
+		keys := v.MapKeys()
+		sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+
+		for _, key := range keys {
+			err = encodeXMLValue(e, xmlKeyElement(key.String()), v.MapIndex(key))
+			if err != nil {
+				return err
+			}
+		}
+
+		return e.EncodeToken(start.End())
+	case (v.Kind() == reflect.Slice || v.Kind() == reflect.Array) && v.Type().Elem().Kind() != reflect.Uint8:
+		err := e.EncodeToken(start)
+		if err != nil {
+			return err
+		}
+
+		for i := 0; i < v.Len(); i++ {
+			err = encodeXMLValue(e, xml.StartElement{Name: xml.Name{Local: xmlItemName(v.Index(i))}}, v.Index(i))
+			if err != nil {
+				return err
+			}
+		}
+
+		return e.EncodeToken(start.End())
+	default:
+		return e.EncodeElement(v.Interface(), start)
+	}
+}
+
+// The xmlKeyElement() function returns the element for a map key: one named after the
+// key, or an <entry> element with the key in its key attribute if the key can't be
+// used as an element name.
+func xmlKeyElement(key string) xml.StartElement {
+	if isXMLName(key) {
+		return xml.StartElement{Name: xml.Name{Local: key}}
+	}
+
+	return xml.StartElement{
+		Name: xml.Name{Local: "entry"},
+		Attr: []xml.Attr{{Name: xml.Name{Local: "key"}, Value: key}},
+	}
+}
+
+// The isXMLName() function reports whether s can be used as an element name. It's
+// stricter than the XML specification, which allows most non-ASCII letters too.
+func isXMLName(s string) bool {
+	if s == "" || strings.HasPrefix(strings.ToLower(s), "xml") {
+		return false
+	}
+
+	for i, c := range s {
+		switch {
+		case c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z'):
+		case i > 0 && (c == '-' || c == '.' || (c >= '0' && c <= '9')):
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+// The xmlItemName() function returns the element name for an item in a slice: the name
+// in the tag on its XMLName field, or "item".
+func xmlItemName(v reflect.Value) string {
+	t := v.Type()
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	if t.Kind() == reflect.Struct {
+		if field, found := t.FieldByName("XMLName"); found {
+			if name := strings.Split(field.Tag.Get("xml"), ",")[0]; name != "" {
+				return name
+			}
+		}
+	}
+
+	return "item"
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/petrostrak/an-open-movie-database/internal/data"
+)
+
+func TestNegotiateMediaType(t *testing.T) {
+	tests := []struct {
+		name   string
+		accept string
+		want   string
+		wantOK bool
+	}{
+		{"no header", "", "application/json", true},
+		{"json", "application/json", "application/json", true},
+		{"xml", "application/xml", "application/xml", true},
+		{"anything", "*/*", "application/json", true},
+		{"any application type", "application/*", "application/json", true},
+		{"higher q wins", "application/json;q=0.5, application/xml", "application/xml", true},
+		{"lower q loses", "application/xml;q=0.1, application/json;q=0.9", "application/json", true},
+		{"tie goes to json", "application/xml, application/json", "application/json", true},
+		{"specific range beats wildcard", "*/*;q=0.9, application/json;q=0.1", "application/xml", true},
+		{"q=0 rules a type out", "*/*, application/json;q=0", "application/xml", true},
+		{"parameters and case", "Application/XML; charset=utf-8 ; q=1", "application/xml", true},
+		{"browser", "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8", "application/xml", true},
+		{"unsupported", "text/csv", "", false},
+		{"everything q=0", "application/json;q=0, application/xml;q=0", "", false},
+		{"invalid q ignored", "application/xml;q=2, application/json", "application/json", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := negotiateMediaType(tt.accept, supportedMediaTypes)
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("got %q, %v; want %q, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestNegotiateLanguage(t *testing.T) {
+	offers := []string{"el", "en"}
+
+	tests := []struct {
+		name           string
+		acceptLanguage string
+		fallback       string
+		want           string
+	}{
+		{"no header", "", "en", "en"},
+		{"no header, greek default", "", "el", "el"},
+		{"greek", "el", "en", "el"},
+		{"region", "el-GR", "en", "el"},
+		{"case", "EL-gr", "en", "el"},
+		{"browser", "el-GR,el;q=0.9,en-US;q=0.8,en;q=0.7", "en", "el"},
+		{"higher q wins", "el;q=0.5, en", "el", "en"},
+		{"unsupported", "fr-FR, de", "en", "en"},
+		{"unsupported then greek", "fr;q=0.9, el;q=0.1", "en", "el"},
+		{"anything goes to the fallback", "*", "el", "el"},
+		{"specific range beats wildcard", "*;q=0.9, en;q=0.1", "en", "el"},
+		{"q=0 rules a language out", "*, en;q=0", "en", "el"},
+		{"prefix of a longer tag", "eng", "en", "en"},
+		{"invalid q ignored", "el;q=2, en", "el", "en"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := negotiateLanguage(tt.acceptLanguage, offers, tt.fallback); got != tt.want {
+				t.Errorf("got %q; want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAcceptsGzip(t *testing.T) {
+	tests := []struct {
+		acceptEncoding string
+		want           bool
+	}{
+		{"", false},
+		{"gzip", true},
+		{"deflate, GZIP;q=0.5", true},
+		{"br, deflate", false},
+		{"*", true},
+		{"*, gzip;q=0", false},
+		{"gzip;q=0, *", false},
+		{"identity", false},
+	}
+
+	for _, tt := range tests {
+		if got := acceptsGzip(tt.acceptEncoding); got != tt.want {
+			t.Errorf("%q: got %t; want %t", tt.acceptEncoding, got, tt.want)
+		}
+	}
+}
+
+func TestXMLResponses(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t)
+
+	_, token := newTestUser(t, app, "reader", "reader")
+
+	movie := &data.Movie{Title: "Casablanca", Year: 1942, Runtime: 102, Genres: []string{"drama", "romance"}}
+	err := app.models.Movies.Insert(movie)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(t *testing.T, path, accept string) (*http.Response, []byte) {
+		t.Helper()
+
+		req, err := http.NewRequest(http.MethodGet, ts.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("Accept", accept)
+
+		res, err := ts.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+
+		body, err := io.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return res, body
+	}
+
+	t.Run("movie round trip", func(t *testing.T) {
+		res, body := get(t, fmt.Sprintf("/v1/movies/%d", movie.ID), "application/xml")
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("got status %d; want %d (body %s)", res.StatusCode, http.StatusOK, body)
+		}
+
+		if got := res.Header.Get("Content-Type"); got != "application/xml" {
+			t.Errorf("got Content-Type %q; want application/xml", got)
+		}
+
+		var response struct {
+			Movie data.Movie `xml:"movie"`
+		}
+
+		err := xml.Unmarshal(body, &response)
+		if err != nil {
+			t.Fatalf("%v decoding %s", err, body)
+		}
+
+		got := response.Movie
+		if got.ID != movie.ID || got.Title != movie.Title || got.Year != movie.Year || got.Runtime != movie.Runtime ||
+			!reflect.DeepEqual(got.Genres, movie.Genres) || got.Version != movie.Version || !got.UpdatedAt.Equal(movie.UpdatedAt) {
+			t.Errorf("got movie %+v; want %+v", got, movie)
+		}
+	})
+
+	t.Run("list", func(t *testing.T) {
+		res, body := get(t, "/v1/movies", "application/xml")
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("got status %d; want %d (body %s)", res.StatusCode, http.StatusOK, body)
+		}
+
+		var response struct {
+			Movies   []data.Movie  `xml:"movies>movie"`
+			Metadata data.Metadata `xml:"metadata"`
+		}
+
+		err := xml.Unmarshal(body, &response)
+		if err != nil {
+			t.Fatalf("%v decoding %s", err, body)
+		}
+
+		if len(response.Movies) != 1 || response.Movies[0].Title != movie.Title || response.Metadata.TotalRecords != 1 {
+			t.Errorf("got %+v", response)
+		}
+	})
+
+	t.Run("error", func(t *testing.T) {
+		res, body := get(t, "/v1/movies?sort=nope", "application/xml")
+		if res.StatusCode != http.StatusUnprocessableEntity {
+			t.Fatalf("got status %d; want %d (body %s)", res.StatusCode, http.StatusUnprocessableEntity, body)
+		}
+
+		var response struct {
+			Code    string `xml:"code"`
+			Details struct {
+				Sort []string `xml:"sort>item"`
+			} `xml:"details"`
+		}
+
+		err := xml.Unmarshal(body, &response)
+		if err != nil {
+			t.Fatalf("%v decoding %s", err, body)
+		}
+
+		if response.Code != errCodeValidationFailed || len(response.Details.Sort) != 1 || response.Details.Sort[0] != "invalid sort value" {
+			t.Errorf("got code %q and sort error %q; want %q and %q", response.Code, response.Details.Sort, errCodeValidationFailed, "invalid sort value")
+		}
+	})
+
+	t.Run("not acceptable", func(t *testing.T) {
+		res, body := get(t, "/v1/movies", "text/csv")
+		if res.StatusCode != http.StatusNotAcceptable {
+			t.Fatalf("got status %d; want %d (body %s)", res.StatusCode, http.StatusNotAcceptable, body)
+		}
+
+		var response struct {
+			Details struct {
+				SupportedTypes []string `json:"supported_types"`
+			} `json:"details"`
+		}
+
+		err := json.Unmarshal(body, &response)
+		if err != nil {
+			t.Fatalf("%v decoding %s", err, body)
+		}
+
+		if !reflect.DeepEqual(response.Details.SupportedTypes, supportedMediaTypes) {
+			t.Errorf("got supported types %q; want %q", response.Details.SupportedTypes, supportedMediaTypes)
+		}
+	})
+
+	// An error is still sent, as JSON, when the client accepts neither JSON nor XML.
+	t.Run("not acceptable error", func(t *testing.T) {
+		res, _ := get(t, "/v1/movies/abc", "text/csv")
+		if res.StatusCode != http.StatusNotFound {
+			t.Errorf("got status %d; want %d", res.StatusCode, http.StatusNotFound)
+		}
+
+		if got := res.Header.Get("Content-Type"); got != "application/json" {
+			t.Errorf("got Content-Type %q; want application/json", got)
+		}
+	})
+}
+
+// Map keys which aren't element names, such as the keys of indexed validation errors,
+// are encoded as <entry> elements.
+func TestXMLIndexedKeys(t *testing.T) {
+	env := envelope{"details": map[string][]string{
+		"genres[1]": {"must not be empty"},
+		"title":     {"must be provided"},
+	}}
+
+	out, err := xml.Marshal(env)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := `<response><details><entry key="genres[1]"><item>must not be empty</item></entry><title><item>must be provided</item></title></details></response>`
+	if string(out) != want {
+		t.Errorf("got %s; want %s", out, want)
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/petrostrak/an-open-movie-database/internal/data"
+	"github.com/petrostrak/an-open-movie-database/internal/oauth"
+	"github.com/petrostrak/an-open-movie-database/internal/validator"
+)
+
+// The name of the cookie which carries the OAuth state value between the login and
+// callback requests.
+const oauthStateCookie = "oauth_state"
+
+// The googleLoginHandler() generates a random state value, stores it in a short-lived
+// cookie and redirects the client to Google's consent screen.
+func (app *application) googleLoginHandler(w http.ResponseWriter, r *http.Request) {
+	randomBytes := make([]byte, 16)
+
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	state := base64.RawURLEncoding.EncodeToString(randomBytes)
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     oauthStateCookie,
+		Value:    state,
+		Path:     "/v1/auth/google",
+		MaxAge:   int((10 * time.Minute).Seconds()),
+		HttpOnly: true,
+		Secure:   app.config.env == "production",
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	http.Redirect(w, r, app.google.AuthCodeURL(state), http.StatusFound)
+}
+
+// The googleCallbackHandler() is where Google sends the client back to after consent.
+// It checks the state value, exchanges the code for the user's Google identity, then
+// finds, links or creates the matching user and returns an authentication token.
+func (app *application) googleCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+
+	// Compare the state value in the query string with the one we stored in the
+	// cookie. If they don't match, the callback didn't originate from a login that
+	// this client started, so we reject it.
+	cookie, err := r.Cookie(oauthStateCookie)
+	if err != nil || cookie.Value == "" || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(qs.Get("state"))) != 1 {
+		app.badRequestResponse(w, r, errors.New("invalid or missing oauth state parameter"))
+		return
+	}
+
+	// The state value is single-use, so expire the cookie straight away.
+	http.SetCookie(w, &http.Cookie{
+		Name:   oauthStateCookie,
+		Path:   "/v1/auth/google",
+		MaxAge: -1,
+	})
+
+	// If the user declined consent, Google redirects back with an error parameter
+	// instead of a code.
+	code := qs.Get("code")
+	if qs.Get("error") != "" || code == "" {
+		app.invalidCredentialsResponse(w, r)
+		return
+	}
+
+	accessToken, err := app.google.Exchange(code)
+	if err != nil {
+		switch {
+		case errors.Is(err, oauth.ErrExchangeFailed):
+			app.invalidCredentialsResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	info, err := app.google.UserInfo(accessToken)
+	if err != nil {
+		switch {
+		case errors.Is(err, oauth.ErrExchangeFailed):
+			app.invalidCredentialsResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	info.Email = data.NormalizeEmail(info.Email)
+
+	// We only trust the email address if Google has verified it. Otherwise anyone
+	// could link themselves to an existing account by claiming its email address.
+	v := validator.New()
+
+	v.Check(info.EmailVerified, "email", validator.Msg("email_unverified"))
+	data.ValidateEmail(v, info.Email)
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := app.findOrCreateOAuthUser("google", info)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict), errors.Is(err, data.ErrDuplicateEmail):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// From here on the user is treated exactly like one who signed in with a
+	// password, so we issue a normal 24-hour authentication token.
+	token, err := app.newAuthenticationToken(user.ID, app.config.tokens.authTTL)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.recordAudit(r, data.AuditEntry{
+		UserID:       user.ID,
+		Action:       "token.create",
+		ResourceType: "token",
+		ResourceID:   data.ScopeAuthentication,
+		Metadata:     map[string]interface{}{"method": "google"},
+	})
+
+	err = app.writeResponse(w, r, http.StatusCreated, envelope{"authentication_token": token}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The findOrCreateOAuthUser() helper returns the user linked to the provider account.
+// If there isn't one, an existing user with the same (verified) email address is linked
+// to it, and failing that a new activated user is created without a password.
+func (app *application) findOrCreateOAuthUser(provider string, info *oauth.UserInfo) (*data.User, error) {
+	user, err := app.models.Users.GetByOAuth(provider, info.Subject)
+	if err == nil {
+		return user, nil
+	}
+	if !errors.Is(err, data.ErrRecordNotFound) {
+		return nil, err
+	}
+
+	user, err = app.models.Users.GetByEmail(info.Email)
+	switch {
+	case err == nil:
+		err = app.models.Users.LinkOAuth(user, provider, info.Subject)
+		if err != nil {
+			return nil, err
+		}
+
+		app.invalidateUser(user.ID)
+
+		return user, nil
+	case !errors.Is(err, data.ErrRecordNotFound):
+		return nil, err
+	}
+
+	name := info.Name
+	if name == "" {
+		name = info.Email
+	}
+
+	username, err := app.models.Users.AvailableUsername(info.Email)
+	if err != nil {
+		return nil, err
+	}
+
+	user = &data.User{
+		Name:          name,
+		Username:      username,
+		Email:         info.Email,
+		Locale:        data.DefaultLocale,
+		Activated:     true,
+		OAuthProvider: provider,
+		OAuthSubject:  info.Subject,
+	}
+
+	err = app.models.Users.Insert(user)
+	if err != nil {
+		return nil, err
+	}
+
+	// New users get the same default role as those who register with a password.
+	err = app.models.Roles.AddForUser(user.ID, "reader")
+	if err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
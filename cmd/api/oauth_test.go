@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/petrostrak/an-open-movie-database/internal/data"
+	"github.com/petrostrak/an-open-movie-database/internal/oauth"
+)
+
+// The newGoogleStub() helper starts a stub of Google's token and userinfo endpoints,
+// which accepts the code "good-code" and returns the given identity, and points the
+// application's Google client at it.
+func newGoogleStub(t *testing.T, app *application, info oauth.UserInfo) {
+	t.Helper()
+
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.PostFormValue("code") != "good-code" || r.PostFormValue("client_secret") != app.google.ClientSecret {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]string{"access_token": "stub-access-token"})
+	})
+
+	mux.HandleFunc("/userinfo", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer stub-access-token" {
+			http.Error(w, `{"error":"invalid_token"}`, http.StatusUnauthorized)
+			return
+		}
+
+		json.NewEncoder(w).Encode(info)
+	})
+
+	stub := httptest.NewServer(mux)
+	t.Cleanup(stub.Close)
+
+	app.google.TokenURL = stub.URL + "/token"
+	app.google.UserInfoURL = stub.URL + "/userinfo"
+}
+
+// The googleCallback() helper sends a callback request with a matching state cookie
+// and returns the response status code.
+func googleCallback(t *testing.T, ts *testServer, code, state, cookieState string) int {
+	t.Helper()
+
+	req, err := http.NewRequest(http.MethodGet, ts.URL+"/v1/auth/google/callback?code="+code+"&state="+state, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req.AddCookie(&http.Cookie{Name: oauthStateCookie, Value: cookieState})
+
+	res, err := ts.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	return res.StatusCode
+}
+
+func TestGoogleCallback(t *testing.T) {
+	tests := []struct {
+		name        string
+		info        oauth.UserInfo
+		code        string
+		cookieState string
+		wantCode    int
+	}{
+		{"new user", oauth.UserInfo{Subject: "1", Email: "new@example.com", EmailVerified: true}, "good-code", "state", http.StatusCreated},
+		{"unverified email", oauth.UserInfo{Subject: "2", Email: "new@example.com"}, "good-code", "state", http.StatusUnprocessableEntity},
+		{"bad code", oauth.UserInfo{Subject: "3", Email: "new@example.com", EmailVerified: true}, "bad-code", "state", http.StatusUnauthorized},
+		{"state mismatch", oauth.UserInfo{Subject: "4", Email: "new@example.com", EmailVerified: true}, "good-code", "other", http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t)
+			ts := newTestServer(t)
+			newGoogleStub(t, app, tt.info)
+
+			code := googleCallback(t, ts, tt.code, "state", tt.cookieState)
+			if code != tt.wantCode {
+				t.Errorf("got status %d; want %d", code, tt.wantCode)
+			}
+		})
+	}
+}
+
+// Someone who registers an account with another person's email address can't
+// activate it, but they know its password. When the real owner signs in with Google
+// and the account is linked, the password and tokens must be removed, or the squatter
+// could still sign in.
+func TestGoogleCallbackLinkUnactivated(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t)
+	newGoogleStub(t, app, oauth.UserInfo{Subject: "42", Email: "victim@example.com", EmailVerified: true})
+
+	squatter := &data.User{Name: "Squatter", Username: "squatter", Email: "victim@example.com"}
+
+	err := squatter.Password.Set("squatters password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = app.models.Users.Register(squatter, []string{"reader"}, time.Hour, func(token *data.Token) *data.EmailJob {
+		return &data.EmailJob{Recipient: squatter.Email, Template: "user_welcome.tmpl"}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code := googleCallback(t, ts, "good-code", "state", "state")
+	if code != http.StatusCreated {
+		t.Fatalf("got status %d; want %d", code, http.StatusCreated)
+	}
+
+	user, err := app.models.Users.GetByEmail("victim@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !user.Activated || user.OAuthSubject != "42" {
+		t.Errorf("got activated %t and subject %q; want the account activated and linked", user.Activated, user.OAuthSubject)
+	}
+
+	code, _ = ts.do(t, http.MethodPost, "/v1/tokens/authentication", "", map[string]string{
+		"email":    "victim@example.com",
+		"password": "squatters password",
+	})
+	if code != http.StatusUnauthorized {
+		t.Errorf("got status %d signing in with the squatter's password; want %d", code, http.StatusUnauthorized)
+	}
+}
+
+// Linking an account which was already activated keeps its password.
+func TestGoogleCallbackLinkActivated(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t)
+	newTestUser(t, app, "owner", "reader")
+	newGoogleStub(t, app, oauth.UserInfo{Subject: "43", Email: "owner@example.com", EmailVerified: true})
+
+	code := googleCallback(t, ts, "good-code", "state", "state")
+	if code != http.StatusCreated {
+		t.Fatalf("got status %d; want %d", code, http.StatusCreated)
+	}
+
+	code, _ = ts.do(t, http.MethodPost, "/v1/tokens/authentication", "", map[string]string{
+		"email":    "owner@example.com",
+		"password": "pa55word1234",
+	})
+	if code != http.StatusCreated {
+		t.Errorf("got status %d signing in with the password; want %d", code, http.StatusCreated)
+	}
+}
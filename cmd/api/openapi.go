@@ -0,0 +1,1247 @@
+package main
+
+import (
+	_ "embed"
+	"fmt"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The docs page is a small, self-contained viewer for the OpenAPI document. It's
+// embedded in the binary so that /v1/docs works without any assets from a CDN.
+//
+//go:embed "docs/index.html"
+var docsHTML []byte
+
+// The apiOperation type describes one documented endpoint. The access field is empty
+// for public endpoints, "authenticated" for those which only need a logged in user,
+// "activated" for those which need the user to be activated too, and otherwise the
+// permission code which the endpoint requires.
+type apiOperation struct {
+	method      string
+	path        string
+	tag         string
+	summary     string
+	access      string
+	parameters  []interface{}
+	requestBody interface{}
+	responses   map[int]interface{}
+}
+
+// The apiRouteAliases map lists the routes which handle more than one documented
+// endpoint. These are the routes registered with matchParam() and switchParam() to work
+// around httprouter's conflicts, so their patterns don't match the documented paths.
+var apiRouteAliases = map[string][]string{
+	"POST /v1/movies/:id":         {"POST /v1/movies/validate", "POST /v1/movies/duplicates"},
+	"POST /v2/movies/:id":         {"POST /v2/movies/validate", "POST /v2/movies/duplicates"},
+	"PUT /v1/users/:id":           {"PUT /v1/users/activated"},
+	"DELETE /v1/users/:id":        {"DELETE /v1/users/me", "DELETE /v1/users/{id}"},
+	"GET /v1/users/:id/:resource": {"GET /v1/users/username/{username}", "GET /v1/users/public/{public_id}", "GET /v1/users/{id}/permissions", "GET /v1/users/{id}/usage"},
+}
+
+// Define the operations for every endpoint. When you add a route in routes(), add it
+// here too; TestOpenAPICoverage fails if you don't. The v2 operations are derived from
+// the v1 ones by withV2Operations().
+var apiOperations = withV2Operations([]apiOperation{
+	{
+		method: http.MethodGet, path: "/v1/healthcheck", tag: "system",
+		summary:    "Show the application status, which is unavailable while the database circuit breaker is open. Administrators can add ?verbose=true to include database pool stats.",
+		parameters: []interface{}{queryParam("verbose", "boolean", "Include database pool stats (administrators only).")},
+		responses:  map[int]interface{}{200: jsonResponse("Application status.", objectSchema(nil))},
+	},
+	{
+		method: http.MethodGet, path: "/v1/openapi.json", tag: "system",
+		summary:   "Show this OpenAPI document.",
+		responses: map[int]interface{}{200: jsonResponse("The OpenAPI document.", objectSchema(nil))},
+	},
+	{
+		method: http.MethodGet, path: "/v1/docs", tag: "system",
+		summary: "Show the API documentation viewer.",
+		responses: map[int]interface{}{200: map[string]interface{}{
+			"description": "An HTML page.",
+			"content":     map[string]interface{}{"text/html": map[string]interface{}{}},
+		}},
+	},
+
+	// Movies:
+	{
+		method: http.MethodGet, path: "/v1/movies", tag: "movies", access: "movies:read",
+		summary: "List movies, optionally filtered by title, genres, awards and who added them.",
+		parameters: append([]interface{}{
+			queryParam("title", "string", "Only return movies whose title contains these words."),
+			queryParam("genres", "string", "A comma-separated list of genres which the movies must all have."),
+			queryParam("has_awards", "boolean", "Only return movies with at least one award (true), or without any (false)."),
+			queryParam("created_by", "integer", "Only return movies added by the user with this ID."),
+			queryParam("facets", "string", "A comma-separated list of facets to count the matching movies by, in metadata.facets: genres, years or both."),
+			ref("RuntimeFormat"),
+			ref("DebugScore"),
+			ref("Format"),
+		}, filterParams()...),
+		responses: map[int]interface{}{200: withNDJSON(jsonResponse("A page of movies. As NDJSON, a movie per line, with the metadata in the X-Current-Page, X-Page-Size, X-Last-Page, X-Total-Records, X-Truncated, X-Returned-Records and X-Dropped-Records headers.", envelopeSchema(
+			"movies", arraySchema(ref("Movie")),
+			"metadata", ref("Metadata"),
+		)), ref("Movie"))},
+	},
+	{
+		method: http.MethodPost, path: "/v1/movies", tag: "movies", access: "movies:write",
+		summary: "Create a movie. Send an Idempotency-Key header to make retries safe. With ?enrich=true, an empty runtime, genres, plot or poster is filled in from OMDb first; if the lookup fails, the movie is created anyway with a warning.",
+		parameters: []interface{}{
+			ref("IdempotencyKey"),
+			ref("RuntimeFormat"),
+			queryParam("enrich", "boolean", "Fill in the fields left empty from OMDb, and list them in enriched."),
+			queryParam("strict", "boolean", "Refuse the movie with a 409 duplicate_movie error, listing details.candidates, if an existing movie scores at least -duplicates-threshold against it."),
+		},
+		requestBody: jsonBody(ref("MovieInput")),
+		responses: map[int]interface{}{
+			201: jsonResponse("The created movie.", enrichedMovieSchema()),
+			409: ref("Conflict"),
+		},
+	},
+	{
+		method: http.MethodPost, path: "/v1/movies/validate", tag: "movies", access: "movies:write",
+		summary:     "Check a movie as creating it would, without creating it.",
+		requestBody: jsonBody(ref("MovieInput")),
+		responses: map[int]interface{}{200: jsonResponse("The movie is valid.", envelopeSchema(
+			"valid", map[string]interface{}{"type": "boolean"},
+		))},
+	},
+	{
+		method: http.MethodPost, path: "/v1/movies/duplicates", tag: "movies", access: "movies:write",
+		summary:    "Find up to 5 existing movies which a new one may be a duplicate of, scored by how alike their titles and years are, the most alike first.",
+		parameters: []interface{}{ref("RuntimeFormat")},
+		requestBody: jsonBody(objectSchema(map[string]interface{}{
+			"title": stringSchema(""),
+			"year":  integerSchema(),
+		}, "title")),
+		responses: map[int]interface{}{200: jsonResponse("The candidate duplicates.", envelopeSchema(
+			"candidates", arraySchema(ref("MovieCandidate")),
+		))},
+	},
+	{
+		method: http.MethodGet, path: "/v1/movies/{id}", tag: "movies", access: "movies:read",
+		summary:    "Show a movie, counting a view towards its popularity.",
+		parameters: []interface{}{ref("RuntimeFormat"), ref("DebugScore")},
+		responses:  map[int]interface{}{200: jsonResponse("The movie.", envelopeSchema("movie", ref("Movie")))},
+	},
+	{
+		method: http.MethodPatch, path: "/v1/movies/{id}", tag: "movies", access: "movies:write",
+		summary:     "Update some or all of a movie's fields.",
+		parameters:  []interface{}{ref("RuntimeFormat")},
+		requestBody: jsonBody(ref("MovieInput")),
+		responses: map[int]interface{}{
+			200: jsonResponse("The updated movie.", envelopeSchema("movie", ref("Movie"))),
+			409: ref("Conflict"),
+		},
+	},
+	{
+		method: http.MethodDelete, path: "/v1/movies/{id}", tag: "movies", access: "movies:write",
+		summary: "Delete a movie, along with the ratings, reviews, watchlist entries and reports which refer to it.",
+		responses: map[int]interface{}{
+			200: jsonResponse("The movie was deleted, with the number of rows of each kind deleted along with it.", envelopeSchema(
+				"message", stringSchema(""),
+				"deleted", ref("MovieDeletion"),
+			)),
+			409: ref("Conflict"),
+		},
+	},
+	{
+		method: http.MethodPost, path: "/v1/movies/{id}/enrich", tag: "movies", access: "movies:write",
+		summary:    "Fill in a movie's empty runtime, genres, plot and poster from OMDb. The movie is only updated if something was filled in.",
+		parameters: []interface{}{ref("RuntimeFormat")},
+		responses: map[int]interface{}{
+			200: jsonResponse("The movie, the fields which were filled in, and a warning if OMDb couldn't be used.", enrichedMovieSchema()),
+			409: ref("Conflict"),
+		},
+	},
+
+	// Reports:
+	{
+		method: http.MethodPost, path: "/v1/movies/{id}/reports", tag: "reports", access: "activated",
+		summary: "Report incorrect data about a movie. A user can have up to 5 open reports.",
+		requestBody: jsonBody(objectSchema(map[string]interface{}{
+			"field":   map[string]interface{}{"type": "string", "enum": []string{"title", "year", "runtime", "genres", "awards", "external_ratings", "plot", "poster", "other"}},
+			"message": stringSchema(""),
+		}, "field", "message")),
+		responses: map[int]interface{}{201: jsonResponse("The report.", envelopeSchema("report", ref("Report")))},
+	},
+	{
+		method: http.MethodGet, path: "/v1/reports", tag: "reports", access: "movies:write",
+		summary: "List the reports with a status.",
+		parameters: append([]interface{}{
+			queryParam("status", "string", "Only return reports with this status: open (the default), resolved or dismissed."),
+		}, filterParams()...),
+		responses: map[int]interface{}{200: jsonResponse("A page of reports.", envelopeSchema(
+			"reports", arraySchema(ref("Report")),
+			"metadata", ref("Metadata"),
+		))},
+	},
+	{
+		method: http.MethodPatch, path: "/v1/reports/{id}", tag: "reports", access: "movies:write",
+		summary: "Resolve or dismiss an open report, with an optional note for the user who made it, or open a closed report again.",
+		requestBody: jsonBody(objectSchema(map[string]interface{}{
+			"status":     map[string]interface{}{"type": "string", "enum": []string{"open", "resolved", "dismissed"}},
+			"resolution": stringSchema(""),
+		}, "status")),
+		responses: map[int]interface{}{
+			200: jsonResponse("The updated report.", envelopeSchema("report", ref("Report"))),
+			409: ref("Conflict"),
+		},
+	},
+
+	// Users:
+	{
+		method: http.MethodPost, path: "/v1/users", tag: "users",
+		summary:    "Register a user. The welcome email contains the activation token.",
+		parameters: []interface{}{ref("IdempotencyKey")},
+		requestBody: jsonBody(objectSchema(map[string]interface{}{
+			"name":     stringSchema(""),
+			"username": stringSchema(""),
+			"email":    stringSchema("email"),
+			"password": stringSchema("password"),
+			"locale":   stringSchema(""),
+		}, "name", "username", "email", "password")),
+		responses: map[int]interface{}{
+			202: jsonResponse("The registered user.", envelopeSchema("user", ref("User"))),
+			409: ref("Conflict"),
+		},
+	},
+	{
+		method: http.MethodPut, path: "/v1/users/activated", tag: "users",
+		summary:     "Activate a user with the token from their welcome email.",
+		requestBody: jsonBody(objectSchema(map[string]interface{}{"token": stringSchema("")}, "token")),
+		responses: map[int]interface{}{
+			200: jsonResponse("The activated user.", envelopeSchema("user", ref("User"))),
+			409: ref("Conflict"),
+		},
+	},
+	{
+		method: http.MethodDelete, path: "/v1/users/me", tag: "users", access: "authenticated",
+		summary:     "Delete the current user's account. The current password must be confirmed.",
+		requestBody: jsonBody(objectSchema(map[string]interface{}{"password": stringSchema("password")}, "password")),
+		responses:   map[int]interface{}{204: map[string]interface{}{"description": "The account was deleted."}},
+	},
+	{
+		method: http.MethodDelete, path: "/v1/users/{id}", tag: "users", access: "users:admin",
+		summary:   "Delete any user's account.",
+		responses: map[int]interface{}{204: map[string]interface{}{"description": "The account was deleted."}},
+	},
+	{
+		method: http.MethodGet, path: "/v1/users/username/{username}", tag: "users",
+		summary:   "Show a user's public profile.",
+		responses: map[int]interface{}{200: jsonResponse("The profile.", envelopeSchema("user", ref("Profile")))},
+	},
+	{
+		method: http.MethodGet, path: "/v1/users/public/{public_id}", tag: "users",
+		summary:   "Show a user's public profile, by the public ID from their profile.",
+		responses: map[int]interface{}{200: jsonResponse("The profile.", envelopeSchema("user", ref("Profile")))},
+	},
+
+	// User permissions:
+	{
+		method: http.MethodGet, path: "/v1/users/{id}/permissions", tag: "permissions", access: "users:admin",
+		summary:   "List a user's permissions.",
+		responses: map[int]interface{}{200: ref("Permissions")},
+	},
+	{
+		method: http.MethodGet, path: "/v1/users/{id}/usage", tag: "users", access: "users:admin",
+		summary:   "Show the number of requests a user made on each of the last 30 days.",
+		responses: map[int]interface{}{200: ref("Usage")},
+	},
+	{
+		method: http.MethodPost, path: "/v1/users/{id}/permissions", tag: "permissions", access: "users:admin",
+		summary:     "Grant permissions to a user.",
+		requestBody: jsonBody(objectSchema(map[string]interface{}{"codes": arraySchema(stringSchema(""))}, "codes")),
+		responses:   map[int]interface{}{200: ref("Permissions")},
+	},
+	{
+		method: http.MethodDelete, path: "/v1/users/{id}/permissions/{code}", tag: "permissions", access: "users:admin",
+		summary:   "Revoke a permission from a user.",
+		responses: map[int]interface{}{200: ref("Message")},
+	},
+
+	// Roles:
+	{
+		method: http.MethodGet, path: "/v1/roles", tag: "roles", access: "users:admin",
+		summary:   "List the roles and the permissions they grant.",
+		responses: map[int]interface{}{200: jsonResponse("The roles.", envelopeSchema("roles", arraySchema(ref("Role"))))},
+	},
+	{
+		method: http.MethodPut, path: "/v1/users/{id}/roles", tag: "roles", access: "users:admin",
+		summary:     "Replace a user's roles.",
+		requestBody: jsonBody(objectSchema(map[string]interface{}{"roles": arraySchema(stringSchema(""))}, "roles")),
+		responses:   map[int]interface{}{200: jsonResponse("The user's roles.", envelopeSchema("roles", arraySchema(stringSchema(""))))},
+	},
+
+	// Audit log:
+	{
+		method: http.MethodGet, path: "/v1/audit", tag: "audit", access: "users:admin",
+		summary: "List audit log entries.",
+		parameters: append([]interface{}{
+			queryParam("user_id", "integer", "Only return entries for this user."),
+			queryParam("action", "string", "Only return entries with this action, such as \"movie.create\"."),
+		}, filterParams()...),
+		responses: map[int]interface{}{200: jsonResponse("A page of audit log entries.", envelopeSchema(
+			"audit", arraySchema(ref("AuditEntry")),
+			"metadata", ref("Metadata"),
+		))},
+	},
+
+	// Webhooks:
+	{
+		method: http.MethodGet, path: "/v1/webhooks", tag: "webhooks", access: "users:admin",
+		summary:   "List webhooks.",
+		responses: map[int]interface{}{200: jsonResponse("The webhooks.", envelopeSchema("webhooks", arraySchema(ref("Webhook"))))},
+	},
+	{
+		method: http.MethodPost, path: "/v1/webhooks", tag: "webhooks", access: "users:admin",
+		summary:     "Create a webhook. The signing secret is only returned in this response.",
+		requestBody: jsonBody(ref("WebhookInput")),
+		responses: map[int]interface{}{201: jsonResponse("The created webhook and its signing secret.", envelopeSchema(
+			"webhook", ref("Webhook"),
+			"secret", stringSchema(""),
+		))},
+	},
+	{
+		method: http.MethodGet, path: "/v1/webhooks/{id}", tag: "webhooks", access: "users:admin",
+		summary:   "Show a webhook.",
+		responses: map[int]interface{}{200: jsonResponse("The webhook.", envelopeSchema("webhook", ref("Webhook")))},
+	},
+	{
+		method: http.MethodPatch, path: "/v1/webhooks/{id}", tag: "webhooks", access: "users:admin",
+		summary:     "Update some or all of a webhook's fields.",
+		requestBody: jsonBody(ref("WebhookInput")),
+		responses: map[int]interface{}{
+			200: jsonResponse("The updated webhook.", envelopeSchema("webhook", ref("Webhook"))),
+			409: ref("Conflict"),
+		},
+	},
+	{
+		method: http.MethodDelete, path: "/v1/webhooks/{id}", tag: "webhooks", access: "users:admin",
+		summary:   "Delete a webhook.",
+		responses: map[int]interface{}{200: ref("Message")},
+	},
+	{
+		method: http.MethodGet, path: "/v1/webhooks/{id}/deliveries", tag: "webhooks", access: "users:admin",
+		summary:    "List the delivery attempts for a webhook.",
+		parameters: filterParams(),
+		responses: map[int]interface{}{200: jsonResponse("A page of delivery attempts.", envelopeSchema(
+			"deliveries", arraySchema(ref("WebhookDelivery")),
+			"metadata", ref("Metadata"),
+		))},
+	},
+
+	// Email outbox:
+	{
+		method: http.MethodGet, path: "/v1/admin/outbox", tag: "admin", access: "users:admin",
+		summary: "List the jobs in the email outbox.",
+		parameters: append([]interface{}{
+			queryParam("status", "string", "Only return jobs with this status. Defaults to \"failed\"."),
+		}, filterParams()...),
+		responses: map[int]interface{}{200: jsonResponse("A page of email jobs.", envelopeSchema(
+			"email_jobs", arraySchema(objectSchema(nil)),
+			"metadata", ref("Metadata"),
+		))},
+	},
+
+	// Configuration:
+	{
+		method: http.MethodPost, path: "/v1/admin/config/reload", tag: "admin", access: "users:admin",
+		summary: "Reload the configuration, as on SIGHUP. Only the rate limits, log level, CORS trusted origins and maintenance mode are applied; changes to any other setting are skipped until a restart.",
+		responses: map[int]interface{}{
+			200: jsonResponse("The names of the settings which were reloaded and skipped.", envelopeSchema("config", objectSchema(map[string]interface{}{
+				"reloaded": arraySchema(stringSchema("")),
+				"skipped":  arraySchema(stringSchema("")),
+			}, "reloaded", "skipped"))),
+			422: ref("InvalidConfig"),
+		},
+	},
+
+	// Admin jobs:
+	{
+		method: http.MethodPost, path: "/v1/admin/movies/reindex", tag: "admin", access: "users:admin",
+		summary: "Rebuild the movies' derived columns, such as the rating aggregates, in the background. A re-index which failed or was interrupted is resumed from where it stopped.",
+		responses: map[int]interface{}{
+			202: jsonResponse("The job, to poll for its progress.", envelopeSchema("job", ref("Job"))),
+			409: ref("Conflict"),
+		},
+	},
+	{
+		method: http.MethodGet, path: "/v1/admin/jobs/{id}", tag: "admin", access: "users:admin",
+		summary:   "Show the status and progress of an admin job.",
+		responses: map[int]interface{}{200: jsonResponse("The job.", envelopeSchema("job", ref("Job")))},
+	},
+	{
+		method: http.MethodPost, path: "/v1/admin/jobs/{id}/cancel", tag: "admin", access: "users:admin",
+		summary: "Cancel a running admin job. The batch in progress is rolled back.",
+		responses: map[int]interface{}{
+			200: jsonResponse("The canceled job.", envelopeSchema("job", ref("Job"))),
+			409: ref("Conflict"),
+		},
+	},
+	{
+		method: http.MethodGet, path: "/v1/admin/export", tag: "admin", access: "users:admin",
+		summary:    "Download a dump of the catalog, gzipped if the client accepts it. Users and tokens aren't included.",
+		parameters: []interface{}{ref("Format")},
+		responses: map[int]interface{}{
+			200: withNDJSON(jsonResponse("The dump. As NDJSON, a movie per line, with the number of movies in the X-Total-Records trailer; an error part way through is sent as a final line with an error field.", ref("Dump")), ref("MovieInput")),
+			409: ref("Conflict"),
+		},
+	},
+	{
+		method: http.MethodPost, path: "/v1/admin/import", tag: "admin", access: "users:admin",
+		summary: "Import a dump from the export endpoint in a single transaction. Movies are matched by title and year.",
+		parameters: []interface{}{
+			queryParam("mode", "string", "What to do with a movie which is already in the database: skip (the default) or overwrite."),
+		},
+		requestBody: jsonBody(ref("Dump")),
+		responses: map[int]interface{}{
+			200: jsonResponse("How many movies were created, updated and skipped.", envelopeSchema("import", objectSchema(map[string]interface{}{
+				"created": integerSchema(),
+				"updated": integerSchema(),
+				"skipped": integerSchema(),
+			}, "created", "updated", "skipped"))),
+			409: ref("Conflict"),
+		},
+	},
+
+	// Current user:
+	{
+		method: http.MethodGet, path: "/v1/me", tag: "me", access: "authenticated",
+		summary:   "Show the current user.",
+		responses: map[int]interface{}{200: jsonResponse("The current user.", envelopeSchema("user", ref("User")))},
+	},
+	{
+		method: http.MethodGet, path: "/v1/me/logins", tag: "me", access: "authenticated",
+		summary:   "List the current user's recent logins.",
+		responses: map[int]interface{}{200: jsonResponse("The recent logins.", envelopeSchema("logins", arraySchema(objectSchema(nil))))},
+	},
+	{
+		method: http.MethodGet, path: "/v1/me/usage", tag: "me", access: "authenticated",
+		summary:   "Show the number of requests the current user made on each of the last 30 days, and their rate limit.",
+		responses: map[int]interface{}{200: ref("Usage")},
+	},
+	{
+		method: http.MethodGet, path: "/v1/me/preferences", tag: "me", access: "authenticated",
+		summary:   "Show the current user's preferences.",
+		responses: map[int]interface{}{200: ref("Preferences")},
+	},
+	{
+		method: http.MethodPatch, path: "/v1/me/preferences", tag: "me", access: "authenticated",
+		summary:     "Update some or all of the current user's preferences.",
+		requestBody: jsonBody(objectSchema(nil)),
+		responses:   map[int]interface{}{200: ref("Preferences")},
+	},
+	{
+		method: http.MethodPut, path: "/v1/me/digest", tag: "me", access: "authenticated",
+		summary:     "Subscribe to or unsubscribe from the daily digest of new movies, optionally limited to some genres.",
+		requestBody: jsonBody(ref("DigestSubscription")),
+		responses:   map[int]interface{}{200: jsonResponse("The digest subscription.", envelopeSchema("digest", ref("DigestSubscription")))},
+	},
+	{
+		method: http.MethodGet, path: "/v1/me/export", tag: "me", access: "authenticated",
+		summary:   "Start building an export of everything stored about the current user.",
+		responses: map[int]interface{}{202: ref("Export")},
+	},
+	{
+		method: http.MethodGet, path: "/v1/me/export/{job_id}", tag: "me", access: "authenticated",
+		summary: "Download an export once it's ready.",
+		responses: map[int]interface{}{
+			200: jsonResponse("The export, as a JSON attachment.", objectSchema(nil)),
+			202: ref("Export"),
+		},
+	},
+	{
+		method: http.MethodGet, path: "/v1/me/searches", tag: "me", access: "authenticated",
+		summary:   "List the current user's saved searches.",
+		responses: map[int]interface{}{200: jsonResponse("The saved searches, oldest first.", envelopeSchema("searches", arraySchema(ref("SavedSearch"))))},
+	},
+	{
+		method: http.MethodPost, path: "/v1/me/searches", tag: "me", access: "authenticated",
+		summary: "Save a movie listing under a name. A user can have up to 20 saved searches.",
+		requestBody: jsonBody(objectSchema(map[string]interface{}{
+			"name":  stringSchema(""),
+			"query": ref("SearchQuery"),
+		}, "name")),
+		responses: map[int]interface{}{201: jsonResponse("The saved search.", envelopeSchema("search", ref("SavedSearch")))},
+	},
+	{
+		method: http.MethodDelete, path: "/v1/me/searches/{id}", tag: "me", access: "authenticated",
+		summary:   "Delete a saved search.",
+		responses: map[int]interface{}{200: ref("Message")},
+	},
+	{
+		method: http.MethodGet, path: "/v1/me/searches/{id}/results", tag: "me", access: "authenticated",
+		summary: "Run a saved search, and list the movies it matches now.",
+		parameters: []interface{}{
+			map[string]interface{}{"name": "page", "in": "query", "description": "The page number, starting at 1.", "schema": map[string]interface{}{"type": "integer", "minimum": 1, "maximum": 10_000_000}},
+			queryParam("facets", "string", "A comma-separated list of facets to count the matching movies by, in metadata.facets: genres, years or both."),
+			ref("RuntimeFormat"),
+		},
+		responses: map[int]interface{}{200: jsonResponse("A page of movies.", envelopeSchema(
+			"movies", arraySchema(ref("Movie")),
+			"metadata", ref("Metadata"),
+		))},
+	},
+	{
+		method: http.MethodGet, path: "/v1/me/reports", tag: "me", access: "authenticated",
+		summary:   "List the reports the current user has made, newest first, with the editors' notes.",
+		responses: map[int]interface{}{200: jsonResponse("The reports.", envelopeSchema("reports", arraySchema(ref("Report"))))},
+	},
+	{
+		method: http.MethodGet, path: "/v1/me/watchlist", tag: "me", access: "authenticated",
+		summary:   "List the movies on the current user's watchlist.",
+		responses: map[int]interface{}{200: jsonResponse("The watchlist, oldest first.", envelopeSchema("watchlist", arraySchema(ref("WatchlistEntry"))))},
+	},
+	{
+		method: http.MethodPost, path: "/v1/me/watchlist", tag: "me", access: "authenticated",
+		summary: "Add a movie to the current user's watchlist. With notify, they're emailed when the movie is updated.",
+		requestBody: jsonBody(objectSchema(map[string]interface{}{
+			"movie_id": integerSchema(),
+			"notify":   map[string]interface{}{"type": "boolean"},
+		}, "movie_id")),
+		responses: map[int]interface{}{201: jsonResponse("The watchlist entry.", envelopeSchema("watchlist_entry", ref("WatchlistEntry")))},
+	},
+	{
+		method: http.MethodPatch, path: "/v1/me/watchlist/{id}", tag: "me", access: "authenticated",
+		summary:     "Choose whether the current user is emailed when a movie on their watchlist is updated.",
+		requestBody: jsonBody(objectSchema(map[string]interface{}{"notify": map[string]interface{}{"type": "boolean"}}, "notify")),
+		responses:   map[int]interface{}{200: jsonResponse("The watchlist entry.", envelopeSchema("watchlist_entry", ref("WatchlistEntry")))},
+	},
+	{
+		method: http.MethodDelete, path: "/v1/me/watchlist/{id}", tag: "me", access: "authenticated",
+		summary:   "Remove a movie from the current user's watchlist.",
+		responses: map[int]interface{}{200: ref("Message")},
+	},
+	{
+		method: http.MethodGet, path: "/v1/watchlist/unsubscribe", tag: "users",
+		summary: "Stop the emails about updates to a movie, from the link in one of them.",
+		parameters: []interface{}{
+			queryParam("token", "string", "The unsubscribe token from the email."),
+			queryParam("movie_id", "integer", "The ID of the movie."),
+		},
+		responses: map[int]interface{}{200: ref("Message")},
+	},
+
+	// Authentication:
+	{
+		method: http.MethodPost, path: "/v1/tokens/authentication", tag: "tokens",
+		summary: "Create an authentication token from an email address and password.",
+		requestBody: jsonBody(objectSchema(map[string]interface{}{
+			"email":    stringSchema("email"),
+			"password": stringSchema("password"),
+		}, "email", "password")),
+		responses: map[int]interface{}{201: ref("AuthenticationToken")},
+	},
+	{
+		method: http.MethodDelete, path: "/v1/tokens/authentication", tag: "tokens", access: "authenticated",
+		summary:   "Revoke the authentication token used to make the request.",
+		responses: map[int]interface{}{200: ref("Message")},
+	},
+
+	// Sign in with Google:
+	{
+		method: http.MethodGet, path: "/v1/auth/google/login", tag: "tokens",
+		summary:   "Redirect to Google to sign in. Only available when Google sign in is configured.",
+		responses: map[int]interface{}{302: map[string]interface{}{"description": "A redirect to Google's consent page."}},
+	},
+	{
+		method: http.MethodGet, path: "/v1/auth/google/callback", tag: "tokens",
+		summary: "Complete signing in with Google and create an authentication token.",
+		parameters: []interface{}{
+			queryParam("code", "string", "The authorization code from Google."),
+			queryParam("state", "string", "The state value sent to Google."),
+		},
+		responses: map[int]interface{}{201: ref("AuthenticationToken")},
+	},
+})
+
+// The v2 schemas which replace the v1 ones in the operations of the routes available
+// under v2.
+var openAPIV2Schemas = map[string]string{
+	"Movie":          "MovieV2",
+	"MovieCandidate": "MovieCandidateV2",
+}
+
+// The withV2Operations() function returns the operations with those of the movie
+// routes added again under v2, which only differ in the representation of the movies
+// they respond with, and in ignoring runtime_format.
+func withV2Operations(operations []apiOperation) []apiOperation {
+	for _, op := range operations {
+		if op.tag != "movies" {
+			continue
+		}
+
+		v2 := op
+		v2.path = "/" + apiV2 + strings.TrimPrefix(op.path, "/"+apiV1)
+		v2.summary = op.summary + " The movies are in their v2 representation."
+
+		v2.parameters = nil
+		for _, param := range op.parameters {
+			if !reflect.DeepEqual(param, ref("RuntimeFormat")) {
+				v2.parameters = append(v2.parameters, param)
+			}
+		}
+
+		v2.responses = make(map[int]interface{}, len(op.responses))
+		for status, response := range op.responses {
+			v2.responses[status] = replaceSchemaRefs(response, openAPIV2Schemas)
+		}
+
+		operations = append(operations, v2)
+	}
+
+	return operations
+}
+
+// The replaceSchemaRefs() function returns a copy of part of the document with its
+// references to the schemas in replacements changed to references to their
+// replacements.
+func replaceSchemaRefs(value interface{}, replacements map[string]string) interface{} {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		copied := make(map[string]interface{}, len(value))
+		for key, v := range value {
+			copied[key] = replaceSchemaRefs(v, replacements)
+		}
+
+		if target, ok := value["$ref"].(string); ok {
+			name := strings.TrimPrefix(target, "#/components/schemas/")
+			if replacement, ok := replacements[name]; ok {
+				copied["$ref"] = ref(replacement)["$ref"]
+			}
+		}
+
+		return copied
+	case []interface{}:
+		copied := make([]interface{}, len(value))
+		for i, v := range value {
+			copied[i] = replaceSchemaRefs(v, replacements)
+		}
+
+		return copied
+	default:
+		return value
+	}
+}
+
+// The openAPISchemas map holds the schemas for the resources which the API returns.
+var openAPISchemas = map[string]interface{}{
+	"Movie": objectSchema(map[string]interface{}{
+		"id":               integerSchema(),
+		"title":            stringSchema(""),
+		"year":             integerSchema(),
+		"runtime":          ref("Runtime"),
+		"genres":           arraySchema(stringSchema("")),
+		"version":          integerSchema(),
+		"updated_at":       stringSchema("date-time"),
+		"awards":           arraySchema(ref("Award")),
+		"external_ratings": arraySchema(ref("ExternalRating")),
+		"plot":             stringSchema(""),
+		"poster":           stringSchema("uri"),
+		"created_by":       nullable(ref("UserRef")),
+		"updated_by":       nullable(ref("UserRef")),
+		"popularity":       map[string]interface{}{"type": "number", "description": "The movie's popularity score, only sent with debug_score=true."},
+	}, "id", "title", "version", "updated_at"),
+	"UserRef": objectSchema(map[string]interface{}{
+		"id":   integerSchema(),
+		"name": stringSchema(""),
+	}, "id", "name"),
+	"MovieInput": objectSchema(map[string]interface{}{
+		"title":            stringSchema(""),
+		"year":             integerSchema(),
+		"runtime":          ref("Runtime"),
+		"genres":           arraySchema(stringSchema("")),
+		"awards":           arraySchema(ref("Award")),
+		"external_ratings": arraySchema(ref("ExternalRating")),
+		"plot":             stringSchema(""),
+		"poster":           stringSchema("uri"),
+	}),
+	"MovieCandidate": objectSchema(map[string]interface{}{
+		"movie": ref("Movie"),
+		"score": map[string]interface{}{"type": "number", "minimum": 0, "maximum": 1},
+	}, "movie", "score"),
+	"MovieV2": objectSchema(map[string]interface{}{
+		"id":               integerSchema(),
+		"title":            stringSchema(""),
+		"year":             integerSchema(),
+		"runtime":          map[string]interface{}{"type": "integer", "minimum": 0, "description": "The runtime in minutes."},
+		"genres":           arraySchema(ref("Genre")),
+		"version":          integerSchema(),
+		"updated_at":       stringSchema("date-time"),
+		"awards":           arraySchema(ref("Award")),
+		"external_ratings": arraySchema(ref("ExternalRating")),
+		"plot":             stringSchema(""),
+		"poster":           stringSchema("uri"),
+		"created_by":       nullable(ref("UserRef")),
+		"updated_by":       nullable(ref("UserRef")),
+		"popularity":       map[string]interface{}{"type": "number", "description": "The movie's popularity score, only sent with debug_score=true."},
+	}, "id", "title", "version", "updated_at"),
+	"Genre": objectSchema(map[string]interface{}{
+		"name": stringSchema(""),
+	}, "name"),
+	"MovieCandidateV2": objectSchema(map[string]interface{}{
+		"movie": ref("MovieV2"),
+		"score": map[string]interface{}{"type": "number", "minimum": 0, "maximum": 1},
+	}, "movie", "score"),
+	"Warning": objectSchema(map[string]interface{}{
+		"code":    map[string]interface{}{"type": "string", "enum": []string{"enrichment_disabled", "enrichment_not_found", "enrichment_failed"}},
+		"message": stringSchema(""),
+	}, "code", "message"),
+	"Award": objectSchema(map[string]interface{}{
+		"name":     stringSchema(""),
+		"category": stringSchema(""),
+		"year":     integerSchema(),
+		"won":      map[string]interface{}{"type": "boolean"},
+	}, "name", "year", "won"),
+	"ExternalRating": objectSchema(map[string]interface{}{
+		"source": stringSchema(""),
+		"score":  map[string]interface{}{"type": "number", "minimum": 0},
+		"scale":  map[string]interface{}{"type": "number", "minimum": 0, "exclusiveMinimum": true, "maximum": 1000},
+	}, "source", "score", "scale"),
+	"Runtime": map[string]interface{}{
+		"oneOf": []interface{}{
+			map[string]interface{}{"type": "string", "pattern": `^\s*\d+(\s+mins)?\s*$`},
+			map[string]interface{}{"type": "integer", "minimum": 0},
+		},
+		"example":     "102 mins",
+		"description": "The runtime in minutes. Responses use the format \"<runtime> mins\", or a plain number with runtime_format=minutes. Requests may use either, or a string containing just the number.",
+	},
+	"User": objectSchema(map[string]interface{}{
+		"id":            integerSchema(),
+		"public_id":     stringSchema("uuid"),
+		"created_at":    stringSchema("date-time"),
+		"name":          stringSchema(""),
+		"username":      stringSchema(""),
+		"email":         stringSchema("email"),
+		"locale":        stringSchema(""),
+		"activated":     map[string]interface{}{"type": "boolean"},
+		"last_login_at": stringSchema("date-time"),
+	}, "id", "public_id", "created_at", "name", "username", "email", "locale", "activated"),
+	"Profile": objectSchema(map[string]interface{}{
+		"id":        stringSchema("uuid"),
+		"username":  stringSchema(""),
+		"joined_at": stringSchema("date-time"),
+	}, "id", "username", "joined_at"),
+	"Role": objectSchema(map[string]interface{}{
+		"id":          integerSchema(),
+		"name":        stringSchema(""),
+		"permissions": arraySchema(stringSchema("")),
+	}, "id", "name", "permissions"),
+	"AuditEntry": objectSchema(map[string]interface{}{
+		"id":            integerSchema(),
+		"occurred_at":   stringSchema("date-time"),
+		"user_id":       integerSchema(),
+		"action":        stringSchema(""),
+		"resource_type": stringSchema(""),
+		"resource_id":   stringSchema(""),
+		"metadata":      objectSchema(nil),
+		"request_id":    stringSchema(""),
+		"ip":            stringSchema(""),
+	}, "id", "occurred_at", "action", "resource_type", "resource_id"),
+	"Dump": objectSchema(map[string]interface{}{
+		"version":     map[string]interface{}{"type": "integer", "enum": []int{dumpVersion}},
+		"exported_at": stringSchema("date-time"),
+		"movies":      arraySchema(ref("MovieInput")),
+	}, "version", "movies"),
+	"Job": objectSchema(map[string]interface{}{
+		"id":         integerSchema(),
+		"kind":       stringSchema(""),
+		"status":     map[string]interface{}{"type": "string", "enum": []string{"running", "completed", "failed", "canceled"}},
+		"cursor":     integerSchema(),
+		"processed":  integerSchema(),
+		"errors":     arraySchema(stringSchema("")),
+		"created_at": stringSchema("date-time"),
+		"updated_at": stringSchema("date-time"),
+	}, "id", "kind", "status", "cursor", "processed", "errors", "created_at", "updated_at"),
+	"Webhook": objectSchema(map[string]interface{}{
+		"id":         integerSchema(),
+		"created_at": stringSchema("date-time"),
+		"url":        stringSchema("uri"),
+		"events":     arraySchema(stringSchema("")),
+		"active":     map[string]interface{}{"type": "boolean"},
+		"version":    integerSchema(),
+	}, "id", "created_at", "url", "events", "active", "version"),
+	"WebhookInput": objectSchema(map[string]interface{}{
+		"url":    stringSchema("uri"),
+		"secret": stringSchema(""),
+		"events": arraySchema(stringSchema("")),
+		"active": map[string]interface{}{"type": "boolean"},
+	}),
+	"WebhookDelivery": objectSchema(map[string]interface{}{
+		"id":          integerSchema(),
+		"created_at":  stringSchema("date-time"),
+		"webhook_id":  integerSchema(),
+		"event_id":    stringSchema(""),
+		"event_type":  stringSchema(""),
+		"attempt":     integerSchema(),
+		"status_code": integerSchema(),
+		"error":       stringSchema(""),
+		"succeeded":   map[string]interface{}{"type": "boolean"},
+		"duration_ms": integerSchema(),
+	}, "id", "created_at", "webhook_id", "event_id", "event_type", "attempt", "succeeded"),
+	"Metadata": objectSchema(map[string]interface{}{
+		"current_page":     integerSchema(),
+		"page_size":        integerSchema(),
+		"first_page":       integerSchema(),
+		"last_page":        integerSchema(),
+		"total_records":    integerSchema(),
+		"truncated":        map[string]interface{}{"type": "boolean"},
+		"returned_records": integerSchema(),
+		"dropped_records":  integerSchema(),
+		"facets": objectSchema(map[string]interface{}{
+			"genres": arraySchema(ref("FacetCount")),
+			"years":  arraySchema(ref("YearBucket")),
+		}),
+	}),
+	"YearBucket": objectSchema(map[string]interface{}{
+		"from":  integerSchema(),
+		"to":    integerSchema(),
+		"count": integerSchema(),
+	}, "from", "to", "count"),
+	"MovieDeletion": objectSchema(map[string]interface{}{
+		"ratings":           integerSchema(),
+		"reviews":           integerSchema(),
+		"watchlist_entries": integerSchema(),
+		"reports":           integerSchema(),
+	}, "ratings", "reviews", "watchlist_entries", "reports"),
+	"DigestSubscription": objectSchema(map[string]interface{}{
+		"enabled": map[string]interface{}{"type": "boolean"},
+		"genres":  arraySchema(stringSchema("")),
+	}, "enabled"),
+	"SavedSearch": objectSchema(map[string]interface{}{
+		"id":         integerSchema(),
+		"name":       stringSchema(""),
+		"query":      ref("SearchQuery"),
+		"created_at": stringSchema("date-time"),
+	}, "id", "name", "query", "created_at"),
+	"SearchQuery": map[string]interface{}{
+		"type":                 "object",
+		"description":          "The query string parameters of a movie listing: title, genres, has_awards, created_by, sort and page_size.",
+		"additionalProperties": stringSchema(""),
+	},
+	"Report": objectSchema(map[string]interface{}{
+		"id":          integerSchema(),
+		"movie_id":    integerSchema(),
+		"movie_title": stringSchema(""),
+		"user_id":     integerSchema(),
+		"field":       stringSchema(""),
+		"message":     stringSchema(""),
+		"status":      stringSchema(""),
+		"resolution":  stringSchema(""),
+		"created_at":  stringSchema("date-time"),
+		"closed_at":   stringSchema("date-time"),
+	}, "id", "movie_id", "movie_title", "user_id", "field", "message", "status", "created_at"),
+	"WatchlistEntry": objectSchema(map[string]interface{}{
+		"movie_id": integerSchema(),
+		"title":    stringSchema(""),
+		"year":     integerSchema(),
+		"notify":   map[string]interface{}{"type": "boolean"},
+		"added_at": stringSchema("date-time"),
+	}, "movie_id", "title", "year", "notify", "added_at"),
+	"FacetCount": objectSchema(map[string]interface{}{
+		"value": stringSchema(""),
+		"count": integerSchema(),
+	}, "value", "count"),
+	"Meta": objectSchema(map[string]interface{}{
+		"request_id":  stringSchema(""),
+		"version":     stringSchema(""),
+		"duration_ms": map[string]interface{}{"type": "number", "description": "How long the server took to process the request, in milliseconds."},
+	}, "version"),
+	"Error": objectSchema(map[string]interface{}{
+		"meta": ref("Meta"),
+		"error": map[string]interface{}{
+			"type":        "string",
+			"description": "A human-readable message, which may be reworded. Match on the code instead.",
+		},
+		"code": map[string]interface{}{
+			"type":        "string",
+			"description": "A stable code identifying the kind of error.",
+			"enum":        errorCodes,
+		},
+		"details": map[string]interface{}{
+			"type":                 "object",
+			"description":          "More about the error: the list of messages for each invalid field for validation_failed, keyed by paths such as genres[1], request_id for server_error and timeout, retry_after and retry_at, and the class for a route class's limit, for rate_limited, supported_types for not_acceptable, and https_url for https_required.",
+			"additionalProperties": true,
+		},
+	}, "error", "code"),
+}
+
+// The openAPIResponses map holds the responses shared between endpoints.
+var openAPIResponses = map[string]interface{}{
+	"Message":             jsonResponse("A confirmation message.", envelopeSchema("message", stringSchema(""))),
+	"Permissions":         jsonResponse("The user's permissions.", envelopeSchema("permissions", arraySchema(stringSchema("")))),
+	"Preferences":         jsonResponse("The user's preferences.", envelopeSchema("preferences", objectSchema(nil))),
+	"AuthenticationToken": jsonResponse("An authentication token.", envelopeSchema("authentication_token", objectSchema(map[string]interface{}{"token": stringSchema(""), "expiry": stringSchema("date-time")}, "token", "expiry"))),
+	"Export": jsonResponse("The export is still being built.", envelopeSchema("export", objectSchema(map[string]interface{}{
+		"id":         stringSchema(""),
+		"created_at": stringSchema("date-time"),
+	}, "id", "created_at"))),
+	"Usage": jsonResponse("The daily request counts, oldest first.", envelopeSchema("usage", objectSchema(map[string]interface{}{
+		"days": arraySchema(objectSchema(map[string]interface{}{
+			"date":     stringSchema("date"),
+			"requests": integerSchema(),
+		}, "date", "requests")),
+		"total": integerSchema(),
+		"rate_limit": objectSchema(map[string]interface{}{
+			"enabled":             map[string]interface{}{"type": "boolean"},
+			"requests_per_second": map[string]interface{}{"type": "number"},
+			"burst":               integerSchema(),
+		}, "enabled", "requests_per_second", "burst"),
+	}, "days", "total", "rate_limit"))),
+	"BadRequest":           errorResponse("The request body or query string is malformed."),
+	"Unauthorized":         errorResponse("The authentication token is missing or invalid."),
+	"Forbidden":            errorResponse("The user isn't activated or doesn't have the required permission."),
+	"NotFound":             errorResponse("The resource could not be found."),
+	"Conflict":             errorResponse("The resource was changed by another request, a request with the same idempotency key is in progress, a movie created with ?strict=true looks like an existing one, or a resource can't be deleted while something else refers to it."),
+	"PayloadTooLarge":      errorResponse("The request body is too large."),
+	"UnsupportedMediaType": errorResponse("The request body's Content-Encoding isn't supported."),
+	"ValidationFailed":     errorResponse("The request failed validation."),
+	"TooManyRequests":      errorResponse("The rate limit was exceeded. The Retry-After header gives the number of seconds to wait."),
+	"ServerError":          errorResponse("The server encountered a problem."),
+	"InvalidConfig":        errorResponse("The reloaded configuration is invalid, so none of it was applied."),
+	"ServiceUnavailable":   errorResponse("The server took too long to process the request, is in maintenance mode, or its database is unavailable."),
+}
+
+// The openAPIDocument() function builds the OpenAPI document from the operations above,
+// adding the error responses which the middleware and helpers can send for each one.
+func openAPIDocument() map[string]interface{} {
+	paths := make(map[string]interface{})
+
+	for _, op := range apiOperations {
+		item, ok := paths[op.path].(map[string]interface{})
+		if !ok {
+			item = make(map[string]interface{})
+			paths[op.path] = item
+		}
+
+		responses := make(map[string]interface{})
+		for status, response := range op.responses {
+			responses[strconv.Itoa(status)] = response
+		}
+
+		addResponse := func(status int, name string) {
+			if _, exists := responses[strconv.Itoa(status)]; !exists {
+				responses[strconv.Itoa(status)] = ref(name)
+			}
+		}
+
+		parameters := append([]interface{}{}, op.parameters...)
+		for _, name := range pathParamNames(op.path) {
+			parameters = append(parameters, pathParam(name))
+		}
+
+		if len(pathParamNames(op.path)) > 0 {
+			addResponse(http.StatusNotFound, "NotFound")
+		}
+
+		if len(op.parameters) > 0 {
+			addResponse(http.StatusUnprocessableEntity, "ValidationFailed")
+		}
+
+		if op.requestBody != nil {
+			addResponse(http.StatusBadRequest, "BadRequest")
+			addResponse(http.StatusRequestEntityTooLarge, "PayloadTooLarge")
+			addResponse(http.StatusUnsupportedMediaType, "UnsupportedMediaType")
+			addResponse(http.StatusUnprocessableEntity, "ValidationFailed")
+		}
+
+		operation := map[string]interface{}{
+			"operationId": operationID(op.method, op.path),
+			"summary":     op.summary,
+			"tags":        []string{op.tag},
+		}
+
+		switch op.access {
+		case "":
+			// A token is optional on public endpoints, but an invalid one is still
+			// rejected by the authenticate() middleware.
+			operation["security"] = []interface{}{map[string]interface{}{}, map[string]interface{}{"bearerAuth": []string{}}}
+			addResponse(http.StatusUnauthorized, "Unauthorized")
+		case "authenticated":
+			operation["security"] = []interface{}{map[string]interface{}{"bearerAuth": []string{}}}
+			addResponse(http.StatusUnauthorized, "Unauthorized")
+		case "activated":
+			operation["security"] = []interface{}{map[string]interface{}{"bearerAuth": []string{}}}
+			operation["description"] = "Requires an activated account."
+			addResponse(http.StatusUnauthorized, "Unauthorized")
+			addResponse(http.StatusForbidden, "Forbidden")
+		default:
+			operation["security"] = []interface{}{map[string]interface{}{"bearerAuth": []string{}}}
+			operation["description"] = fmt.Sprintf("Requires the %q permission.", op.access)
+			// The movies:read routes use requirePermissionOrAnonymousRead().
+			if op.access == "movies:read" {
+				operation["description"] = fmt.Sprintf("Requires the %q permission, unless the server allows anonymous reads.", op.access)
+			}
+			addResponse(http.StatusUnauthorized, "Unauthorized")
+			addResponse(http.StatusForbidden, "Forbidden")
+		}
+
+		addResponse(http.StatusTooManyRequests, "TooManyRequests")
+		addResponse(http.StatusInternalServerError, "ServerError")
+		addResponse(http.StatusServiceUnavailable, "ServiceUnavailable")
+
+		if len(parameters) > 0 {
+			operation["parameters"] = parameters
+		}
+		if op.requestBody != nil {
+			operation["requestBody"] = op.requestBody
+		}
+		operation["responses"] = responses
+
+		item[strings.ToLower(op.method)] = operation
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":       "Open Movie Database API",
+			"description": "A JSON API for retrieving and managing information about movies.",
+			"version":     build.Version,
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas":   openAPISchemas,
+			"responses": openAPIResponses,
+			"parameters": map[string]interface{}{
+				"IdempotencyKey": headerParam("Idempotency-Key", "string", "A unique key which makes it safe to retry the request."),
+				"RuntimeFormat": map[string]interface{}{
+					"name": "runtime_format", "in": "query",
+					"description": "How movie runtimes are sent: \"string\" for \"102 mins\", or \"minutes\" for 102. Defaults to the server's -runtime-format setting.",
+					"schema":      map[string]interface{}{"type": "string", "enum": []string{"string", "minutes"}},
+				},
+				"Format":     queryParam("format", "string", "json (the default) or ndjson, for newline-delimited JSON. NDJSON can also be asked for with an Accept header of application/x-ndjson."),
+				"DebugScore": queryParam("debug_score", "boolean", "Include each movie's popularity score, which a listing is sorted by unless it asks for another sort. It's only sent to users with the movies:write permission."),
+			},
+			"securitySchemes": map[string]interface{}{
+				"bearerAuth": map[string]interface{}{
+					"type":        "http",
+					"scheme":      "bearer",
+					"description": "An authentication token from POST /v1/tokens/authentication.",
+				},
+			},
+		},
+	}
+}
+
+// The checkOpenAPICoverage() function returns an error listing any registered routes
+// which aren't documented in apiOperations. It's run by TestOpenAPICoverage, so that
+// the spec can't fall behind the router unnoticed.
+func checkOpenAPICoverage(routes []string) error {
+	documented := make(map[string]bool, len(apiOperations))
+	for _, op := range apiOperations {
+		documented[op.method+" "+op.path] = true
+	}
+
+	var missing []string
+
+	for _, route := range routes {
+		endpoints, ok := apiRouteAliases[route]
+		if !ok {
+			endpoints = []string{httprouterParamRX.ReplaceAllString(route, "{$1}")}
+		}
+
+		for _, endpoint := range endpoints {
+			if !documented[endpoint] {
+				missing = append(missing, endpoint)
+			}
+		}
+	}
+
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return fmt.Errorf("routes missing from the OpenAPI document: %s", strings.Join(missing, ", "))
+	}
+
+	return nil
+}
+
+var (
+	httprouterParamRX = regexp.MustCompile(`:([a-z_]+)`)
+	openAPIParamRX    = regexp.MustCompile(`\{([a-z_]+)\}`)
+)
+
+// The showOpenAPIHandler() sends the OpenAPI document for the API.
+func (app *application) showOpenAPIHandler(w http.ResponseWriter, r *http.Request) {
+	err := app.writeJSON(w, http.StatusOK, envelope(openAPIDocument()), nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The showDocsHandler() sends the documentation viewer, which loads the OpenAPI
+// document from /v1/openapi.json.
+func (app *application) showDocsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; script-src 'unsafe-inline'; style-src 'unsafe-inline'; connect-src 'self'")
+	w.Write(docsHTML)
+}
+
+func pathParamNames(path string) []string {
+	var names []string
+	for _, match := range openAPIParamRX.FindAllStringSubmatch(path, -1) {
+		names = append(names, match[1])
+	}
+	return names
+}
+
+// The operationID() helper derives an operation ID such as "getV1MoviesId" from the
+// method and path, for SDK generators to name their methods with.
+func operationID(method, path string) string {
+	var sb strings.Builder
+	sb.WriteString(strings.ToLower(method))
+
+	for _, part := range strings.FieldsFunc(path, func(r rune) bool {
+		return r == '/' || r == '{' || r == '}' || r == '_' || r == '.'
+	}) {
+		sb.WriteString(strings.ToUpper(part[:1]) + part[1:])
+	}
+
+	return sb.String()
+}
+
+func ref(name string) map[string]interface{} {
+	section := "schemas"
+	if _, ok := openAPIResponsesNames[name]; ok {
+		section = "responses"
+	} else if name == "IdempotencyKey" || name == "RuntimeFormat" {
+		section = "parameters"
+	}
+
+	return map[string]interface{}{"$ref": "#/components/" + section + "/" + name}
+}
+
+// The names of the shared responses, which ref() uses to tell responses and schemas
+// apart. This can't be derived from openAPIResponses, which refers to ref() itself.
+var openAPIResponsesNames = map[string]struct{}{
+	"Message": {}, "Permissions": {}, "Preferences": {}, "AuthenticationToken": {}, "Export": {}, "Usage": {},
+	"BadRequest": {}, "Unauthorized": {}, "Forbidden": {}, "NotFound": {}, "Conflict": {},
+	"PayloadTooLarge": {}, "UnsupportedMediaType": {}, "ValidationFailed": {},
+	"InvalidConfig": {}, "TooManyRequests": {}, "ServerError": {}, "ServiceUnavailable": {},
+}
+
+func stringSchema(format string) map[string]interface{} {
+	schema := map[string]interface{}{"type": "string"}
+	if format != "" {
+		schema["format"] = format
+	}
+	return schema
+}
+
+func integerSchema() map[string]interface{} {
+	return map[string]interface{}{"type": "integer", "format": "int64"}
+}
+
+func arraySchema(items interface{}) map[string]interface{} {
+	return map[string]interface{}{"type": "array", "items": items}
+}
+
+// The nullable() helper returns a schema which is either schema or null. OpenAPI 3.0
+// ignores the siblings of a $ref, so it's wrapped in an allOf.
+func nullable(schema map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{"allOf": []interface{}{schema}, "nullable": true}
+}
+
+func objectSchema(properties map[string]interface{}, required ...string) map[string]interface{} {
+	schema := map[string]interface{}{"type": "object"}
+	if properties != nil {
+		schema["properties"] = properties
+	}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema
+}
+
+// The envelopeSchema() helper describes a response envelope from alternating key and
+// schema arguments, all of which are required, along with the meta object that every
+// response carries unless -response-meta=false.
+func envelopeSchema(pairs ...interface{}) map[string]interface{} {
+	properties := map[string]interface{}{"meta": ref("Meta")}
+	var required []string
+
+	for i := 0; i < len(pairs); i += 2 {
+		key := pairs[i].(string)
+		properties[key] = pairs[i+1]
+		required = append(required, key)
+	}
+
+	return objectSchema(properties, required...)
+}
+
+// The enrichedMovieSchema() helper describes the response to a request which can
+// enrich a movie. The enriched fields are only listed when enrichment was asked for,
+// and the warnings only when it failed.
+func enrichedMovieSchema() map[string]interface{} {
+	schema := envelopeSchema("movie", ref("Movie"))
+
+	properties := schema["properties"].(map[string]interface{})
+	properties["enriched"] = arraySchema(map[string]interface{}{"type": "string", "enum": []string{"runtime", "genres", "plot", "poster"}})
+	properties["warnings"] = arraySchema(ref("Warning"))
+
+	return schema
+}
+
+func jsonResponse(description string, schema interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"description": description,
+		"content": map[string]interface{}{
+			"application/json": map[string]interface{}{"schema": schema},
+		},
+	}
+}
+
+// The withNDJSON() helper adds NDJSON to the media types of a response, with each line
+// matching the given schema.
+func withNDJSON(response map[string]interface{}, lineSchema interface{}) map[string]interface{} {
+	content, _ := response["content"].(map[string]interface{})
+	content[ndjsonMediaType] = map[string]interface{}{"schema": lineSchema}
+
+	return response
+}
+
+func errorResponse(description string) map[string]interface{} {
+	return jsonResponse(description, ref("Error"))
+}
+
+func jsonBody(schema interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"required": true,
+		"content": map[string]interface{}{
+			"application/json": map[string]interface{}{"schema": schema},
+		},
+	}
+}
+
+func pathParam(name string) map[string]interface{} {
+	schema := stringSchema("")
+	switch name {
+	case "id":
+		schema = integerSchema()
+	case "public_id":
+		schema = stringSchema("uuid")
+	}
+
+	return map[string]interface{}{"name": name, "in": "path", "required": true, "schema": schema}
+}
+
+func queryParam(name, typ, description string) map[string]interface{} {
+	return map[string]interface{}{"name": name, "in": "query", "description": description, "schema": map[string]interface{}{"type": typ}}
+}
+
+func headerParam(name, typ, description string) map[string]interface{} {
+	return map[string]interface{}{"name": name, "in": "header", "description": description, "schema": map[string]interface{}{"type": typ}}
+}
+
+// The filterParams() helper describes the page, page_size and sort query parameters
+// which every list endpoint reads into a data.Filters struct.
+func filterParams() []interface{} {
+	return []interface{}{
+		map[string]interface{}{"name": "page", "in": "query", "description": "The page number, starting at 1.", "schema": map[string]interface{}{"type": "integer", "minimum": 1, "maximum": 10_000_000}},
+		map[string]interface{}{"name": "page_size", "in": "query", "description": "The number of records per page, up to the server's -max-page-size (100 by default).", "schema": map[string]interface{}{"type": "integer", "minimum": 1}},
+		queryParam("sort", "string", "The field to sort by. Prefix it with \"-\" to sort in descending order."),
+	}
+}
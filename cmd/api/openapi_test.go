@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// Every route registered by routes() must be described in the OpenAPI document.
+// TestMain has already called routes(), with the Google routes enabled.
+func TestOpenAPICoverage(t *testing.T) {
+	if len(registeredRoutes) == 0 {
+		t.Fatal("got no registered routes")
+	}
+
+	err := checkOpenAPICoverage(registeredRoutes)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCheckOpenAPICoverage(t *testing.T) {
+	tests := []struct {
+		name        string
+		routes      []string
+		wantMissing string
+	}{
+		{"documented", []string{"GET /v1/healthcheck", "GET /v1/movies/:id"}, ""},
+		{"alias", []string{"DELETE /v1/users/:id"}, ""},
+		{"undocumented", []string{"GET /v1/healthcheck", "POST /v1/nope/:id"}, "POST /v1/nope/{id}"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkOpenAPICoverage(tt.routes)
+
+			switch {
+			case tt.wantMissing == "" && err != nil:
+				t.Errorf("got error %v; want none", err)
+			case tt.wantMissing != "" && (err == nil || !strings.Contains(err.Error(), tt.wantMissing)):
+				t.Errorf("got error %v; want %s reported missing", err, tt.wantMissing)
+			}
+		})
+	}
+}
+
+func TestShowOpenAPI(t *testing.T) {
+	newTestApplication(t)
+	ts := newTestServer(t)
+
+	code, body := ts.do(t, http.MethodGet, "/v1/openapi.json", "", nil)
+	if code != http.StatusOK {
+		t.Fatalf("got status %d; want %d", code, http.StatusOK)
+	}
+
+	paths, _ := body["paths"].(map[string]interface{})
+	if _, ok := paths["/v1/movies/{id}"]; !ok {
+		t.Errorf("got paths %v; want /v1/movies/{id} among them", paths)
+	}
+}
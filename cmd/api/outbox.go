@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/petrostrak/an-open-movie-database/internal/data"
+	"github.com/petrostrak/an-open-movie-database/internal/validator"
+)
+
+// The number of jobs claimed from the outbox at a time, and how long a claimed job is
+// left alone before it's assumed that the process sending it died.
+const (
+	outboxBatchSize = 10
+	outboxLease     = 5 * time.Minute
+)
+
+// Define an outbox type which lets handlers wake the outbox poller after adding a job,
+// instead of the email waiting for the next tick.
+type outbox struct {
+	wake chan struct{}
+}
+
+func newOutbox() *outbox {
+	return &outbox{
+		wake: make(chan struct{}, 1),
+	}
+}
+
+// The notify() method wakes the poller. It never blocks: if the poller has already
+// been woken, it'll pick up the new job anyway.
+func (o *outbox) notify() {
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+}
+
+// The startOutboxPoller() helper starts a background goroutine which sends the emails
+// in the outbox, every cfg.outbox.pollInterval or when woken, until the context is
+// cancelled. It's tracked by the WaitGroup, so graceful shutdown waits for a batch
+// that's being sent. It beats after each batch, so it goes stale if the mail workers
+// stop taking jobs from a full queue.
+func (app *application) startOutboxPoller(ctx context.Context) {
+	app.workers.register(workerOutboxPoller, 1, app.config.outbox.pollInterval, nil)
+	app.wg.Add(1)
+
+	go func() {
+		defer app.wg.Done()
+
+		ticker := time.NewTicker(app.config.outbox.pollInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			case <-app.outbox.wake:
+			}
+
+			app.processOutbox(ctx)
+			app.workers.beat(workerOutboxPoller, 0)
+		}
+	}()
+}
+
+// The processOutbox() helper claims batches of due jobs, and hands them to the mail
+// workers to send, until there are none left. Database errors are logged, and the
+// jobs are tried again on the next tick.
+func (app *application) processOutbox(ctx context.Context) {
+	for ctx.Err() == nil {
+		jobs, err := app.models.EmailJobs.Claim(outboxBatchSize, outboxLease)
+		if err != nil {
+			app.logger.PrintError(err, nil)
+			return
+		}
+
+		for _, job := range jobs {
+			if !app.enqueueEmail(ctx, job) {
+				return
+			}
+		}
+
+		if len(jobs) < outboxBatchSize {
+			return
+		}
+	}
+}
+
+// The sendEmailJob() helper sends a claimed job and records the outcome. It's run by
+// the mail workers. A failed job is retried with exponential backoff, until it runs
+// out of attempts, when it's also recorded in the failed_emails table.
+func (app *application) sendEmailJob(job *data.EmailJob) {
+	err := app.sendOutboxEmail(job)
+	if err == nil {
+		err = app.models.EmailJobs.MarkSent(job.ID)
+		if err != nil {
+			app.logger.PrintError(err, nil)
+		}
+		return
+	}
+
+	properties := map[string]string{
+		"email_job_id": fmt.Sprint(job.ID),
+		"attempts":     fmt.Sprint(job.Attempts),
+	}
+
+	var retryAt time.Time
+	if job.Attempts < app.config.outbox.maxAttempts {
+		retryAt = time.Now().Add(outboxBackoff(job.Attempts))
+		properties["next_retry_at"] = retryAt.Format(time.RFC3339)
+	}
+
+	app.logger.PrintError(err, properties)
+
+	if retryAt.IsZero() {
+		app.recordFailedEmail(job.Recipient, job.Template, err)
+	}
+
+	err = app.models.EmailJobs.MarkFailed(job.ID, err, retryAt)
+	if err != nil {
+		app.logger.PrintError(err, nil)
+	}
+}
+
+// The sendOutboxEmail() helper sends the email for a job, turning a panic into an
+// error so that one bad job doesn't take a mail worker down.
+func (app *application) sendOutboxEmail(job *data.EmailJob) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("%s", p)
+		}
+	}()
+
+	return app.mailer.Send(job.Recipient, job.Locale, job.Template, job.Payload)
+}
+
+// The outboxBackoff() function returns how long to wait before retrying a job which
+// has failed the given number of times: one minute, doubling each time, up to an hour.
+func outboxBackoff(attempts int) time.Duration {
+	backoff := time.Minute
+
+	for i := 1; i < attempts && backoff < time.Hour; i++ {
+		backoff *= 2
+	}
+
+	if backoff > time.Hour {
+		backoff = time.Hour
+	}
+
+	return backoff
+}
+
+// The listOutboxHandler() returns a page of the email jobs in the outbox. By default
+// only the jobs which have failed for good are returned.
+func (app *application) listOutboxHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Status string
+		data.Filters
+	}
+
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	input.Status = app.readString(qs, "status", data.EmailJobFailed)
+
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	input.Filters.Sort = app.readString(qs, "sort", "-id")
+	input.Filters.SortSafelist = []string{"id", "created_at", "next_retry_at", "-id", "-created_at", "-next_retry_at"}
+
+	v.Check(validator.In(input.Status, data.EmailJobPending, data.EmailJobSent, data.EmailJobFailed), "status", validator.Msg("invalid_status"))
+
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	jobs, metadata, err := app.models.EmailJobs.GetAll(input.Status, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	jobs, err = limitPage(app, jobs, &metadata)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"email_jobs": jobs, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
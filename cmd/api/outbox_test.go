@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/petrostrak/an-open-movie-database/internal/data"
+	"github.com/petrostrak/an-open-movie-database/internal/mailer"
+)
+
+// Define a fakeMailer type which records the recipients and data of the emails it's
+// asked to send. If fail is set, every send returns an error, and if release is set, every send waits for it to
+// be closed first.
+type fakeMailer struct {
+	mu      sync.Mutex
+	sent    []string
+	data    []interface{}
+	fail    bool
+	release chan struct{}
+}
+
+func (m *fakeMailer) Send(recipient, locale, templateFile string, data interface{}) error {
+	if m.release != nil {
+		<-m.release
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.fail {
+		return errors.New("smtp: connection refused")
+	}
+
+	m.sent = append(m.sent, recipient)
+	m.data = append(m.data, data)
+
+	return nil
+}
+
+func (m *fakeMailer) count() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return len(m.sent)
+}
+
+// The newOutboxTestApplication() helper returns a test application with the fake
+// mailer, and the given number of email jobs in the outbox.
+func newOutboxTestApplication(t *testing.T, mailer *fakeMailer, jobs int) *application {
+	t.Helper()
+
+	app := newTestApplication(t)
+	app.mailer = mailer
+	app.config.mailer.workers = 2
+	app.config.outbox.pollInterval = time.Hour
+	app.config.outbox.maxAttempts = 1
+
+	for i := 0; i < jobs; i++ {
+		err := app.models.EmailJobs.Insert(&data.EmailJob{
+			Recipient: "alice@example.com",
+			Locale:    data.DefaultLocale,
+			Template:  "user_welcome.tmpl",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return app
+}
+
+// The runOutbox() helper starts the mail workers and the outbox poller, wakes the
+// poller, and waits until done returns true, before shutting everything down in the
+// same order as serve().
+func runOutbox(t *testing.T, app *application, done func() bool) {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	app.startMailWorkers()
+	app.startOutboxPoller(ctx)
+	app.outbox.notify()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for !done() && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	cancel()
+	app.wg.Wait()
+	app.stopMailWorkers()
+}
+
+func emailJobCount(t *testing.T, app *application, status string) int {
+	t.Helper()
+
+	_, metadata, err := app.models.EmailJobs.GetAll(status, data.Filters{Page: 1, PageSize: 100, Sort: "id", SortSafelist: []string{"id"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return metadata.TotalRecords
+}
+
+func TestOutboxSendsThroughMailWorkers(t *testing.T) {
+	mailer := &fakeMailer{}
+	app := newOutboxTestApplication(t, mailer, 25)
+
+	runOutbox(t, app, func() bool {
+		return emailJobCount(t, app, data.EmailJobSent) == 25
+	})
+
+	if got := mailer.count(); got != 25 {
+		t.Errorf("got %d emails sent; want 25", got)
+	}
+
+	if got := emailJobCount(t, app, data.EmailJobSent); got != 25 {
+		t.Errorf("got %d jobs marked sent; want 25", got)
+	}
+}
+
+func TestOutboxMarksFailedJobs(t *testing.T) {
+	mailer := &fakeMailer{fail: true}
+	app := newOutboxTestApplication(t, mailer, 3)
+
+	runOutbox(t, app, func() bool {
+		return emailJobCount(t, app, data.EmailJobFailed) == 3
+	})
+
+	if got := emailJobCount(t, app, data.EmailJobFailed); got != 3 {
+		t.Errorf("got %d jobs marked failed; want 3", got)
+	}
+}
+
+// stopMailWorkers() must wait for the emails which have already been queued.
+func TestStopMailWorkersWaitsForQueuedEmails(t *testing.T) {
+	mailer := &fakeMailer{release: make(chan struct{})}
+	app := newOutboxTestApplication(t, mailer, 0)
+	app.mailQueue = newMailQueue(10)
+
+	app.startMailWorkers()
+
+	for i := int64(1); i <= 5; i++ {
+		if !app.enqueueEmail(context.Background(), &data.EmailJob{ID: i, Recipient: "alice@example.com"}) {
+			t.Fatal("enqueueEmail() returned false")
+		}
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		app.stopMailWorkers()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+		t.Fatal("stopMailWorkers() returned before the queued emails were sent")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	close(mailer.release)
+	<-stopped
+
+	if got := mailer.count(); got != 5 {
+		t.Errorf("got %d emails sent; want 5", got)
+	}
+}
+
+// Define a recordingFailedEmailStore type which records the failed emails inserted.
+type recordingFailedEmailStore struct {
+	mu     sync.Mutex
+	emails []data.FailedEmail
+}
+
+func (s *recordingFailedEmailStore) Insert(email *data.FailedEmail) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.emails = append(s.emails, *email)
+
+	return nil
+}
+
+func (s *recordingFailedEmailStore) recorded() []data.FailedEmail {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]data.FailedEmail(nil), s.emails...)
+}
+
+// Define a flakyMailer type which fails every send for the first failures attempts at
+// each recipient, with an SMTP "try again later" reply, and then sends it.
+type flakyMailer struct {
+	fakeMailer
+	failures int
+	attempts map[string]int
+}
+
+func (m *flakyMailer) Send(recipient, locale, templateFile string, data interface{}) error {
+	m.mu.Lock()
+	m.attempts[recipient]++
+	attempts := m.attempts[recipient]
+	m.mu.Unlock()
+
+	if attempts <= m.failures {
+		return &textproto.Error{Code: 421, Msg: "service not available"}
+	}
+
+	return m.fakeMailer.Send(recipient, locale, templateFile, data)
+}
+
+// An email which fails with a temporary error is retried by the mailer until it's
+// sent, and one which is still failing once the retries and the outbox's attempts have
+// run out is recorded in the failed_emails table.
+func TestOutboxRetriesAndRecordsFailedEmails(t *testing.T) {
+	tests := []struct {
+		name       string
+		failures   int
+		wantSent   int
+		wantFailed int
+	}{
+		{"eventual success", 2, 1, 0},
+		{"dead letter", 3, 0, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			flaky := &flakyMailer{failures: tt.failures, attempts: make(map[string]int)}
+			failed := &recordingFailedEmailStore{}
+
+			app := newOutboxTestApplication(t, nil, 1)
+			app.mailer = mailer.NewRetry(context.Background(), flaky, []time.Duration{0, 0})
+			app.models.FailedEmails = failed
+
+			runOutbox(t, app, func() bool {
+				return emailJobCount(t, app, data.EmailJobSent)+emailJobCount(t, app, data.EmailJobFailed) == 1
+			})
+
+			if got := flaky.count(); got != tt.wantSent {
+				t.Errorf("got %d emails sent; want %d", got, tt.wantSent)
+			}
+
+			emails := failed.recorded()
+			if len(emails) != tt.wantFailed {
+				t.Fatalf("got failed emails %+v; want %d", emails, tt.wantFailed)
+			}
+
+			if tt.wantFailed > 0 && (emails[0].Recipient != "alice@example.com" || emails[0].Template != "user_welcome.tmpl" || !strings.Contains(emails[0].Error, "service not available")) {
+				t.Errorf("got failed email %+v; want the welcome email to alice@example.com and the SMTP error", emails[0])
+			}
+		})
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// The disableEcho() function turns off echoing on a terminal, so that a password isn't
+// shown as it's typed, and returns a function which restores the previous settings.
+// It does nothing if the file isn't a terminal.
+func disableEcho(f *os.File) func() {
+	fd := int(f.Fd())
+
+	termios, err := unix.IoctlGetTermios(fd, unix.TCGETS)
+	if err != nil {
+		return func() {}
+	}
+
+	previous := *termios
+	termios.Lflag &^= unix.ECHO
+
+	if err := unix.IoctlSetTermios(fd, unix.TCSETS, termios); err != nil {
+		return func() {}
+	}
+
+	return func() {
+		unix.IoctlSetTermios(fd, unix.TCSETS, &previous)
+	}
+}
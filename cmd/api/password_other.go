@@ -0,0 +1,11 @@
+//go:build !linux
+
+package main
+
+import "os"
+
+// The disableEcho() function is a no-op outside Linux, so the password is shown as it's
+// typed. Set OMDB_SUPERUSER_PASSWORD to avoid the prompt.
+func disableEcho(f *os.File) func() {
+	return func() {}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/petrostrak/an-open-movie-database/internal/data"
+	"github.com/petrostrak/an-open-movie-database/internal/validator"
+)
+
+// The listUserPermissionsHandler() returns the permission codes held by a user.
+func (app *application) listUserPermissionsHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readUserParam(w, r)
+	if !ok {
+		return
+	}
+
+	permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"permissions": permissions}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The grantUserPermissionsHandler() adds one or more permission codes to a user and
+// returns the user's updated permissions.
+func (app *application) grantUserPermissionsHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readUserParam(w, r)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		Codes []string `json:"codes"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	v.Check(len(input.Codes) > 0, "codes", validator.Msg("permission_codes_min"))
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// Check that every requested code exists, listing any unknown ones in the error
+	// message.
+	known, err := app.models.Permissions.GetAll()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	var unknown []string
+
+	for _, code := range input.Codes {
+		if !known.Include(code) {
+			unknown = append(unknown, code)
+		}
+	}
+
+	v.Check(len(unknown) == 0, "codes", validator.Msg("unknown_permission_codes", "codes", strings.Join(unknown, ", ")))
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Permissions.AddForUser(user.ID, input.Codes...)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.invalidatePermissions(user.ID)
+
+	app.recordAudit(r, data.AuditEntry{
+		Action:       "permissions.grant",
+		ResourceType: "user",
+		ResourceID:   strconv.FormatInt(user.ID, 10),
+		Metadata:     map[string]interface{}{"codes": input.Codes},
+	})
+
+	// Read the permissions back from the primary, as the grant may not have reached
+	// the read replica yet.
+	r = app.contextSetReadPrimary(r)
+
+	permissions, err := app.modelsFor(r).Permissions.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"permissions": permissions}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The revokeUserPermissionHandler() removes a single permission code from a user.
+func (app *application) revokeUserPermissionHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readUserParam(w, r)
+	if !ok {
+		return
+	}
+
+	code := httprouter.ParamsFromContext(r.Context()).ByName("code")
+
+	err := app.models.Permissions.RemoveForUser(user.ID, code)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.invalidatePermissions(user.ID)
+
+	app.recordAudit(r, data.AuditEntry{
+		Action:       "permissions.revoke",
+		ResourceType: "user",
+		ResourceID:   strconv.FormatInt(user.ID, 10),
+		Metadata:     map[string]interface{}{"code": code},
+	})
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"message": "permission successfully revoked"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The readUserParam() helper loads the user identified by the "id" URL parameter. If
+// there's no such user it sends the appropriate error response and returns false.
+func (app *application) readUserParam(w http.ResponseWriter, r *http.Request) (*data.User, bool) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.invalidParamResponse(w, r, err)
+		return nil, false
+	}
+
+	user, err := app.models.Users.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+
+	return user, true
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/petrostrak/an-open-movie-database/internal/data"
+)
+
+// Changing a user's roles or permissions must take effect straight away, even though
+// their permissions are cached.
+func TestPermissionsCacheInvalidation(t *testing.T) {
+	app := newTestApplication(t)
+	app.permissionsCache = data.NewPermissionsCache(time.Hour)
+	ts := newTestServer(t)
+
+	user, token := newTestUser(t, app, "reader", "reader")
+	_, adminToken := newTestUser(t, app, "admin", "admin")
+
+	movie := map[string]interface{}{"title": "Moana", "year": 2016, "runtime": "107 mins", "genres": []string{"animation"}}
+
+	steps := []struct {
+		name     string
+		method   string
+		path     string
+		token    string
+		body     interface{}
+		wantCode int
+	}{
+		{"reader can't create", http.MethodPost, "/v1/movies", token, movie, http.StatusForbidden},
+		{"make editor", http.MethodPut, fmt.Sprintf("/v1/users/%d/roles", user.ID), adminToken, map[string][]string{"roles": {"editor"}}, http.StatusOK},
+		{"editor can create", http.MethodPost, "/v1/movies", token, movie, http.StatusCreated},
+		{"make reader", http.MethodPut, fmt.Sprintf("/v1/users/%d/roles", user.ID), adminToken, map[string][]string{"roles": {"reader"}}, http.StatusOK},
+		{"reader can't create again", http.MethodPost, "/v1/movies", token, movie, http.StatusForbidden},
+		{"grant permission", http.MethodPost, fmt.Sprintf("/v1/users/%d/permissions", user.ID), adminToken, map[string][]string{"codes": {"movies:write"}}, http.StatusOK},
+		{"granted can create", http.MethodPost, "/v1/movies", token, movie, http.StatusCreated},
+		{"revoke permission", http.MethodDelete, fmt.Sprintf("/v1/users/%d/permissions/movies:write", user.ID), adminToken, nil, http.StatusOK},
+		{"revoked can't create", http.MethodPost, "/v1/movies", token, movie, http.StatusForbidden},
+	}
+
+	for _, step := range steps {
+		code, body := ts.do(t, step.method, step.path, step.token, step.body)
+		if code != step.wantCode {
+			t.Fatalf("%s: got status %d; want %d (body %v)", step.name, code, step.wantCode, body)
+		}
+	}
+}
+
+// Run with -race to check that concurrent requests can share the caches.
+func TestCachesConcurrentRequests(t *testing.T) {
+	app := newTestApplication(t)
+	app.permissionsCache = data.NewPermissionsCache(time.Millisecond)
+	app.userCache = data.NewUserCache(2, time.Hour, time.Millisecond)
+	ts := newTestServer(t)
+
+	var tokens []string
+	for i := 0; i < 4; i++ {
+		_, token := newTestUser(t, app, fmt.Sprintf("user%d", i), "reader")
+		tokens = append(tokens, token)
+	}
+
+	var wg sync.WaitGroup
+
+	for _, token := range tokens {
+		wg.Add(1)
+
+		go func(token string) {
+			defer wg.Done()
+
+			for i := 0; i < 20; i++ {
+				code, _ := ts.do(t, http.MethodGet, "/v1/movies", token, nil)
+				if code != http.StatusOK {
+					t.Errorf("got status %d; want %d", code, http.StatusOK)
+					return
+				}
+			}
+		}(token)
+	}
+
+	wg.Wait()
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/petrostrak/an-open-movie-database/internal/data"
+	"github.com/petrostrak/an-open-movie-database/internal/validator"
+)
+
+// The number of movies whose popularity is refreshed by each statement.
+const popularityBatchSize = 500
+
+// Define a viewCounter type which counts the times each movie is viewed, by ID, between
+// refreshes of the popularity scores, so that a view doesn't cost a write.
+type viewCounter struct {
+	mu     sync.Mutex
+	counts map[int64]int64
+}
+
+func newViewCounter() *viewCounter {
+	return &viewCounter{
+		counts: make(map[int64]int64),
+	}
+}
+
+// The add() method counts n views of the movie with the given ID.
+func (vc *viewCounter) add(id, n int64) {
+	vc.mu.Lock()
+	defer vc.mu.Unlock()
+
+	vc.counts[id] += n
+}
+
+// The take() method returns the views counted so far, and starts counting again from
+// zero.
+func (vc *viewCounter) take() map[int64]int64 {
+	vc.mu.Lock()
+	defer vc.mu.Unlock()
+
+	counts := vc.counts
+	vc.counts = make(map[int64]int64)
+
+	return counts
+}
+
+// The startPopularityRefresh() helper starts a background goroutine which refreshes the
+// movies' popularity scores every cfg.popularity.interval, until the context is
+// cancelled. Like the token cleanup, it's tracked by the WaitGroup, and beats on every
+// tick.
+func (app *application) startPopularityRefresh(ctx context.Context) {
+	app.workers.register(workerPopularity, 1, app.config.popularity.interval, nil)
+	app.wg.Add(1)
+
+	go func() {
+		defer app.wg.Done()
+
+		ticker := time.NewTicker(app.config.popularity.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				app.workers.beat(workerPopularity, 0)
+
+				refreshed, err := app.refreshPopularity(ctx, time.Now())
+				if err != nil {
+					app.logger.PrintError(err, nil)
+					continue
+				}
+
+				app.logger.PrintInfo("refreshed movie popularity", map[string]string{
+					"count": strconv.Itoa(refreshed),
+				})
+			}
+		}
+	}()
+}
+
+// The refreshPopularity() helper adds the views counted since the last refresh to the
+// movies, and then scores every movie as of now, popularityBatchSize at a time. It
+// returns the number of movies scored.
+//
+// The views are counted by each instance of the API, so every instance adds its own.
+// Only one scores the movies at a time, though: the others find the advisory lock
+// taken, and score nothing, as they would only repeat the work. If the views can't be
+// added, they're counted again, to be added by the next refresh.
+func (app *application) refreshPopularity(ctx context.Context, now time.Time) (int, error) {
+	views := app.views.take()
+
+	if len(views) > 0 {
+		err := app.models.Movies.AddViews(views)
+		if err != nil {
+			for id, n := range views {
+				app.views.add(id, n)
+			}
+
+			return 0, err
+		}
+	}
+
+	release, acquired, err := app.models.Locks.TryLock(ctx, data.LockPopularity)
+	if err != nil {
+		return 0, err
+	}
+
+	if !acquired {
+		app.logger.PrintInfo("movie popularity is being refreshed by another instance", nil)
+		return 0, nil
+	}
+	defer release()
+
+	// The ratings are normalized by the most rated movie at the start of the refresh,
+	// so that every movie is scored on the same scale.
+	maxRatingMass, err := app.models.Movies.MaxRatingMass()
+	if err != nil {
+		return 0, err
+	}
+
+	score := func(in data.PopularityInput) float64 {
+		return data.PopularityScore(in, maxRatingMass, app.config.popularity.weights, now)
+	}
+
+	var refreshed int
+	var afterID int64
+
+	for ctx.Err() == nil {
+		lastID, count, err := app.models.Movies.RefreshPopularityBatch(afterID, popularityBatchSize, score)
+		if err != nil {
+			return refreshed, err
+		}
+
+		refreshed += count
+
+		if count < popularityBatchSize {
+			break
+		}
+
+		afterID = lastID
+	}
+
+	return refreshed, ctx.Err()
+}
+
+// The readDebugScore() helper reports whether the movies should be sent with their
+// popularity scores: the client asked for them with ?debug_score=true, and has the
+// "movies:write" permission. Anyone else is sent the movies without them, as they
+// would be without the parameter.
+func (app *application) readDebugScore(r *http.Request, qs url.Values, v *validator.Validator) (bool, error) {
+	debug := app.readBool(qs, "debug_score", v)
+	if debug == nil || !*debug {
+		return false, nil
+	}
+
+	user := app.contextGetUser(r)
+	if user.IsAnonymous() {
+		return false, nil
+	}
+
+	permissions, err := app.userPermissions(user.ID)
+	if err != nil {
+		return false, err
+	}
+
+	return permissions.Include("movies:write"), nil
+}
+
+// The withScores() helper returns copies of the movies with their popularity scores
+// set to be sent. The movies are copied as they may be shared, such as by the movie
+// cache.
+func withScores(movies []*data.Movie) []*data.Movie {
+	scored := make([]*data.Movie, len(movies))
+
+	for i, movie := range movies {
+		m := *movie
+		m.Score = &m.Popularity
+		scored[i] = &m
+	}
+
+	return scored
+}
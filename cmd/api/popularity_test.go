@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/petrostrak/an-open-movie-database/internal/data"
+)
+
+// Viewing a movie counts towards its popularity once the scores are refreshed, and the
+// listing is then sorted by popularity when it's the default sort.
+func TestRefreshPopularity(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t)
+
+	app.config.defaultSort = "-popularity"
+
+	_, token := newTestUser(t, app, "reader", "reader")
+
+	var ids []int64
+	for _, title := range []string{"Casablanca", "Moana", "Up"} {
+		movie := &data.Movie{Title: title, Year: 2016, Runtime: 90, Genres: []string{"drama"}}
+
+		err := app.models.Movies.Insert(movie)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ids = append(ids, movie.ID)
+	}
+
+	views := map[int64]int{ids[1]: 3, ids[2]: 1}
+	for id, n := range views {
+		for i := 0; i < n; i++ {
+			code, _ := ts.do(t, http.MethodGet, fmt.Sprintf("/v1/movies/%d", id), token, nil)
+			if code != http.StatusOK {
+				t.Fatalf("got status %d viewing movie %d; want %d", code, id, http.StatusOK)
+			}
+		}
+	}
+
+	// A movie which isn't found isn't counted.
+	ts.do(t, http.MethodGet, "/v1/movies/1000", token, nil)
+
+	refreshed, err := app.refreshPopularity(context.Background(), time.Now())
+	if err != nil || refreshed != 3 {
+		t.Fatalf("got %d movies refreshed and error %v; want 3", refreshed, err)
+	}
+
+	if pending := app.views.take(); len(pending) != 0 {
+		t.Errorf("got views %v left after the refresh; want none", pending)
+	}
+
+	for id, n := range views {
+		movie, err := app.models.Movies.Get(id)
+		if err != nil || movie.Views != int64(n) {
+			t.Errorf("got movie %+v and error %v; want %d views", movie, err, n)
+		}
+	}
+
+	code, body := ts.do(t, http.MethodGet, "/v1/movies", token, nil)
+	if code != http.StatusOK {
+		t.Fatalf("got status %d; want %d", code, http.StatusOK)
+	}
+
+	if got := fmt.Sprint(movieTitles(body)); got != "[Moana Up Casablanca]" {
+		t.Errorf("got movies %s by default; want the most viewed first", got)
+	}
+
+	// The sort still applies when it's asked for.
+	_, body = ts.do(t, http.MethodGet, "/v1/movies?sort=title", token, nil)
+	if got := fmt.Sprint(movieTitles(body)); got != "[Casablanca Moana Up]" {
+		t.Errorf("got movies %s sorted by title; want them in alphabetical order", got)
+	}
+}
+
+// While another instance holds the lock, the views are added but the movies aren't
+// scored.
+func TestRefreshPopularityLeaderElection(t *testing.T) {
+	app := newTestApplication(t)
+
+	movie := &data.Movie{Title: "Moana", Year: 2016, Runtime: 107, Genres: []string{"animation"}}
+
+	err := app.models.Movies.Insert(movie)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app.views.add(movie.ID, 2)
+
+	ctx := context.Background()
+
+	release, acquired, err := app.models.Locks.TryLock(ctx, data.LockPopularity)
+	if err != nil || !acquired {
+		t.Fatalf("got %t and error %v; want the lock", acquired, err)
+	}
+
+	refreshed, err := app.refreshPopularity(ctx, time.Now())
+	if err != nil || refreshed != 0 {
+		t.Errorf("got %d movies refreshed and error %v with the lock held; want none", refreshed, err)
+	}
+
+	release()
+
+	got, err := app.models.Movies.Get(movie.ID)
+	if err != nil || got.Views != 2 || got.Popularity != 0 {
+		t.Errorf("got movie %+v and error %v; want 2 views and no score yet", got, err)
+	}
+
+	refreshed, err = app.refreshPopularity(ctx, time.Now())
+	if err != nil || refreshed != 1 {
+		t.Errorf("got %d movies refreshed and error %v once the lock was released; want 1", refreshed, err)
+	}
+}
+
+// The popularity scores are only sent with ?debug_score=true, to users with the
+// movies:write permission.
+func TestDebugScore(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t)
+
+	_, readerToken := newTestUser(t, app, "reader", "reader")
+	_, editorToken := newTestUser(t, app, "editor", "editor")
+
+	movie := &data.Movie{Title: "Moana", Year: 2016, Runtime: 107, Genres: []string{"animation"}}
+
+	err := app.models.Movies.Insert(movie)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = app.refreshPopularity(context.Background(), time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		token     string
+		query     string
+		wantScore bool
+	}{
+		{"editor", editorToken, "?debug_score=true", true},
+		{"editor without debug_score", editorToken, "", false},
+		{"editor with debug_score=false", editorToken, "?debug_score=false", false},
+		{"reader", readerToken, "?debug_score=true", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, body := ts.do(t, http.MethodGet, fmt.Sprintf("/v1/movies/%d%s", movie.ID, tt.query), tt.token, nil)
+			if code != http.StatusOK {
+				t.Fatalf("got status %d; want %d", code, http.StatusOK)
+			}
+
+			shown, _ := body["movie"].(map[string]interface{})
+			if score, ok := shown["popularity"].(float64); ok != tt.wantScore || (ok && score <= 0) {
+				t.Errorf("got popularity %v shown; want it shown %t", shown["popularity"], tt.wantScore)
+			}
+
+			code, body = ts.do(t, http.MethodGet, "/v1/movies"+tt.query, tt.token, nil)
+			if code != http.StatusOK {
+				t.Fatalf("got status %d listing; want %d", code, http.StatusOK)
+			}
+
+			movies, _ := body["movies"].([]interface{})
+			listed, _ := movies[0].(map[string]interface{})
+			if _, ok := listed["popularity"]; ok != tt.wantScore {
+				t.Errorf("got popularity %v listed; want it listed %t", listed["popularity"], tt.wantScore)
+			}
+		})
+	}
+
+	code, body := ts.do(t, http.MethodGet, "/v1/movies?debug_score=maybe", editorToken, nil)
+	if code != http.StatusUnprocessableEntity {
+		t.Errorf("got status %d for debug_score=maybe; want %d (body %v)", code, http.StatusUnprocessableEntity, body)
+	}
+
+	// The score isn't left on the stored movie.
+	got, err := app.models.Movies.Get(movie.ID)
+	if err != nil || got.Score != nil {
+		t.Errorf("got movie %+v and error %v; want no score on the stored movie", got, err)
+	}
+}
+
+// The movieTitles() helper returns the titles of the movies in a listing's response
+// body.
+func movieTitles(body map[string]interface{}) []string {
+	movies, _ := body["movies"].([]interface{})
+
+	titles := make([]string, len(movies))
+	for i, movie := range movies {
+		m, _ := movie.(map[string]interface{})
+		titles[i], _ = m["title"].(string)
+	}
+
+	return titles
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+
+	"github.com/petrostrak/an-open-movie-database/internal/data"
+	"github.com/petrostrak/an-open-movie-database/internal/validator"
+)
+
+// The showPreferencesHandler() returns the authenticated user's stored preferences.
+func (app *application) showPreferencesHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	preferences, err := app.models.Preferences.Get(user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"preferences": preferences}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The updatePreferencesHandler() merges the supplied preferences into the authenticated
+// user's stored preferences. Keys which aren't supplied are left unchanged.
+func (app *application) updatePreferencesHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	// Decode the body into a map rather than the Preferences struct, so that we can
+	// report unknown keys as validation errors instead of a bad request.
+	var input map[string]json.RawMessage
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	var preferences data.Preferences
+
+	for key, value := range input {
+		switch key {
+		case "default_page_size":
+			if json.Unmarshal(value, &preferences.DefaultPageSize) != nil || preferences.DefaultPageSize == nil {
+				v.AddError(key, validator.Msg("integer"))
+			}
+		case "default_sort":
+			if json.Unmarshal(value, &preferences.DefaultSort) != nil || preferences.DefaultSort == nil {
+				v.AddError(key, validator.Msg("string"))
+			}
+		case "locale":
+			if json.Unmarshal(value, &preferences.Locale) != nil || preferences.Locale == nil {
+				v.AddError(key, validator.Msg("string"))
+			}
+		default:
+			v.AddError(key, validator.Msg("unsupported_preference"))
+		}
+	}
+
+	if data.ValidatePreferences(v, &preferences); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	merged, err := app.models.Preferences.Update(user.ID, &preferences)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"preferences": merged}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The movieListDefaults() helper returns the default page size and sort for a movie
+// listing. These are the user's stored preferences if the client is authenticated and
+// the query string doesn't provide its own values, and 20 and cfg.defaultSort otherwise.
+func (app *application) movieListDefaults(r *http.Request, qs url.Values) (int, string, error) {
+	pageSize, sort := 20, app.config.defaultSort
+
+	user := app.contextGetUser(r)
+	if user.IsAnonymous() || (qs.Get("page_size") != "" && qs.Get("sort") != "") {
+		return pageSize, sort, nil
+	}
+
+	preferences, err := app.models.Preferences.Get(user.ID)
+	if err != nil {
+		switch {
+		// The user may have been deleted since the request was authenticated, in
+		// which case there's nothing stored.
+		case errors.Is(err, data.ErrRecordNotFound):
+			return pageSize, sort, nil
+		default:
+			return 0, "", err
+		}
+	}
+
+	if preferences.DefaultPageSize != nil {
+		pageSize = *preferences.DefaultPageSize
+	}
+
+	if preferences.DefaultSort != nil {
+		sort = *preferences.DefaultSort
+	}
+
+	return pageSize, sort, nil
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/petrostrak/an-open-movie-database/internal/ratelimit"
+	"github.com/petrostrak/an-open-movie-database/internal/redis"
+)
+
+// The enableRateLimits() helper turns on in-memory rate limiting with the given
+// settings for IP addresses and users. The refill rates are tiny, so that the buckets
+// don't refill during a test.
+func enableRateLimits(app *application, ipBurst, userBurst int) {
+	app.config.limiter.enable = true
+	app.config.limiter.rps, app.config.limiter.burst = 0.001, ipBurst
+	app.config.limiter.userRPS, app.config.limiter.userBurst = 0.001, userBurst
+	app.limiters.ip = ratelimit.NewMemory(app.config.limiter.rps, app.config.limiter.burst, ratelimit.MemoryOptions{})
+	app.limiters.user = ratelimit.NewMemory(app.config.limiter.userRPS, app.config.limiter.userBurst, ratelimit.MemoryOptions{})
+	app.live.Store(newDynamicConfig(app.config))
+}
+
+func TestRateLimit(t *testing.T) {
+	tests := []struct {
+		name      string
+		ipBurst   int
+		userBurst int
+		tokens    []string
+		wantCodes []int
+	}{
+		{
+			name:      "anonymous by ip",
+			ipBurst:   2,
+			userBurst: 10,
+			tokens:    []string{"", "", ""},
+			wantCodes: []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests},
+		},
+		{
+			// Invalid tokens are limited before authenticate() looks them up.
+			name:      "invalid tokens by ip",
+			ipBurst:   2,
+			userBurst: 10,
+			tokens:    []string{"AAAAAAAAAAAAAAAAAAAAAAAAAA", "BBBBBBBBBBBBBBBBBBBBBBBBBB", "CCCCCCCCCCCCCCCCCCCCCCCCCC"},
+			wantCodes: []int{http.StatusUnauthorized, http.StatusUnauthorized, http.StatusTooManyRequests},
+		},
+		{
+			// Each user has their own bucket, even from the same IP address.
+			name:      "users by id",
+			ipBurst:   10,
+			userBurst: 1,
+			tokens:    []string{"alice", "alice", "bob"},
+			wantCodes: []int{http.StatusOK, http.StatusTooManyRequests, http.StatusOK},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t)
+			ts := newTestServer(t)
+
+			_, alice := newTestUser(t, app, "alice", "reader")
+			_, bob := newTestUser(t, app, "bob", "reader")
+			users := map[string]string{"alice": alice, "bob": bob}
+
+			enableRateLimits(app, tt.ipBurst, tt.userBurst)
+			t.Cleanup(func() { app.live.Store(newDynamicConfig(config{})) })
+
+			for i, token := range tt.tokens {
+				if users[token] != "" {
+					token = users[token]
+				}
+
+				code, _ := ts.do(t, http.MethodGet, "/v1/healthcheck", token, nil)
+				if code != tt.wantCodes[i] {
+					t.Errorf("request %d: got status %d; want %d", i+1, code, tt.wantCodes[i])
+				}
+			}
+		})
+	}
+}
+
+// Run with -race to check that concurrent requests share the limiters safely. Exactly
+// burst requests should be allowed.
+func TestRateLimitConcurrent(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t)
+
+	_, token := newTestUser(t, app, "alice", "reader")
+
+	enableRateLimits(app, 100, 20)
+	t.Cleanup(func() { app.live.Store(newDynamicConfig(config{})) })
+
+	var (
+		wg      sync.WaitGroup
+		allowed int64
+	)
+
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for j := 0; j < 5; j++ {
+				code, _ := ts.do(t, http.MethodGet, "/v1/healthcheck", token, nil)
+				if code == http.StatusOK {
+					atomic.AddInt64(&allowed, 1)
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	if allowed != 20 {
+		t.Errorf("got %d requests allowed; want 20", allowed)
+	}
+}
+
+// When the Redis store is unreachable, requests are allowed if -limiter-fail-open is
+// set, and refused otherwise.
+func TestRateLimitRedisUnavailable(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	tests := []struct {
+		name     string
+		failOpen bool
+		wantCode int
+	}{
+		{"fail open", true, http.StatusOK},
+		{"fail closed", false, http.StatusInternalServerError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t)
+			ts := newTestServer(t)
+
+			client := redis.NewClient(addr, "", 1, 100*time.Millisecond)
+			t.Cleanup(client.Close)
+
+			app.config.limiter.enable = true
+			app.config.limiter.failOpen = tt.failOpen
+			app.config.limiter.rps, app.config.limiter.burst = 1, 1
+			app.limiters.ip = ratelimit.NewRedis(client, "ratelimit:ip:", 1, 1)
+			app.live.Store(newDynamicConfig(app.config))
+			t.Cleanup(func() {
+				app.config.limiter.failOpen = false
+				app.live.Store(newDynamicConfig(config{}))
+			})
+
+			code, _ := ts.do(t, http.MethodGet, "/v1/healthcheck", "", nil)
+			if code != tt.wantCode {
+				t.Errorf("got status %d; want %d", code, tt.wantCode)
+			}
+		})
+	}
+}
+
+// A client which has used up its write requests can still read, and the 429 response
+// says which class was exceeded. The limits on all routes are high enough not to get in
+// the way.
+func TestRateLimitClasses(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t)
+
+	_, token := newTestUser(t, app, "editor", "editor")
+
+	enableRateLimits(app, 100, 100)
+	app.config.limiter.write = classLimit{rps: 0.001, burst: 1}
+	app.config.limiter.auth = classLimit{rps: 0.001, burst: 1}
+	app.limiters.classes = map[string]ratelimit.RateLimiter{
+		routeClassWrite: ratelimit.NewMemory(0.001, 1, ratelimit.MemoryOptions{}),
+		routeClassAuth:  ratelimit.NewMemory(0.001, 1, ratelimit.MemoryOptions{}),
+	}
+	app.live.Store(newDynamicConfig(app.config))
+	t.Cleanup(func() { app.live.Store(newDynamicConfig(config{})) })
+
+	movie := map[string]interface{}{"title": "Moana", "year": 2016, "runtime": 107, "genres": []string{"animation"}}
+	credentials := map[string]interface{}{"email": "editor@example.com", "password": "wrong password"}
+
+	tests := []struct {
+		name      string
+		method    string
+		path      string
+		body      interface{}
+		wantCode  int
+		wantClass string
+	}{
+		{"first write", http.MethodPost, "/v1/movies", movie, http.StatusCreated, ""},
+		{"second write", http.MethodPost, "/v1/movies", movie, http.StatusTooManyRequests, routeClassWrite},
+		{"read", http.MethodGet, "/v1/movies", nil, http.StatusOK, ""},
+		{"read again", http.MethodGet, "/v1/movies", nil, http.StatusOK, ""},
+		{"first sign in", http.MethodPost, "/v1/tokens/authentication", credentials, http.StatusUnauthorized, ""},
+		{"second sign in", http.MethodPost, "/v1/tokens/authentication", credentials, http.StatusTooManyRequests, routeClassAuth},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, body := ts.do(t, tt.method, tt.path, token, tt.body)
+			if code != tt.wantCode {
+				t.Fatalf("got status %d and body %v; want %d", code, body, tt.wantCode)
+			}
+
+			details, _ := body["details"].(map[string]interface{})
+			if tt.wantClass != "" && details["class"] != tt.wantClass {
+				t.Errorf("got details %v; want the %s class", details, tt.wantClass)
+			}
+		})
+	}
+}
+
+func TestRouteClass(t *testing.T) {
+	tests := []struct {
+		method, pattern, want string
+	}{
+		{http.MethodGet, "/v1/movies", routeClassRead},
+		{http.MethodPost, "/v1/movies", routeClassWrite},
+		{http.MethodDelete, "/v1/movies/:id", routeClassWrite},
+		{http.MethodPost, "/v1/tokens/authentication", routeClassAuth},
+		{http.MethodGet, "/v1/me/export", routeClassWrite},
+	}
+
+	for _, tt := range tests {
+		if got := routeClass(tt.method, tt.pattern); got != tt.want {
+			t.Errorf("%s %s: got class %q; want %q", tt.method, tt.pattern, got, tt.want)
+		}
+	}
+
+	// Every override is for a route which exists, other than those which are only
+	// registered when Google sign in is configured.
+	registered := make(map[string]bool)
+	for _, route := range registeredRoutes {
+		registered[route] = true
+	}
+
+	for route := range routeClassOverrides {
+		if !registered[route] && !strings.Contains(route, "/auth/google/") {
+			t.Errorf("got a class for %s; want a registered route", route)
+		}
+	}
+}
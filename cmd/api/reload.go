@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+
+	conf "github.com/petrostrak/an-open-movie-database/internal/config"
+	"github.com/petrostrak/an-open-movie-database/internal/data"
+	"github.com/petrostrak/an-open-movie-database/internal/jsonlog"
+)
+
+// The dynamicConfig struct holds the settings which can be changed while the server is
+// running. A reload stores a new dynamicConfig in app.live, rather than changing the
+// one in use, so the middleware always sees a consistent set of settings.
+type dynamicConfig struct {
+	limiter struct {
+		enable    bool
+		rps       float64
+		burst     int
+		userRPS   float64
+		userBurst int
+		classes   map[string]classLimit
+	}
+	trustedOrigins  []string
+	maintenanceMode bool
+	anonymousReads  bool
+}
+
+func newDynamicConfig(cfg config) *dynamicConfig {
+	d := &dynamicConfig{
+		trustedOrigins:  cfg.cors.trustedOrigins,
+		maintenanceMode: cfg.maintenanceMode,
+		anonymousReads:  cfg.anonymousReads,
+	}
+
+	d.limiter.enable = cfg.limiter.enable
+	d.limiter.rps = cfg.limiter.rps
+	d.limiter.burst = cfg.limiter.burst
+	d.limiter.userRPS = cfg.limiter.userRPS
+	d.limiter.userBurst = cfg.limiter.userBurst
+	d.limiter.classes = classLimits(cfg)
+
+	return d
+}
+
+// The reloadableSettings are the flags in dynamicConfig, along with -log-level, which is
+// applied to the logger. A change to any other flag, such as -port or -db-dsn, needs a
+// restart.
+var reloadableSettings = map[string]bool{
+	"limiter-enable":          true,
+	"limiter-rps":             true,
+	"limiter-burst":           true,
+	"limiter-user-rps":        true,
+	"limiter-user-burst":      true,
+	"limiter-read-rps":        true,
+	"limiter-read-burst":      true,
+	"limiter-write-rps":       true,
+	"limiter-write-burst":     true,
+	"limiter-auth-rps":        true,
+	"limiter-auth-burst":      true,
+	"limiter-anonymous-rps":   true,
+	"limiter-anonymous-burst": true,
+	"log-level":               true,
+	"cors-trusted-origins":    true,
+	"maintenance-mode":        true,
+	"anonymous-reads":         true,
+}
+
+// The reloadConfig() method reads the configuration again from the command-line
+// arguments, environment variables and config file, and applies the settings which can
+// be changed while the server is running. It returns the names of the settings which
+// were changed, and of those which were changed but need a restart, and so were
+// skipped. Nothing is applied if the new configuration is invalid.
+//
+// The environment of a running process doesn't change, so in practice a reload picks
+// up changes to the config file.
+func (app *application) reloadConfig() (reloaded, skipped []string, err error) {
+	app.reload.mu.Lock()
+	defer app.reload.mu.Unlock()
+
+	// Read the log flags into a logger of our own, so that the level is only changed
+	// once the whole configuration has been checked. -version is defined so that it
+	// can be given on the command line, but it's ignored.
+	var cfg config
+	logger := jsonlog.New(io.Discard, jsonlog.LevelInfo)
+
+	fs := serveFlags(&cfg, logger, flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	fs.Bool("version", false, "")
+
+	err = conf.Load(fs, app.reload.args, "version")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = validateConfig(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Compare the new settings against those in use. The skipped settings keep their
+	// old values, so that they're reported again by the next reload.
+	settings := settingValues(fs, cfg)
+
+	for name, value := range settings {
+		previous := app.reload.settings[name]
+		if value == previous {
+			continue
+		}
+
+		if reloadableSettings[name] {
+			reloaded = append(reloaded, name)
+		} else {
+			skipped = append(skipped, name)
+			settings[name] = previous
+		}
+	}
+
+	if logger.Level() != app.logger.Level() {
+		reloaded = append(reloaded, "log-level")
+	}
+
+	if logger.Format() != app.logger.Format() {
+		skipped = append(skipped, "log-format")
+	}
+
+	sort.Strings(reloaded)
+	sort.Strings(skipped)
+
+	// Change the limits of the existing limiters, rather than replacing them, so that
+	// the clients' buckets are kept.
+	current := app.live.Load()
+
+	if cfg.limiter.rps != current.limiter.rps || cfg.limiter.burst != current.limiter.burst {
+		app.limiters.ip.SetLimits(cfg.limiter.rps, cfg.limiter.burst)
+	}
+
+	if cfg.limiter.userRPS != current.limiter.userRPS || cfg.limiter.userBurst != current.limiter.userBurst {
+		app.limiters.user.SetLimits(cfg.limiter.userRPS, cfg.limiter.userBurst)
+	}
+
+	for class, limits := range classLimits(cfg) {
+		if limiter, ok := app.limiters.classes[class]; ok && limits != current.limiter.classes[class] {
+			limiter.SetLimits(limits.rps, limits.burst)
+		}
+	}
+
+	app.live.Store(newDynamicConfig(cfg))
+	app.logger.SetLevel(logger.Level())
+	app.reload.settings = settings
+
+	// Only the names are logged, as the skipped settings may be secrets.
+	app.logger.PrintInfo("configuration reloaded", map[string]string{
+		"reloaded": strings.Join(reloaded, ","),
+		"skipped":  strings.Join(skipped, ","),
+	})
+
+	return reloaded, skipped, nil
+}
+
+// The reloadOnSIGHUP() helper starts a background goroutine which reloads the
+// configuration whenever the process receives a SIGHUP signal, until the context is
+// cancelled.
+func (app *application) reloadOnSIGHUP(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	go func() {
+		defer signal.Stop(hup)
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-hup:
+				_, _, err := app.reloadConfig()
+				if err != nil {
+					app.logger.PrintError(err, map[string]string{"signal": "hangup"})
+				}
+			}
+		}
+	}()
+}
+
+// The reloadConfigHandler() reloads the configuration, in the same way as sending the
+// process a SIGHUP signal, and returns the names of the settings which were changed
+// and skipped. An invalid configuration is reported with a 422 Unprocessable Entity
+// response, and leaves the settings in use alone.
+func (app *application) reloadConfigHandler(w http.ResponseWriter, r *http.Request) {
+	reloaded, skipped, err := app.reloadConfig()
+	if err != nil {
+		app.invalidConfigResponse(w, r, err)
+		return
+	}
+
+	// Report empty lists as [] rather than null.
+	if reloaded == nil {
+		reloaded = []string{}
+	}
+
+	if skipped == nil {
+		skipped = []string{}
+	}
+
+	app.recordAudit(r, data.AuditEntry{
+		Action:       "config.reload",
+		ResourceType: "config",
+		Metadata:     map[string]interface{}{"reloaded": reloaded, "skipped": skipped},
+	})
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"config": envelope{"reloaded": reloaded, "skipped": skipped}}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	conf "github.com/petrostrak/an-open-movie-database/internal/config"
+	"github.com/petrostrak/an-open-movie-database/internal/jsonlog"
+	"github.com/petrostrak/an-open-movie-database/internal/ratelimit"
+)
+
+// The useConfigFile() helper points the reload at a config file with the given
+// contents, read as if the server had been started with it, and returns a function
+// which replaces them. The log level is turned off in every version of the file, as
+// the tests share the logger.
+func useConfigFile(t *testing.T, app *application, contents string) func(contents string) {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+
+	write := func(contents string) {
+		err := os.WriteFile(path, []byte("log-level: off\n"+contents), 0o600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write(contents)
+
+	var cfg config
+
+	fs := serveFlags(&cfg, jsonlog.New(io.Discard, jsonlog.LevelOff), flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+
+	err := conf.Load(fs, []string{"-config", path})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app.reload.args = []string{"-config", path}
+	app.reload.settings = settingValues(fs, cfg)
+	t.Cleanup(func() { app.reload.args, app.reload.settings = nil, nil })
+
+	return write
+}
+
+func TestReloadConfigLimiter(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t)
+
+	app.limiters.ip = ratelimit.NewMemory(4, 8, ratelimit.MemoryOptions{})
+	app.limiters.user = ratelimit.NewMemory(4, 8, ratelimit.MemoryOptions{})
+	t.Cleanup(func() { app.live.Store(newDynamicConfig(config{})) })
+
+	write := useConfigFile(t, app, "limiter-enable: true\nlimiter-rps: 0.001\nlimiter-burst: 1\n")
+
+	_, _, err := app.reloadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	codes := []int{http.StatusOK, http.StatusTooManyRequests}
+	for i, want := range codes {
+		code, _ := ts.do(t, http.MethodGet, "/v1/healthcheck", "", nil)
+		if code != want {
+			t.Errorf("request %d with the limiter on: got status %d; want %d", i+1, code, want)
+		}
+	}
+
+	// Turn the limiter off, and change the port, which needs a restart.
+	write("limiter-enable: false\nlimiter-rps: 0.001\nlimiter-burst: 1\nport: 5000\n")
+
+	reloaded, skipped, err := app.reloadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Join(reloaded, ",") != "limiter-enable" || strings.Join(skipped, ",") != "port" {
+		t.Errorf("got reloaded %q and skipped %q; want limiter-enable and port", reloaded, skipped)
+	}
+
+	for i := 0; i < 3; i++ {
+		code, _ := ts.do(t, http.MethodGet, "/v1/healthcheck", "", nil)
+		if code != http.StatusOK {
+			t.Errorf("request %d with the limiter off: got status %d; want %d", i+1, code, http.StatusOK)
+		}
+	}
+}
+
+func TestReloadConfigHandler(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t)
+
+	_, adminToken := newTestUser(t, app, "admin", "admin")
+	_, readerToken := newTestUser(t, app, "reader", "reader")
+
+	app.limiters.ip = ratelimit.NewMemory(4, 8, ratelimit.MemoryOptions{})
+	app.limiters.user = ratelimit.NewMemory(4, 8, ratelimit.MemoryOptions{})
+	t.Cleanup(func() { app.live.Store(newDynamicConfig(config{})) })
+
+	write := useConfigFile(t, app, "")
+	write("maintenance-mode: true\n")
+
+	code, _ := ts.do(t, http.MethodPost, "/v1/admin/config/reload", readerToken, nil)
+	if code != http.StatusForbidden {
+		t.Errorf("got status %d reloading without users:admin; want %d", code, http.StatusForbidden)
+	}
+
+	code, body := ts.do(t, http.MethodPost, "/v1/admin/config/reload", adminToken, nil)
+	if code != http.StatusOK {
+		t.Fatalf("got status %d reloading; want %d", code, http.StatusOK)
+	}
+
+	reloaded, _ := body["config"].(map[string]interface{})["reloaded"].([]interface{})
+	if len(reloaded) != 1 || reloaded[0] != "maintenance-mode" {
+		t.Errorf("got %v; want maintenance-mode reloaded", body)
+	}
+
+	// In maintenance mode, only the healthcheck and the reload endpoint are served.
+	code, body = ts.do(t, http.MethodGet, "/v1/movies", readerToken, nil)
+	if code != http.StatusServiceUnavailable || body["code"] != errCodeMaintenance {
+		t.Errorf("got status %d and code %v in maintenance mode; want %d and %s", code, body["code"], http.StatusServiceUnavailable, errCodeMaintenance)
+	}
+
+	code, _ = ts.do(t, http.MethodGet, "/v1/healthcheck", "", nil)
+	if code != http.StatusOK {
+		t.Errorf("got healthcheck status %d in maintenance mode; want %d", code, http.StatusOK)
+	}
+
+	// An invalid configuration is refused, and leaves maintenance mode on.
+	write("maintenance-mode: false\nenv: testing\n")
+
+	code, body = ts.do(t, http.MethodPost, "/v1/admin/config/reload", adminToken, nil)
+	if code != http.StatusUnprocessableEntity || body["code"] != errCodeInvalidConfig {
+		t.Errorf("got status %d and code %v for an invalid config; want %d and %s", code, body["code"], http.StatusUnprocessableEntity, errCodeInvalidConfig)
+	}
+
+	if !app.live.Load().maintenanceMode {
+		t.Error("got maintenance mode turned off by an invalid config")
+	}
+
+	write("maintenance-mode: false\n")
+
+	code, _ = ts.do(t, http.MethodPost, "/v1/admin/config/reload", adminToken, nil)
+	if code != http.StatusOK {
+		t.Fatalf("got status %d reloading; want %d", code, http.StatusOK)
+	}
+
+	code, _ = ts.do(t, http.MethodGet, "/v1/movies", readerToken, nil)
+	if code != http.StatusOK {
+		t.Errorf("got status %d after leaving maintenance mode; want %d", code, http.StatusOK)
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/petrostrak/an-open-movie-database/internal/data"
+	"github.com/petrostrak/an-open-movie-database/internal/validator"
+)
+
+// The createReportHandler() handler for the "POST /v1/movies/:id/reports" endpoint lets
+// an activated user report incorrect data about a movie, such as
+// {"field": "runtime", "message": "actually 142 mins"}, for an editor to look at.
+func (app *application) createReportHandler(w http.ResponseWriter, r *http.Request) {
+	movieID, err := app.readIDParam(r)
+	if err != nil {
+		app.invalidParamResponse(w, r, err)
+		return
+	}
+
+	var input struct {
+		Field   string `json:"field"`
+		Message string `json:"message"`
+	}
+
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	report := &data.Report{
+		MovieID: movieID,
+		UserID:  user.ID,
+		Field:   input.Field,
+		Message: input.Message,
+	}
+
+	v := validator.New()
+
+	if data.ValidateReport(v, report); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Reports.Insert(report)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		case errors.Is(err, data.ErrReportLimit):
+			v.AddError("reports", validator.Msg("reports_max", "n", data.MaxOpenReports))
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/reports/%d", report.ID))
+
+	err = app.writeResponse(w, r, http.StatusCreated, envelope{"report": report}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The listReportsHandler() handler for the "GET /v1/reports" endpoint returns a page of
+// the reports with a status, open by default, for editors to work through.
+func (app *application) listReportsHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Status string
+		data.Filters
+	}
+
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	input.Status = app.readString(qs, "status", data.ReportOpen)
+
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	input.Filters.Sort = app.readString(qs, "sort", "id")
+	input.Filters.SortSafelist = []string{"id", "created_at", "-id", "-created_at"}
+
+	v.Check(validator.In(input.Status, data.ReportOpen, data.ReportResolved, data.ReportDismissed), "status", validator.Msg("invalid_status"))
+
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	reports, metadata, err := app.models.Reports.GetAll(input.Status, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	reports, err = limitPage(app, reports, &metadata)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"reports": reports, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The updateReportHandler() handler for the "PATCH /v1/reports/:id" endpoint resolves
+// or dismisses an open report, with an optional note for the user who made it, or
+// opens a closed report again.
+func (app *application) updateReportHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.invalidParamResponse(w, r, err)
+		return
+	}
+
+	report, err := app.models.Reports.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	var input struct {
+		Status     string `json:"status"`
+		Resolution string `json:"resolution"`
+	}
+
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateReportStatus(v, report.Status, input.Status, input.Resolution); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	from := report.Status
+	report.Status = input.Status
+	report.Resolution = input.Resolution
+
+	err = app.models.Reports.UpdateStatus(report, from)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.recordAudit(r, data.AuditEntry{
+		Action:       "report.update",
+		ResourceType: "report",
+		ResourceID:   strconv.FormatInt(report.ID, 10),
+		Metadata:     map[string]interface{}{"from": from, "to": report.Status},
+	})
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"report": report}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The listCurrentUserReportsHandler() handler for the "GET /v1/me/reports" endpoint
+// returns the reports the authenticated user has made, newest first, so that they can
+// see which have been dealt with and read the editors' notes.
+func (app *application) listCurrentUserReportsHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	reports, err := app.models.Reports.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"reports": reports}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/petrostrak/an-open-movie-database/internal/data"
+)
+
+// The fileReport() helper reports a movie through the API, and returns the report's ID.
+func fileReport(t *testing.T, ts *testServer, token string, movieID int64, field string) int64 {
+	t.Helper()
+
+	code, body := ts.do(t, http.MethodPost, fmt.Sprintf("/v1/movies/%d/reports", movieID), token, map[string]interface{}{"field": field, "message": "this is wrong"})
+	if code != http.StatusCreated {
+		t.Fatalf("got status %d reporting movie %d; want %d (body %v)", code, movieID, http.StatusCreated, body)
+	}
+
+	report, _ := body["report"].(map[string]interface{})
+	id, _ := report["id"].(float64)
+
+	return int64(id)
+}
+
+func TestCreateReportValidation(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t)
+
+	_, token := newTestUser(t, app, "reader", "reader")
+	movieID := seedMovies(t, app, 1)[0]
+
+	tests := []struct {
+		name     string
+		movieID  int64
+		body     map[string]interface{}
+		wantCode int
+		wantKey  string
+	}{
+		{"valid", movieID, map[string]interface{}{"field": "runtime", "message": "actually 142 mins"}, http.StatusCreated, ""},
+		{"unknown field", movieID, map[string]interface{}{"field": "budget", "message": "too low"}, http.StatusUnprocessableEntity, "field"},
+		{"no message", movieID, map[string]interface{}{"field": "year"}, http.StatusUnprocessableEntity, "message"},
+		{"long message", movieID, map[string]interface{}{"field": "year", "message": strings.Repeat("a", 1001)}, http.StatusUnprocessableEntity, "message"},
+		{"missing movie", 9999, map[string]interface{}{"field": "title", "message": "misspelt"}, http.StatusNotFound, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, body := ts.do(t, http.MethodPost, fmt.Sprintf("/v1/movies/%d/reports", tt.movieID), token, tt.body)
+			if code != tt.wantCode {
+				t.Fatalf("got status %d and body %v; want %d", code, body, tt.wantCode)
+			}
+
+			if details, _ := body["details"].(map[string]interface{}); tt.wantKey != "" && details[tt.wantKey] == nil {
+				t.Errorf("got body %v; want an error for %q", body, tt.wantKey)
+			}
+		})
+	}
+}
+
+// Each user can have up to data.MaxOpenReports open reports, and closing one makes room
+// for another.
+func TestReportLimit(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t)
+
+	_, aliceToken := newTestUser(t, app, "alice", "reader")
+	_, bobToken := newTestUser(t, app, "bob", "reader")
+	_, editorToken := newTestUser(t, app, "editor", "editor")
+	movieID := seedMovies(t, app, 1)[0]
+
+	var id int64
+	for i := 0; i < data.MaxOpenReports; i++ {
+		id = fileReport(t, ts, aliceToken, movieID, "runtime")
+	}
+
+	code, body := ts.do(t, http.MethodPost, fmt.Sprintf("/v1/movies/%d/reports", movieID), aliceToken, map[string]interface{}{"field": "year", "message": "one too many"})
+	if details, _ := body["details"].(map[string]interface{}); code != http.StatusUnprocessableEntity || details["reports"] == nil {
+		t.Errorf("got status %d and body %v; want %d with an error for the reports", code, body, http.StatusUnprocessableEntity)
+	}
+
+	// Another user's limit is separate.
+	fileReport(t, ts, bobToken, movieID, "year")
+
+	code, _ = ts.do(t, http.MethodPatch, fmt.Sprintf("/v1/reports/%d", id), editorToken, map[string]interface{}{"status": "dismissed"})
+	if code != http.StatusOK {
+		t.Fatalf("got status %d dismissing a report; want %d", code, http.StatusOK)
+	}
+
+	fileReport(t, ts, aliceToken, movieID, "year")
+}
+
+func TestReportStatusTransitions(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t)
+
+	_, readerToken := newTestUser(t, app, "reader", "reader")
+	_, editorToken := newTestUser(t, app, "editor", "editor")
+	movieID := seedMovies(t, app, 1)[0]
+
+	id := fileReport(t, ts, readerToken, movieID, "runtime")
+	path := fmt.Sprintf("/v1/reports/%d", id)
+
+	code, _ := ts.do(t, http.MethodPatch, path, readerToken, map[string]interface{}{"status": "resolved"})
+	if code != http.StatusForbidden {
+		t.Errorf("got status %d for a reader; want %d", code, http.StatusForbidden)
+	}
+
+	// The steps run in order against the same report.
+	steps := []struct {
+		name       string
+		status     string
+		resolution string
+		wantCode   int
+	}{
+		{"unknown status", "closed", "", http.StatusUnprocessableEntity},
+		{"open to open", "open", "", http.StatusUnprocessableEntity},
+		{"open to resolved", "resolved", "Fixed the runtime, thanks!", http.StatusOK},
+		{"resolved to dismissed", "dismissed", "", http.StatusUnprocessableEntity},
+		{"resolved to resolved", "resolved", "", http.StatusUnprocessableEntity},
+		{"reopened with a note", "open", "again", http.StatusUnprocessableEntity},
+		{"resolved to open", "open", "", http.StatusOK},
+		{"open to dismissed", "dismissed", "It was right all along.", http.StatusOK},
+	}
+
+	for _, step := range steps {
+		code, body := ts.do(t, http.MethodPatch, path, editorToken, map[string]interface{}{"status": step.status, "resolution": step.resolution})
+		if code != step.wantCode {
+			t.Errorf("%s: got status %d and body %v; want %d", step.name, code, body, step.wantCode)
+		}
+	}
+
+	code, body := ts.do(t, http.MethodGet, "/v1/reports?status=dismissed", editorToken, nil)
+	if reports, _ := body["reports"].([]interface{}); code != http.StatusOK || len(reports) != 1 {
+		t.Errorf("got status %d and body %v; want the dismissed report", code, body)
+	}
+
+	code, body = ts.do(t, http.MethodGet, "/v1/reports", editorToken, nil)
+	if reports, _ := body["reports"].([]interface{}); code != http.StatusOK || len(reports) != 0 {
+		t.Errorf("got status %d and body %v; want no open reports", code, body)
+	}
+
+	// The user who made the report can read the editor's note.
+	code, body = ts.do(t, http.MethodGet, "/v1/me/reports", readerToken, nil)
+	reports, _ := body["reports"].([]interface{})
+	if len(reports) != 1 {
+		t.Fatalf("got status %d and body %v; want one report", code, body)
+	}
+
+	report, _ := reports[0].(map[string]interface{})
+	if report["status"] != "dismissed" || report["resolution"] != "It was right all along." || report["movie_title"] != "Movie 1" || report["closed_at"] == nil {
+		t.Errorf("got report %v; want it dismissed with the editor's note", report)
+	}
+}
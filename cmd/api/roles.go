@@ -0,0 +1,111 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/petrostrak/an-open-movie-database/internal/data"
+	"github.com/petrostrak/an-open-movie-database/internal/validator"
+)
+
+// The listRolesHandler() returns every role along with its permission codes.
+func (app *application) listRolesHandler(w http.ResponseWriter, r *http.Request) {
+	roles, err := app.models.Roles.GetAll()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"roles": roles}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The setUserRolesHandler() replaces the set of roles assigned to a user. Sending an
+// empty list removes all of the user's roles.
+func (app *application) setUserRolesHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readUserParam(w, r)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		Roles []string `json:"roles"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	v.Check(input.Roles != nil, "roles", validator.Msg("required"))
+	v.Check(validator.Unique(input.Roles), "roles", validator.Msg("duplicate_values"))
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// Check that every requested role exists, listing any unknown ones in the error
+	// message.
+	roles, err := app.models.Roles.GetAll()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	known := make([]string, 0, len(roles))
+	for _, role := range roles {
+		known = append(known, role.Name)
+	}
+
+	var unknown []string
+
+	for _, name := range input.Roles {
+		if !validator.In(name, known...) {
+			unknown = append(unknown, name)
+		}
+	}
+
+	v.Check(len(unknown) == 0, "roles", validator.Msg("unknown_roles", "roles", strings.Join(unknown, ", ")))
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Roles.SetForUser(user.ID, input.Roles...)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.invalidatePermissions(user.ID)
+
+	app.recordAudit(r, data.AuditEntry{
+		Action:       "roles.set",
+		ResourceType: "user",
+		ResourceID:   strconv.FormatInt(user.ID, 10),
+		Metadata:     map[string]interface{}{"roles": input.Roles},
+	})
+
+	// Read the roles back from the primary, as the change may not have reached the
+	// read replica yet.
+	r = app.contextSetReadPrimary(r)
+
+	names, err := app.modelsFor(r).Roles.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"roles": names}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -1,69 +1,418 @@
 package main
 
 import (
-	"expvar"
 	"net/http"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/julienschmidt/httprouter"
 )
 
 var (
 	router *httprouter.Router
+
+	// The registeredRoutes slice holds the "METHOD pattern" of every route added with
+	// handle(), which TestOpenAPICoverage compares against the OpenAPI document.
+	registeredRoutes []string
+
+	// The routeMethods map holds the methods registered with handle() for each path
+	// pattern, which the router doesn't expose. The routes in apiRouteAliases are
+	// recorded under the patterns of the endpoints they handle instead, as their own
+	// patterns match paths that they send a 404 Not Found for.
+	routeMethods = make(map[string][]string)
 )
 
+// Define the routes which may take longer than -request-timeout. The export download
+// can be large; its timeout stays below the server's WriteTimeout, which would
+// otherwise cut the response off first. The database export and import have no timeout,
+// as the middleware would buffer the dump rather than streaming it; they use the
+// streaming() middleware to keep the server's timeouts from cutting them off instead.
+var requestTimeoutOverrides = []struct {
+	method     string
+	pathPrefix string
+	timeout    time.Duration
+}{
+	{http.MethodGet, "/v1/me/export", 25 * time.Second},
+	{http.MethodGet, "/v1/admin/export", 0},
+	{http.MethodPost, "/v1/admin/import", 0},
+}
+
+// The route classes, which can be given rate limits of their own with the
+// -limiter-read-*, -limiter-write-* and -limiter-auth-* flags. The anonymous class
+// isn't a route's class, but applies on top of it to the requests without a token
+// which requirePermissionOrAnonymousRead() lets through, with -limiter-anonymous-*.
+const (
+	routeClassRead      = "read"
+	routeClassWrite     = "write"
+	routeClassAuth      = "auth"
+	routeClassAnonymous = "anonymous"
+)
+
+// Define the routes whose class isn't the one for their method: the routes which sign
+// users in or up, and the export, which starts a job despite being a GET.
+var routeClassOverrides = map[string]string{
+	"POST /v1/tokens/authentication": routeClassAuth,
+	"POST /v1/users":                 routeClassAuth,
+	"PUT /v1/users/:id":              routeClassAuth,
+	"GET /v1/auth/google/login":      routeClassAuth,
+	"GET /v1/auth/google/callback":   routeClassAuth,
+	"GET /v1/me/export":              routeClassWrite,
+}
+
+// The routeClass() function returns the class of a route: its override if it has one,
+// and otherwise read for GET and HEAD requests and write for any other method.
+func routeClass(method, pattern string) string {
+	if class, ok := routeClassOverrides[method+" "+pattern]; ok {
+		return class
+	}
+
+	switch method {
+	case http.MethodGet, http.MethodHead:
+		return routeClassRead
+	default:
+		return routeClassWrite
+	}
+}
+
 func init() {
 	// Initialize a new httprouter router instance.
 	router = httprouter.New()
 }
 
+// The matchParam() helper only calls the next handler if the named URL parameter has
+// the given value, and otherwise responds as the router does for a request it has no
+// route for.
+func (app *application) matchParam(name, value string, next http.HandlerFunc) http.HandlerFunc {
+	return app.switchParam(name, value, next, app.routeNotMatched)
+}
+
+// The switchParam() helper calls the match handler if the named URL parameter has the
+// given value, and the otherwise handler if it doesn't.
+func (app *application) switchParam(name, value string, match, otherwise http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if httprouter.ParamsFromContext(r.Context()).ByName(name) == value {
+			match.ServeHTTP(w, r)
+			return
+		}
+
+		otherwise.ServeHTTP(w, r)
+	}
+}
+
+// The handle() helper registers a handler with the router, recording the matched
+// route in the request context so that the metrics() middleware can break its
+// counters down by route. The handler is wrapped with the rate limiting for the
+// route's class.
+func (app *application) handle(method, pattern string, handler http.HandlerFunc) {
+	registeredRoutes = append(registeredRoutes, method+" "+pattern)
+
+	patterns := []string{pattern}
+	if endpoints, ok := apiRouteAliases[method+" "+pattern]; ok {
+		patterns = patterns[:0]
+		for _, endpoint := range endpoints {
+			path := strings.TrimPrefix(endpoint, method+" ")
+			patterns = append(patterns, openAPIParamRX.ReplaceAllString(path, ":$1"))
+		}
+	}
+
+	for _, p := range patterns {
+		routeMethods[p] = append(routeMethods[p], method)
+	}
+
+	handler = app.rateLimitClass(routeClass(method, pattern), handler)
+
+	router.HandlerFunc(method, pattern, func(w http.ResponseWriter, r *http.Request) {
+		app.contextSetRoute(r, method+" "+pattern)
+		handler(w, r)
+	})
+}
+
+// The allowedMethods() function returns the methods registered for the patterns which
+// match path, in alphabetical order and including OPTIONS, or nil if none match. A
+// named parameter matches any non-empty segment.
+func allowedMethods(path string) []string {
+	segments := strings.Split(path, "/")
+	found := make(map[string]bool)
+
+	for pattern, methods := range routeMethods {
+		if !matchPattern(strings.Split(pattern, "/"), segments) {
+			continue
+		}
+
+		for _, method := range methods {
+			found[method] = true
+		}
+	}
+
+	if len(found) == 0 {
+		return nil
+	}
+
+	found[http.MethodOptions] = true
+
+	allowed := make([]string, 0, len(found))
+	for method := range found {
+		allowed = append(allowed, method)
+	}
+	sort.Strings(allowed)
+
+	return allowed
+}
+
+// The matchPattern() function reports whether the segments of a path match those of a
+// route pattern.
+func matchPattern(pattern, segments []string) bool {
+	if len(pattern) != len(segments) {
+		return false
+	}
+
+	for i, segment := range pattern {
+		if strings.HasPrefix(segment, ":") {
+			if segments[i] == "" {
+				return false
+			}
+			continue
+		}
+
+		if segment != segments[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// The routeNotMatched() method handles the requests which no route takes, whether the
+// router found no handler for them or a handler registered with matchParam() turned
+// them away. If routes are registered for the path with other methods, it sends a 405
+// Method Not Allowed response, or a 204 No Content response to an OPTIONS request,
+// with an Allow header listing them. Otherwise, it sends a 404 Not Found response.
+//
+// The Allow header replaces the one the router sets, which it works out from the
+// routes' patterns, so that it doesn't list the methods of the routes in
+// apiRouteAliases for paths which they don't handle.
+func (app *application) routeNotMatched(w http.ResponseWriter, r *http.Request) {
+	allowed := allowedMethods(r.URL.Path)
+
+	// If the method is among those registered for the path, the route for it turned
+	// the request away itself, and there's no other method to suggest.
+	registered := false
+	for _, method := range allowed {
+		registered = registered || (method == r.Method && method != http.MethodOptions)
+	}
+
+	if len(allowed) == 0 || registered {
+		w.Header().Del("Allow")
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	app.methodNotAllowedResponse(w, r)
+}
+
 // Update the routes() to return a http.Handler instead of a *httprouter.Router.
 func (app *application) routes() http.Handler {
 
-	// Convert the notFoundResponse() helper to a http.Handler using the
-	// http.HandlerFunc() adapter, and then set it as the custom error
-	// handler for 404 Not Found responses.
-	router.NotFound = http.HandlerFunc(app.notFoundResponse)
+	// Use the routeNotMatched() helper as the custom error handler for 404 Not Found
+	// and 405 Method Not Allowed responses, and for OPTIONS requests, so that they all
+	// agree on which methods a path has.
+	router.NotFound = http.HandlerFunc(app.routeNotMatched)
+	router.MethodNotAllowed = http.HandlerFunc(app.routeNotMatched)
+	router.GlobalOPTIONS = http.HandlerFunc(app.routeNotMatched)
+
+	// Routes are registered under the versions of the API they're available in. Most
+	// are only available under v1; the movies are under v2 too, in their v2
+	// representation.
+	v1 := app.versions(apiV1)
+	movies := app.versions(apiV1, apiV2)
 
-	// Convert the methodNotAllowedResponse() helper to a http.Handler and see
-	// it as the custom error handler  for 405 Method Not Allowed responses.
-	router.MethodNotAllowed = http.HandlerFunc(app.methodNotAllowedResponse)
+	v1.handle(http.MethodGet, "/healthcheck", app.healthcheckHandler)
 
-	router.HandlerFunc(http.MethodGet, "/v1/healthcheck", app.healthcheckHandler)
+	// API documentation:
+	v1.handle(http.MethodGet, "/openapi.json", app.showOpenAPIHandler)
+	v1.handle(http.MethodGet, "/docs", app.showDocsHandler)
 
 	// Register the relevant methods, URL patterns and handler functions for our
-	// endpoints using the HandlerFunc() method. Note that http.MethodGet and
-	// http.MethodPost are constants which equate to the strings "GET" and "POST"
-	// respectively.
+	// endpoints using the handle() method of their version group. Note that
+	// http.MethodGet and http.MethodPost are constants which equate to the strings
+	// "GET" and "POST" respectively.
 	//
-	// Use the requireActivatedUser() middleware on our /v1/movies** endpoints
+	// Use the requireActivatedUser() middleware on our /v1/movies** endpoints. The
+	// catalog's read-only routes are open to clients without a token too, when
+	// -anonymous-reads is set.
 	//
 	// Movies:
-	router.HandlerFunc(http.MethodGet, "/v1/movies", app.requirePermission("movies:read", app.listMoviesHandler))
-	router.HandlerFunc(http.MethodPost, "/v1/movies", app.requirePermission("movies:write", app.createMovieHandler))
-	router.HandlerFunc(http.MethodGet, "/v1/movies/:id", app.requirePermission("movies:read", app.showMovieHandler))
-	router.HandlerFunc(http.MethodPatch, "/v1/movies/:id", app.requirePermission("movies:write", app.updateMovieHandler))
-	router.HandlerFunc(http.MethodDelete, "/v1/movies/:id", app.requirePermission("movies:write", app.deleteMovieHandler))
+	movies.handle(http.MethodGet, "/movies", app.requirePermissionOrAnonymousRead("movies:read", app.listMoviesHandler))
+	movies.handle(http.MethodPost, "/movies", app.requirePermission("movies:write", app.idempotent(app.createMovieHandler)))
+	// httprouter doesn't allow a static segment and a named parameter in the same
+	// position for the same method, so "POST /v1/movies/validate" and "POST
+	// /v1/movies/duplicates" are registered as the :id route, next to "POST
+	// /v1/movies/:id/reports" and "POST /v1/movies/:id/enrich", and likewise for v2.
+	movies.handle(http.MethodPost, "/movies/:id", app.switchParam("id", "validate",
+		app.requirePermission("movies:write", app.validateMovieHandler),
+		app.matchParam("id", "duplicates", app.requirePermission("movies:write", app.findDuplicatesHandler)),
+	))
+	movies.handle(http.MethodGet, "/movies/:id", app.requirePermissionOrAnonymousRead("movies:read", app.showMovieHandler))
+	movies.handle(http.MethodPatch, "/movies/:id", app.requirePermission("movies:write", app.updateMovieHandler))
+	movies.handle(http.MethodDelete, "/movies/:id", app.requirePermission("movies:write", app.deleteMovieHandler))
+	movies.handle(http.MethodPost, "/movies/:id/enrich", app.requirePermission("movies:write", app.enrichMovieHandler))
+
+	// Reports of incorrect movie data:
+	v1.handle(http.MethodPost, "/movies/:id/reports", app.requireActivatedUser(app.createReportHandler))
+	v1.handle(http.MethodGet, "/reports", app.requirePermission("movies:write", app.listReportsHandler))
+	v1.handle(http.MethodPatch, "/reports/:id", app.requirePermission("movies:write", app.updateReportHandler))
 
 	// Users:
-	router.HandlerFunc(http.MethodPost, "/v1/users", app.registerUserHandler)
-	router.HandlerFunc(http.MethodPut, "/v1/users/activated", app.activateUserHandler)
+	v1.handle(http.MethodPost, "/users", app.idempotent(app.registerUserHandler))
+	// httprouter doesn't allow a static segment and a named parameter in the same
+	// position for the same method, so "PUT /v1/users/activated" is registered as
+	// the :id route and only matches when the parameter is literally "activated".
+	v1.handle(http.MethodPut, "/users/:id", app.matchParam("id", "activated", app.activateUserHandler))
+
+	// "DELETE /v1/users/me" deletes the caller's own account, and any other ID is
+	// the admin variant. These share a route for the same reason as above.
+	v1.handle(http.MethodDelete, "/users/:id", app.switchParam("id", "me",
+		app.requireAuthenticatedUser(app.deleteCurrentUserHandler),
+		app.requirePermission("users:admin", app.deleteUserHandler),
+	))
+
+	// "GET /v1/users/username/:username" and "GET /v1/users/public/:public_id" return
+	// a public profile, and share a route with "GET /v1/users/:id/permissions" and
+	// "GET /v1/users/:id/usage" for the same reason again.
+	v1.handle(http.MethodGet, "/users/:id/:resource", app.switchParam("id", "username",
+		app.showUserProfileHandler,
+		app.switchParam("id", "public",
+			app.showUserPublicProfileHandler,
+			app.switchParam("resource", "permissions",
+				app.requirePermission("users:admin", app.listUserPermissionsHandler),
+				app.matchParam("resource", "usage", app.requirePermission("users:admin", app.showUserUsageHandler)),
+			),
+		),
+	))
+
+	// User permissions:
+	v1.handle(http.MethodPost, "/users/:id/permissions", app.requirePermission("users:admin", app.grantUserPermissionsHandler))
+	v1.handle(http.MethodDelete, "/users/:id/permissions/:code", app.requirePermission("users:admin", app.revokeUserPermissionHandler))
+
+	// Roles:
+	v1.handle(http.MethodGet, "/roles", app.requirePermission("users:admin", app.listRolesHandler))
+	v1.handle(http.MethodPut, "/users/:id/roles", app.requirePermission("users:admin", app.setUserRolesHandler))
+
+	// Audit log:
+	v1.handle(http.MethodGet, "/audit", app.requirePermission("users:admin", app.listAuditHandler))
+
+	// Webhooks:
+	v1.handle(http.MethodGet, "/webhooks", app.requirePermission("users:admin", app.listWebhooksHandler))
+	v1.handle(http.MethodPost, "/webhooks", app.requirePermission("users:admin", app.createWebhookHandler))
+	v1.handle(http.MethodGet, "/webhooks/:id", app.requirePermission("users:admin", app.showWebhookHandler))
+	v1.handle(http.MethodPatch, "/webhooks/:id", app.requirePermission("users:admin", app.updateWebhookHandler))
+	v1.handle(http.MethodDelete, "/webhooks/:id", app.requirePermission("users:admin", app.deleteWebhookHandler))
+	v1.handle(http.MethodGet, "/webhooks/:id/deliveries", app.requirePermission("users:admin", app.listWebhookDeliveriesHandler))
+
+	// Email outbox:
+	v1.handle(http.MethodGet, "/admin/outbox", app.requirePermission("users:admin", app.listOutboxHandler))
+
+	// Configuration:
+	v1.handle(http.MethodPost, "/admin/config/reload", app.requirePermission("users:admin", app.reloadConfigHandler))
+
+	// Admin jobs:
+	v1.handle(http.MethodPost, "/admin/movies/reindex", app.requirePermission("users:admin", app.reindexMoviesHandler))
+	v1.handle(http.MethodGet, "/admin/jobs/:id", app.requirePermission("users:admin", app.showJobHandler))
+	v1.handle(http.MethodPost, "/admin/jobs/:id/cancel", app.requirePermission("users:admin", app.cancelJobHandler))
+
+	// Database export and import:
+	v1.handle(http.MethodGet, "/admin/export", app.requirePermission("users:admin", app.streaming(app.exportDatabaseHandler)))
+	v1.handle(http.MethodPost, "/admin/import", app.requirePermission("users:admin", app.streaming(app.importDatabaseHandler)))
+
+	// Current user:
+	v1.handle(http.MethodGet, "/me", app.requireAuthenticatedUser(app.showCurrentUserHandler))
+	v1.handle(http.MethodGet, "/me/logins", app.requireAuthenticatedUser(app.listCurrentUserLoginsHandler))
+	v1.handle(http.MethodGet, "/me/usage", app.requireAuthenticatedUser(app.showCurrentUserUsageHandler))
+	v1.handle(http.MethodGet, "/me/preferences", app.requireAuthenticatedUser(app.showPreferencesHandler))
+	v1.handle(http.MethodPatch, "/me/preferences", app.requireAuthenticatedUser(app.updatePreferencesHandler))
+	v1.handle(http.MethodPut, "/me/digest", app.requireAuthenticatedUser(app.updateDigestHandler))
+	v1.handle(http.MethodGet, "/me/export", app.requireAuthenticatedUser(app.createExportHandler))
+	v1.handle(http.MethodGet, "/me/export/:job_id", app.requireAuthenticatedUser(app.showExportHandler))
+	v1.handle(http.MethodGet, "/me/searches", app.requireAuthenticatedUser(app.listSearchesHandler))
+	v1.handle(http.MethodPost, "/me/searches", app.requireAuthenticatedUser(app.createSearchHandler))
+	v1.handle(http.MethodDelete, "/me/searches/:id", app.requireAuthenticatedUser(app.deleteSearchHandler))
+	v1.handle(http.MethodGet, "/me/searches/:id/results", app.requireAuthenticatedUser(app.showSearchResultsHandler))
+	v1.handle(http.MethodGet, "/me/reports", app.requireAuthenticatedUser(app.listCurrentUserReportsHandler))
+	v1.handle(http.MethodGet, "/me/watchlist", app.requireAuthenticatedUser(app.listWatchlistHandler))
+	v1.handle(http.MethodPost, "/me/watchlist", app.requireAuthenticatedUser(app.addToWatchlistHandler))
+	v1.handle(http.MethodPatch, "/me/watchlist/:id", app.requireAuthenticatedUser(app.updateWatchlistHandler))
+	v1.handle(http.MethodDelete, "/me/watchlist/:id", app.requireAuthenticatedUser(app.removeFromWatchlistHandler))
+
+	// The unsubscribe link in the watchlist emails, which works without signing in.
+	v1.handle(http.MethodGet, "/watchlist/unsubscribe", app.unsubscribeWatchlistHandler)
 
 	// Authentication
-	router.HandlerFunc(http.MethodPost, "/v1/tokens/authentication", app.createAuthenticationTokenHandler)
+	v1.handle(http.MethodPost, "/tokens/authentication", app.createAuthenticationTokenHandler)
+	v1.handle(http.MethodDelete, "/tokens/authentication", app.requireAuthenticatedUser(app.deleteAuthenticationTokenHandler))
 
-	// Metrics:
-	//
-	// go run ./cmd/api -limiter-enabled=false -port=4000
-	router.Handler(http.MethodGet, "/debug/vars", expvar.Handler())
+	// Sign in with Google. These are only registered when the OAuth client
+	// credentials have been configured.
+	if app.google.Enabled() {
+		v1.handle(http.MethodGet, "/auth/google/login", app.googleLoginHandler)
+		v1.handle(http.MethodGet, "/auth/google/callback", app.googleCallbackHandler)
+	}
 
 	// Wrap the router with the panic recovery middleware.
 	//
-	// Wrap the router with the rateLimit() middleware.
+	// Wrap the router with the rate limiting middleware.
 	//
 	// Use the authenticate() middleware on all requests.
 	//
 	// Add the enebleCORS() middleware
 	//
 	// Use the metrics() middleware at the start of the chain.
-	return app.metrics(app.recoverPanic(app.enableCORS(app.rateLimit(app.authenticate(router)))))
+	//
+	// The rateLimitIP() middleware comes before authenticate(), so that token lookups
+	// are limited too, and rateLimitUser() after it, so that it can limit
+	// authenticated users by user ID.
+	//
+	// The requestID() middleware comes before recoverPanic(), so that the response
+	// for a panic carries the request ID too, and before logRequests(), so that the
+	// log entries do.
+	//
+	// The requestTimeout() middleware comes straight after recoverPanic(), which
+	// it passes handler panics back to, so that the authentication lookup is covered
+	// by the timeout too.
+	//
+	// The maintenance() middleware comes after enableCORS(), so that browsers can
+	// read its responses, and before the rate limiting, so that requests refused
+	// during maintenance don't use up the clients' tokens.
+	//
+	// The meterUsage() middleware comes last, so that it only counts the requests
+	// which got past the rate limiters, other than the limits of the route classes,
+	// which are checked once the route is known.
+	//
+	// The enforceHTTPS() middleware comes before requestTimeout(), so that plain HTTP
+	// requests are turned away before anything else is done with them.
+	//
+	// The methodOverride() middleware comes straight before the router, so that the
+	// router sees the overridden method and the user is known.
+	api := app.metrics(app.requestID(app.logRequests(app.recoverPanic(app.enforceHTTPS(app.requestTimeout(app.enableCORS(app.maintenance(app.rateLimitIP(app.authenticate(app.rateLimitUser(app.meterUsage(app.methodOverride(router)))))))))))))
+
+	// The /debug/ endpoints get their own chain, without the metrics(),
+	// requestTimeout() and rate limiting middleware, so that scraping the metrics or
+	// capturing a profile doesn't skew the metrics or trip the limiter.
+	debug := app.requestID(app.recoverPanic(app.enforceHTTPS(app.debugRoutes())))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/debug/") {
+			debug.ServeHTTP(w, r)
+			return
+		}
+
+		api.ServeHTTP(w, r)
+	})
 }
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// Pin down the response for known and unknown paths with each kind of method: the
+// router's own 404 and 405 responses, those of the routes registered with matchParam(),
+// OPTIONS requests, and malformed IDs.
+func TestRouterErrors(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t)
+
+	_, readerToken := newTestUser(t, app, "reader", "reader")
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		wantStatus int
+		wantAllow  string
+		wantCode   string
+		wantDetail string
+	}{
+		{"known method", http.MethodGet, "/v1/movies", http.StatusOK, "", "", ""},
+		{"unknown method", http.MethodPut, "/v1/movies", http.StatusMethodNotAllowed, "GET, OPTIONS, POST", errCodeMethodNotAllowed, ""},
+		{"head", http.MethodHead, "/v1/movies", http.StatusMethodNotAllowed, "GET, OPTIONS, POST", "", ""},
+		{"options", http.MethodOptions, "/v1/movies", http.StatusNoContent, "GET, OPTIONS, POST", "", ""},
+		{"options with id", http.MethodOptions, "/v1/movies/1", http.StatusNoContent, "DELETE, GET, OPTIONS, PATCH", "", ""},
+		{"options alias", http.MethodOptions, "/v1/movies/validate", http.StatusNoContent, "DELETE, GET, OPTIONS, PATCH, POST", "", ""},
+		{"unknown method with id", http.MethodPut, "/v1/movies/1", http.StatusMethodNotAllowed, "DELETE, GET, OPTIONS, PATCH", errCodeMethodNotAllowed, ""},
+		{"alias method with id", http.MethodPost, "/v1/movies/1", http.StatusMethodNotAllowed, "DELETE, GET, OPTIONS, PATCH", errCodeMethodNotAllowed, ""},
+		{"alias method with other value", http.MethodPut, "/v1/users/1", http.StatusMethodNotAllowed, "DELETE, OPTIONS", errCodeMethodNotAllowed, ""},
+		{"options alias value", http.MethodOptions, "/v1/users/activated", http.StatusNoContent, "DELETE, OPTIONS, PUT", "", ""},
+		{"malformed id", http.MethodGet, "/v1/movies/abc", http.StatusNotFound, "", errCodeNotFound, "id"},
+		{"zero id", http.MethodGet, "/v1/movies/0", http.StatusNotFound, "", errCodeNotFound, "id"},
+		{"extra segment", http.MethodGet, "/v1/movies/1/extra", http.StatusNotFound, "", errCodeNotFound, ""},
+		{"unknown resource", http.MethodGet, "/v1/users/1/nope", http.StatusNotFound, "", errCodeNotFound, ""},
+		{"unknown path", http.MethodGet, "/v1/nope", http.StatusNotFound, "", errCodeNotFound, ""},
+		{"unknown path and method", http.MethodDelete, "/v1/nope", http.StatusNotFound, "", errCodeNotFound, ""},
+		{"options unknown path", http.MethodOptions, "/v1/nope", http.StatusNotFound, "", errCodeNotFound, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(tt.method, ts.URL+tt.path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Authorization", "Bearer "+readerToken)
+
+			res, err := ts.Client().Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer res.Body.Close()
+
+			if res.StatusCode != tt.wantStatus {
+				t.Errorf("got status %d; want %d", res.StatusCode, tt.wantStatus)
+			}
+
+			if allow := res.Header.Get("Allow"); allow != tt.wantAllow {
+				t.Errorf("got Allow %q; want %q", allow, tt.wantAllow)
+			}
+
+			if tt.wantCode == "" {
+				return
+			}
+
+			var body struct {
+				Code    string                 `json:"code"`
+				Details map[string]interface{} `json:"details"`
+			}
+
+			err = json.NewDecoder(res.Body).Decode(&body)
+			if err != nil && err != io.EOF {
+				t.Fatal(err)
+			}
+
+			if body.Code != tt.wantCode {
+				t.Errorf("got code %q; want %q", body.Code, tt.wantCode)
+			}
+
+			if _, ok := body.Details[tt.wantDetail]; tt.wantDetail != "" && !ok {
+				t.Errorf("got details %v; want %q", body.Details, tt.wantDetail)
+			}
+		})
+	}
+}
+
+// The path of every route other than the aliases, with its parameters filled in,
+// allows the route's method.
+func TestAllowedMethods(t *testing.T) {
+	for _, route := range registeredRoutes {
+		if _, ok := apiRouteAliases[route]; ok {
+			continue
+		}
+
+		method, pattern, _ := strings.Cut(route, " ")
+
+		path := httprouterParamRX.ReplaceAllString(pattern, "1")
+
+		found := false
+		for _, allowed := range allowedMethods(path) {
+			found = found || allowed == method
+		}
+
+		if !found {
+			t.Errorf("%s: got %v for %s; want %s allowed", route, allowedMethods(path), path, method)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/petrostrak/an-open-movie-database/internal/data"
+	"github.com/petrostrak/an-open-movie-database/internal/validator"
+)
+
+// The query string parameters of GET /v1/me/searches/:id/results which apply on top of
+// the saved search's own parameters.
+var searchResultParams = []string{"page", "facets", "runtime_format", "format"}
+
+// The createSearchHandler() handler for the "POST /v1/me/searches" endpoint saves a
+// movie listing under a name for the authenticated user. The query holds the listing's
+// query string parameters as strings, and is checked in the same way as the query
+// string of GET /v1/movies, so that a search can't be saved if it can't be run.
+func (app *application) createSearchHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Name  string           `json:"name"`
+		Query data.SearchQuery `json:"query"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	search := &data.SavedSearch{
+		UserID: user.ID,
+		Name:   input.Name,
+		Query:  input.Query,
+	}
+
+	if search.Query == nil {
+		search.Query = data.SearchQuery{}
+	}
+
+	v := validator.New()
+
+	// Only check the values once every parameter is known to be one that a search can
+	// store.
+	if data.ValidateSavedSearch(v, search); v.Valid() {
+		_, err = app.readMovieListing(r, search.Query.Values(), v.Child("query"))
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.SavedSearches.Insert(search)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateSearchName):
+			v.AddError("name", validator.Msg("search_name_taken"))
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrSavedSearchLimit):
+			v.AddError("searches", validator.Msg("searches_max", "n", data.MaxSavedSearches))
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/me/searches/%d", search.ID))
+
+	err = app.writeResponse(w, r, http.StatusCreated, envelope{"search": search}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The listSearchesHandler() handler for the "GET /v1/me/searches" endpoint returns the
+// authenticated user's saved searches.
+func (app *application) listSearchesHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	searches, err := app.models.SavedSearches.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"searches": searches}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The deleteSearchHandler() handler for the "DELETE /v1/me/searches/:id" endpoint
+// removes one of the authenticated user's saved searches.
+func (app *application) deleteSearchHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.invalidParamResponse(w, r, err)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	err = app.models.SavedSearches.DeleteForUser(id, user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"message": "search successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The showSearchResultsHandler() handler for the "GET /v1/me/searches/:id/results"
+// endpoint runs one of the authenticated user's saved searches against the catalog as
+// it is now, and responds exactly as GET /v1/movies would. The page, facets,
+// runtime_format and format can be given in the query string, as they aren't stored.
+func (app *application) showSearchResultsHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.invalidParamResponse(w, r, err)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	search, err := app.models.SavedSearches.GetForUser(id, user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	qs := search.Query.Values()
+
+	for _, key := range searchResultParams {
+		if values, ok := r.URL.Query()[key]; ok {
+			qs[key] = values
+		}
+	}
+
+	app.listMovies(w, r, qs)
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/petrostrak/an-open-movie-database/internal/data"
+)
+
+// The saveSearch() helper saves a search through the API, and returns its ID.
+func saveSearch(t *testing.T, ts *testServer, token, name string, query map[string]string) int64 {
+	t.Helper()
+
+	code, body := ts.do(t, http.MethodPost, "/v1/me/searches", token, map[string]interface{}{"name": name, "query": query})
+	if code != http.StatusCreated {
+		t.Fatalf("got status %d saving %q; want %d (body %v)", code, name, http.StatusCreated, body)
+	}
+
+	search, _ := body["search"].(map[string]interface{})
+	id, _ := search["id"].(float64)
+
+	return int64(id)
+}
+
+// The searchResults() helper runs a saved search, and returns the titles of the movies
+// it found.
+func searchResults(t *testing.T, ts *testServer, token string, id int64, query string) []interface{} {
+	t.Helper()
+
+	code, body := ts.do(t, http.MethodGet, fmt.Sprintf("/v1/me/searches/%d/results%s", id, query), token, nil)
+	if code != http.StatusOK {
+		t.Fatalf("got status %d running search %d; want %d (body %v)", code, id, http.StatusOK, body)
+	}
+
+	movies, _ := body["movies"].([]interface{})
+
+	titles := []interface{}{}
+	for _, movie := range movies {
+		movie, _ := movie.(map[string]interface{})
+		titles = append(titles, movie["title"])
+	}
+
+	return titles
+}
+
+// A saved search runs against the catalog as it is when it's run, not as it was when it
+// was saved.
+func TestSavedSearchResults(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t)
+
+	_, token := newTestUser(t, app, "reader", "reader")
+
+	deadpool := &data.Movie{Title: "Deadpool", Year: 2016, Runtime: 108, Genres: []string{"action", "comedy"}}
+
+	for _, movie := range []*data.Movie{
+		deadpool,
+		{Title: "Black Panther", Year: 2018, Runtime: 134, Genres: []string{"action", "adventure"}},
+		{Title: "The Breakfast Club", Year: 1985, Runtime: 97, Genres: []string{"comedy", "drama"}},
+	} {
+		err := app.models.Movies.Insert(movie)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	id := saveSearch(t, ts, token, "Action by title", map[string]string{"genres": "action", "sort": "title", "page_size": "2"})
+
+	if got := fmt.Sprint(searchResults(t, ts, token, id, "")); got != "[Black Panther Deadpool]" {
+		t.Errorf("got %s; want [Black Panther Deadpool]", got)
+	}
+
+	// Movies added to and removed from the catalog are picked up.
+	err := app.models.Movies.Insert(&data.Movie{Title: "Avatar", Year: 2009, Runtime: 162, Genres: []string{"action"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = app.models.Movies.Delete(deadpool.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := fmt.Sprint(searchResults(t, ts, token, id, "")); got != "[Avatar Black Panther]" {
+		t.Errorf("got %s after changing the catalog; want [Avatar Black Panther]", got)
+	}
+
+	// The page can be chosen, but the stored parameters can't be overridden.
+	if got := fmt.Sprint(searchResults(t, ts, token, id, "?page=2&genres=drama")); got != "[]" {
+		t.Errorf("got %s for page 2; want []", got)
+	}
+
+	code, body := ts.do(t, http.MethodGet, "/v1/me/searches", token, nil)
+	if searches, _ := body["searches"].([]interface{}); code != http.StatusOK || len(searches) != 1 {
+		t.Errorf("got status %d and body %v; want the saved search", code, body)
+	}
+
+	code, _ = ts.do(t, http.MethodDelete, fmt.Sprintf("/v1/me/searches/%d", id), token, nil)
+	if code != http.StatusOK {
+		t.Errorf("got status %d deleting the search; want %d", code, http.StatusOK)
+	}
+
+	code, _ = ts.do(t, http.MethodGet, fmt.Sprintf("/v1/me/searches/%d/results", id), token, nil)
+	if code != http.StatusNotFound {
+		t.Errorf("got status %d running a deleted search; want %d", code, http.StatusNotFound)
+	}
+}
+
+func TestCreateSavedSearchValidation(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t)
+
+	_, token := newTestUser(t, app, "reader", "reader")
+
+	saveSearch(t, ts, token, "Dramas", map[string]string{"genres": "drama"})
+
+	tests := []struct {
+		name    string
+		body    map[string]interface{}
+		wantKey string
+	}{
+		{"no name", map[string]interface{}{"query": map[string]string{"title": "moana"}}, "name"},
+		{"taken name", map[string]interface{}{"name": "DRAMAS"}, "name"},
+		{"unknown parameter", map[string]interface{}{"name": "Paged", "query": map[string]string{"page": "2"}}, "query.page"},
+		{"invalid sort", map[string]interface{}{"name": "Sorted", "query": map[string]string{"sort": "budget"}}, "query.sort"},
+		{"invalid page size", map[string]interface{}{"name": "Big", "query": map[string]string{"page_size": "1000"}}, "query.page_size"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, body := ts.do(t, http.MethodPost, "/v1/me/searches", token, tt.body)
+
+			if details, _ := body["details"].(map[string]interface{}); code != http.StatusUnprocessableEntity || details[tt.wantKey] == nil {
+				t.Errorf("got status %d and body %v; want %d with an error for %q", code, body, http.StatusUnprocessableEntity, tt.wantKey)
+			}
+		})
+	}
+}
+
+// Each user can have up to data.MaxSavedSearches searches, and only sees their own.
+func TestSavedSearchLimitAndOwnership(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t)
+
+	_, aliceToken := newTestUser(t, app, "alice", "reader")
+	_, bobToken := newTestUser(t, app, "bob", "reader")
+
+	var id int64
+	for i := 0; i < data.MaxSavedSearches; i++ {
+		id = saveSearch(t, ts, aliceToken, fmt.Sprintf("Search %d", i+1), nil)
+	}
+
+	code, body := ts.do(t, http.MethodPost, "/v1/me/searches", aliceToken, map[string]interface{}{"name": "One too many"})
+	if details, _ := body["details"].(map[string]interface{}); code != http.StatusUnprocessableEntity || details["searches"] == nil {
+		t.Errorf("got status %d and body %v; want %d with an error for the searches", code, body, http.StatusUnprocessableEntity)
+	}
+
+	// Another user's limit and names are separate.
+	saveSearch(t, ts, bobToken, "Search 1", nil)
+
+	code, body = ts.do(t, http.MethodGet, "/v1/me/searches", bobToken, nil)
+	if searches, _ := body["searches"].([]interface{}); code != http.StatusOK || len(searches) != 1 {
+		t.Errorf("got status %d and body %v; want only bob's search", code, body)
+	}
+
+	for _, method := range []string{http.MethodGet, http.MethodDelete} {
+		path := fmt.Sprintf("/v1/me/searches/%d", id)
+		if method == http.MethodGet {
+			path += "/results"
+		}
+
+		code, _ := ts.do(t, method, path, bobToken, nil)
+		if code != http.StatusNotFound {
+			t.Errorf("%s %s: got status %d for another user's search; want %d", method, path, code, http.StatusNotFound)
+		}
+	}
+}
@@ -4,16 +4,44 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"syscall"
 	"time"
 )
 
-// Declare a HTTP server with some sensible timeout settings, which listens on the
-// port provided in the config struct and uses the servemux we created above as the
-// handler.
+// The server's timeouts. ReadTimeout covers reading the whole request, including the
+// body, and WriteTimeout runs from the end of the request headers to the end of the
+// response. The routes which stream a large body extend them as they go (see
+// streaming()), so for them the timeouts only cut off a stalled transfer.
+const (
+	serverReadTimeout  = 10 * time.Second
+	serverWriteTimeout = 30 * time.Second
+	serverIdleTimeout  = time.Minute
+)
+
+// The newServer() method returns a HTTP server with some sensible timeout settings,
+// which listens on the port provided in the config struct and uses the handler.
+func (app *application) newServer(handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:         fmt.Sprintf(":%d", app.config.port),
+		Handler:      handler,
+		IdleTimeout:  serverIdleTimeout,
+		ReadTimeout:  serverReadTimeout,
+		WriteTimeout: serverWriteTimeout,
+		// Record each request's connection in its context, so that the streaming()
+		// middleware can extend the connection's deadlines.
+		ConnContext: app.contextWithConn,
+		// Write the server's own errors, such as TLS handshake failures, through our
+		// logger at the ERROR level, rather than to the standard logger.
+		ErrorLog: log.New(app.logger, "", 0),
+	}
+}
+
+// Declare a HTTP server with newServer(), using the routes() as the handler.
 //
 // Graceful Shutdown theory:
 // When we receive a SIGINT or SIGTERM signal, we instruct our server to
@@ -21,12 +49,30 @@ import (
 // a ‘grace period’ of 5 seconds to complete before the application is terminated
 func (app *application) serve() error {
 	// Declare a HTTP server as in main()
-	srv := &http.Server{
-		Addr:         fmt.Sprintf(":%d", app.config.port),
-		Handler:      app.routes(),
-		IdleTimeout:  time.Minute,
-		ReadTimeout:  10 * time.Second,
-		WriteTimeout: 30 * time.Second,
+	srv := app.newServer(app.routes())
+
+	// Create a context which is cancelled when the server starts shutting down, to
+	// stop the periodic background jobs.
+	jobsCtx, stopJobs := context.WithCancel(context.Background())
+	defer stopJobs()
+
+	app.startTokenCleanup(jobsCtx)
+	app.startOutboxPoller(jobsCtx)
+	app.startDigestScheduler(jobsCtx)
+	app.startPopularityRefresh(jobsCtx)
+
+	// Reload the configuration on SIGHUP, until the server starts shutting down.
+	app.reloadOnSIGHUP(jobsCtx)
+
+	// Start the goroutines which send the queued emails and deliver the webhooks.
+	app.startMailWorkers()
+	app.startWebhookWorkers()
+
+	// Start the gRPC server, if -grpc-port is set. It's stopped along with the HTTP
+	// server.
+	stopGRPC, err := app.serveGRPC()
+	if err != nil {
+		return err
 	}
 
 	// Create a shutdownError channel. We will use this to receive any errors returned
@@ -72,6 +118,10 @@ func (app *application) serve() error {
 			shutdownError <- err
 		}
 
+		// Likewise stop the gRPC server, waiting for the calls in progress within the
+		// same grace period.
+		stopGRPC(ctx)
+
 		// Log a message to say that we're waiting for any background go routines to
 		// complete their tasks.
 		app.logger.PrintInfo("completing background tasks", map[string]string{
@@ -82,7 +132,43 @@ func (app *application) serve() error {
 		// blocking until the background goroutines have finished. Then we return nil on
 		// the shutdownError channel, to indicate that the shutdown completed without
 		// any issues.s
+		//
+		// Stop the periodic background jobs and the admin jobs first, so that they finish
+		// too.
+		stopJobs()
+		app.jobs.stop()
 		app.wg.Wait()
+
+		// Stop the mailer backing off between retries, so that each email which is
+		// still queued gets one more try before it's left in the outbox for the next
+		// start, rather than holding up the shutdown.
+		if app.stopMailRetries != nil {
+			app.stopMailRetries()
+		}
+
+		// Send any emails which are still queued. The server has stopped handling
+		// requests and the background goroutines have finished, so nothing else can
+		// be queued.
+		app.stopMailWorkers()
+
+		// Stop delivering webhooks. Receivers aren't worth holding up the shutdown
+		// for, so this abandons the deliveries in progress.
+		app.stopWebhookWorkers()
+
+		// Flush any audit log entries which are still queued. This comes after the
+		// background goroutines have finished, as they may record entries too.
+		app.audit.Close()
+
+		// Write the request counts which haven't been flushed yet. The server has
+		// stopped handling requests, so no more will be counted.
+		app.usage.Close()
+
+		// Send any errors which are still waiting to be reported, without holding up
+		// the shutdown for long if the error tracking service is slow.
+		if !app.reporter.Flush(2 * time.Second) {
+			app.logger.PrintInfo("error reports not sent before shutdown", nil)
+		}
+
 		shutdownError <- nil
 
 	}()
@@ -91,15 +177,18 @@ func (app *application) serve() error {
 	//
 	// Start the server as normal.
 	app.logger.PrintInfo("starting server", map[string]string{
-		"addr": srv.Addr,
-		"env":  app.config.env,
+		"addr":     srv.Addr,
+		"env":      app.config.env,
+		"version":  build.Version,
+		"revision": build.Revision,
+		"modified": strconv.FormatBool(build.Modified),
 	})
 
 	// Calling Shutdown() on our server will cause ListenAndServe() to immediately
 	// return a http.ErrServerClosed error. So if we see this error, it is actually a
 	// good thing and an indication that the graceful shutdown has started. So we check
 	// specifically for this, only returning the error if it is NOT http.ErrServerClosed.
-	err := srv.ListenAndServe()
+	err = srv.ListenAndServe()
 	if !errors.Is(err, http.ErrServerClosed) {
 		return err
 	}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The server's timeouts and the length of the transfers are scaled down by a factor of
+// 100, so that a 45 second stream against the 30 second WriteTimeout takes under half
+// a second.
+const (
+	testWriteTimeout  = serverWriteTimeout / 100
+	testStreamLength  = 45 * time.Second / 100
+	testStreamChunk   = 50 * time.Millisecond
+	testStreamStalled = 2 * testWriteTimeout
+)
+
+// A route wrapped in streaming() can keep writing for longer than the WriteTimeout,
+// while one which stalls, and any other route, is still cut off.
+func TestStreaming(t *testing.T) {
+	app := newTestApplication(t)
+
+	// The stream() handler writes a chunk every testStreamChunk for testStreamLength,
+	// and then a final line, after pausing for stall.
+	stream := func(stall time.Duration) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			for start := time.Now(); time.Since(start) < testStreamLength; {
+				io.WriteString(w, "chunk\n")
+				w.(http.Flusher).Flush()
+				time.Sleep(testStreamChunk)
+			}
+
+			time.Sleep(stall)
+			io.WriteString(w, "done\n")
+		}
+	}
+
+	tests := []struct {
+		name     string
+		handler  http.HandlerFunc
+		wantDone bool
+	}{
+		{"streaming", app.streaming(stream(0)), true},
+		{"not streaming", stream(0), false},
+		{"streaming stalled", app.streaming(stream(testStreamStalled)), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := httptest.NewUnstartedServer(nil)
+			ts.Config = app.newServer(tt.handler)
+			ts.Config.WriteTimeout = testWriteTimeout
+			ts.Start()
+			defer ts.Close()
+
+			res, err := ts.Client().Get(ts.URL)
+			if err != nil {
+				if tt.wantDone {
+					t.Fatal(err)
+				}
+				return
+			}
+			defer res.Body.Close()
+
+			body, err := io.ReadAll(res.Body)
+			done := err == nil && strings.HasSuffix(string(body), "done\n")
+
+			if done != tt.wantDone {
+				t.Errorf("got the whole stream %t (%d bytes, error %v); want %t", done, len(body), err, tt.wantDone)
+			}
+		})
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/petrostrak/an-open-movie-database/internal/audit"
+	"github.com/petrostrak/an-open-movie-database/internal/data"
+	"github.com/petrostrak/an-open-movie-database/internal/enrich"
+	"github.com/petrostrak/an-open-movie-database/internal/errreport"
+	"github.com/petrostrak/an-open-movie-database/internal/httpclient"
+	"github.com/petrostrak/an-open-movie-database/internal/jsonlog"
+	"github.com/petrostrak/an-open-movie-database/internal/oauth"
+	"github.com/petrostrak/an-open-movie-database/internal/usage"
+	"github.com/petrostrak/an-open-movie-database/internal/validator"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// The router and the expvar metrics are package-level, so routes() can only be called
+// once per process. The tests therefore share a single application and handler, and
+// newTestApplication() gives each test fresh models and state instead.
+var (
+	testApp     *application
+	testHandler http.Handler
+)
+
+func TestMain(m *testing.M) {
+	// Use the cheapest bcrypt cost, so that the tests don't spend their time hashing
+	// passwords.
+	err := data.SetHashingParams(data.HashingParams{Algorithm: data.HashBcrypt, BcryptCost: bcrypt.MinCost})
+	if err != nil {
+		panic(err)
+	}
+
+	// The Google client credentials are set so that the OAuth routes are registered.
+	// Tests which use them point the endpoints at a stub server.
+	testApp = &application{
+		logger:   jsonlog.New(io.Discard, jsonlog.LevelOff),
+		reporter: errreport.Nop{},
+		google:   oauth.NewGoogle("test-client-id", "test-client-secret", "http://localhost/v1/auth/google/callback"),
+	}
+	testHandler = testApp.routes()
+
+	os.Exit(m.Run())
+}
+
+// The newTestApplication() helper resets the shared application to use a fresh set of
+// in-memory mock models, with the rate limiter and caches disabled, and returns it.
+func newTestApplication(t *testing.T) *application {
+	t.Helper()
+
+	models := data.NewMockModels()
+
+	var cfg config
+	cfg.env = "testing"
+	cfg.maxRequestBody = 1_048_576
+	cfg.runtimeFormat = runtimeFormatString
+	cfg.defaultLocale = validator.DefaultLocale
+	cfg.responseMeta = true
+	cfg.tokens.authTTL = 24 * time.Hour
+	cfg.tokens.activationTTL = 72 * time.Hour
+	cfg.tokens.unsubscribeTTL = 30 * 24 * time.Hour
+	cfg.api.baseURL = "http://localhost:4000"
+	cfg.watchlist.dailyEmailCap = 10
+	cfg.duplicates.threshold = 0.8
+	cfg.digest.hour = 8
+	cfg.popularity.interval = 10 * time.Minute
+	cfg.popularity.weights = data.PopularityWeights{Views: 1, Ratings: 3, Recency: 2, HalfLife: 30 * 24 * time.Hour}
+	cfg.defaultSort = "id"
+
+	testApp.config = cfg
+	testApp.live.Store(newDynamicConfig(cfg))
+	testApp.models = models
+	testApp.audit = audit.New(models.Audit, testApp.logger, 1024)
+	testApp.exports = newExportRegistry()
+	testApp.jobs = newJobRunner()
+	testApp.workers = newWorkerRegistry()
+	testApp.views = newViewCounter()
+	testApp.mailQueue = newMailQueue(16)
+	testApp.webhookQueue = newWebhookQueue(16)
+	testApp.outbox = newOutbox()
+	testApp.usage = usage.New(models.Usage, testApp.logger, time.Hour)
+	testApp.google = oauth.NewGoogle("test-client-id", "test-client-secret", "http://localhost/v1/auth/google/callback")
+	testApp.reporter = errreport.Nop{}
+	testApp.enricher = enrich.Disabled{}
+	testApp.httpClient = httpclient.New(httpclient.Options{})
+	testApp.jwt = nil
+	testApp.permissionsCache = nil
+	testApp.userCache = nil
+	testApp.breakers.primary, testApp.breakers.read = nil, nil
+
+	t.Cleanup(func() {
+		testApp.jobs.stop()
+		testApp.wg.Wait()
+		testApp.audit.Close()
+		testApp.usage.Close()
+	})
+
+	return testApp
+}
+
+// Define a fakeReporter type which records the errors it's given, in place of Sentry.
+type fakeReporter struct {
+	mu      sync.Mutex
+	reports []fakeReport
+}
+
+type fakeReport struct {
+	err     error
+	context map[string]string
+}
+
+func (f *fakeReporter) Report(err error, context map[string]string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.reports = append(f.reports, fakeReport{err: err, context: context})
+}
+
+func (f *fakeReporter) Flush(timeout time.Duration) bool { return true }
+
+func (f *fakeReporter) get() []fakeReport {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return append([]fakeReport(nil), f.reports...)
+}
+
+// Define a testServer type which wraps an httptest.Server.
+type testServer struct {
+	*httptest.Server
+}
+
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+
+	ts := httptest.NewServer(testHandler)
+	t.Cleanup(ts.Close)
+
+	return &testServer{ts}
+}
+
+// The do() method sends a request with an optional JSON body and bearer token, and
+// returns the response status code and decoded JSON body.
+func (ts *testServer) do(t *testing.T, method, path, token string, body interface{}) (int, map[string]interface{}) {
+	t.Helper()
+
+	// A []byte body is sent as it is, for testing bodies which aren't valid JSON.
+	var reqBody io.Reader
+	if raw, ok := body.([]byte); ok {
+		reqBody = bytes.NewReader(raw)
+	} else if body != nil {
+		js, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reqBody = bytes.NewReader(js)
+	}
+
+	req, err := http.NewRequest(method, ts.URL+path, reqBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	res, err := ts.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	var js map[string]interface{}
+	err = json.NewDecoder(res.Body).Decode(&js)
+	if err != nil && err != io.EOF {
+		t.Fatal(err)
+	}
+
+	return res.StatusCode, js
+}
+
+// The newTestUser() helper inserts an activated user with the given roles, and returns
+// the user along with an authentication token for them.
+func newTestUser(t *testing.T, app *application, name string, roles ...string) (*data.User, string) {
+	t.Helper()
+
+	user := &data.User{
+		Name:      name,
+		Username:  name,
+		Email:     name + "@example.com",
+		Activated: true,
+	}
+
+	err := user.Password.Set("pa55word1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = app.models.Users.Insert(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = app.models.Roles.AddForUser(user.ID, roles...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := app.models.Tokens.New(user.ID, time.Hour, data.ScopeAuthentication)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return user, token.Plaintext
+}
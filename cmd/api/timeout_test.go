@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/petrostrak/an-open-movie-database/internal/jsonlog"
+)
+
+// Define a syncBuffer type which is a bytes.Buffer that's safe to read while the
+// logger writes to it from another goroutine.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.buf.String()
+}
+
+// The captureLogs() helper points the application's logger at a buffer for the rest of
+// the test.
+func captureLogs(t *testing.T, app *application) *syncBuffer {
+	t.Helper()
+
+	logs := &syncBuffer{}
+	logger := app.logger
+
+	app.logger = jsonlog.New(logs, jsonlog.LevelInfo)
+	t.Cleanup(func() { app.logger = logger })
+
+	return logs
+}
+
+func TestRequestTimeout(t *testing.T) {
+	tests := []struct {
+		name     string
+		handler  func(w http.ResponseWriter, r *http.Request)
+		wantCode int
+	}{
+		{
+			name: "in time",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusTeapot)
+			},
+			wantCode: http.StatusTeapot,
+		},
+		{
+			name: "too slow",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				<-r.Context().Done()
+				w.WriteHeader(http.StatusTeapot)
+			},
+			wantCode: http.StatusServiceUnavailable,
+		},
+		{
+			name: "panic in time",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				panic("boom")
+			},
+			wantCode: http.StatusInternalServerError,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t)
+			app.config.requestTimeout = 20 * time.Millisecond
+
+			h := app.recoverPanic(app.requestTimeout(http.HandlerFunc(tt.handler)))
+
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/v1/healthcheck", nil))
+
+			if w.Code != tt.wantCode {
+				t.Errorf("got status %d; want %d", w.Code, tt.wantCode)
+			}
+		})
+	}
+}
+
+// A handler which panics after the request has timed out has nothing to pass its panic
+// back to, so it must be logged and counted in the handler's goroutine.
+func TestRequestTimeoutLatePanic(t *testing.T) {
+	app := newTestApplication(t)
+	app.config.requestTimeout = 20 * time.Millisecond
+	logs := captureLogs(t, app)
+
+	panicked := make(chan struct{})
+
+	h := app.recoverPanic(app.requestTimeout(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+
+		// Give the middleware time to send the timeout response first.
+		time.Sleep(10 * time.Millisecond)
+
+		defer close(panicked)
+		panic("late boom")
+	})))
+
+	before := totalPanicsRecovered.Value()
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/v1/healthcheck", nil))
+
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("got status %d; want %d", w.Code, http.StatusServiceUnavailable)
+	}
+
+	<-panicked
+
+	// The deferred recover runs after close(panicked), so wait for it to log.
+	deadline := time.Now().Add(time.Second)
+	for !strings.Contains(logs.String(), "late boom") && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	if !strings.Contains(logs.String(), "late boom") {
+		t.Errorf("got logs %q; want the late panic logged", logs.String())
+	}
+
+	if got := totalPanicsRecovered.Value() - before; got != 1 {
+		t.Errorf("got %d panics counted; want 1", got)
+	}
+}
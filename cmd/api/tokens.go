@@ -1,14 +1,22 @@
 package main
 
 import (
+	"crypto/sha256"
 	"errors"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/petrostrak/an-open-movie-database/internal/data"
+	"github.com/petrostrak/an-open-movie-database/internal/jwt"
 	"github.com/petrostrak/an-open-movie-database/internal/validator"
 )
 
+// The bodies sent to the authentication and account endpoints only ever hold a few
+// short fields, so they accept far less than the -max-request-body default.
+const authMaxRequestBody = 4_096
+
 func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
 	// Parse the email and password from the request body.
 	var input struct {
@@ -16,17 +24,24 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 		Password string `json:"password"`
 	}
 
-	err := app.readJSON(w, r, &input)
+	err := app.readJSONWithLimit(w, r, &input, authMaxRequestBody)
 	if err != nil {
 		app.badRequestResponse(w, r, err)
 		return
 	}
 
+	// Normalize the email address so that it matches the form stored at registration.
+	input.Email = data.NormalizeEmail(input.Email)
+
 	// Validate the email and password provided by the client.
 	v := validator.New()
 
+	// Note that we deliberately don't call ValidatePasswordPlaintext() here. Its
+	// strength checks apply when a password is chosen, and shouldn't lock out users
+	// whose existing password predates them.
 	data.ValidateEmail(v, input.Email)
-	data.ValidatePasswordPlaintext(v, input.Password)
+	v.Check(input.Password != "", "password", validator.Msg("required"))
+	v.Check(validator.MaxBytes(input.Password, 72), "password", validator.Msg("max_bytes", "n", 72))
 
 	if !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
@@ -61,18 +76,137 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 		return
 	}
 
+	// Record the login time and add it to the user's login history. As with the
+	// re-hash below, a failure here shouldn't fail the login itself.
+	err = app.models.Users.RecordLogin(user.ID, app.clientIP(r), r.UserAgent())
+	if err != nil {
+		app.logger.PrintError(err, app.logProperties(r, map[string]string{
+			"user_id": strconv.FormatInt(user.ID, 10),
+			"action":  "record login",
+		}))
+	}
+
+	// If the password was hashed with an older algorithm or a lower cost than the one
+	// we're configured with, take the opportunity to re-hash it now that we know the
+	// plaintext. A failure here shouldn't stop the user logging in, so we just log it.
+	if user.Password.NeedsRehash() {
+		err = user.Password.Set(input.Password)
+		if err == nil {
+			err = app.models.Users.Update(user)
+			app.invalidateUser(user.ID)
+		}
+		if err != nil {
+			app.logger.PrintError(err, app.logProperties(r, map[string]string{
+				"user_id": strconv.FormatInt(user.ID, 10),
+				"action":  "rehash password",
+			}))
+		}
+	}
+
 	// Otherwise, if the password is correct, we generate a new token with a 24-hour
 	// expiry time and the scope 'authentication'.
-	token, err := app.models.Tokens.New(user.ID, 24*time.Hour, data.ScopeAuthentication)
+	token, err := app.newAuthenticationToken(user.ID, app.config.tokens.authTTL)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
+	app.recordAudit(r, data.AuditEntry{
+		UserID:       user.ID,
+		Action:       "token.create",
+		ResourceType: "token",
+		ResourceID:   data.ScopeAuthentication,
+		Metadata:     map[string]interface{}{"method": "password"},
+	})
+
 	// Encode the token to JSON and send it in the response along with a 201 Created
 	// status code.
-	err = app.writeJSON(w, http.StatusCreated, envelope{"authentication_token": token}, nil)
+	err = app.writeResponse(w, r, http.StatusCreated, envelope{"authentication_token": token}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
 }
+
+// The deleteAuthenticationTokenHandler() revokes the authentication token used to make
+// the request, logging the client out.
+func (app *application) deleteAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	// JWTs are verified without looking them up, so there's nothing we can delete.
+	if app.jwt != nil {
+		app.badRequestResponse(w, r, errors.New("authentication tokens cannot be revoked in jwt mode"))
+		return
+	}
+
+	// The authenticate() middleware has already checked that the header is in the
+	// format "Bearer <token>".
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+	err := app.models.Tokens.Delete(data.ScopeAuthentication, token)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// Make sure the revoked token can't keep authenticating from the cache.
+	if app.userCache != nil {
+		app.userCache.Delete(sha256.Sum256([]byte(token)))
+	}
+
+	app.recordAudit(r, data.AuditEntry{
+		Action:       "token.delete",
+		ResourceType: "token",
+		ResourceID:   data.ScopeAuthentication,
+	})
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"message": "authentication token successfully revoked"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The newAuthenticationToken() helper issues an authentication token for the user. In
+// the default stateful mode this is stored in the tokens table; in jwt mode we return
+// a signed JWT instead and nothing is written to the database.
+func (app *application) newAuthenticationToken(userID int64, ttl time.Duration) (*data.Token, error) {
+	if app.jwt == nil {
+		return app.models.Tokens.New(userID, ttl, data.ScopeAuthentication)
+	}
+
+	now := time.Now()
+
+	claims := jwt.Claims{
+		Subject:   strconv.FormatInt(userID, 10),
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(ttl).Unix(),
+	}
+
+	plaintext, err := app.jwt.Sign(claims)
+	if err != nil {
+		return nil, err
+	}
+
+	return &data.Token{
+		Plaintext: plaintext,
+		UserID:    userID,
+		Expiry:    time.Unix(claims.ExpiresAt, 0),
+		Scope:     data.ScopeAuthentication,
+	}, nil
+}
+
+// The userForJWT() helper verifies a JWT authentication token and loads the user
+// identified by its subject claim. Any problem with the token itself is reported as
+// data.ErrRecordNotFound, so that callers treat it the same as an unknown token.
+func (app *application) userForJWT(token string) (*data.User, error) {
+	claims, err := app.jwt.Verify(token)
+	if err != nil {
+		return nil, data.ErrRecordNotFound
+	}
+
+	userID, err := strconv.ParseInt(claims.Subject, 10, 64)
+	if err != nil {
+		return nil, data.ErrRecordNotFound
+	}
+
+	// Load the user from the primary, so that a user who has just been deleted or
+	// changed can't be authenticated from a stale read replica.
+	return app.models.Primary().Users.Get(userID)
+}
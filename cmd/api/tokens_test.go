@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/petrostrak/an-open-movie-database/internal/data"
+	"github.com/petrostrak/an-open-movie-database/internal/jwt"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// The authentication tests run once in each token mode, as the behaviour seen by
+// clients should be the same apart from revocation.
+var authModes = []struct {
+	name   string
+	alg    string
+	jwtKey string
+}{
+	{"stateful", "", ""},
+	{"jwt HS256", jwt.AlgHS256, "a-test-signing-key-which-is-long-enough"},
+	{"jwt EdDSA", jwt.AlgEdDSA, base64.StdEncoding.EncodeToString([]byte("0123456789abcdef0123456789abcdef"))},
+}
+
+// The newAuthTestApplication() helper returns a test application in the given mode.
+func newAuthTestApplication(t *testing.T, alg, jwtKey string) *application {
+	t.Helper()
+
+	app := newTestApplication(t)
+
+	if alg != "" {
+		var cfg config
+		cfg.auth.mode = "jwt"
+		cfg.auth.jwtAlg = alg
+		cfg.auth.jwtKey = jwtKey
+
+		signer, err := openJWTSigner(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		app.jwt = signer
+	}
+
+	return app
+}
+
+func TestAuthenticationModes(t *testing.T) {
+	for _, mode := range authModes {
+		t.Run(mode.name, func(t *testing.T) {
+			app := newAuthTestApplication(t, mode.alg, mode.jwtKey)
+			ts := newTestServer(t)
+
+			user, _ := newTestUser(t, app, "alice", "reader")
+
+			code, body := ts.do(t, http.MethodPost, "/v1/tokens/authentication", "", map[string]string{
+				"email":    "alice@example.com",
+				"password": "pa55word1234",
+			})
+			if code != http.StatusCreated {
+				t.Fatalf("got status %d creating a token; want %d (body %v)", code, http.StatusCreated, body)
+			}
+
+			token := body["authentication_token"].(map[string]interface{})["token"].(string)
+
+			tests := []struct {
+				name     string
+				token    string
+				wantCode int
+			}{
+				{"valid", token, http.StatusOK},
+				{"malformed", "not-a-token", http.StatusUnauthorized},
+				{"tampered", tamper(token), http.StatusUnauthorized},
+			}
+
+			for _, tt := range tests {
+				t.Run(tt.name, func(t *testing.T) {
+					code, body := ts.do(t, http.MethodGet, "/v1/me", tt.token, nil)
+					if code != tt.wantCode {
+						t.Errorf("got status %d; want %d (body %v)", code, tt.wantCode, body)
+					}
+				})
+			}
+
+			// Stateful tokens can be revoked; JWTs can't, and remain valid.
+			wantLogout, wantAfter := http.StatusOK, http.StatusUnauthorized
+			if app.jwt != nil {
+				wantLogout, wantAfter = http.StatusBadRequest, http.StatusOK
+			}
+
+			code, _ = ts.do(t, http.MethodDelete, "/v1/tokens/authentication", token, nil)
+			if code != wantLogout {
+				t.Errorf("got status %d revoking the token; want %d", code, wantLogout)
+			}
+
+			code, _ = ts.do(t, http.MethodGet, "/v1/me", token, nil)
+			if code != wantAfter {
+				t.Errorf("got status %d after revoking the token; want %d", code, wantAfter)
+			}
+
+			// In both modes a token stops working once its user is deleted.
+			err := app.models.Users.Delete(user.ID, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			code, _ = ts.do(t, http.MethodGet, "/v1/me", token, nil)
+			if code != http.StatusUnauthorized {
+				t.Errorf("got status %d after deleting the user; want %d", code, http.StatusUnauthorized)
+			}
+		})
+	}
+}
+
+// The tamper() helper changes one character in the middle of a token.
+func tamper(token string) string {
+	i := len(token) / 2
+
+	c := "A"
+	if strings.HasPrefix(token[i:], "A") {
+		c = "B"
+	}
+
+	return token[:i] + c + token[i+1:]
+}
+
+// Logging in with a password hashed by bcrypt, once argon2id is configured, re-hashes
+// it with argon2id, and the user can still log in afterwards.
+func TestAuthenticationRehash(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t)
+
+	user, _ := newTestUser(t, app, "reader", "reader")
+
+	err := data.SetHashingParams(data.HashingParams{Algorithm: data.HashArgon2id, Argon2Memory: 64, Argon2Time: 1, Argon2Parallelism: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		data.SetHashingParams(data.HashingParams{Algorithm: data.HashBcrypt, BcryptCost: bcrypt.MinCost})
+	})
+
+	if !user.Password.NeedsRehash() {
+		t.Fatal("got a bcrypt hash which doesn't need a rehash with argon2id configured")
+	}
+
+	login := map[string]string{"email": "reader@example.com", "password": "pa55word1234"}
+
+	for i := 1; i <= 2; i++ {
+		code, body := ts.do(t, http.MethodPost, "/v1/tokens/authentication", "", login)
+		if code != http.StatusCreated {
+			t.Fatalf("login %d: got status %d; want %d (body %v)", i, code, http.StatusCreated, body)
+		}
+
+		stored, err := app.models.Users.GetByEmail("reader@example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if stored.Password.NeedsRehash() {
+			t.Errorf("login %d: got a hash which still needs a rehash", i)
+		}
+
+		if stored.Version != user.Version+1 {
+			t.Errorf("login %d: got version %d; want %d, as only the first login re-hashes", i, stored.Version, user.Version+1)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+// The number of days of request counts returned by the usage endpoints.
+const usageDays = 30
+
+// The showCurrentUserUsageHandler() returns the authenticated user's request counts.
+func (app *application) showCurrentUserUsageHandler(w http.ResponseWriter, r *http.Request) {
+	app.writeUsage(w, r, app.contextGetUser(r).ID)
+}
+
+// The showUserUsageHandler() returns any user's request counts, for administrators.
+func (app *application) showUserUsageHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readUserParam(w, r)
+	if !ok {
+		return
+	}
+
+	app.writeUsage(w, r, user.ID)
+}
+
+// The writeUsage() helper sends the user's request count for each of the last
+// usageDays days (in UTC), oldest first, along with the total and the per-user rate
+// limit. The counts which haven't been flushed to the database yet are included, so
+// that they're up to date.
+func (app *application) writeUsage(w http.ResponseWriter, r *http.Request, userID int64) {
+	now := time.Now().UTC()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	since := today.AddDate(0, 0, -(usageDays - 1))
+
+	stored, err := app.models.Usage.GetAllForUser(userID, since)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	counts := app.usage.Pending(userID)
+	for _, u := range stored {
+		counts[u.Date.UTC().Format("2006-01-02")] += u.Requests
+	}
+
+	type day struct {
+		Date     string `json:"date"`
+		Requests int64  `json:"requests"`
+	}
+
+	days := make([]day, usageDays)
+	var total int64
+
+	for i := range days {
+		date := since.AddDate(0, 0, i).Format("2006-01-02")
+		days[i] = day{Date: date, Requests: counts[date]}
+		total += counts[date]
+	}
+
+	limiter := app.live.Load().limiter
+
+	env := envelope{"usage": envelope{
+		"days":  days,
+		"total": total,
+		"rate_limit": envelope{
+			"enabled":             limiter.enable,
+			"requests_per_second": limiter.userRPS,
+			"burst":               limiter.userBurst,
+		},
+	}}
+
+	err = app.writeResponse(w, r, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestUsage(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t)
+
+	alice, aliceToken := newTestUser(t, app, "alice")
+	_, adminToken := newTestUser(t, app, "admin", "admin")
+
+	app.config.limiter.userRPS = 4
+	app.config.limiter.userBurst = 8
+	app.live.Store(newDynamicConfig(app.config))
+	t.Cleanup(func() { app.live.Store(newDynamicConfig(config{})) })
+
+	// Anonymous requests aren't counted.
+	ts.do(t, http.MethodGet, "/v1/healthcheck", "", nil)
+
+	for i := 0; i < 3; i++ {
+		ts.do(t, http.MethodGet, "/v1/me", aliceToken, nil)
+	}
+
+	today := time.Now().UTC().Format("2006-01-02")
+
+	check := func(path, token string, want int64) {
+		t.Helper()
+
+		code, body := ts.do(t, http.MethodGet, path, token, nil)
+		if code != http.StatusOK {
+			t.Fatalf("got status %d for %s; want %d", code, path, http.StatusOK)
+		}
+
+		usage, _ := body["usage"].(map[string]interface{})
+		days, _ := usage["days"].([]interface{})
+		if len(days) != usageDays {
+			t.Fatalf("got %d days; want %d", len(days), usageDays)
+		}
+
+		last, _ := days[usageDays-1].(map[string]interface{})
+		if last["date"] != today || last["requests"] != float64(want) || usage["total"] != float64(want) {
+			t.Errorf("got today %v and total %v from %s; want %s with %d requests", last, usage["total"], path, today, want)
+		}
+
+		limit, _ := usage["rate_limit"].(map[string]interface{})
+		if limit["requests_per_second"] != float64(4) || limit["burst"] != float64(8) {
+			t.Errorf("got rate limit %v; want 4 requests per second and a burst of 8", limit)
+		}
+	}
+
+	// The usage request itself is counted, and the counts which haven't been flushed
+	// yet are included.
+	check("/v1/me/usage", aliceToken, 4)
+
+	err := app.usage.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check("/v1/me/usage", aliceToken, 5)
+
+	// Administrators can see anyone's usage.
+	check(fmt.Sprintf("/v1/users/%d/usage", alice.ID), adminToken, 5)
+
+	code, _ := ts.do(t, http.MethodGet, fmt.Sprintf("/v1/users/%d/usage", alice.ID), aliceToken, nil)
+	if code != http.StatusForbidden {
+		t.Errorf("got status %d for another user's usage without users:admin; want %d", code, http.StatusForbidden)
+	}
+
+	code, _ = ts.do(t, http.MethodGet, "/v1/users/999999/usage", adminToken, nil)
+	if code != http.StatusNotFound {
+		t.Errorf("got status %d for an unknown user's usage; want %d", code, http.StatusNotFound)
+	}
+}
@@ -3,7 +3,8 @@ package main
 import (
 	"errors"
 	"net/http"
-	"time"
+	"net/url"
+	"strconv"
 
 	"github.com/petrostrak/an-open-movie-database/internal/data"
 	"github.com/petrostrak/an-open-movie-database/internal/validator"
@@ -13,12 +14,14 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 	// Create an anonymous struct to hold the expected data from the request body.
 	var input struct {
 		Name     string `json:"name"`
+		Username string `json:"username"`
 		Email    string `json:"email"`
 		Password string `json:"password"`
+		Locale   string `json:"locale"`
 	}
 
 	// Parse the request body into the anonymous struct.
-	err := app.readJSON(w, r, &input)
+	err := app.readJSONWithLimit(w, r, &input, authMaxRequestBody)
 	if err != nil {
 		app.badRequestResponse(w, r, err)
 		return
@@ -30,10 +33,17 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 	// explicitly helps to make our intentions clear to anyone reading the code.
 	user := &data.User{
 		Name:      input.Name,
-		Email:     input.Email,
+		Username:  data.NormalizeUsername(input.Username),
+		Email:     data.NormalizeEmail(input.Email),
+		Locale:    input.Locale,
 		Activated: false,
 	}
 
+	// The locale is optional, and defaults to English.
+	if user.Locale == "" {
+		user.Locale = data.DefaultLocale
+	}
+
 	// Use the Password.Set() to generate and store the hashed and plaintext passwords.
 	err = user.Password.Set(input.Password)
 	if err != nil {
@@ -41,24 +51,63 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
+	app.registerUser(w, r, user)
+}
+
+// The registerUser() helper validates a new user, inserts them along with their
+// activation token and welcome email, and sends them in a 202 Accepted response.
+func (app *application) registerUser(w http.ResponseWriter, r *http.Request, user *data.User) {
 	v := validator.New()
 
 	// Validate the user struct and return the error messages to the client if any of
-	// the checks fail.
-	if data.ValidateUser(v, user); !v.Valid() {
+	// the checks fail. An error here means we've built the user incorrectly, so we
+	// send a 500 (which also logs it) rather than a validation failure.
+	err := data.ValidateUser(v, user)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
 
-	// Insert the user data into the database.
-	err = app.models.Users.Insert(user)
+	// Insert the user data into the database, along with the "reader" role (which
+	// grants the "movies:read" permission), an activation token, and the welcome
+	// email. These are all written in one transaction, and the email is sent from the
+	// outbox by the outbox poller, so the response isn't held up and the email
+	// survives a restart.
+	_, err = app.models.Users.Register(user, []string{"reader"}, app.config.tokens.activationTTL, func(token *data.Token) *data.EmailJob {
+		// As there are now multiple pieces of data that we want to pass to our email
+		// templates, we create a map to act as a 'holding structure' for the data.
+		// This contains the plaintext version of the activation token for the user,
+		// along with their ID.
+		//
+		// The activation URL points at the frontend, which submits the token to the
+		// PUT /v1/users/activated endpoint on the user's behalf.
+		return &data.EmailJob{
+			Recipient: user.Email,
+			Locale:    user.Locale,
+			Template:  "user_welcome.tmpl",
+			Payload: map[string]interface{}{
+				"activationToken":  token.Plaintext,
+				"activationURL":    app.frontendURL("/activate", url.Values{"token": {token.Plaintext}}),
+				"activationExpiry": token.Expiry.UTC().Format("2006-01-02 15:04 MST"),
+				"userID":           user.ID,
+			},
+		}
+	})
 	if err != nil {
 		switch {
 		// If we get a ErrDuplicateEmail error, use the v.AddError() to manually
 		// add a message to the validator instance, and then call our
 		// failedValidationResponse() helper.
 		case errors.Is(err, data.ErrDuplicateEmail):
-			v.AddError("email", "a user with this email address already exists")
+			v.AddError("email", validator.Msg("email_taken"))
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrDuplicateUsername):
+			v.AddError("username", validator.Msg("username_taken"))
 			app.failedValidationResponse(w, r, v.Errors)
 		default:
 			app.serverErrorResponse(w, r, err)
@@ -67,51 +116,14 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	// Add the "movies:read" permission for the new user.
-	err = app.models.Permissions.AddForUser(user.ID, "movies:read")
-	if err != nil {
-		app.serverErrorResponse(w, r, err)
-		return
-	}
-
-	// After the user record has been created in the database, generate a new activation
-	// token for the user.
-	token, err := app.models.Tokens.New(user.ID, 3*24*time.Hour, data.ScopeActivation)
-	if err != nil {
-		app.serverErrorResponse(w, r, err)
-		return
-	}
-
-	// Use the background helper to execute an anonymous function that sends the welcome
-	// email.
-	app.background(func() {
-		// As there are now multiple pieces of data that we want to pass to our email
-		// templates, we create a map to act as a 'holding structure' for the data. This
-		// contains the plaintext version of the activation token for the user, along
-		// with their ID.
-		data := map[string]interface{}{
-			"activationToken": token.Plaintext,
-			"userID":          user.ID,
-		}
-
-		// Call the Send() on our Mailer, passing in the user's email address,
-		// name of the template file, and the User struct containing the new user's data.
-		//
-		// Send the welcome email, passing in the map above as dynamic data.
-		err = app.mailer.Send(user.Email, "user_welcome.tmpl", data)
-		if err != nil {
-			// Importantly, if there is an error sending the email then we use the
-			// app.logger.PrintError() helper to manage it, instead of the
-			// app.serverErrorResponse() helper like before.
-			app.logger.PrintError(err, nil)
-			return
-		}
-	})
+	// Wake the outbox poller, so that the email goes out straight away rather than
+	// on its next tick.
+	app.outbox.notify()
 
 	// Note that we also change this to send the client a 202 Accepted status code.
 	// This status code indicates that the request has been accepted for processing, but
 	// the processing has not been completed
-	err = app.writeJSON(w, http.StatusAccepted, envelope{"user": user}, nil)
+	err = app.writeResponse(w, r, http.StatusAccepted, envelope{"user": user}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -123,7 +135,7 @@ func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Reque
 		TokenPlaintext string `json:"token"`
 	}
 
-	err := app.readJSON(w, r, &input)
+	err := app.readJSONWithLimit(w, r, &input, authMaxRequestBody)
 	if err != nil {
 		app.badRequestResponse(w, r, err)
 		return
@@ -144,7 +156,7 @@ func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Reque
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
-			v.AddError("token", "invalid or expired activation token")
+			v.AddError("token", validator.Msg("invalid_activation_token"))
 			app.failedValidationResponse(w, r, v.Errors)
 		default:
 			app.serverErrorResponse(w, r, err)
@@ -168,6 +180,17 @@ func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
+	// Drop any permissions and user records cached while the account was inactive.
+	app.invalidatePermissions(user.ID)
+	app.invalidateUser(user.ID)
+
+	app.recordAudit(r, data.AuditEntry{
+		UserID:       user.ID,
+		Action:       "user.activate",
+		ResourceType: "user",
+		ResourceID:   strconv.FormatInt(user.ID, 10),
+	})
+
 	// If everything went successfully, then we delete all activation tokens for the
 	// user.
 	err = app.models.Tokens.DeleteAllForUser(data.ScopeActivation, user.ID)
@@ -177,7 +200,175 @@ func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Reque
 	}
 
 	// Send the updated user details to the client in a JSON response.
-	err = app.writeJSON(w, http.StatusOK, envelope{"user": user}, nil)
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The showCurrentUserHandler() returns the details of the authenticated user.
+func (app *application) showCurrentUserHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	err := app.writeResponse(w, r, http.StatusOK, envelope{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The listCurrentUserLoginsHandler() returns the recent login history of the
+// authenticated user.
+func (app *application) listCurrentUserLoginsHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	logins, err := app.models.Logins.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"logins": logins}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The deleteCurrentUserHandler() deletes the authenticated user's account. The user
+// must confirm their current password, unless they signed up via an OAuth provider and
+// so don't have one.
+func (app *application) deleteCurrentUserHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	if !user.Password.IsSet() {
+		app.deleteUser(w, r, user.ID)
+		return
+	}
+
+	var input struct {
+		Password string `json:"password"`
+	}
+
+	err := app.readJSONWithLimit(w, r, &input, authMaxRequestBody)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if v.Check(input.Password != "", "password", validator.Msg("required")); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	match, err := user.Password.Matches(input.Password)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !match {
+		app.invalidCredentialsResponse(w, r)
+		return
+	}
+
+	app.deleteUser(w, r, user.ID)
+}
+
+// The deleteUserHandler() lets an administrator delete any user's account, without
+// the password check.
+func (app *application) deleteUserHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.invalidParamResponse(w, r, err)
+		return
+	}
+
+	app.deleteUser(w, r, id)
+}
+
+// The deleteUser() helper deletes a user, drops anything we have cached or are holding
+// in memory for them, and sends a 204 No Content response. Their reviews are kept
+// without an author if -delete-anonymizes-reviews is set.
+func (app *application) deleteUser(w http.ResponseWriter, r *http.Request, userID int64) {
+	err := app.models.Users.Delete(userID, app.config.users.deleteAnonymizesReviews)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.invalidatePermissions(userID)
+	app.invalidateUser(userID)
+	app.exports.deleteForUser(userID)
+
+	app.recordAudit(r, data.AuditEntry{
+		Action:       "user.delete",
+		ResourceType: "user",
+		ResourceID:   strconv.FormatInt(userID, 10),
+	})
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// The showUserProfileHandler() returns the public profile for a username. This is the
+// only way other clients can look a user up, and it never includes their email
+// address.
+func (app *application) showUserProfileHandler(w http.ResponseWriter, r *http.Request) {
+	username := app.readParam(r, "resource")
+
+	user, err := app.models.Users.GetByUsername(username)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.writeUserProfile(w, r, user)
+}
+
+// The showUserPublicProfileHandler() returns the same public profile for a user's
+// public ID.
+func (app *application) showUserPublicProfileHandler(w http.ResponseWriter, r *http.Request) {
+	publicID, err := app.readUUIDParam(r, "resource")
+	if err != nil {
+		app.invalidParamResponse(w, r, err)
+		return
+	}
+
+	user, err := app.models.Users.GetByPublicID(publicID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.writeUserProfile(w, r, user)
+}
+
+// The writeUserProfile() helper sends a user's public profile. It's identified by the
+// user's public ID, rather than the serial ID, which would let clients enumerate the
+// users.
+func (app *application) writeUserProfile(w http.ResponseWriter, r *http.Request, user *data.User) {
+	profile := envelope{
+		"id":        user.PublicID,
+		"username":  user.Username,
+		"joined_at": user.CreatedAt,
+	}
+
+	err := app.writeResponse(w, r, http.StatusOK, envelope{"user": profile}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/petrostrak/an-open-movie-database/internal/data"
+)
+
+func TestUserHandlers(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t)
+
+	_, readerToken := newTestUser(t, app, "reader", "reader")
+	_, adminToken := newTestUser(t, app, "admin", "admin")
+
+	tests := []struct {
+		name     string
+		method   string
+		path     string
+		token    string
+		body     interface{}
+		wantCode int
+		wantKey  string
+	}{
+		{"register", http.MethodPost, "/v1/users", "", map[string]string{"name": "Alice", "username": "alice", "email": "alice@example.com", "password": "correct horse battery"}, http.StatusAccepted, "user"},
+		{"register duplicate", http.MethodPost, "/v1/users", "", map[string]string{"name": "Alice", "username": "alice", "email": "alice@example.com", "password": "correct horse battery"}, http.StatusUnprocessableEntity, "error"},
+		{"authenticate", http.MethodPost, "/v1/tokens/authentication", "", map[string]string{"email": "reader@example.com", "password": "pa55word1234"}, http.StatusCreated, "authentication_token"},
+		{"authenticate wrong password", http.MethodPost, "/v1/tokens/authentication", "", map[string]string{"email": "reader@example.com", "password": "wrong password"}, http.StatusUnauthorized, "error"},
+		{"me", http.MethodGet, "/v1/me", readerToken, nil, http.StatusOK, "user"},
+		{"logins", http.MethodGet, "/v1/me/logins", readerToken, nil, http.StatusOK, "logins"},
+		{"preferences", http.MethodGet, "/v1/me/preferences", readerToken, nil, http.StatusOK, "preferences"},
+		{"update preferences", http.MethodPatch, "/v1/me/preferences", readerToken, map[string]interface{}{"default_page_size": 5}, http.StatusOK, "preferences"},
+		{"roles reader", http.MethodGet, "/v1/roles", readerToken, nil, http.StatusForbidden, "error"},
+		{"roles admin", http.MethodGet, "/v1/roles", adminToken, nil, http.StatusOK, "roles"},
+		{"audit admin", http.MethodGet, "/v1/audit", adminToken, nil, http.StatusOK, "audit"},
+		{"outbox admin", http.MethodGet, "/v1/admin/outbox", adminToken, nil, http.StatusOK, "email_jobs"},
+		{"webhooks admin", http.MethodGet, "/v1/webhooks", adminToken, nil, http.StatusOK, "webhooks"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, body := ts.do(t, tt.method, tt.path, tt.token, tt.body)
+
+			if code != tt.wantCode {
+				t.Errorf("got status %d; want %d (body %v)", code, tt.wantCode, body)
+			}
+
+			if _, ok := body[tt.wantKey]; !ok {
+				t.Errorf("response body %v has no %q key", body, tt.wantKey)
+			}
+		})
+	}
+
+	// Registration should have queued the welcome email in the outbox.
+	jobs, _, err := app.models.EmailJobs.GetAll(data.EmailJobPending, data.Filters{Page: 1, PageSize: 20, Sort: "id", SortSafelist: []string{"id"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(jobs) != 1 || jobs[0].Recipient != "alice@example.com" {
+		t.Errorf("got pending email jobs %v; want one for alice@example.com", jobs)
+	}
+}
+
+// Email addresses are stored lowercased, so a user who registers with a mixed-case
+// address can log in with it in any case, and can't be registered again in another.
+func TestRegisterUserEmailCase(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t)
+
+	code, body := ts.do(t, http.MethodPost, "/v1/users", "", map[string]string{"name": "Alice", "username": "alice", "email": " Alice@Example.COM ", "password": "correct horse battery"})
+	if code != http.StatusAccepted {
+		t.Fatalf("got status %d; want %d (body %v)", code, http.StatusAccepted, body)
+	}
+
+	if user, _ := body["user"].(map[string]interface{}); user["email"] != "alice@example.com" {
+		t.Errorf("got user %v; want the email address lowercased", body["user"])
+	}
+
+	stored, err := app.models.Users.GetByEmail("Alice@Example.COM")
+	if err != nil || stored.Email != "alice@example.com" {
+		t.Errorf("got user %+v and error %v; want alice@example.com stored", stored, err)
+	}
+
+	for _, email := range []string{"alice@example.com", "ALICE@EXAMPLE.COM"} {
+		code, body := ts.do(t, http.MethodPost, "/v1/tokens/authentication", "", map[string]string{"email": email, "password": "correct horse battery"})
+		if code != http.StatusCreated {
+			t.Errorf("got status %d logging in as %s; want %d (body %v)", code, email, http.StatusCreated, body)
+		}
+	}
+
+	tests := []struct {
+		name      string
+		email     string
+		username  string
+		wantField string
+	}{
+		{"lowercase email", "alice@example.com", "alice2", "email"},
+		{"uppercase email", "ALICE@EXAMPLE.COM", "alice3", "email"},
+		{"mixed-case username", "bob@example.com", "Alice", "username"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, body := ts.do(t, http.MethodPost, "/v1/users", "", map[string]string{"name": "Alice", "username": tt.username, "email": tt.email, "password": "correct horse battery"})
+			if code != http.StatusUnprocessableEntity {
+				t.Fatalf("got status %d; want %d", code, http.StatusUnprocessableEntity)
+			}
+
+			if details, _ := body["details"].(map[string]interface{}); details[tt.wantField] == nil {
+				t.Errorf("got body %v; want an error for the %s", body, tt.wantField)
+			}
+		})
+	}
+}
+
+// A user without a password hash, who didn't sign up through an OAuth provider, is a
+// bug in how the user was built rather than a problem with the request, so registering
+// them is a 500 Internal Server Error, sent without needing recoverPanic(), and nothing
+// is inserted.
+func TestRegisterUserMissingPassword(t *testing.T) {
+	app := newTestApplication(t)
+
+	user := &data.User{Name: "Alice", Username: "alice", Email: "alice@example.com", Locale: data.DefaultLocale}
+
+	w := httptest.NewRecorder()
+	app.registerUser(w, httptest.NewRequest(http.MethodPost, "/v1/users", nil), user)
+
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("got status %d; want %d", w.Code, http.StatusInternalServerError)
+	}
+
+	var body struct {
+		Error   string                 `json:"error"`
+		Code    string                 `json:"code"`
+		Details map[string]interface{} `json:"details"`
+	}
+
+	err := json.Unmarshal(w.Body.Bytes(), &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if body.Code != errCodeServerError || body.Error == "" {
+		t.Errorf("got body %s; want the server error envelope", w.Body)
+	}
+
+	if _, ok := body.Details["request_id"]; !ok {
+		t.Errorf("got details %v; want the request ID", body.Details)
+	}
+
+	_, err = app.models.Users.GetByEmail("alice@example.com")
+	if !errors.Is(err, data.ErrRecordNotFound) {
+		t.Errorf("got error %v looking up the user; want ErrRecordNotFound", err)
+	}
+}
+
+// The public profiles are identified by the public ID rather than the serial ID, and
+// the profile of a public ID which isn't a valid UUID, or is the nil UUID, is not found.
+func TestUserProfiles(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t)
+
+	user, _ := newTestUser(t, app, "reader", "reader")
+
+	unknown, err := data.NewUUID()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	publicID := user.PublicID.String()
+
+	tests := []struct {
+		name     string
+		path     string
+		wantCode int
+	}{
+		{"by username", "/v1/users/username/reader", http.StatusOK},
+		{"by public id", "/v1/users/public/" + publicID, http.StatusOK},
+		{"by upper case public id", "/v1/users/public/" + strings.ToUpper(publicID), http.StatusOK},
+		{"unknown public id", "/v1/users/public/" + unknown.String(), http.StatusNotFound},
+		{"nil public id", "/v1/users/public/00000000-0000-0000-0000-000000000000", http.StatusNotFound},
+		{"serial id", "/v1/users/public/" + strconv.FormatInt(user.ID, 10), http.StatusNotFound},
+		{"no hyphens", "/v1/users/public/" + strings.ReplaceAll(publicID, "-", ""), http.StatusNotFound},
+		{"truncated", "/v1/users/public/" + publicID[:35], http.StatusNotFound},
+		{"not hex", "/v1/users/public/" + publicID[:35] + "z", http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, body := ts.do(t, http.MethodGet, tt.path, "", nil)
+			if code != tt.wantCode {
+				t.Fatalf("got status %d; want %d (body %v)", code, tt.wantCode, body)
+			}
+
+			if tt.wantCode != http.StatusOK {
+				return
+			}
+
+			profile, _ := body["user"].(map[string]interface{})
+			if profile["id"] != publicID || profile["username"] != "reader" {
+				t.Errorf("got profile %v; want the public ID %s and username reader", profile, publicID)
+			}
+
+			if _, ok := profile["email"]; ok {
+				t.Errorf("got profile %v; want no email address", profile)
+			}
+		})
+	}
+}
+
+func TestDeleteCurrentUser(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t)
+
+	user, token := newTestUser(t, app, "reader", "reader")
+
+	// An email addressed to the user and an export of their data should both go along
+	// with the account.
+	err := app.models.EmailJobs.Insert(&data.EmailJob{Recipient: user.Email, Locale: "en", Template: "user_welcome.tmpl"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, err = app.exports.start(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code, _ := ts.do(t, http.MethodDelete, "/v1/users/me", token, map[string]string{"password": "wrong password"})
+	if code != http.StatusUnauthorized {
+		t.Fatalf("got status %d with the wrong password; want %d", code, http.StatusUnauthorized)
+	}
+
+	code, body := ts.do(t, http.MethodDelete, "/v1/users/me", token, map[string]string{"password": "pa55word1234"})
+	if code != http.StatusNoContent {
+		t.Fatalf("got status %d; want %d (body %v)", code, http.StatusNoContent, body)
+	}
+
+	_, err = app.models.Users.Get(user.ID)
+	if err != data.ErrRecordNotFound {
+		t.Errorf("got error %v getting the deleted user; want %v", err, data.ErrRecordNotFound)
+	}
+
+	code, _ = ts.do(t, http.MethodGet, "/v1/me", token, nil)
+	if code != http.StatusUnauthorized {
+		t.Errorf("got status %d using the deleted user's token; want %d", code, http.StatusUnauthorized)
+	}
+
+	jobs, _, err := app.models.EmailJobs.GetAll(data.EmailJobPending, data.Filters{Page: 1, PageSize: 20, Sort: "id", SortSafelist: []string{"id"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 0 {
+		t.Errorf("got pending email jobs %v after deleting the user; want none", jobs)
+	}
+
+	if len(app.exports.jobs) != 0 {
+		t.Errorf("got %d export jobs after deleting the user; want none", len(app.exports.jobs))
+	}
+}
+
+// A user who signed up with Google has no password to confirm, so they can delete
+// their account without one.
+func TestDeleteCurrentUserOAuth(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t)
+
+	user := &data.User{
+		Name:          "Olivia",
+		Username:      "olivia",
+		Email:         "olivia@example.com",
+		Activated:     true,
+		OAuthProvider: "google",
+		OAuthSubject:  "1234",
+	}
+
+	err := app.models.Users.Insert(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := app.models.Tokens.New(user.ID, time.Hour, data.ScopeAuthentication)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code, body := ts.do(t, http.MethodDelete, "/v1/users/me", token.Plaintext, nil)
+	if code != http.StatusNoContent {
+		t.Fatalf("got status %d; want %d (body %v)", code, http.StatusNoContent, body)
+	}
+
+	_, err = app.models.Users.Get(user.ID)
+	if err != data.ErrRecordNotFound {
+		t.Errorf("got error %v getting the deleted user; want %v", err, data.ErrRecordNotFound)
+	}
+}
+
+func TestDeleteUser(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t)
+
+	user, _ := newTestUser(t, app, "reader", "reader")
+	_, otherToken := newTestUser(t, app, "other", "reader")
+	_, adminToken := newTestUser(t, app, "admin", "admin")
+
+	path := "/v1/users/" + strconv.FormatInt(user.ID, 10)
+
+	code, _ := ts.do(t, http.MethodDelete, path, otherToken, nil)
+	if code != http.StatusForbidden {
+		t.Errorf("got status %d deleting another user without users:admin; want %d", code, http.StatusForbidden)
+	}
+
+	code, body := ts.do(t, http.MethodDelete, path, adminToken, nil)
+	if code != http.StatusNoContent {
+		t.Fatalf("got status %d; want %d (body %v)", code, http.StatusNoContent, body)
+	}
+
+	code, _ = ts.do(t, http.MethodDelete, path, adminToken, nil)
+	if code != http.StatusNotFound {
+		t.Errorf("got status %d deleting the user again; want %d", code, http.StatusNotFound)
+	}
+}
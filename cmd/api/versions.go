@@ -0,0 +1,100 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/petrostrak/an-open-movie-database/internal/validator"
+)
+
+// The versions of the API. A route's path starts with the version it's served under,
+// such as "/v2/movies".
+const (
+	apiV1 = "v1"
+	apiV2 = "v2"
+)
+
+// The vendor media types which a client can send in its Accept header to ask for a
+// version of the API, whatever the path says. Responses to them are JSON, with the
+// media type as their Content-Type.
+var versionMediaTypes = map[string]string{
+	"application/vnd.omdb.v1+json": apiV1,
+	"application/vnd.omdb.v2+json": apiV2,
+}
+
+// Define a routeGroup type for registering routes under one or more versions of the
+// API. The handler is shared between the versions, and reads the version it's serving
+// from the request context to choose the representation it responds with.
+type routeGroup struct {
+	app      *application
+	versions []string
+}
+
+// The versions() helper returns a routeGroup for the given versions.
+func (app *application) versions(versions ...string) routeGroup {
+	return routeGroup{app: app, versions: versions}
+}
+
+// The handle() method registers the handler for the pattern under each of the group's
+// versions, so that "/movies" is registered as "/v1/movies" and "/v2/movies".
+func (g routeGroup) handle(method, pattern string, handler http.HandlerFunc) {
+	for _, version := range g.versions {
+		g.app.handle(method, "/"+version+pattern, g.app.apiVersion(version, g.versions, handler))
+	}
+}
+
+// The apiVersion() middleware records the version of the API that the request is
+// served under in the request context. That's the one in the path, unless the Accept
+// header asks for another with a vendor media type, which must be one of the versions
+// the route is available in; otherwise the client gets a 406 Not Acceptable response.
+//
+// Responses under v1 carry the Deprecation and Sunset headers, if the -v1-deprecation
+// and -v1-sunset flags are set, as long as the route is available under v2 for the
+// client to move to.
+func (app *application) apiVersion(version string, available []string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		served := version
+
+		if requested, ok := requestedAPIVersion(r); ok {
+			if !validator.In(requested, available...) {
+				app.notAcceptableResponse(w, r)
+				return
+			}
+
+			served = requested
+		}
+
+		if served == apiV1 && validator.In(apiV2, available...) {
+			app.setDeprecationHeaders(w)
+		}
+
+		next(w, app.contextSetAPIVersion(r, served))
+	}
+}
+
+// The requestedAPIVersion() function returns the version of the API which the
+// request's Accept header asks for, if the media type it prefers is one of the vendor
+// media types.
+func requestedAPIVersion(r *http.Request) (string, bool) {
+	mediaType, ok := negotiateMediaType(r.Header.Get("Accept"), supportedMediaTypes)
+	if !ok {
+		return "", false
+	}
+
+	version, ok := versionMediaTypes[mediaType]
+	return version, ok
+}
+
+// The setDeprecationHeaders() method adds the Deprecation header, with the date that
+// v1 was deprecated on as a Unix timestamp (RFC 9745), and the Sunset header, with the
+// date it will stop being served on as an HTTP date (RFC 8594). Each is left out when
+// its flag isn't set.
+func (app *application) setDeprecationHeaders(w http.ResponseWriter) {
+	if !app.config.v1.deprecation.IsZero() {
+		w.Header().Set("Deprecation", "@"+strconv.FormatInt(app.config.v1.deprecation.Unix(), 10))
+	}
+
+	if !app.config.v1.sunset.IsZero() {
+		w.Header().Set("Sunset", app.config.v1.sunset.UTC().Format(http.TimeFormat))
+	}
+}
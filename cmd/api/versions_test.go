@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/petrostrak/an-open-movie-database/internal/data"
+)
+
+// Lock down the v1 and v2 representations of a movie, and the Accept header which
+// overrides the version in the path.
+func TestMovieVersions(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t)
+
+	_, readerToken := newTestUser(t, app, "reader", "reader")
+
+	movie := &data.Movie{Title: "Casablanca", Year: 1942, Runtime: 102, Genres: []string{"drama", "romance"}}
+	err := app.models.Movies.Insert(movie)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v1Movie := map[string]interface{}{
+		"runtime": "102 mins",
+		"genres":  []interface{}{"drama", "romance"},
+	}
+	v2Movie := map[string]interface{}{
+		"runtime": float64(102),
+		"genres":  []interface{}{map[string]interface{}{"name": "drama"}, map[string]interface{}{"name": "romance"}},
+	}
+
+	tests := []struct {
+		name            string
+		path            string
+		accept          string
+		wantStatus      int
+		wantContentType string
+		wantMovie       map[string]interface{}
+	}{
+		{"v1", "/v1/movies/%d", "", http.StatusOK, "application/json", v1Movie},
+		{"v2", "/v2/movies/%d", "", http.StatusOK, "application/json", v2Movie},
+		{"v1 listing", "/v1/movies?title=casablanca", "", http.StatusOK, "application/json", v1Movie},
+		{"v2 listing", "/v2/movies?title=casablanca", "", http.StatusOK, "application/json", v2Movie},
+		{"v2 ignores runtime format", "/v2/movies/%d?runtime_format=string", "", http.StatusOK, "application/json", v2Movie},
+		{"v2 asked for under v1", "/v1/movies/%d", "application/vnd.omdb.v2+json", http.StatusOK, "application/vnd.omdb.v2+json", v2Movie},
+		{"v1 asked for under v2", "/v2/movies/%d", "application/vnd.omdb.v1+json", http.StatusOK, "application/vnd.omdb.v1+json", v1Movie},
+		{"v1 asked for under v1", "/v1/movies/%d", "application/vnd.omdb.v1+json", http.StatusOK, "application/vnd.omdb.v1+json", v1Movie},
+		{"json preferred", "/v1/movies/%d", "application/json, application/vnd.omdb.v2+json;q=0.5", http.StatusOK, "application/json", v1Movie},
+		{"v2 of a v1 only route", "/v1/me", "application/vnd.omdb.v2+json", http.StatusNotAcceptable, "application/vnd.omdb.v2+json", nil},
+		{"v2 path of a v1 only route", "/v2/me", "", http.StatusNotFound, "application/json", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := tt.path
+			if strings.Contains(path, "%d") {
+				path = fmt.Sprintf(path, movie.ID)
+			}
+
+			req, err := http.NewRequest(http.MethodGet, ts.URL+path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Authorization", "Bearer "+readerToken)
+			if tt.accept != "" {
+				req.Header.Set("Accept", tt.accept)
+			}
+
+			res, err := ts.Client().Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer res.Body.Close()
+
+			if res.StatusCode != tt.wantStatus {
+				t.Fatalf("got status %d; want %d", res.StatusCode, tt.wantStatus)
+			}
+
+			if contentType := res.Header.Get("Content-Type"); contentType != tt.wantContentType {
+				t.Errorf("got Content-Type %q; want %q", contentType, tt.wantContentType)
+			}
+
+			if tt.wantMovie == nil {
+				return
+			}
+
+			var body struct {
+				Movie  map[string]interface{}   `json:"movie"`
+				Movies []map[string]interface{} `json:"movies"`
+			}
+
+			err = json.NewDecoder(res.Body).Decode(&body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := body.Movie
+			if len(body.Movies) > 0 {
+				got = body.Movies[0]
+			}
+
+			for key, want := range tt.wantMovie {
+				if !reflect.DeepEqual(got[key], want) {
+					t.Errorf("got %s %#v; want %#v", key, got[key], want)
+				}
+			}
+		})
+	}
+}
+
+// Responses under v1 carry the Deprecation and Sunset headers, when they're set, on
+// the routes which are available under v2.
+func TestDeprecationHeaders(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t)
+
+	_, readerToken := newTestUser(t, app, "reader", "reader")
+
+	app.config.v1.deprecation = time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+	app.config.v1.sunset = time.Date(2027, 4, 1, 0, 0, 0, 0, time.UTC)
+	t.Cleanup(func() { app.config.v1.deprecation, app.config.v1.sunset = time.Time{}, time.Time{} })
+
+	tests := []struct {
+		path            string
+		accept          string
+		wantDeprecation string
+		wantSunset      string
+	}{
+		{"/v1/movies", "", "@1790812800", "Thu, 01 Apr 2027 00:00:00 GMT"},
+		{"/v2/movies", "", "", ""},
+		{"/v2/movies", "application/vnd.omdb.v1+json", "@1790812800", "Thu, 01 Apr 2027 00:00:00 GMT"},
+		{"/v1/movies", "application/vnd.omdb.v2+json", "", ""},
+		{"/v1/me", "", "", ""},
+	}
+
+	for _, tt := range tests {
+		req, err := http.NewRequest(http.MethodGet, ts.URL+tt.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+readerToken)
+		if tt.accept != "" {
+			req.Header.Set("Accept", tt.accept)
+		}
+
+		res, err := ts.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+
+		deprecation, sunset := res.Header.Get("Deprecation"), res.Header.Get("Sunset")
+		if deprecation != tt.wantDeprecation || sunset != tt.wantSunset {
+			t.Errorf("%s with Accept %q: got Deprecation %q and Sunset %q; want %q and %q", tt.path, tt.accept, deprecation, sunset, tt.wantDeprecation, tt.wantSunset)
+		}
+	}
+}
+
+func TestParseDateFlag(t *testing.T) {
+	var date time.Time
+
+	if err := parseDateFlag("2027-04-01", &date); err != nil || !date.Equal(time.Date(2027, 4, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("got %s and error %v; want 2027-04-01", date, err)
+	}
+
+	if formatDateFlag(date) != "2027-04-01" {
+		t.Errorf("got %q formatted; want 2027-04-01", formatDateFlag(date))
+	}
+
+	if err := parseDateFlag("01/04/2027", &date); err == nil {
+		t.Error("got no error for a date in the wrong format")
+	}
+
+	if err := parseDateFlag("", &date); err != nil || !date.IsZero() {
+		t.Errorf("got %s and error %v for an empty value; want the zero time", date, err)
+	}
+}
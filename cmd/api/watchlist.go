@@ -0,0 +1,389 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/petrostrak/an-open-movie-database/internal/data"
+	"github.com/petrostrak/an-open-movie-database/internal/validator"
+)
+
+// The number of watchers read from the database at a time while queueing the emails
+// about an update to a movie.
+const watchlistBatchSize = 100
+
+// The listWatchlistHandler() handler for the "GET /v1/me/watchlist" endpoint returns
+// the movies on the authenticated user's watchlist.
+func (app *application) listWatchlistHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	entries, err := app.models.Watchlist.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"watchlist": entries}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The addToWatchlistHandler() handler for the "POST /v1/me/watchlist" endpoint puts a
+// movie on the authenticated user's watchlist. With "notify": true they're emailed
+// when the movie is updated.
+func (app *application) addToWatchlistHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		MovieID int64 `json:"movie_id"`
+		Notify  bool  `json:"notify"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if v.Check(input.MovieID > 0, "movie_id", validator.Msg("positive_integer")); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	entry, err := app.models.Watchlist.Add(user.ID, input.MovieID, input.Notify)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("movie_id", validator.Msg("movie_not_found"))
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrAlreadyWatching):
+			v.AddError("movie_id", validator.Msg("already_watching"))
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusCreated, envelope{"watchlist_entry": entry}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The updateWatchlistHandler() handler for the "PATCH /v1/me/watchlist/:id" endpoint
+// sets whether the authenticated user is emailed when the movie with that ID, which
+// must be on their watchlist, is updated.
+func (app *application) updateWatchlistHandler(w http.ResponseWriter, r *http.Request) {
+	movieID, err := app.readIDParam(r)
+	if err != nil {
+		app.invalidParamResponse(w, r, err)
+		return
+	}
+
+	var input struct {
+		Notify *bool `json:"notify"`
+	}
+
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if v.Check(input.Notify != nil, "notify", validator.Msg("required")); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	entry, err := app.models.Watchlist.SetNotify(user.ID, movieID, *input.Notify)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"watchlist_entry": entry}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The removeFromWatchlistHandler() handler for the "DELETE /v1/me/watchlist/:id"
+// endpoint takes the movie with that ID off the authenticated user's watchlist.
+func (app *application) removeFromWatchlistHandler(w http.ResponseWriter, r *http.Request) {
+	movieID, err := app.readIDParam(r)
+	if err != nil {
+		app.invalidParamResponse(w, r, err)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	err = app.models.Watchlist.Remove(user.ID, movieID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"message": "movie successfully removed from the watchlist"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The unsubscribeWatchlistHandler() handler for the "GET /v1/watchlist/unsubscribe"
+// endpoint is the link at the bottom of the watchlist emails. It's a GET request, so
+// that the link works from any email client, and it doesn't need the user to sign in:
+// the token says who they are. It stops the emails about one movie, and can be
+// followed again until the token expires.
+func (app *application) unsubscribeWatchlistHandler(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+	v := validator.New()
+
+	token := app.readString(qs, "token", "")
+	movieID := int64(app.readInt(qs, "movie_id", 0, v))
+
+	v.Check(movieID > 0, "movie_id", validator.Msg("positive_integer"))
+
+	if data.ValidateTokenPlaintext(v, token); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := app.models.Users.GetForToken(data.ScopeUnsubscribe, token)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", validator.Msg("invalid_unsubscribe_token"))
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// A movie which has been taken off the watchlist since isn't emailed about either,
+	// so there's nothing to do.
+	_, err = app.models.Watchlist.SetNotify(user.ID, movieID, false)
+	if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"message": "you won't be emailed about updates to this movie any more"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Define a movieChange struct to hold a field of a movie which was changed by an
+// update, with its old and new values formatted for an email.
+type movieChange struct {
+	Field  string
+	Before string
+	After  string
+}
+
+// The movieChanges() function compares a movie before and after an update, and
+// returns the fields which changed, in the order they appear in the movie.
+func movieChanges(before, after *data.Movie) []movieChange {
+	fields := []struct {
+		name          string
+		before, after string
+	}{
+		{"title", before.Title, after.Title},
+		{"year", strconv.Itoa(int(before.Year)), strconv.Itoa(int(after.Year))},
+		{"runtime", fmt.Sprintf("%d mins", before.Runtime), fmt.Sprintf("%d mins", after.Runtime)},
+		{"genres", formatList(before.Genres), formatList(after.Genres)},
+		{"awards", formatAwards(before.Awards), formatAwards(after.Awards)},
+		{"external_ratings", formatExternalRatings(before.ExternalRatings), formatExternalRatings(after.ExternalRatings)},
+		{"plot", formatText(before.Plot), formatText(after.Plot)},
+		{"poster", formatText(before.Poster), formatText(after.Poster)},
+	}
+
+	var changes []movieChange
+
+	for _, field := range fields {
+		if field.before != field.after {
+			changes = append(changes, movieChange{Field: field.name, Before: field.before, After: field.after})
+		}
+	}
+
+	return changes
+}
+
+// The formatList() helper joins a list of values for an email, or returns "none" if
+// it's empty.
+func formatList(values []string) string {
+	if len(values) == 0 {
+		return "none"
+	}
+
+	return strings.Join(values, ", ")
+}
+
+// The formatText() helper returns a text field for an email, or "none" if it's empty.
+func formatText(value string) string {
+	if value == "" {
+		return "none"
+	}
+
+	return value
+}
+
+// The formatAwards() helper formats a movie's awards for an email, such as "Oscar Best
+// Picture (1973, won)".
+func formatAwards(awards data.Awards) string {
+	values := make([]string, len(awards))
+
+	for i, award := range awards {
+		outcome := "nominated"
+		if award.Won {
+			outcome = "won"
+		}
+
+		name := award.Name
+		if award.Category != "" {
+			name += " " + award.Category
+		}
+
+		values[i] = fmt.Sprintf("%s (%d, %s)", name, award.Year, outcome)
+	}
+
+	return formatList(values)
+}
+
+// The formatExternalRatings() helper formats a movie's external ratings for an email,
+// such as "IMDb 9.2/10".
+func formatExternalRatings(ratings data.ExternalRatings) string {
+	values := make([]string, len(ratings))
+
+	for i, rating := range ratings {
+		values[i] = fmt.Sprintf("%s %s/%s", rating.Source, strconv.FormatFloat(rating.Score, 'f', -1, 64), strconv.FormatFloat(rating.Scale, 'f', -1, 64))
+	}
+
+	return formatList(values)
+}
+
+// The notifyWatchers() helper emails the users who asked to hear about updates to a
+// movie on their watchlist, describing what changed. The emails are queued in the
+// background, so that a popular movie doesn't hold up the response to the update.
+func (app *application) notifyWatchers(before, after *data.Movie) {
+	changes := movieChanges(before, after)
+	if len(changes) == 0 {
+		return
+	}
+
+	app.background(func() {
+		queued, capped, err := app.queueWatchlistEmails(after, changes)
+
+		properties := map[string]string{
+			"movie_id": strconv.FormatInt(after.ID, 10),
+			"queued":   strconv.Itoa(queued),
+			"capped":   strconv.Itoa(capped),
+		}
+
+		if err != nil {
+			app.logger.PrintError(err, properties)
+			return
+		}
+
+		app.logger.PrintInfo("watchlist emails queued", properties)
+	})
+}
+
+// The queueWatchlistEmails() helper adds an email about the changes to a movie to the
+// outbox for each of its watchers, a batch of watchers at a time, and wakes the outbox
+// poller after each batch so that the mail workers start sending them straight away.
+// Watchers who have already had -watchlist-daily-email-cap emails today are skipped.
+// It returns the number of emails queued, and the number of watchers skipped.
+func (app *application) queueWatchlistEmails(movie *data.Movie, changes []movieChange) (queued, capped int, err error) {
+	payloadChanges := make([]map[string]string, len(changes))
+	for i, change := range changes {
+		payloadChanges[i] = map[string]string{"field": change.Field, "before": change.Before, "after": change.After}
+	}
+
+	var afterUserID int64
+
+	for {
+		watchers, err := app.models.Watchlist.GetWatchers(movie.ID, afterUserID, watchlistBatchSize)
+		if err != nil {
+			return queued, capped, err
+		}
+
+		for _, watcher := range watchers {
+			sent := false
+
+			// Count the email, issue the unsubscribe token and queue the email
+			// together, so that a failure doesn't use up the user's allowance.
+			err := app.models.WithTx(context.Background(), func(m data.Models) error {
+				ok, err := m.Watchlist.ClaimNotification(watcher.UserID, app.config.watchlist.dailyEmailCap)
+				if err != nil || !ok {
+					return err
+				}
+
+				token, err := m.Tokens.New(watcher.UserID, app.config.tokens.unsubscribeTTL, data.ScopeUnsubscribe)
+				if err != nil {
+					return err
+				}
+
+				sent = true
+
+				return m.EmailJobs.Insert(&data.EmailJob{
+					Recipient: watcher.Email,
+					Locale:    watcher.Locale,
+					Template:  "watchlist_movie_updated.tmpl",
+					Payload: map[string]interface{}{
+						"name":       watcher.Name,
+						"movieID":    movie.ID,
+						"movieTitle": movie.Title,
+						"changes":    payloadChanges,
+						"unsubscribeURL": app.apiURL("/v1/watchlist/unsubscribe", url.Values{
+							"token":    {token.Plaintext},
+							"movie_id": {strconv.FormatInt(movie.ID, 10)},
+						}),
+					},
+				})
+			})
+			if err != nil {
+				return queued, capped, err
+			}
+
+			if sent {
+				queued++
+			} else {
+				capped++
+			}
+		}
+
+		app.outbox.notify()
+
+		if len(watchers) < watchlistBatchSize {
+			return queued, capped, nil
+		}
+
+		afterUserID = watchers[len(watchers)-1].UserID
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/petrostrak/an-open-movie-database/internal/data"
+)
+
+func TestMovieChanges(t *testing.T) {
+	before := &data.Movie{
+		Title:   "The Godfather",
+		Year:    1972,
+		Runtime: 175,
+		Genres:  []string{"crime", "drama"},
+	}
+
+	after := *before
+	after.Runtime = 177
+	after.Genres = []string{"crime"}
+	after.Awards = data.Awards{{Name: "Oscar", Category: "Best Picture", Year: 1973, Won: true}}
+	after.ExternalRatings = data.ExternalRatings{{Source: "IMDb", Score: 9.2, Scale: 10}}
+
+	got := fmt.Sprint(movieChanges(before, &after))
+	want := "[{runtime 175 mins 177 mins} {genres crime, drama crime} {awards none Oscar Best Picture (1973, won)} {external_ratings none IMDb 9.2/10}]"
+
+	if got != want {
+		t.Errorf("got %s; want %s", got, want)
+	}
+
+	// A copy of a movie is unchanged, even though its slices are shared.
+	unchanged := after
+	if changes := movieChanges(&after, &unchanged); len(changes) != 0 {
+		t.Errorf("got %v for an unchanged movie; want no changes", changes)
+	}
+}
+
+func TestWatchlistEndpoints(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t)
+
+	_, token := newTestUser(t, app, "reader", "reader")
+	ids := seedMovies(t, app, 2)
+
+	code, body := ts.do(t, http.MethodPost, "/v1/me/watchlist", token, map[string]interface{}{"movie_id": ids[0], "notify": true})
+	entry, _ := body["watchlist_entry"].(map[string]interface{})
+	if code != http.StatusCreated || entry["title"] != "Movie 1" || entry["notify"] != true {
+		t.Fatalf("got status %d and body %v; want the watchlist entry", code, body)
+	}
+
+	for _, movieID := range []int64{ids[0], 9999} {
+		code, body := ts.do(t, http.MethodPost, "/v1/me/watchlist", token, map[string]interface{}{"movie_id": movieID})
+		if details, _ := body["details"].(map[string]interface{}); code != http.StatusUnprocessableEntity || details["movie_id"] == nil {
+			t.Errorf("movie %d: got status %d and body %v; want %d with an error for the movie_id", movieID, code, body, http.StatusUnprocessableEntity)
+		}
+	}
+
+	ts.do(t, http.MethodPost, "/v1/me/watchlist", token, map[string]interface{}{"movie_id": ids[1]})
+
+	code, body = ts.do(t, http.MethodPatch, fmt.Sprintf("/v1/me/watchlist/%d", ids[0]), token, map[string]interface{}{"notify": false})
+	entry, _ = body["watchlist_entry"].(map[string]interface{})
+	if code != http.StatusOK || entry["notify"] != false {
+		t.Errorf("got status %d and body %v; want notify turned off", code, body)
+	}
+
+	code, _ = ts.do(t, http.MethodPatch, fmt.Sprintf("/v1/me/watchlist/%d", ids[0]), token, map[string]interface{}{})
+	if code != http.StatusUnprocessableEntity {
+		t.Errorf("got status %d without notify; want %d", code, http.StatusUnprocessableEntity)
+	}
+
+	code, _ = ts.do(t, http.MethodDelete, fmt.Sprintf("/v1/me/watchlist/%d", ids[1]), token, nil)
+	if code != http.StatusOK {
+		t.Errorf("got status %d removing a movie; want %d", code, http.StatusOK)
+	}
+
+	for _, method := range []string{http.MethodPatch, http.MethodDelete} {
+		code, _ := ts.do(t, method, fmt.Sprintf("/v1/me/watchlist/%d", ids[1]), token, map[string]interface{}{"notify": true})
+		if code != http.StatusNotFound {
+			t.Errorf("%s: got status %d for a movie that isn't on the watchlist; want %d", method, code, http.StatusNotFound)
+		}
+	}
+
+	code, body = ts.do(t, http.MethodGet, "/v1/me/watchlist", token, nil)
+	if watchlist, _ := body["watchlist"].([]interface{}); code != http.StatusOK || len(watchlist) != 1 {
+		t.Errorf("got status %d and body %v; want one movie on the watchlist", code, body)
+	}
+}
+
+// Updating a movie emails the watchers who asked to be notified, up to the daily cap,
+// through the outbox and the mail workers. Each email links to an unsubscribe URL which
+// stops them for that movie.
+func TestWatchlistUpdateEmails(t *testing.T) {
+	mailer := &fakeMailer{}
+	app := newOutboxTestApplication(t, mailer, 0)
+	app.config.watchlist.dailyEmailCap = 1
+	ts := newTestServer(t)
+
+	_, editorToken := newTestUser(t, app, "editor", "editor")
+	movieID := seedMovies(t, app, 1)[0]
+
+	watchers := map[string]bool{"alice": true, "bob": false, "carol": true}
+	users := map[string]*data.User{}
+
+	for name, notify := range watchers {
+		user, _ := newTestUser(t, app, name, "reader")
+		users[name] = user
+
+		_, err := app.models.Watchlist.Add(user.ID, movieID, notify)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Carol has already had one email today.
+	if _, err := app.models.Watchlist.ClaimNotification(users["carol"].ID, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	code, body := ts.do(t, http.MethodPatch, fmt.Sprintf("/v1/movies/%d", movieID), editorToken, map[string]interface{}{"runtime": 200})
+	if code != http.StatusOK {
+		t.Fatalf("got status %d and body %v updating the movie; want %d", code, body, http.StatusOK)
+	}
+
+	// Wait for the emails to be queued, then send them.
+	app.wg.Wait()
+
+	runOutbox(t, app, func() bool {
+		return emailJobCount(t, app, data.EmailJobSent) == 1
+	})
+
+	if got := fmt.Sprint(mailer.sent); got != "[alice@example.com]" {
+		t.Fatalf("got emails sent to %s; want only alice", got)
+	}
+
+	payload, _ := mailer.data[0].(map[string]interface{})
+	if got := fmt.Sprint(payload["changes"]); !strings.Contains(got, "runtime") || !strings.Contains(got, "200 mins") {
+		t.Errorf("got changes %s; want the new runtime", got)
+	}
+
+	unsubscribeURL, err := url.Parse(fmt.Sprint(payload["unsubscribeURL"]))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The link works without signing in, and can be followed more than once.
+	for i := 0; i < 2; i++ {
+		code, body := ts.do(t, http.MethodGet, unsubscribeURL.RequestURI(), "", nil)
+		if code != http.StatusOK {
+			t.Fatalf("got status %d and body %v following the unsubscribe link; want %d", code, body, http.StatusOK)
+		}
+	}
+
+	entries, err := app.models.Watchlist.GetAllForUser(users["alice"].ID)
+	if err != nil || len(entries) != 1 || entries[0].Notify {
+		t.Errorf("got entries %v and error %v; want notify turned off", entries, err)
+	}
+
+	code, _ = ts.do(t, http.MethodGet, "/v1/watchlist/unsubscribe?movie_id=1&token=ABCDEFGHIJKLMNOPQRSTUVWXYZ", "", nil)
+	if code != http.StatusUnprocessableEntity {
+		t.Errorf("got status %d for an invalid token; want %d", code, http.StatusUnprocessableEntity)
+	}
+}
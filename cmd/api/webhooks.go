@@ -0,0 +1,518 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/petrostrak/an-open-movie-database/internal/data"
+	"github.com/petrostrak/an-open-movie-database/internal/httpclient"
+	"github.com/petrostrak/an-open-movie-database/internal/validator"
+)
+
+// Failed webhook deliveries are retried 3 times, backing off exponentially.
+var webhookRetryDelays = []time.Duration{2 * time.Second, 4 * time.Second, 8 * time.Second}
+
+// Define a webhookQueue type which hands deliveries to the webhook workers. Bounding
+// the number of workers bounds the number of requests we make to receivers at once,
+// however many events are fired.
+type webhookQueue struct {
+	jobs chan webhookJob
+	wg   sync.WaitGroup
+
+	// ctx is cancelled by stopWebhookWorkers(), which abandons the deliveries in
+	// progress and their retries.
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// Define a webhookJob struct to hold one event to be delivered to one webhook.
+type webhookJob struct {
+	webhook *data.Webhook
+	event   webhookEvent
+	body    []byte
+}
+
+func newWebhookQueue(capacity int) *webhookQueue {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &webhookQueue{
+		jobs:   make(chan webhookJob, capacity),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+}
+
+// The startWebhookWorkers() helper starts cfg.webhooks.workers goroutines which
+// deliver the queued events until stopWebhookWorkers() is called. Each beats after
+// every delivery, and every workerHeartbeatInterval while the queue is empty.
+func (app *application) startWebhookWorkers() {
+	q := app.webhookQueue
+
+	app.workers.register(workerWebhooks, app.config.webhooks.workers, workerHeartbeatInterval, func() int {
+		return len(q.jobs)
+	})
+
+	for i := 0; i < app.config.webhooks.workers; i++ {
+		q.wg.Add(1)
+
+		go func(i int) {
+			defer q.wg.Done()
+
+			heartbeat := time.NewTicker(workerHeartbeatInterval)
+			defer heartbeat.Stop()
+
+			for {
+				select {
+				case job := <-q.jobs:
+					app.deliverWebhook(q.ctx, job)
+				case <-heartbeat.C:
+				case <-q.ctx.Done():
+					return
+				}
+
+				app.workers.beat(workerWebhooks, i)
+			}
+		}(i)
+	}
+}
+
+// The stopWebhookWorkers() helper stops the webhook workers, cancelling any delivery
+// in progress, and waits for them to return. Unlike emails, deliveries aren't kept
+// anywhere but the queue, so the ones still queued are lost; we log how many. It must
+// only be called once nothing else can fire webhooks.
+func (app *application) stopWebhookWorkers() {
+	q := app.webhookQueue
+
+	q.cancel()
+	q.wg.Wait()
+
+	if dropped := len(q.jobs); dropped > 0 {
+		app.logger.PrintInfo("webhook deliveries dropped at shutdown", map[string]string{
+			"count": strconv.Itoa(dropped),
+		})
+	}
+}
+
+// Define a webhookEvent struct for the body of a webhook request.
+type webhookEvent struct {
+	ID        string      `json:"id"`
+	Type      string      `json:"type"`
+	CreatedAt time.Time   `json:"created_at"`
+	Data      interface{} `json:"data"`
+}
+
+// The fireWebhook() helper sends an event to every active webhook which subscribes to
+// it. Everything happens in the background, so a failure never affects the request
+// which triggered the event. If the webhook queue is full, the delivery is recorded
+// as failed rather than waiting for space.
+func (app *application) fireWebhook(eventType string, payload interface{}) {
+	app.background(func() {
+		webhooks, err := app.models.Webhooks.GetAllActiveForEvent(eventType)
+		if err != nil {
+			app.logger.PrintError(err, map[string]string{"event_type": eventType})
+			return
+		}
+
+		if len(webhooks) == 0 {
+			return
+		}
+
+		randomBytes := make([]byte, 16)
+
+		_, err = rand.Read(randomBytes)
+		if err != nil {
+			app.logger.PrintError(err, map[string]string{"event_type": eventType})
+			return
+		}
+
+		event := webhookEvent{
+			ID:        hex.EncodeToString(randomBytes),
+			Type:      eventType,
+			CreatedAt: time.Now().UTC(),
+			Data:      payload,
+		}
+
+		body, err := json.Marshal(event)
+		if err != nil {
+			app.logger.PrintError(err, map[string]string{"event_type": eventType})
+			return
+		}
+
+		for _, webhook := range webhooks {
+			select {
+			case app.webhookQueue.jobs <- webhookJob{webhook: webhook, event: event, body: body}:
+			default:
+				app.recordWebhookDelivery(&data.WebhookDelivery{
+					WebhookID: webhook.ID,
+					EventID:   event.ID,
+					EventType: event.Type,
+					Attempt:   1,
+					Error:     "webhook queue full",
+				})
+			}
+		}
+	})
+}
+
+// The deliverWebhook() helper POSTs an event to a webhook, retrying failures, and
+// records every attempt. It gives up when ctx is cancelled.
+func (app *application) deliverWebhook(ctx context.Context, job webhookJob) {
+	for attempt := 1; attempt <= len(webhookRetryDelays)+1; attempt++ {
+		if attempt > 1 {
+			timer := time.NewTimer(webhookRetryDelays[attempt-2])
+
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			}
+		}
+
+		delivery := &data.WebhookDelivery{
+			WebhookID: job.webhook.ID,
+			EventID:   job.event.ID,
+			EventType: job.event.Type,
+			Attempt:   attempt,
+		}
+
+		start := time.Now()
+		statusCode, err := postWebhook(ctx, app.httpClient, job.webhook, job.event, job.body)
+
+		delivery.DurationMS = time.Since(start).Milliseconds()
+		delivery.StatusCode = statusCode
+		delivery.Succeeded = err == nil
+		if err != nil {
+			delivery.Error = err.Error()
+		}
+
+		app.recordWebhookDelivery(delivery)
+
+		if delivery.Succeeded {
+			return
+		}
+	}
+}
+
+// The recordWebhookDelivery() helper records a delivery attempt, logging any error.
+func (app *application) recordWebhookDelivery(delivery *data.WebhookDelivery) {
+	err := app.models.WebhookDeliveries.Insert(delivery)
+	if err != nil {
+		app.logger.PrintError(err, map[string]string{
+			"webhook_id": strconv.FormatInt(delivery.WebhookID, 10),
+			"event_id":   delivery.EventID,
+		})
+	}
+}
+
+// The postWebhook() function makes a single delivery attempt, returning the response
+// status code (or 0 if there wasn't a response) and an error unless the receiver
+// responded with a 2xx status.
+//
+// The request is signed with an HMAC-SHA256 of the timestamp and body, keyed with the
+// webhook's secret, in the X-OMDB-Signature header ("t=<timestamp>,v1=<hex digest>").
+// Including the timestamp lets receivers reject replayed requests.
+//
+// The client's timeout stops a slow receiver from holding up a webhook worker
+// indefinitely. It doesn't retry the POST itself, as deliverWebhook() does, recording
+// each attempt, and while the receiver's circuit breaker is open the attempt fails
+// without a request being made.
+func postWebhook(ctx context.Context, client *httpclient.Client, webhook *data.Webhook, event webhookEvent, body []byte) (int, error) {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	mac := hmac.New(sha256.New, []byte(webhook.Secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "omdb-webhooks/"+build.Version)
+	req.Header.Set("X-OMDB-Event", event.Type)
+	req.Header.Set("X-OMDB-Event-ID", event.ID)
+	req.Header.Set("X-OMDB-Signature", fmt.Sprintf("t=%s,v1=%s", timestamp, hex.EncodeToString(mac.Sum(nil))))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	// Read (up to 1MB of) the body before closing it, so that the connection can be
+	// reused for the next delivery.
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<20))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("unexpected response status %d", resp.StatusCode)
+	}
+
+	return resp.StatusCode, nil
+}
+
+func (app *application) createWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		URL    string   `json:"url"`
+		Secret string   `json:"secret"`
+		Events []string `json:"events"`
+		Active *bool    `json:"active"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	webhook := &data.Webhook{
+		URL:    input.URL,
+		Secret: input.Secret,
+		Events: input.Events,
+		Active: true,
+	}
+
+	if input.Active != nil {
+		webhook.Active = *input.Active
+	}
+
+	// If no secret is provided, generate one. Either way it's only ever returned in
+	// this response.
+	if webhook.Secret == "" {
+		randomBytes := make([]byte, 32)
+
+		_, err = rand.Read(randomBytes)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		webhook.Secret = hex.EncodeToString(randomBytes)
+	}
+
+	v := validator.New()
+
+	if data.ValidateWebhook(v, webhook); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Webhooks.Insert(webhook)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.recordAudit(r, data.AuditEntry{
+		Action:       "webhook.create",
+		ResourceType: "webhook",
+		ResourceID:   strconv.FormatInt(webhook.ID, 10),
+	})
+
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/webhooks/%d", webhook.ID))
+
+	err = app.writeResponse(w, r, http.StatusCreated, envelope{"webhook": webhook, "secret": webhook.Secret}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) listWebhooksHandler(w http.ResponseWriter, r *http.Request) {
+	webhooks, err := app.models.Webhooks.GetAll()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"webhooks": webhooks}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) showWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	webhook, ok := app.readWebhook(w, r)
+	if !ok {
+		return
+	}
+
+	err := app.writeResponse(w, r, http.StatusOK, envelope{"webhook": webhook}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) updateWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	webhook, ok := app.readWebhook(w, r)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		URL    *string  `json:"url"`
+		Secret *string  `json:"secret"`
+		Events []string `json:"events"`
+		Active *bool    `json:"active"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	if input.URL != nil {
+		webhook.URL = *input.URL
+	}
+
+	if input.Secret != nil {
+		webhook.Secret = *input.Secret
+	}
+
+	if input.Events != nil {
+		webhook.Events = input.Events
+	}
+
+	if input.Active != nil {
+		webhook.Active = *input.Active
+	}
+
+	v := validator.New()
+
+	if data.ValidateWebhook(v, webhook); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Webhooks.Update(webhook)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.recordAudit(r, data.AuditEntry{
+		Action:       "webhook.update",
+		ResourceType: "webhook",
+		ResourceID:   strconv.FormatInt(webhook.ID, 10),
+		Metadata:     map[string]interface{}{"version": webhook.Version},
+	})
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"webhook": webhook}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) deleteWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.invalidParamResponse(w, r, err)
+		return
+	}
+
+	err = app.models.Webhooks.Delete(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.recordAudit(r, data.AuditEntry{
+		Action:       "webhook.delete",
+		ResourceType: "webhook",
+		ResourceID:   strconv.FormatInt(id, 10),
+	})
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"message": "webhook successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) listWebhookDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	webhook, ok := app.readWebhook(w, r)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		data.Filters
+	}
+
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	input.Filters.Sort = app.readString(qs, "sort", "-id")
+	input.Filters.SortSafelist = []string{"id", "created_at", "-id", "-created_at"}
+
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	deliveries, metadata, err := app.models.WebhookDeliveries.GetAllForWebhook(webhook.ID, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	deliveries, err = limitPage(app, deliveries, &metadata)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"deliveries": deliveries, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The readWebhook() helper fetches the webhook identified by the "id" URL parameter.
+// If it can't, it sends the error response and returns false.
+func (app *application) readWebhook(w http.ResponseWriter, r *http.Request) (*data.Webhook, bool) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.invalidParamResponse(w, r, err)
+		return nil, false
+	}
+
+	webhook, err := app.models.Webhooks.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+
+	return webhook, true
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/petrostrak/an-open-movie-database/internal/data"
+)
+
+// The newWebhookReceiver() helper starts a server which verifies the signature of each
+// webhook request and responds with the status returned by respond, and subscribes a
+// webhook pointing at it to every event. It returns the webhook and a count of the
+// connections which have been opened to the server.
+func newWebhookReceiver(t *testing.T, app *application, respond func(attempt int) int) (*data.Webhook, *int64) {
+	t.Helper()
+
+	var requests, conns int64
+
+	receiver := httptest.NewUnstartedServer(nil)
+	receiver.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt64(&conns, 1)
+		}
+	}
+
+	webhook := &data.Webhook{Secret: "webhook-secret", Events: data.WebhookEvents, Active: true}
+
+	receiver.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+
+		parts := strings.Split(r.Header.Get("X-OMDB-Signature"), ",")
+		if len(parts) != 2 {
+			t.Errorf("got signature header %q", r.Header.Get("X-OMDB-Signature"))
+			return
+		}
+
+		mac := hmac.New(sha256.New, []byte(webhook.Secret))
+		mac.Write([]byte(strings.TrimPrefix(parts[0], "t=") + "."))
+		mac.Write(body)
+
+		if strings.TrimPrefix(parts[1], "v1=") != hex.EncodeToString(mac.Sum(nil)) {
+			t.Error("got a webhook request with an invalid signature")
+		}
+
+		w.WriteHeader(respond(int(atomic.AddInt64(&requests, 1))))
+
+		// Send a body, which the client must read for the connection to be reused.
+		io.WriteString(w, strings.Repeat("ok", 256<<10))
+	})
+
+	receiver.Start()
+	t.Cleanup(receiver.Close)
+
+	webhook.URL = receiver.URL
+
+	err := app.models.Webhooks.Insert(webhook)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return webhook, &conns
+}
+
+// The waitForDeliveries() helper waits for n delivery attempts to be recorded for the
+// webhook, and returns them.
+func waitForDeliveries(t *testing.T, app *application, webhookID int64, n int) []*data.WebhookDelivery {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+
+	for {
+		deliveries, _, err := app.models.WebhookDeliveries.GetAllForWebhook(webhookID, data.Filters{Page: 1, PageSize: 100, Sort: "id", SortSafelist: []string{"id"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(deliveries) >= n || time.Now().After(deadline) {
+			if len(deliveries) != n {
+				t.Fatalf("got %d deliveries; want %d", len(deliveries), n)
+			}
+			return deliveries
+		}
+
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// The startTestWebhookWorkers() helper starts the webhook workers, and stops them at
+// the end of the test.
+func startTestWebhookWorkers(t *testing.T, app *application, workers int) {
+	t.Helper()
+
+	app.config.webhooks.workers = workers
+	app.startWebhookWorkers()
+	t.Cleanup(app.stopWebhookWorkers)
+}
+
+// The setWebhookRetryDelays() helper replaces the retry delays for the rest of the test.
+func setWebhookRetryDelays(t *testing.T, delays ...time.Duration) {
+	t.Helper()
+
+	saved := webhookRetryDelays
+	webhookRetryDelays = delays
+	t.Cleanup(func() { webhookRetryDelays = saved })
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t)
+	startTestWebhookWorkers(t, app, 1)
+
+	webhook, conns := newWebhookReceiver(t, app, func(int) int { return http.StatusOK })
+	_, token := newTestUser(t, app, "editor", "editor")
+
+	for i, title := range []string{"Moana", "Frozen"} {
+		code, body := ts.do(t, http.MethodPost, "/v1/movies", token, map[string]interface{}{
+			"title":   title,
+			"year":    2016,
+			"runtime": "107 mins",
+			"genres":  []string{"animation"},
+		})
+		if code != http.StatusCreated {
+			t.Fatalf("got status %d; want %d (body %v)", code, http.StatusCreated, body)
+		}
+
+		deliveries := waitForDeliveries(t, app, webhook.ID, i+1)
+
+		if d := deliveries[i]; !d.Succeeded || d.StatusCode != http.StatusOK || d.EventType != data.WebhookMovieCreated {
+			t.Errorf("got delivery %+v; want a successful movie.created delivery", d)
+		}
+	}
+
+	// The response bodies are drained, so both deliveries used the same connection.
+	if n := atomic.LoadInt64(conns); n != 1 {
+		t.Errorf("got %d connections to the receiver; want 1", n)
+	}
+}
+
+func TestWebhookRetry(t *testing.T) {
+	app := newTestApplication(t)
+	setWebhookRetryDelays(t, time.Millisecond, time.Millisecond, time.Millisecond)
+	startTestWebhookWorkers(t, app, 1)
+
+	webhook, _ := newWebhookReceiver(t, app, func(attempt int) int {
+		if attempt < 3 {
+			return http.StatusServiceUnavailable
+		}
+		return http.StatusOK
+	})
+
+	app.fireWebhook(data.WebhookMovieDeleted, envelope{"movie": envelope{"id": 1}})
+
+	deliveries := waitForDeliveries(t, app, webhook.ID, 3)
+
+	for i, d := range deliveries {
+		wantSucceeded := i == 2
+		if d.Attempt != i+1 || d.Succeeded != wantSucceeded {
+			t.Errorf("got attempt %d succeeded %t; want attempt %d succeeded %t", d.Attempt, d.Succeeded, i+1, wantSucceeded)
+		}
+	}
+}
+
+// Stopping the workers abandons the retries, rather than waiting out the backoff.
+func TestWebhookStop(t *testing.T) {
+	app := newTestApplication(t)
+	setWebhookRetryDelays(t, time.Hour)
+
+	app.config.webhooks.workers = 2
+	app.startWebhookWorkers()
+
+	webhook, _ := newWebhookReceiver(t, app, func(int) int { return http.StatusInternalServerError })
+
+	app.fireWebhook(data.WebhookMovieDeleted, envelope{"movie": envelope{"id": 1}})
+	waitForDeliveries(t, app, webhook.ID, 1)
+
+	stopped := make(chan struct{})
+
+	go func() {
+		app.stopWebhookWorkers()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("the webhook workers didn't stop")
+	}
+}
+
+// When the queue is full, a delivery is recorded as failed rather than waiting.
+func TestWebhookQueueFull(t *testing.T) {
+	app := newTestApplication(t)
+	app.webhookQueue = newWebhookQueue(1)
+
+	webhook, _ := newWebhookReceiver(t, app, func(int) int { return http.StatusOK })
+
+	// With no workers running, the first event fills the queue.
+	app.fireWebhook(data.WebhookMovieDeleted, envelope{"movie": envelope{"id": 1}})
+	app.wg.Wait()
+	app.fireWebhook(data.WebhookMovieDeleted, envelope{"movie": envelope{"id": 2}})
+	app.wg.Wait()
+
+	deliveries := waitForDeliveries(t, app, webhook.ID, 1)
+	if deliveries[0].Succeeded || deliveries[0].Error != "webhook queue full" {
+		t.Errorf("got delivery %+v; want a failed delivery for the full queue", deliveries[0])
+	}
+
+	if n := len(app.webhookQueue.jobs); n != 1 {
+		t.Errorf("got %d queued deliveries; want 1", n)
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/petrostrak/an-open-movie-database/internal/validator"
+)
+
+// The names of the background workers, as reported by the verbose healthcheck and
+// /debug/vars, and as listed in -critical-workers.
+const (
+	workerTokenCleanup    = "token_cleanup"
+	workerOutboxPoller    = "outbox_poller"
+	workerDigestScheduler = "digest_scheduler"
+	workerMail            = "mail_workers"
+	workerWebhooks        = "webhook_workers"
+	workerPopularity      = "popularity_refresh"
+)
+
+var workerNames = []string{workerTokenCleanup, workerOutboxPoller, workerDigestScheduler, workerMail, workerWebhooks, workerPopularity}
+
+// How often the mail and webhook workers beat while they wait for the queue, so that an
+// idle worker isn't mistaken for a stalled one.
+const workerHeartbeatInterval = 10 * time.Second
+
+// A worker is stale once it hasn't beaten for this many of its intervals.
+const workerStaleIntervals = 3
+
+// Define a workerRegistry type which holds the heartbeats of the background workers,
+// so that the healthcheck can tell whether they're still running.
+type workerRegistry struct {
+	mu      sync.Mutex
+	workers map[string]*worker
+}
+
+// Define a worker struct to hold a registered background component. It has a heartbeat
+// for each of its goroutines, as the time of the last one in Unix nanoseconds, which it
+// refreshes on every iteration of its loop. The queue function returns how many jobs
+// are waiting for it, and is nil if it doesn't have a queue.
+type worker struct {
+	interval time.Duration
+	queue    func() int
+	beats    []atomic.Int64
+}
+
+// Define a workerStatus struct to hold what's reported about a worker. The heartbeat
+// age is that of its goroutine which beat the longest ago.
+type workerStatus struct {
+	LastHeartbeatAge string `json:"last_heartbeat_age"`
+	Interval         string `json:"interval"`
+	Goroutines       int    `json:"goroutines"`
+	QueueDepth       *int   `json:"queue_depth,omitempty"`
+	Stale            bool   `json:"stale"`
+	Critical         bool   `json:"critical"`
+}
+
+func newWorkerRegistry() *workerRegistry {
+	return &workerRegistry{
+		workers: make(map[string]*worker),
+	}
+}
+
+// The register() method adds a worker with the given number of goroutines, each of
+// which is expected to beat at least once every interval, and counts them as having
+// just beaten. Registering a name again replaces the worker.
+func (wr *workerRegistry) register(name string, goroutines int, interval time.Duration, queue func() int) {
+	w := &worker{
+		interval: interval,
+		queue:    queue,
+		beats:    make([]atomic.Int64, goroutines),
+	}
+
+	now := time.Now().UnixNano()
+	for i := range w.beats {
+		w.beats[i].Store(now)
+	}
+
+	wr.mu.Lock()
+	defer wr.mu.Unlock()
+
+	wr.workers[name] = w
+}
+
+// The beat() method records a heartbeat from the ith goroutine of the named worker. It
+// does nothing if the worker isn't registered, as in the tests which run a worker's
+// loop directly.
+func (wr *workerRegistry) beat(name string, i int) {
+	wr.mu.Lock()
+	w, ok := wr.workers[name]
+	wr.mu.Unlock()
+
+	if ok && i < len(w.beats) {
+		w.beats[i].Store(time.Now().UnixNano())
+	}
+}
+
+// The status() method returns the status of each registered worker, by name. The
+// critical workers are those listed in -critical-workers.
+func (wr *workerRegistry) status(critical []string) map[string]workerStatus {
+	wr.mu.Lock()
+	defer wr.mu.Unlock()
+
+	now := time.Now()
+	statuses := make(map[string]workerStatus, len(wr.workers))
+
+	for name, w := range wr.workers {
+		age := w.heartbeatAge(now)
+
+		status := workerStatus{
+			LastHeartbeatAge: age.Round(time.Millisecond).String(),
+			Interval:         w.interval.String(),
+			Goroutines:       len(w.beats),
+			Stale:            age > workerStaleIntervals*w.interval,
+			Critical:         validator.In(name, critical...),
+		}
+
+		if w.queue != nil {
+			depth := w.queue()
+			status.QueueDepth = &depth
+		}
+
+		statuses[name] = status
+	}
+
+	return statuses
+}
+
+// The staleCritical() method returns the names of the critical workers which are
+// stale, in alphabetical order.
+func (wr *workerRegistry) staleCritical(critical []string) []string {
+	var stale []string
+
+	for name, status := range wr.status(critical) {
+		if status.Critical && status.Stale {
+			stale = append(stale, name)
+		}
+	}
+
+	sort.Strings(stale)
+
+	return stale
+}
+
+// The heartbeatAge() method returns how long ago the worker's goroutine which beat the
+// longest ago did so.
+func (w *worker) heartbeatAge(now time.Time) time.Duration {
+	var age time.Duration
+
+	for i := range w.beats {
+		if a := now.Sub(time.Unix(0, w.beats[i].Load())); a > age {
+			age = a
+		}
+	}
+
+	return age
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// The fakeWorkerInterval is the heartbeat interval of the fake workers, so a worker
+// is stale once it has stalled for three of them.
+const fakeWorkerInterval = 20 * time.Millisecond
+
+// The startFakeWorker() helper registers a worker with the given name and starts a
+// goroutine which beats every fakeWorkerInterval until the returned function is called,
+// when it stalls without unregistering, as a stuck worker would.
+func startFakeWorker(t *testing.T, app *application, name string, queue func() int) (stall func()) {
+	t.Helper()
+
+	app.workers.register(name, 1, fakeWorkerInterval, queue)
+
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+
+	go func() {
+		defer close(stopped)
+
+		ticker := time.NewTicker(fakeWorkerInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				app.workers.beat(name, 0)
+			}
+		}
+	}()
+
+	stalled := false
+	stall = func() {
+		if !stalled {
+			stalled = true
+			close(stop)
+			<-stopped
+		}
+	}
+	t.Cleanup(stall)
+
+	return stall
+}
+
+func TestWorkerRegistry(t *testing.T) {
+	app := newTestApplication(t)
+
+	stall := startFakeWorker(t, app, "fake", func() int { return 7 })
+	startFakeWorker(t, app, "healthy", nil)
+
+	time.Sleep(5 * fakeWorkerInterval)
+
+	status := app.workers.status([]string{"fake"})
+	if fake := status["fake"]; fake.Stale || !fake.Critical || fake.QueueDepth == nil || *fake.QueueDepth != 7 || fake.Goroutines != 1 {
+		t.Errorf("got %+v for the running worker; want it fresh, critical and with 7 queued", fake)
+	}
+
+	stall()
+	time.Sleep((workerStaleIntervals + 2) * fakeWorkerInterval)
+
+	status = app.workers.status([]string{"fake"})
+	if fake := status["fake"]; !fake.Stale {
+		t.Errorf("got %+v for the stalled worker; want it stale", fake)
+	}
+	if healthy := status["healthy"]; healthy.Stale || healthy.Critical || healthy.QueueDepth != nil {
+		t.Errorf("got %+v for the healthy worker; want it fresh, not critical and without a queue", healthy)
+	}
+
+	if stale := app.workers.staleCritical([]string{"fake", "healthy"}); fmt.Sprint(stale) != "[fake]" {
+		t.Errorf("got stale critical workers %v; want [fake]", stale)
+	}
+
+	// A worker with several goroutines is as stale as the one which beat the longest
+	// ago.
+	app.workers.register("pool", 2, fakeWorkerInterval, nil)
+	time.Sleep((workerStaleIntervals + 2) * fakeWorkerInterval)
+	app.workers.beat("pool", 0)
+
+	if pool := app.workers.status(nil)["pool"]; !pool.Stale || pool.Goroutines != 2 {
+		t.Errorf("got %+v with one of two goroutines stalled; want it stale", pool)
+	}
+}
+
+// The healthcheck reports the application as unavailable while a critical worker is
+// stale, and not for a stale worker which isn't critical.
+func TestHealthcheckStaleWorker(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t)
+
+	app.config.criticalWorkers = []string{workerOutboxPoller}
+
+	stall := startFakeWorker(t, app, workerOutboxPoller, nil)
+
+	code, body := ts.do(t, http.MethodGet, "/v1/healthcheck", "", nil)
+	if code != http.StatusOK || body["status"] != "available" {
+		t.Fatalf("got status %d and %v with the worker running; want %d and available", code, body["status"], http.StatusOK)
+	}
+
+	stall()
+	time.Sleep((workerStaleIntervals + 2) * fakeWorkerInterval)
+
+	code, body = ts.do(t, http.MethodGet, "/v1/healthcheck", "", nil)
+	if code != http.StatusServiceUnavailable || body["status"] != "unavailable" || fmt.Sprint(body["stale_workers"]) != "["+workerOutboxPoller+"]" {
+		t.Errorf("got status %d, %v and stale workers %v; want %d, unavailable and [%s]", code, body["status"], body["stale_workers"], http.StatusServiceUnavailable, workerOutboxPoller)
+	}
+
+	app.config.criticalWorkers = []string{workerMail}
+
+	code, _ = ts.do(t, http.MethodGet, "/v1/healthcheck", "", nil)
+	if code != http.StatusOK {
+		t.Errorf("got status %d with a stale worker which isn't critical; want %d", code, http.StatusOK)
+	}
+}
@@ -1,16 +1,23 @@
 module github.com/petrostrak/an-open-movie-database
 
-go 1.17
+go 1.19
 
 require (
+	github.com/felixge/httpsnoop v1.0.1
+	github.com/go-mail/mail/v2 v2.3.0
 	github.com/julienschmidt/httprouter v1.3.0
 	github.com/lib/pq v1.10.0
+	github.com/mattn/go-sqlite3 v1.14.33
+	golang.org/x/crypto v0.24.0
+	golang.org/x/sys v0.21.0
 	golang.org/x/time v0.0.0-20210723032227-1f47c861a9ac
+	google.golang.org/grpc v1.64.1
+	google.golang.org/protobuf v1.33.0
 )
 
 require (
-	github.com/felixge/httpsnoop v1.0.1 // indirect
-	github.com/go-mail/mail/v2 v2.3.0 // indirect
-	golang.org/x/crypto v0.0.0-20210921155107-089bfa567519 // indirect
+	golang.org/x/net v0.26.0 // indirect
+	golang.org/x/text v0.16.0 // indirect
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20240318140521-94a12d6c2237 // indirect
 	gopkg.in/alexcesaro/quotedprintable.v3 v3.0.0-20150716171945-2caba252f4dc // indirect
 )
@@ -0,0 +1,93 @@
+package audit
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/petrostrak/an-open-movie-database/internal/data"
+	"github.com/petrostrak/an-open-movie-database/internal/jsonlog"
+)
+
+// Define an error that is logged when an entry is dropped because the buffer is full.
+var (
+	ErrBufferFull = errors.New("audit: buffer full, entry dropped")
+)
+
+// Define a Logger type which writes audit entries to the database asynchronously.
+// Entries are queued on a buffered channel and written by a single goroutine, so that
+// recording an entry never slows down (or fails) the request that made it.
+type Logger struct {
+	model  data.AuditStore
+	logger *jsonlog.Logger
+	queue  chan *data.AuditEntry
+	once   sync.Once
+	done   chan struct{}
+}
+
+// Return a new Logger which buffers up to bufferSize entries, and start its writer
+// goroutine.
+func New(model data.AuditStore, logger *jsonlog.Logger, bufferSize int) *Logger {
+	l := &Logger{
+		model:  model,
+		logger: logger,
+		queue:  make(chan *data.AuditEntry, bufferSize),
+		done:   make(chan struct{}),
+	}
+
+	go l.run()
+
+	return l
+}
+
+// Record queues an entry to be written. If the buffer is full the entry is dropped and
+// the problem is logged, rather than blocking the caller.
+func (l *Logger) Record(ctx context.Context, entry data.AuditEntry) {
+	if entry.OccurredAt.IsZero() {
+		entry.OccurredAt = time.Now()
+	}
+
+	if entry.RequestID == "" {
+		entry.RequestID = data.RequestIDFromContext(ctx)
+	}
+
+	select {
+	case l.queue <- &entry:
+	default:
+		l.logger.PrintError(ErrBufferFull, map[string]string{
+			"action":        entry.Action,
+			"resource_type": entry.ResourceType,
+			"resource_id":   entry.ResourceID,
+		})
+	}
+}
+
+// Close stops accepting entries and blocks until everything already queued has been
+// written. It should be called during graceful shutdown, after any background
+// goroutines which might record entries have finished.
+func (l *Logger) Close() {
+	l.once.Do(func() {
+		close(l.queue)
+	})
+
+	<-l.done
+}
+
+// The run() method writes queued entries until the queue is closed and drained.
+func (l *Logger) run() {
+	defer close(l.done)
+
+	for entry := range l.queue {
+		err := l.model.Insert(entry)
+		if err != nil {
+			l.logger.PrintError(err, map[string]string{
+				"action":        entry.Action,
+				"resource_type": entry.ResourceType,
+				"resource_id":   entry.ResourceID,
+				"user_id":       strconv.FormatInt(entry.UserID, 10),
+			})
+		}
+	}
+}
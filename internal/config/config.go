@@ -0,0 +1,276 @@
+// Package config fills in the command-line flags of a flag.FlagSet from environment
+// variables and a YAML config file. A flag given on the command line wins, then its
+// environment variable, then the config file, and then the flag's default.
+package config
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// EnvPrefix is the prefix of the environment variable for each flag. The rest of its
+// name is the flag's name in upper case, with underscores for hyphens, so -db-dsn is
+// read from OMDB_DB_DSN.
+const EnvPrefix = "OMDB_"
+
+// EnvName returns the name of the environment variable for a flag.
+func EnvName(flagName string) string {
+	return EnvPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// IsSecret reports whether a flag holds a secret, such as a password or a DSN with a
+// password in it, going by its name. The values of these flags are never included in
+// Effective() or in error messages.
+func IsSecret(flagName string) bool {
+	for _, suffix := range []string{"-dsn", "-password", "-pass", "-secret", "-key"} {
+		if strings.HasSuffix(flagName, suffix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Load adds a -config flag to the flag set for the path of the config file, which can
+// also be set with the OMDB_CONFIG environment variable, and parses the command-line
+// arguments. It then sets each flag which wasn't on the command line from its
+// environment variable or, failing that, from the config file.
+//
+// The flags named in commandLineOnly, such as -version, are only read from the command
+// line, as setting them anywhere else would change what every run of the command does.
+func Load(fs *flag.FlagSet, args []string, commandLineOnly ...string) error {
+	path := fs.String("config", "", "Path to a YAML config file of flag settings (optional)")
+
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	skip := map[string]bool{"config": true}
+	for _, name := range commandLineOnly {
+		skip[name] = true
+	}
+
+	// Note the flags which were given on the command line, which take precedence.
+	fs.Visit(func(f *flag.Flag) {
+		skip[f.Name] = true
+	})
+
+	if *path == "" {
+		*path = os.Getenv(EnvName("config"))
+	}
+
+	var file map[string]string
+
+	if *path != "" {
+		file, err = readFile(*path)
+		if err != nil {
+			return err
+		}
+
+		for key := range file {
+			if fs.Lookup(key) == nil || key == "config" {
+				return fmt.Errorf("config file %s: unknown setting %q", *path, key)
+			}
+		}
+	}
+
+	var errs []string
+
+	fs.VisitAll(func(f *flag.Flag) {
+		if skip[f.Name] {
+			return
+		}
+
+		source := EnvName(f.Name)
+		value, found := os.LookupEnv(source)
+
+		if !found {
+			source = "config file " + *path
+			value, found = file[f.Name]
+		}
+
+		if !found {
+			return
+		}
+
+		err := fs.Set(f.Name, value)
+		if err != nil {
+			if IsSecret(f.Name) {
+				errs = append(errs, fmt.Sprintf("invalid value for -%s from %s", f.Name, source))
+			} else {
+				errs = append(errs, fmt.Sprintf("invalid value %q for -%s from %s: %v", value, f.Name, source, err))
+			}
+		}
+	})
+
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+
+	return nil
+}
+
+// Effective returns the value of every flag in the flag set, apart from the secrets and
+// the flags named in exclude, for logging the configuration at startup.
+func Effective(fs *flag.FlagSet, exclude ...string) map[string]string {
+	skip := make(map[string]bool)
+	for _, name := range exclude {
+		skip[name] = true
+	}
+
+	values := make(map[string]string)
+
+	fs.VisitAll(func(f *flag.Flag) {
+		if !skip[f.Name] && !IsSecret(f.Name) {
+			values[f.Name] = f.Value.String()
+		}
+	})
+
+	return values
+}
+
+func readFile(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("config file: %w", err)
+	}
+	defer f.Close()
+
+	settings, err := parse(f)
+	if err != nil {
+		return nil, fmt.Errorf("config file %s: %w", path, err)
+	}
+
+	return settings, nil
+}
+
+// The parse() function reads the subset of YAML which a config file needs: a mapping
+// of flag names to scalar values, one per line, such as
+//
+//	# Defaults for the staging servers.
+//	env: staging
+//	db-max-open-conns: 50
+//	cors-trusted-origins: "https://staging.example.com https://admin.example.com"
+//
+// Values may be double-quoted, with backslash escapes, or single-quoted, with a quote
+// written twice. Nested mappings and lists aren't supported, as no flag needs them.
+func parse(r io.Reader) (map[string]string, error) {
+	settings := make(map[string]string)
+	scanner := bufio.NewScanner(r)
+
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimRight(scanner.Text(), " \t\r")
+
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") || trimmed == "---" {
+			continue
+		}
+
+		if line != trimmed && !strings.HasPrefix(trimmed, "#") {
+			return nil, fmt.Errorf("line %d: nested settings are not supported", n)
+		}
+
+		if strings.HasPrefix(trimmed, "- ") {
+			return nil, fmt.Errorf("line %d: lists are not supported", n)
+		}
+
+		key, value, found := strings.Cut(trimmed, ":")
+		key = strings.TrimSpace(key)
+		if !found || key == "" {
+			return nil, fmt.Errorf("line %d: expected \"key: value\"", n)
+		}
+
+		value, err := parseValue(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+
+		if _, exists := settings[key]; exists {
+			return nil, fmt.Errorf("line %d: duplicate setting %q", n, key)
+		}
+
+		settings[key] = value
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return settings, nil
+}
+
+// The parseValue() function unquotes a scalar value and removes any trailing comment.
+func parseValue(value string) (string, error) {
+	switch {
+	case strings.HasPrefix(value, `"`):
+		// Find the closing quote, skipping escaped ones.
+		end := -1
+		for i := 1; i < len(value); i++ {
+			if value[i] == '\\' {
+				i++
+				continue
+			}
+			if value[i] == '"' {
+				end = i
+				break
+			}
+		}
+
+		if end < 0 || !isComment(value[end+1:]) {
+			return "", errors.New("invalid double-quoted value")
+		}
+
+		s, err := strconv.Unquote(value[:end+1])
+		if err != nil {
+			return "", errors.New("invalid double-quoted value")
+		}
+
+		return s, nil
+	case strings.HasPrefix(value, "'"):
+		// A quote inside the value is written as two quotes.
+		var b strings.Builder
+
+		for i := 1; i < len(value); i++ {
+			if value[i] != '\'' {
+				b.WriteByte(value[i])
+				continue
+			}
+
+			if i+1 < len(value) && value[i+1] == '\'' {
+				b.WriteByte('\'')
+				i++
+				continue
+			}
+
+			if !isComment(value[i+1:]) {
+				return "", errors.New("invalid single-quoted value")
+			}
+
+			return b.String(), nil
+		}
+
+		return "", errors.New("invalid single-quoted value")
+	default:
+		// A comment has to be preceded by a space, so that a value such as a URL
+		// with a fragment keeps its "#".
+		if i := strings.Index(value, " #"); i >= 0 {
+			value = value[:i]
+		}
+
+		return strings.TrimSpace(value), nil
+	}
+}
+
+// The isComment() function reports whether the rest of a line after a quoted value is
+// empty or a comment.
+func isComment(rest string) bool {
+	rest = strings.TrimSpace(rest)
+	return rest == "" || strings.HasPrefix(rest, "#")
+}
@@ -0,0 +1,185 @@
+// Package crypto encrypts sensitive values, such as webhook signing secrets, before
+// they're stored in the database, with AES-256-GCM.
+//
+// Each ciphertext starts with the ID of the key it was encrypted with, so that a
+// Keyring can hold the old keys alongside the current one while the stored values are
+// re-encrypted under a new key:
+//
+//	enc:1a2b3c4d:<base64 of the nonce and the sealed value>
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// KeySize is the length of an AES-256 key, in bytes.
+const KeySize = 32
+
+// The prefix of every ciphertext, which tells it apart from a value stored before
+// encryption was turned on.
+const prefix = "enc:"
+
+// Define the errors returned for a key which can't be used, and for ciphertexts which
+// can't be decrypted.
+var (
+	ErrInvalidKey = errors.New("crypto: key must be 32 bytes, base64-encoded")
+	ErrMalformed  = errors.New("crypto: malformed ciphertext")
+	ErrUnknownKey = errors.New("crypto: ciphertext was encrypted with an unknown key")
+	ErrTampered   = errors.New("crypto: ciphertext failed authentication")
+)
+
+// ParseKey decodes a base64-encoded 32-byte key, as given to -data-encryption-key.
+// Both the standard and the URL-safe alphabets are accepted, with or without padding.
+func ParseKey(s string) ([]byte, error) {
+	s = strings.TrimSpace(s)
+
+	for _, encoding := range []*base64.Encoding{base64.StdEncoding, base64.RawStdEncoding, base64.URLEncoding, base64.RawURLEncoding} {
+		key, err := encoding.DecodeString(s)
+		if err == nil && len(key) == KeySize {
+			return key, nil
+		}
+	}
+
+	return nil, ErrInvalidKey
+}
+
+// KeyID returns the ID of a key: the first 4 bytes of its SHA-256 hash, in hex. It
+// identifies the key in ciphertexts without giving anything away about it.
+func KeyID(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:4])
+}
+
+// Define a Keyring type to hold the key which new values are encrypted with, and the
+// old keys which values encrypted before a rotation can still be decrypted with. It's
+// safe for concurrent use.
+type Keyring struct {
+	currentID string
+	aeads     map[string]cipher.AEAD
+}
+
+// NewKeyring returns a keyring which encrypts with the current key, and decrypts with
+// it or any of the old ones.
+func NewKeyring(current []byte, old ...[]byte) (*Keyring, error) {
+	k := &Keyring{
+		currentID: KeyID(current),
+		aeads:     make(map[string]cipher.AEAD, 1+len(old)),
+	}
+
+	for _, key := range append([][]byte{current}, old...) {
+		if len(key) != KeySize {
+			return nil, ErrInvalidKey
+		}
+
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+
+		k.aeads[KeyID(key)] = aead
+	}
+
+	return k, nil
+}
+
+// CurrentKeyID returns the ID of the key which new values are encrypted with.
+func (k *Keyring) CurrentKeyID() string {
+	return k.currentID
+}
+
+// Encrypt encrypts a value with the current key. The key ID is authenticated along
+// with the value, so it can't be swapped for another.
+func (k *Keyring) Encrypt(plaintext string) (string, error) {
+	aead := k.aeads[k.currentID]
+
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return "", err
+	}
+
+	sealed := aead.Seal(nonce, nonce, []byte(plaintext), []byte(k.currentID))
+
+	return prefix + k.currentID + ":" + base64.RawStdEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt decrypts a value encrypted with any of the keys in the keyring. It returns
+// ErrUnknownKey if the key isn't in the keyring, and ErrTampered if the ciphertext has
+// been changed.
+func (k *Keyring) Decrypt(ciphertext string) (string, error) {
+	id, sealed, err := split(ciphertext)
+	if err != nil {
+		return "", err
+	}
+
+	aead, ok := k.aeads[id]
+	if !ok {
+		return "", fmt.Errorf("%w %s", ErrUnknownKey, id)
+	}
+
+	if len(sealed) < aead.NonceSize()+aead.Overhead() {
+		return "", ErrMalformed
+	}
+
+	nonce, sealed := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+
+	plaintext, err := aead.Open(nil, nonce, sealed, []byte(id))
+	if err != nil {
+		return "", ErrTampered
+	}
+
+	return string(plaintext), nil
+}
+
+// NeedsRotation reports whether a stored value should be encrypted again with the
+// current key: because it was stored before encryption was turned on, or was
+// encrypted with an old key.
+func (k *Keyring) NeedsRotation(value string) bool {
+	if !IsEncrypted(value) {
+		return true
+	}
+
+	id, _, err := split(value)
+
+	return err == nil && id != k.currentID
+}
+
+// IsEncrypted reports whether a stored value is a ciphertext, rather than a value
+// stored before encryption was turned on.
+func IsEncrypted(value string) bool {
+	return strings.HasPrefix(value, prefix)
+}
+
+// The split() function returns the key ID and the decoded nonce and sealed value of a
+// ciphertext.
+func split(ciphertext string) (string, []byte, error) {
+	if !IsEncrypted(ciphertext) {
+		return "", nil, ErrMalformed
+	}
+
+	id, encoded, ok := strings.Cut(strings.TrimPrefix(ciphertext, prefix), ":")
+	if !ok || id == "" {
+		return "", nil, ErrMalformed
+	}
+
+	sealed, err := base64.RawStdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", nil, ErrMalformed
+	}
+
+	return id, sealed, nil
+}
@@ -0,0 +1,185 @@
+package crypto
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func testKey(b byte) []byte {
+	return bytes.Repeat([]byte{b}, KeySize)
+}
+
+func TestParseKey(t *testing.T) {
+	key := testKey(7)
+
+	tests := []struct {
+		name    string
+		value   string
+		wantErr bool
+	}{
+		{"standard", base64.StdEncoding.EncodeToString(key), false},
+		{"unpadded", base64.RawStdEncoding.EncodeToString(key), false},
+		{"url safe", base64.URLEncoding.EncodeToString(key), false},
+		{"trailing newline", base64.StdEncoding.EncodeToString(key) + "\n", false},
+		{"empty", "", true},
+		{"too short", base64.StdEncoding.EncodeToString(key[:16]), true},
+		{"too long", base64.StdEncoding.EncodeToString(append(key, 0)), true},
+		{"not base64", strings.Repeat("!", 44), true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseKey(tt.value)
+
+		if tt.wantErr {
+			if !errors.Is(err, ErrInvalidKey) {
+				t.Errorf("%s: got error %v; want ErrInvalidKey", tt.name, err)
+			}
+			continue
+		}
+
+		if err != nil || !bytes.Equal(got, key) {
+			t.Errorf("%s: got %x and error %v; want the key", tt.name, got, err)
+		}
+	}
+}
+
+func TestEncryptRoundTrip(t *testing.T) {
+	k, err := NewKeyring(testKey(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, plaintext := range []string{"", "0123456789abcdef", "καλημέρα", strings.Repeat("x", 4096)} {
+		ciphertext, err := k.Encrypt(plaintext)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !IsEncrypted(ciphertext) || !strings.HasPrefix(ciphertext, "enc:"+k.CurrentKeyID()+":") {
+			t.Errorf("got ciphertext %q; want it prefixed with the key ID", ciphertext)
+		}
+
+		if plaintext != "" && strings.Contains(ciphertext, plaintext) {
+			t.Errorf("ciphertext %q contains the plaintext", ciphertext)
+		}
+
+		got, err := k.Decrypt(ciphertext)
+		if err != nil || got != plaintext {
+			t.Errorf("got %q and error %v; want %q", got, err, plaintext)
+		}
+	}
+
+	// Each encryption uses a new nonce.
+	a, _ := k.Encrypt("secret")
+	b, _ := k.Encrypt("secret")
+	if a == b {
+		t.Error("encrypting the same value twice gave the same ciphertext")
+	}
+}
+
+func TestDecryptTampered(t *testing.T) {
+	k, err := NewKeyring(testKey(1), testKey(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ciphertext, err := k.Encrypt("webhook secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id, sealed, err := split(ciphertext)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	flipped := append([]byte(nil), sealed...)
+	flipped[len(flipped)-1] ^= 1
+
+	encode := func(id string, sealed []byte) string {
+		return prefix + id + ":" + base64.RawStdEncoding.EncodeToString(sealed)
+	}
+
+	tests := []struct {
+		name       string
+		ciphertext string
+		want       error
+	}{
+		{"flipped bit", encode(id, flipped), ErrTampered},
+		{"truncated", encode(id, sealed[:len(sealed)-1]), ErrTampered},
+		{"swapped key ID", encode(KeyID(testKey(2)), sealed), ErrTampered},
+		{"too short", encode(id, sealed[:8]), ErrMalformed},
+		{"unknown key", encode(KeyID(testKey(3)), sealed), ErrUnknownKey},
+		{"not base64", prefix + id + ":!!!", ErrMalformed},
+		{"no key ID", prefix + base64.RawStdEncoding.EncodeToString(sealed), ErrMalformed},
+		{"plaintext", "webhook secret", ErrMalformed},
+	}
+
+	for _, tt := range tests {
+		got, err := k.Decrypt(tt.ciphertext)
+		if !errors.Is(err, tt.want) {
+			t.Errorf("%s: got %q and error %v; want %v", tt.name, got, err, tt.want)
+		}
+	}
+}
+
+func TestKeyringRotation(t *testing.T) {
+	old, err := NewKeyring(testKey(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ciphertext, err := old.Encrypt("webhook secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rotated, err := NewKeyring(testKey(2), testKey(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The old key is still accepted, but the value should be encrypted again.
+	got, err := rotated.Decrypt(ciphertext)
+	if err != nil || got != "webhook secret" {
+		t.Fatalf("got %q and error %v decrypting with the old key", got, err)
+	}
+
+	if !rotated.NeedsRotation(ciphertext) {
+		t.Error("got NeedsRotation false for a value encrypted with the old key")
+	}
+
+	if !rotated.NeedsRotation("webhook secret") {
+		t.Error("got NeedsRotation false for an unencrypted value")
+	}
+
+	reencrypted, err := rotated.Encrypt(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rotated.NeedsRotation(reencrypted) {
+		t.Error("got NeedsRotation true for a value encrypted with the current key")
+	}
+
+	// Once the old key is dropped, only the re-encrypted value can be read.
+	current, err := NewKeyring(testKey(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := current.Decrypt(ciphertext); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("got error %v for the old ciphertext; want ErrUnknownKey", err)
+	}
+
+	if got, err := current.Decrypt(reencrypted); err != nil || got != "webhook secret" {
+		t.Errorf("got %q and error %v for the re-encrypted value", got, err)
+	}
+
+	if _, err := NewKeyring(testKey(2), []byte("short")); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("got error %v for a short old key; want ErrInvalidKey", err)
+	}
+}
@@ -0,0 +1,155 @@
+package data
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Define an AuditEntry struct to represent a single administrative or write action.
+// A UserID of 0 means the action wasn't performed by an authenticated user (or that
+// the user has since been deleted).
+type AuditEntry struct {
+	ID           int64                  `json:"id"`
+	OccurredAt   time.Time              `json:"occurred_at"`
+	UserID       int64                  `json:"user_id,omitempty"`
+	Action       string                 `json:"action"`
+	ResourceType string                 `json:"resource_type"`
+	ResourceID   string                 `json:"resource_id"`
+	Metadata     map[string]interface{} `json:"metadata,omitempty"`
+	RequestID    string                 `json:"request_id,omitempty"`
+	IP           string                 `json:"ip,omitempty"`
+}
+
+// Define an AuditFilters struct to hold the optional filters for listing entries. A
+// zero value for any field means that filter isn't applied.
+type AuditFilters struct {
+	UserID int64
+	Action string
+	From   time.Time
+	To     time.Time
+}
+
+// Define the AuditModel type.
+type AuditModel struct {
+	DB      Querier
+	ReadDB  Querier
+	Dialect Dialect
+}
+
+// Insert adds an entry to the audit log.
+func (m AuditModel) Insert(entry *AuditEntry) error {
+	metadata, err := json.Marshal(entry.Metadata)
+	if err != nil {
+		return err
+	}
+
+	// A nil map marshals to "null", but we want an empty object in the database.
+	if entry.Metadata == nil {
+		metadata = []byte("{}")
+	}
+
+	query := `
+		INSERT INTO audit_log (occurred_at, user_id, action, resource_type, resource_id, metadata, request_id, ip)
+		VALUES ($1, NULLIF($2, 0), $3, $4, $5, $6, $7, $8)
+		RETURNING id`
+
+	args := []interface{}{
+		entry.OccurredAt,
+		entry.UserID,
+		entry.Action,
+		entry.ResourceType,
+		entry.ResourceID,
+		string(metadata),
+		entry.RequestID,
+		entry.IP,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, m.Dialect.Rebind(query), args...).Scan(&entry.ID)
+}
+
+// GetAll returns a page of audit log entries matching the filters.
+func (m AuditModel) GetAll(auditFilters AuditFilters, filters Filters) ([]*AuditEntry, Metadata, error) {
+	query := fmt.Sprintf(`
+		SELECT count(*) OVER(), id, occurred_at, COALESCE(user_id, 0), action, resource_type, resource_id, metadata, request_id, ip
+		FROM audit_log
+		WHERE (user_id = $1 OR $1 = 0)
+		AND (action = $2 OR $2 = '')
+		AND (%s IS NULL OR occurred_at >= $3)
+		AND (%s IS NULL OR occurred_at <= $4)
+		ORDER BY %s %s, id ASC
+		LIMIT $5 OFFSET $6`, m.Dialect.Cast("$3", "timestamptz"), m.Dialect.Cast("$4", "timestamptz"), filters.sortColumn(), filters.sortDirection())
+
+	// Pass a NULL for either end of the date range if it isn't set.
+	var from, to interface{}
+	if !auditFilters.From.IsZero() {
+		from = auditFilters.From
+	}
+	if !auditFilters.To.IsZero() {
+		to = auditFilters.To
+	}
+
+	args := []interface{}{
+		auditFilters.UserID,
+		auditFilters.Action,
+		from,
+		to,
+		filters.limit(),
+		filters.offset(),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.ReadDB.QueryContext(ctx, m.Dialect.Rebind(query), args...)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+
+	defer rows.Close()
+
+	totalRecords := 0
+	entries := []*AuditEntry{}
+
+	for rows.Next() {
+		var (
+			entry    AuditEntry
+			metadata []byte
+		)
+
+		err := rows.Scan(
+			&totalRecords,
+			&entry.ID,
+			&entry.OccurredAt,
+			&entry.UserID,
+			&entry.Action,
+			&entry.ResourceType,
+			&entry.ResourceID,
+			&metadata,
+			&entry.RequestID,
+			&entry.IP,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		err = json.Unmarshal(metadata, &entry.Metadata)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		entries = append(entries, &entry)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.limit())
+
+	return entries, metadata, nil
+}
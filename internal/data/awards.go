@@ -0,0 +1,144 @@
+package data
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/petrostrak/an-open-movie-database/internal/validator"
+)
+
+// The limits on a movie's awards and external ratings.
+const (
+	maxAwards          = 50
+	maxExternalRatings = 10
+	maxRatingScale     = 1000
+)
+
+// Define an Award struct to hold an award which a movie won or was nominated for, such
+// as {"name": "Academy Awards", "category": "Best Picture", "year": 1995, "won": true}.
+type Award struct {
+	Name     string `json:"name" xml:"name"`
+	Category string `json:"category,omitempty" xml:"category,omitempty"`
+	Year     int32  `json:"year" xml:"year"`
+	Won      bool   `json:"won" xml:"won"`
+}
+
+// Define an ExternalRating struct to hold a movie's score on another site, out of the
+// site's scale, such as {"source": "IMDb", "score": 8.8, "scale": 10} or
+// {"source": "Rotten Tomatoes", "score": 91, "scale": 100}.
+type ExternalRating struct {
+	Source string  `json:"source" xml:"source"`
+	Score  float64 `json:"score" xml:"score"`
+	Scale  float64 `json:"scale" xml:"scale"`
+}
+
+// Declare the Awards and ExternalRatings types, which are stored in jsonb columns.
+type (
+	Awards          []Award
+	ExternalRatings []ExternalRating
+)
+
+// Value() and Scan() store the awards as a JSON array.
+func (a Awards) Value() (driver.Value, error) {
+	return jsonColumnValue(a, len(a))
+}
+
+func (a *Awards) Scan(src interface{}) error {
+	return scanJSONColumn(src, a)
+}
+
+// Value() and Scan() store the ratings as a JSON array.
+func (r ExternalRatings) Value() (driver.Value, error) {
+	return jsonColumnValue(r, len(r))
+}
+
+func (r *ExternalRatings) Scan(src interface{}) error {
+	return scanJSONColumn(src, r)
+}
+
+// The jsonColumnValue() helper encodes a slice for a JSON column. An empty slice is
+// stored as an empty array, rather than null. The value is sent as a string, as lib/pq
+// would send a []byte as bytea.
+func jsonColumnValue(v interface{}, length int) (driver.Value, error) {
+	if length == 0 {
+		return "[]", nil
+	}
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	return string(b), nil
+}
+
+// The scanJSONColumn() helper decodes a JSON column, which lib/pq returns as []byte and
+// SQLite as a string.
+func scanJSONColumn(src interface{}, dst interface{}) error {
+	var b []byte
+
+	switch src := src.(type) {
+	case []byte:
+		b = src
+	case string:
+		b = []byte(src)
+	case nil:
+		return nil
+	default:
+		return fmt.Errorf("cannot scan %T into %T", src, dst)
+	}
+
+	return json.Unmarshal(b, dst)
+}
+
+// The validateAwards() function checks a movie's awards. An award can't predate the
+// movie, nor be in the future.
+func validateAwards(v *validator.Validator, movie *Movie) {
+	v.Check(len(movie.Awards) <= maxAwards, "awards", validator.Msg("awards_max", "n", maxAwards))
+
+	validator.ValidateEach(v, "awards", movie.Awards, func(v *validator.Validator, award Award) {
+		v.Check(strings.TrimSpace(award.Name) != "", "name", validator.Msg("required"))
+		v.Check(validator.MaxBytes(award.Name, 200), "name", validator.Msg("max_bytes", "n", 200))
+		v.Check(validator.MaxBytes(award.Category, 200), "category", validator.Msg("max_bytes", "n", 200))
+
+		switch {
+		case award.Year == 0:
+			v.AddError("year", validator.Msg("required"))
+		case award.Year < movie.Year:
+			v.AddError("year", validator.Msg("not_before_release"))
+		case award.Year > int32(time.Now().Year()):
+			v.AddError("year", validator.Msg("not_in_future"))
+		}
+	})
+}
+
+// The validateExternalRatings() function checks a movie's external ratings. Each
+// source may only be given once, and a score must be within its scale.
+func validateExternalRatings(v *validator.Validator, movie *Movie) {
+	v.Check(len(movie.ExternalRatings) <= maxExternalRatings, "external_ratings", validator.Msg("ratings_max", "n", maxExternalRatings))
+
+	sources := make([]string, len(movie.ExternalRatings))
+
+	validator.ValidateEach(v, "external_ratings", movie.ExternalRatings, func(v *validator.Validator, rating ExternalRating) {
+		v.Check(strings.TrimSpace(rating.Source) != "", "source", validator.Msg("required"))
+		v.Check(validator.MaxBytes(rating.Source, 100), "source", validator.Msg("max_bytes", "n", 100))
+
+		switch {
+		case rating.Scale <= 0:
+			v.AddError("scale", validator.Msg("greater_than_zero"))
+		case rating.Scale > maxRatingScale:
+			v.AddError("scale", validator.Msg("maximum", "n", maxRatingScale))
+		default:
+			v.Check(validator.Between(rating.Score, 0, rating.Scale), "score", validator.Msg("score_range", "scale", rating.Scale))
+		}
+	})
+
+	for i, rating := range movie.ExternalRatings {
+		sources[i] = strings.TrimSpace(rating.Source)
+	}
+
+	v.Check(validator.UniqueFold(sources), "external_ratings", validator.Msg("duplicate_values"))
+}
@@ -0,0 +1,75 @@
+package data
+
+import (
+	"database/sql/driver"
+	"reflect"
+	"testing"
+)
+
+func TestAwardsValueScan(t *testing.T) {
+	awards := Awards{
+		{Name: "Academy Awards", Category: "Best Picture", Year: 1995, Won: true},
+		{Name: "Golden Globes", Year: 1995},
+	}
+
+	value, err := awards.Value()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// lib/pq returns jsonb as []byte, and SQLite returns text as a string.
+	for _, src := range []interface{}{value, []byte(value.(string))} {
+		var got Awards
+
+		err := got.Scan(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(got, awards) {
+			t.Errorf("got %+v scanning %T; want %+v", got, src, awards)
+		}
+	}
+
+	for _, empty := range []Awards{nil, {}} {
+		if value, err := empty.Value(); err != nil || value != "[]" {
+			t.Errorf("got %v and error %v for %#v; want an empty array", value, err, empty)
+		}
+	}
+
+	var got Awards
+	for _, src := range []interface{}{`{"name": "not an array"}`, `[{"year": "1995"}]`, `[`, 42} {
+		if err := got.Scan(src); err == nil {
+			t.Errorf("got no error scanning %v", src)
+		}
+	}
+}
+
+func TestExternalRatingsValueScan(t *testing.T) {
+	ratings := ExternalRatings{
+		{Source: "IMDb", Score: 8.8, Scale: 10},
+		{Source: "Rotten Tomatoes", Score: 91, Scale: 100},
+	}
+
+	var _ driver.Valuer = ratings
+
+	value, err := ratings.Value()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got ExternalRatings
+
+	err = got.Scan([]byte(value.(string)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(got, ratings) {
+		t.Errorf("got %+v; want %+v", got, ratings)
+	}
+
+	if err := got.Scan(`[{"source": "IMDb", "score": "high"}]`); err == nil {
+		t.Error("got no error scanning a score which isn't a number")
+	}
+}
@@ -0,0 +1,220 @@
+package data
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// ErrUnavailable is returned, wrapped in an *UnavailableError, instead of running a
+// query while the database's circuit breaker is open.
+var ErrUnavailable = errors.New("database unavailable")
+
+// UnavailableError is the error returned while a circuit breaker is open. RetryAfter is
+// how long until the breaker lets a request through to test whether the database has
+// recovered.
+type UnavailableError struct {
+	RetryAfter time.Duration
+}
+
+func (e *UnavailableError) Error() string {
+	return ErrUnavailable.Error()
+}
+
+// Is makes errors.Is(err, ErrUnavailable) true for an *UnavailableError.
+func (e *UnavailableError) Is(target error) bool {
+	return target == ErrUnavailable
+}
+
+// Define a BreakerState type for the three states of a Breaker.
+type BreakerState int
+
+const (
+	BreakerClosed BreakerState = iota
+	BreakerOpen
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// Breaker is a circuit breaker for a database connection pool. When the database goes
+// down, every request would otherwise wait for a connection attempt to time out, so
+// after threshold consecutive connection errors the breaker opens, and for the
+// cool-down period connection attempts fail straight away with ErrUnavailable. Then
+// the breaker is half-open: it lets a single attempt through as a probe, which closes
+// the breaker if it succeeds and opens it again if it fails.
+//
+// Only connection errors (see IsConnectionError()) count, so a missing record or a
+// constraint violation never trips the breaker.
+type Breaker struct {
+	threshold int
+	cooldown  time.Duration
+	// The now field is replaced in the tests, to move the clock forward.
+	now func() time.Time
+
+	mu       sync.Mutex
+	state    BreakerState
+	failures int
+	openedAt time.Time
+	probing  bool
+	trips    int64
+}
+
+// NewBreaker returns a closed Breaker which opens after threshold consecutive
+// connection errors, for the cool-down period.
+func NewBreaker(threshold int, cooldown time.Duration) *Breaker {
+	return &Breaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+		now:       time.Now,
+	}
+}
+
+// The allow() method returns nil if a connection attempt may go ahead, and an
+// *UnavailableError if it may not. Once the cool-down has passed, the first caller is
+// let through as the probe, and the rest are turned away until its result is known.
+func (b *Breaker) allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.now()
+
+	if b.state == BreakerOpen && now.Sub(b.openedAt) >= b.cooldown {
+		b.state = BreakerHalfOpen
+	}
+
+	switch b.state {
+	case BreakerOpen:
+		return &UnavailableError{RetryAfter: b.cooldown - now.Sub(b.openedAt)}
+	case BreakerHalfOpen:
+		if b.probing {
+			return &UnavailableError{RetryAfter: time.Second}
+		}
+		b.probing = true
+	}
+
+	return nil
+}
+
+// The record() method updates the breaker with the result of a connection attempt
+// which allow() let through.
+func (b *Breaker) record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	probe := b.state == BreakerHalfOpen
+	if probe {
+		b.probing = false
+	}
+
+	switch {
+	case IsConnectionError(err):
+		b.failures++
+		if probe || b.failures >= b.threshold {
+			b.state = BreakerOpen
+			b.openedAt = b.now()
+			b.trips++
+		}
+	case errors.Is(err, context.Canceled):
+		// The caller gave up, which tells us nothing about the database. A probe
+		// which was cancelled leaves the breaker half-open for the next caller.
+	default:
+		b.state = BreakerClosed
+		b.failures = 0
+	}
+}
+
+// State returns the current state of the breaker. An open breaker whose cool-down has
+// passed is reported as half-open, as the next attempt will be a probe.
+func (b *Breaker) State() BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == BreakerOpen && b.now().Sub(b.openedAt) >= b.cooldown {
+		return BreakerHalfOpen
+	}
+
+	return b.state
+}
+
+// Stats returns the state of the breaker, the number of consecutive connection errors,
+// and the number of times it has opened, for the expvar handler.
+func (b *Breaker) Stats() map[string]interface{} {
+	state := b.State()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return map[string]interface{}{
+		"state":              state.String(),
+		"consecutive_errors": b.failures,
+		"trips":              b.trips,
+	}
+}
+
+// Connector wraps a driver.Connector so that the connections made by a pool opened
+// with sql.OpenDB() go through the breaker. database/sql returns the error from
+// Connect() to the query which needed the connection, so the models see
+// ErrUnavailable without any changes. Connections already in the pool are unaffected,
+// but once the database is down they fail, and are replaced by new ones.
+func (b *Breaker) Connector(c driver.Connector) driver.Connector {
+	return breakerConnector{Connector: c, breaker: b}
+}
+
+type breakerConnector struct {
+	driver.Connector
+	breaker *Breaker
+}
+
+func (c breakerConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	err := c.breaker.allow()
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := c.Connector.Connect(ctx)
+	c.breaker.record(err)
+
+	return conn, err
+}
+
+// IsConnectionError reports whether an error means the database couldn't be reached,
+// as opposed to a query failing. That's network errors, such as the connection being
+// refused or timing out, and PostgreSQL telling us it isn't accepting connections.
+func IsConnectionError(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		switch pqErr.Code {
+		// cannot_connect_now, too_many_connections and the connection_exception class.
+		case "57P03", "53300":
+			return true
+		}
+		return pqErr.Code.Class() == "08"
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+
+	return errors.Is(err, context.DeadlineExceeded) || errors.Is(err, io.EOF) || errors.Is(err, driver.ErrBadConn)
+}
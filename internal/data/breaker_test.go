@@ -0,0 +1,167 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Define a fakeConnector whose Connect() returns the error in its err field, or a
+// connection which does nothing, and counts the attempts.
+type fakeConnector struct {
+	err      error
+	attempts int
+}
+
+func (c *fakeConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	c.attempts++
+	if c.err != nil {
+		return nil, c.err
+	}
+	return fakeConn{}, nil
+}
+
+func (c *fakeConnector) Driver() driver.Driver { return nil }
+
+type fakeConn struct{}
+
+func (fakeConn) Prepare(query string) (driver.Stmt, error) { return nil, errors.New("not supported") }
+func (fakeConn) Close() error                              { return nil }
+func (fakeConn) Begin() (driver.Tx, error)                 { return nil, errors.New("not supported") }
+
+func TestBreaker(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	b := NewBreaker(3, 10*time.Second)
+	b.now = func() time.Time { return now }
+
+	connector := &fakeConnector{}
+
+	// Keep no idle connections, so that every ping makes a new one.
+	db := sql.OpenDB(b.Connector(connector))
+	db.SetMaxIdleConns(0)
+	defer db.Close()
+
+	refused := &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}
+
+	ping := func() error {
+		return db.PingContext(context.Background())
+	}
+
+	// Errors which aren't about the connection never trip the breaker.
+	for _, err := range []error{ErrRecordNotFound, &pq.Error{Code: "23505"}, fmt.Errorf("scanning: %w", sql.ErrNoRows)} {
+		connector.err = err
+		for i := 0; i < 5; i++ {
+			ping()
+		}
+
+		if state := b.State(); state != BreakerClosed {
+			t.Fatalf("got the breaker %s after %v; want closed", state, err)
+		}
+	}
+
+	// Two connection errors leave it closed, and a success resets the count.
+	connector.err = refused
+	ping()
+	ping()
+
+	connector.err = nil
+	if err := ping(); err != nil {
+		t.Fatal(err)
+	}
+
+	connector.err = refused
+	ping()
+	ping()
+
+	if state := b.State(); state != BreakerClosed {
+		t.Fatalf("got the breaker %s after two errors; want closed", state)
+	}
+
+	// The third consecutive error opens it, and then connections aren't attempted.
+	ping()
+
+	if state := b.State(); state != BreakerOpen {
+		t.Fatalf("got the breaker %s after three errors; want open", state)
+	}
+
+	attempts := connector.attempts
+
+	err := ping()
+
+	var unavailable *UnavailableError
+	if !errors.Is(err, ErrUnavailable) || !errors.As(err, &unavailable) || unavailable.RetryAfter != 10*time.Second {
+		t.Fatalf("got %v while open; want ErrUnavailable, retrying after 10s", err)
+	}
+
+	if connector.attempts != attempts {
+		t.Errorf("got %d connection attempts while open; want none", connector.attempts-attempts)
+	}
+
+	// Once the cool-down has passed, a failed probe opens the breaker again.
+	now = now.Add(10 * time.Second)
+
+	if state := b.State(); state != BreakerHalfOpen {
+		t.Fatalf("got the breaker %s after the cool-down; want half-open", state)
+	}
+
+	if err := ping(); errors.Is(err, ErrUnavailable) {
+		t.Fatalf("got %v for the probe; want the connection attempted", err)
+	}
+
+	if state := b.State(); state != BreakerOpen {
+		t.Fatalf("got the breaker %s after a failed probe; want open", state)
+	}
+
+	// A successful probe closes it.
+	now = now.Add(10 * time.Second)
+	connector.err = nil
+
+	if err := ping(); err != nil {
+		t.Fatalf("got %v for the probe; want success", err)
+	}
+
+	if state := b.State(); state != BreakerClosed {
+		t.Fatalf("got the breaker %s after a successful probe; want closed", state)
+	}
+
+	if stats := b.Stats(); stats["trips"] != int64(2) || stats["consecutive_errors"] != 0 {
+		t.Errorf("got stats %v; want 2 trips and no errors", stats)
+	}
+}
+
+// While the probe is running, other callers are turned away.
+func TestBreakerSingleProbe(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	b := NewBreaker(1, time.Second)
+	b.now = func() time.Time { return now }
+
+	b.allow()
+	b.record(driver.ErrBadConn)
+
+	now = now.Add(time.Second)
+
+	if err := b.allow(); err != nil {
+		t.Fatalf("got %v for the first caller after the cool-down; want the probe let through", err)
+	}
+
+	if err := b.allow(); !errors.Is(err, ErrUnavailable) {
+		t.Fatalf("got %v for a second caller during the probe; want ErrUnavailable", err)
+	}
+
+	// A cancelled probe tells us nothing, so the next caller probes instead.
+	b.record(context.Canceled)
+
+	if err := b.allow(); err != nil {
+		t.Fatalf("got %v after a cancelled probe; want another probe let through", err)
+	}
+}
@@ -0,0 +1,34 @@
+package data
+
+import (
+	_ "embed"
+	"strings"
+)
+
+// Embed the newline-delimited list of the most commonly used (and therefore most
+// commonly breached) passwords.
+//
+//go:embed common_passwords.txt
+var commonPasswordsFile string
+
+// Load the list into a map when the package is initialized, so that checking whether a
+// password is common is a single O(1) lookup.
+var commonPasswords = func() map[string]struct{} {
+	lines := strings.Split(commonPasswordsFile, "\n")
+
+	passwords := make(map[string]struct{}, len(lines))
+
+	for _, line := range lines {
+		if line = strings.TrimSpace(line); line != "" {
+			passwords[line] = struct{}{}
+		}
+	}
+
+	return passwords
+}()
+
+// IsCommonPassword returns true if the password is in the list of common passwords.
+func IsCommonPassword(password string) bool {
+	_, found := commonPasswords[password]
+	return found
+}
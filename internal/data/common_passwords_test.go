@@ -0,0 +1,111 @@
+package data
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/petrostrak/an-open-movie-database/internal/validator"
+)
+
+// A common password, or one which is the same as the user's name or the local-part of
+// their email address, ignoring case, is rejected when the user is validated.
+func TestValidateUserPassword(t *testing.T) {
+	tests := []struct {
+		name     string
+		password string
+		want     map[string][]string
+	}{
+		{"strong", "correct horse battery", map[string][]string{}},
+		{"common", "password123", map[string][]string{
+			"password": {"is too common, please choose a stronger password"},
+		}},
+		{"common number", "12345678", map[string][]string{
+			"password": {"is too common, please choose a stronger password"},
+		}},
+		{"name", "Alice Smith", map[string][]string{
+			"password": {"must not be the same as your name or email address"},
+		}},
+		{"email local-part", "ALICE.SMITH", map[string][]string{
+			"password": {"must not be the same as your name or email address"},
+		}},
+		{"whole email", "alice.smith@example.com", map[string][]string{}},
+		{"too short", "alice", map[string][]string{
+			"password": {"must be at least 8 bytes long"},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The password isn't hashed, as only the plaintext is validated.
+			user := &User{Name: "Alice Smith", Username: "alice", Email: "alice.smith@example.com", Locale: DefaultLocale}
+			user.Password = password{plaintext: &tt.password, hash: []byte("unused")}
+
+			v := validator.New()
+
+			err := ValidateUser(v, user)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := validator.Render(v.Errors, validator.DefaultLocale); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got errors %v; want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsCommonPassword(t *testing.T) {
+	tests := []struct {
+		password string
+		want     bool
+	}{
+		{"password123", true},
+		{"password", true},
+		{"12345678", true},
+		{"pASSWORD123", false},
+		{" password123", false},
+		{"correct horse battery", false},
+		{"", false},
+	}
+
+	for _, tt := range tests {
+		if got := IsCommonPassword(tt.password); got != tt.want {
+			t.Errorf("got %t for %q; want %t", got, tt.password, tt.want)
+		}
+	}
+}
+
+// Compare the map lookup with a scan of the list, for a password near the start of the
+// list, one near the end, and one which isn't in it. The lookup takes about the same
+// time for each, while the scan's time grows with the password's position.
+func BenchmarkIsCommonPassword(b *testing.B) {
+	list := strings.Fields(commonPasswordsFile)
+
+	passwords := []struct {
+		name     string
+		password string
+	}{
+		{"first", list[0]},
+		{"last", list[len(list)-1]},
+		{"missing", "correct horse battery"},
+	}
+
+	for _, p := range passwords {
+		b.Run("map/"+p.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				IsCommonPassword(p.password)
+			}
+		})
+
+		b.Run("scan/"+p.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				for _, common := range list {
+					if common == p.password {
+						break
+					}
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,23 @@
+package data
+
+import "context"
+
+// Define a custom contextKey type so that our context keys can't collide with those
+// from other packages.
+type contextKey string
+
+const requestIDContextKey = contextKey("request_id")
+
+// ContextWithRequestID returns a copy of the context carrying the ID of the current
+// request. It lives in the data package so that the data layer (and anything which
+// imports it, such as the audit log) can read the ID without depending on the API.
+func ContextWithRequestID(ctx context.Context, requestID string) context.Context {
+	return context.WithValue(ctx, requestIDContextKey, requestID)
+}
+
+// RequestIDFromContext returns the request ID carried by the context, or the empty
+// string if there isn't one.
+func RequestIDFromContext(ctx context.Context) string {
+	requestID, _ := ctx.Value(requestIDContextKey).(string)
+	return requestID
+}
@@ -0,0 +1,442 @@
+package data
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// The names of the supported database drivers, as passed to sql.Open().
+const (
+	DriverPostgres = "postgres"
+	DriverSQLite   = "sqlite"
+)
+
+// Define a Dialect interface for the parts of the queries which differ between
+// PostgreSQL and SQLite. The queries are written for PostgreSQL, with $N placeholders,
+// and Rebind() converts them for the driver in use.
+//
+// SQLite is meant for running the API locally without PostgreSQL. It has no advisory
+// locks, and FOR UPDATE is left out of the queries, as a SQLite database only has one
+// writer at a time anyway (see dialect_sqlite.go).
+type Dialect interface {
+	// Rebind() converts the placeholders in a query for the driver.
+	Rebind(query string) string
+	// Array() and ScanArray() adapt a slice for storing and scanning, in place of
+	// pq.Array().
+	Array(a interface{}) interface{}
+	ScanArray(a *[]string) interface{}
+	// Cast() casts the expression to a PostgreSQL type, where PostgreSQL needs to be
+	// told the type, such as for a placeholder.
+	Cast(expr, pgType string) string
+	// In() returns a condition which is true when the expression equals an element of
+	// the array.
+	In(expr, array string) string
+	// ArrayLength() returns the number of elements in the array, and ArrayAppend()
+	// the array in the column with the value added to the end.
+	ArrayLength(array string) string
+	ArrayAppend(column, value string) string
+	// ArrayAgg() returns an aggregate of the non-NULL values in the column as an
+	// array, in order, which is empty if there are none.
+	ArrayAgg(column string) string
+	// Unnest() returns a table expression for the FROM clause with a row for each
+	// index of the arrays, which must be the same length, and a column for each array.
+	Unnest(arrays []string, alias string, columns []string) string
+	// RowLock() returns the locking clause of a SELECT, such as FOR UPDATE, or nothing
+	// if the database doesn't lock rows.
+	RowLock(clause string) string
+	// TodayUTC() returns the current date in UTC.
+	TodayUTC() string
+	// JSONMerge() returns the JSON object in the column with the keys of the object in
+	// the placeholder added, replacing any which are already there.
+	JSONMerge(column, placeholder string) string
+	// UniqueViolation() reports whether err is a violation of the named unique
+	// constraint or index, and ForeignKeyViolation() whether it's a violation of the
+	// named foreign key constraint on the table.
+	UniqueViolation(err error, constraint string) bool
+	ForeignKeyViolation(err error, table, constraint string) bool
+	// InUseError() turns a foreign key violation from deleting the row with the id from
+	// the table into an *InUseError, and returns any other error unchanged. It may run
+	// queries on q to find the table which still refers to the row.
+	InUseError(ctx context.Context, q Querier, err error, table string, id int64) error
+	// AdvisoryLocks() reports whether the database has advisory locks (see LockModel).
+	AdvisoryLocks() bool
+	// TitleMatches() returns a condition which is true when the title matches the
+	// search terms in the given placeholder, or when they're empty.
+	TitleMatches(placeholder string) string
+	// ContainsAll() returns a condition which is true when the column holds every value
+	// in the array in the given placeholder.
+	ContainsAll(column, placeholder string) string
+	// NextSecond() returns the current time, or one second after the timestamp in the
+	// column if that's later.
+	NextSecond(column string) string
+	// JSONArrayLength() returns the number of elements in the JSON array in the column.
+	JSONArrayLength(column string) string
+	// Elements() returns a table expression for the FROM clause with a row for each
+	// element of the array in the column, whose value is alias.value.
+	Elements(column, alias string) string
+	// SimilarTo() returns a condition which is true when the text in the column has a
+	// trigram similarity() of at least similarTitleMin to the text in the placeholder.
+	SimilarTo(column, placeholder string) string
+}
+
+// DialectFor returns the dialect for a driver name.
+func DialectFor(driverName string) (Dialect, error) {
+	switch driverName {
+	case DriverPostgres:
+		return postgresDialect{}, nil
+	case DriverSQLite:
+		return sqliteDialect{}, nil
+	default:
+		return nil, fmt.Errorf("unsupported database driver %q", driverName)
+	}
+}
+
+// The sqliteConnector opens a connector for a SQLite DSN, when the SQLite driver is
+// built in (see dialect_sqlite.go).
+var sqliteConnector func(dsn string) (driver.Connector, error)
+
+// NewConnector returns a connector for the DSN with the named driver, to pass to
+// sql.OpenDB().
+func NewConnector(driverName, dsn string) (driver.Connector, error) {
+	switch driverName {
+	case DriverPostgres:
+		return pq.NewConnector(dsn)
+	case DriverSQLite:
+		if sqliteConnector == nil {
+			return nil, errors.New("the sqlite driver isn't built in: build with -tags sqlite, which needs cgo (CGO_ENABLED=1)")
+		}
+
+		return sqliteConnector(dsn)
+	default:
+		return nil, fmt.Errorf("unsupported database driver %q", driverName)
+	}
+}
+
+// The postgresDialect stores arrays in text[] columns and searches titles with full-text
+// search.
+type postgresDialect struct{}
+
+func (postgresDialect) Rebind(query string) string {
+	return query
+}
+
+func (postgresDialect) Array(a interface{}) interface{} {
+	return pq.Array(a)
+}
+
+func (postgresDialect) ScanArray(a *[]string) interface{} {
+	return pq.Array(a)
+}
+
+func (postgresDialect) Cast(expr, pgType string) string {
+	return expr + "::" + pgType
+}
+
+func (postgresDialect) In(expr, array string) string {
+	return fmt.Sprintf("%s = ANY(%s)", expr, array)
+}
+
+func (postgresDialect) ArrayLength(array string) string {
+	return fmt.Sprintf("cardinality(%s)", array)
+}
+
+func (postgresDialect) ArrayAppend(column, value string) string {
+	return fmt.Sprintf("array_append(%s, %s)", column, value)
+}
+
+func (postgresDialect) ArrayAgg(column string) string {
+	return fmt.Sprintf("COALESCE(array_agg(%[1]s ORDER BY %[1]s) FILTER (WHERE %[1]s IS NOT NULL), '{}')", column)
+}
+
+func (postgresDialect) Unnest(arrays []string, alias string, columns []string) string {
+	return fmt.Sprintf("unnest(%s) AS %s (%s)", strings.Join(arrays, ", "), alias, strings.Join(columns, ", "))
+}
+
+func (postgresDialect) RowLock(clause string) string {
+	return clause
+}
+
+func (postgresDialect) TodayUTC() string {
+	return "(NOW() AT TIME ZONE 'UTC')::date"
+}
+
+func (postgresDialect) JSONMerge(column, placeholder string) string {
+	return fmt.Sprintf("%s || %s::jsonb", column, placeholder)
+}
+
+// lib/pq's errors say which constraint was violated, as do the messages we compare.
+func (postgresDialect) UniqueViolation(err error, constraint string) bool {
+	return err.Error() == fmt.Sprintf("pq: duplicate key value violates unique constraint %q", constraint)
+}
+
+func (postgresDialect) ForeignKeyViolation(err error, table, constraint string) bool {
+	return err.Error() == fmt.Sprintf("pq: insert or update on table %q violates foreign key constraint %q", table, constraint)
+}
+
+func (postgresDialect) InUseError(ctx context.Context, q Querier, err error, table string, id int64) error {
+	return inUseError(err)
+}
+
+func (postgresDialect) AdvisoryLocks() bool {
+	return true
+}
+
+func (postgresDialect) TitleMatches(placeholder string) string {
+	return fmt.Sprintf("(to_tsvector('simple', title) @@ plainto_tsquery('simple', %[1]s) OR %[1]s = '')", placeholder)
+}
+
+func (postgresDialect) ContainsAll(column, placeholder string) string {
+	return fmt.Sprintf("(%[1]s @> %[2]s OR %[2]s = '{}')", column, placeholder)
+}
+
+func (postgresDialect) NextSecond(column string) string {
+	return fmt.Sprintf("GREATEST(NOW(), %s + interval '1 second')", column)
+}
+
+func (postgresDialect) JSONArrayLength(column string) string {
+	return fmt.Sprintf("jsonb_array_length(%s)", column)
+}
+
+func (postgresDialect) Elements(column, alias string) string {
+	return fmt.Sprintf("unnest(%s) AS %s(value)", column, alias)
+}
+
+// The % operator compares the similarity with pg_trgm.similarity_threshold, which is
+// similarTitleMin by default, and can use the trigram index on the title.
+func (postgresDialect) SimilarTo(column, placeholder string) string {
+	return fmt.Sprintf("%s %% %s", column, placeholder)
+}
+
+// The sqliteDialect stores arrays as JSON text and searches titles with LIKE, which
+// matches a substring of the title rather than whole words in any order.
+type sqliteDialect struct{}
+
+var placeholderRX = regexp.MustCompile(`\$(\d+)`)
+
+// SQLite's ?NNN placeholders are numbered like PostgreSQL's $N ones, so a placeholder
+// can still be used more than once in a query.
+func (sqliteDialect) Rebind(query string) string {
+	return placeholderRX.ReplaceAllString(query, "?$1")
+}
+
+func (sqliteDialect) Array(a interface{}) interface{} {
+	return jsonArray{a: a}
+}
+
+func (sqliteDialect) ScanArray(a *[]string) interface{} {
+	return jsonArray{a: a}
+}
+
+// SQLite's columns don't need a type, apart from citext, whose comparisons ignore case
+// like those of the columns declared with COLLATE NOCASE.
+func (sqliteDialect) Cast(expr, pgType string) string {
+	if pgType == "citext" {
+		return expr + " COLLATE NOCASE"
+	}
+
+	return expr
+}
+
+func (sqliteDialect) In(expr, array string) string {
+	return fmt.Sprintf("%s IN (SELECT value FROM json_each(%s))", expr, array)
+}
+
+func (sqliteDialect) ArrayLength(array string) string {
+	return fmt.Sprintf("json_array_length(%s)", array)
+}
+
+func (sqliteDialect) ArrayAppend(column, value string) string {
+	return fmt.Sprintf("json_insert(%s, '$[#]', %s)", column, value)
+}
+
+func (sqliteDialect) ArrayAgg(column string) string {
+	return fmt.Sprintf("COALESCE(json_group_array(%[1]s ORDER BY %[1]s) FILTER (WHERE %[1]s IS NOT NULL), '[]')", column)
+}
+
+// The elements of the JSON arrays are joined on their indexes, which json_each() has
+// as its key column.
+func (sqliteDialect) Unnest(arrays []string, alias string, columns []string) string {
+	selected := make([]string, len(arrays))
+	joins := make([]string, len(arrays))
+
+	for i, array := range arrays {
+		selected[i] = fmt.Sprintf("a%d.value AS %s", i, columns[i])
+		joins[i] = fmt.Sprintf("json_each(%s) AS a%d", array, i)
+		if i > 0 {
+			joins[i] += fmt.Sprintf(" ON a%d.key = a0.key", i)
+		}
+	}
+
+	return fmt.Sprintf("(SELECT %s FROM %s) AS %s", strings.Join(selected, ", "), strings.Join(joins, " INNER JOIN "), alias)
+}
+
+// A write transaction on SQLite locks the whole database, so there's no need to lock
+// rows. The driver begins every transaction as a write one (see dialect_sqlite.go), so
+// that rows read in a transaction can't change before it ends.
+func (sqliteDialect) RowLock(clause string) string {
+	return ""
+}
+
+func (sqliteDialect) TodayUTC() string {
+	return "date('now')"
+}
+
+// The patch only ever holds the keys being set, so json_patch() merges it the same way
+// as PostgreSQL's || operator.
+func (sqliteDialect) JSONMerge(column, placeholder string) string {
+	return fmt.Sprintf("json_patch(%s, %s)", column, placeholder)
+}
+
+// SQLite names a unique index on an expression, but otherwise names the columns, so
+// the constraints on columns are listed in sqliteUniqueColumns.
+func (sqliteDialect) UniqueViolation(err error, constraint string) bool {
+	target, ok := sqliteUniqueColumns[constraint]
+	if !ok {
+		target = fmt.Sprintf("index '%s'", constraint)
+	}
+
+	return err.Error() == "UNIQUE constraint failed: "+target
+}
+
+var sqliteUniqueColumns = map[string]string{
+	"jobs_running_idx": "jobs.kind",
+	"watchlist_pkey":   "watchlist.user_id, watchlist.movie_id",
+}
+
+// SQLite doesn't say which foreign key was violated, so this is true for any of them.
+func (sqliteDialect) ForeignKeyViolation(err error, table, constraint string) bool {
+	return err.Error() == "FOREIGN KEY constraint failed"
+}
+
+// SQLite doesn't say which table still refers to the row either, so InUseError() looks
+// for a referencing row in each table with a foreign key to it.
+func (sqliteDialect) InUseError(ctx context.Context, q Querier, err error, table string, id int64) error {
+	if err.Error() != "FOREIGN KEY constraint failed" {
+		return err
+	}
+
+	query := `
+		SELECT m.name, f."from"
+		FROM sqlite_master AS m, pragma_foreign_key_list(m.name) AS f
+		WHERE m.type = 'table' AND f."table" = ?`
+
+	rows, qErr := q.QueryContext(ctx, query, table)
+	if qErr != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var references [][2]string
+
+	for rows.Next() {
+		var ref [2]string
+
+		if rows.Scan(&ref[0], &ref[1]) != nil {
+			return err
+		}
+
+		references = append(references, ref)
+	}
+
+	if rows.Err() != nil {
+		return err
+	}
+
+	rows.Close()
+
+	for _, ref := range references {
+		query := fmt.Sprintf(`SELECT EXISTS (SELECT 1 FROM %q WHERE %q = ?)`, ref[0], ref[1])
+
+		var exists bool
+
+		if q.QueryRowContext(ctx, query, id).Scan(&exists) == nil && exists {
+			return &InUseError{Table: ref[0]}
+		}
+	}
+
+	return err
+}
+
+func (sqliteDialect) AdvisoryLocks() bool {
+	return false
+}
+
+func (sqliteDialect) TitleMatches(placeholder string) string {
+	return fmt.Sprintf("(title LIKE '%%' || %[1]s || '%%' OR %[1]s = '')", placeholder)
+}
+
+func (sqliteDialect) ContainsAll(column, placeholder string) string {
+	return fmt.Sprintf(`NOT EXISTS (
+			SELECT 1 FROM json_each(%s) AS wanted
+			WHERE wanted.value NOT IN (SELECT value FROM json_each(%s))
+		)`, placeholder, column)
+}
+
+// SQLite's timestamps are text in the format 'YYYY-MM-DD HH:MM:SS', which sorts in time
+// order, so the max() of two of them is the later one.
+func (sqliteDialect) NextSecond(column string) string {
+	return fmt.Sprintf("max(CURRENT_TIMESTAMP, datetime(%s, '+1 second'))", column)
+}
+
+func (sqliteDialect) JSONArrayLength(column string) string {
+	return fmt.Sprintf("json_array_length(%s)", column)
+}
+
+func (sqliteDialect) Elements(column, alias string) string {
+	return fmt.Sprintf("json_each(%s) AS %s", column, alias)
+}
+
+// SQLite has no pg_trgm, so similarity() is registered as a Go function (see
+// dialect_sqlite.go), and can't use an index.
+func (sqliteDialect) SimilarTo(column, placeholder string) string {
+	return fmt.Sprintf("similarity(%s, %s) >= %v", column, placeholder, similarTitleMin)
+}
+
+// The jsonArray type stores a slice as a JSON array, for databases without an array
+// type. It holds the slice, or a pointer to one to scan into. A nil slice is stored as
+// an empty array, as it is by pq.Array().
+type jsonArray struct {
+	a interface{}
+}
+
+func (j jsonArray) Value() (driver.Value, error) {
+	b, err := json.Marshal(j.a)
+	if err != nil {
+		return nil, err
+	}
+
+	if string(b) == "null" {
+		return "[]", nil
+	}
+
+	return string(b), nil
+}
+
+func (j jsonArray) Scan(src interface{}) error {
+	var b []byte
+
+	switch src := src.(type) {
+	case string:
+		b = []byte(src)
+	case []byte:
+		b = src
+	case nil:
+		b = []byte("null")
+	default:
+		return fmt.Errorf("can't scan %T into a JSON array", src)
+	}
+
+	err := json.Unmarshal(b, j.a)
+	if err != nil {
+		return errors.New("invalid JSON array: " + err.Error())
+	}
+
+	return nil
+}
@@ -0,0 +1,115 @@
+//go:build sqlite && cgo
+
+package data
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// Register the github.com/mattn/go-sqlite3 driver as DriverSQLite. It needs cgo, so it's
+// only linked in with -tags sqlite, and a build with CGO_ENABLED=0 leaves it out even
+// then (see NewConnector()).
+//
+// Each connection gets a similarity() function, in place of pg_trgm's, and a now()
+// function, so that the queries' NOW() works unchanged.
+func init() {
+	d := &sqliteDriver{SQLiteDriver: sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+			err := conn.RegisterFunc("similarity", trigramSimilarity, true)
+			if err != nil {
+				return err
+			}
+
+			return conn.RegisterFunc("now", func() string {
+				return time.Now().UTC().Format(sqliteTimeFormat)
+			}, false)
+		},
+	}}
+
+	sql.Register(DriverSQLite, d)
+	sqliteConnector = d.OpenConnector
+}
+
+// SQLite has no timestamp type, so the times are stored as text in the format of its
+// CURRENT_TIMESTAMP, in UTC and to the second, like PostgreSQL's timestamp(0). Text in
+// this format sorts in time order, so times can be compared.
+const sqliteTimeFormat = "2006-01-02 15:04:05"
+
+// The sqliteDriver wraps the go-sqlite3 driver, to turn on the options every database
+// needs, and to store times in sqliteTimeFormat.
+type sqliteDriver struct {
+	sqlite3.SQLiteDriver
+}
+
+// The DSN is a file name, with the driver's options in the query string. Foreign keys
+// are checked, and every transaction begins as a write one (BEGIN IMMEDIATE), so that
+// a transaction which reads a row and then updates it can't be overtaken by another.
+// Connections wait up to the driver's default of 5 seconds for another's transaction to
+// finish.
+func (d *sqliteDriver) Open(dsn string) (driver.Conn, error) {
+	name, query, _ := strings.Cut(dsn, "?")
+
+	options, err := url.ParseQuery(query)
+	if err != nil {
+		return nil, err
+	}
+
+	for key, value := range map[string]string{"_foreign_keys": "on", "_txlock": "immediate"} {
+		if options.Get(key) == "" {
+			options.Set(key, value)
+		}
+	}
+
+	conn, err := d.SQLiteDriver.Open(name + "?" + options.Encode())
+	if err != nil {
+		return nil, err
+	}
+
+	return sqliteConn{conn.(*sqlite3.SQLiteConn)}, nil
+}
+
+func (d *sqliteDriver) OpenConnector(dsn string) (driver.Connector, error) {
+	return sqliteDSNConnector{driver: d, dsn: dsn}, nil
+}
+
+type sqliteDSNConnector struct {
+	driver *sqliteDriver
+	dsn    string
+}
+
+func (c sqliteDSNConnector) Connect(context.Context) (driver.Conn, error) {
+	return c.driver.Open(c.dsn)
+}
+
+func (c sqliteDSNConnector) Driver() driver.Driver {
+	return c.driver
+}
+
+type sqliteConn struct {
+	*sqlite3.SQLiteConn
+}
+
+// CheckNamedValue() converts the arguments as database/sql would, and then formats
+// times in sqliteTimeFormat. The go-sqlite3 driver would otherwise store them with
+// their time zone and fractional seconds, which don't compare as text with the others.
+func (sqliteConn) CheckNamedValue(nv *driver.NamedValue) error {
+	value, err := driver.DefaultParameterConverter.ConvertValue(nv.Value)
+	if err != nil {
+		return err
+	}
+
+	if t, ok := value.(time.Time); ok {
+		value = t.UTC().Round(time.Second).Format(sqliteTimeFormat)
+	}
+
+	nv.Value = value
+
+	return nil
+}
@@ -0,0 +1,72 @@
+package data
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSQLiteRebind(t *testing.T) {
+	got := sqliteDialect{}.Rebind(`SELECT * FROM movies WHERE (title = $1 OR $1 = '') LIMIT $10`)
+	want := `SELECT * FROM movies WHERE (title = ?1 OR ?1 = '') LIMIT ?10`
+
+	if got != want {
+		t.Errorf("got %q; want %q", got, want)
+	}
+}
+
+func TestJSONArray(t *testing.T) {
+	tests := []struct {
+		name  string
+		value []string
+		want  string
+	}{
+		{"nil", nil, `[]`},
+		{"empty", []string{}, `[]`},
+		{"values", []string{"drama", "sci-fi"}, `["drama","sci-fi"]`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v, err := jsonArray{a: &tt.value}.Value()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if v != tt.want {
+				t.Errorf("got value %v; want %s", v, tt.want)
+			}
+
+			var got []string
+
+			err = jsonArray{a: &got}.Scan([]byte(tt.want))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(got) != len(tt.value) || (len(got) > 0 && !reflect.DeepEqual(got, tt.value)) {
+				t.Errorf("scanned %q; want %q", got, tt.value)
+			}
+		})
+	}
+
+	var got []string
+
+	err := jsonArray{a: &got}.Scan(42)
+	if err == nil {
+		t.Error("got no error scanning an integer")
+	}
+}
+
+func TestDialectFor(t *testing.T) {
+	for _, name := range []string{DriverPostgres, DriverSQLite} {
+		_, err := DialectFor(name)
+		if err != nil {
+			t.Errorf("DialectFor(%q): %v", name, err)
+		}
+	}
+
+	_, err := DialectFor("mysql")
+	if err == nil {
+		t.Error("got no error for an unsupported driver")
+	}
+}
@@ -0,0 +1,147 @@
+package data
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Define a DigestSubscriber struct to hold a user who is sent the daily digest of new
+// movies, and the genres it's limited to, in lowercase.
+type DigestSubscriber struct {
+	UserID int64
+	Name   string
+	Email  string
+	Locale string
+	Genres []string
+}
+
+// Define the DigestModel type.
+type DigestModel struct {
+	DB      Querier
+	ReadDB  Querier
+	Dialect Dialect
+}
+
+// GetSubscribers returns the activated users who subscribe to the digest and haven't
+// been sent one since the given time, in order of their IDs, a batch of limit users at
+// a time after afterUserID.
+func (m DigestModel) GetSubscribers(since time.Time, afterUserID int64, limit int) ([]*DigestSubscriber, error) {
+	query := fmt.Sprintf(`
+		SELECT id, name, email, locale, COALESCE(preferences->'digest_genres', '[]')
+		FROM users
+		WHERE %s AND activated
+		AND (last_digest_sent_at IS NULL OR last_digest_sent_at < $1)
+		AND id > $2
+		ORDER BY id
+		LIMIT $3`, m.Dialect.Cast("(preferences->>'digest')", "boolean"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.ReadDB.QueryContext(ctx, m.Dialect.Rebind(query), since, afterUserID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	subscribers := []*DigestSubscriber{}
+
+	for rows.Next() {
+		var subscriber DigestSubscriber
+		var genres []byte
+
+		err := rows.Scan(&subscriber.UserID, &subscriber.Name, &subscriber.Email, &subscriber.Locale, &genres)
+		if err != nil {
+			return nil, err
+		}
+
+		err = json.Unmarshal(genres, &subscriber.Genres)
+		if err != nil {
+			return nil, err
+		}
+
+		for i, genre := range subscriber.Genres {
+			subscriber.Genres[i] = strings.ToLower(genre)
+		}
+
+		subscribers = append(subscribers, &subscriber)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return subscribers, nil
+}
+
+// GetNewMovies returns up to limit movies created after since and no later than until,
+// the newest first, which have at least one of the genres, ignoring case. Every new
+// movie matches if there are no genres.
+func (m DigestModel) GetNewMovies(since, until time.Time, genres []string, limit int) ([]*Movie, error) {
+	query := fmt.Sprintf(`
+		SELECT %s
+		FROM movies
+		WHERE movies.created_at > $1 AND movies.created_at <= $2
+		AND (%s = 0 OR EXISTS (
+			SELECT 1 FROM %s WHERE %s
+		))
+		ORDER BY movies.created_at DESC, movies.id DESC
+		LIMIT $4`, movieColumns("movies"), m.Dialect.ArrayLength(m.Dialect.Cast("$3", "text[]")),
+		m.Dialect.Elements("movies.genres", "genre"), m.Dialect.In("lower(genre.value)", "$3"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.ReadDB.QueryContext(ctx, m.Dialect.Rebind(query), since, until, m.Dialect.Array(genres), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	movies := []*Movie{}
+
+	for rows.Next() {
+		var row movieRow
+
+		err := rows.Scan(row.dest(m.Dialect)...)
+		if err != nil {
+			return nil, err
+		}
+
+		movies = append(movies, row.toMovie())
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return movies, nil
+}
+
+// ClaimSent records that a user was sent the digest at sentAt, and returns false
+// without recording it if they've already been sent one since the given time, such as
+// by another instance of the API, or before a restart.
+func (m DigestModel) ClaimSent(userID int64, since, sentAt time.Time) (bool, error) {
+	query := `
+		UPDATE users
+		SET last_digest_sent_at = $1
+		WHERE id = $2 AND (last_digest_sent_at IS NULL OR last_digest_sent_at < $3)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, m.Dialect.Rebind(query), sentAt, userID, since)
+	if err != nil {
+		return false, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return rowsAffected == 1, nil
+}
@@ -0,0 +1,149 @@
+package data
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/petrostrak/an-open-movie-database/internal/testdb"
+)
+
+func TestDigestModel(t *testing.T) {
+	driverName, db := testdb.Open(t)
+
+	models, err := NewModelsForDriver(driverName, db, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var users []*User
+
+	for _, name := range []string{"alice", "bob", "carol"} {
+		user := &User{Name: name, Username: name, Email: name + "@example.com", Activated: name != "carol"}
+
+		err := user.Password.Set("pa55word1234")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = models.Users.Insert(user)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		users = append(users, user)
+	}
+
+	alice, carol := users[0], users[2]
+
+	// Alice subscribes to dramas, bob doesn't subscribe, and carol isn't activated.
+	on := true
+	for _, user := range []*User{alice, carol} {
+		_, err := models.Preferences.Update(user.ID, &Preferences{Digest: &on, DigestGenres: &[]string{"Drama"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	since := time.Now().Add(-time.Hour)
+
+	subscribers, err := models.Digests.GetSubscribers(since, 0, 10)
+	if err != nil || len(subscribers) != 1 || subscribers[0].UserID != alice.ID || fmt.Sprint(subscribers[0].Genres) != "[drama]" {
+		t.Fatalf("got subscribers %v and error %v; want alice, for dramas", subscribers, err)
+	}
+
+	for _, movie := range []*Movie{
+		{Title: "Moana", Year: 2016, Runtime: 107, Genres: []string{"animation"}},
+		{Title: "Black Panther", Year: 2018, Runtime: 134, Genres: []string{"sci-fi", "Drama"}, Plot: "T'Challa returns home."},
+	} {
+		err := models.Movies.Insert(movie)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	until := time.Now().Add(time.Minute)
+
+	movies, err := models.Digests.GetNewMovies(since, until, subscribers[0].Genres, 10)
+	if err != nil || len(movies) != 1 || movies[0].Title != "Black Panther" {
+		t.Fatalf("got movies %v and error %v; want Black Panther", movies, err)
+	}
+
+	// The movies are scanned whole, as for the other movie queries.
+	if movies[0].Plot != "T'Challa returns home." || movies[0].Version != 1 || movies[0].UpdatedAt.IsZero() {
+		t.Errorf("got %+v; want every column scanned", movies[0])
+	}
+
+	movies, err = models.Digests.GetNewMovies(since, until, nil, 10)
+	if err != nil || len(movies) != 2 {
+		t.Errorf("got movies %v and error %v; want both", movies, err)
+	}
+
+	movies, err = models.Digests.GetNewMovies(until, until.Add(time.Hour), nil, 10)
+	if err != nil || len(movies) != 0 {
+		t.Errorf("got movies %v and error %v; want none created later", movies, err)
+	}
+
+	// The digest can only be claimed once for the same day.
+	claimed, err := models.Digests.ClaimSent(alice.ID, since, time.Now())
+	if err != nil || !claimed {
+		t.Fatalf("got %t and error %v; want the first claim to succeed", claimed, err)
+	}
+
+	claimed, err = models.Digests.ClaimSent(alice.ID, since, time.Now())
+	if err != nil || claimed {
+		t.Errorf("got %t and error %v; want the second claim to fail", claimed, err)
+	}
+
+	subscribers, err = models.Digests.GetSubscribers(since, 0, 10)
+	if err != nil || len(subscribers) != 0 {
+		t.Errorf("got subscribers %v and error %v; want none left to send to", subscribers, err)
+	}
+
+	// The next day's digest can be claimed.
+	claimed, err = models.Digests.ClaimSent(alice.ID, time.Now().Add(time.Hour), time.Now().Add(time.Hour))
+	if err != nil || !claimed {
+		t.Errorf("got %t and error %v; want the next day's claim to succeed", claimed, err)
+	}
+}
+
+func TestLockModel(t *testing.T) {
+	driverName, db := testdb.Open(t)
+
+	models, err := NewModelsForDriver(driverName, db, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testTryLock(t, models)
+}
+
+func TestMockTryLock(t *testing.T) {
+	testTryLock(t, NewMockModels())
+}
+
+// The testTryLock() helper checks that a lock can only be held by one caller at a time,
+// and can be taken again once it's released.
+func testTryLock(t *testing.T, models Models) {
+	ctx := context.Background()
+
+	release, acquired, err := models.Locks.TryLock(ctx, LockDigest)
+	if err != nil || !acquired {
+		t.Fatalf("got %t and error %v; want the lock", acquired, err)
+	}
+
+	_, acquired, err = models.Locks.TryLock(ctx, LockDigest)
+	if err != nil || acquired {
+		t.Errorf("got %t and error %v; want the lock to be held", acquired, err)
+	}
+
+	release()
+
+	release, acquired, err = models.Locks.TryLock(ctx, LockDigest)
+	if err != nil || !acquired {
+		t.Fatalf("got %t and error %v; want the lock once it was released", acquired, err)
+	}
+
+	release()
+}
@@ -0,0 +1,228 @@
+package data
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Define constants for the status of an email job.
+const (
+	EmailJobPending = "pending"
+	EmailJobSent    = "sent"
+	EmailJobFailed  = "failed"
+)
+
+// Define an EmailJob struct to represent an email in the outbox. The payload holds the
+// template data, which can include tokens, so it's never included in JSON output and
+// it's cleared once the email has been sent.
+type EmailJob struct {
+	ID          int64                  `json:"id"`
+	CreatedAt   time.Time              `json:"created_at"`
+	Recipient   string                 `json:"recipient"`
+	Locale      string                 `json:"locale"`
+	Template    string                 `json:"template"`
+	Payload     map[string]interface{} `json:"-"`
+	Status      string                 `json:"status"`
+	Attempts    int                    `json:"attempts"`
+	NextRetryAt time.Time              `json:"next_retry_at"`
+	LastError   string                 `json:"last_error,omitempty"`
+	SentAt      *time.Time             `json:"sent_at,omitempty"`
+}
+
+// Define the EmailJobModel type.
+type EmailJobModel struct {
+	DB      Querier
+	ReadDB  Querier
+	Dialect Dialect
+}
+
+// Insert adds a pending email job to the outbox.
+func (m EmailJobModel) Insert(job *EmailJob) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return insertEmailJob(ctx, m.DB, m.Dialect, job)
+}
+
+// The insertEmailJob() helper runs the insert for Insert() and UserModel.Register().
+func insertEmailJob(ctx context.Context, db Querier, dialect Dialect, job *EmailJob) error {
+	payload, err := json.Marshal(job.Payload)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		INSERT INTO email_jobs (recipient, locale, template, payload)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, created_at, status, attempts, next_retry_at`
+
+	args := []interface{}{job.Recipient, job.Locale, job.Template, string(payload)}
+
+	return db.QueryRowContext(ctx, dialect.Rebind(query), args...).Scan(
+		&job.ID,
+		&job.CreatedAt,
+		&job.Status,
+		&job.Attempts,
+		&job.NextRetryAt,
+	)
+}
+
+// Claim returns up to limit pending jobs which are due, and counts an attempt for each
+// one. Claimed jobs aren't due again until the lease has passed, so if the process dies
+// while sending them they'll be picked up again afterwards. FOR UPDATE SKIP LOCKED
+// means several pollers can claim jobs at the same time without getting the same ones.
+func (m EmailJobModel) Claim(limit int, lease time.Duration) ([]*EmailJob, error) {
+	query := fmt.Sprintf(`
+		UPDATE email_jobs
+		SET attempts = attempts + 1, next_retry_at = $1
+		WHERE id IN (
+			SELECT id FROM email_jobs
+			WHERE status = 'pending' AND next_retry_at <= $2
+			ORDER BY next_retry_at, id
+			LIMIT $3
+			%s
+		)
+		RETURNING id, created_at, recipient, locale, template, payload, status, attempts, next_retry_at, last_error, sent_at`, m.Dialect.RowLock("FOR UPDATE SKIP LOCKED"))
+
+	now := time.Now()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, m.Dialect.Rebind(query), now.Add(lease), now, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	jobs := []*EmailJob{}
+
+	for rows.Next() {
+		var (
+			job     EmailJob
+			payload []byte
+		)
+
+		err := rows.Scan(
+			&job.ID,
+			&job.CreatedAt,
+			&job.Recipient,
+			&job.Locale,
+			&job.Template,
+			&payload,
+			&job.Status,
+			&job.Attempts,
+			&job.NextRetryAt,
+			&job.LastError,
+			&job.SentAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		err = json.Unmarshal(payload, &job.Payload)
+		if err != nil {
+			return nil, err
+		}
+
+		jobs = append(jobs, &job)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return jobs, nil
+}
+
+// MarkSent records that a job's email has been sent, and clears its payload.
+func (m EmailJobModel) MarkSent(id int64) error {
+	query := `
+		UPDATE email_jobs
+		SET status = 'sent', sent_at = NOW(), payload = '{}', last_error = ''
+		WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, m.Dialect.Rebind(query), id)
+	return err
+}
+
+// MarkFailed records an attempt that failed. If retryAt is the zero time the job has
+// run out of attempts and is marked as failed; otherwise it's retried at retryAt.
+func (m EmailJobModel) MarkFailed(id int64, sendErr error, retryAt time.Time) error {
+	query := `
+		UPDATE email_jobs
+		SET status = $1, next_retry_at = $2, last_error = $3
+		WHERE id = $4`
+
+	status := EmailJobPending
+	if retryAt.IsZero() {
+		status = EmailJobFailed
+		retryAt = time.Now()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, m.Dialect.Rebind(query), status, retryAt, sendErr.Error(), id)
+	return err
+}
+
+// GetAll returns a page of email jobs, optionally only those with a specific status.
+func (m EmailJobModel) GetAll(status string, filters Filters) ([]*EmailJob, Metadata, error) {
+	query := fmt.Sprintf(`
+		SELECT count(*) OVER(), id, created_at, recipient, locale, template, status, attempts, next_retry_at, last_error, sent_at
+		FROM email_jobs
+		WHERE (status = $1 OR $1 = '')
+		ORDER BY %s %s, id ASC
+		LIMIT $2 OFFSET $3`, filters.sortColumn(), filters.sortDirection())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.ReadDB.QueryContext(ctx, m.Dialect.Rebind(query), status, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+
+	defer rows.Close()
+
+	totalRecords := 0
+	jobs := []*EmailJob{}
+
+	for rows.Next() {
+		var job EmailJob
+
+		err := rows.Scan(
+			&totalRecords,
+			&job.ID,
+			&job.CreatedAt,
+			&job.Recipient,
+			&job.Locale,
+			&job.Template,
+			&job.Status,
+			&job.Attempts,
+			&job.NextRetryAt,
+			&job.LastError,
+			&job.SentAt,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		jobs = append(jobs, &job)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.limit())
+
+	return jobs, metadata, nil
+}
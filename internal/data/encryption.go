@@ -0,0 +1,51 @@
+package data
+
+import (
+	"errors"
+
+	"github.com/petrostrak/an-open-movie-database/internal/crypto"
+)
+
+// Define an error for an encrypted value read without a keyring to decrypt it with.
+var ErrEncryptionKeyMissing = errors.New("value is encrypted, but no data encryption key is set")
+
+// The keyring which the sensitive columns, such as the webhook signing secrets, are
+// encrypted with. It's nil until SetEncryptionKeyring() is called, and new values are
+// then stored unencrypted.
+var encryptionKeyring *crypto.Keyring
+
+// SetEncryptionKeyring installs the keyring used to encrypt and decrypt the sensitive
+// columns. It should be called once at startup, before any requests are served.
+func SetEncryptionKeyring(k *crypto.Keyring) {
+	encryptionKeyring = k
+}
+
+// The encryptColumn() helper encrypts a value before it's stored, if there's a
+// keyring.
+func encryptColumn(value string) (string, error) {
+	if encryptionKeyring == nil {
+		return value, nil
+	}
+
+	return encryptionKeyring.Encrypt(value)
+}
+
+// The decryptColumn() helper decrypts a stored value. Values stored before encryption
+// was turned on are returned as they are, until the rotate command encrypts them.
+func decryptColumn(value string) (string, error) {
+	if !crypto.IsEncrypted(value) {
+		return value, nil
+	}
+
+	if encryptionKeyring == nil {
+		return "", ErrEncryptionKeyMissing
+	}
+
+	return encryptionKeyring.Decrypt(value)
+}
+
+// The needsRotation() helper reports whether a stored value should be encrypted again
+// with the current key. It's always false without a keyring.
+func needsRotation(value string) bool {
+	return encryptionKeyring != nil && encryptionKeyring.NeedsRotation(value)
+}
@@ -0,0 +1,59 @@
+package data
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/petrostrak/an-open-movie-database/internal/crypto"
+)
+
+// The webhook secrets are stored encrypted, and the models only ever hand out the
+// plaintext.
+func TestWebhookSecretEncrypted(t *testing.T) {
+	keyring, err := crypto.NewKeyring(bytes.Repeat([]byte{1}, crypto.KeySize))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	SetEncryptionKeyring(keyring)
+	t.Cleanup(func() { SetEncryptionKeyring(nil) })
+
+	models := NewMockModels()
+	store := models.Webhooks.(mockWebhookStore)
+
+	webhook := &Webhook{URL: "https://example.com/hook", Secret: "0123456789abcdef", Events: []string{WebhookMovieCreated}}
+
+	err = models.Webhooks.Insert(webhook)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stored := store.storedSecret(webhook.ID)
+	if !crypto.IsEncrypted(stored) || stored == webhook.Secret {
+		t.Errorf("got stored secret %q; want it encrypted", stored)
+	}
+
+	got, err := models.Webhooks.Get(webhook.ID)
+	if err != nil || got.Secret != "0123456789abcdef" {
+		t.Fatalf("got %+v and error %v; want the plaintext secret", got, err)
+	}
+
+	got.Secret = "fedcba9876543210"
+
+	err = models.Webhooks.Update(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stored := store.storedSecret(webhook.ID); !crypto.IsEncrypted(stored) {
+		t.Errorf("got stored secret %q after an update; want it encrypted", stored)
+	}
+
+	// Without the key, the secret can't be read.
+	SetEncryptionKeyring(nil)
+
+	if _, err := models.Webhooks.Get(webhook.ID); !errors.Is(err, ErrEncryptionKeyMissing) {
+		t.Errorf("got error %v without a key; want ErrEncryptionKeyMissing", err)
+	}
+}
@@ -0,0 +1,36 @@
+package data
+
+import (
+	"context"
+	"time"
+)
+
+// Define a FailedEmail struct to represent an email which couldn't be sent, even after
+// retrying. The template data isn't stored, as it can contain tokens; to re-send an
+// email, operators should trigger it again (for example with a new activation token).
+type FailedEmail struct {
+	ID        int64     `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	Recipient string    `json:"recipient"`
+	Template  string    `json:"template"`
+	Error     string    `json:"error"`
+}
+
+// Define the FailedEmailModel type.
+type FailedEmailModel struct {
+	DB      Querier
+	Dialect Dialect
+}
+
+// Insert records an email which couldn't be sent.
+func (m FailedEmailModel) Insert(email *FailedEmail) error {
+	query := `
+		INSERT INTO failed_emails (recipient, template, error)
+		VALUES ($1, $2, $3)
+		RETURNING id, created_at`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, m.Dialect.Rebind(query), email.Recipient, email.Template, email.Error).Scan(&email.ID, &email.CreatedAt)
+}
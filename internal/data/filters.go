@@ -1,12 +1,43 @@
 package data
 
 import (
+	"errors"
+	"fmt"
 	"math"
 	"strings"
 
 	"github.com/petrostrak/an-open-movie-database/internal/validator"
 )
 
+// DefaultMaxPageSize is the largest page size, unless SetMaxPageSize() changes it.
+const DefaultMaxPageSize = 100
+
+// Define an error for an invalid maximum page size.
+var ErrInvalidMaxPageSize = errors.New("invalid maximum page size")
+
+// The largest number of records on a page. This defaults to DefaultMaxPageSize and is
+// changed at startup by SetMaxPageSize().
+var maxPageSize = DefaultMaxPageSize
+
+// SetMaxPageSize sets the largest number of records on a page. ValidateFilters()
+// rejects a larger page size, and the models never fetch more, even for a caller which
+// skipped the validation. It should be called once at startup, before any requests are
+// served.
+func SetMaxPageSize(n int) error {
+	if n < 1 {
+		return fmt.Errorf("%w: must be at least 1", ErrInvalidMaxPageSize)
+	}
+
+	maxPageSize = n
+
+	return nil
+}
+
+// MaxPageSize returns the largest number of records on a page.
+func MaxPageSize() int {
+	return maxPageSize
+}
+
 // Page, PageSize and Sort query string parameters.
 //
 // Add a SortSafelist field to hold the supported sort values.
@@ -19,13 +50,13 @@ type Filters struct {
 
 func ValidateFilters(v *validator.Validator, f Filters) {
 	// Check that the page and page_size parameters contain sensible values.
-	v.Check(f.Page > 0, "page", "must be greater that zero")
-	v.Check(f.Page <= 10_000_000, "page", "must be a maximum that 10 million")
-	v.Check(f.PageSize > 0, "page_size", "must be greater than zero")
-	v.Check(f.PageSize <= 100, "page_size", "must be a maximum of 100")
+	v.Check(f.Page > 0, "page", validator.Msg("greater_than_zero"))
+	v.Check(f.Page <= 10_000_000, "page", validator.Msg("page_maximum"))
+	v.Check(f.PageSize > 0, "page_size", validator.Msg("greater_than_zero"))
+	v.Check(f.PageSize <= maxPageSize, "page_size", validator.Msg("maximum", "n", maxPageSize))
 
 	// Check that the sort parameter matches a value in the safelist.
-	v.Check(validator.In(f.Sort, f.SortSafelist...), "sort", "invalid sort value")
+	v.Check(validator.In(f.Sort, f.SortSafelist...), "sort", validator.Msg("invalid_sort"))
 }
 
 // Check that the client-provided Sort field matches on of the entries in our safelist
@@ -51,8 +82,13 @@ func (f Filters) sortDirection() string {
 	return "ASC"
 }
 
-// Helper method that returns the page size
+// Helper method that returns the page size, which is never more than the maximum page
+// size, whether or not the filters were validated.
 func (f Filters) limit() int {
+	if f.PageSize > maxPageSize {
+		return maxPageSize
+	}
+
 	return f.PageSize
 }
 
@@ -61,18 +97,112 @@ func (f Filters) limit() int {
 //
 // There is the theoretical risk of an integer overflow as we are multiplying two int values
 // together. However, this is mitigated by the validation rules we created in our ValidateFilters()
-// function, where we enforced maximum values of page_size=100 and page=10000000
+// function, where we enforced maximum values of page_size and page=10000000, and by
+// limit() clamping the page size.
 func (f Filters) offset() int {
-	return (f.Page - 1) * f.PageSize
+	return (f.Page - 1) * f.limit()
 }
 
 // Define a new Metadata struct for holding the pagination metadata.
 type Metadata struct {
-	CurrentPage  int `json:"current_page,omitempty"`
-	PageSize     int `json:"page_size,omitempty"`
-	FirstPage    int `json:"first_page,omitempty"`
-	LastPage     int `json:"last_page,omitempty"`
-	TotalRecords int `json:"total_records,omitempty"`
+	CurrentPage  int `json:"current_page,omitempty" xml:"current_page,omitempty"`
+	PageSize     int `json:"page_size,omitempty" xml:"page_size,omitempty"`
+	FirstPage    int `json:"first_page,omitempty" xml:"first_page,omitempty"`
+	LastPage     int `json:"last_page,omitempty" xml:"last_page,omitempty"`
+	TotalRecords int `json:"total_records,omitempty" xml:"total_records,omitempty"`
+
+	// Truncated is true if the page was cut short, as the response would have been
+	// larger than the server allows. ReturnedRecords is then the number of records
+	// sent, and DroppedRecords the number left off the end of the page. The next page
+	// still starts a full page size on, so the dropped records are only sent to a
+	// client which asks for them again with a smaller page size.
+	Truncated       bool `json:"truncated,omitempty" xml:"truncated,omitempty"`
+	ReturnedRecords int  `json:"returned_records,omitempty" xml:"returned_records,omitempty"`
+	DroppedRecords  int  `json:"dropped_records,omitempty" xml:"dropped_records,omitempty"`
+
+	// Facets is nil unless the listing asked for facet counts.
+	Facets *Facets `json:"facets,omitempty" xml:"facets,omitempty"`
+}
+
+// The facets which a movie listing can ask for.
+const (
+	FacetGenres = "genres"
+	FacetYears  = "years"
+)
+
+// MovieFacets holds the facets which a movie listing can ask for.
+var MovieFacets = []string{FacetGenres, FacetYears}
+
+// Define a Facets struct to hold the facet counts of a listing. Each is nil unless it
+// was asked for, and an empty slice if none of the listed movies have a value for it.
+type Facets struct {
+	Genres *[]FacetCount `json:"genres,omitempty" xml:"genres>genre,omitempty"`
+	Years  *[]YearBucket `json:"years,omitempty" xml:"years>bucket,omitempty"`
+}
+
+// Define a FacetCount struct to hold how many of the listed movies have a value, such
+// as {"value": "comedy", "count": 12}.
+type FacetCount struct {
+	Value string `json:"value" xml:"value"`
+	Count int    `json:"count" xml:"count"`
+}
+
+// The width of the year buckets, in years, and the span of years below which each year
+// gets a bucket of its own instead.
+const (
+	yearBucketWidth   = 10
+	yearBucketMinSpan = 30
+)
+
+// Define a YearBucket struct to hold how many of the listed movies were released in the
+// years from From to To, inclusive.
+type YearBucket struct {
+	From  int32 `json:"from" xml:"from"`
+	To    int32 `json:"to" xml:"to"`
+	Count int   `json:"count" xml:"count"`
+}
+
+// The yearBuckets() function groups the number of movies released in each year into
+// buckets for a histogram, one per decade, or one per year if the years span fewer than
+// yearBucketMinSpan years. There's a bucket for every decade or year from the earliest
+// to the latest, including those without any movies, so that the histogram has no
+// gaps.
+func yearBuckets(counts map[int32]int) []YearBucket {
+	buckets := []YearBucket{}
+
+	if len(counts) == 0 {
+		return buckets
+	}
+
+	var earliest, latest int32
+	first := true
+
+	for year := range counts {
+		if first || year < earliest {
+			earliest = year
+		}
+		if first || year > latest {
+			latest = year
+		}
+		first = false
+	}
+
+	width := int32(yearBucketWidth)
+	if latest-earliest+1 < yearBucketMinSpan {
+		width = 1
+	}
+
+	for from := earliest - earliest%width; from <= latest; from += width {
+		bucket := YearBucket{From: from, To: from + width - 1}
+
+		for year := bucket.From; year <= bucket.To; year++ {
+			bucket.Count += counts[year]
+		}
+
+		buckets = append(buckets, bucket)
+	}
+
+	return buckets
 }
 
 // The calculateMetadata() function calculates the appropriate paginationn metadata
@@ -0,0 +1,77 @@
+package data
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/petrostrak/an-open-movie-database/internal/validator"
+)
+
+// The setMaxPageSize() helper changes the maximum page size for the rest of the test.
+func setMaxPageSize(t *testing.T, n int) {
+	t.Helper()
+
+	err := SetMaxPageSize(n)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { maxPageSize = DefaultMaxPageSize })
+}
+
+// A page size over the maximum is clamped, even if the filters weren't validated, and
+// the offset and the metadata follow the clamped size.
+func TestFiltersLimit(t *testing.T) {
+	setMaxPageSize(t, 10)
+
+	tests := []struct {
+		filters    Filters
+		wantLimit  int
+		wantOffset int
+	}{
+		{Filters{Page: 1, PageSize: 5}, 5, 0},
+		{Filters{Page: 3, PageSize: 10}, 10, 20},
+		{Filters{Page: 3, PageSize: 1_000_000}, 10, 20},
+	}
+
+	for _, tt := range tests {
+		if limit, offset := tt.filters.limit(), tt.filters.offset(); limit != tt.wantLimit || offset != tt.wantOffset {
+			t.Errorf("page %d of %d: got limit %d and offset %d; want %d and %d", tt.filters.Page, tt.filters.PageSize, limit, offset, tt.wantLimit, tt.wantOffset)
+		}
+	}
+
+	models := NewMockModels()
+	for i := 0; i < 25; i++ {
+		err := models.Movies.Insert(&Movie{Title: "Movie", Year: 2000, Runtime: 90, Genres: []string{"drama"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	movies, metadata, err := models.Movies.GetAll(MovieFilters{}, Filters{Page: 1, PageSize: 1_000_000, Sort: "id", SortSafelist: []string{"id"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(movies) != 10 || metadata.PageSize != 10 || metadata.LastPage != 3 {
+		t.Errorf("got %d movies and metadata %+v; want 10 movies on each of 3 pages", len(movies), metadata)
+	}
+}
+
+func TestValidateFiltersMaxPageSize(t *testing.T) {
+	setMaxPageSize(t, 10)
+
+	for pageSize, wantValid := range map[int]bool{10: true, 11: false} {
+		v := validator.New()
+		ValidateFilters(v, Filters{Page: 1, PageSize: pageSize, Sort: "id", SortSafelist: []string{"id"}})
+
+		if v.Valid() != wantValid {
+			t.Errorf("page size %d: got valid %t; want %t (errors %v)", pageSize, v.Valid(), wantValid, v.Errors)
+		}
+	}
+
+	err := SetMaxPageSize(0)
+	if !errors.Is(err, ErrInvalidMaxPageSize) {
+		t.Errorf("got error %v for a maximum of 0; want %v", err, ErrInvalidMaxPageSize)
+	}
+}
@@ -0,0 +1,187 @@
+package data
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Define constants for the supported password hashing algorithms.
+const (
+	HashBcrypt   = "bcrypt"
+	HashArgon2id = "argon2id"
+)
+
+// Define errors for an unknown hashing configuration and for a stored hash that we
+// can't parse.
+var (
+	ErrInvalidHashingParams = errors.New("invalid password hashing parameters")
+	ErrInvalidHash          = errors.New("invalid password hash format")
+)
+
+// The prefix used by the PHC string format for argon2id hashes. Anything else is
+// treated as a bcrypt hash, which is what all our existing hashes are.
+const argon2idPrefix = "$argon2id$"
+
+// Define a HashingParams struct to hold the algorithm used for new password hashes
+// and the cost settings for each algorithm. Argon2Memory is in KiB.
+type HashingParams struct {
+	Algorithm         string
+	BcryptCost        int
+	Argon2Memory      uint32
+	Argon2Time        uint32
+	Argon2Parallelism uint8
+}
+
+// The hashing parameters in use. These default to the bcrypt cost of 12 that we've
+// always used, and are changed at startup by SetHashingParams().
+var hashingParams = HashingParams{
+	Algorithm:         HashBcrypt,
+	BcryptCost:        12,
+	Argon2Memory:      64 * 1024,
+	Argon2Time:        3,
+	Argon2Parallelism: 2,
+}
+
+// SetHashingParams validates and installs the parameters used for hashing passwords.
+// It should be called once at startup, before any requests are served.
+func SetHashingParams(p HashingParams) error {
+	switch p.Algorithm {
+	case HashBcrypt:
+		if p.BcryptCost < bcrypt.MinCost || p.BcryptCost > bcrypt.MaxCost {
+			return fmt.Errorf("%w: bcrypt cost must be between %d and %d", ErrInvalidHashingParams, bcrypt.MinCost, bcrypt.MaxCost)
+		}
+	case HashArgon2id:
+		if p.Argon2Memory < 8*uint32(p.Argon2Parallelism) || p.Argon2Time < 1 || p.Argon2Parallelism < 1 {
+			return fmt.Errorf("%w: argon2id memory, time and parallelism must be positive", ErrInvalidHashingParams)
+		}
+	default:
+		return fmt.Errorf("%w: unknown algorithm %q", ErrInvalidHashingParams, p.Algorithm)
+	}
+
+	hashingParams = p
+
+	return nil
+}
+
+// The hashPassword() helper hashes a plaintext password with the configured
+// algorithm.
+func hashPassword(plaintextPassword string) ([]byte, error) {
+	if hashingParams.Algorithm != HashArgon2id {
+		return bcrypt.GenerateFromPassword([]byte(plaintextPassword), hashingParams.BcryptCost)
+	}
+
+	salt := make([]byte, 16)
+
+	_, err := rand.Read(salt)
+	if err != nil {
+		return nil, err
+	}
+
+	p := hashingParams
+	key := argon2.IDKey([]byte(plaintextPassword), salt, p.Argon2Time, p.Argon2Memory, p.Argon2Parallelism, 32)
+
+	// Encode the hash in the standard PHC string format, which records the parameters
+	// alongside the salt and key so that the hash can be verified after they change.
+	encoded := fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2idPrefix,
+		argon2.Version,
+		p.Argon2Memory,
+		p.Argon2Time,
+		p.Argon2Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	)
+
+	return []byte(encoded), nil
+}
+
+// The compareHashAndPassword() helper checks a plaintext password against a hash of
+// either format, returning bcrypt.ErrMismatchedHashAndPassword if it doesn't match.
+func compareHashAndPassword(hash []byte, plaintextPassword string) error {
+	if !strings.HasPrefix(string(hash), argon2idPrefix) {
+		return bcrypt.CompareHashAndPassword(hash, []byte(plaintextPassword))
+	}
+
+	p, salt, key, err := decodeArgon2idHash(hash)
+	if err != nil {
+		return err
+	}
+
+	otherKey := argon2.IDKey([]byte(plaintextPassword), salt, p.Argon2Time, p.Argon2Memory, p.Argon2Parallelism, uint32(len(key)))
+
+	if subtle.ConstantTimeCompare(key, otherKey) != 1 {
+		return bcrypt.ErrMismatchedHashAndPassword
+	}
+
+	return nil
+}
+
+// The needsRehash() helper reports whether a hash was generated with a different
+// algorithm, or with weaker parameters, than the ones currently configured.
+func needsRehash(hash []byte) bool {
+	if !strings.HasPrefix(string(hash), argon2idPrefix) {
+		if hashingParams.Algorithm != HashBcrypt {
+			return true
+		}
+
+		cost, err := bcrypt.Cost(hash)
+		return err != nil || cost < hashingParams.BcryptCost
+	}
+
+	if hashingParams.Algorithm != HashArgon2id {
+		return true
+	}
+
+	p, _, _, err := decodeArgon2idHash(hash)
+	if err != nil {
+		return true
+	}
+
+	return p.Argon2Memory < hashingParams.Argon2Memory ||
+		p.Argon2Time < hashingParams.Argon2Time ||
+		p.Argon2Parallelism < hashingParams.Argon2Parallelism
+}
+
+// The decodeArgon2idHash() helper parses a PHC formatted argon2id hash into its
+// parameters, salt and key.
+func decodeArgon2idHash(hash []byte) (HashingParams, []byte, []byte, error) {
+	// The hash looks like "$argon2id$v=19$m=65536,t=3,p=2$<salt>$<key>", so splitting
+	// on "$" gives us an empty first part followed by five fields.
+	parts := strings.Split(string(hash), "$")
+	if len(parts) != 6 {
+		return HashingParams{}, nil, nil, ErrInvalidHash
+	}
+
+	var version int
+
+	_, err := fmt.Sscanf(parts[2], "v=%d", &version)
+	if err != nil || version != argon2.Version {
+		return HashingParams{}, nil, nil, ErrInvalidHash
+	}
+
+	p := HashingParams{Algorithm: HashArgon2id}
+
+	_, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.Argon2Memory, &p.Argon2Time, &p.Argon2Parallelism)
+	if err != nil {
+		return HashingParams{}, nil, nil, ErrInvalidHash
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return HashingParams{}, nil, nil, ErrInvalidHash
+	}
+
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return HashingParams{}, nil, nil, ErrInvalidHash
+	}
+
+	return p, salt, key, nil
+}
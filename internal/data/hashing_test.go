@@ -0,0 +1,122 @@
+package data
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// The cheapest parameters for each algorithm, so that the tests don't spend their time
+// hashing.
+var (
+	testBcryptParams   = HashingParams{Algorithm: HashBcrypt, BcryptCost: bcrypt.MinCost}
+	testArgon2idParams = HashingParams{Algorithm: HashArgon2id, Argon2Memory: 64, Argon2Time: 1, Argon2Parallelism: 1}
+)
+
+// The useHashingParams() helper installs the hashing parameters for the rest of the
+// test, and puts back the ones in use before when it finishes.
+func useHashingParams(t *testing.T, p HashingParams) {
+	t.Helper()
+
+	previous := hashingParams
+	t.Cleanup(func() { hashingParams = previous })
+
+	err := SetHashingParams(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// A hash made with either algorithm is verified whichever algorithm is configured, so
+// that switching doesn't lock anyone out, and it needs a rehash once the other is.
+func TestHashingCrossVerification(t *testing.T) {
+	hashes := make(map[string]password)
+
+	for _, p := range []HashingParams{testBcryptParams, testArgon2idParams} {
+		useHashingParams(t, p)
+
+		var pw password
+
+		err := pw.Set("correct horse battery")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		hashes[p.Algorithm] = pw
+	}
+
+	if !strings.HasPrefix(string(hashes[HashArgon2id].hash), argon2idPrefix) || strings.HasPrefix(string(hashes[HashBcrypt].hash), argon2idPrefix) {
+		t.Fatalf("got hashes %q and %q; want bcrypt and then argon2id", hashes[HashBcrypt].hash, hashes[HashArgon2id].hash)
+	}
+
+	for _, configured := range []HashingParams{testBcryptParams, testArgon2idParams} {
+		useHashingParams(t, configured)
+
+		for algorithm, pw := range hashes {
+			match, err := pw.Matches("correct horse battery")
+			if err != nil || !match {
+				t.Errorf("got %t and error %v for a %s hash with %s configured; want a match", match, err, algorithm, configured.Algorithm)
+			}
+
+			match, err = pw.Matches("wrong horse battery")
+			if err != nil || match {
+				t.Errorf("got %t and error %v for the wrong password and a %s hash with %s configured; want no match", match, err, algorithm, configured.Algorithm)
+			}
+
+			if got, want := pw.NeedsRehash(), algorithm != configured.Algorithm; got != want {
+				t.Errorf("got NeedsRehash() %t for a %s hash with %s configured; want %t", got, algorithm, configured.Algorithm, want)
+			}
+		}
+	}
+}
+
+// A hash made with weaker parameters than those configured needs a rehash, and one
+// made with the same or stronger parameters doesn't.
+func TestNeedsRehash(t *testing.T) {
+	stronger := testArgon2idParams
+	stronger.Argon2Time = 2
+
+	tests := []struct {
+		name       string
+		hashedWith HashingParams
+		configured HashingParams
+		want       bool
+	}{
+		{"same bcrypt cost", testBcryptParams, testBcryptParams, false},
+		{"higher bcrypt cost", testBcryptParams, HashingParams{Algorithm: HashBcrypt, BcryptCost: bcrypt.MinCost + 1}, true},
+		{"same argon2id parameters", testArgon2idParams, testArgon2idParams, false},
+		{"more argon2id time", testArgon2idParams, stronger, true},
+		{"less argon2id time", stronger, testArgon2idParams, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useHashingParams(t, tt.hashedWith)
+
+			var pw password
+
+			err := pw.Set("correct horse battery")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			useHashingParams(t, tt.configured)
+
+			if got := pw.NeedsRehash(); got != tt.want {
+				t.Errorf("got %t; want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+// A malformed argon2id hash is reported as such rather than as a mismatch.
+func TestMalformedArgon2idHash(t *testing.T) {
+	pw := password{hash: []byte(argon2idPrefix + "v=19$m=64,t=1,p=1$c2FsdA")}
+
+	_, err := pw.Matches("correct horse battery")
+	if !errors.Is(err, ErrInvalidHash) {
+		t.Errorf("got error %v; want ErrInvalidHash", err)
+	}
+}
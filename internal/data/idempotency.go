@@ -0,0 +1,185 @@
+package data
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// Define an error for an idempotency key which was first used with a different
+// request.
+var (
+	ErrIdempotencyKeyMismatch = errors.New("idempotency key used with a different request")
+)
+
+// Define an IdempotencyKey struct to represent a key sent in an Idempotency-Key header,
+// along with the response to the first request which used it. The user ID is 0 for
+// keys sent by anonymous users. StatusCode is 0 while the first request is still being
+// processed.
+type IdempotencyKey struct {
+	UserID          int64
+	Key             string
+	Fingerprint     []byte
+	StatusCode      int
+	ResponseHeaders http.Header
+	ResponseBody    []byte
+	ExpiresAt       time.Time
+}
+
+// Define the IdempotencyKeyModel type.
+type IdempotencyKeyModel struct {
+	DB      Querier
+	Dialect Dialect
+}
+
+// Claim records the first use of a key, and returns true if the caller should now
+// process the request. Inserting first means that of two concurrent requests with the
+// same key, only one can succeed; an expired key is taken over as if it were new.
+//
+// If the key has already been used, the existing record is returned instead, along
+// with ErrIdempotencyKeyMismatch if it was used with a different request. The request
+// which holds the key may release it before the record is read, in which case the key
+// is free again, and Claim tries once more to insert it.
+func (m IdempotencyKeyModel) Claim(userID int64, key string, fingerprint []byte, ttl time.Duration) (*IdempotencyKey, bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	expiresAt := time.Now().Add(ttl)
+
+	for attempt := 1; ; attempt++ {
+		claimed, err := m.insert(ctx, userID, key, fingerprint, expiresAt)
+		if err != nil || claimed {
+			return nil, claimed, err
+		}
+
+		existing, err := m.get(ctx, userID, key)
+		if err != nil {
+			if errors.Is(err, ErrRecordNotFound) && attempt < 2 {
+				continue
+			}
+
+			return nil, false, err
+		}
+
+		if !bytes.Equal(existing.Fingerprint, fingerprint) {
+			return existing, false, ErrIdempotencyKeyMismatch
+		}
+
+		return existing, false, nil
+	}
+}
+
+// The insert() method inserts the key, or takes it over if it has expired, and reports
+// whether it did either.
+func (m IdempotencyKeyModel) insert(ctx context.Context, userID int64, key string, fingerprint []byte, expiresAt time.Time) (bool, error) {
+	query := `
+		INSERT INTO idempotency_keys (user_id, key, fingerprint, expires_at)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (user_id, key) DO UPDATE
+		SET fingerprint = EXCLUDED.fingerprint, status_code = NULL, response_headers = '{}',
+			response_body = NULL, created_at = NOW(), expires_at = EXCLUDED.expires_at
+		WHERE idempotency_keys.expires_at < NOW()`
+
+	result, err := m.DB.ExecContext(ctx, m.Dialect.Rebind(query), userID, key, fingerprint, expiresAt)
+	if err != nil {
+		return false, err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return rows == 1, nil
+}
+
+func (m IdempotencyKeyModel) get(ctx context.Context, userID int64, key string) (*IdempotencyKey, error) {
+	query := `
+		SELECT user_id, key, fingerprint, COALESCE(status_code, 0), response_headers, COALESCE(response_body, ''), expires_at
+		FROM idempotency_keys
+		WHERE user_id = $1 AND key = $2`
+
+	var (
+		record  IdempotencyKey
+		headers []byte
+	)
+
+	err := m.DB.QueryRowContext(ctx, m.Dialect.Rebind(query), userID, key).Scan(
+		&record.UserID,
+		&record.Key,
+		&record.Fingerprint,
+		&record.StatusCode,
+		&headers,
+		&record.ResponseBody,
+		&record.ExpiresAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	err = json.Unmarshal(headers, &record.ResponseHeaders)
+	if err != nil {
+		return nil, err
+	}
+
+	return &record, nil
+}
+
+// Complete stores the response to the request which claimed a key, so that it can be
+// replayed.
+func (m IdempotencyKeyModel) Complete(userID int64, key string, statusCode int, headers http.Header, body []byte) error {
+	query := `
+		UPDATE idempotency_keys
+		SET status_code = $3, response_headers = $4, response_body = $5
+		WHERE user_id = $1 AND key = $2`
+
+	js, err := json.Marshal(headers)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err = m.DB.ExecContext(ctx, m.Dialect.Rebind(query), userID, key, statusCode, string(js), body)
+	return err
+}
+
+// Release deletes a claimed key whose request failed, so that it can be retried.
+func (m IdempotencyKeyModel) Release(userID int64, key string) error {
+	query := `
+		DELETE FROM idempotency_keys
+		WHERE user_id = $1 AND key = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, m.Dialect.Rebind(query), userID, key)
+	return err
+}
+
+// DeleteAllExpired deletes every expired key, and returns the number deleted.
+func (m IdempotencyKeyModel) DeleteAllExpired() (int64, error) {
+	query := `
+		DELETE FROM idempotency_keys
+		WHERE expires_at < $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, m.Dialect.Rebind(query), time.Now())
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
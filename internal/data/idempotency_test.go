@@ -0,0 +1,70 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/petrostrak/an-open-movie-database/internal/testdb"
+)
+
+// The releasingQuerier releases the key before the first query it runs, as the request
+// holding it would if it failed between another request's insert and read.
+type releasingQuerier struct {
+	*sql.DB
+	release func()
+}
+
+func (q *releasingQuerier) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	if q.release != nil {
+		q.release()
+		q.release = nil
+	}
+
+	return q.DB.QueryRowContext(ctx, query, args...)
+}
+
+func TestIdempotencyKeyModelClaim(t *testing.T) {
+	driverName, db := testdb.Open(t)
+
+	dialect, err := DialectFor(driverName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := IdempotencyKeyModel{DB: db, Dialect: dialect}
+
+	_, claimed, err := keys.Claim(1, "abc", []byte("first"), time.Hour)
+	if err != nil || !claimed {
+		t.Fatalf("got claimed %t, error %v; want the new key claimed", claimed, err)
+	}
+
+	existing, claimed, err := keys.Claim(1, "abc", []byte("second"), time.Hour)
+	if !errors.Is(err, ErrIdempotencyKeyMismatch) || claimed || existing == nil {
+		t.Fatalf("got %+v, claimed %t, error %v; want the existing key and a mismatch", existing, claimed, err)
+	}
+
+	t.Run("Released", func(t *testing.T) {
+		q := &releasingQuerier{DB: db}
+		q.release = func() {
+			err := keys.Release(1, "abc")
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		racing := IdempotencyKeyModel{DB: q, Dialect: dialect}
+
+		_, claimed, err := racing.Claim(1, "abc", []byte("second"), time.Hour)
+		if err != nil || !claimed {
+			t.Fatalf("got claimed %t, error %v; want the released key claimed", claimed, err)
+		}
+
+		_, _, err = keys.Claim(1, "abc", []byte("first"), time.Hour)
+		if !errors.Is(err, ErrIdempotencyKeyMismatch) {
+			t.Errorf("got error %v; want the key held for the second request", err)
+		}
+	})
+}
@@ -0,0 +1,244 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Define constants for the kinds of job, and for the status of a job.
+const (
+	JobReindexMovies = "movies.reindex"
+
+	JobRunning   = "running"
+	JobCompleted = "completed"
+	JobFailed    = "failed"
+	JobCanceled  = "canceled"
+)
+
+// Define the errors returned when a job can't be started because one of its kind is
+// already running, and when a job which has finished is advanced or canceled.
+var (
+	ErrJobRunning    = errors.New("a job of this kind is already running")
+	ErrJobNotRunning = errors.New("job is not running")
+)
+
+// Define a Job struct to hold the progress of a long-running admin job, such as
+// re-indexing the movies. Jobs work through their records in order of ID, and the
+// cursor holds the last ID they've finished with, so that a job which was interrupted
+// can carry on from there.
+type Job struct {
+	ID        int64     `json:"id"`
+	Kind      string    `json:"kind"`
+	Status    string    `json:"status"`
+	Cursor    int64     `json:"cursor"`
+	Processed int64     `json:"processed"`
+	Errors    []string  `json:"errors"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Define the JobModel type.
+type JobModel struct {
+	DB      Querier
+	ReadDB  Querier
+	Dialect Dialect
+}
+
+// Start returns a job of the given kind to run. A job which failed, or whose updated_at
+// is older than the lease because the process running it died, is resumed from its
+// cursor, and the resumed return value is true. Otherwise a new job is created, unless
+// one is already running, in which case the running job is returned along with
+// ErrJobRunning.
+func (m JobModel) Start(kind string, lease time.Duration) (job *Job, resumed bool, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := beginTx(ctx, m.DB)
+	if err != nil {
+		return nil, false, err
+	}
+
+	// Rollback() is a no-op if the transaction has already been committed.
+	defer tx.Rollback()
+
+	// Lock the latest unfinished job, so that two requests can't both resume it.
+	query := fmt.Sprintf(`
+		SELECT id, kind, status, cursor, processed, errors, created_at, updated_at
+		FROM jobs
+		WHERE kind = $1 AND status IN ('running', 'failed')
+		ORDER BY id DESC
+		LIMIT 1
+		%s`, m.Dialect.RowLock("FOR UPDATE"))
+
+	job, err = scanJob(m.Dialect, tx.QueryRowContext(ctx, m.Dialect.Rebind(query), kind))
+
+	switch {
+	case errors.Is(err, ErrRecordNotFound):
+		// The jobs_running_idx index stops two requests both creating a job.
+		query = `
+			INSERT INTO jobs (kind, status)
+			VALUES ($1, 'running')
+			RETURNING id, kind, status, cursor, processed, errors, created_at, updated_at`
+
+		job, err = scanJob(m.Dialect, tx.QueryRowContext(ctx, m.Dialect.Rebind(query), kind))
+		if err != nil {
+			if m.Dialect.UniqueViolation(err, "jobs_running_idx") {
+				return nil, false, ErrJobRunning
+			}
+			return nil, false, err
+		}
+	case err != nil:
+		return nil, false, err
+	case job.Status == JobRunning && time.Since(job.UpdatedAt) < lease:
+		return job, false, ErrJobRunning
+	default:
+		query = `
+			UPDATE jobs
+			SET status = 'running', updated_at = NOW()
+			WHERE id = $1
+			RETURNING id, kind, status, cursor, processed, errors, created_at, updated_at`
+
+		job, err = scanJob(m.Dialect, tx.QueryRowContext(ctx, m.Dialect.Rebind(query), job.ID))
+		if err != nil {
+			return nil, false, err
+		}
+		resumed = true
+	}
+
+	return job, resumed, tx.Commit()
+}
+
+// Get returns a job by its ID.
+func (m JobModel) Get(id int64) (*Job, error) {
+	query := `
+		SELECT id, kind, status, cursor, processed, errors, created_at, updated_at
+		FROM jobs
+		WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	// Jobs are polled while they run, so read them from the primary, where the
+	// progress is up to date.
+	return scanJob(m.Dialect, m.DB.QueryRowContext(ctx, m.Dialect.Rebind(query), id))
+}
+
+// Advance records that a running job has finished with the records up to and
+// including the cursor, and adds the number it processed. It's called in the same
+// transaction as the work, so that the cursor can't get ahead of what's been done or
+// fall behind it. It returns ErrJobNotRunning if the job has been canceled, which
+// rolls back the work.
+func (m JobModel) Advance(id, cursor int64, processed int) error {
+	query := `
+		UPDATE jobs
+		SET cursor = $2, processed = processed + $3, updated_at = NOW()
+		WHERE id = $1 AND status = 'running'`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, m.Dialect.Rebind(query), id, cursor, processed)
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rows == 0 {
+		return ErrJobNotRunning
+	}
+
+	return nil
+}
+
+// Finish sets the final status of a running job, adding the error message, if any, to
+// its errors. It returns ErrJobNotRunning if the job has already finished, such as
+// when it was canceled.
+func (m JobModel) Finish(id int64, status, message string) error {
+	query := fmt.Sprintf(`
+		UPDATE jobs
+		SET status = $2, errors = CASE WHEN $3 = '' THEN errors ELSE %s END, updated_at = NOW()
+		WHERE id = $1 AND status = 'running'`, m.Dialect.ArrayAppend("errors", "$3"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, m.Dialect.Rebind(query), id, status, message)
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rows == 0 {
+		return ErrJobNotRunning
+	}
+
+	return nil
+}
+
+// Cancel stops a running job. The process running it notices when it next calls
+// Advance(), and stops. It returns ErrRecordNotFound if there's no such job, and
+// ErrJobNotRunning if it has already finished.
+func (m JobModel) Cancel(id int64) (*Job, error) {
+	query := `
+		UPDATE jobs
+		SET status = 'canceled', updated_at = NOW()
+		WHERE id = $1 AND status = 'running'
+		RETURNING id, kind, status, cursor, processed, errors, created_at, updated_at`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	job, err := scanJob(m.Dialect, m.DB.QueryRowContext(ctx, m.Dialect.Rebind(query), id))
+	if !errors.Is(err, ErrRecordNotFound) {
+		return job, err
+	}
+
+	// Tell a job which has finished apart from one which doesn't exist.
+	if _, err := m.Get(id); err != nil {
+		return nil, err
+	}
+
+	return nil, ErrJobNotRunning
+}
+
+// The scanJob() helper scans a row of the jobs table, returning ErrRecordNotFound if
+// there's no row.
+func scanJob(dialect Dialect, row *sql.Row) (*Job, error) {
+	var job Job
+
+	err := row.Scan(
+		&job.ID,
+		&job.Kind,
+		&job.Status,
+		&job.Cursor,
+		&job.Processed,
+		dialect.ScanArray(&job.Errors),
+		&job.CreatedAt,
+		&job.UpdatedAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	if job.Errors == nil {
+		job.Errors = []string{}
+	}
+
+	return &job, nil
+}
@@ -0,0 +1,140 @@
+package data
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/petrostrak/an-open-movie-database/internal/testdb"
+)
+
+func TestJobModel(t *testing.T) {
+	driverName, db := testdb.Open(t)
+
+	models, err := NewModelsForDriver(driverName, db, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	job, resumed, err := models.Jobs.Start(JobReindexMovies, time.Minute)
+	if err != nil || resumed || job.Status != JobRunning {
+		t.Fatalf("got job %+v, resumed %t and error %v; want a new running job", job, resumed, err)
+	}
+
+	running, _, err := models.Jobs.Start(JobReindexMovies, time.Minute)
+	if !errors.Is(err, ErrJobRunning) || running == nil || running.ID != job.ID {
+		t.Errorf("got job %+v and error %v; want the running job and ErrJobRunning", running, err)
+	}
+
+	err = models.Jobs.Advance(job.ID, 500, 500)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = models.Jobs.Finish(job.ID, JobFailed, "connection reset by peer")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A failed job is resumed from its cursor, rather than a new one started.
+	resumedJob, resumed, err := models.Jobs.Start(JobReindexMovies, time.Minute)
+	if err != nil || !resumed || resumedJob.ID != job.ID || resumedJob.Cursor != 500 || len(resumedJob.Errors) != 1 {
+		t.Errorf("got job %+v, resumed %t and error %v; want the failed job resumed", resumedJob, resumed, err)
+	}
+
+	// So is one which has stopped making progress. updated_at is rounded to the
+	// second, so use a lease which has run out whichever way it was rounded.
+	stale, resumed, err := models.Jobs.Start(JobReindexMovies, -time.Minute)
+	if err != nil || !resumed || stale.ID != job.ID {
+		t.Errorf("got job %+v, resumed %t and error %v; want the stale job resumed", stale, resumed, err)
+	}
+
+	canceled, err := models.Jobs.Cancel(job.ID)
+	if err != nil || canceled.Status != JobCanceled {
+		t.Fatalf("got job %+v and error %v; want it canceled", canceled, err)
+	}
+
+	if err := models.Jobs.Advance(job.ID, 1000, 500); !errors.Is(err, ErrJobNotRunning) {
+		t.Errorf("got error %v advancing a canceled job; want ErrJobNotRunning", err)
+	}
+
+	if _, err := models.Jobs.Cancel(job.ID); !errors.Is(err, ErrJobNotRunning) {
+		t.Errorf("got error %v canceling a canceled job; want ErrJobNotRunning", err)
+	}
+
+	if _, err := models.Jobs.Cancel(job.ID + 1); !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("got error %v canceling an unknown job; want ErrRecordNotFound", err)
+	}
+
+	// A canceled job isn't resumed.
+	next, resumed, err := models.Jobs.Start(JobReindexMovies, time.Minute)
+	if err != nil || resumed || next.ID == job.ID {
+		t.Errorf("got job %+v, resumed %t and error %v; want a new job", next, resumed, err)
+	}
+}
+
+// ReindexBatch() rebuilds the rating aggregates of a batch of movies at a time, without
+// changing their versions.
+func TestMovieModelReindexBatch(t *testing.T) {
+	driverName, db := testdb.Open(t)
+
+	models, err := NewModelsForDriver(driverName, db, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user := &User{Name: "Alice", Username: "alice", Email: "alice@example.com", Activated: true}
+
+	err = user.Password.Set("pa55word1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = models.Users.Insert(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var movies []*Movie
+
+	for _, title := range []string{"Casablanca", "Moana", "Up"} {
+		movie := &Movie{Title: title, Year: 2000, Runtime: 90, Genres: []string{"drama"}}
+
+		err := models.Movies.Insert(movie)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		movies = append(movies, movie)
+	}
+
+	_, err = db.Exec(`INSERT INTO ratings (user_id, movie_id, rating) VALUES ($1, $2, 8)`, user.ID, movies[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lastID, count, err := models.Movies.ReindexBatch(0, 2)
+	if err != nil || lastID != movies[1].ID || count != 2 {
+		t.Errorf("got last ID %d, count %d and error %v; want %d and 2", lastID, count, err, movies[1].ID)
+	}
+
+	lastID, count, err = models.Movies.ReindexBatch(lastID, 2)
+	if err != nil || lastID != movies[2].ID || count != 1 {
+		t.Errorf("got last ID %d, count %d and error %v; want %d and 1", lastID, count, err, movies[2].ID)
+	}
+
+	var (
+		average float64
+		ratings int
+		version int32
+	)
+
+	err = db.QueryRow(`SELECT average_rating, ratings_count, version FROM movies WHERE id = $1`, movies[0].ID).Scan(&average, &ratings, &version)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if average != 8 || ratings != 1 || version != 1 {
+		t.Errorf("got average %v, count %d and version %d; want 8, 1 and 1", average, ratings, version)
+	}
+}
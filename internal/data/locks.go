@@ -0,0 +1,126 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+// The names of the advisory locks taken by the periodic jobs which must only run on one
+// instance of the API at a time.
+const (
+	LockDigest     = "digest"
+	LockPopularity = "popularity"
+)
+
+// The sqlConner interface is satisfied by *sql.DB, which can set a single connection
+// aside, but not by *sql.Tx.
+type sqlConner interface {
+	Conn(ctx context.Context) (*sql.Conn, error)
+}
+
+// Define the LockModel type, which takes PostgreSQL advisory locks.
+type LockModel struct {
+	DB      Querier
+	Dialect Dialect
+}
+
+// TryLock takes the named advisory lock without waiting for it, and returns false if
+// another session holds it. Otherwise the caller must call the returned function to
+// release it. An advisory lock belongs to a session, so a connection is set aside from
+// the pool until then. In a transaction (see Models.WithTx()), the lock is held until
+// the transaction ends instead, and the function does nothing.
+//
+// SQLite has no advisory locks, but a SQLite database is only used by one process, so
+// the locks are held in memory instead, and released by the function even in a
+// transaction.
+func (m LockModel) TryLock(ctx context.Context, name string) (func(), bool, error) {
+	if !m.Dialect.AdvisoryLocks() {
+		release, acquired := localLocks.tryLock(name)
+		return release, acquired, nil
+	}
+
+	key := advisoryLockKey(name)
+
+	db, ok := m.DB.(sqlConner)
+	if !ok {
+		var acquired bool
+
+		err := m.DB.QueryRowContext(ctx, `SELECT pg_try_advisory_xact_lock($1)`, key).Scan(&acquired)
+		if err != nil {
+			return nil, false, err
+		}
+
+		return func() {}, acquired, nil
+	}
+
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+
+	var acquired bool
+
+	err = conn.QueryRowContext(ctx, `SELECT pg_try_advisory_lock($1)`, key).Scan(&acquired)
+	if err != nil || !acquired {
+		conn.Close()
+		return nil, false, err
+	}
+
+	release := func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+		defer cancel()
+
+		_, err := conn.ExecContext(ctx, `SELECT pg_advisory_unlock($1)`, key)
+		if err != nil {
+			// Discard the connection rather than returning it to the pool still
+			// holding the lock. Closing it ends the session, which releases the lock.
+			conn.Raw(func(interface{}) error { return driver.ErrBadConn })
+		}
+
+		conn.Close()
+	}
+
+	return release, true, nil
+}
+
+// The localLocks hold the names of the locks taken on a database without advisory
+// locks.
+var localLocks = &lockSet{held: make(map[string]bool)}
+
+type lockSet struct {
+	mu   sync.Mutex
+	held map[string]bool
+}
+
+func (s *lockSet) tryLock(name string) (func(), bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.held[name] {
+		return nil, false
+	}
+
+	s.held[name] = true
+
+	release := func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		delete(s.held, name)
+	}
+
+	return release, true
+}
+
+// The advisoryLockKey() function turns a lock name into the bigint key of an advisory
+// lock.
+func advisoryLockKey(name string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte("omdb:" + name))
+
+	return int64(h.Sum64())
+}
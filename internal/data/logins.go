@@ -0,0 +1,62 @@
+package data
+
+import (
+	"context"
+	"time"
+)
+
+// The number of login history entries that we keep for each user.
+const maxLoginHistory = 50
+
+// Define a Login struct to represent a single successful login.
+type Login struct {
+	CreatedAt time.Time `json:"created_at"`
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"user_agent"`
+}
+
+// Define the LoginModel type.
+type LoginModel struct {
+	DB      Querier
+	ReadDB  Querier
+	Dialect Dialect
+}
+
+// The GetAllForUser() returns the login history for a specific user, most recent
+// first.
+func (m LoginModel) GetAllForUser(userID int64) ([]*Login, error) {
+	query := `
+		SELECT created_at, ip, user_agent
+		FROM logins
+		WHERE user_id = $1
+		ORDER BY created_at DESC, id DESC
+		LIMIT $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.ReadDB.QueryContext(ctx, m.Dialect.Rebind(query), userID, maxLoginHistory)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	logins := []*Login{}
+
+	for rows.Next() {
+		var login Login
+
+		err := rows.Scan(&login.CreatedAt, &login.IP, &login.UserAgent)
+		if err != nil {
+			return nil, err
+		}
+
+		logins = append(logins, &login)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return logins, nil
+}
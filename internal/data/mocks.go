@@ -0,0 +1,2595 @@
+package data
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// NewMockModels returns a Models struct whose stores keep their data in memory, for
+// testing handlers without a database. They behave like the SQL-backed models: lookups
+// of missing records return ErrRecordNotFound, updates with a stale version return
+// ErrEditConflict, and email addresses and usernames must be unique.
+//
+// WithTx() is supported too. It doesn't isolate the callback from other goroutines,
+// but if the callback returns an error every change made since it started is undone.
+func NewMockModels() Models {
+	db := &mockDB{mockData: newMockData(), locks: make(map[string]bool)}
+
+	return Models{
+		Audit:             mockAuditStore{db},
+		Digests:           mockDigestStore{db},
+		EmailJobs:         mockEmailJobStore{db},
+		FailedEmails:      mockFailedEmailStore{db},
+		Idempotency:       mockIdempotencyKeyStore{db},
+		Jobs:              mockJobStore{db},
+		Locks:             mockLockStore{db},
+		Logins:            mockLoginStore{db},
+		Movies:            mockMovieStore{db},
+		Permissions:       mockPermissionStore{db},
+		Preferences:       mockPreferencesStore{db},
+		Reports:           mockReportStore{db},
+		Roles:             mockRoleStore{db},
+		SavedSearches:     mockSavedSearchStore{db},
+		Tokens:            mockTokenStore{db},
+		Usage:             mockUsageStore{db},
+		Users:             mockUserStore{db},
+		Watchlist:         mockWatchlistStore{db},
+		Webhooks:          mockWebhookStore{db},
+		WebhookDeliveries: mockWebhookDeliveryStore{db},
+
+		mock: db,
+	}
+}
+
+// The mockRoles slice holds the default roles and their permissions, as set up by the
+// add_roles migration, in order of their IDs.
+var mockRoles = []*Role{
+	{ID: 1, Name: "reader", Permissions: Permissions{"movies:read"}},
+	{ID: 2, Name: "editor", Permissions: Permissions{"movies:read", "movies:write"}},
+	{ID: 3, Name: "admin", Permissions: Permissions{"movies:read", "movies:write", "users:admin"}},
+}
+
+// The mockRole() helper returns the named role, or nil if there isn't one.
+func mockRole(name string) *Role {
+	for _, role := range mockRoles {
+		if role.Name == name {
+			return role
+		}
+	}
+
+	return nil
+}
+
+// Define a mockDB type which holds the data shared by the mock stores. The stores may
+// be used from several goroutines at once, so every method holds the mutex.
+type mockDB struct {
+	mu sync.Mutex
+	mockData
+
+	// The advisory locks which are held. Like PostgreSQL's session-level locks, they
+	// aren't released when a transaction is rolled back.
+	locks map[string]bool
+}
+
+// Define a mockData type to hold the tables. Records are stored as pointers, and are
+// copied on the way in and out, so that callers can't change them by accident.
+type mockData struct {
+	movies            map[int64]*Movie
+	users             map[int64]*User
+	preferences       map[int64]*Preferences
+	logins            map[int64][]*Login
+	tokens            []*Token
+	permissions       map[int64]map[string]bool
+	roles             map[int64]map[string]bool
+	allCodes          Permissions
+	auditEntries      []*AuditEntry
+	emailJobs         map[int64]*EmailJob
+	failedEmails      []*FailedEmail
+	idempotencyKeys   map[mockIdempotencyKeyID]*IdempotencyKey
+	jobs              map[int64]*Job
+	reports           map[int64]*Report
+	savedSearches     map[int64]*SavedSearch
+	webhooks          map[int64]*Webhook
+	webhookDeliveries []*WebhookDelivery
+	usage             map[mockUsageID]int64
+	watchlist         map[mockWatchlistID]*WatchlistEntry
+	notifications     map[mockUsageID]int
+	digestsSent       map[int64]time.Time
+	lastID            int64
+}
+
+type mockUsageID struct {
+	userID int64
+	date   string
+}
+
+type mockWatchlistID struct {
+	userID  int64
+	movieID int64
+}
+
+type mockIdempotencyKeyID struct {
+	userID int64
+	key    string
+}
+
+func newMockData() mockData {
+	return mockData{
+		movies:          make(map[int64]*Movie),
+		users:           make(map[int64]*User),
+		preferences:     make(map[int64]*Preferences),
+		logins:          make(map[int64][]*Login),
+		permissions:     make(map[int64]map[string]bool),
+		roles:           make(map[int64]map[string]bool),
+		allCodes:        Permissions{"movies:read", "movies:write", "users:admin"},
+		emailJobs:       make(map[int64]*EmailJob),
+		idempotencyKeys: make(map[mockIdempotencyKeyID]*IdempotencyKey),
+		jobs:            make(map[int64]*Job),
+		reports:         make(map[int64]*Report),
+		savedSearches:   make(map[int64]*SavedSearch),
+		webhooks:        make(map[int64]*Webhook),
+		usage:           make(map[mockUsageID]int64),
+		watchlist:       make(map[mockWatchlistID]*WatchlistEntry),
+		notifications:   make(map[mockUsageID]int),
+		digestsSent:     make(map[int64]time.Time),
+	}
+}
+
+// The nextID() method returns a new ID. The IDs are shared by every table, which like
+// bigserial columns means they're never reused. The caller must hold the mutex.
+func (db *mockDB) nextID() int64 {
+	db.lastID++
+	return db.lastID
+}
+
+// The clone() method returns a deep copy of the data, for undoing the changes made by
+// a failed WithTx() callback.
+func (d mockData) clone() mockData {
+	c := d
+	c.movies = make(map[int64]*Movie)
+	c.users = make(map[int64]*User)
+	c.preferences = make(map[int64]*Preferences)
+	c.logins = make(map[int64][]*Login)
+	c.tokens = nil
+	c.permissions = make(map[int64]map[string]bool)
+	c.roles = make(map[int64]map[string]bool)
+	c.allCodes = append(Permissions(nil), d.allCodes...)
+	c.auditEntries = nil
+	c.emailJobs = make(map[int64]*EmailJob)
+	c.failedEmails = nil
+	c.idempotencyKeys = make(map[mockIdempotencyKeyID]*IdempotencyKey)
+	c.jobs = make(map[int64]*Job)
+	c.reports = make(map[int64]*Report)
+	c.savedSearches = make(map[int64]*SavedSearch)
+	c.webhooks = make(map[int64]*Webhook)
+	c.webhookDeliveries = nil
+	c.usage = make(map[mockUsageID]int64)
+	c.watchlist = make(map[mockWatchlistID]*WatchlistEntry)
+	c.notifications = make(map[mockUsageID]int)
+	c.digestsSent = make(map[int64]time.Time)
+
+	for id, movie := range d.movies {
+		c.movies[id] = copyMovie(movie)
+	}
+	for id, user := range d.users {
+		c.users[id] = copyUser(user)
+	}
+	for id, preferences := range d.preferences {
+		c.preferences[id] = copyPreferences(preferences)
+	}
+	for id, logins := range d.logins {
+		for _, login := range logins {
+			l := *login
+			c.logins[id] = append(c.logins[id], &l)
+		}
+	}
+	for _, token := range d.tokens {
+		t := *token
+		c.tokens = append(c.tokens, &t)
+	}
+	for id, codes := range d.permissions {
+		c.permissions[id] = copySet(codes)
+	}
+	for id, names := range d.roles {
+		c.roles[id] = copySet(names)
+	}
+	for _, entry := range d.auditEntries {
+		e := *entry
+		c.auditEntries = append(c.auditEntries, &e)
+	}
+	for id, job := range d.emailJobs {
+		c.emailJobs[id] = copyEmailJob(job)
+	}
+	for _, email := range d.failedEmails {
+		e := *email
+		c.failedEmails = append(c.failedEmails, &e)
+	}
+	for id, record := range d.idempotencyKeys {
+		r := *record
+		c.idempotencyKeys[id] = &r
+	}
+	for id, job := range d.jobs {
+		c.jobs[id] = copyJob(job)
+	}
+	for id, report := range d.reports {
+		c.reports[id] = copyReport(report)
+	}
+	for id, search := range d.savedSearches {
+		c.savedSearches[id] = copySavedSearch(search)
+	}
+	for id, webhook := range d.webhooks {
+		c.webhooks[id] = copyWebhook(webhook)
+	}
+	for _, delivery := range d.webhookDeliveries {
+		d := *delivery
+		c.webhookDeliveries = append(c.webhookDeliveries, &d)
+	}
+	for id, requests := range d.usage {
+		c.usage[id] = requests
+	}
+	for id, entry := range d.watchlist {
+		e := *entry
+		c.watchlist[id] = &e
+	}
+	for id, sent := range d.notifications {
+		c.notifications[id] = sent
+	}
+	for id, sentAt := range d.digestsSent {
+		c.digestsSent[id] = sentAt
+	}
+
+	return c
+}
+
+// The withTx() method runs fn, and puts the data back as it was if fn returns an error.
+func (db *mockDB) withTx(m Models, fn func(m Models) error) error {
+	db.mu.Lock()
+	saved := db.mockData.clone()
+	db.mu.Unlock()
+
+	err := fn(m)
+	if err != nil {
+		db.mu.Lock()
+		db.mockData = saved
+		db.mu.Unlock()
+	}
+
+	return err
+}
+
+func copySet(set map[string]bool) map[string]bool {
+	c := make(map[string]bool, len(set))
+	for k, v := range set {
+		c[k] = v
+	}
+	return c
+}
+
+// The mockSort() helper sorts a slice of records in the order given by the filters, in
+// the same way as the SQL queries: by the sort column, and then by ascending ID. The
+// column function returns the value of a column for the record at index i, which must
+// be an int64, a string or a time.Time.
+func mockSort(slice interface{}, filters Filters, column func(i int, name string) interface{}) {
+	name, descending := filters.sortColumn(), filters.sortDirection() == "DESC"
+
+	sort.SliceStable(slice, func(i, j int) bool {
+		cmp := compareMockValues(column(i, name), column(j, name))
+		if descending {
+			cmp = -cmp
+		}
+
+		if cmp != 0 {
+			return cmp < 0
+		}
+
+		return compareMockValues(column(i, "id"), column(j, "id")) < 0
+	})
+}
+
+func compareMockValues(a, b interface{}) int {
+	switch a := a.(type) {
+	case int64:
+		b := b.(int64)
+		switch {
+		case a < b:
+			return -1
+		case a > b:
+			return 1
+		}
+		return 0
+	case float64:
+		b := b.(float64)
+		switch {
+		case a < b:
+			return -1
+		case a > b:
+			return 1
+		}
+		return 0
+	case string:
+		return strings.Compare(a, b.(string))
+	case time.Time:
+		b := b.(time.Time)
+		switch {
+		case a.Before(b):
+			return -1
+		case a.After(b):
+			return 1
+		}
+		return 0
+	default:
+		panic(fmt.Sprintf("mockSort: unsupported column type %T", a))
+	}
+}
+
+// The mockPage() helper returns the bounds of the requested page of a slice with n
+// elements, along with the pagination metadata.
+func mockPage(n int, filters Filters) (int, int, Metadata) {
+	start := filters.offset()
+	if start > n {
+		start = n
+	}
+
+	end := start + filters.limit()
+	if end > n {
+		end = n
+	}
+
+	return start, end, calculateMetadata(n, filters.Page, filters.limit())
+}
+
+// Define the mockMovieStore type, which satisfies MovieStore.
+type mockMovieStore struct {
+	db *mockDB
+}
+
+// The copyMovie() helper returns a copy of a movie, so that callers can't change the
+// stored data without calling Update().
+func copyMovie(movie *Movie) *Movie {
+	c := *movie
+	c.Genres = append([]string(nil), movie.Genres...)
+	c.Awards = append(Awards(nil), movie.Awards...)
+	c.ExternalRatings = append(ExternalRatings(nil), movie.ExternalRatings...)
+	c.CreatedBy = copyUserRef(movie.CreatedBy)
+	c.UpdatedBy = copyUserRef(movie.UpdatedBy)
+	return &c
+}
+
+func copyUserRef(user *UserRef) *UserRef {
+	if user == nil {
+		return nil
+	}
+
+	c := *user
+	return &c
+}
+
+// The readMovie() method returns a copy of a stored movie, with the names of the users
+// who created and last updated it looked up as the SQL query's joins do. They're nil if
+// the user has been deleted.
+func (s mockMovieStore) readMovie(movie *Movie) *Movie {
+	c := copyMovie(movie)
+
+	for _, ref := range []**UserRef{&c.CreatedBy, &c.UpdatedBy} {
+		if *ref == nil {
+			continue
+		}
+
+		user, ok := s.db.users[(*ref).ID]
+		if !ok {
+			*ref = nil
+			continue
+		}
+
+		(*ref).Name = user.Name
+	}
+
+	return c
+}
+
+func (s mockMovieStore) Insert(movie *Movie) error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	movie.ID = s.db.nextID()
+	movie.CreatedAt = time.Now()
+	movie.UpdatedAt = movie.CreatedAt
+	movie.Version = 1
+
+	s.db.movies[movie.ID] = copyMovie(movie)
+
+	return nil
+}
+
+func (s mockMovieStore) Get(id int64) (*Movie, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	movie, ok := s.db.movies[id]
+	if !ok {
+		return nil, ErrRecordNotFound
+	}
+
+	return s.readMovie(movie), nil
+}
+
+func (s mockMovieStore) GetVersion(id int64) (int32, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	movie, ok := s.db.movies[id]
+	if !ok {
+		return 0, ErrRecordNotFound
+	}
+
+	return movie.Version, nil
+}
+
+func (s mockMovieStore) Update(movie *Movie) error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	// Like the SQL query, a movie which has been deleted is an edit conflict too.
+	stored, ok := s.db.movies[movie.ID]
+	if !ok || stored.Version != movie.Version {
+		return ErrEditConflict
+	}
+
+	// Move updated_at on by at least a second, as the SQL query does.
+	movie.UpdatedAt = time.Now()
+	if next := stored.UpdatedAt.Add(time.Second); movie.UpdatedAt.Before(next) {
+		movie.UpdatedAt = next
+	}
+
+	// The creator is never changed by an update, and nor are the derived views and
+	// popularity.
+	movie.CreatedBy = copyUserRef(stored.CreatedBy)
+	movie.Views, movie.Popularity = stored.Views, stored.Popularity
+	movie.Version++
+	s.db.movies[movie.ID] = copyMovie(movie)
+
+	return nil
+}
+
+// Delete() deletes the movie's watchlist entries and reports with it, and counts them,
+// like the SQL version. There are no ratings or reviews in the mock stores.
+func (s mockMovieStore) Delete(id int64) (*MovieDeletion, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	if _, ok := s.db.movies[id]; !ok {
+		return nil, ErrRecordNotFound
+	}
+
+	delete(s.db.movies, id)
+
+	var deletion MovieDeletion
+
+	for watchID := range s.db.watchlist {
+		if watchID.movieID == id {
+			delete(s.db.watchlist, watchID)
+			deletion.WatchlistEntries++
+		}
+	}
+	for reportID, report := range s.db.reports {
+		if report.MovieID == id {
+			delete(s.db.reports, reportID)
+			deletion.Reports++
+		}
+	}
+
+	return &deletion, nil
+}
+
+// The GetAll() method filters, sorts and paginates the movies in the same way as the
+// SQL query.
+func (s mockMovieStore) GetAll(movieFilters MovieFilters, filters Filters) ([]*Movie, Metadata, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	matches := []*Movie{}
+
+	for _, movie := range s.db.movies {
+		if mockMovieMatches(movie, movieFilters) {
+			matches = append(matches, s.readMovie(movie))
+		}
+	}
+
+	mockSort(matches, filters, func(i int, name string) interface{} {
+		switch name {
+		case "title":
+			return matches[i].Title
+		case "year":
+			return int64(matches[i].Year)
+		case "runtime":
+			return int64(matches[i].Runtime)
+		case "popularity":
+			return matches[i].Popularity
+		default:
+			return matches[i].ID
+		}
+	})
+
+	start, end, metadata := mockPage(len(matches), filters)
+
+	return matches[start:end], metadata, nil
+}
+
+// The mockMovieMatches() helper reports whether a movie matches the filters. The title
+// filter matches movies whose title contains every word of it.
+func mockMovieMatches(movie *Movie, movieFilters MovieFilters) bool {
+	switch {
+	case !containsAll(mockWords(movie.Title), mockWords(movieFilters.Title)):
+	case !containsAll(movie.Genres, movieFilters.Genres):
+	case movieFilters.HasAwards != nil && *movieFilters.HasAwards != (len(movie.Awards) > 0):
+	case movieFilters.CreatedBy != 0 && (movie.CreatedBy == nil || movie.CreatedBy.ID != movieFilters.CreatedBy):
+	default:
+		return true
+	}
+
+	return false
+}
+
+// The GenreFacets() method counts the genres of the same movies that GetAll() lists,
+// and orders them as the SQL query does.
+func (s mockMovieStore) GenreFacets(movieFilters MovieFilters) ([]FacetCount, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	counts := make(map[string]int)
+
+	for _, movie := range s.db.movies {
+		if mockMovieMatches(movie, movieFilters) {
+			for _, genre := range movie.Genres {
+				counts[genre]++
+			}
+		}
+	}
+
+	facets := []FacetCount{}
+	for genre, count := range counts {
+		facets = append(facets, FacetCount{Value: genre, Count: count})
+	}
+
+	sort.Slice(facets, func(i, j int) bool {
+		if facets[i].Count != facets[j].Count {
+			return facets[i].Count > facets[j].Count
+		}
+		return facets[i].Value < facets[j].Value
+	})
+
+	return facets, nil
+}
+
+func (s mockMovieStore) YearFacets(movieFilters MovieFilters) ([]YearBucket, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	counts := make(map[int32]int)
+
+	for _, movie := range s.db.movies {
+		if mockMovieMatches(movie, movieFilters) {
+			counts[movie.Year]++
+		}
+	}
+
+	return yearBuckets(counts), nil
+}
+
+// The AddViews() method adds to the views of the movies, skipping those which have
+// been deleted, like the SQL version.
+func (s mockMovieStore) AddViews(views map[int64]int64) error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	for id, n := range views {
+		if movie, ok := s.db.movies[id]; ok {
+			movie.Views += n
+		}
+	}
+
+	return nil
+}
+
+// The MaxRatingMass() method returns 0, as the mocks don't store ratings.
+func (s mockMovieStore) MaxRatingMass() (float64, error) {
+	return 0, nil
+}
+
+// The RefreshPopularityBatch() method scores the movies in order of ID, as the SQL
+// version does. Their ratings are always 0, as the mocks don't store ratings.
+func (s mockMovieStore) RefreshPopularityBatch(afterID int64, limit int, score func(PopularityInput) float64) (int64, int, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	ids := []int64{}
+
+	for id := range s.db.movies {
+		if id > afterID {
+			ids = append(ids, id)
+		}
+	}
+
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	if len(ids) > limit {
+		ids = ids[:limit]
+	}
+
+	if len(ids) == 0 {
+		return 0, 0, nil
+	}
+
+	for _, id := range ids {
+		movie := s.db.movies[id]
+		movie.Popularity = score(PopularityInput{ID: id, Views: movie.Views, CreatedAt: movie.CreatedAt})
+	}
+
+	return ids[len(ids)-1], len(ids), nil
+}
+
+// The ReindexBatch() method only counts the movies, as the mocks don't store ratings to
+// rebuild the aggregates from.
+func (s mockMovieStore) ReindexBatch(afterID int64, limit int) (int64, int, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	ids := []int64{}
+
+	for id := range s.db.movies {
+		if id > afterID {
+			ids = append(ids, id)
+		}
+	}
+
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	if len(ids) > limit {
+		ids = ids[:limit]
+	}
+
+	if len(ids) == 0 {
+		return 0, 0, nil
+	}
+
+	return ids[len(ids)-1], len(ids), nil
+}
+
+func (s mockMovieStore) GetBatch(afterID int64, limit int) ([]*Movie, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	movies := []*Movie{}
+
+	for id, movie := range s.db.movies {
+		if id > afterID {
+			movies = append(movies, copyMovie(movie))
+		}
+	}
+
+	sort.Slice(movies, func(i, j int) bool { return movies[i].ID < movies[j].ID })
+
+	if len(movies) > limit {
+		movies = movies[:limit]
+	}
+
+	// Like the SQL query, the batch doesn't include the users.
+	for _, movie := range movies {
+		movie.CreatedBy, movie.UpdatedBy = nil, nil
+	}
+
+	return movies, nil
+}
+
+func (s mockMovieStore) GetByTitleYear(title string, year int32) (*Movie, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	var found *Movie
+
+	for _, movie := range s.db.movies {
+		if movie.Title == title && movie.Year == year && (found == nil || movie.ID < found.ID) {
+			found = movie
+		}
+	}
+
+	if found == nil {
+		return nil, ErrRecordNotFound
+	}
+
+	movie := copyMovie(found)
+	movie.CreatedBy, movie.UpdatedBy = nil, nil
+
+	return movie, nil
+}
+
+// Like the SQL query, the candidates are scored by candidateScore() and don't include
+// the users.
+func (s mockMovieStore) FindSimilarCandidates(title string, year int32, limit int) ([]*MovieCandidate, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	candidates := []*MovieCandidate{}
+
+	for _, movie := range s.db.movies {
+		similarity := trigramSimilarity(movie.Title, title)
+		if similarity < similarTitleMin {
+			continue
+		}
+
+		c := copyMovie(movie)
+		c.CreatedBy, c.UpdatedBy = nil, nil
+
+		candidates = append(candidates, &MovieCandidate{Movie: c, Score: candidateScore(similarity, movie.Year, year)})
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].Score != candidates[j].Score {
+			return candidates[i].Score > candidates[j].Score
+		}
+
+		return candidates[i].Movie.ID < candidates[j].Movie.ID
+	})
+
+	if len(candidates) > limit {
+		candidates = candidates[:limit]
+	}
+
+	return candidates, nil
+}
+
+// The mockWords() helper splits text into lowercase words, like PostgreSQL's 'simple'
+// text search configuration.
+func mockWords(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// The containsAll() helper reports whether every value in want is in values.
+func containsAll(values, want []string) bool {
+	for _, w := range want {
+		found := false
+		for _, v := range values {
+			if v == w {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Define the mockUserStore type, which satisfies UserStore.
+type mockUserStore struct {
+	db *mockDB
+}
+
+// The copyUser() helper returns a copy of a user. The plaintext password isn't kept,
+// as it's never stored in the database.
+func copyUser(user *User) *User {
+	c := *user
+	c.Password.plaintext = nil
+	return &c
+}
+
+// The checkUnique() method returns ErrDuplicateEmail or ErrDuplicateUsername if another
+// user has the same email address or username. The caller must hold the mutex.
+func (s mockUserStore) checkUnique(user *User) error {
+	for _, other := range s.db.users {
+		if other.ID == user.ID {
+			continue
+		}
+
+		switch {
+		case NormalizeEmail(other.Email) == NormalizeEmail(user.Email):
+			return ErrDuplicateEmail
+		case NormalizeUsername(other.Username) == NormalizeUsername(user.Username):
+			return ErrDuplicateUsername
+		}
+	}
+
+	return nil
+}
+
+// The insert() method adds a user. The caller must hold the mutex.
+func (s mockUserStore) insert(user *User) error {
+	user.ID = 0
+
+	err := s.checkUnique(user)
+	if err != nil {
+		return err
+	}
+
+	publicID, err := NewUUID()
+	if err != nil {
+		return err
+	}
+
+	user.ID = s.db.nextID()
+	user.PublicID = publicID
+	user.CreatedAt = time.Now()
+	user.Version = 1
+
+	s.db.users[user.ID] = copyUser(user)
+	s.db.preferences[user.ID] = &Preferences{}
+
+	return nil
+}
+
+func (s mockUserStore) Insert(user *User) error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	return s.insert(user)
+}
+
+// Register() adds the user, their roles, an activation token and the welcome email,
+// undoing everything if any step fails.
+func (s mockUserStore) Register(user *User, roles []string, activationTTL time.Duration, newEmail func(token *Token) *EmailJob) (*Token, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	saved := s.db.mockData.clone()
+
+	token, err := s.register(user, roles, activationTTL, newEmail)
+	if err != nil {
+		s.db.mockData = saved
+		return nil, err
+	}
+
+	return token, nil
+}
+
+func (s mockUserStore) register(user *User, roles []string, activationTTL time.Duration, newEmail func(token *Token) *EmailJob) (*Token, error) {
+	err := s.insert(user)
+	if err != nil {
+		return nil, err
+	}
+
+	s.db.addRoles(user.ID, roles...)
+
+	token, err := generateToekn(user.ID, activationTTL, ScopeActivation)
+	if err != nil {
+		return nil, err
+	}
+
+	s.db.tokens = append(s.db.tokens, token)
+
+	s.db.insertEmailJob(newEmail(token))
+
+	return token, nil
+}
+
+// The find() method returns a copy of the first user for which match returns true, or
+// ErrRecordNotFound if there isn't one.
+func (s mockUserStore) find(match func(user *User) bool) (*User, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	for _, user := range s.db.users {
+		if match(user) {
+			return copyUser(user), nil
+		}
+	}
+
+	return nil, ErrRecordNotFound
+}
+
+func (s mockUserStore) GetByEmail(email string) (*User, error) {
+	return s.find(func(user *User) bool {
+		return NormalizeEmail(user.Email) == NormalizeEmail(email)
+	})
+}
+
+func (s mockUserStore) GetByUsername(username string) (*User, error) {
+	return s.find(func(user *User) bool {
+		return NormalizeUsername(user.Username) == NormalizeUsername(username)
+	})
+}
+
+func (s mockUserStore) AvailableUsername(email string) (string, error) {
+	base := usernameFromEmail(email)
+
+	for i := 1; ; i++ {
+		username := base
+		if i > 1 {
+			username = fmt.Sprintf("%s%d", base, i)
+		}
+
+		_, err := s.GetByUsername(username)
+		if errors.Is(err, ErrRecordNotFound) {
+			return username, nil
+		}
+	}
+}
+
+func (s mockUserStore) Get(id int64) (*User, error) {
+	return s.find(func(user *User) bool {
+		return user.ID == id
+	})
+}
+
+func (s mockUserStore) GetByPublicID(publicID UUID) (*User, error) {
+	if publicID.IsNil() {
+		return nil, ErrRecordNotFound
+	}
+
+	return s.find(func(user *User) bool {
+		return user.PublicID == publicID
+	})
+}
+
+func (s mockUserStore) Update(user *User) error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	stored, ok := s.db.users[user.ID]
+	if !ok || stored.Version != user.Version {
+		return ErrEditConflict
+	}
+
+	err := s.checkUnique(user)
+	if err != nil {
+		return err
+	}
+
+	// Only the columns which the SQL query sets are changed.
+	updated := copyUser(stored)
+	updated.Name = user.Name
+	updated.Username = user.Username
+	updated.Email = user.Email
+	updated.Locale = user.Locale
+	updated.Password.hash = user.Password.hash
+	updated.Activated = user.Activated
+	updated.Version++
+
+	s.db.users[user.ID] = updated
+	user.Version = updated.Version
+
+	return nil
+}
+
+func (s mockUserStore) GetByOAuth(provider, subject string) (*User, error) {
+	return s.find(func(user *User) bool {
+		return user.OAuthProvider != "" && user.OAuthProvider == provider && user.OAuthSubject == subject
+	})
+}
+
+// LinkOAuth() links the account in the same way as UserModel.LinkOAuth(), including
+// clearing the password and tokens of an account which wasn't activated.
+func (s mockUserStore) LinkOAuth(user *User, provider, subject string) error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	stored, ok := s.db.users[user.ID]
+	if !ok || stored.Version != user.Version {
+		return ErrEditConflict
+	}
+
+	if !stored.Activated {
+		stored.Password.hash = nil
+		s.db.removeTokens(func(token *Token) bool {
+			return token.UserID == user.ID
+		})
+	}
+
+	stored.OAuthProvider = provider
+	stored.OAuthSubject = subject
+	stored.Activated = true
+	stored.Version++
+
+	user.OAuthProvider = provider
+	user.OAuthSubject = subject
+	user.Activated = true
+	user.Password.hash = stored.Password.hash
+	user.Version = stored.Version
+
+	return nil
+}
+
+// The userForToken() method returns the user with an unexpired token, or
+// ErrRecordNotFound. The caller must hold the mutex.
+func (s mockUserStore) userForToken(tokenScope string, tokenHash [32]byte) (*User, error) {
+	now := time.Now()
+
+	for _, token := range s.db.tokens {
+		if token.Scope == tokenScope && bytes.Equal(token.Hash, tokenHash[:]) && token.Expiry.After(now) {
+			if user, ok := s.db.users[token.UserID]; ok {
+				return user, nil
+			}
+		}
+	}
+
+	return nil, ErrRecordNotFound
+}
+
+func (s mockUserStore) GetForToken(tokenScope, tokenPlaintext string) (*User, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	user, err := s.userForToken(tokenScope, sha256.Sum256([]byte(tokenPlaintext)))
+	if err != nil {
+		return nil, err
+	}
+
+	return copyUser(user), nil
+}
+
+func (s mockUserStore) GetVersionForToken(tokenScope string, tokenHash [32]byte) (int, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	user, err := s.userForToken(tokenScope, tokenHash)
+	if err != nil {
+		return 0, err
+	}
+
+	return user.Version, nil
+}
+
+// RecordLogin() records the login time and adds an entry to the login history, keeping
+// only the most recent maxLoginHistory entries.
+func (s mockUserStore) RecordLogin(userID int64, ip, userAgent string) error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	user, ok := s.db.users[userID]
+	if !ok {
+		return ErrRecordNotFound
+	}
+
+	now := time.Now()
+	user.LastLoginAt = &now
+
+	logins := append([]*Login{{CreatedAt: now, IP: ip, UserAgent: userAgent}}, s.db.logins[userID]...)
+	if len(logins) > maxLoginHistory {
+		logins = logins[:maxLoginHistory]
+	}
+
+	s.db.logins[userID] = logins
+
+	return nil
+}
+
+// Delete() removes the user along with everything that belongs to them, including the
+// emails addressed to them. There are no reviews in the mock, so anonymizeReviews has
+// no effect.
+func (s mockUserStore) Delete(id int64, anonymizeReviews bool) error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	user, ok := s.db.users[id]
+	if !ok {
+		return ErrRecordNotFound
+	}
+
+	for jobID, job := range s.db.emailJobs {
+		if strings.EqualFold(job.Recipient, user.Email) {
+			delete(s.db.emailJobs, jobID)
+		}
+	}
+
+	failedEmails := s.db.failedEmails[:0]
+	for _, email := range s.db.failedEmails {
+		if !strings.EqualFold(email.Recipient, user.Email) {
+			failedEmails = append(failedEmails, email)
+		}
+	}
+	s.db.failedEmails = failedEmails
+
+	delete(s.db.users, id)
+	delete(s.db.preferences, id)
+	delete(s.db.logins, id)
+	delete(s.db.permissions, id)
+	delete(s.db.roles, id)
+
+	s.db.removeTokens(func(token *Token) bool {
+		return token.UserID == id
+	})
+
+	for keyID := range s.db.idempotencyKeys {
+		if keyID.userID == id {
+			delete(s.db.idempotencyKeys, keyID)
+		}
+	}
+
+	for usageID := range s.db.usage {
+		if usageID.userID == id {
+			delete(s.db.usage, usageID)
+		}
+	}
+
+	for searchID, search := range s.db.savedSearches {
+		if search.UserID == id {
+			delete(s.db.savedSearches, searchID)
+		}
+	}
+
+	for reportID, report := range s.db.reports {
+		if report.UserID == id {
+			delete(s.db.reports, reportID)
+		}
+	}
+
+	for watchID := range s.db.watchlist {
+		if watchID.userID == id {
+			delete(s.db.watchlist, watchID)
+		}
+	}
+
+	for dayID := range s.db.notifications {
+		if dayID.userID == id {
+			delete(s.db.notifications, dayID)
+		}
+	}
+
+	return nil
+}
+
+// Define the mockTokenStore type, which satisfies TokenStore.
+type mockTokenStore struct {
+	db *mockDB
+}
+
+// The removeTokens() method deletes the tokens for which match returns true, and
+// returns how many were deleted. The caller must hold the mutex.
+func (db *mockDB) removeTokens(match func(token *Token) bool) int64 {
+	var kept []*Token
+	var removed int64
+
+	for _, token := range db.tokens {
+		if match(token) {
+			removed++
+			continue
+		}
+		kept = append(kept, token)
+	}
+
+	db.tokens = kept
+
+	return removed
+}
+
+func (s mockTokenStore) New(userID int64, ttl time.Duration, scope string) (*Token, error) {
+	token, err := generateToekn(userID, ttl, scope)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.Insert(token)
+	return token, err
+}
+
+func (s mockTokenStore) Insert(token *Token) error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	c := *token
+	s.db.tokens = append(s.db.tokens, &c)
+
+	return nil
+}
+
+func (s mockTokenStore) DeleteAllForUser(scope string, userID int64) error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	s.db.removeTokens(func(token *Token) bool {
+		return token.Scope == scope && token.UserID == userID
+	})
+
+	return nil
+}
+
+func (s mockTokenStore) DeleteAllExpired() (int64, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	now := time.Now()
+
+	return s.db.removeTokens(func(token *Token) bool {
+		return token.Expiry.Before(now)
+	}), nil
+}
+
+func (s mockTokenStore) Delete(scope, tokenPlaintext string) error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	s.db.removeTokens(func(token *Token) bool {
+		return token.Scope == scope && bytes.Equal(token.Hash, tokenHash[:])
+	})
+
+	return nil
+}
+
+// Define the mockPermissionStore type, which satisfies PermissionStore.
+type mockPermissionStore struct {
+	db *mockDB
+}
+
+// GetAllForUser() returns the user's permissions, both direct and through their
+// roles, in alphabetical order.
+func (s mockPermissionStore) GetAllForUser(userID int64) (Permissions, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	codes := copySet(s.db.permissions[userID])
+
+	for name := range s.db.roles[userID] {
+		for _, code := range mockRole(name).Permissions {
+			codes[code] = true
+		}
+	}
+
+	var permissions Permissions
+	for code := range codes {
+		permissions = append(permissions, code)
+	}
+
+	sort.Strings(permissions)
+
+	return permissions, nil
+}
+
+func (s mockPermissionStore) GetAll() (Permissions, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	return append(Permissions(nil), s.db.allCodes...), nil
+}
+
+// AddForUser() grants the codes which exist, and skips the others, as the SQL query
+// does.
+func (s mockPermissionStore) AddForUser(userID int64, codes ...string) error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	for _, code := range codes {
+		if s.db.allCodes.Include(code) {
+			s.db.grant(userID, code)
+		}
+	}
+
+	return nil
+}
+
+func (s mockPermissionStore) RemoveForUser(userID int64, code string) error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	if !s.db.permissions[userID][code] {
+		return ErrRecordNotFound
+	}
+
+	delete(s.db.permissions[userID], code)
+
+	return nil
+}
+
+func (s mockPermissionStore) AddAllForUser(userID int64) error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	for _, code := range s.db.allCodes {
+		s.db.grant(userID, code)
+	}
+
+	return nil
+}
+
+// The grant() method gives a user a permission. The caller must hold the mutex.
+func (db *mockDB) grant(userID int64, code string) {
+	if db.permissions[userID] == nil {
+		db.permissions[userID] = make(map[string]bool)
+	}
+
+	db.permissions[userID][code] = true
+}
+
+// Define the mockRoleStore type, which satisfies RoleStore.
+type mockRoleStore struct {
+	db *mockDB
+}
+
+func (s mockRoleStore) GetAll() ([]*Role, error) {
+	roles := []*Role{}
+
+	for _, role := range mockRoles {
+		r := *role
+		r.Permissions = append(Permissions(nil), role.Permissions...)
+		roles = append(roles, &r)
+	}
+
+	return roles, nil
+}
+
+func (s mockRoleStore) GetAllForUser(userID int64) ([]string, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	names := []string{}
+	for name := range s.db.roles[userID] {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names, nil
+}
+
+func (s mockRoleStore) AddForUser(userID int64, names ...string) error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	s.db.addRoles(userID, names...)
+
+	return nil
+}
+
+func (s mockRoleStore) SetForUser(userID int64, names ...string) error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	delete(s.db.roles, userID)
+	s.db.addRoles(userID, names...)
+
+	return nil
+}
+
+// The addRoles() method assigns the named roles which exist to a user, and skips the
+// others, as the SQL query does. The caller must hold the mutex.
+func (db *mockDB) addRoles(userID int64, names ...string) {
+	for _, name := range names {
+		if mockRole(name) == nil {
+			continue
+		}
+
+		if db.roles[userID] == nil {
+			db.roles[userID] = make(map[string]bool)
+		}
+
+		db.roles[userID][name] = true
+	}
+}
+
+// Define the mockPreferencesStore type, which satisfies PreferencesStore.
+type mockPreferencesStore struct {
+	db *mockDB
+}
+
+func copyPreferences(preferences *Preferences) *Preferences {
+	c := &Preferences{}
+
+	if preferences.DefaultPageSize != nil {
+		v := *preferences.DefaultPageSize
+		c.DefaultPageSize = &v
+	}
+	if preferences.DefaultSort != nil {
+		v := *preferences.DefaultSort
+		c.DefaultSort = &v
+	}
+	if preferences.Locale != nil {
+		v := *preferences.Locale
+		c.Locale = &v
+	}
+	if preferences.Digest != nil {
+		v := *preferences.Digest
+		c.Digest = &v
+	}
+	if preferences.DigestGenres != nil {
+		v := append([]string{}, *preferences.DigestGenres...)
+		c.DigestGenres = &v
+	}
+
+	return c
+}
+
+func (s mockPreferencesStore) Get(userID int64) (*Preferences, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	preferences, ok := s.db.preferences[userID]
+	if !ok {
+		return nil, ErrRecordNotFound
+	}
+
+	return copyPreferences(preferences), nil
+}
+
+// Update() merges the preferences which are set into the stored ones, like the jsonb
+// || operator in the SQL query.
+func (s mockPreferencesStore) Update(userID int64, preferences *Preferences) (*Preferences, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	stored, ok := s.db.preferences[userID]
+	if !ok {
+		return nil, ErrRecordNotFound
+	}
+
+	patch := copyPreferences(preferences)
+
+	if patch.DefaultPageSize != nil {
+		stored.DefaultPageSize = patch.DefaultPageSize
+	}
+	if patch.DefaultSort != nil {
+		stored.DefaultSort = patch.DefaultSort
+	}
+	if patch.Locale != nil {
+		stored.Locale = patch.Locale
+	}
+	if patch.Digest != nil {
+		stored.Digest = patch.Digest
+	}
+	if patch.DigestGenres != nil {
+		stored.DigestGenres = patch.DigestGenres
+	}
+
+	return copyPreferences(stored), nil
+}
+
+// Define the mockReportStore type, which satisfies ReportStore.
+type mockReportStore struct {
+	db *mockDB
+}
+
+func copyReport(report *Report) *Report {
+	c := *report
+	if report.ClosedAt != nil {
+		closedAt := *report.ClosedAt
+		c.ClosedAt = &closedAt
+	}
+	return &c
+}
+
+// The readReport() method returns a copy of a report with the movie's current title,
+// like the join in the SQL queries. The caller must hold the mutex.
+func (s mockReportStore) readReport(report *Report) *Report {
+	c := copyReport(report)
+
+	if movie, ok := s.db.movies[report.MovieID]; ok {
+		c.MovieTitle = movie.Title
+	}
+
+	return c
+}
+
+func (s mockReportStore) Insert(report *Report) error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	movie, ok := s.db.movies[report.MovieID]
+	if !ok {
+		return ErrRecordNotFound
+	}
+
+	count := 0
+	for _, stored := range s.db.reports {
+		if stored.UserID == report.UserID && stored.Status == ReportOpen {
+			count++
+		}
+	}
+
+	if count >= MaxOpenReports {
+		return ErrReportLimit
+	}
+
+	report.ID = s.db.nextID()
+	report.MovieTitle = movie.Title
+	report.Status = ReportOpen
+	report.CreatedAt = time.Now().Truncate(time.Second)
+
+	s.db.reports[report.ID] = copyReport(report)
+
+	return nil
+}
+
+func (s mockReportStore) Get(id int64) (*Report, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	report, ok := s.db.reports[id]
+	if !ok {
+		return nil, ErrRecordNotFound
+	}
+
+	return s.readReport(report), nil
+}
+
+func (s mockReportStore) GetAll(status string, filters Filters) ([]*Report, Metadata, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	reports := []*Report{}
+	for _, report := range s.db.reports {
+		if report.Status == status {
+			reports = append(reports, s.readReport(report))
+		}
+	}
+
+	mockSort(reports, filters, func(i int, name string) interface{} {
+		switch name {
+		case "created_at":
+			return reports[i].CreatedAt
+		default:
+			return reports[i].ID
+		}
+	})
+
+	start, end, metadata := mockPage(len(reports), filters)
+
+	return reports[start:end], metadata, nil
+}
+
+func (s mockReportStore) GetAllForUser(userID int64) ([]*Report, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	reports := []*Report{}
+	for _, report := range s.db.reports {
+		if report.UserID == userID {
+			reports = append(reports, s.readReport(report))
+		}
+	}
+
+	sort.Slice(reports, func(i, j int) bool { return reports[i].ID > reports[j].ID })
+
+	return reports, nil
+}
+
+func (s mockReportStore) UpdateStatus(report *Report, from string) error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	stored, ok := s.db.reports[report.ID]
+	if !ok || stored.Status != from {
+		return ErrEditConflict
+	}
+
+	report.ClosedAt = nil
+	if report.Status != ReportOpen {
+		closedAt := time.Now().Truncate(time.Second)
+		report.ClosedAt = &closedAt
+	}
+
+	stored.Status = report.Status
+	stored.Resolution = report.Resolution
+	stored.ClosedAt = copyReport(report).ClosedAt
+
+	return nil
+}
+
+// Define the mockSavedSearchStore type, which satisfies SavedSearchStore.
+type mockSavedSearchStore struct {
+	db *mockDB
+}
+
+func copySavedSearch(search *SavedSearch) *SavedSearch {
+	c := *search
+
+	c.Query = make(SearchQuery, len(search.Query))
+	for key, value := range search.Query {
+		c.Query[key] = value
+	}
+
+	return &c
+}
+
+// Insert() checks the limit and the names like the SQL model, comparing the names
+// without regard to case like the lower(name) index.
+func (s mockSavedSearchStore) Insert(search *SavedSearch) error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	count := 0
+	for _, stored := range s.db.savedSearches {
+		if stored.UserID != search.UserID {
+			continue
+		}
+
+		if strings.EqualFold(stored.Name, search.Name) {
+			return ErrDuplicateSearchName
+		}
+
+		count++
+	}
+
+	if count >= MaxSavedSearches {
+		return ErrSavedSearchLimit
+	}
+
+	search.ID = s.db.nextID()
+	search.CreatedAt = time.Now().Truncate(time.Second)
+
+	s.db.savedSearches[search.ID] = copySavedSearch(search)
+
+	return nil
+}
+
+func (s mockSavedSearchStore) GetAllForUser(userID int64) ([]*SavedSearch, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	searches := []*SavedSearch{}
+	for _, search := range s.db.savedSearches {
+		if search.UserID == userID {
+			searches = append(searches, copySavedSearch(search))
+		}
+	}
+
+	sort.Slice(searches, func(i, j int) bool { return searches[i].ID < searches[j].ID })
+
+	return searches, nil
+}
+
+func (s mockSavedSearchStore) GetForUser(id, userID int64) (*SavedSearch, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	search, ok := s.db.savedSearches[id]
+	if !ok || search.UserID != userID {
+		return nil, ErrRecordNotFound
+	}
+
+	return copySavedSearch(search), nil
+}
+
+func (s mockSavedSearchStore) DeleteForUser(id, userID int64) error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	search, ok := s.db.savedSearches[id]
+	if !ok || search.UserID != userID {
+		return ErrRecordNotFound
+	}
+
+	delete(s.db.savedSearches, id)
+
+	return nil
+}
+
+// Define the mockLoginStore type, which satisfies LoginStore. Logins are added by
+// mockUserStore.RecordLogin().
+type mockLoginStore struct {
+	db *mockDB
+}
+
+func (s mockLoginStore) GetAllForUser(userID int64) ([]*Login, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	logins := []*Login{}
+	for _, login := range s.db.logins[userID] {
+		l := *login
+		logins = append(logins, &l)
+	}
+
+	return logins, nil
+}
+
+// Define the mockUsageStore type, which satisfies UsageStore. Like the SQL model, it
+// skips the counts of users who don't exist.
+type mockUsageStore struct {
+	db *mockDB
+}
+
+func (s mockUsageStore) Add(counts []UsageCount) error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	for _, count := range counts {
+		if _, ok := s.db.users[count.UserID]; !ok {
+			continue
+		}
+
+		s.db.usage[mockUsageID{count.UserID, count.Date.UTC().Format("2006-01-02")}] += count.Requests
+	}
+
+	return nil
+}
+
+func (s mockUsageStore) GetAllForUser(userID int64, since time.Time) ([]*Usage, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	from := since.UTC().Format("2006-01-02")
+
+	usage := []*Usage{}
+	for id, requests := range s.db.usage {
+		if id.userID != userID || id.date < from {
+			continue
+		}
+
+		date, err := time.Parse("2006-01-02", id.date)
+		if err != nil {
+			return nil, err
+		}
+
+		usage = append(usage, &Usage{Date: date, Requests: requests})
+	}
+
+	sort.Slice(usage, func(i, j int) bool { return usage[i].Date.Before(usage[j].Date) })
+
+	return usage, nil
+}
+
+// Define the mockWatchlistStore type, which satisfies WatchlistStore.
+type mockWatchlistStore struct {
+	db *mockDB
+}
+
+// The readEntry() method returns a copy of an entry with the movie's current title and
+// year, like the join in the SQL queries. The caller must hold the mutex.
+func (s mockWatchlistStore) readEntry(id mockWatchlistID) *WatchlistEntry {
+	entry := *s.db.watchlist[id]
+
+	if movie, ok := s.db.movies[id.movieID]; ok {
+		entry.Title = movie.Title
+		entry.Year = movie.Year
+	}
+
+	return &entry
+}
+
+func (s mockWatchlistStore) Add(userID, movieID int64, notify bool) (*WatchlistEntry, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	if _, ok := s.db.movies[movieID]; !ok {
+		return nil, ErrRecordNotFound
+	}
+
+	id := mockWatchlistID{userID, movieID}
+
+	if _, ok := s.db.watchlist[id]; ok {
+		return nil, ErrAlreadyWatching
+	}
+
+	s.db.watchlist[id] = &WatchlistEntry{MovieID: movieID, Notify: notify, AddedAt: time.Now().Truncate(time.Second)}
+
+	return s.readEntry(id), nil
+}
+
+func (s mockWatchlistStore) GetAllForUser(userID int64) ([]*WatchlistEntry, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	entries := []*WatchlistEntry{}
+	for id := range s.db.watchlist {
+		if id.userID == userID {
+			entries = append(entries, s.readEntry(id))
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		if !entries[i].AddedAt.Equal(entries[j].AddedAt) {
+			return entries[i].AddedAt.Before(entries[j].AddedAt)
+		}
+		return entries[i].MovieID < entries[j].MovieID
+	})
+
+	return entries, nil
+}
+
+func (s mockWatchlistStore) SetNotify(userID, movieID int64, notify bool) (*WatchlistEntry, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	id := mockWatchlistID{userID, movieID}
+
+	entry, ok := s.db.watchlist[id]
+	if !ok {
+		return nil, ErrRecordNotFound
+	}
+
+	entry.Notify = notify
+
+	return s.readEntry(id), nil
+}
+
+func (s mockWatchlistStore) Remove(userID, movieID int64) error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	id := mockWatchlistID{userID, movieID}
+
+	if _, ok := s.db.watchlist[id]; !ok {
+		return ErrRecordNotFound
+	}
+
+	delete(s.db.watchlist, id)
+
+	return nil
+}
+
+func (s mockWatchlistStore) GetWatchers(movieID, afterUserID int64, limit int) ([]*Watcher, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	watchers := []*Watcher{}
+	for id, entry := range s.db.watchlist {
+		user, ok := s.db.users[id.userID]
+		if id.movieID != movieID || !entry.Notify || !ok || !user.Activated || user.ID <= afterUserID {
+			continue
+		}
+
+		watchers = append(watchers, &Watcher{UserID: user.ID, Name: user.Name, Email: user.Email, Locale: user.Locale})
+	}
+
+	sort.Slice(watchers, func(i, j int) bool { return watchers[i].UserID < watchers[j].UserID })
+
+	if len(watchers) > limit {
+		watchers = watchers[:limit]
+	}
+
+	return watchers, nil
+}
+
+func (s mockWatchlistStore) ClaimNotification(userID int64, limit int) (bool, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	id := mockUsageID{userID, time.Now().UTC().Format("2006-01-02")}
+
+	if s.db.notifications[id] >= limit {
+		return false, nil
+	}
+
+	s.db.notifications[id]++
+
+	return true, nil
+}
+
+func (s mockWatchlistStore) DeleteOldNotifications() (int64, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	today := time.Now().UTC().Format("2006-01-02")
+
+	var deleted int64
+	for id := range s.db.notifications {
+		if id.date < today {
+			delete(s.db.notifications, id)
+			deleted++
+		}
+	}
+
+	return deleted, nil
+}
+
+// Define the mockAuditStore type, which satisfies AuditStore.
+type mockAuditStore struct {
+	db *mockDB
+}
+
+func (s mockAuditStore) Insert(entry *AuditEntry) error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	entry.ID = s.db.nextID()
+
+	e := *entry
+	s.db.auditEntries = append(s.db.auditEntries, &e)
+
+	return nil
+}
+
+func (s mockAuditStore) GetAll(auditFilters AuditFilters, filters Filters) ([]*AuditEntry, Metadata, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	entries := []*AuditEntry{}
+
+	for _, entry := range s.db.auditEntries {
+		switch {
+		case auditFilters.UserID != 0 && entry.UserID != auditFilters.UserID:
+		case auditFilters.Action != "" && entry.Action != auditFilters.Action:
+		case !auditFilters.From.IsZero() && entry.OccurredAt.Before(auditFilters.From):
+		case !auditFilters.To.IsZero() && entry.OccurredAt.After(auditFilters.To):
+		default:
+			e := *entry
+			entries = append(entries, &e)
+		}
+	}
+
+	mockSort(entries, filters, func(i int, name string) interface{} {
+		switch name {
+		case "occurred_at":
+			return entries[i].OccurredAt
+		default:
+			return entries[i].ID
+		}
+	})
+
+	start, end, metadata := mockPage(len(entries), filters)
+
+	return entries[start:end], metadata, nil
+}
+
+// Define the mockDigestStore type, which satisfies DigestStore.
+type mockDigestStore struct {
+	db *mockDB
+}
+
+func (s mockDigestStore) GetSubscribers(since time.Time, afterUserID int64, limit int) ([]*DigestSubscriber, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	subscribers := []*DigestSubscriber{}
+	for id, preferences := range s.db.preferences {
+		user, ok := s.db.users[id]
+		if !ok || !user.Activated || id <= afterUserID || preferences.Digest == nil || !*preferences.Digest {
+			continue
+		}
+
+		if sentAt, ok := s.db.digestsSent[id]; ok && !sentAt.Before(since) {
+			continue
+		}
+
+		subscriber := &DigestSubscriber{UserID: user.ID, Name: user.Name, Email: user.Email, Locale: user.Locale, Genres: []string{}}
+		if preferences.DigestGenres != nil {
+			for _, genre := range *preferences.DigestGenres {
+				subscriber.Genres = append(subscriber.Genres, strings.ToLower(genre))
+			}
+		}
+
+		subscribers = append(subscribers, subscriber)
+	}
+
+	sort.Slice(subscribers, func(i, j int) bool { return subscribers[i].UserID < subscribers[j].UserID })
+
+	if len(subscribers) > limit {
+		subscribers = subscribers[:limit]
+	}
+
+	return subscribers, nil
+}
+
+func (s mockDigestStore) GetNewMovies(since, until time.Time, genres []string, limit int) ([]*Movie, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	movies := []*Movie{}
+	for _, movie := range s.db.movies {
+		if !movie.CreatedAt.After(since) || movie.CreatedAt.After(until) {
+			continue
+		}
+
+		matches := len(genres) == 0
+		for _, genre := range movie.Genres {
+			for _, wanted := range genres {
+				matches = matches || strings.ToLower(genre) == wanted
+			}
+		}
+
+		if matches {
+			movies = append(movies, copyMovie(movie))
+		}
+	}
+
+	sort.Slice(movies, func(i, j int) bool {
+		if !movies[i].CreatedAt.Equal(movies[j].CreatedAt) {
+			return movies[i].CreatedAt.After(movies[j].CreatedAt)
+		}
+		return movies[i].ID > movies[j].ID
+	})
+
+	if len(movies) > limit {
+		movies = movies[:limit]
+	}
+
+	return movies, nil
+}
+
+func (s mockDigestStore) ClaimSent(userID int64, since, sentAt time.Time) (bool, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	if _, ok := s.db.users[userID]; !ok {
+		return false, nil
+	}
+
+	if last, ok := s.db.digestsSent[userID]; ok && !last.Before(since) {
+		return false, nil
+	}
+
+	s.db.digestsSent[userID] = sentAt
+
+	return true, nil
+}
+
+// Define the mockLockStore type, which satisfies LockStore.
+type mockLockStore struct {
+	db *mockDB
+}
+
+func (s mockLockStore) TryLock(ctx context.Context, name string) (func(), bool, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	if s.db.locks[name] {
+		return nil, false, nil
+	}
+
+	s.db.locks[name] = true
+
+	release := func() {
+		s.db.mu.Lock()
+		defer s.db.mu.Unlock()
+
+		delete(s.db.locks, name)
+	}
+
+	return release, true, nil
+}
+
+// Define the mockEmailJobStore type, which satisfies EmailJobStore.
+type mockEmailJobStore struct {
+	db *mockDB
+}
+
+func copyEmailJob(job *EmailJob) *EmailJob {
+	c := *job
+
+	c.Payload = make(map[string]interface{}, len(job.Payload))
+	for k, v := range job.Payload {
+		c.Payload[k] = v
+	}
+
+	return &c
+}
+
+// The insertEmailJob() method adds a pending job. The caller must hold the mutex.
+func (db *mockDB) insertEmailJob(job *EmailJob) {
+	job.ID = db.nextID()
+	job.CreatedAt = time.Now()
+	job.Status = EmailJobPending
+	job.Attempts = 0
+	job.NextRetryAt = job.CreatedAt
+
+	db.emailJobs[job.ID] = copyEmailJob(job)
+}
+
+func (s mockEmailJobStore) Insert(job *EmailJob) error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	s.db.insertEmailJob(job)
+
+	return nil
+}
+
+func (s mockEmailJobStore) Claim(limit int, lease time.Duration) ([]*EmailJob, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	now := time.Now()
+	due := []*EmailJob{}
+
+	for _, job := range s.db.emailJobs {
+		if job.Status == EmailJobPending && !job.NextRetryAt.After(now) {
+			due = append(due, job)
+		}
+	}
+
+	sort.Slice(due, func(i, j int) bool {
+		if !due[i].NextRetryAt.Equal(due[j].NextRetryAt) {
+			return due[i].NextRetryAt.Before(due[j].NextRetryAt)
+		}
+		return due[i].ID < due[j].ID
+	})
+
+	if len(due) > limit {
+		due = due[:limit]
+	}
+
+	jobs := []*EmailJob{}
+
+	for _, job := range due {
+		job.Attempts++
+		job.NextRetryAt = now.Add(lease)
+		jobs = append(jobs, copyEmailJob(job))
+	}
+
+	return jobs, nil
+}
+
+func (s mockEmailJobStore) MarkSent(id int64) error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	if job, ok := s.db.emailJobs[id]; ok {
+		now := time.Now()
+		job.Status = EmailJobSent
+		job.SentAt = &now
+		job.Payload = map[string]interface{}{}
+		job.LastError = ""
+	}
+
+	return nil
+}
+
+func (s mockEmailJobStore) MarkFailed(id int64, sendErr error, retryAt time.Time) error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	if job, ok := s.db.emailJobs[id]; ok {
+		job.Status = EmailJobPending
+		if retryAt.IsZero() {
+			job.Status = EmailJobFailed
+			retryAt = time.Now()
+		}
+
+		job.NextRetryAt = retryAt
+		job.LastError = sendErr.Error()
+	}
+
+	return nil
+}
+
+// GetAll() returns the jobs without their payloads, like the SQL query.
+func (s mockEmailJobStore) GetAll(status string, filters Filters) ([]*EmailJob, Metadata, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	jobs := []*EmailJob{}
+
+	for _, job := range s.db.emailJobs {
+		if status == "" || job.Status == status {
+			c := copyEmailJob(job)
+			c.Payload = nil
+			jobs = append(jobs, c)
+		}
+	}
+
+	mockSort(jobs, filters, func(i int, name string) interface{} {
+		switch name {
+		case "created_at":
+			return jobs[i].CreatedAt
+		case "next_retry_at":
+			return jobs[i].NextRetryAt
+		default:
+			return jobs[i].ID
+		}
+	})
+
+	start, end, metadata := mockPage(len(jobs), filters)
+
+	return jobs[start:end], metadata, nil
+}
+
+// Define the mockJobStore type, which satisfies JobStore.
+type mockJobStore struct {
+	db *mockDB
+}
+
+func copyJob(job *Job) *Job {
+	c := *job
+	c.Errors = append([]string{}, job.Errors...)
+	return &c
+}
+
+// The Start() method resumes the latest failed or abandoned job of the kind, like the
+// SQL query.
+func (s mockJobStore) Start(kind string, lease time.Duration) (*Job, bool, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	var latest *Job
+
+	for _, job := range s.db.jobs {
+		if job.Kind == kind && (job.Status == JobRunning || job.Status == JobFailed) && (latest == nil || job.ID > latest.ID) {
+			latest = job
+		}
+	}
+
+	switch {
+	case latest == nil:
+		now := time.Now()
+		latest = &Job{ID: s.db.nextID(), Kind: kind, Status: JobRunning, Errors: []string{}, CreatedAt: now, UpdatedAt: now}
+		s.db.jobs[latest.ID] = latest
+
+		return copyJob(latest), false, nil
+	case latest.Status == JobRunning && time.Since(latest.UpdatedAt) < lease:
+		return copyJob(latest), false, ErrJobRunning
+	default:
+		latest.Status = JobRunning
+		latest.UpdatedAt = time.Now()
+
+		return copyJob(latest), true, nil
+	}
+}
+
+func (s mockJobStore) Get(id int64) (*Job, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	job, ok := s.db.jobs[id]
+	if !ok {
+		return nil, ErrRecordNotFound
+	}
+
+	return copyJob(job), nil
+}
+
+func (s mockJobStore) Advance(id, cursor int64, processed int) error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	job, ok := s.db.jobs[id]
+	if !ok || job.Status != JobRunning {
+		return ErrJobNotRunning
+	}
+
+	job.Cursor = cursor
+	job.Processed += int64(processed)
+	job.UpdatedAt = time.Now()
+
+	return nil
+}
+
+func (s mockJobStore) Finish(id int64, status, message string) error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	job, ok := s.db.jobs[id]
+	if !ok || job.Status != JobRunning {
+		return ErrJobNotRunning
+	}
+
+	job.Status = status
+	if message != "" {
+		job.Errors = append(job.Errors, message)
+	}
+	job.UpdatedAt = time.Now()
+
+	return nil
+}
+
+func (s mockJobStore) Cancel(id int64) (*Job, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	job, ok := s.db.jobs[id]
+	switch {
+	case !ok:
+		return nil, ErrRecordNotFound
+	case job.Status != JobRunning:
+		return nil, ErrJobNotRunning
+	}
+
+	job.Status = JobCanceled
+	job.UpdatedAt = time.Now()
+
+	return copyJob(job), nil
+}
+
+// Define the mockFailedEmailStore type, which satisfies FailedEmailStore.
+type mockFailedEmailStore struct {
+	db *mockDB
+}
+
+func (s mockFailedEmailStore) Insert(email *FailedEmail) error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	email.ID = s.db.nextID()
+	email.CreatedAt = time.Now()
+
+	e := *email
+	s.db.failedEmails = append(s.db.failedEmails, &e)
+
+	return nil
+}
+
+// Define the mockIdempotencyKeyStore type, which satisfies IdempotencyKeyStore.
+type mockIdempotencyKeyStore struct {
+	db *mockDB
+}
+
+// Claim() records the first use of a key, or takes over an expired one, in the same way
+// as IdempotencyKeyModel.Claim().
+func (s mockIdempotencyKeyStore) Claim(userID int64, key string, fingerprint []byte, ttl time.Duration) (*IdempotencyKey, bool, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	id := mockIdempotencyKeyID{userID, key}
+	now := time.Now()
+
+	existing, ok := s.db.idempotencyKeys[id]
+	if !ok || existing.ExpiresAt.Before(now) {
+		s.db.idempotencyKeys[id] = &IdempotencyKey{
+			UserID:      userID,
+			Key:         key,
+			Fingerprint: append([]byte(nil), fingerprint...),
+			ExpiresAt:   now.Add(ttl),
+		}
+
+		return nil, true, nil
+	}
+
+	c := *existing
+
+	if !bytes.Equal(existing.Fingerprint, fingerprint) {
+		return &c, false, ErrIdempotencyKeyMismatch
+	}
+
+	return &c, false, nil
+}
+
+func (s mockIdempotencyKeyStore) Complete(userID int64, key string, statusCode int, headers http.Header, body []byte) error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	if record, ok := s.db.idempotencyKeys[mockIdempotencyKeyID{userID, key}]; ok {
+		record.StatusCode = statusCode
+		record.ResponseHeaders = headers.Clone()
+		record.ResponseBody = append([]byte(nil), body...)
+	}
+
+	return nil
+}
+
+func (s mockIdempotencyKeyStore) Release(userID int64, key string) error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	delete(s.db.idempotencyKeys, mockIdempotencyKeyID{userID, key})
+
+	return nil
+}
+
+func (s mockIdempotencyKeyStore) DeleteAllExpired() (int64, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	var removed int64
+	now := time.Now()
+
+	for id, record := range s.db.idempotencyKeys {
+		if record.ExpiresAt.Before(now) {
+			delete(s.db.idempotencyKeys, id)
+			removed++
+		}
+	}
+
+	return removed, nil
+}
+
+// Define the mockWebhookStore type, which satisfies WebhookStore. The secrets are
+// kept encrypted, as they are in the database, and decrypted when they're read.
+type mockWebhookStore struct {
+	db *mockDB
+}
+
+func copyWebhook(webhook *Webhook) *Webhook {
+	c := *webhook
+	c.Events = append([]string(nil), webhook.Events...)
+	return &c
+}
+
+// The load() method returns a copy of a stored webhook with its secret decrypted.
+func (s mockWebhookStore) load(stored *Webhook) (*Webhook, error) {
+	webhook := copyWebhook(stored)
+
+	secret, err := decryptColumn(stored.Secret)
+	if err != nil {
+		return nil, fmt.Errorf("webhook %d secret: %w", stored.ID, err)
+	}
+
+	webhook.Secret = secret
+
+	return webhook, nil
+}
+
+// The store() method saves a copy of a webhook with its secret encrypted.
+func (s mockWebhookStore) store(webhook *Webhook) error {
+	stored := copyWebhook(webhook)
+
+	secret, err := encryptColumn(webhook.Secret)
+	if err != nil {
+		return err
+	}
+
+	stored.Secret = secret
+	s.db.webhooks[webhook.ID] = stored
+
+	return nil
+}
+
+func (s mockWebhookStore) Insert(webhook *Webhook) error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	webhook.ID = s.db.nextID()
+	webhook.CreatedAt = time.Now()
+	webhook.Version = 1
+
+	return s.store(webhook)
+}
+
+func (s mockWebhookStore) Get(id int64) (*Webhook, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	webhook, ok := s.db.webhooks[id]
+	if !ok {
+		return nil, ErrRecordNotFound
+	}
+
+	return s.load(webhook)
+}
+
+// The filter() method returns copies of the webhooks for which match returns true,
+// ordered by ID.
+func (s mockWebhookStore) filter(match func(webhook *Webhook) bool) ([]*Webhook, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	webhooks := []*Webhook{}
+
+	for _, stored := range s.db.webhooks {
+		if match(stored) {
+			webhook, err := s.load(stored)
+			if err != nil {
+				return nil, err
+			}
+
+			webhooks = append(webhooks, webhook)
+		}
+	}
+
+	sort.Slice(webhooks, func(i, j int) bool {
+		return webhooks[i].ID < webhooks[j].ID
+	})
+
+	return webhooks, nil
+}
+
+func (s mockWebhookStore) GetAll() ([]*Webhook, error) {
+	return s.filter(func(webhook *Webhook) bool {
+		return true
+	})
+}
+
+func (s mockWebhookStore) GetAllActiveForEvent(event string) ([]*Webhook, error) {
+	return s.filter(func(webhook *Webhook) bool {
+		return webhook.Active && containsAll(webhook.Events, []string{event})
+	})
+}
+
+func (s mockWebhookStore) Update(webhook *Webhook) error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	stored, ok := s.db.webhooks[webhook.ID]
+	if !ok || stored.Version != webhook.Version {
+		return ErrEditConflict
+	}
+
+	webhook.Version++
+
+	return s.store(webhook)
+}
+
+func (s mockWebhookStore) ReencryptSecrets() (int, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	changed := 0
+
+	for id, stored := range s.db.webhooks {
+		if !needsRotation(stored.Secret) {
+			continue
+		}
+
+		plaintext, err := decryptColumn(stored.Secret)
+		if err != nil {
+			return changed, fmt.Errorf("webhook %d secret: %w", id, err)
+		}
+
+		stored.Secret, err = encryptColumn(plaintext)
+		if err != nil {
+			return changed, err
+		}
+
+		changed++
+	}
+
+	return changed, nil
+}
+
+// The storedSecret() method returns a webhook's secret as it's stored, for tests of
+// the encryption.
+func (s mockWebhookStore) storedSecret(id int64) string {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	return s.db.webhooks[id].Secret
+}
+
+// Delete() removes the webhook along with its deliveries.
+func (s mockWebhookStore) Delete(id int64) error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	if _, ok := s.db.webhooks[id]; !ok {
+		return ErrRecordNotFound
+	}
+
+	delete(s.db.webhooks, id)
+
+	var kept []*WebhookDelivery
+	for _, delivery := range s.db.webhookDeliveries {
+		if delivery.WebhookID != id {
+			kept = append(kept, delivery)
+		}
+	}
+
+	s.db.webhookDeliveries = kept
+
+	return nil
+}
+
+// Define the mockWebhookDeliveryStore type, which satisfies WebhookDeliveryStore.
+type mockWebhookDeliveryStore struct {
+	db *mockDB
+}
+
+func (s mockWebhookDeliveryStore) Insert(delivery *WebhookDelivery) error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	delivery.ID = s.db.nextID()
+	delivery.CreatedAt = time.Now()
+
+	d := *delivery
+	s.db.webhookDeliveries = append(s.db.webhookDeliveries, &d)
+
+	return nil
+}
+
+func (s mockWebhookDeliveryStore) GetAllForWebhook(webhookID int64, filters Filters) ([]*WebhookDelivery, Metadata, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	deliveries := []*WebhookDelivery{}
+
+	for _, delivery := range s.db.webhookDeliveries {
+		if delivery.WebhookID == webhookID {
+			d := *delivery
+			deliveries = append(deliveries, &d)
+		}
+	}
+
+	mockSort(deliveries, filters, func(i int, name string) interface{} {
+		switch name {
+		case "created_at":
+			return deliveries[i].CreatedAt
+		default:
+			return deliveries[i].ID
+		}
+	})
+
+	start, end, metadata := mockPage(len(deliveries), filters)
+
+	return deliveries[start:end], metadata, nil
+}
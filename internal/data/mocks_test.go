@@ -0,0 +1,77 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestMockModelsWithTx(t *testing.T) {
+	models := NewMockModels()
+	errRollback := errors.New("rollback")
+
+	err := models.WithTx(context.Background(), func(m Models) error {
+		err := m.Movies.Insert(&Movie{Title: "Rolled back", Year: 2000, Runtime: 90, Genres: []string{"drama"}})
+		if err != nil {
+			return err
+		}
+
+		return errRollback
+	})
+	if !errors.Is(err, errRollback) {
+		t.Fatalf("got error %v; want %v", err, errRollback)
+	}
+
+	movies, _, err := models.Movies.GetAll(MovieFilters{}, Filters{Page: 1, PageSize: 20, Sort: "id", SortSafelist: []string{"id"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(movies) != 0 {
+		t.Errorf("got %d movies after the rollback; want 0", len(movies))
+	}
+
+	err = models.WithTx(context.Background(), func(m Models) error {
+		return m.Movies.Insert(&Movie{Title: "Committed", Year: 2000, Runtime: 90, Genres: []string{"drama"}})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	movies, _, err = models.Movies.GetAll(MovieFilters{}, Filters{Page: 1, PageSize: 20, Sort: "id", SortSafelist: []string{"id"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(movies) != 1 || movies[0].Title != "Committed" {
+		t.Errorf("got movies %v; want just the committed one", movies)
+	}
+}
+
+func TestMockUsersDuplicate(t *testing.T) {
+	models := NewMockModels()
+
+	err := models.Users.Insert(&User{Name: "A", Username: "alice", Email: "alice@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		user *User
+		want error
+	}{
+		{"email", &User{Name: "B", Username: "bob", Email: "ALICE@example.com"}, ErrDuplicateEmail},
+		{"username", &User{Name: "B", Username: "Alice", Email: "bob@example.com"}, ErrDuplicateUsername},
+		{"unique", &User{Name: "B", Username: "bob", Email: "bob@example.com"}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := models.Users.Insert(tt.user)
+			if !errors.Is(err, tt.want) {
+				t.Errorf("got error %v; want %v", err, tt.want)
+			}
+		})
+	}
+}
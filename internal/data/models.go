@@ -1,8 +1,12 @@
 package data
 
 import (
+	"context"
 	"database/sql"
 	"errors"
+	"fmt"
+
+	"github.com/lib/pq"
 )
 
 // Define a custom ErrRecordNotFound error. We'll return this from our Get() method when
@@ -10,23 +14,249 @@ import (
 var (
 	ErrRecordNotFound = errors.New("record not found")
 	ErrEditConflict   = errors.New("edit conflict")
+	ErrInUse          = errors.New("record is in use")
 )
 
+// InUseError is the error returned, wrapping ErrInUse, when a record can't be deleted
+// because a row in another table still refers to it. Table is the name of that table.
+type InUseError struct {
+	Table string
+}
+
+func (e *InUseError) Error() string {
+	return fmt.Sprintf("%s: referenced from table %q", ErrInUse, e.Table)
+}
+
+// Is makes errors.Is(err, ErrInUse) true for an *InUseError.
+func (e *InUseError) Is(target error) bool {
+	return target == ErrInUse
+}
+
+// The inUseError() helper turns a PostgreSQL foreign_key_violation into an
+// *InUseError, and returns any other error unchanged.
+func inUseError(err error) error {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23503" {
+		return &InUseError{Table: pqErr.Table}
+	}
+
+	return err
+}
+
+// Define a Querier interface which is satisfied by both *sql.DB and *sql.Tx. The models
+// run their queries through it, so that the same methods can run on their own or as
+// part of a larger transaction (see Models.WithTx()).
+type Querier interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
 // Create a Models struct which wraps the MovieModel and the UserModel.
+//
+// The models run their read-only queries on the ReadDB pool, which may be a read
+// replica, and everything else on the primary DB pool. The exceptions are the queries
+// used to authenticate and authorize a request, which always read from the primary so
+// that a revoked token or permission can't outlive the replication lag.
+//
+// The fields are interfaces, so that handlers can be tested against the in-memory
+// stores from NewMockModels(). Each model's Dialect adapts its queries to the database
+// driver (see NewModelsForDriver()).
 type Models struct {
-	Movies      MovieModel
-	Permissions PermissionModel
-	Tokens      TokenModel
-	Users       UserModel
+	Audit             AuditStore
+	Digests           DigestStore
+	EmailJobs         EmailJobStore
+	FailedEmails      FailedEmailStore
+	Idempotency       IdempotencyKeyStore
+	Jobs              JobStore
+	Locks             LockStore
+	Logins            LoginStore
+	Movies            MovieStore
+	Permissions       PermissionStore
+	Preferences       PreferencesStore
+	Reports           ReportStore
+	Roles             RoleStore
+	SavedSearches     SavedSearchStore
+	Tokens            TokenStore
+	Usage             UsageStore
+	Users             UserStore
+	Watchlist         WatchlistStore
+	Webhooks          WebhookStore
+	WebhookDeliveries WebhookDeliveryStore
+
+	primary Querier
+	dialect Dialect
+	// The mock field is set for the models returned by NewMockModels().
+	mock *mockDB
 }
 
 // For ease of use, we also add a New() method which returns a Models struct containing
 // the initialized MovieModel and UserModel.
-func NewModels(db *sql.DB) Models {
+//
+// The readDB pool is used for read-only queries. It's nil when there's no read
+// replica, in which case the primary db pool is used for everything.
+func NewModels(db, readDB *sql.DB) Models {
+	if readDB == nil {
+		return newModels(db, db, postgresDialect{})
+	}
+
+	return newModels(db, readDB, postgresDialect{})
+}
+
+// NewModelsForDriver is like NewModels(), for a database opened with the named driver
+// (DriverPostgres or DriverSQLite). See the Dialect type for what works on SQLite.
+func NewModelsForDriver(driverName string, db, readDB *sql.DB) (Models, error) {
+	dialect, err := DialectFor(driverName)
+	if err != nil {
+		return Models{}, err
+	}
+
+	if readDB == nil {
+		return newModels(db, db, dialect), nil
+	}
+
+	return newModels(db, readDB, dialect), nil
+}
+
+// The newModels() function builds the models on any Querier, which is a transaction
+// for the models passed to the WithTx() callback.
+func newModels(db, readDB Querier, dialect Dialect) Models {
 	return Models{
-		Movies:      MovieModel{DB: db},
-		Permissions: PermissionModel{DB: db},
-		Tokens:      TokenModel{DB: db},
-		Users:       UserModel{DB: db},
+		Audit:             AuditModel{DB: db, ReadDB: readDB, Dialect: dialect},
+		Digests:           DigestModel{DB: db, ReadDB: readDB, Dialect: dialect},
+		EmailJobs:         EmailJobModel{DB: db, ReadDB: readDB, Dialect: dialect},
+		FailedEmails:      FailedEmailModel{DB: db, Dialect: dialect},
+		Idempotency:       IdempotencyKeyModel{DB: db, Dialect: dialect},
+		Jobs:              JobModel{DB: db, ReadDB: readDB, Dialect: dialect},
+		Locks:             LockModel{DB: db, Dialect: dialect},
+		Logins:            LoginModel{DB: db, ReadDB: readDB, Dialect: dialect},
+		Movies:            MovieModel{DB: db, ReadDB: readDB, Dialect: dialect},
+		Permissions:       PermissionModel{DB: db, ReadDB: readDB, Dialect: dialect},
+		Preferences:       PreferencesModel{DB: db, ReadDB: readDB, Dialect: dialect},
+		Reports:           ReportModel{DB: db, ReadDB: readDB, Dialect: dialect},
+		Roles:             RoleModel{DB: db, ReadDB: readDB, Dialect: dialect},
+		SavedSearches:     SavedSearchModel{DB: db, ReadDB: readDB, Dialect: dialect},
+		Tokens:            TokenModel{DB: db, Dialect: dialect},
+		Usage:             UsageModel{DB: db, ReadDB: readDB, Dialect: dialect},
+		Users:             UserModel{DB: db, ReadDB: readDB, Dialect: dialect},
+		Watchlist:         WatchlistModel{DB: db, ReadDB: readDB, Dialect: dialect},
+		Webhooks:          WebhookModel{DB: db, ReadDB: readDB, Dialect: dialect},
+		WebhookDeliveries: WebhookDeliveryModel{DB: db, ReadDB: readDB, Dialect: dialect},
+
+		primary: db,
+		dialect: dialect,
 	}
 }
+
+// Primary returns a copy of the models which run every query on the primary pool. It's
+// used to read back data written earlier in the same request, which may not have
+// reached the read replica yet.
+func (m Models) Primary() Models {
+	// The mock models don't have a database, and all of their reads are consistent.
+	if m.mock != nil {
+		return m
+	}
+
+	return newModels(m.primary, m.primary, m.dialect)
+}
+
+// WithTx runs fn in a transaction on the primary database. The models passed to fn
+// run every query, including reads, in the transaction, which is committed if fn
+// returns nil and rolled back otherwise.
+//
+//	err := app.models.WithTx(ctx, func(m data.Models) error {
+//		err := m.Movies.Insert(movie)
+//		if err != nil {
+//			return err
+//		}
+//		return m.EmailJobs.Insert(job)
+//	})
+//
+// Calling WithTx() on the models passed to fn runs the inner callback in a savepoint,
+// so that it can be rolled back without aborting the outer transaction.
+func (m Models) WithTx(ctx context.Context, fn func(m Models) error) error {
+	if m.mock != nil {
+		return m.mock.withTx(m, fn)
+	}
+
+	tx, err := beginTx(ctx, m.primary)
+	if err != nil {
+		return err
+	}
+
+	// Rollback() is a no-op if the transaction has already been committed.
+	defer tx.Rollback()
+
+	err = fn(newModels(tx, tx, m.dialect))
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Define a transaction interface for what beginTx() returns: either a *sql.Tx or a
+// savepoint within one.
+type transaction interface {
+	Querier
+	Commit() error
+	Rollback() error
+}
+
+// The beginTx() function begins a transaction on q. If q is already a transaction, as
+// it is for the models passed to the WithTx() callback, it creates a savepoint instead,
+// so that model methods which use their own transaction still work inside WithTx().
+func beginTx(ctx context.Context, q Querier) (transaction, error) {
+	switch q := q.(type) {
+	case *sql.DB:
+		return q.BeginTx(ctx, nil)
+	case *sql.Tx:
+		return newSavepoint(ctx, q)
+	case *savepoint:
+		return newSavepoint(ctx, q.Tx)
+	default:
+		return nil, fmt.Errorf("can't begin a transaction on %T", q)
+	}
+}
+
+// Define a savepoint type which behaves like a nested transaction. PostgreSQL allows
+// savepoints to reuse a name, and ROLLBACK TO and RELEASE then refer to the most
+// recent one, so they can be nested without generating names.
+type savepoint struct {
+	*sql.Tx
+	ctx  context.Context
+	done bool
+}
+
+func newSavepoint(ctx context.Context, tx *sql.Tx) (*savepoint, error) {
+	_, err := tx.ExecContext(ctx, `SAVEPOINT nested`)
+	if err != nil {
+		return nil, err
+	}
+
+	return &savepoint{Tx: tx, ctx: ctx}, nil
+}
+
+// Commit() releases the savepoint. The changes are only committed along with the
+// enclosing transaction.
+func (s *savepoint) Commit() error {
+	if s.done {
+		return sql.ErrTxDone
+	}
+	s.done = true
+
+	_, err := s.Tx.ExecContext(s.ctx, `RELEASE SAVEPOINT nested`)
+	return err
+}
+
+// Rollback() undoes the changes made since the savepoint. Like sql.Tx, it returns
+// sql.ErrTxDone if the savepoint has already been committed or rolled back.
+func (s *savepoint) Rollback() error {
+	if s.done {
+		return sql.ErrTxDone
+	}
+	s.done = true
+
+	_, err := s.Tx.ExecContext(s.ctx, `ROLLBACK TO SAVEPOINT nested`)
+	return err
+}
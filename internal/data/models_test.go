@@ -0,0 +1,186 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/petrostrak/an-open-movie-database/internal/testdb"
+)
+
+func newTestMovie(title string) *Movie {
+	return &Movie{Title: title, Year: 2000, Runtime: 90, Genres: []string{"drama"}}
+}
+
+func TestModelsWithTx(t *testing.T) {
+	driverName, db := testdb.Open(t)
+
+	models, err := NewModelsForDriver(driverName, db, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	errRollback := errors.New("rollback")
+
+	t.Run("commit", func(t *testing.T) {
+		movie := newTestMovie("Committed")
+
+		err := models.WithTx(ctx, func(m Models) error {
+			return m.Movies.Insert(movie)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = models.Movies.Get(movie.ID)
+		if err != nil {
+			t.Errorf("getting the committed movie: %v", err)
+		}
+	})
+
+	t.Run("rollback", func(t *testing.T) {
+		movie := newTestMovie("Rolled back")
+
+		err := models.WithTx(ctx, func(m Models) error {
+			err := m.Movies.Insert(movie)
+			if err != nil {
+				return err
+			}
+
+			// Reads in the callback see the transaction's own writes.
+			_, err = m.Movies.Get(movie.ID)
+			if err != nil {
+				t.Errorf("getting the movie inside the transaction: %v", err)
+			}
+
+			return errRollback
+		})
+		if !errors.Is(err, errRollback) {
+			t.Fatalf("got error %v; want %v", err, errRollback)
+		}
+
+		_, err = models.Movies.Get(movie.ID)
+		if !errors.Is(err, ErrRecordNotFound) {
+			t.Errorf("got error %v getting the rolled back movie; want ErrRecordNotFound", err)
+		}
+	})
+
+	t.Run("nested rollback", func(t *testing.T) {
+		outer, inner := newTestMovie("Outer"), newTestMovie("Inner")
+
+		err := models.WithTx(ctx, func(m Models) error {
+			err := m.Movies.Insert(outer)
+			if err != nil {
+				return err
+			}
+
+			err = m.WithTx(ctx, func(m Models) error {
+				err := m.Movies.Insert(inner)
+				if err != nil {
+					return err
+				}
+				return errRollback
+			})
+			if !errors.Is(err, errRollback) {
+				t.Errorf("got error %v from the inner callback; want %v", err, errRollback)
+			}
+
+			// The outer transaction is still usable after the savepoint is rolled back.
+			_, err = m.Movies.Get(outer.ID)
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = models.Movies.Get(outer.ID)
+		if err != nil {
+			t.Errorf("getting the outer movie: %v", err)
+		}
+
+		_, err = models.Movies.Get(inner.ID)
+		if !errors.Is(err, ErrRecordNotFound) {
+			t.Errorf("got error %v getting the inner movie; want ErrRecordNotFound", err)
+		}
+	})
+
+	t.Run("method with its own transaction", func(t *testing.T) {
+		user := &User{Name: "Alice", Username: "alice", Email: "alice@example.com"}
+
+		err := user.Password.Set("pa55word1234")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = models.Users.Insert(user)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// SetForUser() runs in a savepoint here, so rolling back the outer transaction
+		// undoes it too.
+		err = models.WithTx(ctx, func(m Models) error {
+			err := m.Roles.SetForUser(user.ID, "editor")
+			if err != nil {
+				return err
+			}
+			return errRollback
+		})
+		if !errors.Is(err, errRollback) {
+			t.Fatalf("got error %v; want %v", err, errRollback)
+		}
+
+		roles, err := models.Roles.GetAllForUser(user.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(roles) != 0 {
+			t.Errorf("got roles %v after the rollback; want none", roles)
+		}
+
+		err = models.WithTx(ctx, func(m Models) error {
+			return m.Roles.SetForUser(user.ID, "editor")
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		roles, err = models.Roles.GetAllForUser(user.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(roles, []string{"editor"}) {
+			t.Errorf("got roles %v; want [editor]", roles)
+		}
+	})
+}
+
+func TestSavepointDone(t *testing.T) {
+	_, db := testdb.Open(t)
+	ctx := context.Background()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	sp, err := beginTx(ctx, tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = sp.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sp.Commit(); !errors.Is(err, sql.ErrTxDone) {
+		t.Errorf("got error %v committing twice; want sql.ErrTxDone", err)
+	}
+	if err := sp.Rollback(); !errors.Is(err, sql.ErrTxDone) {
+		t.Errorf("got error %v rolling back after commit; want sql.ErrTxDone", err)
+	}
+}
@@ -0,0 +1,216 @@
+package data
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/petrostrak/an-open-movie-database/internal/redis"
+)
+
+// Define a RedisMovieCache type which wraps a MovieStore, caching the movies returned by
+// Get() in Redis under the key movie:<id>. Insert() adds the new movie to the cache,
+// and Update() and Delete() remove it, so that the cache is shared by every instance of
+// the API without serving stale movies.
+//
+// A Get() which misses and races with an Update() can still put the old version back
+// in the cache, so entries expire after ttl to bound how long that can last.
+//
+// Redis being unavailable doesn't fail any requests: the error is passed to onError
+// and the call goes through to the store. Writes made through Models.WithTx() bypass
+// the cache, as the transaction may still be rolled back.
+type RedisMovieCache struct {
+	MovieStore
+	client  *redis.Client
+	ttl     time.Duration
+	onError func(error)
+
+	hits   int64
+	misses int64
+	errors int64
+}
+
+// Define a MovieCacheStats struct to hold the counters which we publish via expvar.
+type MovieCacheStats struct {
+	Hits   int64 `json:"hits"`
+	Misses int64 `json:"misses"`
+	Errors int64 `json:"errors"`
+}
+
+// The cachedMovie struct is what's stored in Redis. Unlike the Movie struct's JSON
+// encoding it includes every field.
+type cachedMovie struct {
+	ID        int64     `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	Title     string    `json:"title"`
+	Year      int32     `json:"year"`
+	Runtime   int32     `json:"runtime"`
+	Genres    []string  `json:"genres"`
+	Version   int32     `json:"version"`
+	UpdatedAt time.Time `json:"updated_at"`
+
+	Awards          Awards          `json:"awards"`
+	ExternalRatings ExternalRatings `json:"external_ratings"`
+	Plot            string          `json:"plot"`
+	Poster          string          `json:"poster"`
+	CreatedBy       *UserRef        `json:"created_by"`
+	UpdatedBy       *UserRef        `json:"updated_by"`
+	Views           int64           `json:"views"`
+	Popularity      float64         `json:"popularity"`
+}
+
+// Return a new RedisMovieCache in front of store, whose entries expire after ttl. The
+// onError function is called with any error from Redis.
+func NewRedisMovieCache(store MovieStore, client *redis.Client, ttl time.Duration, onError func(error)) *RedisMovieCache {
+	return &RedisMovieCache{
+		MovieStore: store,
+		client:     client,
+		ttl:        ttl,
+		onError:    onError,
+	}
+}
+
+func movieCacheKey(id int64) string {
+	return "movie:" + strconv.FormatInt(id, 10)
+}
+
+// Insert adds the movie to the store, and then to the cache, as a new movie is usually
+// read back straight away.
+func (c *RedisMovieCache) Insert(movie *Movie) error {
+	err := c.MovieStore.Insert(movie)
+	if err != nil {
+		return err
+	}
+
+	c.set(movie)
+
+	return nil
+}
+
+// Get returns the movie from the cache, or from the store if it isn't cached.
+func (c *RedisMovieCache) Get(id int64) (*Movie, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	value, err := c.client.Get(movieCacheKey(id))
+	switch {
+	case err == nil:
+		var cached cachedMovie
+
+		err = json.Unmarshal([]byte(value), &cached)
+		if err == nil {
+			atomic.AddInt64(&c.hits, 1)
+
+			return &Movie{
+				ID:        cached.ID,
+				CreatedAt: cached.CreatedAt,
+				Title:     cached.Title,
+				Year:      cached.Year,
+				Runtime:   Runtime(cached.Runtime),
+				Genres:    cached.Genres,
+				Version:   cached.Version,
+				UpdatedAt: cached.UpdatedAt,
+
+				Awards:          cached.Awards,
+				ExternalRatings: cached.ExternalRatings,
+				Plot:            cached.Plot,
+				Poster:          cached.Poster,
+				CreatedBy:       cached.CreatedBy,
+				UpdatedBy:       cached.UpdatedBy,
+				Views:           cached.Views,
+				Popularity:      cached.Popularity,
+			}, nil
+		}
+
+		c.error(err)
+	case !errors.Is(err, redis.ErrNil):
+		c.error(err)
+	}
+
+	atomic.AddInt64(&c.misses, 1)
+
+	movie, err := c.MovieStore.Get(id)
+	if err != nil {
+		return nil, err
+	}
+
+	c.set(movie)
+
+	return movie, nil
+}
+
+// Update updates the movie in the store and removes it from the cache. It's removed
+// even if the update fails with an edit conflict, as the cached copy may be the stale
+// one.
+func (c *RedisMovieCache) Update(movie *Movie) error {
+	err := c.MovieStore.Update(movie)
+	c.delete(movie.ID)
+
+	return err
+}
+
+// Delete deletes the movie from the store and removes it from the cache.
+func (c *RedisMovieCache) Delete(id int64) (*MovieDeletion, error) {
+	deletion, err := c.MovieStore.Delete(id)
+	c.delete(id)
+
+	return deletion, err
+}
+
+// Stats returns the hit, miss and error counters.
+func (c *RedisMovieCache) Stats() MovieCacheStats {
+	return MovieCacheStats{
+		Hits:   atomic.LoadInt64(&c.hits),
+		Misses: atomic.LoadInt64(&c.misses),
+		Errors: atomic.LoadInt64(&c.errors),
+	}
+}
+
+func (c *RedisMovieCache) set(movie *Movie) {
+	value, err := json.Marshal(cachedMovie{
+		ID:        movie.ID,
+		CreatedAt: movie.CreatedAt,
+		Title:     movie.Title,
+		Year:      movie.Year,
+		Runtime:   int32(movie.Runtime),
+		Genres:    movie.Genres,
+		Version:   movie.Version,
+		UpdatedAt: movie.UpdatedAt,
+
+		Awards:          movie.Awards,
+		ExternalRatings: movie.ExternalRatings,
+		Plot:            movie.Plot,
+		Poster:          movie.Poster,
+		CreatedBy:       movie.CreatedBy,
+		UpdatedBy:       movie.UpdatedBy,
+		Views:           movie.Views,
+		Popularity:      movie.Popularity,
+	})
+	if err != nil {
+		c.error(err)
+		return
+	}
+
+	err = c.client.Set(movieCacheKey(movie.ID), string(value), c.ttl)
+	if err != nil {
+		c.error(err)
+	}
+}
+
+func (c *RedisMovieCache) delete(id int64) {
+	err := c.client.Del(movieCacheKey(id))
+	if err != nil {
+		c.error(err)
+	}
+}
+
+func (c *RedisMovieCache) error(err error) {
+	atomic.AddInt64(&c.errors, 1)
+
+	if c.onError != nil {
+		c.onError(err)
+	}
+}
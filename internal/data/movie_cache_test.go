@@ -0,0 +1,180 @@
+package data
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/petrostrak/an-open-movie-database/internal/redis"
+	"github.com/petrostrak/an-open-movie-database/internal/redis/redistest"
+)
+
+func newTestMovieCache(t *testing.T, s *redistest.Server) (*RedisMovieCache, MovieStore, *[]error) {
+	t.Helper()
+
+	client := redis.NewClient(s.Addr(), "", 2, 100*time.Millisecond)
+	t.Cleanup(client.Close)
+
+	var (
+		mu   sync.Mutex
+		errs []error
+	)
+
+	store := NewMockModels().Movies
+	cache := NewRedisMovieCache(store, client, time.Minute, func(err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		errs = append(errs, err)
+	})
+
+	return cache, store, &errs
+}
+
+func TestRedisMovieCache(t *testing.T) {
+	s := redistest.NewServer(t, "")
+	cache, store, errs := newTestMovieCache(t, s)
+
+	movie := &Movie{Title: "Moana", Year: 2016, Runtime: 107, Genres: []string{"animation"}}
+
+	err := cache.Insert(movie)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Insert() populates the cache, so the first Get() is a hit.
+	if _, found := s.Get("movie:1"); !found {
+		t.Fatal("got no cache entry after the insert")
+	}
+
+	got, err := cache.Get(movie.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Title != "Moana" || got.Runtime != 107 || got.Version != 1 || len(got.Genres) != 1 {
+		t.Errorf("got movie %+v from the cache; want %+v", got, movie)
+	}
+
+	// An update removes the entry, so the next Get() doesn't return the old version.
+	got.Title = "Moana 2"
+
+	err = cache.Update(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err = cache.Get(movie.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Title != "Moana 2" || got.Version != 2 {
+		t.Errorf("got title %q and version %d after the update; want Moana 2 and 2", got.Title, got.Version)
+	}
+
+	// The miss put the new version in the cache. Update the store directly, behind the
+	// cache's back, to check that the next Get() is served from the cache.
+	direct, err := store.Get(movie.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	direct.Title = "Moana 3"
+
+	err = store.Update(direct)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err = cache.Get(movie.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Title != "Moana 2" {
+		t.Errorf("got title %q; want the cached Moana 2", got.Title)
+	}
+
+	_, err = cache.Delete(movie.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = cache.Get(movie.ID)
+	if !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("got error %v after the delete; want ErrRecordNotFound", err)
+	}
+
+	want := MovieCacheStats{Hits: 2, Misses: 2}
+	if stats := cache.Stats(); stats != want {
+		t.Errorf("got stats %+v; want %+v", stats, want)
+	}
+
+	if len(*errs) != 0 {
+		t.Errorf("got errors %v", *errs)
+	}
+}
+
+// When Redis is unavailable the cache falls through to the store, and reports the
+// errors.
+func TestRedisMovieCacheUnavailable(t *testing.T) {
+	s := redistest.NewServer(t, "")
+	s.Close()
+
+	cache, _, errs := newTestMovieCache(t, s)
+
+	movie := &Movie{Title: "Moana", Year: 2016, Runtime: 107, Genres: []string{"animation"}}
+
+	err := cache.Insert(movie)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := cache.Get(movie.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Title != "Moana" {
+		t.Errorf("got title %q; want Moana", got.Title)
+	}
+
+	got.Title = "Moana 2"
+
+	err = cache.Update(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The insert, the get's lookup and fill, and the update's invalidation all failed.
+	if stats := cache.Stats(); stats.Misses != 1 || stats.Errors != 4 {
+		t.Errorf("got stats %+v; want 1 miss and 4 errors", stats)
+	}
+
+	if len(*errs) != 4 {
+		t.Errorf("got %d errors reported; want 4", len(*errs))
+	}
+}
+
+// A corrupt entry is treated as a miss.
+func TestRedisMovieCacheCorruptEntry(t *testing.T) {
+	s := redistest.NewServer(t, "")
+	cache, _, _ := newTestMovieCache(t, s)
+
+	movie := &Movie{Title: "Moana", Year: 2016, Runtime: 107, Genres: []string{"animation"}}
+
+	err := cache.Insert(movie)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.Set("movie:1", "not json")
+
+	got, err := cache.Get(movie.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Title != "Moana" {
+		t.Errorf("got title %q; want Moana", got.Title)
+	}
+
+	if stats := cache.Stats(); stats.Misses != 1 || stats.Errors != 1 {
+		t.Errorf("got stats %+v; want 1 miss and 1 error", stats)
+	}
+}
@@ -0,0 +1,132 @@
+package data
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// Define a MovieCoalescer type which wraps a MovieStore, so that concurrent calls to
+// Get() for the same movie share one call to the store, such as when a link to a
+// popular movie is shared and hundreds of requests for it arrive at once. Each caller
+// is given its own copy of the movie, so that one request changing it can't change
+// another's.
+//
+// The shared call doesn't belong to any one caller, so a request which goes away while
+// it waits doesn't cut it short for the others. Update() and Delete() stop later calls
+// to Get() joining a call which began before the change, so a client which has changed
+// a movie always reads the change back.
+type MovieCoalescer struct {
+	MovieStore
+
+	mu    sync.Mutex
+	calls map[int64]*movieCall
+
+	fetches   int64
+	coalesced int64
+}
+
+// Define a movieCall struct to hold a call to the store's Get() which is in flight, and
+// its result once it's done.
+type movieCall struct {
+	done  chan struct{}
+	movie *Movie
+	err   error
+}
+
+// Define a MovieCoalescerStats struct to hold the counters which we publish via expvar.
+// Coalesced counts the calls which shared another's, rather than calling the store.
+type MovieCoalescerStats struct {
+	Fetches   int64 `json:"fetches"`
+	Coalesced int64 `json:"coalesced"`
+}
+
+// Return a new MovieCoalescer in front of store.
+func NewMovieCoalescer(store MovieStore) *MovieCoalescer {
+	return &MovieCoalescer{
+		MovieStore: store,
+		calls:      make(map[int64]*movieCall),
+	}
+}
+
+// Get returns the movie from the store, waiting for the result of a call for the same
+// movie which is already in flight if there is one.
+func (c *MovieCoalescer) Get(id int64) (*Movie, error) {
+	c.mu.Lock()
+
+	call, found := c.calls[id]
+	if found {
+		c.mu.Unlock()
+		atomic.AddInt64(&c.coalesced, 1)
+
+		<-call.done
+	} else {
+		call = &movieCall{done: make(chan struct{})}
+		c.calls[id] = call
+		c.mu.Unlock()
+		atomic.AddInt64(&c.fetches, 1)
+
+		c.fetch(id, call)
+	}
+
+	if call.err != nil {
+		return nil, call.err
+	}
+
+	return copyMovie(call.movie), nil
+}
+
+// The fetch() method makes the call to the store, and hands its result to the callers
+// waiting for it. If the store panics, the waiters are given an error, and the panic
+// carries on up the caller's stack.
+func (c *MovieCoalescer) fetch(id int64, call *movieCall) {
+	defer func() {
+		if err := recover(); err != nil {
+			call.err = fmt.Errorf("movie %d: store panicked: %v", id, err)
+			defer panic(err)
+		}
+
+		close(call.done)
+		c.forget(id, call)
+	}()
+
+	call.movie, call.err = c.MovieStore.Get(id)
+}
+
+// Update updates the movie in the store, and then stops later reads joining a call
+// which may have read the old version.
+func (c *MovieCoalescer) Update(movie *Movie) error {
+	err := c.MovieStore.Update(movie)
+	c.forget(movie.ID, nil)
+
+	return err
+}
+
+// Delete deletes the movie from the store, and then stops later reads joining a call
+// which may have found it.
+func (c *MovieCoalescer) Delete(id int64) (*MovieDeletion, error) {
+	deletion, err := c.MovieStore.Delete(id)
+	c.forget(id, nil)
+
+	return deletion, err
+}
+
+// Stats returns the number of calls made to the store, and of those which shared one.
+func (c *MovieCoalescer) Stats() MovieCoalescerStats {
+	return MovieCoalescerStats{
+		Fetches:   atomic.LoadInt64(&c.fetches),
+		Coalesced: atomic.LoadInt64(&c.coalesced),
+	}
+}
+
+// The forget() method removes the call in flight for a movie, so that the next call to
+// Get() calls the store again. If call isn't nil, it's only removed if it's still the
+// one in flight, as it may already have been replaced by a newer one.
+func (c *MovieCoalescer) forget(id int64, call *movieCall) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if call == nil || c.calls[id] == call {
+		delete(c.calls, id)
+	}
+}
@@ -0,0 +1,122 @@
+package data
+
+import (
+	"errors"
+	"runtime"
+	"sync"
+	"testing"
+)
+
+// Define a gatedMovieStore type which wraps a MovieStore, holding calls to Get() until
+// release is closed.
+type gatedMovieStore struct {
+	MovieStore
+	release chan struct{}
+}
+
+func (s gatedMovieStore) Get(id int64) (*Movie, error) {
+	<-s.release
+	return s.MovieStore.Get(id)
+}
+
+// The callers sharing a call are each given their own copy of the movie, and a missing
+// movie is an error for all of them.
+func TestMovieCoalescer(t *testing.T) {
+	store := NewMockModels().Movies
+	movie := insertTestMovies(t, store, 1)[0]
+
+	gated := gatedMovieStore{MovieStore: store, release: make(chan struct{})}
+	coalescer := NewMovieCoalescer(gated)
+
+	for round, id := range []int64{movie.ID, movie.ID + 1} {
+		results := make([]*Movie, 3)
+		errs := make([]error, 3)
+
+		var wg sync.WaitGroup
+		for i := range results {
+			wg.Add(1)
+
+			go func(i int) {
+				defer wg.Done()
+				results[i], errs[i] = coalescer.Get(id)
+			}(i)
+		}
+
+		// Wait for the second and third calls to join the first.
+		for coalescer.Stats().Coalesced != int64(2*(round+1)) {
+			runtime.Gosched()
+		}
+
+		gated.release <- struct{}{}
+		wg.Wait()
+
+		for i := range results {
+			if id != movie.ID {
+				if !errors.Is(errs[i], ErrRecordNotFound) {
+					t.Errorf("got error %v for a missing movie; want ErrRecordNotFound", errs[i])
+				}
+				continue
+			}
+
+			if errs[i] != nil || results[i].Title != movie.Title {
+				t.Fatalf("got movie %v and error %v; want %q", results[i], errs[i], movie.Title)
+			}
+		}
+
+		if id == movie.ID {
+			results[0].Genres[0] = "changed"
+
+			if results[1].Genres[0] != "drama" || results[2].Genres[0] != "drama" {
+				t.Errorf("got genres %v and %v after changing another caller's copy; want them unchanged", results[1].Genres, results[2].Genres)
+			}
+		}
+	}
+
+	if stats := coalescer.Stats(); stats != (MovieCoalescerStats{Fetches: 2, Coalesced: 4}) {
+		t.Errorf("got stats %+v; want 2 fetches and 4 coalesced", stats)
+	}
+}
+
+// A read which starts after an update doesn't join a call which began before it.
+func TestMovieCoalescerUpdate(t *testing.T) {
+	store := NewMockModels().Movies
+	movie := insertTestMovies(t, store, 1)[0]
+
+	gated := gatedMovieStore{MovieStore: store, release: make(chan struct{})}
+	coalescer := NewMovieCoalescer(gated)
+
+	stale := make(chan *Movie)
+	go func() {
+		movie, _ := coalescer.Get(movie.ID)
+		stale <- movie
+	}()
+
+	// Wait for the first read to be in flight.
+	for coalescer.Stats().Fetches == 0 {
+		runtime.Gosched()
+	}
+
+	movie.Title = "Changed"
+
+	err := coalescer.Update(movie)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fresh := make(chan *Movie)
+	go func() {
+		movie, _ := coalescer.Get(movie.ID)
+		fresh <- movie
+	}()
+
+	close(gated.release)
+	<-stale
+
+	if got := <-fresh; got == nil || got.Title != "Changed" {
+		t.Errorf("got %v after the update; want the new title", got)
+	}
+
+	if stats := coalescer.Stats(); stats.Fetches != 2 || stats.Coalesced != 0 {
+		t.Errorf("got stats %+v; want 2 fetches", stats)
+	}
+}
@@ -0,0 +1,220 @@
+package data
+
+import (
+	"container/list"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Define a MovieLRUCache type which wraps a MovieStore, caching the movies returned by
+// Get() in memory. It's a fixed-capacity LRU cache: once it's full, adding a new entry
+// evicts the least recently used one.
+//
+// Update() and Delete() only remove the movie from this instance's cache, so other
+// instances of the API may still have the old version. To catch that, an entry which
+// hasn't been checked for longer than staleness has its version compared with the
+// database's before it's used, which is much cheaper than reading the whole movie.
+// Entries are dropped altogether after ttl.
+type MovieLRUCache struct {
+	MovieStore
+	capacity  int
+	ttl       time.Duration
+	staleness time.Duration
+
+	mu      sync.Mutex
+	order   *list.List
+	entries map[int64]*list.Element
+
+	hits      int64
+	misses    int64
+	evictions int64
+}
+
+type movieLRUEntry struct {
+	movie      Movie
+	expiry     time.Time
+	verifiedAt time.Time
+}
+
+// Define a MovieLRUCacheStats struct to hold the counters which we publish via expvar.
+type MovieLRUCacheStats struct {
+	Size      int   `json:"size"`
+	Hits      int64 `json:"hits"`
+	Misses    int64 `json:"misses"`
+	Evictions int64 `json:"evictions"`
+}
+
+// Return a new MovieLRUCache in front of store, holding at most capacity movies.
+func NewMovieLRUCache(store MovieStore, capacity int, ttl, staleness time.Duration) *MovieLRUCache {
+	return &MovieLRUCache{
+		MovieStore: store,
+		capacity:   capacity,
+		ttl:        ttl,
+		staleness:  staleness,
+		order:      list.New(),
+		entries:    make(map[int64]*list.Element),
+	}
+}
+
+// Insert adds the movie to the store, and then to the cache.
+func (c *MovieLRUCache) Insert(movie *Movie) error {
+	err := c.MovieStore.Insert(movie)
+	if err != nil {
+		return err
+	}
+
+	c.set(movie)
+
+	return nil
+}
+
+// Get returns the movie from the cache, or from the store if it isn't cached or the
+// cached version is out of date.
+func (c *MovieLRUCache) Get(id int64) (*Movie, error) {
+	movie, stale, found := c.get(id)
+
+	if found && stale {
+		version, err := c.MovieStore.GetVersion(id)
+		switch {
+		case errors.Is(err, ErrRecordNotFound):
+			c.delete(id)
+			return nil, ErrRecordNotFound
+		case err != nil:
+			return nil, err
+		case version == movie.Version:
+			c.touch(id, version)
+		default:
+			c.delete(id)
+			found = false
+		}
+	}
+
+	if found {
+		atomic.AddInt64(&c.hits, 1)
+		return movie, nil
+	}
+
+	atomic.AddInt64(&c.misses, 1)
+
+	movie, err := c.MovieStore.Get(id)
+	if err != nil {
+		return nil, err
+	}
+
+	c.set(movie)
+
+	return movie, nil
+}
+
+// Update updates the movie in the store and removes it from the cache. It's removed
+// even if the update fails with an edit conflict, as the cached copy may be the stale
+// one.
+func (c *MovieLRUCache) Update(movie *Movie) error {
+	err := c.MovieStore.Update(movie)
+	c.delete(movie.ID)
+
+	return err
+}
+
+// Delete deletes the movie from the store and removes it from the cache.
+func (c *MovieLRUCache) Delete(id int64) (*MovieDeletion, error) {
+	deletion, err := c.MovieStore.Delete(id)
+	c.delete(id)
+
+	return deletion, err
+}
+
+// Stats returns the current size of the cache and its counters. Evictions counts the
+// entries removed to make room for new ones.
+func (c *MovieLRUCache) Stats() MovieLRUCacheStats {
+	c.mu.Lock()
+	size := c.order.Len()
+	c.mu.Unlock()
+
+	return MovieLRUCacheStats{
+		Size:      size,
+		Hits:      atomic.LoadInt64(&c.hits),
+		Misses:    atomic.LoadInt64(&c.misses),
+		Evictions: atomic.LoadInt64(&c.evictions),
+	}
+}
+
+// The get() method returns a copy of the cached movie. The stale return value is true
+// if its version is due to be checked.
+func (c *MovieLRUCache) get(id int64) (movie *Movie, stale bool, found bool) {
+	now := time.Now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, found := c.entries[id]
+	if !found {
+		return nil, false, false
+	}
+
+	entry := element.Value.(*movieLRUEntry)
+
+	if now.After(entry.expiry) {
+		c.remove(element)
+		return nil, false, false
+	}
+
+	c.order.MoveToFront(element)
+
+	return copyMovie(&entry.movie), now.Sub(entry.verifiedAt) > c.staleness, true
+}
+
+// The set() method adds or replaces the cached copy of a movie.
+func (c *MovieLRUCache) set(movie *Movie) {
+	now := time.Now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, found := c.entries[movie.ID]; found {
+		c.remove(element)
+	}
+
+	c.entries[movie.ID] = c.order.PushFront(&movieLRUEntry{
+		movie:      *copyMovie(movie),
+		expiry:     now.Add(c.ttl),
+		verifiedAt: now,
+	})
+
+	for c.order.Len() > c.capacity {
+		c.remove(c.order.Back())
+		atomic.AddInt64(&c.evictions, 1)
+	}
+}
+
+// The touch() method marks a cached movie as just verified, unless it has been
+// replaced by another version in the meantime.
+func (c *MovieLRUCache) touch(id int64, version int32) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, found := c.entries[id]; found {
+		entry := element.Value.(*movieLRUEntry)
+		if entry.movie.Version == version {
+			entry.verifiedAt = time.Now()
+		}
+	}
+}
+
+func (c *MovieLRUCache) delete(id int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, found := c.entries[id]; found {
+		c.remove(element)
+	}
+}
+
+// The remove() helper removes an element from both the list and the map. The mutex
+// must be held by the caller.
+func (c *MovieLRUCache) remove(element *list.Element) {
+	c.order.Remove(element)
+	delete(c.entries, element.Value.(*movieLRUEntry).movie.ID)
+}
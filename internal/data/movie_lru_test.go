@@ -0,0 +1,199 @@
+package data
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func insertTestMovies(t *testing.T, store MovieStore, n int) []*Movie {
+	t.Helper()
+
+	movies := make([]*Movie, n)
+	for i := range movies {
+		movies[i] = &Movie{Title: "Movie", Year: 2000, Runtime: 90, Genres: []string{"drama"}}
+
+		err := store.Insert(movies[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return movies
+}
+
+func TestMovieLRUCache(t *testing.T) {
+	store := NewMockModels().Movies
+	cache := NewMovieLRUCache(store, 2, time.Minute, time.Hour)
+
+	movies := insertTestMovies(t, store, 3)
+
+	for _, id := range []int64{movies[0].ID, movies[0].ID, movies[1].ID, movies[2].ID, movies[1].ID} {
+		_, err := cache.Get(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The third movie evicted the first, which was the least recently used.
+	want := MovieLRUCacheStats{Size: 2, Hits: 2, Misses: 3, Evictions: 1}
+	if stats := cache.Stats(); stats != want {
+		t.Errorf("got stats %+v; want %+v", stats, want)
+	}
+
+	// Changing the returned movie doesn't change the cached copy.
+	movie, err := cache.Get(movies[1].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	movie.Genres[0] = "changed"
+
+	movie, err = cache.Get(movies[1].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if movie.Genres[0] != "drama" {
+		t.Errorf("got genre %q from the cache; want drama", movie.Genres[0])
+	}
+
+	// An update through the cache removes the cached copy.
+	movie.Title = "Updated"
+
+	err = cache.Update(movie)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	movie, err = cache.Get(movies[1].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if movie.Title != "Updated" || movie.Version != 2 {
+		t.Errorf("got title %q and version %d after the update; want Updated and 2", movie.Title, movie.Version)
+	}
+
+	_, err = cache.Delete(movies[1].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = cache.Get(movies[1].ID)
+	if !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("got error %v after the delete; want ErrRecordNotFound", err)
+	}
+}
+
+// Writes made by another instance of the API go straight to the store. They're only
+// noticed once an entry is older than the staleness window.
+func TestMovieLRUCacheRevalidation(t *testing.T) {
+	tests := []struct {
+		name      string
+		staleness time.Duration
+		wantTitle string
+	}{
+		{"fresh", time.Hour, "Movie"},
+		{"stale", 0, "Elsewhere"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := NewMockModels().Movies
+			cache := NewMovieLRUCache(store, 10, time.Hour, tt.staleness)
+
+			movie := insertTestMovies(t, store, 1)[0]
+
+			_, err := cache.Get(movie.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			movie.Title = "Elsewhere"
+
+			err = store.Update(movie)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := cache.Get(movie.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Title != tt.wantTitle {
+				t.Errorf("got title %q; want %q", got.Title, tt.wantTitle)
+			}
+
+			_, err = store.Delete(movie.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = cache.Get(movie.ID)
+			if tt.staleness == 0 && !errors.Is(err, ErrRecordNotFound) {
+				t.Errorf("got error %v after another instance deleted the movie; want ErrRecordNotFound", err)
+			}
+		})
+	}
+}
+
+func TestMovieLRUCacheExpiry(t *testing.T) {
+	store := NewMockModels().Movies
+	cache := NewMovieLRUCache(store, 10, time.Millisecond, time.Hour)
+
+	movie := insertTestMovies(t, store, 1)[0]
+
+	_, err := cache.Get(movie.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(5 * time.Millisecond)
+
+	_, err = cache.Get(movie.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stats := cache.Stats(); stats.Misses != 2 {
+		t.Errorf("got %d misses; want 2, as the entry had expired", stats.Misses)
+	}
+}
+
+func TestMovieLRUCacheConcurrent(t *testing.T) {
+	store := NewMockModels().Movies
+	cache := NewMovieLRUCache(store, 4, time.Minute, time.Millisecond)
+
+	movies := insertTestMovies(t, store, 8)
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+
+			for j := 0; j < 100; j++ {
+				movie, err := cache.Get(movies[(i+j)%len(movies)].ID)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+
+				if j%10 == 0 {
+					err = cache.Update(movie)
+					if err != nil && !errors.Is(err, ErrEditConflict) {
+						t.Error(err)
+						return
+					}
+				}
+			}
+		}(i)
+	}
+
+	wg.Wait()
+
+	if stats := cache.Stats(); stats.Size > 4 {
+		t.Errorf("got %d entries; want at most 4", stats.Size)
+	}
+}
@@ -0,0 +1,111 @@
+package data
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+)
+
+// The columns of the movies table which every method returning whole movies selects,
+// in the order that movieRow.dest() scans them. Adding a column to the movies means
+// adding it here, to movieRow and dest(), and to toMovie().
+var movieColumnNames = []string{
+	"id", "created_at", "title", "year", "runtime", "genres", "version", "updated_at",
+	"awards", "external_ratings", "plot", "poster", "views", "popularity",
+}
+
+// The columns of the users who created and last updated a movie, which come from the
+// movieUserJoins, in the order that movieRow.userDest() scans them.
+const (
+	movieUserColumns = `creator.id, creator.name, updater.id, updater.name`
+	movieUserJoins   = `
+		LEFT JOIN users AS creator ON creator.id = movies.created_by
+		LEFT JOIN users AS updater ON updater.id = movies.updated_by`
+)
+
+// The movieColumns() function returns the movie columns for a SELECT, qualified with
+// the given table name or alias.
+func movieColumns(table string) string {
+	columns := make([]string, len(movieColumnNames))
+	for i, name := range movieColumnNames {
+		columns[i] = table + "." + name
+	}
+
+	return strings.Join(columns, ", ")
+}
+
+// Define a movieRow struct to hold a movie as it's scanned from the database, before
+// it's converted to a Movie by toMovie(). The optional columns are scanned into
+// sql.Null* types, so that a NULL, such as in a column which has been added but not yet
+// backfilled, reads as the zero value rather than failing the scan. The genres, awards
+// and external ratings need no such type, as their Scan() methods read NULL as empty.
+// The users who created and last updated the movie are NULL when they aren't known, or
+// weren't selected.
+type movieRow struct {
+	id              int64
+	createdAt       time.Time
+	title           string
+	year            int32
+	runtime         Runtime
+	genres          []string
+	version         int32
+	updatedAt       time.Time
+	awards          Awards
+	externalRatings ExternalRatings
+	plot            sql.NullString
+	poster          sql.NullString
+	views           sql.NullInt64
+	popularity      sql.NullFloat64
+
+	creatorID, updaterID     sql.NullInt64
+	creatorName, updaterName sql.NullString
+}
+
+// The dest() method returns the scan destinations for the columns from movieColumns(),
+// followed by any others given, such as those from userDest().
+func (r *movieRow) dest(d Dialect, others ...interface{}) []interface{} {
+	return append([]interface{}{
+		&r.id,
+		&r.createdAt,
+		&r.title,
+		&r.year,
+		&r.runtime,
+		d.ScanArray(&r.genres),
+		&r.version,
+		&r.updatedAt,
+		&r.awards,
+		&r.externalRatings,
+		&r.plot,
+		&r.poster,
+		&r.views,
+		&r.popularity,
+	}, others...)
+}
+
+// The userDest() method returns the scan destinations for movieUserColumns.
+func (r *movieRow) userDest() []interface{} {
+	return []interface{}{&r.creatorID, &r.creatorName, &r.updaterID, &r.updaterName}
+}
+
+// The toMovie() method returns the movie which was scanned, with the zero value in
+// place of each NULL.
+func (r *movieRow) toMovie() *Movie {
+	return &Movie{
+		ID:              r.id,
+		CreatedAt:       r.createdAt,
+		Title:           r.title,
+		Year:            r.year,
+		Runtime:         r.runtime,
+		Genres:          r.genres,
+		Version:         r.version,
+		UpdatedAt:       r.updatedAt,
+		Awards:          r.awards,
+		ExternalRatings: r.externalRatings,
+		Plot:            r.plot.String,
+		Poster:          r.poster.String,
+		Views:           r.views.Int64,
+		Popularity:      r.popularity.Float64,
+		CreatedBy:       scanUserRef(r.creatorID, r.creatorName),
+		UpdatedBy:       scanUserRef(r.updaterID, r.updaterName),
+	}
+}
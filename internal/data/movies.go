@@ -3,58 +3,129 @@ package data
 import (
 	"context"
 	"database/sql"
+	"encoding/xml"
 	"errors"
 	"fmt"
+	"strings"
 	"time"
 
-	"github.com/lib/pq"
 	"github.com/petrostrak/an-open-movie-database/internal/validator"
 )
 
+// The values which movie listings can be sorted by. A leading "-" means descending.
+var MovieSortSafelist = []string{"id", "title", "year", "runtime", "popularity", "-id", "-title", "-year", "-runtime", "-popularity"}
+
 type Movie struct {
-	ID        int64     `json:"id"`                // Unique integer ID for the movie
-	CreatedAt time.Time `json:"-"`                 // Timestamp for when the movie is added to our  DB
-	Title     string    `json:"title"`             // Movie title
-	Year      int32     `json:"year,omitempty"`    // Movie release year
-	Runtime   Runtime   `json:"runtime,omitempty"` // Movie runtime(in minutes)
-	Genres    []string  `json:"genres,omitempty"`  // Slice of genres for the movie (romance, comedy etc.)
-	Version   int32     `json:"version"`           // The version number starts at 1 and will be incremented each time the movie info is updated
+	XMLName         xml.Name        `json:"-" xml:"movie"`
+	ID              int64           `json:"id" xml:"id"`                                              // Unique integer ID for the movie
+	CreatedAt       time.Time       `json:"-" xml:"-"`                                                // Timestamp for when the movie is added to our  DB
+	Title           string          `json:"title" xml:"title"`                                        // Movie title
+	Year            int32           `json:"year,omitempty" xml:"year,omitempty"`                      // Movie release year
+	Runtime         Runtime         `json:"runtime,omitempty" xml:"runtime,omitempty"`                // Movie runtime(in minutes)
+	Genres          []string        `json:"genres,omitempty" xml:"genres>genre"`                      // Slice of genres for the movie (romance, comedy etc.)
+	Version         int32           `json:"version" xml:"version"`                                    // The version number starts at 1 and will be incremented each time the movie info is updated
+	UpdatedAt       time.Time       `json:"updated_at" xml:"updated_at"`                              // Timestamp for when the movie was last updated, used for Last-Modified
+	Awards          Awards          `json:"awards,omitempty" xml:"awards>award"`                      // Awards the movie won or was nominated for
+	ExternalRatings ExternalRatings `json:"external_ratings,omitempty" xml:"external_ratings>rating"` // Scores on other sites, such as IMDb
+	Plot            string          `json:"plot,omitempty" xml:"plot,omitempty"`                      // A short summary of the movie
+	Poster          string          `json:"poster,omitempty" xml:"poster,omitempty"`                  // The URL of an image of the movie's poster
+	CreatedBy       *UserRef        `json:"created_by" xml:"created_by,omitempty"`                    // The user who added the movie, or nil for movies added before this was recorded
+	UpdatedBy       *UserRef        `json:"updated_by" xml:"updated_by,omitempty"`                    // The user who last updated the movie, or nil if it hasn't been
+	Views           int64           `json:"-" xml:"-"`                                                // How many times the movie has been viewed, as of the last popularity refresh
+	Popularity      float64         `json:"-" xml:"-"`                                                // The popularity score, which the listing is sorted by by default
+	Score           *float64        `json:"popularity,omitempty" xml:"popularity,omitempty"`          // The popularity score, set only for a client debugging the order of the listing
+}
+
+// Define a UserRef struct to hold the ID and name of the user who created or last
+// updated a record. It's nil when the user isn't known, either because the record was
+// made before we recorded who by, or because the user's account has been deleted.
+type UserRef struct {
+	ID   int64  `json:"id" xml:"id"`
+	Name string `json:"name" xml:"name"`
+}
+
+// The scanUserRef() helper returns the UserRef for the nullable ID and name columns of
+// a LEFT JOIN on the users table.
+func scanUserRef(id sql.NullInt64, name sql.NullString) *UserRef {
+	if !id.Valid {
+		return nil
+	}
+
+	return &UserRef{ID: id.Int64, Name: name.String}
+}
+
+// The userRefID() helper returns the ID to store for a UserRef, which is NULL if
+// there's no user.
+func userRefID(user *UserRef) interface{} {
+	if user == nil {
+		return nil
+	}
+
+	return user.ID
+}
+
+// Define a MovieFilters struct to hold the optional filters for listing movies. The
+// movies must match the title and have every genre. HasAwards is nil when the listing
+// isn't filtered on whether a movie has any awards, and CreatedBy is 0 when it isn't
+// filtered on who added them.
+type MovieFilters struct {
+	Title     string
+	Genres    []string
+	HasAwards *bool
+	CreatedBy int64
 }
 
 func ValidateMovie(v *validator.Validator, movie *Movie) {
 	// Use the Check() method to execute our validation checks. This will add the
 	// provided key and error message to the errors map if the check does not evaluate
 	// to true.
-	v.Check(movie.Title != "", "title", "must be provided")
-	v.Check(len(movie.Title) <= 500, "title", "must not be more that 500 bytes long")
-	v.Check(movie.Year != 0, "year", "must be provided")
-	v.Check(movie.Year >= 1888, "year", "must be greater than 1888")
-	v.Check(movie.Year <= int32(time.Now().Year()), "year", "must not be in the future")
-	v.Check(movie.Runtime != 0, "runtime", "must be provided")
-	v.Check(movie.Runtime > 0, "runtime", "must be a positive integer")
-	v.Check(movie.Genres != nil, "genres", "must be provided")
-	v.Check(len(movie.Genres) >= 1, "genres", "must contain at least 1 genre")
-	v.Check(len(movie.Genres) <= 5, "genres", "must bot contain more that 5 genres")
-	// Note that we're using the Unique helper below to check that all values in the
-	// input.Genres slice are unique.
-	v.Check(validator.Unique(movie.Genres), "genres", "must not contain duplicate values")
-
+	v.Check(movie.Title != "", "title", validator.Msg("required"))
+	v.Check(validator.MaxBytes(movie.Title, 500), "title", validator.Msg("max_bytes", "n", 500))
+	v.Check(movie.Year != 0, "year", validator.Msg("required"))
+	v.Check(movie.Year >= 1888, "year", validator.Msg("greater_than", "n", 1888))
+	v.Check(movie.Year <= int32(time.Now().Year()), "year", validator.Msg("not_in_future"))
+	v.Check(movie.Runtime != 0, "runtime", validator.Msg("required"))
+	v.Check(movie.Runtime > 0, "runtime", validator.Msg("positive_integer"))
+	v.Check(movie.Genres != nil, "genres", validator.Msg("required"))
+	v.Check(len(movie.Genres) >= 1, "genres", validator.Msg("genres_min"))
+	v.Check(len(movie.Genres) <= 5, "genres", validator.Msg("genres_max", "n", 5))
+	// Each genre is checked by a child validator, so that its errors are reported
+	// against its index, as in "genres[2]".
+	validator.ValidateEach(v, "genres", movie.Genres, func(v *validator.Validator, genre string) {
+		v.Check(strings.TrimSpace(genre) != "", "", validator.Msg("empty"))
+	})
+	// Note that we're using the UniqueFold helper below to check that all values in the
+	// input.Genres slice are unique, so "Drama" and "drama" aren't both accepted.
+	v.Check(validator.UniqueFold(movie.Genres), "genres", validator.Msg("duplicate_values"))
+
+	// The plot and poster are optional.
+	v.Check(validator.MaxBytes(movie.Plot, 2000), "plot", validator.Msg("max_bytes", "n", 2000))
+	v.Check(movie.Poster == "" || validator.IsURL(movie.Poster, "http", "https"), "poster", validator.Msg("http_url"))
+	v.Check(validator.MaxBytes(movie.Poster, 2000), "poster", validator.Msg("max_bytes", "n", 2000))
+
+	validateAwards(v, movie)
+	validateExternalRatings(v, movie)
 }
 
 // Define a MovieModel struct type which wraps a sql.DB connection poll.
+//
+// The Dialect field holds the differences between the PostgreSQL and SQLite versions
+// of the queries.
 type MovieModel struct {
-	DB *sql.DB
+	DB      Querier
+	ReadDB  Querier
+	Dialect Dialect
 }
 
 // The Insert() acceptsa pointer to a movie struct, which should contain the
-// data for the new record.
+// data for the new record. The movie's CreatedBy is the user adding it, if any.
 func (m MovieModel) Insert(movie *Movie) error {
 	// Define the SQL query for inserting a new record in the movies table and returning
 	// the system-generated data.
 	query := `
-			INSERT INTO movies (title, year, runtime, genres)
-			VALUES ($1, $2, $3, $4)
-			RETURNING id, created_at, version`
+			INSERT INTO movies (title, year, runtime, genres, awards, external_ratings, plot, poster, created_by)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+			RETURNING id, created_at, version, updated_at`
 
 	// Create an args slice containing the values for the placeholder parameters from
 	// the movie struct. Declaring this slice immediately next to our SQL query
@@ -62,8 +133,11 @@ func (m MovieModel) Insert(movie *Movie) error {
 	// query.
 	//
 	// In order to store a []string slice in postgres we need to pass it through the
-	// pq.Array() adapter function before executing the SQL query.
-	args := []interface{}{movie.Title, movie.Year, movie.Runtime, pq.Array(movie.Genres)}
+	// pq.Array() adapter function before executing the SQL query. The dialect's
+	// Array() method does this, or stores it as JSON for SQLite.
+	//
+	// The awards and external ratings are stored as JSON by their Value() methods.
+	args := []interface{}{movie.Title, movie.Year, movie.Runtime, m.Dialect.Array(movie.Genres), movie.Awards, movie.ExternalRatings, movie.Plot, movie.Poster, userRefID(movie.CreatedBy)}
 
 	// Create a context with a 3 second timeout
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
@@ -71,14 +145,16 @@ func (m MovieModel) Insert(movie *Movie) error {
 
 	// Use the QueryRow to execute the SQL query on our connection pool
 	// passing in the args slice as a variadic parameter and scanning the
-	// system-generated id, created_at and version values into the movie
-	// struct.
+	// system-generated id, created_at, version and updated_at values into the movie
+	// struct. Both timestamps default to the time of the transaction, so a new movie's
+	// updated_at is the same as its created_at.
 	//
 	// Use QueryRowContext() and pass the context as the first argument.
-	return m.DB.QueryRowContext(ctx, query, args...).Scan(
+	return m.DB.QueryRowContext(ctx, m.Dialect.Rebind(query), args...).Scan(
 		&movie.ID,
 		&movie.CreatedAt,
 		&movie.Version,
+		&movie.UpdatedAt,
 	)
 }
 
@@ -92,14 +168,17 @@ func (m MovieModel) Get(id int64) (*Movie, error) {
 		return nil, ErrRecordNotFound
 	}
 
-	// Define the SQL query for retrieving the movie data.
+	// Define the SQL query for retrieving the movie data, along with the names of the
+	// users who created and last updated it. Those are LEFT JOINs, as either may be
+	// unknown.
 	stmt := `
-			SELECT id, created_at, title, year, runtime, genres, version
-			FROM movies
-			WHERE id = $1`
+			SELECT ` + movieColumns("movies") + `, ` + movieUserColumns + `
+			FROM movies` + movieUserJoins + `
+			WHERE movies.id = $1`
 
-	// Declare a Movie struct to hold the data returned by the query
-	var movie Movie
+	// Declare a movieRow struct to hold the data returned by the query, including the
+	// nullable columns of the users who created and last updated it.
+	var row movieRow
 
 	// Use the context.WithTimeout() to create a context.Context which carries a
 	// 3 second timeout deadline. Note that we are using the empty context.Background()
@@ -112,22 +191,24 @@ func (m MovieModel) Get(id int64) (*Movie, error) {
 
 	// Execute the query using the QueryRow() method, passing in the provided id value
 	// as a placeholder parameter, and scan the response data into the fields of the
-	// Movie struct.
-	//
-	// We need to convert the scan target for the genres column using the pq.Array()
-	// adaplter function.
+	// movieRow struct. Its dest() method converts the scan target for the genres column
+	// using the pq.Array() adapter function, which the dialect's ScanArray() method
+	// wraps.
 	//
 	// Use the QueryRowContext to execute the query, passing in the context
 	// with the deadline as the first argument.
-	err := m.DB.QueryRowContext(ctx, stmt, id).Scan(
-		&movie.ID,
-		&movie.CreatedAt,
-		&movie.Title,
-		&movie.Year,
-		&movie.Runtime,
-		pq.Array(&movie.Genres),
-		&movie.Version,
-	)
+	scan := func(db Querier) error {
+		return db.QueryRowContext(ctx, m.Dialect.Rebind(stmt), id).Scan(row.dest(m.Dialect, row.userDest()...)...)
+	}
+
+	err := scan(m.ReadDB)
+
+	// A movie created moments ago may not have reached the read replica yet, such as
+	// when a client follows the Location header from createMovieHandler(), so look on
+	// the primary before reporting that it doesn't exist.
+	if errors.Is(err, sql.ErrNoRows) && m.ReadDB != m.DB {
+		err = scan(m.DB)
+	}
 
 	// Handle any errors. If there was no matching movie found, Scan() will return
 	// a sql.ErrNoRows error. We check for this and return our custom ErrRecordNotFound
@@ -142,25 +223,70 @@ func (m MovieModel) Get(id int64) (*Movie, error) {
 	}
 
 	// Otherwise, return a pointer to the Movie struct.
-	return &movie, nil
+	return row.toMovie(), nil
+}
+
+// The GetVersion() method returns just the version number of a specific movie. It's a
+// cheap way for a cache to check that its copy of the movie is still current.
+func (m MovieModel) GetVersion(id int64) (int32, error) {
+	if id < 1 {
+		return 0, ErrRecordNotFound
+	}
+
+	query := `
+		SELECT version
+		FROM movies
+		WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var version int32
+
+	// Read from the primary, as the point is to notice writes made by other instances
+	// of the API, which a lagging read replica may not have yet.
+	err := m.DB.QueryRowContext(ctx, m.Dialect.Rebind(query), id).Scan(&version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return 0, ErrRecordNotFound
+		default:
+			return 0, err
+		}
+	}
+
+	return version, nil
 }
 
-// Add a placeholder method for updating a specific record in the movies table.
+// Add a placeholder method for updating a specific record in the movies table. The
+// movie's UpdatedBy is recorded as the user making the update, and its CreatedBy is
+// left as it was.
 func (m MovieModel) Update(movie *Movie) error {
 	// Declare the SQL query for updating the record and returning the new version
-	// number.
-	query := `
+	// number and updated_at timestamp.
+	//
+	// Last-Modified only has a resolution of one second, so updated_at is moved on by at
+	// least a second each time. Otherwise a second update within the same second would
+	// leave it unchanged, and a client revalidating with If-Modified-Since would be told
+	// that its copy from before that update was still current.
+	query := fmt.Sprintf(`
 		UPDATE movies
-		SET title = $1, year = $2, runtime = $3, genres = $4, version = version + 1
-		WHERE id = $5 AND version = $6
-		RETURNING version`
+		SET title = $1, year = $2, runtime = $3, genres = $4, awards = $5, external_ratings = $6,
+			plot = $7, poster = $8, updated_by = $9, version = version + 1, updated_at = %s
+		WHERE id = $10 AND version = $11
+		RETURNING version, updated_at`, m.Dialect.NextSecond("updated_at"))
 
 	// Create an args slice containing the values for the placeholder parameters.
 	args := []interface{}{
 		movie.Title,
 		movie.Year,
 		movie.Runtime,
-		pq.Array(movie.Genres),
+		m.Dialect.Array(movie.Genres),
+		movie.Awards,
+		movie.ExternalRatings,
+		movie.Plot,
+		movie.Poster,
+		userRefID(movie.UpdatedBy),
 		movie.ID,
 		movie.Version,
 	}
@@ -174,7 +300,7 @@ func (m MovieModel) Update(movie *Movie) error {
 	// ErrEditConflict error.
 	//
 	// Use QueryRowContext() and pass the context as the first argument.
-	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&movie.Version)
+	err := m.DB.QueryRowContext(ctx, m.Dialect.Rebind(query), args...).Scan(&movie.Version, &movie.UpdatedAt)
 	if err != nil {
 		switch {
 		case errors.Is(err, sql.ErrNoRows):
@@ -187,47 +313,382 @@ func (m MovieModel) Update(movie *Movie) error {
 	return nil
 }
 
-// Add a placeholder method for deleting a specific record from the movies table.
-func (m MovieModel) Delete(id int64) error {
-	// Return an ErrRecordNotFound error if the movie ID is less than 1.
-	if id < 1 {
-		return ErrRecordNotFound
+// ReindexBatch rebuilds the derived columns of up to limit movies whose IDs come after
+// afterID, in order of ID, and returns the last ID it rebuilt and how many there were.
+// A count less than limit means it has reached the end of the table. The derived
+// columns are the rating aggregates; the title search index is an expression index,
+// which the database keeps up to date itself. The version isn't changed, as the movie
+// itself hasn't been.
+func (m MovieModel) ReindexBatch(afterID int64, limit int) (lastID int64, count int, err error) {
+	query := `
+		WITH batch AS (
+			SELECT id FROM movies
+			WHERE id > $1
+			ORDER BY id
+			LIMIT $2
+		)
+		UPDATE movies
+		SET ratings_count = (SELECT count(*) FROM ratings WHERE movie_id = movies.id),
+			average_rating = COALESCE((SELECT avg(rating) FROM ratings WHERE movie_id = movies.id), 0)
+		WHERE id IN (SELECT id FROM batch)
+		RETURNING id`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, m.Dialect.Rebind(query), afterID, limit)
+	if err != nil {
+		return 0, 0, err
 	}
 
-	// Construct the SQL query to delete the record.
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int64
+
+		err := rows.Scan(&id)
+		if err != nil {
+			return 0, 0, err
+		}
+
+		count++
+		if id > lastID {
+			lastID = id
+		}
+	}
+
+	if err = rows.Err(); err != nil {
+		return 0, 0, err
+	}
+
+	return lastID, count, nil
+}
+
+// GetBatch returns up to limit movies whose IDs come after afterID, in order of ID, so
+// that the whole table can be read a batch at a time without holding it in memory. A
+// batch shorter than limit means it has reached the end of the table. The users who
+// created and updated the movies aren't included.
+func (m MovieModel) GetBatch(afterID int64, limit int) ([]*Movie, error) {
 	query := `
-		DELETE FROM movies
-		WHERE id = $1`
+		SELECT ` + movieColumns("movies") + `
+		FROM movies
+		WHERE id > $1
+		ORDER BY id
+		LIMIT $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	rows, err := m.ReadDB.QueryContext(ctx, m.Dialect.Rebind(query), afterID, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	movies := []*Movie{}
+
+	for rows.Next() {
+		var row movieRow
+
+		err := rows.Scan(row.dest(m.Dialect)...)
+		if err != nil {
+			return nil, err
+		}
+
+		movies = append(movies, row.toMovie())
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return movies, nil
+}
+
+// GetByTitleYear returns the movie with exactly the given title and year, which is how
+// a movie is identified outside of this database, such as in an import. If there's more
+// than one, it returns the first one added.
+func (m MovieModel) GetByTitleYear(title string, year int32) (*Movie, error) {
+	query := `
+		SELECT ` + movieColumns("movies") + `
+		FROM movies
+		WHERE title = $1 AND year = $2
+		ORDER BY id
+		LIMIT 1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var row movieRow
+
+	err := m.DB.QueryRowContext(ctx, m.Dialect.Rebind(query), title, year).Scan(row.dest(m.Dialect)...)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return row.toMovie(), nil
+}
+
+// FindSimilarCandidates returns up to limit existing movies which may be duplicates
+// of one with the given title and year, the most alike first. Only movies whose titles
+// have a trigram similarity of at least similarTitleMin are considered, and they're
+// scored by candidateScore(). If year is 0, only the titles are compared. The users
+// who created and updated the movies aren't included.
+func (m MovieModel) FindSimilarCandidates(title string, year int32, limit int) ([]*MovieCandidate, error) {
+	// The score is calculated as candidateScore() does. The year's part is written
+	// with CASE rather than GREATEST(), which SQLite doesn't have.
+	query := fmt.Sprintf(`
+		SELECT %s, candidates.score
+		FROM (
+			SELECT *, CASE
+				WHEN $2 = 0 THEN similarity(title, $1)
+				ELSE 0.8 * similarity(title, $1) + 0.2 * CASE WHEN abs(year - $2) >= 5 THEN 0 ELSE 1 - abs(year - $2) / 5.0 END
+			END AS score
+			FROM movies
+			WHERE %s
+		) AS candidates
+		ORDER BY score DESC, id ASC
+		LIMIT $3`, movieColumns("candidates"), m.Dialect.SimilarTo("title", "$1"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.ReadDB.QueryContext(ctx, m.Dialect.Rebind(query), title, year, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	candidates := []*MovieCandidate{}
+
+	for rows.Next() {
+		var (
+			row   movieRow
+			score float64
+		)
+
+		err := rows.Scan(row.dest(m.Dialect, &score)...)
+		if err != nil {
+			return nil, err
+		}
+
+		candidates = append(candidates, &MovieCandidate{Movie: row.toMovie(), Score: roundScore(score)})
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return candidates, nil
+}
+
+// Define a MovieDeletion struct to hold the number of rows which referred to a movie
+// and were deleted along with it.
+type MovieDeletion struct {
+	Ratings          int64 `json:"ratings"`
+	Reviews          int64 `json:"reviews"`
+	WatchlistEntries int64 `json:"watchlist_entries"`
+	Reports          int64 `json:"reports"`
+}
+
+// Delete a specific movie along with the ratings, reviews, watchlist entries and
+// reports which refer to it, and return how many of each were deleted. The foreign
+// keys on these tables cascade anyway, but deleting the rows explicitly inside a single
+// transaction lets us count them, and means the movie is never left half-deleted if a
+// constraint changes.
+//
+// If another table refers to the movie without cascading, the movie is left as it was
+// and an *InUseError naming the table is returned.
+func (m MovieModel) Delete(id int64) (*MovieDeletion, error) {
+	// Return an ErrRecordNotFound error if the movie ID is less than 1.
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
 
 	// Create a context with a 3 second timeout.
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	// Execute the SQL query using the Exec() method, passing the id variable as
-	// the value for the placeholder parameter. The Exec() method returns a sql.Result
-	// object.
-	//
-	// Use ExecContext() and pass the context as the first argument.
-	result, err := m.DB.ExecContext(ctx, query, id)
+	tx, err := beginTx(ctx, m.DB)
+	if err != nil {
+		return nil, err
+	}
+
+	// Rollback() is a no-op if the transaction has already been committed.
+	defer tx.Rollback()
+
+	var deletion MovieDeletion
+
+	// The dependent rows are deleted before the movie, in an order that doesn't
+	// matter as none of them refer to each other.
+	dependents := []struct {
+		query string
+		count *int64
+	}{
+		{`DELETE FROM ratings WHERE movie_id = $1`, &deletion.Ratings},
+		{`DELETE FROM reviews WHERE movie_id = $1`, &deletion.Reviews},
+		{`DELETE FROM watchlist WHERE movie_id = $1`, &deletion.WatchlistEntries},
+		{`DELETE FROM reports WHERE movie_id = $1`, &deletion.Reports},
+	}
+
+	for _, dependent := range dependents {
+		result, err := tx.ExecContext(ctx, m.Dialect.Rebind(dependent.query), id)
+		if err != nil {
+			return nil, err
+		}
+
+		*dependent.count, err = result.RowsAffected()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	result, err := tx.ExecContext(ctx, m.Dialect.Rebind(`DELETE FROM movies WHERE id = $1`), id)
 	if err != nil {
-		return err
+		return nil, m.Dialect.InUseError(ctx, tx, err, "movies", id)
 	}
 
 	// Call the RowsAffected() method on the sql.Result object to get the number of rows
 	// affected by the query.
 	rowsAffected, err := result.RowsAffected()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// If no rows were affected, we know that the movies table didn't contain a record
 	// with the provided ID at the moment we tried to delete it. In that case we
-	// return an ErrRecordNotFound error.
+	// return an ErrRecordNotFound error, and the transaction is rolled back, although
+	// there can't have been anything referring to the movie.
 	if rowsAffected == 0 {
-		return ErrRecordNotFound
+		return nil, ErrRecordNotFound
 	}
 
-	return nil
+	err = tx.Commit()
+	if err != nil {
+		return nil, inUseError(err)
+	}
+
+	return &deletion, nil
+}
+
+// The filterSQL() method returns the WHERE conditions for the movie filters, and the
+// arguments for their placeholders, which are numbered from $1. GetAll() and
+// GenreFacets() share it, so that the facets always count the movies being listed.
+//
+// The title and genre conditions come from the dialect, as SQLite has neither
+// full-text search nor array columns. The awards condition only depends on whether
+// HasAwards is set, so it's written into the query rather than passed as a parameter.
+func (m MovieModel) filterSQL(movieFilters MovieFilters) (string, []interface{}) {
+	awards := "1 = 1"
+	if movieFilters.HasAwards != nil {
+		awards = m.Dialect.JSONArrayLength("awards") + " = 0"
+		if *movieFilters.HasAwards {
+			awards = m.Dialect.JSONArrayLength("awards") + " > 0"
+		}
+	}
+
+	where := fmt.Sprintf(`%s
+		AND %s
+		AND %s
+		AND (movies.created_by = $3 OR $3 = 0)`,
+		m.Dialect.TitleMatches("$1"), m.Dialect.ContainsAll("genres", "$2"), awards)
+
+	return where, []interface{}{movieFilters.Title, m.Dialect.Array(movieFilters.Genres), movieFilters.CreatedBy}
+}
+
+// GenreFacets returns how many of the movies matching the filters have each genre, the
+// most common first. It counts the same movies that GetAll() lists, over every page.
+func (m MovieModel) GenreFacets(movieFilters MovieFilters) ([]FacetCount, error) {
+	where, args := m.filterSQL(movieFilters)
+
+	query := fmt.Sprintf(`
+		SELECT facet.value, count(*)
+		FROM movies, %s
+		WHERE %s
+		GROUP BY facet.value
+		ORDER BY count(*) DESC, facet.value ASC`,
+		m.Dialect.Elements("genres", "facet"), where)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.ReadDB.QueryContext(ctx, m.Dialect.Rebind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	facets := []FacetCount{}
+
+	for rows.Next() {
+		var facet FacetCount
+
+		err := rows.Scan(&facet.Value, &facet.Count)
+		if err != nil {
+			return nil, err
+		}
+
+		facets = append(facets, facet)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return facets, nil
+}
+
+// YearFacets returns a histogram of the years the movies matching the filters were
+// released in, grouped by yearBuckets(). Like GenreFacets(), it counts the same movies
+// that GetAll() lists, over every page.
+func (m MovieModel) YearFacets(movieFilters MovieFilters) ([]YearBucket, error) {
+	where, args := m.filterSQL(movieFilters)
+
+	query := fmt.Sprintf(`
+		SELECT year, count(*)
+		FROM movies
+		WHERE %s
+		GROUP BY year`, where)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.ReadDB.QueryContext(ctx, m.Dialect.Rebind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	counts := make(map[int32]int)
+
+	for rows.Next() {
+		var (
+			year  int32
+			count int
+		)
+
+		err := rows.Scan(&year, &count)
+		if err != nil {
+			return nil, err
+		}
+
+		counts[year] = count
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return yearBuckets(counts), nil
 }
 
 // Create a new GetAll() method which returns a slice of movies. Although we're not
@@ -235,7 +696,11 @@ func (m MovieModel) Delete(id int64) error {
 // arguments.
 //
 // Update the function signature to return a Metadata struct.
-func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*Movie, Metadata, error) {
+//
+// The movies are filtered by the title, genres, awards and creator in movieFilters.
+// Like Get(), the users who created and last updated them are LEFT JOINed, so the
+// movies' columns have to be qualified where the users table has one of the same name.
+func (m MovieModel) GetAll(movieFilters MovieFilters, filters Filters) ([]*Movie, Metadata, error) {
 	// Construct the SQL query to retrive all movie records.
 	//
 	// Update the SQL query to include the filter conditions.
@@ -250,13 +715,18 @@ func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*M
 	//
 	// Update the SQL query to include the window function which counts the total
 	// (filtered) records.
+	//
+	// The filter conditions come from filterSQL(), which numbers their placeholders
+	// from $1, so the LIMIT and OFFSET placeholders come after them.
+	where, args := m.filterSQL(movieFilters)
+
 	query := fmt.Sprintf(`
-		SELECT count(*) OVER(), id, created_at, title, year, runtime, genres, version
-		FROM movies
-		WHERE (to_tsvector('simple', title) @@ plainto_tsquery('simple', $1) OR $1 = '')
-		AND (genres @> $2 OR $2 = '{}')
-		ORDER BY %s %s, id ASC
-		LIMIT $3 OFFSET $4`, filters.sortColumn(), filters.sortDirection())
+		SELECT %s, %s, count(*) OVER()
+		FROM movies%s
+		WHERE %s
+		ORDER BY movies.%s %s, movies.id ASC
+		LIMIT $%d OFFSET $%d`,
+		movieColumns("movies"), movieUserColumns, movieUserJoins, where, filters.sortColumn(), filters.sortDirection(), len(args)+1, len(args)+2)
 
 	// Create a context with a 3 second timeout.
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
@@ -266,13 +736,13 @@ func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*M
 	// values for the placeholders in a slice. Notice here how we call the limit() and
 	// offset() methods on the Filters struct to get the appropriate values for the
 	// LIMIT and OFFSET clauses.
-	args := []interface{}{title, pq.Array(genres), filters.limit(), filters.offset()}
+	args = append(args, filters.limit(), filters.offset())
 
 	// Use QueryContext() to execute the query. This returns a sql.Rows resultset
 	// containing the result.
 	//
 	// Pass the args slice to QueryContext() as a variadic parameter.
-	rows, err := m.DB.QueryContext(ctx, query, args...)
+	rows, err := m.ReadDB.QueryContext(ctx, m.Dialect.Rebind(query), args...)
 	if err != nil {
 		return nil, Metadata{}, err
 	}
@@ -288,28 +758,20 @@ func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*M
 
 	// Use  rows.Next to iterate through the rows in the resultset.
 	for rows.Next() {
-		// Initialize an empty Movie struct to hold the data for an individual movie
-		var movie Movie
-
-		// Scan the values from the row into the Movie struct. Note that we are
-		// using the pq.Array() adapter on the genres field here.
-		err := rows.Scan(
-			&totalRecords, // Scan the count from the window function into totalRecords
-			&movie.ID,
-			&movie.CreatedAt,
-			&movie.Title,
-			&movie.Year,
-			&movie.Runtime,
-			pq.Array(&movie.Genres),
-			&movie.Version,
-		)
+		// Initialize an empty movieRow struct to hold the data for an individual movie,
+		// including the nullable columns of the users who created and last updated it.
+		var row movieRow
+
+		// Scan the values from the row into the movieRow struct, followed by the
+		// count from the window function into totalRecords.
+		err := rows.Scan(row.dest(m.Dialect, append(row.userDest(), &totalRecords)...)...)
 
 		if err != nil {
 			return nil, Metadata{}, err
 		}
 
 		// Add the Movie struct to the slice
-		movies = append(movies, &movie)
+		movies = append(movies, row.toMovie())
 
 	}
 
@@ -321,7 +783,7 @@ func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*M
 
 	// Generate a Metadata struct, passing in the total record count and pagination
 	// parameters from the client.
-	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.limit())
 
 	return movies, metadata, nil
 }
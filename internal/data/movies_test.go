@@ -0,0 +1,864 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/petrostrak/an-open-movie-database/internal/testdb"
+	"github.com/petrostrak/an-open-movie-database/internal/validator"
+)
+
+// The newTestMovieModels() helper returns models on a database for the driver selected
+// by OMDB_TEST_DB_DRIVER, so that these tests run on SQLite too.
+func newTestMovieModels(t *testing.T) Models {
+	t.Helper()
+
+	driverName, db := testdb.Open(t)
+
+	models, err := NewModelsForDriver(driverName, db, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return models
+}
+
+func TestValidateMovie(t *testing.T) {
+	valid := func() *Movie {
+		return &Movie{Title: "Moana", Year: 2016, Runtime: 107, Genres: []string{"animation", "adventure"}}
+	}
+
+	tests := []struct {
+		name   string
+		change func(m *Movie)
+		want   map[string][]string
+	}{
+		{"valid", func(m *Movie) {}, map[string][]string{}},
+		{"multibyte title", func(m *Movie) { m.Title = "千と千尋の神隠し" }, map[string][]string{}},
+		{"long title", func(m *Movie) { m.Title = strings.Repeat("é", 251) }, map[string][]string{
+			"title": {"must not be more than 500 bytes long"},
+		}},
+		{"too many genres", func(m *Movie) { m.Genres = []string{"a", "b", "c", "d", "e", "f"} }, map[string][]string{
+			"genres": {"must not contain more than 5 genres"},
+		}},
+		{"duplicate genres ignoring case", func(m *Movie) { m.Genres = []string{"Drama", "drama"} }, map[string][]string{
+			"genres": {"must not contain duplicate values"},
+		}},
+		{"awards and ratings", func(m *Movie) {
+			m.Awards = Awards{{Name: "Academy Awards", Category: "Best Animated Feature", Year: 2017}}
+			m.ExternalRatings = ExternalRatings{{Source: "IMDb", Score: 7.6, Scale: 10}, {Source: "Metacritic", Score: 0, Scale: 100}}
+		}, map[string][]string{}},
+		{"malformed awards", func(m *Movie) {
+			m.Awards = Awards{
+				{Name: " ", Year: 2017},
+				{Name: "Academy Awards"},
+				{Name: "Golden Globes", Year: 2015},
+				{Name: "BAFTA", Year: int32(time.Now().Year() + 1)},
+			}
+		}, map[string][]string{
+			"awards[0].name": {"must be provided"},
+			"awards[1].year": {"must be provided"},
+			"awards[2].year": {"must not be before the movie's release year"},
+			"awards[3].year": {"must not be in the future"},
+		}},
+		{"too many awards", func(m *Movie) {
+			m.Awards = make(Awards, maxAwards+1)
+			for i := range m.Awards {
+				m.Awards[i] = Award{Name: "Festival", Year: 2016}
+			}
+		}, map[string][]string{
+			"awards": {"must not contain more than 50 awards"},
+		}},
+		{"malformed ratings", func(m *Movie) {
+			m.ExternalRatings = ExternalRatings{
+				{Source: "", Score: 5, Scale: 10},
+				{Source: "IMDb", Score: 11, Scale: 10},
+				{Source: "Rotten Tomatoes", Score: -1, Scale: 100},
+				{Source: "Metacritic", Score: 50, Scale: 0},
+				{Source: "Letterboxd", Score: 4, Scale: 5000},
+				{Source: "imdb", Score: 7, Scale: 10},
+			}
+		}, map[string][]string{
+			"external_ratings":           {"must not contain duplicate values"},
+			"external_ratings[0].source": {"must be provided"},
+			"external_ratings[1].score":  {"must be between 0 and the scale of 10"},
+			"external_ratings[2].score":  {"must be between 0 and the scale of 100"},
+			"external_ratings[3].scale":  {"must be greater than zero"},
+			"external_ratings[4].scale":  {"must be a maximum of 1000"},
+		}},
+		{"too many ratings", func(m *Movie) {
+			m.ExternalRatings = make(ExternalRatings, maxExternalRatings+1)
+			for i := range m.ExternalRatings {
+				m.ExternalRatings[i] = ExternalRating{Source: string(rune('a' + i)), Score: 1, Scale: 10}
+			}
+		}, map[string][]string{
+			"external_ratings": {"must not contain more than 10 ratings"},
+		}},
+		{"plot and poster", func(m *Movie) {
+			m.Plot = "An adventurous teenager sails out on a daring mission to save her people."
+			m.Poster = "https://example.com/moana.jpg"
+		}, map[string][]string{}},
+		{"malformed plot and poster", func(m *Movie) {
+			m.Plot = strings.Repeat("a", 2001)
+			m.Poster = "ftp://example.com/moana.jpg"
+		}, map[string][]string{
+			"plot":   {"must not be more than 2000 bytes long"},
+			"poster": {"must be an absolute http or https URL"},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			movie := valid()
+			tt.change(movie)
+
+			v := validator.New()
+			ValidateMovie(v, movie)
+
+			if got := validator.Render(v.Errors, validator.DefaultLocale); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got errors %v; want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMovieModel(t *testing.T) {
+	models := newTestMovieModels(t)
+
+	movie := &Movie{
+		Title:           "Moana",
+		Year:            2016,
+		Runtime:         107,
+		Genres:          []string{"animation", "adventure"},
+		Awards:          Awards{{Name: "Academy Awards", Category: "Best Animated Feature", Year: 2017}},
+		ExternalRatings: ExternalRatings{{Source: "IMDb", Score: 7.6, Scale: 10}},
+		Plot:            "An adventurous teenager sails out on a daring mission.",
+	}
+
+	err := models.Movies.Insert(movie)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if movie.ID < 1 || movie.Version != 1 || movie.CreatedAt.IsZero() {
+		t.Errorf("got ID %d, version %d and created_at %v after the insert", movie.ID, movie.Version, movie.CreatedAt)
+	}
+
+	if !movie.UpdatedAt.Equal(movie.CreatedAt) {
+		t.Errorf("got updated_at %v after the insert; want created_at %v", movie.UpdatedAt, movie.CreatedAt)
+	}
+
+	got, err := models.Movies.Get(movie.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got.Title != movie.Title || len(got.Genres) != 2 || got.Genres[1] != "adventure" || got.Plot != movie.Plot {
+		t.Errorf("got movie %+v; want %+v", got, movie)
+	}
+
+	// The awards and ratings make the round trip through the JSON columns.
+	if !reflect.DeepEqual(got.Awards, movie.Awards) || !reflect.DeepEqual(got.ExternalRatings, movie.ExternalRatings) {
+		t.Errorf("got awards %+v and ratings %+v; want %+v and %+v", got.Awards, got.ExternalRatings, movie.Awards, movie.ExternalRatings)
+	}
+
+	got.Genres = append(got.Genres, "comedy")
+	got.Awards = append(got.Awards, Award{Name: "Golden Globes", Category: "Best Animated Feature Film", Year: 2017})
+	got.ExternalRatings = nil
+	got.Poster = "https://example.com/moana.jpg"
+
+	err = models.Movies.Update(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got.Version != 2 {
+		t.Errorf("got version %d after the update; want 2", got.Version)
+	}
+
+	// The update happened within a second of the insert, so updated_at has to be moved
+	// on by a whole second for Last-Modified to change.
+	if got.UpdatedAt.Truncate(time.Second).Sub(movie.UpdatedAt.Truncate(time.Second)) < time.Second {
+		t.Errorf("got updated_at %v after the update; want at least a second after %v", got.UpdatedAt, movie.UpdatedAt)
+	}
+
+	stored, err := models.Movies.Get(movie.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !stored.UpdatedAt.Equal(got.UpdatedAt) {
+		t.Errorf("got stored updated_at %v; want %v", stored.UpdatedAt, got.UpdatedAt)
+	}
+
+	if len(stored.Awards) != 2 || stored.Awards[1].Name != "Golden Globes" || len(stored.ExternalRatings) != 0 || stored.Poster != got.Poster {
+		t.Errorf("got stored awards %+v, ratings %+v and poster %q after the update", stored.Awards, stored.ExternalRatings, stored.Poster)
+	}
+
+	// Updating the original, which has the old version, is an edit conflict.
+	err = models.Movies.Update(movie)
+	if !errors.Is(err, ErrEditConflict) {
+		t.Errorf("got error %v updating a stale movie; want ErrEditConflict", err)
+	}
+
+	_, err = models.Movies.Delete(movie.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = models.Movies.Get(movie.ID)
+	if !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("got error %v getting the deleted movie; want ErrRecordNotFound", err)
+	}
+
+	_, err = models.Movies.Delete(movie.ID)
+	if !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("got error %v deleting the movie again; want ErrRecordNotFound", err)
+	}
+}
+
+// Deleting a movie deletes everything which refers to it, and counts it, while leaving
+// the rows which refer to other movies alone.
+func TestMovieModelDeleteRelated(t *testing.T) {
+	driverName, db := testdb.Open(t)
+
+	models, err := NewModelsForDriver(driverName, db, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alice := newTestUserWithData(t, db, models, "alice")
+	bob := newTestUserWithData(t, db, models, "bob")
+
+	var movies []*Movie
+
+	for _, title := range []string{"Moana", "Jaws"} {
+		movie := &Movie{Title: title, Year: 2000, Runtime: 90, Genres: []string{"drama"}}
+
+		err := models.Movies.Insert(movie)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		movies = append(movies, movie)
+	}
+
+	moana, jaws := movies[0], movies[1]
+
+	for _, user := range []*User{alice, bob} {
+		for _, movie := range movies {
+			for _, query := range []string{
+				`INSERT INTO ratings (user_id, movie_id, rating) VALUES ($1, $2, 8)`,
+				`INSERT INTO reviews (user_id, movie_id, body) VALUES ($1, $2, 'Good')`,
+				`INSERT INTO watchlist (user_id, movie_id) VALUES ($1, $2)`,
+			} {
+				_, err := db.Exec(query, user.ID, movie.ID)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+	}
+
+	err = models.Reports.Insert(&Report{MovieID: moana.ID, UserID: alice.ID, Field: "year", Message: "It's 2016."})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deletion, err := models.Movies.Delete(moana.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := fmt.Sprintf("%+v", *deletion); got != "{Ratings:2 Reviews:2 WatchlistEntries:2 Reports:1}" {
+		t.Errorf("got %s deleted; want two of each and one report", got)
+	}
+
+	for _, table := range []string{"ratings", "reviews", "watchlist", "reports"} {
+		query := `SELECT count(*) FROM ` + table + ` WHERE movie_id = $1`
+
+		if n := count(t, db, query, moana.ID); n != 0 {
+			t.Errorf("got %d rows in %s for the deleted movie; want 0", n, table)
+		}
+
+		if n := count(t, db, query, jaws.ID); table != "reports" && n != 2 {
+			t.Errorf("got %d rows in %s for the other movie; want 2", n, table)
+		}
+	}
+
+	// A table which refers to the movies without cascading, as a new one might, blocks
+	// the delete, and nothing is deleted.
+	_, err = db.Exec(`CREATE TABLE credits (movie_id bigint NOT NULL REFERENCES movies, name text NOT NULL)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = db.Exec(`INSERT INTO credits (movie_id, name) VALUES ($1, 'Steven Spielberg')`, jaws.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var inUse *InUseError
+
+	_, err = models.Movies.Delete(jaws.ID)
+	if !errors.Is(err, ErrInUse) || !errors.As(err, &inUse) || inUse.Table != "credits" {
+		t.Fatalf("got error %v; want an InUseError for credits", err)
+	}
+
+	if n := count(t, db, `SELECT count(*) FROM ratings WHERE movie_id = $1`, jaws.ID); n != 2 {
+		t.Errorf("got %d ratings for the blocked movie; want 2", n)
+	}
+
+	if _, err := models.Movies.Get(jaws.ID); err != nil {
+		t.Errorf("got error %v getting the blocked movie; want it kept", err)
+	}
+}
+
+func TestMovieModelGetAll(t *testing.T) {
+	models := newTestMovieModels(t)
+
+	for _, movie := range []*Movie{
+		{Title: "Black Panther", Year: 2018, Runtime: 134, Genres: []string{"action", "adventure"}, Awards: Awards{{Name: "Academy Awards", Category: "Best Costume Design", Year: 2019, Won: true}}},
+		{Title: "Deadpool", Year: 2016, Runtime: 108, Genres: []string{"action", "comedy"}},
+		{Title: "The Breakfast Club", Year: 1985, Runtime: 96, Genres: []string{"drama"}},
+	} {
+		err := models.Movies.Insert(movie)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	yes, no := true, false
+
+	tests := []struct {
+		name      string
+		title     string
+		genres    []string
+		hasAwards *bool
+		sort      string
+		want      []string
+		wantTotal int
+	}{
+		{"all", "", nil, nil, "id", []string{"Black Panther", "Deadpool"}, 3},
+		{"title", "panther", nil, nil, "id", []string{"Black Panther"}, 1},
+		{"genre", "", []string{"action"}, nil, "-year", []string{"Black Panther", "Deadpool"}, 2},
+		{"every genre", "", []string{"action", "comedy"}, nil, "id", []string{"Deadpool"}, 1},
+		{"no match", "club", []string{"action"}, nil, "id", []string{}, 0},
+		{"with awards", "", nil, &yes, "id", []string{"Black Panther"}, 1},
+		{"without awards", "", nil, &no, "id", []string{"Deadpool", "The Breakfast Club"}, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			movies, metadata, err := models.Movies.GetAll(MovieFilters{Title: tt.title, Genres: tt.genres, HasAwards: tt.hasAwards}, Filters{Page: 1, PageSize: 2, Sort: tt.sort, SortSafelist: MovieSortSafelist})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			titles := []string{}
+			for _, movie := range movies {
+				titles = append(titles, movie.Title)
+			}
+
+			if !reflect.DeepEqual(titles, tt.want) {
+				t.Errorf("got movies %q; want %q", titles, tt.want)
+			}
+
+			if metadata.TotalRecords != tt.wantTotal {
+				t.Errorf("got %d total records; want %d", metadata.TotalRecords, tt.wantTotal)
+			}
+		})
+	}
+}
+
+// A movie's creator and last updater are read back with their names, updating a movie
+// doesn't change its creator, and deleting a user's account leaves their movies with
+// no creator.
+func TestMovieModelCreatedBy(t *testing.T) {
+	driverName, db := testdb.Open(t)
+
+	models, err := NewModelsForDriver(driverName, db, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var users []*User
+
+	for _, name := range []string{"alice", "bob"} {
+		user := &User{Name: name, Username: name, Email: name + "@example.com", Activated: true}
+
+		err := user.Password.Set("pa55word1234")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = models.Users.Insert(user)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		users = append(users, user)
+	}
+
+	movie := &Movie{Title: "Moana", Year: 2016, Runtime: 107, Genres: []string{"animation"}, CreatedBy: &UserRef{ID: users[0].ID}}
+
+	err = models.Movies.Insert(movie)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	legacy := &Movie{Title: "Casablanca", Year: 1942, Runtime: 102, Genres: []string{"drama"}}
+
+	err = models.Movies.Insert(legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	movie.CreatedBy = &UserRef{ID: users[1].ID}
+	movie.UpdatedBy = &UserRef{ID: users[1].ID}
+
+	err = models.Movies.Update(movie)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := models.Movies.Get(movie.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := (&UserRef{ID: users[0].ID, Name: "alice"}); !reflect.DeepEqual(got.CreatedBy, want) {
+		t.Errorf("got created by %+v; want %+v", got.CreatedBy, want)
+	}
+
+	if want := (&UserRef{ID: users[1].ID, Name: "bob"}); !reflect.DeepEqual(got.UpdatedBy, want) {
+		t.Errorf("got updated by %+v; want %+v", got.UpdatedBy, want)
+	}
+
+	movies, _, err := models.Movies.GetAll(MovieFilters{CreatedBy: users[0].ID}, Filters{Page: 1, PageSize: 20, Sort: "id", SortSafelist: MovieSortSafelist})
+	if err != nil || len(movies) != 1 || movies[0].ID != movie.ID {
+		t.Errorf("got movies %+v and error %v; want only alice's movie", movies, err)
+	}
+
+	err = models.Users.Delete(users[0].ID, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, id := range []int64{movie.ID, legacy.ID} {
+		got, err := models.Movies.Get(id)
+		if err != nil || got.CreatedBy != nil {
+			t.Errorf("got movie %+v and error %v; want no creator", got, err)
+		}
+	}
+}
+
+// GetBatch() reads the movies a batch at a time in order of ID, and GetByTitleYear()
+// finds the first movie with exactly the given title and year.
+func TestMovieModelGetBatch(t *testing.T) {
+	models := newTestMovieModels(t)
+
+	var ids []int64
+
+	for _, title := range []string{"Casablanca", "Moana", "Moana", "Up"} {
+		movie := &Movie{Title: title, Year: 2016, Runtime: 90, Genres: []string{"drama"}}
+
+		err := models.Movies.Insert(movie)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ids = append(ids, movie.ID)
+	}
+
+	var got []int64
+
+	for afterID := int64(0); ; {
+		batch, err := models.Movies.GetBatch(afterID, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, movie := range batch {
+			got = append(got, movie.ID)
+		}
+
+		if len(batch) < 3 {
+			break
+		}
+
+		afterID = batch[len(batch)-1].ID
+	}
+
+	if !reflect.DeepEqual(got, ids) {
+		t.Errorf("got IDs %v; want %v", got, ids)
+	}
+
+	movie, err := models.Movies.GetByTitleYear("Moana", 2016)
+	if err != nil || movie.ID != ids[1] {
+		t.Errorf("got movie %+v and error %v; want movie %d", movie, err, ids[1])
+	}
+
+	for _, year := range []int32{2015, 2017} {
+		if _, err := models.Movies.GetByTitleYear("Moana", year); !errors.Is(err, ErrRecordNotFound) {
+			t.Errorf("got error %v for %d; want ErrRecordNotFound", err, year)
+		}
+	}
+
+	if _, err := models.Movies.GetByTitleYear("moana", 2016); !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("got error %v for a different case; want ErrRecordNotFound", err)
+	}
+}
+
+// GenreFacets() counts the genres of the movies which GetAll() would list.
+func TestMovieModelGenreFacets(t *testing.T) {
+	models := newTestMovieModels(t)
+
+	for _, movie := range []*Movie{
+		{Title: "Black Panther", Year: 2018, Runtime: 134, Genres: []string{"action", "adventure"}, Awards: Awards{{Name: "Academy Awards", Category: "Best Costume Design", Year: 2019, Won: true}}},
+		{Title: "Deadpool", Year: 2016, Runtime: 108, Genres: []string{"action", "comedy"}},
+		{Title: "The Breakfast Club", Year: 1985, Runtime: 96, Genres: []string{"drama"}},
+	} {
+		err := models.Movies.Insert(movie)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	yes := true
+
+	tests := []struct {
+		name    string
+		filters MovieFilters
+		want    []FacetCount
+	}{
+		{"all", MovieFilters{}, []FacetCount{{"action", 2}, {"adventure", 1}, {"comedy", 1}, {"drama", 1}}},
+		{"title", MovieFilters{Title: "deadpool"}, []FacetCount{{"action", 1}, {"comedy", 1}}},
+		{"genre", MovieFilters{Genres: []string{"action"}}, []FacetCount{{"action", 2}, {"adventure", 1}, {"comedy", 1}}},
+		{"awards", MovieFilters{HasAwards: &yes}, []FacetCount{{"action", 1}, {"adventure", 1}}},
+		{"no match", MovieFilters{Title: "casablanca"}, []FacetCount{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			facets, err := models.Movies.GenreFacets(tt.filters)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(facets, tt.want) {
+				t.Errorf("got facets %v; want %v", facets, tt.want)
+			}
+		})
+	}
+}
+
+func TestYearBuckets(t *testing.T) {
+	tests := []struct {
+		name   string
+		counts map[int32]int
+		want   []YearBucket
+	}{
+		{"none", map[int32]int{}, []YearBucket{}},
+		{"one year", map[int32]int{2016: 3}, []YearBucket{{2016, 2016, 3}}},
+		{"29 years by year", map[int32]int{1990: 1, 1992: 2, 2018: 1}, append(append([]YearBucket{{1990, 1990, 1}, {1991, 1991, 0}, {1992, 1992, 2}}, emptyYears(1993, 2017)...), YearBucket{2018, 2018, 1})},
+		{"30 years by decade", map[int32]int{1990: 1, 1992: 2, 2019: 1}, []YearBucket{{1990, 1999, 3}, {2000, 2009, 0}, {2010, 2019, 1}}},
+		{"decades are aligned", map[int32]int{1985: 1, 2016: 1, 2018: 1}, []YearBucket{{1980, 1989, 1}, {1990, 1999, 0}, {2000, 2009, 0}, {2010, 2019, 2}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := yearBuckets(tt.counts); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got buckets %v; want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// The emptyYears() helper returns a bucket with no movies for each year from from to to.
+func emptyYears(from, to int32) []YearBucket {
+	var buckets []YearBucket
+	for year := from; year <= to; year++ {
+		buckets = append(buckets, YearBucket{year, year, 0})
+	}
+	return buckets
+}
+
+// YearFacets() buckets the years of the movies which GetAll() would list.
+func TestMovieModelYearFacets(t *testing.T) {
+	models := newTestMovieModels(t)
+
+	for _, movie := range []*Movie{
+		{Title: "Black Panther", Year: 2018, Runtime: 134, Genres: []string{"action", "adventure"}},
+		{Title: "Deadpool", Year: 2016, Runtime: 108, Genres: []string{"action", "comedy"}},
+		{Title: "The Breakfast Club", Year: 1985, Runtime: 96, Genres: []string{"drama"}},
+	} {
+		err := models.Movies.Insert(movie)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name    string
+		filters MovieFilters
+		want    []YearBucket
+	}{
+		{"by decade", MovieFilters{}, []YearBucket{{1980, 1989, 1}, {1990, 1999, 0}, {2000, 2009, 0}, {2010, 2019, 2}}},
+		{"by year", MovieFilters{Genres: []string{"action"}}, []YearBucket{{2016, 2016, 1}, {2017, 2017, 0}, {2018, 2018, 1}}},
+		{"no match", MovieFilters{Title: "casablanca"}, []YearBucket{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buckets, err := models.Movies.YearFacets(tt.filters)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(buckets, tt.want) {
+				t.Errorf("got buckets %v; want %v", buckets, tt.want)
+			}
+		})
+	}
+}
+
+// FindSimilarCandidates() catches near-duplicates such as "Matrix, The", and lets
+// genuinely different titles through. The mock store scores them in the same way.
+func TestMovieModelFindSimilarCandidates(t *testing.T) {
+	testFindSimilarCandidates(t, newTestMovieModels(t))
+}
+
+func TestMockFindSimilarCandidates(t *testing.T) {
+	testFindSimilarCandidates(t, NewMockModels())
+}
+
+func testFindSimilarCandidates(t *testing.T, models Models) {
+	t.Helper()
+
+	for _, movie := range []*Movie{
+		{Title: "The Matrix", Year: 1999, Runtime: 136, Genres: []string{"sci-fi"}},
+		{Title: "The Matrix Reloaded", Year: 2003, Runtime: 138, Genres: []string{"sci-fi"}},
+		{Title: "Jaws", Year: 1975, Runtime: 124, Genres: []string{"thriller"}},
+	} {
+		err := models.Movies.Insert(movie)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name  string
+		title string
+		year  int32
+		want  string
+	}{
+		{"reordered title", "Matrix, The", 1999, "[The Matrix 1] [The Matrix Reloaded 0.48]"},
+		{"no year", "the matrix", 0, "[The Matrix 1] [The Matrix Reloaded 0.55]"},
+		{"different year", "The Matrix", 2021, "[The Matrix 0.8] [The Matrix Reloaded 0.44]"},
+		{"distinct title", "Casablanca", 1942, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			candidates, err := models.Movies.FindSimilarCandidates(tt.title, tt.year, 5)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got []string
+			for _, candidate := range candidates {
+				got = append(got, fmt.Sprintf("[%s %v]", candidate.Movie.Title, candidate.Score))
+			}
+
+			if strings.Join(got, " ") != tt.want {
+				t.Errorf("got candidates %v; want %s", got, tt.want)
+			}
+		})
+	}
+
+	candidates, err := models.Movies.FindSimilarCandidates("The Matrix", 1999, 1)
+	if err != nil || len(candidates) != 1 {
+		t.Errorf("got %d candidates and error %v; want 1", len(candidates), err)
+	}
+}
+
+// A NULL in any of the optional columns, as in a column which has been added but not
+// yet backfilled, reads as the zero value, which is omitted from the JSON.
+func TestMovieRowNulls(t *testing.T) {
+	row := movieRow{id: 1, title: "Moana", year: 2016, runtime: 107, genres: []string{"animation"}, version: 1}
+
+	movie := row.toMovie()
+
+	if movie.Plot != "" || movie.Poster != "" || movie.Views != 0 || movie.Popularity != 0 || movie.CreatedBy != nil || movie.UpdatedBy != nil {
+		t.Errorf("got movie %+v; want the zero value for each NULL", movie)
+	}
+
+	row.plot = sql.NullString{String: "A voyage.", Valid: true}
+	row.views = sql.NullInt64{Int64: 3, Valid: true}
+	row.creatorID, row.creatorName = sql.NullInt64{Int64: 2, Valid: true}, sql.NullString{String: "Alice", Valid: true}
+
+	movie = row.toMovie()
+
+	if movie.Plot != "A voyage." || movie.Views != 3 || movie.CreatedBy == nil || movie.CreatedBy.Name != "Alice" {
+		t.Errorf("got movie %+v; want the values which aren't NULL", movie)
+	}
+
+	if got := strings.Count(movieColumns("movies"), "movies."); got != len(row.dest(postgresDialect{})) {
+		t.Errorf("got %d columns; want one for each of the %d scan destinations", got, len(row.dest(postgresDialect{})))
+	}
+}
+
+// Every method which reads whole movies reads one with NULLs in each of its optional
+// columns, giving the zero values. The columns are NOT NULL in the schema, so the
+// constraints are dropped first; SQLite can't drop one, so it's only run on PostgreSQL.
+// The dropNotNull() helper drops the NOT NULL constraint on a column. SQLite's ALTER
+// TABLE can't do that, but as the constraint doesn't change how the rows are stored,
+// it can be taken out of the table's definition in the schema instead, which tells the
+// pool's other connections to reload it by bumping the schema version.
+func dropNotNull(t *testing.T, driverName string, db *sql.DB, table, column string) {
+	t.Helper()
+
+	if driverName == DriverPostgres {
+		_, err := db.Exec(`ALTER TABLE ` + table + ` ALTER COLUMN ` + column + ` DROP NOT NULL`)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return
+	}
+
+	ctx := context.Background()
+
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	var definition string
+	var version int
+
+	err = conn.QueryRowContext(ctx, `SELECT sql FROM sqlite_master WHERE type = 'table' AND name = ?`, table).Scan(&definition)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = conn.QueryRowContext(ctx, `PRAGMA schema_version`).Scan(&version)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	notNull := regexp.MustCompile(`(?m)^(\s*` + column + ` \w+) NOT NULL`)
+	if !notNull.MatchString(definition) {
+		t.Fatalf("got no NOT NULL constraint on %s.%s", table, column)
+	}
+
+	statements := []struct {
+		query string
+		args  []interface{}
+	}{
+		{`PRAGMA writable_schema = ON`, nil},
+		{`UPDATE sqlite_master SET sql = ? WHERE type = 'table' AND name = ?`, []interface{}{notNull.ReplaceAllString(definition, "$1"), table}},
+		{fmt.Sprintf(`PRAGMA schema_version = %d`, version+1), nil},
+		{`PRAGMA writable_schema = OFF`, nil},
+	}
+
+	for _, statement := range statements {
+		_, err = conn.ExecContext(ctx, statement.query, statement.args...)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestMovieModelNullColumns(t *testing.T) {
+	driverName, db := testdb.Open(t)
+
+	models, err := NewModelsForDriver(driverName, db, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	movie := &Movie{
+		Title:           "Moana",
+		Year:            2016,
+		Runtime:         107,
+		Genres:          []string{"animation"},
+		Awards:          Awards{{Name: "Annie Awards", Category: "Best Animated Feature", Year: 2017}},
+		ExternalRatings: ExternalRatings{{Source: "IMDb", Score: 7.6, Scale: 10}},
+		Plot:            "A voyage across the ocean.",
+		Poster:          "https://example.com/moana.jpg",
+	}
+
+	err = models.Movies.Insert(movie)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	optional := []string{"plot", "poster", "awards", "external_ratings", "views", "popularity"}
+
+	for _, column := range optional {
+		dropNotNull(t, driverName, db, "movies", column)
+
+		_, err = db.Exec(`UPDATE movies SET ` + column + ` = NULL`)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	check := func(method string, got *Movie, err error) {
+		t.Helper()
+
+		if err != nil {
+			t.Fatalf("got error %v from %s()", err, method)
+		}
+
+		if got.ID != movie.ID || got.Title != "Moana" || got.Plot != "" || got.Poster != "" || len(got.Awards) != 0 || len(got.ExternalRatings) != 0 || got.Views != 0 || got.Popularity != 0 {
+			t.Errorf("got movie %+v from %s(); want movie %d with the zero value for each NULL", got, method, movie.ID)
+		}
+
+		js, err := json.Marshal(got)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, key := range []string{`"plot"`, `"poster"`, `"awards"`, `"external_ratings"`, `"popularity"`} {
+			if strings.Contains(string(js), key) {
+				t.Errorf("got %s from %s(); want %s omitted", js, method, key)
+			}
+		}
+	}
+
+	got, err := models.Movies.Get(movie.ID)
+	check("Get", got, err)
+
+	got, err = models.Movies.GetByTitleYear("Moana", 2016)
+	check("GetByTitleYear", got, err)
+
+	movies, _, err := models.Movies.GetAll(MovieFilters{}, Filters{Page: 1, PageSize: 5, Sort: "id", SortSafelist: MovieSortSafelist})
+	if err != nil || len(movies) != 1 {
+		t.Fatalf("got %d movies and error %v from GetAll(); want 1", len(movies), err)
+	}
+	check("GetAll", movies[0], nil)
+
+	movies, err = models.Movies.GetBatch(0, 5)
+	if err != nil || len(movies) != 1 {
+		t.Fatalf("got %d movies and error %v from GetBatch(); want 1", len(movies), err)
+	}
+	check("GetBatch", movies[0], nil)
+
+	candidates, err := models.Movies.FindSimilarCandidates("Moana", 2016, 5)
+	if err != nil || len(candidates) != 1 {
+		t.Fatalf("got %d candidates and error %v from FindSimilarCandidates(); want 1", len(candidates), err)
+	}
+	check("FindSimilarCandidates", candidates[0].Movie, nil)
+}
@@ -2,10 +2,8 @@ package data
 
 import (
 	"context"
-	"database/sql"
+	"fmt"
 	"time"
-
-	"github.com/lib/pq"
 )
 
 // Define a Permission slice, which we will use to hold the permission codes (like
@@ -26,24 +24,73 @@ func (p Permissions) Include(code string) bool {
 
 // Define the PermissionModel type.
 type PermissionModel struct {
-	DB *sql.DB
+	DB      Querier
+	ReadDB  Querier
+	Dialect Dialect
 }
 
 // The GetAllForUser() returns all permission codes for a specific user in a
-// Permission slice.
+// Permission slice. This includes both the permissions granted to the user directly
+// and those granted through the user's roles.
 func (p PermissionModel) GetAllForUser(userID int64) (Permissions, error) {
 	query := `
 		SELECT permissions.code
 		FROM permissions
 		INNER JOIN users_permissions ON users_permissions.permission_id =
 		permissions.id
-		INNER JOIN users ON users_permissions.user_id = users.id
-		WHERE users.id = $1`
+		WHERE users_permissions.user_id = $1
+		UNION
+		SELECT permissions.code
+		FROM permissions
+		INNER JOIN role_permissions ON role_permissions.permission_id =
+		permissions.id
+		INNER JOIN user_roles ON user_roles.role_id = role_permissions.role_id
+		WHERE user_roles.user_id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	// Read the permissions from the primary, like the other queries used to authorize
+	// a request: a permission which has just been revoked mustn't still be granted
+	// because the revocation hasn't reached the read replica, and the permissions
+	// cache would then hold on to the stale set.
+	rows, err := p.DB.QueryContext(ctx, p.Dialect.Rebind(query), userID)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var permissions Permissions
+
+	for rows.Next() {
+		var permission string
+
+		err := rows.Scan(&permission)
+		if err != nil {
+			return nil, err
+		}
+
+		permissions = append(permissions, permission)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return permissions, nil
+}
+
+// The GetAll() returns every permission code that exists in the permissions table.
+func (p PermissionModel) GetAll() (Permissions, error) {
+	query := `
+		SELECT code
+		FROM permissions
+		ORDER BY code`
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	rows, err := p.DB.QueryContext(ctx, query, userID)
+	rows, err := p.ReadDB.QueryContext(ctx, p.Dialect.Rebind(query))
 	if err != nil {
 		return nil, err
 	}
@@ -71,16 +118,63 @@ func (p PermissionModel) GetAllForUser(userID int64) (Permissions, error) {
 
 // Add the provided permission codes for a specific user. Notice that we're using a
 // variadic parameter for the codes so that we can assign multiple permissions in a
-// single call.
+// single call. Codes that the user already holds are skipped, so that granting a
+// permission twice is harmless.
 func (m PermissionModel) AddForUser(userId int64, codes ...string) error {
+	query := fmt.Sprintf(`
+		INSERT INTO users_permissions
+		SELECT $1, permissions.id FROM permissions WHERE %s
+		ON CONFLICT DO NOTHING`, m.Dialect.In("permissions.code", "$2"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, m.Dialect.Rebind(query), userId, m.Dialect.Array(codes))
+	return err
+}
+
+// Remove a permission code from a specific user, returning a ErrRecordNotFound error
+// if the user didn't hold it.
+func (m PermissionModel) RemoveForUser(userID int64, code string) error {
+	query := `
+		DELETE FROM users_permissions
+		WHERE user_id = $1
+		AND permission_id IN (SELECT id FROM permissions WHERE code = $2)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, m.Dialect.Rebind(query), userID, code)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// AddAllForUser grants every permission to a specific user. It's used when creating a
+// superuser, and like AddForUser() it skips the permissions the user already holds.
+//
+// SQLite would take the ON of ON CONFLICT to begin a join constraint, if the SELECT had
+// no WHERE clause.
+func (m PermissionModel) AddAllForUser(userID int64) error {
 	query := `
 		INSERT INTO users_permissions
-		SELECT $1, permissions.id FROM permissions WHERE permissions.code =
-		ANY($2)`
+		SELECT $1, permissions.id FROM permissions WHERE true
+		ON CONFLICT DO NOTHING`
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	_, err := m.DB.ExecContext(ctx, query, pq.Array(codes))
+	_, err := m.DB.ExecContext(ctx, m.Dialect.Rebind(query), userID)
 	return err
 }
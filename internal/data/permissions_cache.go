@@ -0,0 +1,76 @@
+package data
+
+import (
+	"sync"
+	"time"
+)
+
+// Define a PermissionsCache type which holds recently loaded permissions for each user
+// in memory, so that we don't have to query the database on every request. Entries
+// expire after the configured TTL, and can be invalidated early with Delete().
+type PermissionsCache struct {
+	ttl       time.Duration
+	mu        sync.RWMutex
+	entries   map[int64]permissionsCacheEntry
+	lastSweep time.Time
+}
+
+type permissionsCacheEntry struct {
+	permissions Permissions
+	expiry      time.Time
+}
+
+// Return a new PermissionsCache whose entries live for the given TTL.
+func NewPermissionsCache(ttl time.Duration) *PermissionsCache {
+	return &PermissionsCache{
+		ttl:     ttl,
+		entries: make(map[int64]permissionsCacheEntry),
+	}
+}
+
+// Get returns the cached permissions for a user, if there's an entry which hasn't
+// expired yet.
+func (c *PermissionsCache) Get(userID int64) (Permissions, bool) {
+	c.mu.RLock()
+	entry, found := c.entries[userID]
+	c.mu.RUnlock()
+
+	if !found || time.Now().After(entry.expiry) {
+		return nil, false
+	}
+
+	return entry.permissions, true
+}
+
+// Set stores the permissions for a user. Once per TTL period we also sweep out any
+// expired entries, which keeps the map from growing without a cleanup goroutine.
+func (c *PermissionsCache) Set(userID int64, permissions Permissions) {
+	now := time.Now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if now.Sub(c.lastSweep) > c.ttl {
+		for id, entry := range c.entries {
+			if now.After(entry.expiry) {
+				delete(c.entries, id)
+			}
+		}
+
+		c.lastSweep = now
+	}
+
+	c.entries[userID] = permissionsCacheEntry{
+		permissions: permissions,
+		expiry:      now.Add(c.ttl),
+	}
+}
+
+// Delete removes the cached permissions for a user. It must be called whenever the
+// user's permissions or roles change.
+func (c *PermissionsCache) Delete(userID int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.entries, userID)
+}
@@ -0,0 +1,77 @@
+package data
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPermissionsCache(t *testing.T) {
+	c := NewPermissionsCache(time.Minute)
+
+	_, found := c.Get(1)
+	if found {
+		t.Fatal("got an entry from an empty cache")
+	}
+
+	c.Set(1, Permissions{"movies:read"})
+
+	permissions, found := c.Get(1)
+	if !found || !permissions.Include("movies:read") {
+		t.Errorf("got %v, %t; want [movies:read], true", permissions, found)
+	}
+
+	c.Delete(1)
+
+	_, found = c.Get(1)
+	if found {
+		t.Error("got an entry after Delete()")
+	}
+}
+
+func TestPermissionsCacheExpiry(t *testing.T) {
+	c := NewPermissionsCache(10 * time.Millisecond)
+
+	c.Set(1, Permissions{"movies:read"})
+	time.Sleep(20 * time.Millisecond)
+
+	_, found := c.Get(1)
+	if found {
+		t.Error("got an entry after the TTL")
+	}
+
+	// The next Set() sweeps out the expired entry.
+	c.Set(2, Permissions{"movies:read"})
+
+	c.mu.RLock()
+	size := len(c.entries)
+	c.mu.RUnlock()
+
+	if size != 1 {
+		t.Errorf("got %d entries after the sweep; want 1", size)
+	}
+}
+
+// Run with -race to check the locking.
+func TestPermissionsCacheConcurrent(t *testing.T) {
+	c := NewPermissionsCache(time.Millisecond)
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+
+		go func(userID int64) {
+			defer wg.Done()
+
+			for j := 0; j < 1000; j++ {
+				c.Set(userID, Permissions{"movies:read"})
+				c.Get(userID)
+				c.Get(userID + 1)
+				c.Delete(userID)
+			}
+		}(int64(i))
+	}
+
+	wg.Wait()
+}
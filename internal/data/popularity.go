@@ -0,0 +1,185 @@
+package data
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+// The most rows a single UPDATE statement of AddViews() or RefreshPopularityBatch()
+// sets, which keeps it well under PostgreSQL's limit of 65535 placeholders.
+const popularityUpdateBatch = 1000
+
+// Define a PopularityWeights struct to hold how much each part of a movie's popularity
+// score counts for. The recency part halves every HalfLife since the movie was added.
+type PopularityWeights struct {
+	Views    float64
+	Ratings  float64
+	Recency  float64
+	HalfLife time.Duration
+}
+
+// Define a PopularityInput struct to hold what a movie's popularity score is computed
+// from.
+type PopularityInput struct {
+	ID            int64
+	Views         int64
+	RatingsCount  int
+	AverageRating float64
+	CreatedAt     time.Time
+}
+
+// PopularityScore returns the popularity score of a movie at the given time:
+//
+//	ln(views+1)·w.Views + (average_rating·ratings_count / maxRatingMass)·w.Ratings + 0.5^(age/w.HalfLife)·w.Recency
+//
+// The ratings part is normalized by maxRatingMass, the largest average_rating times
+// ratings_count in the catalog, so that it's between 0 and 1 however many ratings the
+// most rated movie has. It's 0 when no movie has been rated, and the recency part is 0
+// when w.HalfLife isn't positive. A movie added in the future counts as just added.
+func PopularityScore(in PopularityInput, maxRatingMass float64, w PopularityWeights, now time.Time) float64 {
+	score := math.Log1p(float64(in.Views)) * w.Views
+
+	if maxRatingMass > 0 {
+		score += in.AverageRating * float64(in.RatingsCount) / maxRatingMass * w.Ratings
+	}
+
+	if w.HalfLife > 0 {
+		age := now.Sub(in.CreatedAt)
+		if age < 0 {
+			age = 0
+		}
+
+		score += math.Exp2(-float64(age)/float64(w.HalfLife)) * w.Recency
+	}
+
+	return score
+}
+
+// AddViews adds the number of times each movie has been viewed, by ID, to its views.
+// Movies which have been deleted since are skipped.
+func (m MovieModel) AddViews(views map[int64]int64) error {
+	ids := make([]int64, 0, len(views))
+	values := make([]interface{}, 0, len(views))
+
+	for id, n := range views {
+		ids = append(ids, id)
+		values = append(values, n)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	return m.updateEach(ctx, "views = views + (SELECT value FROM v WHERE v.id = movies.id)", "bigint", ids, values)
+}
+
+// MaxRatingMass returns the largest average_rating times ratings_count of any movie,
+// which PopularityScore() normalizes the ratings by, or 0 if no movie has been rated.
+func (m MovieModel) MaxRatingMass() (float64, error) {
+	query := `SELECT COALESCE(max(average_rating * ratings_count), 0) FROM movies`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var mass float64
+
+	err := m.DB.QueryRowContext(ctx, query).Scan(&mass)
+	if err != nil {
+		return 0, err
+	}
+
+	return mass, nil
+}
+
+// RefreshPopularityBatch sets the popularity of up to limit movies whose IDs come after
+// afterID, in order of ID, to the score returned for each, and returns the last ID it
+// refreshed and how many there were, as ReindexBatch() does. Like the rating
+// aggregates, the popularity is derived, so neither the version nor updated_at is
+// changed.
+func (m MovieModel) RefreshPopularityBatch(afterID int64, limit int, score func(PopularityInput) float64) (lastID int64, count int, err error) {
+	query := `
+		SELECT id, views, ratings_count, average_rating, created_at
+		FROM movies
+		WHERE id > $1
+		ORDER BY id
+		LIMIT $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// Read from the primary, so that the views added by AddViews() just before are
+	// counted.
+	rows, err := m.DB.QueryContext(ctx, m.Dialect.Rebind(query), afterID, limit)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	defer rows.Close()
+
+	var (
+		ids    []int64
+		scores []interface{}
+	)
+
+	for rows.Next() {
+		var in PopularityInput
+
+		err := rows.Scan(&in.ID, &in.Views, &in.RatingsCount, &in.AverageRating, &in.CreatedAt)
+		if err != nil {
+			return 0, 0, err
+		}
+
+		ids = append(ids, in.ID)
+		scores = append(scores, score(in))
+		lastID = in.ID
+	}
+
+	if err = rows.Err(); err != nil {
+		return 0, 0, err
+	}
+
+	err = m.updateEach(ctx, "popularity = (SELECT value FROM v WHERE v.id = movies.id)", "double precision", ids, scores)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return lastID, len(ids), nil
+}
+
+// The updateEach() method applies the SET clause to each movie in ids, with a value of
+// its own, popularityUpdateBatch movies to a statement. The SET clause reads a movie's
+// value from the v table, whose rows are (id, value) pairs with the value cast to
+// valueType. The casts are written with CAST() rather than ::, which SQLite doesn't
+// support.
+func (m MovieModel) updateEach(ctx context.Context, set, valueType string, ids []int64, values []interface{}) error {
+	for start := 0; start < len(ids); start += popularityUpdateBatch {
+		end := start + popularityUpdateBatch
+		if end > len(ids) {
+			end = len(ids)
+		}
+
+		rows := make([]string, 0, end-start)
+		args := make([]interface{}, 0, 2*(end-start))
+
+		for i := start; i < end; i++ {
+			rows = append(rows, fmt.Sprintf("(CAST($%d AS bigint), CAST($%d AS %s))", len(args)+1, len(args)+2, valueType))
+			args = append(args, ids[i], values[i])
+		}
+
+		query := fmt.Sprintf(`
+			WITH v (id, value) AS (VALUES %s)
+			UPDATE movies
+			SET %s
+			WHERE id IN (SELECT id FROM v)`,
+			strings.Join(rows, ", "), set)
+
+		_, err := m.DB.ExecContext(ctx, m.Dialect.Rebind(query), args...)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
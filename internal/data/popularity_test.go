@@ -0,0 +1,149 @@
+package data
+
+import (
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPopularityScore(t *testing.T) {
+	now := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+	weights := PopularityWeights{Views: 1, Ratings: 3, Recency: 2, HalfLife: 30 * 24 * time.Hour}
+
+	tests := []struct {
+		name          string
+		in            PopularityInput
+		maxRatingMass float64
+		weights       PopularityWeights
+		want          float64
+	}{
+		{"nothing", PopularityInput{CreatedAt: now.AddDate(-10, 0, 0)}, 0, weights, 2 * math.Exp2(-float64(10*365+2)/30)},
+		{"just added", PopularityInput{CreatedAt: now}, 0, weights, 2},
+		{"added in the future", PopularityInput{CreatedAt: now.Add(time.Hour)}, 0, weights, 2},
+		{"one half life ago", PopularityInput{CreatedAt: now.Add(-30 * 24 * time.Hour)}, 0, weights, 1},
+		{"views", PopularityInput{Views: math.MaxInt32, CreatedAt: now}, 0, PopularityWeights{Views: 1}, math.Log1p(math.MaxInt32)},
+		{"nine views", PopularityInput{Views: 9, CreatedAt: now}, 0, PopularityWeights{Views: 2}, 2 * math.Log(10)},
+		{"most rated", PopularityInput{RatingsCount: 10, AverageRating: 8, CreatedAt: now}, 80, PopularityWeights{Ratings: 3}, 3},
+		{"half as rated", PopularityInput{RatingsCount: 5, AverageRating: 8, CreatedAt: now}, 80, PopularityWeights{Ratings: 3}, 1.5},
+		{"nothing rated", PopularityInput{CreatedAt: now}, 0, PopularityWeights{Ratings: 3}, 0},
+		{"no half life", PopularityInput{CreatedAt: now}, 0, PopularityWeights{Recency: 2}, 0},
+		{"everything", PopularityInput{Views: 99, RatingsCount: 4, AverageRating: 5, CreatedAt: now.Add(-60 * 24 * time.Hour)}, 40, weights, math.Log(100) + 1.5 + 0.5},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := PopularityScore(tt.in, tt.maxRatingMass, tt.weights, now)
+
+			if math.Abs(got-tt.want) > 1e-9 {
+				t.Errorf("got %v; want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// A movie with more views, better ratings or a more recent release scores higher, all
+// else being equal.
+func TestPopularityScoreOrder(t *testing.T) {
+	now := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+	weights := PopularityWeights{Views: 1, Ratings: 3, Recency: 2, HalfLife: 30 * 24 * time.Hour}
+	base := PopularityInput{Views: 10, RatingsCount: 5, AverageRating: 6, CreatedAt: now.AddDate(0, -1, 0)}
+
+	more := []PopularityInput{base, base, base, base}
+	more[0].Views++
+	more[1].RatingsCount++
+	more[2].AverageRating++
+	more[3].CreatedAt = more[3].CreatedAt.Add(time.Hour)
+
+	for i, in := range more {
+		if PopularityScore(in, 100, weights, now) <= PopularityScore(base, 100, weights, now) {
+			t.Errorf("%d: got %+v scoring no higher than %+v", i, in, base)
+		}
+	}
+}
+
+// AddViews() adds to the views, and RefreshPopularityBatch() scores every movie a
+// batch at a time, which the listing can then be sorted by.
+func TestMovieModelPopularity(t *testing.T) {
+	models := newTestMovieModels(t)
+	testPopularity(t, models)
+}
+
+func TestMockPopularity(t *testing.T) {
+	testPopularity(t, NewMockModels())
+}
+
+func testPopularity(t *testing.T, models Models) {
+	t.Helper()
+
+	var ids []int64
+
+	for _, title := range []string{"Casablanca", "Moana", "Up"} {
+		movie := &Movie{Title: title, Year: 2016, Runtime: 90, Genres: []string{"drama"}}
+
+		err := models.Movies.Insert(movie)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ids = append(ids, movie.ID)
+	}
+
+	err := models.Movies.AddViews(map[int64]int64{ids[1]: 5, ids[2]: 2, ids[2] + 1000: 7})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = models.Movies.AddViews(map[int64]int64{ids[2]: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Score each movie by its views, two to a batch.
+	scored := make(map[int64]int64)
+
+	for afterID := int64(0); ; {
+		lastID, count, err := models.Movies.RefreshPopularityBatch(afterID, 2, func(in PopularityInput) float64 {
+			scored[in.ID] = in.Views
+			return float64(in.Views)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if count < 2 {
+			break
+		}
+
+		afterID = lastID
+	}
+
+	want := map[int64]int64{ids[0]: 0, ids[1]: 5, ids[2]: 3}
+	if !reflect.DeepEqual(scored, want) {
+		t.Errorf("got views %v; want %v", scored, want)
+	}
+
+	movies, _, err := models.Movies.GetAll(MovieFilters{}, Filters{Page: 1, PageSize: 10, Sort: "-popularity", SortSafelist: MovieSortSafelist})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var titles []string
+	for _, movie := range movies {
+		titles = append(titles, movie.Title)
+	}
+
+	if !reflect.DeepEqual(titles, []string{"Moana", "Up", "Casablanca"}) {
+		t.Errorf("got %q by popularity; want Moana, Up and Casablanca", titles)
+	}
+
+	movie, err := models.Movies.Get(ids[1])
+	if err != nil || movie.Popularity != 5 || movie.Views != 5 {
+		t.Errorf("got movie %+v and error %v; want a popularity and views of 5", movie, err)
+	}
+
+	mass, err := models.Movies.MaxRatingMass()
+	if err != nil || mass != 0 {
+		t.Errorf("got a maximum rating mass of %v and error %v; want 0 with no ratings", mass, err)
+	}
+}
@@ -0,0 +1,138 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/petrostrak/an-open-movie-database/internal/validator"
+)
+
+// The locale for users who haven't chosen one.
+const DefaultLocale = "en"
+
+// The locales that clients can choose from.
+var SupportedLocales = []string{"en", "el", "de", "es", "fr", "it"}
+
+// Define a Preferences struct to hold the settings a user has stored. Every field is a
+// pointer, so that we can tell a preference which hasn't been set apart from one set to
+// its zero value. Unset preferences are omitted from the JSON.
+//
+// Digest and DigestGenres are the daily digest subscription, which is set with PUT
+// /v1/me/digest rather than alongside the others: whether the user is sent the digest
+// of new movies, and the genres it's limited to (every genre if there are none).
+type Preferences struct {
+	DefaultPageSize *int      `json:"default_page_size,omitempty"`
+	DefaultSort     *string   `json:"default_sort,omitempty"`
+	Locale          *string   `json:"locale,omitempty"`
+	Digest          *bool     `json:"digest,omitempty"`
+	DigestGenres    *[]string `json:"digest_genres,omitempty"`
+}
+
+func ValidatePreferences(v *validator.Validator, preferences *Preferences) {
+	if preferences.DefaultPageSize != nil {
+		v.Check(*preferences.DefaultPageSize > 0, "default_page_size", validator.Msg("greater_than_zero"))
+		v.Check(*preferences.DefaultPageSize <= maxPageSize, "default_page_size", validator.Msg("maximum", "n", maxPageSize))
+	}
+
+	if preferences.DefaultSort != nil {
+		v.Check(validator.In(*preferences.DefaultSort, MovieSortSafelist...), "default_sort", validator.Msg("invalid_sort"))
+	}
+
+	if preferences.Locale != nil {
+		v.Check(validator.In(*preferences.Locale, SupportedLocales...), "locale", validator.Msg("unsupported_locale"))
+	}
+
+	if preferences.DigestGenres != nil {
+		genres := *preferences.DigestGenres
+
+		v.Check(len(genres) <= 10, "genres", validator.Msg("genres_max", "n", 10))
+		validator.ValidateEach(v, "genres", genres, func(v *validator.Validator, genre string) {
+			v.Check(strings.TrimSpace(genre) != "", "", validator.Msg("empty"))
+		})
+		v.Check(validator.UniqueFold(genres), "genres", validator.Msg("duplicate_values"))
+	}
+}
+
+// Define the PreferencesModel type. Preferences are stored as a jsonb object in the
+// preferences column of the users table.
+type PreferencesModel struct {
+	DB      Querier
+	ReadDB  Querier
+	Dialect Dialect
+}
+
+// Get returns the stored preferences for a specific user.
+func (m PreferencesModel) Get(userID int64) (*Preferences, error) {
+	query := `
+		SELECT preferences
+		FROM users
+		WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var js []byte
+
+	err := m.ReadDB.QueryRowContext(ctx, m.Dialect.Rebind(query), userID).Scan(&js)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	var preferences Preferences
+
+	err = json.Unmarshal(js, &preferences)
+	if err != nil {
+		return nil, err
+	}
+
+	return &preferences, nil
+}
+
+// Update merges the preferences which are set into the user's stored preferences,
+// leaving any others unchanged, and returns the result.
+func (m PreferencesModel) Update(userID int64, preferences *Preferences) (*Preferences, error) {
+	patch, err := json.Marshal(preferences)
+	if err != nil {
+		return nil, err
+	}
+
+	query := fmt.Sprintf(`
+		UPDATE users
+		SET preferences = %s
+		WHERE id = $2
+		RETURNING preferences`, m.Dialect.JSONMerge("preferences", "$1"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var js []byte
+
+	err = m.DB.QueryRowContext(ctx, m.Dialect.Rebind(query), string(patch), userID).Scan(&js)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	var merged Preferences
+
+	err = json.Unmarshal(js, &merged)
+	if err != nil {
+		return nil, err
+	}
+
+	return &merged, nil
+}
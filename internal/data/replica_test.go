@@ -0,0 +1,94 @@
+package data
+
+import (
+	"crypto/sha256"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/petrostrak/an-open-movie-database/internal/testdb"
+)
+
+// The replica here is a second, empty database, which stands in for a read replica
+// which the writes on the primary haven't reached yet.
+func TestAuthorizationReadsUsePrimary(t *testing.T) {
+	driverName, primary := testdb.Open(t)
+	_, replica := testdb.Open(t)
+
+	models, err := NewModelsForDriver(driverName, primary, replica)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user := &User{Name: "Alice", Username: "alice", Email: "alice@example.com", Activated: true}
+
+	err = user.Password.Set("pa55word1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = models.Users.Insert(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := models.Tokens.New(user.ID, time.Hour, ScopeAuthentication)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = models.Permissions.AddForUser(user.ID, "movies:read")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := models.Users.GetForToken(ScopeAuthentication, token.Plaintext)
+	if err != nil {
+		t.Fatalf("GetForToken: %v", err)
+	}
+	if got.ID != user.ID {
+		t.Errorf("GetForToken returned user %d; want %d", got.ID, user.ID)
+	}
+
+	_, err = models.Users.GetVersionForToken(ScopeAuthentication, sha256.Sum256([]byte(token.Plaintext)))
+	if err != nil {
+		t.Errorf("GetVersionForToken: %v", err)
+	}
+
+	permissions, err := models.Permissions.GetAllForUser(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !permissions.Include("movies:read") {
+		t.Errorf("got permissions %v; want movies:read", permissions)
+	}
+
+	// Revoking the token and the permission on the primary takes effect straight away.
+	err = models.Tokens.Delete(ScopeAuthentication, token.Plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = models.Permissions.RemoveForUser(user.ID, "movies:read")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = models.Users.GetForToken(ScopeAuthentication, token.Plaintext)
+	if !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("GetForToken after delete: got %v; want ErrRecordNotFound", err)
+	}
+
+	_, err = models.Users.GetVersionForToken(ScopeAuthentication, sha256.Sum256([]byte(token.Plaintext)))
+	if !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("GetVersionForToken after delete: got %v; want ErrRecordNotFound", err)
+	}
+
+	permissions, err = models.Permissions.GetAllForUser(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if permissions.Include("movies:read") {
+		t.Errorf("got permissions %v after revoking movies:read", permissions)
+	}
+}
@@ -0,0 +1,293 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/petrostrak/an-open-movie-database/internal/validator"
+)
+
+// The statuses of a report. Every report starts out open, and is closed by an editor
+// as resolved, once the movie has been fixed, or dismissed.
+const (
+	ReportOpen      = "open"
+	ReportResolved  = "resolved"
+	ReportDismissed = "dismissed"
+)
+
+// The most open reports that each user can have at once.
+const MaxOpenReports = 5
+
+// The fields of a movie that a report can be about.
+var ReportFields = []string{"title", "year", "runtime", "genres", "awards", "external_ratings", "plot", "poster", "other"}
+
+// Define the error returned when a user already has MaxOpenReports open reports.
+var ErrReportLimit = errors.New("too many open reports")
+
+// Define a Report struct to hold a user's report of incorrect data about a movie. The
+// resolution is the note an editor left when closing it, which the user can see.
+type Report struct {
+	ID         int64      `json:"id"`
+	MovieID    int64      `json:"movie_id"`
+	MovieTitle string     `json:"movie_title"`
+	UserID     int64      `json:"user_id"`
+	Field      string     `json:"field"`
+	Message    string     `json:"message"`
+	Status     string     `json:"status"`
+	Resolution string     `json:"resolution,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ClosedAt   *time.Time `json:"closed_at,omitempty"`
+}
+
+func ValidateReport(v *validator.Validator, report *Report) {
+	v.Check(validator.In(report.Field, ReportFields...), "field", validator.Msg("report_field", "fields", strings.Join(ReportFields, ", ")))
+
+	v.Check(report.Message != "", "message", validator.Msg("required"))
+	v.Check(validator.MaxBytes(report.Message, 1000), "message", validator.Msg("max_bytes", "n", 1000))
+}
+
+// ValidateReportStatus checks that a report can be moved from one status to another.
+// An open report can be resolved or dismissed, and a closed one can be opened again,
+// but a report can't go straight from resolved to dismissed or back.
+func ValidateReportStatus(v *validator.Validator, from, to, resolution string) {
+	if v.Check(validator.In(to, ReportOpen, ReportResolved, ReportDismissed), "status", validator.Msg("invalid_status")); !v.Valid() {
+		return
+	}
+
+	v.Check((from == ReportOpen) != (to == ReportOpen), "status", validator.Msg("report_status_change", "from", from, "to", to))
+
+	v.Check(validator.MaxBytes(resolution, 1000), "resolution", validator.Msg("max_bytes", "n", 1000))
+	v.Check(to != ReportOpen || resolution == "", "resolution", validator.Msg("resolution_open"))
+}
+
+// Define the ReportModel type.
+type ReportModel struct {
+	DB      Querier
+	ReadDB  Querier
+	Dialect Dialect
+}
+
+// Insert adds an open report, and fills in its ID, the movie's title and the time it
+// was made. It returns ErrRecordNotFound if there's no such movie, and ErrReportLimit
+// if the user already has MaxOpenReports open reports.
+func (m ReportModel) Insert(report *Report) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := beginTx(ctx, m.DB)
+	if err != nil {
+		return err
+	}
+
+	// Rollback() is a no-op if the transaction has already been committed.
+	defer tx.Rollback()
+
+	// Lock the user, so that two requests can't both add the user's last report.
+	_, err = tx.ExecContext(ctx, m.Dialect.Rebind(`SELECT id FROM users WHERE id = $1 `+m.Dialect.RowLock("FOR UPDATE")), report.UserID)
+	if err != nil {
+		return err
+	}
+
+	var count int
+
+	err = tx.QueryRowContext(ctx, m.Dialect.Rebind(`SELECT count(*) FROM reports WHERE user_id = $1 AND status = 'open'`), report.UserID).Scan(&count)
+	if err != nil {
+		return err
+	}
+
+	if count >= MaxOpenReports {
+		return ErrReportLimit
+	}
+
+	query := `
+		INSERT INTO reports (movie_id, user_id, field, message)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, status, created_at, (SELECT title FROM movies WHERE movies.id = reports.movie_id)`
+
+	args := []interface{}{report.MovieID, report.UserID, report.Field, report.Message}
+
+	err = tx.QueryRowContext(ctx, m.Dialect.Rebind(query), args...).Scan(&report.ID, &report.Status, &report.CreatedAt, &report.MovieTitle)
+	if err != nil {
+		switch {
+		case m.Dialect.ForeignKeyViolation(err, "reports", "reports_movie_id_fkey"):
+			return ErrRecordNotFound
+		default:
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Get returns a report, or ErrRecordNotFound.
+func (m ReportModel) Get(id int64) (*Report, error) {
+	query := `
+		SELECT reports.id, reports.movie_id, movies.title, reports.user_id, reports.field, reports.message,
+			reports.status, reports.resolution, reports.created_at, reports.closed_at
+		FROM reports
+		INNER JOIN movies ON movies.id = reports.movie_id
+		WHERE reports.id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var report Report
+
+	err := m.DB.QueryRowContext(ctx, m.Dialect.Rebind(query), id).Scan(
+		&report.ID,
+		&report.MovieID,
+		&report.MovieTitle,
+		&report.UserID,
+		&report.Field,
+		&report.Message,
+		&report.Status,
+		&report.Resolution,
+		&report.CreatedAt,
+		&report.ClosedAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &report, nil
+}
+
+// GetAll returns a page of the reports with a status, with the pagination metadata.
+func (m ReportModel) GetAll(status string, filters Filters) ([]*Report, Metadata, error) {
+	query := fmt.Sprintf(`
+		SELECT count(*) OVER(), reports.id, reports.movie_id, movies.title, reports.user_id, reports.field, reports.message,
+			reports.status, reports.resolution, reports.created_at, reports.closed_at
+		FROM reports
+		INNER JOIN movies ON movies.id = reports.movie_id
+		WHERE reports.status = $1
+		ORDER BY reports.%s %s, reports.id ASC
+		LIMIT $2 OFFSET $3`, filters.sortColumn(), filters.sortDirection())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.ReadDB.QueryContext(ctx, m.Dialect.Rebind(query), status, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	reports := []*Report{}
+
+	for rows.Next() {
+		var report Report
+
+		err := rows.Scan(
+			&totalRecords,
+			&report.ID,
+			&report.MovieID,
+			&report.MovieTitle,
+			&report.UserID,
+			&report.Field,
+			&report.Message,
+			&report.Status,
+			&report.Resolution,
+			&report.CreatedAt,
+			&report.ClosedAt,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		reports = append(reports, &report)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.limit())
+
+	return reports, metadata, nil
+}
+
+// GetAllForUser returns the reports a user has made, newest first.
+func (m ReportModel) GetAllForUser(userID int64) ([]*Report, error) {
+	query := `
+		SELECT reports.id, reports.movie_id, movies.title, reports.user_id, reports.field, reports.message,
+			reports.status, reports.resolution, reports.created_at, reports.closed_at
+		FROM reports
+		INNER JOIN movies ON movies.id = reports.movie_id
+		WHERE reports.user_id = $1
+		ORDER BY reports.id DESC`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.ReadDB.QueryContext(ctx, m.Dialect.Rebind(query), userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	reports := []*Report{}
+
+	for rows.Next() {
+		var report Report
+
+		err := rows.Scan(
+			&report.ID,
+			&report.MovieID,
+			&report.MovieTitle,
+			&report.UserID,
+			&report.Field,
+			&report.Message,
+			&report.Status,
+			&report.Resolution,
+			&report.CreatedAt,
+			&report.ClosedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		reports = append(reports, &report)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return reports, nil
+}
+
+// UpdateStatus saves report.Status and report.Resolution, and sets report.ClosedAt. It
+// returns ErrEditConflict if the report's status is no longer from, because another
+// editor changed it first.
+func (m ReportModel) UpdateStatus(report *Report, from string) error {
+	query := `
+		UPDATE reports
+		SET status = $2, resolution = $3, closed_at = CASE WHEN $2 = 'open' THEN NULL ELSE NOW() END
+		WHERE id = $1 AND status = $4
+		RETURNING closed_at`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, m.Dialect.Rebind(query), report.ID, report.Status, report.Resolution, from).Scan(&report.ClosedAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
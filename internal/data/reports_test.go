@@ -0,0 +1,87 @@
+package data
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/petrostrak/an-open-movie-database/internal/testdb"
+)
+
+func TestReportModel(t *testing.T) {
+	driverName, db := testdb.Open(t)
+
+	models, err := NewModelsForDriver(driverName, db, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user := &User{Name: "alice", Username: "alice", Email: "alice@example.com", Activated: true}
+
+	err = user.Password.Set("pa55word1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = models.Users.Insert(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	movie := &Movie{Title: "Moana", Year: 2016, Runtime: 107, Genres: []string{"animation"}}
+
+	err = models.Movies.Insert(movie)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report := &Report{MovieID: movie.ID, UserID: user.ID, Field: "runtime", Message: "actually 142 mins"}
+
+	err = models.Reports.Insert(report)
+	if err != nil || report.Status != ReportOpen || report.MovieTitle != "Moana" {
+		t.Fatalf("got report %+v and error %v; want an open report", report, err)
+	}
+
+	err = models.Reports.Insert(&Report{MovieID: movie.ID + 1000, UserID: user.ID, Field: "year", Message: "wrong"})
+	if !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("got error %v for a missing movie; want ErrRecordNotFound", err)
+	}
+
+	for i := 1; i < MaxOpenReports; i++ {
+		err := models.Reports.Insert(&Report{MovieID: movie.ID, UserID: user.ID, Field: "year", Message: "wrong"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = models.Reports.Insert(&Report{MovieID: movie.ID, UserID: user.ID, Field: "year", Message: "wrong"})
+	if !errors.Is(err, ErrReportLimit) {
+		t.Errorf("got error %v; want ErrReportLimit", err)
+	}
+
+	report.Status, report.Resolution = ReportResolved, "Fixed"
+
+	err = models.Reports.UpdateStatus(report, ReportOpen)
+	if err != nil || report.ClosedAt == nil {
+		t.Fatalf("got closed_at %v and error %v; want the report closed", report.ClosedAt, err)
+	}
+
+	// The report is no longer open, so a second editor's change conflicts.
+	if err := models.Reports.UpdateStatus(report, ReportOpen); !errors.Is(err, ErrEditConflict) {
+		t.Errorf("got error %v; want ErrEditConflict", err)
+	}
+
+	got, err := models.Reports.Get(report.ID)
+	if err != nil || got.Status != ReportResolved || got.Resolution != "Fixed" {
+		t.Errorf("got report %+v and error %v; want it resolved", got, err)
+	}
+
+	reports, metadata, err := models.Reports.GetAll(ReportOpen, Filters{Page: 1, PageSize: 20, Sort: "id", SortSafelist: []string{"id"}})
+	if err != nil || len(reports) != MaxOpenReports-1 || metadata.TotalRecords != MaxOpenReports-1 {
+		t.Errorf("got %d open reports and error %v; want %d", len(reports), err, MaxOpenReports-1)
+	}
+
+	reports, err = models.Reports.GetAllForUser(user.ID)
+	if err != nil || len(reports) != MaxOpenReports || reports[len(reports)-1].ID != report.ID {
+		t.Errorf("got %d reports and error %v; want %d, newest first", len(reports), err, MaxOpenReports)
+	}
+}
@@ -0,0 +1,150 @@
+package data
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Define a Role struct to represent a named set of permissions.
+type Role struct {
+	ID          int64       `json:"id"`
+	Name        string      `json:"name"`
+	Permissions Permissions `json:"permissions"`
+}
+
+// Define the RoleModel type.
+type RoleModel struct {
+	DB      Querier
+	ReadDB  Querier
+	Dialect Dialect
+}
+
+// The GetAll() returns every role along with its permission codes.
+func (m RoleModel) GetAll() ([]*Role, error) {
+	query := fmt.Sprintf(`
+		SELECT roles.id, roles.name, %s
+		FROM roles
+		LEFT JOIN role_permissions ON role_permissions.role_id = roles.id
+		LEFT JOIN permissions ON role_permissions.permission_id = permissions.id
+		GROUP BY roles.id
+		ORDER BY roles.id`, m.Dialect.ArrayAgg("permissions.code"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.ReadDB.QueryContext(ctx, m.Dialect.Rebind(query))
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	roles := []*Role{}
+
+	for rows.Next() {
+		var role Role
+
+		err := rows.Scan(&role.ID, &role.Name, m.Dialect.ScanArray((*[]string)(&role.Permissions)))
+		if err != nil {
+			return nil, err
+		}
+
+		roles = append(roles, &role)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return roles, nil
+}
+
+// The GetAllForUser() returns the names of the roles assigned to a specific user.
+func (m RoleModel) GetAllForUser(userID int64) ([]string, error) {
+	query := `
+		SELECT roles.name
+		FROM roles
+		INNER JOIN user_roles ON user_roles.role_id = roles.id
+		WHERE user_roles.user_id = $1
+		ORDER BY roles.name`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.ReadDB.QueryContext(ctx, m.Dialect.Rebind(query), userID)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	names := []string{}
+
+	for rows.Next() {
+		var name string
+
+		err := rows.Scan(&name)
+		if err != nil {
+			return nil, err
+		}
+
+		names = append(names, name)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return names, nil
+}
+
+// Assign the named roles to a specific user, in addition to any they already have.
+func (m RoleModel) AddForUser(userID int64, names ...string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return addRolesForUser(ctx, m.DB, m.Dialect, userID, names...)
+}
+
+// The addRolesForUser() helper runs the insert for AddForUser() and UserModel.Register().
+func addRolesForUser(ctx context.Context, db Querier, dialect Dialect, userID int64, names ...string) error {
+	query := fmt.Sprintf(`
+		INSERT INTO user_roles
+		SELECT $1, roles.id FROM roles WHERE %s
+		ON CONFLICT DO NOTHING`, dialect.In("roles.name", "$2"))
+
+	_, err := db.ExecContext(ctx, dialect.Rebind(query), userID, dialect.Array(names))
+	return err
+}
+
+// Replace the set of roles assigned to a specific user with the named roles. Both
+// statements run in a transaction, so the user is never left with a partial set.
+func (m RoleModel) SetForUser(userID int64, names ...string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := beginTx(ctx, m.DB)
+	if err != nil {
+		return err
+	}
+
+	// Rollback() is a no-op if the transaction has already been committed.
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, m.Dialect.Rebind(`
+		DELETE FROM user_roles
+		WHERE user_id = $1`), userID)
+	if err != nil {
+		return err
+	}
+
+	query := fmt.Sprintf(`
+		INSERT INTO user_roles
+		SELECT $1, roles.id FROM roles WHERE %s`, m.Dialect.In("roles.name", "$2"))
+
+	_, err = tx.ExecContext(ctx, m.Dialect.Rebind(query), userID, m.Dialect.Array(names))
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
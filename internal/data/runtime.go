@@ -38,27 +38,47 @@ func (r Runtime) MarshalJSON() ([]byte, error) {
 // receiver (our Runtime type), we must use a pointer receiver for this to work
 // correctly. Otherwise, we will only be modifying a copy (which is then discarded when
 // this method returns).
+//
+// The runtime can be sent as a bare JSON number of minutes, a string containing the
+// number, or a string in the "<runtime> mins" format, so 107, "107" and "107 mins" are
+// all accepted. Whitespace around the parts of a string is ignored.
 func (r *Runtime) UnmarshalJSON(jsonValue []byte) error {
-	// We expect that the incoming JSON value will be a string in the format
-	// "<runtime> mins", and the first thing we need to do is remove the surrounding
-	// double-quotes from the string. If we cannot unquote it, then we return the
-	// ErrInvalidRuntimeFormat error.
-	unquotedJSONValue, err := strconv.Unquote(string(jsonValue))
-	if err != nil {
-		return ErrInvalidRuntimeFormat
-	}
+	// A bare number is handled just like the number part of a string, so that the same
+	// rules apply to both.
+	value := string(jsonValue)
 
-	// Split the string to isolate the part containing the number.
-	parts := strings.Split(unquotedJSONValue, " ")
+	// If the value is a string, remove the surrounding double-quotes. If we cannot
+	// unquote it, then we return the ErrInvalidRuntimeFormat error.
+	if strings.HasPrefix(value, `"`) {
+		unquotedJSONValue, err := strconv.Unquote(value)
+		if err != nil {
+			return ErrInvalidRuntimeFormat
+		}
 
-	// Sanity check the parts of the string to kame sure it was in the
-	// expected format. If it isn't, we return the ErrInvalidRuntimeFormat again.
-	if len(parts) != 2 || parts[1] != "mins" {
+		// Split the string to isolate the part containing the number, and sanity check
+		// the parts to make sure it was in one of the expected formats. If it isn't, we
+		// return the ErrInvalidRuntimeFormat again.
+		parts := strings.Fields(unquotedJSONValue)
+
+		switch {
+		case len(parts) == 1:
+		case len(parts) == 2 && parts[1] == "mins":
+		default:
+			return ErrInvalidRuntimeFormat
+		}
+
+		value = parts[0]
+	}
+
+	// Only accept whole, non-negative numbers of minutes written with plain digits, so
+	// that fractions, signs and exponents are rejected rather than rounded or parsed.
+	if value == "" || strings.Trim(value, "0123456789") != "" {
 		return ErrInvalidRuntimeFormat
 	}
 
-	// Otherwise, parse the string containing the number into an int32.
-	i, err := strconv.ParseInt(parts[0], 10, 32)
+	// Otherwise, parse the string containing the number into an int32. This fails for
+	// a number which is too large.
+	i, err := strconv.ParseInt(value, 10, 32)
 	if err != nil {
 		return ErrInvalidRuntimeFormat
 	}
@@ -70,3 +90,14 @@ func (r *Runtime) UnmarshalJSON(jsonValue []byte) error {
 
 	return nil
 }
+
+// MarshalText() and UnmarshalText() encode the runtime in the same "<runtime> mins"
+// format for encoding/xml, which uses them for the content of the <runtime> element.
+// The JSON encoding still goes through MarshalJSON() and UnmarshalJSON().
+func (r Runtime) MarshalText() ([]byte, error) {
+	return []byte(fmt.Sprintf("%d mins", r)), nil
+}
+
+func (r *Runtime) UnmarshalText(text []byte) error {
+	return r.UnmarshalJSON([]byte(strconv.Quote(string(text))))
+}
@@ -0,0 +1,109 @@
+package data
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestRuntimeUnmarshalJSON(t *testing.T) {
+	tests := []struct {
+		name    string
+		json    string
+		want    Runtime
+		wantErr bool
+	}{
+		{"mins string", `"107 mins"`, 107, false},
+		{"quoted integer", `"107"`, 107, false},
+		{"bare integer", `107`, 107, false},
+		{"zero", `0`, 0, false},
+		{"zero mins", `"0 mins"`, 0, false},
+		{"leading zeros", `"007 mins"`, 7, false},
+		{"largest", `2147483647`, 2147483647, false},
+		{"largest mins", `"2147483647 mins"`, 2147483647, false},
+		{"leading space", `" 107 mins"`, 107, false},
+		{"trailing space", `"107 mins "`, 107, false},
+		{"double space", `"107  mins"`, 107, false},
+		{"tab", `"107\tmins"`, 107, false},
+		{"padded quoted integer", `" 107 "`, 107, false},
+
+		{"negative", `-5`, 0, true},
+		{"negative string", `"-5"`, 0, true},
+		{"negative mins", `"-5 mins"`, 0, true},
+		{"plus sign", `"+5 mins"`, 0, true},
+		{"fraction", `107.5`, 0, true},
+		{"whole fraction", `107.0`, 0, true},
+		{"fraction string", `"107.5"`, 0, true},
+		{"fraction mins", `"107.5 mins"`, 0, true},
+		{"exponent", `1e2`, 0, true},
+		{"overflow", `2147483648`, 0, true},
+		{"overflow mins", `"2147483648 mins"`, 0, true},
+		{"huge", `99999999999999999999999`, 0, true},
+		{"no space", `"107mins"`, 0, true},
+		{"wrong unit", `"107 minutes"`, 0, true},
+		{"unit only", `"mins"`, 0, true},
+		{"unit first", `"mins 107"`, 0, true},
+		{"extra part", `"107 mins long"`, 0, true},
+		{"empty string", `""`, 0, true},
+		{"blank string", `"   "`, 0, true},
+		{"hex", `"0x6b"`, 0, true},
+		{"words", `"one hundred and seven mins"`, 0, true},
+		{"bool", `true`, 0, true},
+		{"null", `null`, 0, true},
+		{"array", `[107]`, 0, true},
+		{"object", `{"mins": 107}`, 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var r Runtime
+
+			err := json.Unmarshal([]byte(tt.json), &r)
+			if tt.wantErr {
+				if !errors.Is(err, ErrInvalidRuntimeFormat) {
+					t.Errorf("got runtime %d and error %v for %s; want ErrInvalidRuntimeFormat", r, err, tt.json)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("got error %v for %s", err, tt.json)
+			}
+
+			if r != tt.want {
+				t.Errorf("got runtime %d for %s; want %d", r, tt.json, tt.want)
+			}
+		})
+	}
+}
+
+func TestRuntimeMarshalJSON(t *testing.T) {
+	tests := []struct {
+		runtime Runtime
+		want    string
+	}{
+		{0, `"0 mins"`},
+		{1, `"1 mins"`},
+		{107, `"107 mins"`},
+		{2147483647, `"2147483647 mins"`},
+	}
+
+	for _, tt := range tests {
+		js, err := json.Marshal(tt.runtime)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(js) != tt.want {
+			t.Errorf("got %s for %d; want %s", js, tt.runtime, tt.want)
+		}
+
+		// What's sent can be read back.
+		var r Runtime
+
+		err = json.Unmarshal(js, &r)
+		if err != nil || r != tt.runtime {
+			t.Errorf("got %d and error %v reading back %s; want %d", r, err, js, tt.runtime)
+		}
+	}
+}
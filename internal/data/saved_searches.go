@@ -0,0 +1,237 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"sort"
+	"time"
+
+	"github.com/petrostrak/an-open-movie-database/internal/validator"
+)
+
+// The most saved searches that each user can have.
+const MaxSavedSearches = 20
+
+// The query string parameters of a movie listing that a saved search can store. The
+// page isn't among them, so that the results of a saved search can be paged through.
+var SavedSearchParams = []string{"title", "genres", "has_awards", "created_by", "sort", "page_size"}
+
+// Define the errors returned when a user already has a saved search with the same name,
+// and when they already have MaxSavedSearches of them.
+var (
+	ErrDuplicateSearchName = errors.New("duplicate saved search name")
+	ErrSavedSearchLimit    = errors.New("too many saved searches")
+)
+
+// Define a SavedSearch struct to hold a movie listing that a user has stored under a
+// name, so that they can run it again without building the query string each time.
+type SavedSearch struct {
+	ID        int64       `json:"id"`
+	UserID    int64       `json:"-"`
+	Name      string      `json:"name"`
+	Query     SearchQuery `json:"query"`
+	CreatedAt time.Time   `json:"created_at"`
+}
+
+// Define a SearchQuery type to hold the query string parameters of a saved search. It's
+// stored as a jsonb object of strings.
+type SearchQuery map[string]string
+
+// Value implements the driver.Valuer interface.
+func (q SearchQuery) Value() (driver.Value, error) {
+	if q == nil {
+		return "{}", nil
+	}
+
+	b, err := json.Marshal(q)
+	if err != nil {
+		return nil, err
+	}
+
+	return string(b), nil
+}
+
+// Scan implements the sql.Scanner interface.
+func (q *SearchQuery) Scan(src interface{}) error {
+	return scanJSONColumn(src, q)
+}
+
+// Values returns the parameters as a url.Values map, like the query string of a request
+// for the listing.
+func (q SearchQuery) Values() url.Values {
+	values := make(url.Values, len(q))
+	for key, value := range q {
+		values.Set(key, value)
+	}
+
+	return values
+}
+
+func ValidateSavedSearch(v *validator.Validator, search *SavedSearch) {
+	v.Check(search.Name != "", "name", validator.Msg("required"))
+	v.Check(validator.MaxBytes(search.Name, 100), "name", validator.Msg("max_bytes", "n", 100))
+
+	// Sort the keys, so that the messages come out in the same order each time.
+	keys := make([]string, 0, len(search.Query))
+	for key := range search.Query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		v.Check(validator.In(key, SavedSearchParams...), "query."+key, validator.Msg("unsupported_search_param"))
+	}
+}
+
+// Define the SavedSearchModel type.
+type SavedSearchModel struct {
+	DB      Querier
+	ReadDB  Querier
+	Dialect Dialect
+}
+
+// Insert adds a saved search for search.UserID. It returns ErrDuplicateSearchName if
+// the user already has a search with the same name, ignoring case, and
+// ErrSavedSearchLimit if they already have MaxSavedSearches.
+func (m SavedSearchModel) Insert(search *SavedSearch) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := beginTx(ctx, m.DB)
+	if err != nil {
+		return err
+	}
+
+	// Rollback() is a no-op if the transaction has already been committed.
+	defer tx.Rollback()
+
+	// Lock the user, so that two requests can't both add the user's last search.
+	_, err = tx.ExecContext(ctx, m.Dialect.Rebind(`SELECT id FROM users WHERE id = $1 `+m.Dialect.RowLock("FOR UPDATE")), search.UserID)
+	if err != nil {
+		return err
+	}
+
+	var count int
+
+	err = tx.QueryRowContext(ctx, m.Dialect.Rebind(`SELECT count(*) FROM saved_searches WHERE user_id = $1`), search.UserID).Scan(&count)
+	if err != nil {
+		return err
+	}
+
+	if count >= MaxSavedSearches {
+		return ErrSavedSearchLimit
+	}
+
+	query := `
+		INSERT INTO saved_searches (user_id, name, query)
+		VALUES ($1, $2, $3)
+		RETURNING id, created_at`
+
+	err = tx.QueryRowContext(ctx, m.Dialect.Rebind(query), search.UserID, search.Name, search.Query).Scan(&search.ID, &search.CreatedAt)
+	if err != nil {
+		if m.Dialect.UniqueViolation(err, "saved_searches_user_name_idx") {
+			return ErrDuplicateSearchName
+		}
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// GetAllForUser returns a user's saved searches, in the order they were added.
+func (m SavedSearchModel) GetAllForUser(userID int64) ([]*SavedSearch, error) {
+	query := `
+		SELECT id, user_id, name, query, created_at
+		FROM saved_searches
+		WHERE user_id = $1
+		ORDER BY id`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.ReadDB.QueryContext(ctx, m.Dialect.Rebind(query), userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	searches := []*SavedSearch{}
+
+	for rows.Next() {
+		var search SavedSearch
+
+		err := rows.Scan(&search.ID, &search.UserID, &search.Name, &search.Query, &search.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		searches = append(searches, &search)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return searches, nil
+}
+
+// GetForUser returns one of a user's saved searches. Another user's search is reported
+// as ErrRecordNotFound, so that its ID doesn't give away that it exists.
+func (m SavedSearchModel) GetForUser(id, userID int64) (*SavedSearch, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `
+		SELECT id, user_id, name, query, created_at
+		FROM saved_searches
+		WHERE id = $1 AND user_id = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var search SavedSearch
+
+	err := m.ReadDB.QueryRowContext(ctx, m.Dialect.Rebind(query), id, userID).Scan(&search.ID, &search.UserID, &search.Name, &search.Query, &search.CreatedAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &search, nil
+}
+
+// DeleteForUser removes one of a user's saved searches, returning ErrRecordNotFound if
+// they don't have one with that ID.
+func (m SavedSearchModel) DeleteForUser(id, userID int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, m.Dialect.Rebind(`DELETE FROM saved_searches WHERE id = $1 AND user_id = $2`), id, userID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
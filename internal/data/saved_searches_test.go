@@ -0,0 +1,95 @@
+package data
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/petrostrak/an-open-movie-database/internal/testdb"
+)
+
+func TestSavedSearchModel(t *testing.T) {
+	driverName, db := testdb.Open(t)
+
+	models, err := NewModelsForDriver(driverName, db, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var users []*User
+
+	for _, name := range []string{"alice", "bob"} {
+		user := &User{Name: name, Username: name, Email: name + "@example.com", Activated: true}
+
+		err := user.Password.Set("pa55word1234")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = models.Users.Insert(user)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		users = append(users, user)
+	}
+
+	alice, bob := users[0], users[1]
+
+	search := &SavedSearch{UserID: alice.ID, Name: "Dramas", Query: SearchQuery{"genres": "drama", "sort": "-year"}}
+
+	err = models.SavedSearches.Insert(search)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := models.SavedSearches.GetForUser(search.ID, alice.ID)
+	if err != nil || got.Name != "Dramas" || got.Query["genres"] != "drama" || got.Query["sort"] != "-year" {
+		t.Errorf("got search %+v and error %v; want the saved search", got, err)
+	}
+
+	if _, err := models.SavedSearches.GetForUser(search.ID, bob.ID); !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("got error %v for another user's search; want ErrRecordNotFound", err)
+	}
+
+	// Names are unique per user, ignoring case.
+	err = models.SavedSearches.Insert(&SavedSearch{UserID: alice.ID, Name: "DRAMAS"})
+	if !errors.Is(err, ErrDuplicateSearchName) {
+		t.Errorf("got error %v; want ErrDuplicateSearchName", err)
+	}
+
+	err = models.SavedSearches.Insert(&SavedSearch{UserID: bob.ID, Name: "Dramas"})
+	if err != nil {
+		t.Errorf("got error %v saving another user's search with the same name; want nil", err)
+	}
+
+	for i := 1; i < MaxSavedSearches; i++ {
+		err := models.SavedSearches.Insert(&SavedSearch{UserID: alice.ID, Name: fmt.Sprintf("Search %d", i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = models.SavedSearches.Insert(&SavedSearch{UserID: alice.ID, Name: "One too many"})
+	if !errors.Is(err, ErrSavedSearchLimit) {
+		t.Errorf("got error %v; want ErrSavedSearchLimit", err)
+	}
+
+	searches, err := models.SavedSearches.GetAllForUser(alice.ID)
+	if err != nil || len(searches) != MaxSavedSearches || searches[0].ID != search.ID {
+		t.Errorf("got %d searches and error %v; want %d, oldest first", len(searches), err, MaxSavedSearches)
+	}
+
+	if err := models.SavedSearches.DeleteForUser(search.ID, bob.ID); !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("got error %v deleting another user's search; want ErrRecordNotFound", err)
+	}
+
+	err = models.SavedSearches.DeleteForUser(search.ID, alice.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := models.SavedSearches.GetForUser(search.ID, alice.ID); !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("got error %v for a deleted search; want ErrRecordNotFound", err)
+	}
+}
@@ -0,0 +1,213 @@
+package seed
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/petrostrak/an-open-movie-database/internal/data"
+)
+
+// Load inserts the dataset into a database opened with the named driver
+// (data.DriverPostgres or data.DriverSQLite), batchSize rows at a time with
+// each batch in its own transaction, so that a large catalog doesn't hold one
+// transaction open for the whole load. The users go in first, in one transaction, so
+// that a database which already has them is rejected before anything else is written.
+// If a later batch fails, the ones before it stay in the database.
+//
+// The movies' rating aggregates are rebuilt at the end, once the ratings are in.
+func (d *Dataset) Load(ctx context.Context, driverName string, db *sql.DB, batchSize int) error {
+	if batchSize < 1 {
+		return errors.New("the batch size must be at least 1")
+	}
+
+	dialect, err := data.DialectFor(driverName)
+	if err != nil {
+		return err
+	}
+
+	userIDs := make([]int64, len(d.Users))
+
+	err = inTx(ctx, db, func(tx *sql.Tx) error {
+		users := data.UserModel{DB: tx, ReadDB: tx, Dialect: dialect}
+		roles := data.RoleModel{DB: tx, ReadDB: tx, Dialect: dialect}
+		permissions := data.PermissionModel{DB: tx, ReadDB: tx, Dialect: dialect}
+
+		for i, u := range d.Users {
+			user := &data.User{
+				Name:      u.Name,
+				Username:  u.Username,
+				Email:     u.Email,
+				Locale:    data.DefaultLocale,
+				Activated: u.Activated,
+			}
+
+			err := user.Password.Set(u.Password)
+			if err != nil {
+				return err
+			}
+
+			err = users.Insert(user)
+			if err != nil {
+				return fmt.Errorf("inserting user %s: %w", u.Email, err)
+			}
+
+			err = roles.AddForUser(user.ID, u.Role)
+			if err != nil {
+				return err
+			}
+
+			if u.AllPermissions {
+				err = permissions.AddAllForUser(user.ID)
+				if err != nil {
+					return err
+				}
+			}
+
+			userIDs[i] = user.ID
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	movieIDs := make([]int64, len(d.Movies))
+
+	err = inBatches(ctx, db, len(d.Movies), batchSize, func(tx *sql.Tx, start, end int) error {
+		movies := data.MovieModel{DB: tx, ReadDB: tx, Dialect: dialect}
+
+		for i := start; i < end; i++ {
+			movie := d.Movies[i]
+			movie.CreatedBy = &data.UserRef{ID: userIDs[0]}
+
+			err := movies.Insert(&movie)
+			if err != nil {
+				return fmt.Errorf("inserting movie %q: %w", movie.Title, err)
+			}
+
+			movieIDs[i] = movie.ID
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	err = insertRows(ctx, db, dialect, "ratings", []string{"user_id", "movie_id", "rating"}, len(d.Ratings), batchSize, func(i int) []interface{} {
+		rating := d.Ratings[i]
+		return []interface{}{userIDs[rating.User], movieIDs[rating.Movie], rating.Rating}
+	})
+	if err != nil {
+		return err
+	}
+
+	err = insertRows(ctx, db, dialect, "reviews", []string{"user_id", "movie_id", "body"}, len(d.Reviews), batchSize, func(i int) []interface{} {
+		review := d.Reviews[i]
+		return []interface{}{userIDs[review.User], movieIDs[review.Movie], review.Body}
+	})
+	if err != nil {
+		return err
+	}
+
+	err = insertRows(ctx, db, dialect, "watchlist", []string{"user_id", "movie_id", "notify"}, len(d.Watchlist), batchSize, func(i int) []interface{} {
+		entry := d.Watchlist[i]
+		return []interface{}{userIDs[entry.User], movieIDs[entry.Movie], entry.Notify}
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(movieIDs) == 0 {
+		return nil
+	}
+
+	movies := data.MovieModel{DB: db, ReadDB: db, Dialect: dialect}
+
+	// The movies were inserted in order, so their IDs are ascending.
+	afterID := movieIDs[0] - 1
+	for {
+		lastID, count, err := movies.ReindexBatch(afterID, batchSize)
+		if err != nil {
+			return err
+		}
+
+		if count < batchSize {
+			return nil
+		}
+
+		afterID = lastID
+	}
+}
+
+// The insertRows() function inserts n rows into the table, with a multi-row INSERT
+// statement for each batch. The row function returns the values of the columns for
+// the ith row.
+func insertRows(ctx context.Context, db *sql.DB, dialect data.Dialect, table string, columns []string, n, batchSize int, row func(i int) []interface{}) error {
+	return inBatches(ctx, db, n, batchSize, func(tx *sql.Tx, start, end int) error {
+		values := make([]string, 0, end-start)
+		args := make([]interface{}, 0, (end-start)*len(columns))
+
+		for i := start; i < end; i++ {
+			placeholders := make([]string, len(columns))
+			for j := range placeholders {
+				placeholders[j] = fmt.Sprintf("$%d", len(args)+j+1)
+			}
+
+			values = append(values, "("+strings.Join(placeholders, ", ")+")")
+			args = append(args, row(i)...)
+		}
+
+		query := fmt.Sprintf("INSERT INTO %s (%s) VALUES %s", table, strings.Join(columns, ", "), strings.Join(values, ", "))
+
+		_, err := tx.ExecContext(ctx, dialect.Rebind(query), args...)
+		if err != nil {
+			return fmt.Errorf("inserting %s: %w", table, err)
+		}
+
+		return nil
+	})
+}
+
+// The inBatches() function calls fn for each batch of up to batchSize of the n rows,
+// with the start and end of the batch, each in its own transaction.
+func inBatches(ctx context.Context, db *sql.DB, n, batchSize int, fn func(tx *sql.Tx, start, end int) error) error {
+	for start := 0; start < n; start += batchSize {
+		end := start + batchSize
+		if end > n {
+			end = n
+		}
+
+		err := inTx(ctx, db, func(tx *sql.Tx) error {
+			return fn(tx, start, end)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// The inTx() function runs fn in a transaction, which is committed if fn returns nil
+// and rolled back otherwise.
+func inTx(ctx context.Context, db *sql.DB, fn func(tx *sql.Tx) error) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	// Rollback() is a no-op if the transaction has already been committed.
+	defer tx.Rollback()
+
+	err = fn(tx)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
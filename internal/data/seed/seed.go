@@ -0,0 +1,350 @@
+// Package seed generates a catalog of made-up movies, along with users who rate,
+// review and watch them, for loading into a development or CI database. The same
+// options always generate the same data, so tests can rely on what's there.
+package seed
+
+import (
+	_ "embed"
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+
+	"github.com/petrostrak/an-open-movie-database/internal/data"
+)
+
+// DefaultMovies is the number of movies generated when Options.Movies isn't set.
+const DefaultMovies = 1000
+
+// The range of the generated release years. The latest year is fixed, rather than
+// the current one, so that the data doesn't change from one year to the next.
+const (
+	minYear = 1920
+	maxYear = 2024
+)
+
+// The number of readers generated in addition to the known users, so that the
+// movies have ratings from more than a couple of people.
+const generatedReaders = 7
+
+// The generatedPassword is the password of every generated reader.
+const generatedPassword = "reader-pa55word"
+
+// The genres a movie can have. Each movie gets between one and three of them.
+var genres = []string{
+	"action", "adventure", "animation", "comedy", "crime", "documentary", "drama",
+	"family", "fantasy", "horror", "musical", "mystery", "romance", "sci-fi",
+	"thriller", "war", "western",
+}
+
+// Embed the newline-delimited word lists which the titles, plots, names and reviews
+// are made from.
+var (
+	//go:embed words/adjectives.txt
+	adjectivesFile string
+	//go:embed words/nouns.txt
+	nounsFile string
+	//go:embed words/names.txt
+	namesFile string
+	//go:embed words/surnames.txt
+	surnamesFile string
+	//go:embed words/places.txt
+	placesFile string
+	//go:embed words/occupations.txt
+	occupationsFile string
+	//go:embed words/goals.txt
+	goalsFile string
+	//go:embed words/stakes.txt
+	stakesFile string
+	//go:embed words/praise.txt
+	praiseFile string
+	//go:embed words/mixed.txt
+	mixedFile string
+	//go:embed words/criticism.txt
+	criticismFile string
+)
+
+var (
+	adjectives  = wordList(adjectivesFile)
+	nouns       = wordList(nounsFile)
+	names       = wordList(namesFile)
+	surnames    = wordList(surnamesFile)
+	places      = wordList(placesFile)
+	occupations = wordList(occupationsFile)
+	goals       = wordList(goalsFile)
+	stakes      = wordList(stakesFile)
+	praise      = wordList(praiseFile)
+	mixed       = wordList(mixedFile)
+	criticism   = wordList(criticismFile)
+)
+
+// The wordList() function splits an embedded file into its non-empty lines.
+func wordList(file string) []string {
+	var words []string
+
+	for _, line := range strings.Split(file, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			words = append(words, line)
+		}
+	}
+
+	return words
+}
+
+// The knownUsers are generated for every seed, with fixed credentials, so that
+// developers and tests can log in as each kind of user.
+var knownUsers = []User{
+	{Name: "Admin", Username: "admin", Email: "admin@example.com", Password: "admin-pa55word", Activated: true, Role: "admin", AllPermissions: true},
+	{Name: "Reader", Username: "reader", Email: "reader@example.com", Password: "reader-pa55word", Activated: true, Role: "reader"},
+	{Name: "Inactive", Username: "inactive", Email: "inactive@example.com", Password: "inactive-pa55word", Activated: false, Role: "reader"},
+}
+
+// Define an Options struct to hold what to generate. The Seed is the seed for the
+// random number generator, so the same Seed generates the same Dataset.
+type Options struct {
+	Movies int
+	Seed   int64
+}
+
+// Define a User struct to hold a generated user, with their plaintext password. The
+// user is given the Role, and every permission if AllPermissions is true.
+type User struct {
+	Name           string
+	Username       string
+	Email          string
+	Password       string
+	Activated      bool
+	Role           string
+	AllPermissions bool
+}
+
+// Define Rating, Review and WatchlistEntry structs to hold a user's activity. The
+// User and Movie fields are indexes into the Dataset's Users and Movies, as the IDs
+// aren't known until they're inserted.
+type Rating struct {
+	User   int
+	Movie  int
+	Rating int
+}
+
+type Review struct {
+	User  int
+	Movie int
+	Body  string
+}
+
+type WatchlistEntry struct {
+	User   int
+	Movie  int
+	Notify bool
+}
+
+// Define a Dataset struct to hold everything generated for one seed. The first user is
+// the admin, who is recorded as having added the movies.
+type Dataset struct {
+	Movies    []data.Movie
+	Users     []User
+	Ratings   []Rating
+	Reviews   []Review
+	Watchlist []WatchlistEntry
+}
+
+// Generate returns the Dataset for the options. Each activated user rates a few dozen
+// movies, reviews some of the ones they rated, and adds a few more to their watchlist;
+// the unactivated user hasn't done anything yet.
+func Generate(opts Options) *Dataset {
+	if opts.Movies <= 0 {
+		opts.Movies = DefaultMovies
+	}
+
+	r := rand.New(rand.NewSource(opts.Seed))
+
+	set := &Dataset{
+		Movies: generateMovies(r, opts.Movies),
+		Users:  generateUsers(r),
+	}
+
+	for i, user := range set.Users {
+		if !user.Activated {
+			continue
+		}
+
+		rated := r.Perm(len(set.Movies))[:between(r, 10, 50, len(set.Movies))]
+
+		for j, movie := range rated {
+			rating := Rating{User: i, Movie: movie, Rating: generateRating(r)}
+			set.Ratings = append(set.Ratings, rating)
+
+			// About a quarter of the ratings come with a review. The first one
+			// always does, so that every user who rates something reviews it too.
+			if j == 0 || r.Intn(4) == 0 {
+				set.Reviews = append(set.Reviews, Review{User: i, Movie: movie, Body: generateReview(r, rating.Rating)})
+			}
+		}
+
+		for _, movie := range r.Perm(len(set.Movies))[:between(r, 3, 10, len(set.Movies))] {
+			set.Watchlist = append(set.Watchlist, WatchlistEntry{User: i, Movie: movie, Notify: r.Intn(2) == 0})
+		}
+	}
+
+	return set
+}
+
+// The between() helper returns a random number from min to max inclusive, but no more
+// than limit.
+func between(r *rand.Rand, min, max, limit int) int {
+	n := min + r.Intn(max-min+1)
+	if n > limit {
+		return limit
+	}
+
+	return n
+}
+
+// The generateMovies() function generates n movies. A title which has already been
+// used is given a sequel number, so that the titles are all different.
+func generateMovies(r *rand.Rand, n int) []data.Movie {
+	movies := make([]data.Movie, n)
+	used := make(map[string]int, n)
+
+	for i := range movies {
+		title := generateTitle(r)
+
+		used[title]++
+		if used[title] > 1 {
+			title += " " + strconv.Itoa(used[title])
+		}
+
+		movies[i] = data.Movie{
+			Title:   title,
+			Year:    generateYear(r),
+			Runtime: data.Runtime(generateRuntime(r)),
+			Genres:  generateGenres(r),
+			Plot:    generatePlot(r),
+		}
+	}
+
+	return movies
+}
+
+// The generateTitle() function makes a title from one of a few common patterns.
+func generateTitle(r *rand.Rand) string {
+	switch r.Intn(5) {
+	case 0:
+		return fmt.Sprintf("The %s %s", pick(r, adjectives), pick(r, nouns))
+	case 1:
+		return fmt.Sprintf("%s of the %s", pick(r, nouns), pick(r, nouns))
+	case 2:
+		return fmt.Sprintf("%s's %s", pick(r, names), pick(r, nouns))
+	case 3:
+		return fmt.Sprintf("%s in %s", pick(r, nouns), pick(r, places))
+	default:
+		return fmt.Sprintf("%s %s", pick(r, adjectives), pick(r, nouns))
+	}
+}
+
+// The generateYear() function returns a release year, with recent years the most
+// likely, as they are in any real catalog.
+func generateYear(r *rand.Rand) int32 {
+	year := maxYear - int(math.Abs(r.NormFloat64())*25)
+	if year < minYear {
+		year = minYear + r.Intn(10)
+	}
+
+	return int32(year)
+}
+
+// The generateRuntime() function returns a runtime in minutes, usually around an hour
+// and three quarters, with the occasional epic.
+func generateRuntime(r *rand.Rand) int32 {
+	runtime := 75 + r.Intn(31) + r.Intn(31)
+	if r.Intn(10) == 0 {
+		runtime += 30 + r.Intn(60)
+	}
+
+	return int32(runtime)
+}
+
+// The generateGenres() function returns between one and three different genres.
+func generateGenres(r *rand.Rand) []string {
+	n := 1 + r.Intn(3)
+
+	picked := make([]string, n)
+	for i, j := range r.Perm(len(genres))[:n] {
+		picked[i] = genres[j]
+	}
+
+	return picked
+}
+
+// The generatePlot() function returns a one sentence summary of the movie.
+func generatePlot(r *rand.Rand) string {
+	occupation := pick(r, occupations)
+
+	article := "A"
+	if strings.ContainsRune("aeiou", rune(occupation[0])) {
+		article = "An"
+	}
+
+	return fmt.Sprintf("%s %s from %s must %s before %s.", article, occupation, pick(r, places), pick(r, goals), pick(r, stakes))
+}
+
+// The generateRating() function returns a rating from 1 to 10, which is most often a
+// 6 or a 7.
+func generateRating(r *rand.Rand) int {
+	rating := int(math.Round(r.NormFloat64()*1.8 + 6.5))
+
+	switch {
+	case rating < 1:
+		return 1
+	case rating > 10:
+		return 10
+	default:
+		return rating
+	}
+}
+
+// The generateReview() function returns a review of a couple of sentences, which
+// agrees with the rating it goes with.
+func generateReview(r *rand.Rand, rating int) string {
+	sentences := mixed
+	switch {
+	case rating >= 8:
+		sentences = praise
+	case rating <= 4:
+		sentences = criticism
+	}
+
+	first := r.Intn(len(sentences))
+	second := (first + 1 + r.Intn(len(sentences)-1)) % len(sentences)
+
+	return sentences[first] + " " + sentences[second]
+}
+
+// The generateUsers() function returns the known users followed by the generated
+// readers, whose names, and so usernames and email addresses, are all different.
+func generateUsers(r *rand.Rand) []User {
+	users := append([]User(nil), knownUsers...)
+
+	for _, i := range r.Perm(len(names))[:generatedReaders] {
+		name, surname := names[i], pick(r, surnames)
+		first, last := strings.ToLower(name), strings.ToLower(surname)
+
+		users = append(users, User{
+			Name:      name + " " + surname,
+			Username:  first + "_" + last,
+			Email:     first + "." + last + "@example.com",
+			Password:  generatedPassword,
+			Activated: true,
+			Role:      "reader",
+		})
+	}
+
+	return users
+}
+
+// The pick() helper returns a random element of words.
+func pick(r *rand.Rand, words []string) string {
+	return words[r.Intn(len(words))]
+}
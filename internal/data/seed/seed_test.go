@@ -0,0 +1,214 @@
+package seed
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/petrostrak/an-open-movie-database/internal/data"
+	"github.com/petrostrak/an-open-movie-database/internal/testdb"
+	"github.com/petrostrak/an-open-movie-database/internal/validator"
+)
+
+func TestGenerateIsDeterministic(t *testing.T) {
+	a := Generate(Options{Movies: 200, Seed: 42})
+	b := Generate(Options{Movies: 200, Seed: 42})
+
+	if !reflect.DeepEqual(a, b) {
+		t.Error("got different datasets for the same seed")
+	}
+
+	c := Generate(Options{Movies: 200, Seed: 43})
+
+	if reflect.DeepEqual(a.Movies, c.Movies) {
+		t.Error("got the same movies for different seeds")
+	}
+}
+
+func TestGenerateDefaultMovies(t *testing.T) {
+	set := Generate(Options{Seed: 1})
+
+	if len(set.Movies) != DefaultMovies {
+		t.Errorf("got %d movies; want %d", len(set.Movies), DefaultMovies)
+	}
+}
+
+// Every rating, review and watchlist entry refers to a movie and an activated user in
+// the dataset, at most once for each pair, and everything passes the validation which
+// the API applies.
+func TestGenerateReferentialIntegrity(t *testing.T) {
+	for _, opts := range []Options{{Movies: 1000, Seed: 1}, {Movies: 50, Seed: 2}, {Movies: 3, Seed: 3}} {
+		set := Generate(opts)
+
+		if len(set.Movies) != opts.Movies {
+			t.Errorf("seed %d: got %d movies; want %d", opts.Seed, len(set.Movies), opts.Movies)
+		}
+
+		titles := make(map[string]bool)
+		for i := range set.Movies {
+			movie := &set.Movies[i]
+
+			v := validator.New()
+			data.ValidateMovie(v, movie)
+			if !v.Valid() {
+				t.Errorf("seed %d: movie %q is invalid: %v", opts.Seed, movie.Title, v.Errors)
+			}
+
+			if titles[movie.Title] {
+				t.Errorf("seed %d: got the title %q more than once", opts.Seed, movie.Title)
+			}
+			titles[movie.Title] = true
+		}
+
+		usernames := make(map[string]bool)
+		emails := make(map[string]bool)
+		for _, user := range set.Users {
+			v := validator.New()
+			data.ValidateUsername(v, user.Username)
+			data.ValidateEmail(v, user.Email)
+			data.ValidatePasswordPlaintext(v, user.Password, user.Name)
+			if !v.Valid() {
+				t.Errorf("seed %d: user %q is invalid: %v", opts.Seed, user.Username, v.Errors)
+			}
+
+			if usernames[user.Username] || emails[user.Email] {
+				t.Errorf("seed %d: got the user %q more than once", opts.Seed, user.Username)
+			}
+			usernames[user.Username], emails[user.Email] = true, true
+		}
+
+		checkRef := func(kind string, user, movie int) {
+			t.Helper()
+
+			if user < 0 || user >= len(set.Users) || movie < 0 || movie >= len(set.Movies) {
+				t.Fatalf("seed %d: %s refers to user %d and movie %d, out of range", opts.Seed, kind, user, movie)
+			}
+
+			if !set.Users[user].Activated {
+				t.Errorf("seed %d: %s by unactivated user %q", opts.Seed, kind, set.Users[user].Username)
+			}
+		}
+
+		type pair struct{ user, movie int }
+
+		ratings := make(map[pair]int)
+		for _, rating := range set.Ratings {
+			checkRef("rating", rating.User, rating.Movie)
+
+			if rating.Rating < 1 || rating.Rating > 10 {
+				t.Errorf("seed %d: got rating %d; want 1 to 10", opts.Seed, rating.Rating)
+			}
+
+			if _, ok := ratings[pair{rating.User, rating.Movie}]; ok {
+				t.Errorf("seed %d: user %d rated movie %d more than once", opts.Seed, rating.User, rating.Movie)
+			}
+			ratings[pair{rating.User, rating.Movie}] = rating.Rating
+		}
+
+		for _, review := range set.Reviews {
+			checkRef("review", review.User, review.Movie)
+
+			if _, ok := ratings[pair{review.User, review.Movie}]; !ok {
+				t.Errorf("seed %d: user %d reviewed movie %d without rating it", opts.Seed, review.User, review.Movie)
+			}
+
+			if review.Body == "" {
+				t.Errorf("seed %d: got an empty review", opts.Seed)
+			}
+		}
+
+		watching := make(map[pair]bool)
+		for _, entry := range set.Watchlist {
+			checkRef("watchlist entry", entry.User, entry.Movie)
+
+			if watching[pair{entry.User, entry.Movie}] {
+				t.Errorf("seed %d: user %d has movie %d on their watchlist more than once", opts.Seed, entry.User, entry.Movie)
+			}
+			watching[pair{entry.User, entry.Movie}] = true
+		}
+
+		if len(set.Ratings) == 0 || len(set.Reviews) == 0 || len(set.Watchlist) == 0 {
+			t.Errorf("seed %d: got %d ratings, %d reviews and %d watchlist entries; want some of each", opts.Seed, len(set.Ratings), len(set.Reviews), len(set.Watchlist))
+		}
+	}
+}
+
+// The known users are the same for every seed, so that their credentials can be
+// documented.
+func TestGenerateKnownUsers(t *testing.T) {
+	set := Generate(Options{Movies: 10, Seed: 7})
+
+	if !reflect.DeepEqual(set.Users[:len(knownUsers)], knownUsers) {
+		t.Fatalf("got users %+v first; want %+v", set.Users[:len(knownUsers)], knownUsers)
+	}
+
+	admin, reader, inactive := set.Users[0], set.Users[1], set.Users[2]
+
+	if !admin.Activated || admin.Role != "admin" || !admin.AllPermissions {
+		t.Errorf("got admin %+v; want an activated admin with every permission", admin)
+	}
+
+	if !reader.Activated || reader.Role != "reader" || reader.AllPermissions {
+		t.Errorf("got reader %+v; want an activated reader", reader)
+	}
+
+	if inactive.Activated {
+		t.Errorf("got inactive user %+v; want them unactivated", inactive)
+	}
+}
+
+func TestLoad(t *testing.T) {
+	driverName, db := testdb.Open(t)
+
+	set := Generate(Options{Movies: 25, Seed: 1})
+
+	// A batch size which doesn't divide the number of rows, so that the last batch
+	// is a short one.
+	err := set.Load(context.Background(), driverName, db, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	counts := []struct {
+		query string
+		want  int
+	}{
+		{`SELECT count(*) FROM movies`, len(set.Movies)},
+		{`SELECT count(*) FROM users`, len(set.Users)},
+		{`SELECT count(*) FROM ratings`, len(set.Ratings)},
+		{`SELECT count(*) FROM reviews`, len(set.Reviews)},
+		{`SELECT count(*) FROM watchlist`, len(set.Watchlist)},
+		{`SELECT COALESCE(sum(ratings_count), 0) FROM movies`, len(set.Ratings)},
+		{`SELECT count(*) FROM users WHERE NOT activated`, 1},
+	}
+
+	for _, c := range counts {
+		var got int
+
+		err := db.QueryRow(c.query).Scan(&got)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got != c.want {
+			t.Errorf("%s: got %d; want %d", c.query, got, c.want)
+		}
+	}
+
+	// Loading it again fails on the users, before any movies are added.
+	err = set.Load(context.Background(), driverName, db, 10)
+	if err == nil {
+		t.Fatal("got no error loading the dataset twice")
+	}
+
+	var movies int
+
+	err = db.QueryRow(`SELECT count(*) FROM movies`).Scan(&movies)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if movies != len(set.Movies) {
+		t.Errorf("got %d movies after the second load; want %d", movies, len(set.Movies))
+	}
+}
@@ -0,0 +1,86 @@
+package data
+
+import (
+	"math"
+	"strings"
+	"unicode"
+)
+
+// The least trigram similarity a title must have to the one being checked to be a
+// candidate duplicate at all. It's the default pg_trgm.similarity_threshold, which the
+// title % $1 condition uses.
+const similarTitleMin = 0.3
+
+// Define a MovieCandidate struct to hold an existing movie which may be a duplicate of
+// a new one, with a score between 0 and 1 of how alike they are.
+type MovieCandidate struct {
+	Movie *Movie  `json:"movie"`
+	Score float64 `json:"score"`
+}
+
+// The candidateScore() function combines the trigram similarity of two titles with how
+// close together their years are into a score between 0 and 1. The title counts for
+// 80% and the year for 20%, falling from a full 20% for the same year to nothing for
+// years five or more apart. If wantYear is 0, only the title counts. It must match the
+// score calculated by MovieModel.FindSimilarCandidates().
+func candidateScore(similarity float64, year, wantYear int32) float64 {
+	if wantYear == 0 {
+		return roundScore(similarity)
+	}
+
+	apart := math.Abs(float64(year - wantYear))
+
+	proximity := 0.0
+	if apart < 5 {
+		proximity = 1 - apart/5
+	}
+
+	return roundScore(0.8*similarity + 0.2*proximity)
+}
+
+// The roundScore() helper rounds a score to three decimal places, which is plenty to
+// rank candidates by, and easier to read.
+func roundScore(score float64) float64 {
+	return math.Round(score*1000) / 1000
+}
+
+// The trigramSimilarity() function returns how alike two strings are, between 0 and 1,
+// in the same way as pg_trgm's similarity(). Each string is split into lowercase
+// words, each word is padded with two spaces in front and one behind, and the score is
+// the number of three-character sequences the strings share divided by the number
+// there are in either. Word order and punctuation don't matter, so "The Matrix" and
+// "Matrix, The" score 1.
+func trigramSimilarity(a, b string) float64 {
+	x, y := trigrams(a), trigrams(b)
+	if len(x) == 0 || len(y) == 0 {
+		return 0
+	}
+
+	shared := 0
+	for t := range x {
+		if y[t] {
+			shared++
+		}
+	}
+
+	return float64(shared) / float64(len(x)+len(y)-shared)
+}
+
+// The trigrams() helper returns the set of trigrams in a string, as pg_trgm extracts
+// them.
+func trigrams(s string) map[string]bool {
+	set := make(map[string]bool)
+
+	words := strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+
+	for _, word := range words {
+		padded := []rune("  " + word + " ")
+		for i := 0; i+3 <= len(padded); i++ {
+			set[string(padded[i:i+3])] = true
+		}
+	}
+
+	return set
+}
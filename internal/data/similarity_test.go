@@ -0,0 +1,45 @@
+package data
+
+import "testing"
+
+func TestTrigramSimilarity(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want float64
+	}{
+		{"The Matrix", "Matrix, The", 1},
+		{"The Matrix", "the matrix", 1},
+		{"The Matrix", "The Matrix Reloaded", 0.55},
+		{"The Matrix", "Jaws", 0},
+		{"", "Moana", 0},
+		{"Amélie", "Amelie", 0.4},
+	}
+
+	for _, tt := range tests {
+		if got := roundScore(trigramSimilarity(tt.a, tt.b)); got != tt.want {
+			t.Errorf("trigramSimilarity(%q, %q) = %v; want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestCandidateScore(t *testing.T) {
+	tests := []struct {
+		name       string
+		similarity float64
+		year       int32
+		wantYear   int32
+		want       float64
+	}{
+		{"same title and year", 1, 1999, 1999, 1},
+		{"a year apart", 1, 2000, 1999, 0.96},
+		{"five years apart", 1, 2004, 1999, 0.8},
+		{"no year", 0.55, 2003, 0, 0.55},
+		{"different title", 0.55, 2003, 1999, 0.48},
+	}
+
+	for _, tt := range tests {
+		if got := candidateScore(tt.similarity, tt.year, tt.wantYear); got != tt.want {
+			t.Errorf("%s: got %v; want %v", tt.name, got, tt.want)
+		}
+	}
+}
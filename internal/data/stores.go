@@ -0,0 +1,185 @@
+package data
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// The store interfaces describe the methods of each model that the application uses.
+// NewModels() fills them in with the SQL-backed models, and NewMockModels() with
+// in-memory versions for unit tests.
+
+// Define a MovieStore interface, which is satisfied by MovieModel.
+type MovieStore interface {
+	Insert(movie *Movie) error
+	Get(id int64) (*Movie, error)
+	GetVersion(id int64) (int32, error)
+	Update(movie *Movie) error
+	Delete(id int64) (*MovieDeletion, error)
+	GetAll(movieFilters MovieFilters, filters Filters) ([]*Movie, Metadata, error)
+	ReindexBatch(afterID int64, limit int) (int64, int, error)
+	AddViews(views map[int64]int64) error
+	MaxRatingMass() (float64, error)
+	RefreshPopularityBatch(afterID int64, limit int, score func(PopularityInput) float64) (int64, int, error)
+	GetBatch(afterID int64, limit int) ([]*Movie, error)
+	GetByTitleYear(title string, year int32) (*Movie, error)
+	FindSimilarCandidates(title string, year int32, limit int) ([]*MovieCandidate, error)
+	GenreFacets(movieFilters MovieFilters) ([]FacetCount, error)
+	YearFacets(movieFilters MovieFilters) ([]YearBucket, error)
+}
+
+// Define a JobStore interface, which is satisfied by JobModel.
+type JobStore interface {
+	Start(kind string, lease time.Duration) (*Job, bool, error)
+	Get(id int64) (*Job, error)
+	Advance(id, cursor int64, processed int) error
+	Finish(id int64, status, message string) error
+	Cancel(id int64) (*Job, error)
+}
+
+// Define a UserStore interface, which is satisfied by UserModel.
+type UserStore interface {
+	Insert(user *User) error
+	Register(user *User, roles []string, activationTTL time.Duration, newEmail func(token *Token) *EmailJob) (*Token, error)
+	GetByEmail(email string) (*User, error)
+	GetByUsername(username string) (*User, error)
+	AvailableUsername(email string) (string, error)
+	Get(id int64) (*User, error)
+	GetByPublicID(publicID UUID) (*User, error)
+	Update(user *User) error
+	GetByOAuth(provider, subject string) (*User, error)
+	LinkOAuth(user *User, provider, subject string) error
+	GetForToken(tokenScope, tokenPlaintext string) (*User, error)
+	GetVersionForToken(tokenScope string, tokenHash [32]byte) (int, error)
+	RecordLogin(userID int64, ip, userAgent string) error
+	Delete(id int64, anonymizeReviews bool) error
+}
+
+// Define a TokenStore interface, which is satisfied by TokenModel.
+type TokenStore interface {
+	New(userID int64, ttl time.Duration, scope string) (*Token, error)
+	Insert(token *Token) error
+	DeleteAllForUser(scope string, userID int64) error
+	DeleteAllExpired() (int64, error)
+	Delete(scope, tokenPlaintext string) error
+}
+
+// Define a PermissionStore interface, which is satisfied by PermissionModel.
+type PermissionStore interface {
+	GetAllForUser(userID int64) (Permissions, error)
+	GetAll() (Permissions, error)
+	AddForUser(userID int64, codes ...string) error
+	RemoveForUser(userID int64, code string) error
+	AddAllForUser(userID int64) error
+}
+
+// Define an AuditStore interface, which is satisfied by AuditModel.
+type AuditStore interface {
+	Insert(entry *AuditEntry) error
+	GetAll(auditFilters AuditFilters, filters Filters) ([]*AuditEntry, Metadata, error)
+}
+
+// Define an EmailJobStore interface, which is satisfied by EmailJobModel.
+type EmailJobStore interface {
+	Insert(job *EmailJob) error
+	Claim(limit int, lease time.Duration) ([]*EmailJob, error)
+	MarkSent(id int64) error
+	MarkFailed(id int64, sendErr error, retryAt time.Time) error
+	GetAll(status string, filters Filters) ([]*EmailJob, Metadata, error)
+}
+
+// Define a FailedEmailStore interface, which is satisfied by FailedEmailModel.
+type FailedEmailStore interface {
+	Insert(email *FailedEmail) error
+}
+
+// Define an IdempotencyKeyStore interface, which is satisfied by IdempotencyKeyModel.
+type IdempotencyKeyStore interface {
+	Claim(userID int64, key string, fingerprint []byte, ttl time.Duration) (*IdempotencyKey, bool, error)
+	Complete(userID int64, key string, statusCode int, headers http.Header, body []byte) error
+	Release(userID int64, key string) error
+	DeleteAllExpired() (int64, error)
+}
+
+// Define a DigestStore interface, which is satisfied by DigestModel.
+type DigestStore interface {
+	GetSubscribers(since time.Time, afterUserID int64, limit int) ([]*DigestSubscriber, error)
+	GetNewMovies(since, until time.Time, genres []string, limit int) ([]*Movie, error)
+	ClaimSent(userID int64, since, sentAt time.Time) (bool, error)
+}
+
+// Define a LockStore interface, which is satisfied by LockModel.
+type LockStore interface {
+	TryLock(ctx context.Context, name string) (func(), bool, error)
+}
+
+// Define a LoginStore interface, which is satisfied by LoginModel.
+type LoginStore interface {
+	GetAllForUser(userID int64) ([]*Login, error)
+}
+
+// Define a PreferencesStore interface, which is satisfied by PreferencesModel.
+type PreferencesStore interface {
+	Get(userID int64) (*Preferences, error)
+	Update(userID int64, preferences *Preferences) (*Preferences, error)
+}
+
+// Define a SavedSearchStore interface, which is satisfied by SavedSearchModel.
+type SavedSearchStore interface {
+	Insert(search *SavedSearch) error
+	GetAllForUser(userID int64) ([]*SavedSearch, error)
+	GetForUser(id, userID int64) (*SavedSearch, error)
+	DeleteForUser(id, userID int64) error
+}
+
+// Define a ReportStore interface, which is satisfied by ReportModel.
+type ReportStore interface {
+	Insert(report *Report) error
+	Get(id int64) (*Report, error)
+	GetAll(status string, filters Filters) ([]*Report, Metadata, error)
+	GetAllForUser(userID int64) ([]*Report, error)
+	UpdateStatus(report *Report, from string) error
+}
+
+// Define a RoleStore interface, which is satisfied by RoleModel.
+type RoleStore interface {
+	GetAll() ([]*Role, error)
+	GetAllForUser(userID int64) ([]string, error)
+	AddForUser(userID int64, names ...string) error
+	SetForUser(userID int64, names ...string) error
+}
+
+// Define a UsageStore interface, which is satisfied by UsageModel.
+type UsageStore interface {
+	Add(counts []UsageCount) error
+	GetAllForUser(userID int64, since time.Time) ([]*Usage, error)
+}
+
+// Define a WatchlistStore interface, which is satisfied by WatchlistModel.
+type WatchlistStore interface {
+	Add(userID, movieID int64, notify bool) (*WatchlistEntry, error)
+	GetAllForUser(userID int64) ([]*WatchlistEntry, error)
+	SetNotify(userID, movieID int64, notify bool) (*WatchlistEntry, error)
+	Remove(userID, movieID int64) error
+	GetWatchers(movieID, afterUserID int64, limit int) ([]*Watcher, error)
+	ClaimNotification(userID int64, limit int) (bool, error)
+	DeleteOldNotifications() (int64, error)
+}
+
+// Define a WebhookStore interface, which is satisfied by WebhookModel.
+type WebhookStore interface {
+	Insert(webhook *Webhook) error
+	Get(id int64) (*Webhook, error)
+	GetAll() ([]*Webhook, error)
+	GetAllActiveForEvent(event string) ([]*Webhook, error)
+	Update(webhook *Webhook) error
+	ReencryptSecrets() (int, error)
+	Delete(id int64) error
+}
+
+// Define a WebhookDeliveryStore interface, which is satisfied by WebhookDeliveryModel.
+type WebhookDeliveryStore interface {
+	Insert(delivery *WebhookDelivery) error
+	GetAllForWebhook(webhookID int64, filters Filters) ([]*WebhookDelivery, Metadata, error)
+}
@@ -2,10 +2,11 @@ package data
 
 import (
 	"context"
+	"crypto/rand"
 	"crypto/sha256"
-	"database/sql"
 	"encoding/base32"
-	"math/rand"
+	"errors"
+	"fmt"
 	"time"
 
 	"github.com/petrostrak/an-open-movie-database/internal/validator"
@@ -16,8 +17,36 @@ import (
 const (
 	ScopeActivation     = "activation"
 	ScopeAuthentication = "authentication" // Include a new authentication scope.
+	ScopeUnsubscribe    = "unsubscribe"    // Turns off the emails about a movie on a watchlist.
 )
 
+// The bounds for the number of random bytes in a token. The plaintext is the base-32
+// encoding of these bytes, so a 16 byte token is 26 characters long.
+const (
+	MinTokenLength = 16
+	MaxTokenLength = 64
+)
+
+// Define an error for an invalid token length.
+var ErrInvalidTokenLength = errors.New("invalid token length")
+
+// The number of random bytes in newly generated tokens. This defaults to 16 and is
+// changed at startup by SetTokenLength().
+var tokenLength = MinTokenLength
+
+// SetTokenLength sets the number of random bytes in newly generated tokens. Tokens that
+// have already been issued remain valid. It should be called once at startup, before
+// any requests are served.
+func SetTokenLength(n int) error {
+	if n < MinTokenLength || n > MaxTokenLength {
+		return fmt.Errorf("%w: must be between %d and %d bytes", ErrInvalidTokenLength, MinTokenLength, MaxTokenLength)
+	}
+
+	tokenLength = n
+
+	return nil
+}
+
 // Define a Token struct to hold the data for an individual token. This includes the
 // plaintext and hashed versions of the token, associated user ID, expiry time and
 // scope.
@@ -41,8 +70,9 @@ func generateToekn(userID int64, ttl time.Duration, scope string) (*Token, error
 		Scope:  scope,
 	}
 
-	// Initialize a zero-valued byte slice with a length of 16 bytes.
-	randomBytes := make([]byte, 16)
+	// Initialize a zero-valued byte slice with the configured length (16 bytes by
+	// default).
+	randomBytes := make([]byte, tokenLength)
 
 	// Use the Read() function from the crypto/rand package to fill the byte slice with
 	// random bytes from your operating system's CSPRNG. This will return an error if
@@ -74,13 +104,20 @@ func generateToekn(userID int64, ttl time.Duration, scope string) (*Token, error
 }
 
 func ValidateTokenPlaintext(v *validator.Validator, tokenPlaintext string) {
-	v.Check(tokenPlaintext != "", "token", "must be provided")
-	v.Check(len(tokenPlaintext) == 26, "token", "must be 26 bytes long")
+	v.Check(tokenPlaintext != "", "token", validator.Msg("required"))
+	// The token length is configurable, so accept any length that we could have
+	// issued rather than only the current one.
+	encoding := base32.StdEncoding.WithPadding(base32.NoPadding)
+	minLength, maxLength := encoding.EncodedLen(MinTokenLength), encoding.EncodedLen(MaxTokenLength)
+
+	v.Check(validator.MinBytes(tokenPlaintext, minLength), "token", validator.Msg("min_bytes", "n", minLength))
+	v.Check(validator.MaxBytes(tokenPlaintext, maxLength), "token", validator.Msg("max_bytes", "n", maxLength))
 }
 
 // Define the TokenModel type.
 type TokenModel struct {
-	DB *sql.DB
+	DB      Querier
+	Dialect Dialect
 }
 
 // The New() is a shortcut which creates a new Token struct and then inserts the
@@ -97,16 +134,21 @@ func (m TokenModel) New(userID int64, ttl time.Duration, scope string) (*Token,
 
 // Insert() adds the data for a specific token to the tokens table.
 func (m TokenModel) Insert(token *Token) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return insertToken(ctx, m.DB, m.Dialect, token)
+}
+
+// The insertToken() helper runs the insert for Insert() and UserModel.Register().
+func insertToken(ctx context.Context, db Querier, dialect Dialect, token *Token) error {
 	query := `
 		INSERT INTO tokens (hash, user_id, expiry, scope)
 		VALUES ($1, $2, $3, $4)`
 
 	args := []interface{}{token.Hash, token.UserID, token.Expiry, token.Scope}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
-
-	_, err := m.DB.ExecContext(ctx, query, args...)
+	_, err := db.ExecContext(ctx, dialect.Rebind(query), args...)
 	return err
 }
 
@@ -119,7 +161,41 @@ func (m TokenModel) DeleteAllForUser(scope string, userID int64) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	_, err := m.DB.ExecContext(ctx, query, scope, userID)
+	_, err := m.DB.ExecContext(ctx, m.Dialect.Rebind(query), scope, userID)
+
+	return err
+}
+
+// DeleteAllExpired() deletes every token whose expiry is in the past, and returns the
+// number of tokens deleted.
+func (m TokenModel) DeleteAllExpired() (int64, error) {
+	query := `
+		DELETE FROM tokens
+		WHERE expiry < $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, m.Dialect.Rebind(query), time.Now())
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+// Delete() deletes a single token, identified by its scope and plaintext.
+func (m TokenModel) Delete(scope, tokenPlaintext string) error {
+	query := `
+		DELETE FROM tokens
+		WHERE scope = $1 AND hash = $2`
+
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, m.Dialect.Rebind(query), scope, tokenHash[:])
 
 	return err
 }
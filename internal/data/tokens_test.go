@@ -0,0 +1,54 @@
+package data
+
+import (
+	"testing"
+	"time"
+
+	"github.com/petrostrak/an-open-movie-database/internal/testdb"
+)
+
+func TestTokenModelDeleteAllExpired(t *testing.T) {
+	driverName, db := testdb.Open(t)
+
+	models, err := NewModelsForDriver(driverName, db, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user := &User{Name: "Alice", Username: "alice", Email: "alice@example.com", Activated: true}
+
+	err = user.Password.Set("pa55word1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = models.Users.Insert(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, ttl := range []time.Duration{-time.Hour, -time.Minute, time.Hour} {
+		_, err := models.Tokens.New(user.ID, ttl, ScopeAuthentication)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	deleted, err := models.Tokens.DeleteAllExpired()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if deleted != 2 {
+		t.Errorf("got %d tokens deleted; want 2", deleted)
+	}
+
+	deleted, err = models.Tokens.DeleteAllExpired()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if deleted != 0 {
+		t.Errorf("got %d tokens deleted the second time; want 0", deleted)
+	}
+}
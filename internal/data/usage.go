@@ -0,0 +1,106 @@
+package data
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Define a UsageCount struct to hold a number of requests made by a user on a day,
+// which UsageModel.Add() adds to the stored count. The Date is truncated to the day,
+// in UTC.
+type UsageCount struct {
+	UserID   int64
+	Date     time.Time
+	Requests int64
+}
+
+// Define a Usage struct to represent the number of requests a user made on a day.
+type Usage struct {
+	Date     time.Time
+	Requests int64
+}
+
+// Define the UsageModel type.
+type UsageModel struct {
+	DB      Querier
+	ReadDB  Querier
+	Dialect Dialect
+}
+
+// The Add() method adds a batch of counts to the stored daily counts, creating the rows
+// for days which don't have one yet, in a single query. Each user and date must only
+// appear once in the batch.
+func (m UsageModel) Add(counts []UsageCount) error {
+	if len(counts) == 0 {
+		return nil
+	}
+
+	userIDs := make([]int64, len(counts))
+	dates := make([]string, len(counts))
+	requests := make([]int64, len(counts))
+
+	for i, count := range counts {
+		userIDs[i] = count.UserID
+		dates[i] = count.Date.UTC().Format("2006-01-02")
+		requests[i] = count.Requests
+	}
+
+	// Skip the counts of users who have been deleted since the requests were made,
+	// rather than failing the whole batch on the foreign key. Without the WHERE clause,
+	// SQLite would take the ON of ON CONFLICT to begin another join constraint.
+	arrays := []string{m.Dialect.Cast("$1", "bigint[]"), m.Dialect.Cast("$2", "date[]"), m.Dialect.Cast("$3", "bigint[]")}
+
+	query := fmt.Sprintf(`
+		INSERT INTO api_usage (user_id, date, requests)
+		SELECT c.user_id, c.date, c.requests
+		FROM %s
+		INNER JOIN users ON users.id = c.user_id
+		WHERE true
+		ON CONFLICT (user_id, date) DO UPDATE SET requests = api_usage.requests + EXCLUDED.requests`,
+		m.Dialect.Unnest(arrays, "c", []string{"user_id", "date", "requests"}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, m.Dialect.Rebind(query), m.Dialect.Array(userIDs), m.Dialect.Array(dates), m.Dialect.Array(requests))
+	return err
+}
+
+// The GetAllForUser() method returns a user's daily counts since the given day, oldest
+// first. Days without any requests are left out.
+func (m UsageModel) GetAllForUser(userID int64, since time.Time) ([]*Usage, error) {
+	query := `
+		SELECT date, requests
+		FROM api_usage
+		WHERE user_id = $1 AND date >= $2
+		ORDER BY date`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.ReadDB.QueryContext(ctx, m.Dialect.Rebind(query), userID, since.UTC().Format("2006-01-02"))
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	usage := []*Usage{}
+
+	for rows.Next() {
+		var u Usage
+
+		err := rows.Scan(&u.Date, &u.Requests)
+		if err != nil {
+			return nil, err
+		}
+
+		usage = append(usage, &u)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return usage, nil
+}
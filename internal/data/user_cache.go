@@ -0,0 +1,177 @@
+package data
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Define a UserCache type which holds the users for recently seen authentication
+// tokens, keyed by the SHA-256 hash of the token. It's a fixed-capacity LRU cache:
+// once it's full, adding a new entry evicts the least recently used one.
+//
+// Entries live for at most ttl. Once an entry is older than verifyInterval, Get()
+// reports it as stale, and the caller is expected to re-check the token and the user's
+// version number against the database before using it again.
+type UserCache struct {
+	capacity       int
+	ttl            time.Duration
+	verifyInterval time.Duration
+
+	mu      sync.Mutex
+	order   *list.List
+	entries map[[32]byte]*list.Element
+
+	hits   int64
+	misses int64
+}
+
+type userCacheEntry struct {
+	hash       [32]byte
+	user       User
+	expiry     time.Time
+	verifiedAt time.Time
+}
+
+// Define a UserCacheStats struct to hold the counters which we publish via expvar.
+type UserCacheStats struct {
+	Size   int   `json:"size"`
+	Hits   int64 `json:"hits"`
+	Misses int64 `json:"misses"`
+}
+
+// Return a new UserCache with the given capacity, entry lifetime and re-verification
+// interval.
+func NewUserCache(capacity int, ttl, verifyInterval time.Duration) *UserCache {
+	return &UserCache{
+		capacity:       capacity,
+		ttl:            ttl,
+		verifyInterval: verifyInterval,
+		order:          list.New(),
+		entries:        make(map[[32]byte]*list.Element),
+	}
+}
+
+// Get returns a copy of the cached user for a token hash. The stale return value is
+// true if the entry is due to be re-verified.
+func (c *UserCache) Get(hash [32]byte) (user *User, stale bool, found bool) {
+	now := time.Now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, found := c.entries[hash]
+	if !found {
+		return nil, false, false
+	}
+
+	entry := element.Value.(*userCacheEntry)
+
+	if now.After(entry.expiry) {
+		c.remove(element)
+		return nil, false, false
+	}
+
+	c.order.MoveToFront(element)
+
+	// Return a copy, so that a handler modifying the user from the request context
+	// can't change the cached entry.
+	u := entry.user
+
+	return &u, now.Sub(entry.verifiedAt) > c.verifyInterval, true
+}
+
+// Set adds or replaces the cached user for a token hash, marking it as just verified.
+func (c *UserCache) Set(hash [32]byte, user *User) {
+	now := time.Now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, found := c.entries[hash]; found {
+		entry := element.Value.(*userCacheEntry)
+		entry.user = *user
+		entry.verifiedAt = now
+		c.order.MoveToFront(element)
+		return
+	}
+
+	c.entries[hash] = c.order.PushFront(&userCacheEntry{
+		hash:       hash,
+		user:       *user,
+		expiry:     now.Add(c.ttl),
+		verifiedAt: now,
+	})
+
+	for c.order.Len() > c.capacity {
+		c.remove(c.order.Back())
+	}
+}
+
+// Touch marks the entry for a token hash as just verified.
+func (c *UserCache) Touch(hash [32]byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, found := c.entries[hash]; found {
+		element.Value.(*userCacheEntry).verifiedAt = time.Now()
+	}
+}
+
+// Delete removes the entry for a token hash. It must be called when the token is
+// revoked.
+func (c *UserCache) Delete(hash [32]byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, found := c.entries[hash]; found {
+		c.remove(element)
+	}
+}
+
+// DeleteUser removes every entry for a specific user. It must be called when the
+// user record changes, for example when their password or activation status does.
+func (c *UserCache) DeleteUser(userID int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for element := c.order.Front(); element != nil; {
+		next := element.Next()
+
+		if element.Value.(*userCacheEntry).user.ID == userID {
+			c.remove(element)
+		}
+
+		element = next
+	}
+}
+
+// RecordHit and RecordMiss increment the hit and miss counters.
+func (c *UserCache) RecordHit() {
+	atomic.AddInt64(&c.hits, 1)
+}
+
+func (c *UserCache) RecordMiss() {
+	atomic.AddInt64(&c.misses, 1)
+}
+
+// Stats returns the current size of the cache and the hit and miss counters.
+func (c *UserCache) Stats() UserCacheStats {
+	c.mu.Lock()
+	size := c.order.Len()
+	c.mu.Unlock()
+
+	return UserCacheStats{
+		Size:   size,
+		Hits:   atomic.LoadInt64(&c.hits),
+		Misses: atomic.LoadInt64(&c.misses),
+	}
+}
+
+// The remove() helper removes an element from both the list and the map. The mutex
+// must be held by the caller.
+func (c *UserCache) remove(element *list.Element) {
+	c.order.Remove(element)
+	delete(c.entries, element.Value.(*userCacheEntry).hash)
+}
@@ -0,0 +1,122 @@
+package data
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestUserCache(t *testing.T) {
+	c := NewUserCache(2, time.Hour, time.Hour)
+
+	hash := func(s string) [32]byte {
+		return sha256.Sum256([]byte(s))
+	}
+
+	c.Set(hash("a"), &User{ID: 1, Name: "Alice"})
+	c.Set(hash("b"), &User{ID: 2, Name: "Bob"})
+
+	// Changing the returned copy mustn't change the cached user.
+	user, stale, found := c.Get(hash("a"))
+	if !found || stale || user.Name != "Alice" {
+		t.Fatalf("got %v, %t, %t; want Alice, false, true", user, stale, found)
+	}
+	user.Name = "Mallory"
+
+	user, _, _ = c.Get(hash("a"))
+	if user.Name != "Alice" {
+		t.Errorf("got name %q from the cache; want %q", user.Name, "Alice")
+	}
+
+	// "b" is now the least recently used entry, so adding a third evicts it.
+	c.Set(hash("c"), &User{ID: 3, Name: "Carol"})
+
+	tests := []struct {
+		token     string
+		wantFound bool
+	}{
+		{"a", true},
+		{"b", false},
+		{"c", true},
+	}
+
+	for _, tt := range tests {
+		_, _, found := c.Get(hash(tt.token))
+		if found != tt.wantFound {
+			t.Errorf("token %q: got found %t; want %t", tt.token, found, tt.wantFound)
+		}
+	}
+
+	c.DeleteUser(1)
+
+	_, _, found = c.Get(hash("a"))
+	if found {
+		t.Error("got an entry after DeleteUser()")
+	}
+
+	c.Delete(hash("c"))
+
+	if size := c.Stats().Size; size != 0 {
+		t.Errorf("got size %d; want 0", size)
+	}
+}
+
+func TestUserCacheStaleAndExpiry(t *testing.T) {
+	c := NewUserCache(10, 40*time.Millisecond, 10*time.Millisecond)
+	hash := sha256.Sum256([]byte("a"))
+
+	c.Set(hash, &User{ID: 1})
+	time.Sleep(20 * time.Millisecond)
+
+	_, stale, found := c.Get(hash)
+	if !found || !stale {
+		t.Errorf("got stale %t, found %t; want true, true", stale, found)
+	}
+
+	c.Touch(hash)
+
+	_, stale, _ = c.Get(hash)
+	if stale {
+		t.Error("got a stale entry after Touch()")
+	}
+
+	time.Sleep(30 * time.Millisecond)
+
+	_, _, found = c.Get(hash)
+	if found {
+		t.Error("got an entry after the TTL")
+	}
+}
+
+// Run with -race to check the locking.
+func TestUserCacheConcurrent(t *testing.T) {
+	c := NewUserCache(4, time.Hour, time.Millisecond)
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+
+		go func(userID int64) {
+			defer wg.Done()
+
+			for j := 0; j < 1000; j++ {
+				hash := sha256.Sum256([]byte(fmt.Sprint(userID, j%8)))
+
+				c.Set(hash, &User{ID: userID})
+				c.Get(hash)
+				c.Touch(hash)
+				c.RecordHit()
+				c.Stats()
+
+				if j%10 == 0 {
+					c.DeleteUser(userID)
+				}
+			}
+		}(int64(i))
+	}
+
+	wg.Wait()
+}
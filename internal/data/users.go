@@ -5,6 +5,8 @@ import (
 	"crypto/sha256"
 	"database/sql"
 	"errors"
+	"fmt"
+	"strings"
 	"time"
 
 	"github.com/petrostrak/an-open-movie-database/internal/validator"
@@ -13,8 +15,10 @@ import (
 
 // Define a custom ErrDuplicateEmail error.
 var (
-	ErrDuplicateEmail = errors.New("duplicate email")
-	AnonymousUser     = &User{}
+	ErrDuplicateEmail    = errors.New("duplicate email")
+	ErrDuplicateUsername = errors.New("duplicate username")
+	ErrMissingPassword   = errors.New("missing password hash for user")
+	AnonymousUser        = &User{}
 )
 
 // Define a User struct to represent an individual user. Importantly, notice how we are
@@ -22,13 +26,25 @@ var (
 // any output when we encode in to JSON. Also notice that the Password fieldd uses the
 // custom password type defined below.
 type User struct {
-	ID        int64     `json:"id"`
+	ID int64 `json:"id"`
+	// The PublicID field holds a random identifier, generated by the database, which
+	// can be shown to other users instead of the ID, as it can't be enumerated.
+	PublicID  UUID      `json:"public_id"`
 	CreatedAt time.Time `json:"created_at"`
 	Name      string    `json:"name"`
+	Username  string    `json:"username"`
 	Email     string    `json:"email"`
+	Locale    string    `json:"locale"`
 	Password  password  `json:"-"`
-	Activated bool      `json:"activated"	`
+	Activated bool      `json:"activated"`
 	Version   int       `json:"-"`
+	// LastLoginAt is nil until the user first logs in with their password.
+	LastLoginAt *time.Time `json:"last_login_at,omitempty"`
+	// The OAuthProvider and OAuthSubject fields identify the external account (for
+	// example "google" and Google's account ID) that the user signs in with. They are
+	// empty for users who registered with a password.
+	OAuthProvider string `json:"-"`
+	OAuthSubject  string `json:"-"`
 }
 
 // Create a custom password type which is a struct containing the plaintext and hashed
@@ -42,13 +58,16 @@ type password struct {
 
 // Create a UserModel struct which wraps the connection pool.
 type UserModel struct {
-	DB *sql.DB
+	DB      Querier
+	ReadDB  Querier
+	Dialect Dialect
 }
 
-// The Set() calculates the bcrypt hash of a plaintext password, and stores both
-// the hash and the plaintext versions in the struct.
+// The Set() calculates the hash of a plaintext password using the configured
+// algorithm (see SetHashingParams), and stores both the hash and the plaintext
+// versions in the struct.
 func (p *password) Set(plaintextPassword string) error {
-	hash, err := bcrypt.GenerateFromPassword([]byte(plaintextPassword), 12)
+	hash, err := hashPassword(plaintextPassword)
 	if err != nil {
 		return err
 	}
@@ -63,7 +82,15 @@ func (p *password) Set(plaintextPassword string) error {
 // hashed password stored in the struct, returning true if it matches and false
 // otherwise.
 func (p *password) Matches(plaintextPassword string) (bool, error) {
-	err := bcrypt.CompareHashAndPassword(p.hash, []byte(plaintextPassword))
+	// Users who signed up via an OAuth provider don't have a password hash, so no
+	// plaintext password can ever match.
+	if p.hash == nil {
+		return false, nil
+	}
+
+	// The algorithm is detected from the stored hash, so existing bcrypt hashes keep
+	// working after switching to argon2id.
+	err := compareHashAndPassword(p.hash, plaintextPassword)
 	if err != nil {
 		switch {
 		case errors.Is(err, bcrypt.ErrMismatchedHashAndPassword):
@@ -76,68 +103,132 @@ func (p *password) Matches(plaintextPassword string) (bool, error) {
 	return true, nil
 }
 
+// NormalizeEmail returns the canonical form of an email address, which is what we store
+// and look up. Email addresses are matched case-insensitively, so we lowercase them and
+// trim any surrounding whitespace.
+func NormalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// The IsSet() reports whether the user has a password. Users who signed up via an
+// OAuth provider don't.
+func (p *password) IsSet() bool {
+	return p.hash != nil
+}
+
+// The NeedsRehash() reports whether the stored hash was generated with a different
+// algorithm, or weaker parameters, than the ones currently configured. It's intended
+// to be checked after a successful Matches() so that the hash can be upgraded.
+func (p *password) NeedsRehash() bool {
+	return p.hash != nil && needsRehash(p.hash)
+}
+
+// NormalizeUsername returns the canonical form of a username. Like email addresses,
+// usernames are matched case-insensitively, so we store them lowercased.
+func NormalizeUsername(username string) string {
+	return strings.ToLower(strings.TrimSpace(username))
+}
+
+func ValidateUsername(v *validator.Validator, username string) {
+	v.Check(username != "", "username", validator.Msg("required"))
+	v.Check(validator.MinRunes(username, 3), "username", validator.Msg("min_chars", "n", 3))
+	v.Check(validator.MaxRunes(username, 30), "username", validator.Msg("max_chars", "n", 30))
+	v.Check(validator.Matches(username, validator.UsernameRX), "username", validator.Msg("username_format"))
+}
+
 func ValidateEmail(v *validator.Validator, email string) {
-	v.Check(email != "", "email", "must be provided")
-	v.Check(validator.Matches(email, validator.EmailRX), "email", "must be a valid email address")
+	v.Check(email != "", "email", validator.Msg("required"))
+	v.Check(validator.Matches(email, validator.EmailRX), "email", validator.Msg("email_format"))
 }
 
-func ValidatePasswordPlaintext(v *validator.Validator, password string) {
-	v.Check(password != "", "password", "must be provided")
-	v.Check(len(password) >= 8, "password", "must be at least 8 bytes long")
-	v.Check(len(password) <= 72, "password", "must not be more than 72 bytes long")
+// ValidatePasswordPlaintext checks a new password. The optional personal values (such
+// as the user's name and the local-part of their email address) are too easy to guess,
+// so the password must not be equal to any of them.
+func ValidatePasswordPlaintext(v *validator.Validator, password string, personal ...string) {
+	v.Check(password != "", "password", validator.Msg("required"))
+	v.Check(validator.MinBytes(password, 8), "password", validator.Msg("min_bytes", "n", 8))
+	v.Check(validator.MaxBytes(password, 72), "password", validator.Msg("max_bytes", "n", 72))
+	v.Check(!IsCommonPassword(password), "password", validator.Msg("password_common"))
+
+	for _, value := range personal {
+		v.Check(value == "" || !strings.EqualFold(password, value), "password", validator.Msg("password_personal"))
+	}
 }
 
-func ValidateUser(v *validator.Validator, user *User) {
-	v.Check(user.Name != "", "name", "must be provided")
-	v.Check(len(user.Name) <= 500, "name", "must not be more than 500 bytes long")
+// ValidateUser checks the user's details, adding any problems with them to the
+// validator. It returns an error only for a problem which isn't the client's fault.
+func ValidateUser(v *validator.Validator, user *User) error {
+	v.Check(user.Name != "", "name", validator.Msg("required"))
+	v.Check(validator.MaxBytes(user.Name, 500), "name", validator.Msg("max_bytes", "n", 500))
 
-	// Call the standalone ValidateEmail() helper.
+	// Call the standalone ValidateUsername() and ValidateEmail() helpers.
+	ValidateUsername(v, user.Username)
 	ValidateEmail(v, user.Email)
 
+	v.Check(validator.In(user.Locale, SupportedLocales...), "locale", validator.Msg("unsupported_locale"))
+
 	// If the plaintext password is not nil, call the standalone
-	// ValidatePasswordPlaintext() helper.
+	// ValidatePasswordPlaintext() helper, passing in the user's name and the
+	// local-part of their email address so that neither can be used as the password.
 	if user.Password.plaintext != nil {
-		ValidatePasswordPlaintext(v, *user.Password.plaintext)
+		localPart := user.Email
+		if i := strings.LastIndex(localPart, "@"); i >= 0 {
+			localPart = localPart[:i]
+		}
+
+		ValidatePasswordPlaintext(v, *user.Password.plaintext, user.Name, localPart)
 	}
 
 	// If the password hash is ever nil, this will be due to a logic error in our
 	// codebase (probably because we forgot to set a password for the user). It's
 	// a useful sanity check to include here, but it's not a problem with the data
 	// provided by the client. So rather than adding an error to the validation map
-	// we raise a panic instead.
-	if user.Password.hash == nil {
-		panic("missing password hash for user")
+	// we return an error for the caller to treat as a server error. Users who sign in
+	// via an OAuth provider don't have a password, so the check only applies to
+	// everyone else.
+	if user.Password.hash == nil && user.OAuthProvider == "" {
+		return ErrMissingPassword
 	}
+
+	return nil
 }
 
-// Insert a new record in the database for the user. Note that the id, created_at and
-// version fields are all automatically generated by our database, so we use the
-// RETURNING clause to read them into the User struct after the insert.
+// Insert a new record in the database for the user. Note that the id, public_id,
+// created_at and version fields are all automatically generated by our database, so we
+// use the RETURNING clause to read them into the User struct after the insert.
 func (m UserModel) Insert(user *User) error {
-	query := `
-		INSERT INTO users (name, email, password_hash, activated)
-		VALUES ($1, $2, $3, $4)
-		RETURNING id, created_at, version`
-
-	args := []interface{}{user.Name, user.Email, user.Password.hash, user.Activated}
-
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
+	return insertUser(ctx, m.DB, m.Dialect, user)
+}
+
+// The insertUser() helper runs the insert for Insert() and Register().
+func insertUser(ctx context.Context, db Querier, dialect Dialect, user *User) error {
+	query := `
+		INSERT INTO users (name, username, email, locale, password_hash, activated, oauth_provider, oauth_subject)
+		VALUES ($1, $2, $3, $4, $5, $6, NULLIF($7, ''), NULLIF($8, ''))
+		RETURNING id, public_id, created_at, version`
+
+	args := []interface{}{user.Name, user.Username, user.Email, user.Locale, user.Password.hash, user.Activated, user.OAuthProvider, user.OAuthSubject}
+
 	// If the table already contains a record with this email address, then when we try
 	// to perform the insert there will be a violation of the UNIQUE "user_email_key"
 	// constraint that we set up in the previous chapter. We check for this error
 	// specifically, and return custom ErrDuplicateEmail error instead.
-	err := m.DB.QueryRowContext(ctx, query, args...).Scan(
+	err := db.QueryRowContext(ctx, dialect.Rebind(query), args...).Scan(
 		&user.ID,
+		&user.PublicID,
 		&user.CreatedAt,
 		&user.Version,
 	)
 
 	if err != nil {
 		switch {
-		case err.Error() == `pq: duplicate key value violates unique constraint "users_email_key"`:
+		case isDuplicateEmail(dialect, err):
 			return ErrDuplicateEmail
+		case isDuplicateUsername(dialect, err):
+			return ErrDuplicateUsername
 		default:
 			return err
 		}
@@ -146,28 +237,266 @@ func (m UserModel) Insert(user *User) error {
 	return nil
 }
 
+// Register inserts a new user along with their roles, an activation token, and the
+// welcome email in the outbox, all in a single transaction. Either everything is
+// written or nothing is, so a crash can never leave a user without their activation
+// email. The email is built by the newEmail function, as it needs the plaintext token.
+func (m UserModel) Register(user *User, roles []string, activationTTL time.Duration, newEmail func(token *Token) *EmailJob) (*Token, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := beginTx(ctx, m.DB)
+	if err != nil {
+		return nil, err
+	}
+
+	// Rollback() is a no-op if the transaction has already been committed.
+	defer tx.Rollback()
+
+	err = insertUser(ctx, tx, m.Dialect, user)
+	if err != nil {
+		return nil, err
+	}
+
+	err = addRolesForUser(ctx, tx, m.Dialect, user.ID, roles...)
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := generateToekn(user.ID, activationTTL, ScopeActivation)
+	if err != nil {
+		return nil, err
+	}
+
+	err = insertToken(ctx, tx, m.Dialect, token)
+	if err != nil {
+		return nil, err
+	}
+
+	err = insertEmailJob(ctx, tx, m.Dialect, newEmail(token))
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	return token, nil
+}
+
 // Retrieve the User details from the database based on the user's email address.
 // Because we have a UNIQUE constraint on the email column, this SQL query will only
 // return one record (or none at all, in which case we return a ErrRecordNotFound error).
 func (m UserModel) GetByEmail(email string) (*User, error) {
+	query := fmt.Sprintf(`
+		SELECT id, public_id, created_at, name, username, email, locale, password_hash, activated, version, last_login_at
+		FROM users
+		WHERE lower(%s) = $1`, m.Dialect.Cast("email", "text"))
+
+	var user User
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	// Callers should already have normalized the email address, but we do it again
+	// here so that a lookup can never miss because of its case.
+	err := m.ReadDB.QueryRowContext(ctx, m.Dialect.Rebind(query), NormalizeEmail(email)).Scan(
+		&user.ID,
+		&user.PublicID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Username,
+		&user.Email,
+		&user.Locale,
+		&user.Password.hash,
+		&user.Activated,
+		&user.Version,
+		&user.LastLoginAt,
+	)
+
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &user, nil
+}
+
+// Retrieve the User details from the database based on the user's username, returning
+// a ErrRecordNotFound error if there is no such user.
+func (m UserModel) GetByUsername(username string) (*User, error) {
+	query := `
+		SELECT id, public_id, created_at, name, username, email, locale, password_hash, activated, version, last_login_at
+		FROM users
+		WHERE lower(username) = $1`
+
+	var user User
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.ReadDB.QueryRowContext(ctx, m.Dialect.Rebind(query), NormalizeUsername(username)).Scan(
+		&user.ID,
+		&user.PublicID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Username,
+		&user.Email,
+		&user.Locale,
+		&user.Password.hash,
+		&user.Activated,
+		&user.Version,
+		&user.LastLoginAt,
+	)
+
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &user, nil
+}
+
+// AvailableUsername derives a username from the local-part of an email address, for
+// users who didn't choose one themselves. If the username is taken, a numeric suffix
+// is appended. This mirrors the backfill in the add_users_username migration.
+func (m UserModel) AvailableUsername(email string) (string, error) {
+	base := usernameFromEmail(email)
+
+	query := `
+		SELECT EXISTS(SELECT 1 FROM users WHERE lower(username) = $1)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	for i := 1; ; i++ {
+		username := base
+		if i > 1 {
+			username = fmt.Sprintf("%s%d", base, i)
+		}
+
+		var exists bool
+
+		err := m.DB.QueryRowContext(ctx, m.Dialect.Rebind(query), username).Scan(&exists)
+		if err != nil {
+			return "", err
+		}
+
+		if !exists {
+			return username, nil
+		}
+	}
+}
+
+// The usernameFromEmail() helper lowercases the local-part of an email address and
+// replaces any characters which aren't allowed in a username with underscores. The
+// result is padded to the minimum length and truncated to leave room for a suffix.
+func usernameFromEmail(email string) string {
+	localPart := NormalizeEmail(email)
+	if i := strings.LastIndex(localPart, "@"); i >= 0 {
+		localPart = localPart[:i]
+	}
+
+	username := []byte(localPart)
+	for i, c := range username {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '_') {
+			username[i] = '_'
+		}
+	}
+
+	for len(username) < 3 {
+		username = append(username, '_')
+	}
+
+	if len(username) > 24 {
+		username = username[:24]
+	}
+
+	return string(username)
+}
+
+// Retrieve the User details from the database based on the user's ID, returning a
+// ErrRecordNotFound error if there is no such user.
+func (m UserModel) Get(id int64) (*User, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `
+		SELECT id, public_id, created_at, name, username, email, locale, password_hash, activated, version, last_login_at
+		FROM users
+		WHERE id = $1`
+
+	var user User
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.ReadDB.QueryRowContext(ctx, m.Dialect.Rebind(query), id).Scan(
+		&user.ID,
+		&user.PublicID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Username,
+		&user.Email,
+		&user.Locale,
+		&user.Password.hash,
+		&user.Activated,
+		&user.Version,
+		&user.LastLoginAt,
+	)
+
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &user, nil
+}
+
+// Retrieve the User details from the database based on the user's public ID, returning
+// a ErrRecordNotFound error if there is no such user.
+func (m UserModel) GetByPublicID(publicID UUID) (*User, error) {
+	if publicID.IsNil() {
+		return nil, ErrRecordNotFound
+	}
+
 	query := `
-		SELECT id, created_at, name, email, password_hash, activated, version
+		SELECT id, public_id, created_at, name, username, email, locale, password_hash, activated, version, last_login_at
 		FROM users
-		WHERE email = $1`
+		WHERE public_id = $1`
 
 	var user User
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	err := m.DB.QueryRowContext(ctx, query, email).Scan(
+	err := m.ReadDB.QueryRowContext(ctx, m.Dialect.Rebind(query), publicID).Scan(
 		&user.ID,
+		&user.PublicID,
 		&user.CreatedAt,
 		&user.Name,
+		&user.Username,
 		&user.Email,
+		&user.Locale,
 		&user.Password.hash,
 		&user.Activated,
 		&user.Version,
+		&user.LastLoginAt,
 	)
 
 	if err != nil {
@@ -188,13 +517,15 @@ func (m UserModel) GetByEmail(email string) (*User, error) {
 func (m UserModel) Update(user *User) error {
 	query := `
 		UPDATE users
-		SET name = $1, email = $2, password_hash = $3, activated = $4, version = version + 1
-		WHERE id = $5 AND version = $6
+		SET name = $1, username = $2, email = $3, locale = $4, password_hash = $5, activated = $6, version = version + 1
+		WHERE id = $7 AND version = $8
 		RETURNING version`
 
 	args := []interface{}{
 		user.Name,
+		user.Username,
 		user.Email,
+		user.Locale,
 		user.Password.hash,
 		user.Activated,
 		user.ID,
@@ -204,12 +535,107 @@ func (m UserModel) Update(user *User) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&user.Version)
+	err := m.DB.QueryRowContext(ctx, m.Dialect.Rebind(query), args...).Scan(&user.Version)
 
 	if err != nil {
 		switch {
-		case err.Error() == `pq: duplicate key value violates unique constraint "users_email_key"`:
+		case isDuplicateEmail(m.Dialect, err):
 			return ErrDuplicateEmail
+		case isDuplicateUsername(m.Dialect, err):
+			return ErrDuplicateUsername
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Retrieve the User details for the account linked to a specific OAuth provider and
+// subject, returning a ErrRecordNotFound error if no user has been linked yet.
+func (m UserModel) GetByOAuth(provider, subject string) (*User, error) {
+	query := `
+		SELECT id, public_id, created_at, name, username, email, locale, password_hash, activated, version, last_login_at
+		FROM users
+		WHERE oauth_provider = $1 AND oauth_subject = $2`
+
+	user := User{
+		OAuthProvider: provider,
+		OAuthSubject:  subject,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.ReadDB.QueryRowContext(ctx, m.Dialect.Rebind(query), provider, subject).Scan(
+		&user.ID,
+		&user.PublicID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Username,
+		&user.Email,
+		&user.Locale,
+		&user.Password.hash,
+		&user.Activated,
+		&user.Version,
+		&user.LastLoginAt,
+	)
+
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &user, nil
+}
+
+// LinkOAuth records the OAuth provider and subject against an existing user and marks
+// the account as activated, since the provider has verified the email address. As with
+// Update() we check the version number to avoid race conditions.
+//
+// If the account wasn't activated, whoever registered it never proved that they own
+// the email address, and could have set the password in advance to take over the
+// account once the real owner signs in with the provider. So in that case we also
+// remove the password and all of the user's tokens, in the same transaction.
+func (m UserModel) LinkOAuth(user *User, provider, subject string) error {
+	query := `
+		UPDATE users
+		SET oauth_provider = $1, oauth_subject = $2, activated = true, version = version + 1
+		WHERE id = $3 AND version = $4
+		RETURNING version`
+
+	if !user.Activated {
+		query = `
+			UPDATE users
+			SET oauth_provider = $1, oauth_subject = $2, activated = true, password_hash = NULL, version = version + 1
+			WHERE id = $3 AND version = $4
+			RETURNING version`
+	}
+
+	args := []interface{}{provider, subject, user.ID, user.Version}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := beginTx(ctx, m.DB)
+	if err != nil {
+		return err
+	}
+
+	// Rollback() is a no-op if the transaction has already been committed.
+	defer tx.Rollback()
+
+	var version int
+
+	err = tx.QueryRowContext(ctx, m.Dialect.Rebind(query), args...).Scan(&version)
+	if err != nil {
+		switch {
 		case errors.Is(err, sql.ErrNoRows):
 			return ErrEditConflict
 		default:
@@ -217,6 +643,27 @@ func (m UserModel) Update(user *User) error {
 		}
 	}
 
+	if !user.Activated {
+		_, err = tx.ExecContext(ctx, m.Dialect.Rebind(`DELETE FROM tokens WHERE user_id = $1`), user.ID)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	if !user.Activated {
+		user.Password.hash = nil
+	}
+
+	user.Version = version
+	user.OAuthProvider = provider
+	user.OAuthSubject = subject
+	user.Activated = true
+
 	return nil
 }
 
@@ -227,7 +674,7 @@ func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error)
 
 	// Set up the SQL query.
 	query := `
-		SELECT users.id, users.created_at, users.name, users.email, users.password_hash, users.activated, users.version
+		SELECT users.id, users.public_id, users.created_at, users.name, users.username, users.email, users.locale, users.password_hash, users.activated, users.version, users.last_login_at
 		FROM users
 		INNER JOIN tokens
 		ON users.id = tokens.user_id
@@ -248,16 +695,26 @@ func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error)
 
 	// Execute the query, scanning the return values into a User struct. If no matching
 	// record is found, we return an ErrRecordNotFound error.
-	err := m.DB.QueryRowContext(ctx, query, args...).Scan(
-		&user.ID,
-		&user.CreatedAt,
-		&user.Name,
-		&user.Email,
-		&user.Password.hash,
-		&user.Activated,
-		&user.Version,
-	)
+	scan := func(db Querier) error {
+		return db.QueryRowContext(ctx, m.Dialect.Rebind(query), args...).Scan(
+			&user.ID,
+			&user.PublicID,
+			&user.CreatedAt,
+			&user.Name,
+			&user.Username,
+			&user.Email,
+			&user.Locale,
+			&user.Password.hash,
+			&user.Activated,
+			&user.Version,
+			&user.LastLoginAt,
+		)
+	}
 
+	// Look the token up on the primary rather than the read replica. A token issued
+	// moments ago may not have reached the replica yet, and, worse, one which has
+	// just been deleted (on logout, or when the user is deleted) may still be there.
+	err := scan(m.DB)
 	if err != nil {
 		switch {
 		case errors.Is(err, sql.ErrNoRows):
@@ -271,6 +728,174 @@ func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error)
 	return &user, nil
 }
 
+// RecordLogin stores the time of a successful login against the user, and adds an
+// entry to their login history. Only the most recent maxLoginHistory entries are kept.
+// Note that we don't increment the version number, as the login time isn't something
+// that the user edits and it shouldn't cause edit conflicts.
+func (m UserModel) RecordLogin(userID int64, ip, userAgent string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := beginTx(ctx, m.DB)
+	if err != nil {
+		return err
+	}
+
+	// Rollback() is a no-op if the transaction has already been committed.
+	defer tx.Rollback()
+
+	now := time.Now()
+
+	_, err = tx.ExecContext(ctx, m.Dialect.Rebind(`
+		UPDATE users
+		SET last_login_at = $1
+		WHERE id = $2`), now, userID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, m.Dialect.Rebind(`
+		INSERT INTO logins (user_id, created_at, ip, user_agent)
+		VALUES ($1, $2, $3, $4)`), userID, now, ip, userAgent)
+	if err != nil {
+		return err
+	}
+
+	// Prune everything but the most recent entries for the user.
+	_, err = tx.ExecContext(ctx, m.Dialect.Rebind(`
+		DELETE FROM logins
+		WHERE user_id = $1 AND id NOT IN (
+			SELECT id FROM logins
+			WHERE user_id = $1
+			ORDER BY created_at DESC, id DESC
+			LIMIT $2
+		)`), userID, maxLoginHistory)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// The isDuplicateEmail() helper reports whether err is a violation of the unique index
+// on the users' email addresses. We check for the original "users_email_key" constraint
+// as well, in case the normalize_users_email migration hasn't been applied yet.
+func isDuplicateEmail(dialect Dialect, err error) bool {
+	return dialect.UniqueViolation(err, "users_email_lower_idx") || dialect.UniqueViolation(err, "users_email_key")
+}
+
+// The isDuplicateUsername() helper reports whether an error was caused by the unique
+// index on usernames.
+func isDuplicateUsername(dialect Dialect, err error) bool {
+	return dialect.UniqueViolation(err, "users_username_lower_idx")
+}
+
+// Delete a specific user along with everything that belongs to them. The foreign keys
+// on these tables cascade anyway, but deleting the rows explicitly inside a single
+// transaction means the user is never left half-deleted if a constraint changes.
+//
+// The idempotency keys and emails aren't tied to the user by a foreign key (the emails
+// only record the address they're sent to), so those have to be deleted here. Their
+// ratings and watchlist entries go with the cascade, as do their reviews unless
+// anonymizeReviews is true, in which case the reviews are kept without an author.
+func (m UserModel) Delete(id int64, anonymizeReviews bool) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := beginTx(ctx, m.DB)
+	if err != nil {
+		return err
+	}
+
+	// Rollback() is a no-op if the transaction has already been committed.
+	defer tx.Rollback()
+
+	queries := []string{
+		`DELETE FROM tokens WHERE user_id = $1`,
+		`DELETE FROM users_permissions WHERE user_id = $1`,
+		`DELETE FROM user_roles WHERE user_id = $1`,
+		`DELETE FROM logins WHERE user_id = $1`,
+		`DELETE FROM idempotency_keys WHERE user_id = $1`,
+		`DELETE FROM email_jobs WHERE ` + m.Dialect.Cast("recipient", "citext") + ` = (SELECT email FROM users WHERE id = $1)`,
+		`DELETE FROM failed_emails WHERE ` + m.Dialect.Cast("recipient", "citext") + ` = (SELECT email FROM users WHERE id = $1)`,
+		`DELETE FROM ratings WHERE user_id = $1`,
+		`DELETE FROM watchlist WHERE user_id = $1`,
+		`DELETE FROM watchlist_notifications WHERE user_id = $1`,
+		`DELETE FROM api_usage WHERE user_id = $1`,
+		`DELETE FROM saved_searches WHERE user_id = $1`,
+		`DELETE FROM reports WHERE user_id = $1`,
+	}
+
+	if anonymizeReviews {
+		queries = append(queries, `UPDATE reviews SET user_id = NULL, version = version + 1 WHERE user_id = $1`)
+	} else {
+		queries = append(queries, `DELETE FROM reviews WHERE user_id = $1`)
+	}
+
+	for _, query := range queries {
+		_, err = tx.ExecContext(ctx, m.Dialect.Rebind(query), id)
+		if err != nil {
+			return err
+		}
+	}
+
+	result, err := tx.ExecContext(ctx, m.Dialect.Rebind(`DELETE FROM users WHERE id = $1`), id)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return tx.Commit()
+}
+
+// The GetVersionForToken() returns the current version number of the user associated
+// with a token, or a ErrRecordNotFound error if the token has been deleted or has
+// expired. It's a cheaper way of checking that a cached user is still valid than
+// calling GetForToken() again.
+func (m UserModel) GetVersionForToken(tokenScope string, tokenHash [32]byte) (int, error) {
+	query := `
+		SELECT users.version
+		FROM users
+		INNER JOIN tokens
+		ON users.id = tokens.user_id
+		WHERE tokens.hash = $1
+		AND tokens.scope = $2
+		AND tokens.expiry > $3`
+
+	args := []interface{}{tokenHash[:], tokenScope, time.Now()}
+
+	var version int
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	// Like GetForToken(), this is used to authenticate a request, so it reads from the
+	// primary.
+	err := m.DB.QueryRowContext(ctx, m.Dialect.Rebind(query), args...).Scan(&version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return 0, ErrRecordNotFound
+		default:
+			return 0, err
+		}
+	}
+
+	return version, nil
+}
+
 // Check if a User instance is the AnonymousUser.
 func (u *User) IsAnonymous() bool {
 	return u == AnonymousUser
@@ -0,0 +1,247 @@
+package data
+
+import (
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/petrostrak/an-open-movie-database/internal/testdb"
+	"github.com/petrostrak/an-open-movie-database/internal/validator"
+)
+
+func TestUserModelDelete(t *testing.T) {
+	for _, anonymizeReviews := range []bool{false, true} {
+		name := "delete reviews"
+		if anonymizeReviews {
+			name = "anonymize reviews"
+		}
+
+		t.Run(name, func(t *testing.T) {
+			driverName, db := testdb.Open(t)
+
+			models, err := NewModelsForDriver(driverName, db, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			user := newTestUserWithData(t, db, models, "alice")
+			other := newTestUserWithData(t, db, models, "bob")
+
+			err = models.Users.Delete(user.ID, anonymizeReviews)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Nothing belonging to the deleted user should be left behind, and the other
+			// user's data should be untouched. The emails are found by their recipient.
+			for _, tt := range []struct {
+				table string
+				query string
+				byID  bool
+			}{
+				{"users", `SELECT count(*) FROM users WHERE id = $1`, true},
+				{"tokens", `SELECT count(*) FROM tokens WHERE user_id = $1`, true},
+				{"users_permissions", `SELECT count(*) FROM users_permissions WHERE user_id = $1`, true},
+				{"user_roles", `SELECT count(*) FROM user_roles WHERE user_id = $1`, true},
+				{"logins", `SELECT count(*) FROM logins WHERE user_id = $1`, true},
+				{"idempotency_keys", `SELECT count(*) FROM idempotency_keys WHERE user_id = $1`, true},
+				{"email_jobs", `SELECT count(*) FROM email_jobs WHERE recipient = $1`, false},
+				{"failed_emails", `SELECT count(*) FROM failed_emails WHERE recipient = $1`, false},
+				{"ratings", `SELECT count(*) FROM ratings WHERE user_id = $1`, true},
+				{"reviews", `SELECT count(*) FROM reviews WHERE user_id = $1`, true},
+				{"watchlist", `SELECT count(*) FROM watchlist WHERE user_id = $1`, true},
+				{"api_usage", `SELECT count(*) FROM api_usage WHERE user_id = $1`, true},
+			} {
+				deletedArg, otherArg := interface{}(user.Email), interface{}(other.Email)
+				if tt.byID {
+					deletedArg, otherArg = user.ID, other.ID
+				}
+
+				if n := count(t, db, tt.query, deletedArg); n != 0 {
+					t.Errorf("got %d rows in %s for the deleted user; want 0", n, tt.table)
+				}
+
+				if n := count(t, db, tt.query, otherArg); n == 0 {
+					t.Errorf("got no rows in %s for the other user", tt.table)
+				}
+			}
+
+			want := 0
+			if anonymizeReviews {
+				want = 1
+			}
+
+			if n := count(t, db, `SELECT count(*) FROM reviews WHERE user_id IS NULL`); n != want {
+				t.Errorf("got %d anonymous reviews; want %d", n, want)
+			}
+
+			err = models.Users.Delete(user.ID, anonymizeReviews)
+			if err != ErrRecordNotFound {
+				t.Errorf("got error %v deleting the user again; want ErrRecordNotFound", err)
+			}
+		})
+	}
+}
+
+// The newTestUserWithData() helper inserts a user along with a row in every table
+// which holds data about them.
+func newTestUserWithData(t *testing.T, db *sql.DB, models Models, name string) *User {
+	t.Helper()
+
+	user := &User{Name: name, Username: name, Email: name + "@example.com", Activated: true}
+
+	err := user.Password.Set("pa55word1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = models.Users.Insert(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	movie := &Movie{Title: name + "'s movie", Year: 2000, Runtime: 90, Genres: []string{"drama"}}
+
+	err = models.Movies.Insert(movie)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = models.Tokens.New(user.ID, time.Hour, ScopeAuthentication)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, f := range []func() error{
+		func() error { return models.Permissions.AddForUser(user.ID, "movies:read") },
+		func() error { return models.Roles.AddForUser(user.ID, "reader") },
+		func() error { return models.Users.RecordLogin(user.ID, "192.0.2.1", "test") },
+		func() error {
+			_, _, err := models.Idempotency.Claim(user.ID, "key", []byte("fingerprint"), time.Hour)
+			return err
+		},
+		func() error {
+			return models.EmailJobs.Insert(&EmailJob{Recipient: user.Email, Locale: "en", Template: "user_welcome.tmpl"})
+		},
+		func() error {
+			return models.Usage.Add([]UsageCount{{UserID: user.ID, Date: time.Now(), Requests: 1}})
+		},
+		func() error {
+			return models.FailedEmails.Insert(&FailedEmail{Recipient: user.Email, Template: "user_welcome.tmpl", Error: "test"})
+		},
+	} {
+		err := f()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, query := range []string{
+		`INSERT INTO ratings (user_id, movie_id, rating) VALUES ($1, $2, 8)`,
+		`INSERT INTO reviews (user_id, movie_id, body) VALUES ($1, $2, 'Good')`,
+		`INSERT INTO watchlist (user_id, movie_id) VALUES ($1, $2)`,
+	} {
+		_, err := db.Exec(query, user.ID, movie.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return user
+}
+
+func count(t *testing.T, db *sql.DB, query string, args ...interface{}) int {
+	t.Helper()
+
+	var n int
+
+	err := db.QueryRow(query, args...).Scan(&n)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return n
+}
+
+func TestUserModelGetByPublicID(t *testing.T) {
+	driverName, db := testdb.Open(t)
+
+	models, err := NewModelsForDriver(driverName, db, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user := newTestUserWithData(t, db, models, "alice")
+	newTestUserWithData(t, db, models, "bob")
+
+	if user.PublicID.IsNil() {
+		t.Fatal("got a nil public ID after the insert")
+	}
+
+	got, err := models.Users.GetByPublicID(user.PublicID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got.ID != user.ID || got.PublicID != user.PublicID {
+		t.Errorf("got user %d (%s); want %d (%s)", got.ID, got.PublicID, user.ID, user.PublicID)
+	}
+
+	other, err := NewUUID()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, publicID := range []UUID{other, NilUUID} {
+		_, err = models.Users.GetByPublicID(publicID)
+		if !errors.Is(err, ErrRecordNotFound) {
+			t.Errorf("got error %v for %s; want ErrRecordNotFound", err, publicID)
+		}
+	}
+}
+
+// A user without a password hash is an error for the caller, rather than a validation
+// failure, unless they signed up through an OAuth provider.
+func TestValidateUserMissingPassword(t *testing.T) {
+	tests := []struct {
+		name    string
+		user    *User
+		wantErr error
+	}{
+		{"no hash", &User{Name: "Alice", Username: "alice", Email: "alice@example.com", Locale: DefaultLocale}, ErrMissingPassword},
+		{"oauth", &User{Name: "Alice", Username: "alice", Email: "alice@example.com", Locale: DefaultLocale, OAuthProvider: "google"}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := validator.New()
+
+			err := ValidateUser(v, tt.user)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("got error %v; want %v", err, tt.wantErr)
+			}
+
+			if !v.Valid() {
+				t.Errorf("got validation errors %v; want none", v.Errors)
+			}
+		})
+	}
+}
+
+func TestNormalizeEmail(t *testing.T) {
+	tests := []struct {
+		email string
+		want  string
+	}{
+		{"alice@example.com", "alice@example.com"},
+		{"Alice@Example.COM", "alice@example.com"},
+		{"  ALICE@EXAMPLE.COM\n", "alice@example.com"},
+	}
+
+	for _, tt := range tests {
+		if got := NormalizeEmail(tt.email); got != tt.want {
+			t.Errorf("got %q for %q; want %q", got, tt.email, tt.want)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package data
+
+import (
+	"crypto/rand"
+	"database/sql/driver"
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+// Define an error that ParseUUID() returns for a string which isn't a UUID.
+var ErrInvalidUUID = errors.New("invalid UUID")
+
+// Declare a UUID type to hold the identifiers of resources which shouldn't be
+// enumerable, such as the public IDs of users. It's encoded in the canonical form,
+// "xxxxxxxx-xxxx-xxxx-xxxx-xxxxxxxxxxxx", in JSON and in the database.
+type UUID [16]byte
+
+// NilUUID is the UUID with every bit set to zero, which never identifies anything.
+var NilUUID UUID
+
+// NewUUID returns a random (version 4) UUID.
+func NewUUID() (UUID, error) {
+	var u UUID
+
+	_, err := rand.Read(u[:])
+	if err != nil {
+		return NilUUID, err
+	}
+
+	// Set the version to 4 and the variant to the one from RFC 4122.
+	u[6] = (u[6] & 0x0f) | 0x40
+	u[8] = (u[8] & 0x3f) | 0x80
+
+	return u, nil
+}
+
+// ParseUUID parses a UUID in the canonical form, in either case. Any other form, such
+// as one without the hyphens or wrapped in braces, returns ErrInvalidUUID.
+func ParseUUID(s string) (UUID, error) {
+	var u UUID
+
+	if len(s) != 36 || s[8] != '-' || s[13] != '-' || s[18] != '-' || s[23] != '-' {
+		return NilUUID, ErrInvalidUUID
+	}
+
+	digits := s[0:8] + s[9:13] + s[14:18] + s[19:23] + s[24:36]
+
+	_, err := hex.Decode(u[:], []byte(digits))
+	if err != nil {
+		return NilUUID, ErrInvalidUUID
+	}
+
+	return u, nil
+}
+
+// String returns the UUID in the canonical form, in lower case.
+func (u UUID) String() string {
+	var buf [36]byte
+
+	hex.Encode(buf[0:8], u[0:4])
+	buf[8] = '-'
+	hex.Encode(buf[9:13], u[4:6])
+	buf[13] = '-'
+	hex.Encode(buf[14:18], u[6:8])
+	buf[18] = '-'
+	hex.Encode(buf[19:23], u[8:10])
+	buf[23] = '-'
+	hex.Encode(buf[24:], u[10:])
+
+	return string(buf[:])
+}
+
+// IsNil reports whether u is the nil UUID.
+func (u UUID) IsNil() bool {
+	return u == NilUUID
+}
+
+// MarshalText() and UnmarshalText() encode the UUID in the canonical form, which
+// encoding/json and encoding/xml use for its string value.
+func (u UUID) MarshalText() ([]byte, error) {
+	return []byte(u.String()), nil
+}
+
+func (u *UUID) UnmarshalText(text []byte) error {
+	parsed, err := ParseUUID(string(text))
+	if err != nil {
+		return err
+	}
+
+	*u = parsed
+	return nil
+}
+
+// Value() and Scan() store the UUID in a PostgreSQL uuid column, which the driver
+// reads and writes as text.
+func (u UUID) Value() (driver.Value, error) {
+	return u.String(), nil
+}
+
+func (u *UUID) Scan(src interface{}) error {
+	switch src := src.(type) {
+	case string:
+		return u.UnmarshalText([]byte(src))
+	case []byte:
+		return u.UnmarshalText(src)
+	default:
+		return fmt.Errorf("cannot scan %T into a UUID", src)
+	}
+}
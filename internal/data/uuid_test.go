@@ -0,0 +1,125 @@
+package data
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestNewUUID(t *testing.T) {
+	seen := make(map[UUID]bool)
+
+	for i := 0; i < 100; i++ {
+		u, err := NewUUID()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if seen[u] {
+			t.Fatalf("got %s twice", u)
+		}
+		seen[u] = true
+
+		s := u.String()
+		if s[14] != '4' || !(s[19] == '8' || s[19] == '9' || s[19] == 'a' || s[19] == 'b') {
+			t.Errorf("got %s; want a version 4 UUID with the RFC 4122 variant", s)
+		}
+
+		parsed, err := ParseUUID(s)
+		if err != nil || parsed != u {
+			t.Errorf("got %s and error %v parsing %s", parsed, err, s)
+		}
+	}
+}
+
+func TestParseUUID(t *testing.T) {
+	valid := UUID{0x12, 0x3e, 0x45, 0x67, 0xe8, 0x9b, 0x12, 0xd3, 0xa4, 0x56, 0x42, 0x66, 0x14, 0x17, 0x40, 0x00}
+
+	tests := []struct {
+		name    string
+		s       string
+		want    UUID
+		wantErr bool
+	}{
+		{"lower case", "123e4567-e89b-12d3-a456-426614174000", valid, false},
+		{"upper case", "123E4567-E89B-12D3-A456-426614174000", valid, false},
+		{"nil", "00000000-0000-0000-0000-000000000000", NilUUID, false},
+		{"empty", "", NilUUID, true},
+		{"no hyphens", "123e4567e89b12d3a456426614174000", NilUUID, true},
+		{"braces", "{123e4567-e89b-12d3-a456-426614174000}", NilUUID, true},
+		{"urn", "urn:uuid:123e4567-e89b-12d3-a456-426614174000", NilUUID, true},
+		{"hyphen moved", "123e456-7e89b-12d3-a456-426614174000", NilUUID, true},
+		{"too short", "123e4567-e89b-12d3-a456-42661417400", NilUUID, true},
+		{"too long", "123e4567-e89b-12d3-a456-4266141740000", NilUUID, true},
+		{"not hex", "123e4567-e89b-12d3-a456-42661417400g", NilUUID, true},
+		{"integer", "42", NilUUID, true},
+		{"spaces", " 123e4567-e89b-12d3-a456-426614174000", NilUUID, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseUUID(tt.s)
+			if tt.wantErr {
+				if !errors.Is(err, ErrInvalidUUID) {
+					t.Errorf("got %s and error %v; want ErrInvalidUUID", got, err)
+				}
+				return
+			}
+
+			if err != nil || got != tt.want {
+				t.Errorf("got %s and error %v; want %s", got, err, tt.want)
+			}
+		})
+	}
+
+	if s := valid.String(); s != "123e4567-e89b-12d3-a456-426614174000" {
+		t.Errorf("got string %s", s)
+	}
+
+	if !NilUUID.IsNil() || valid.IsNil() {
+		t.Error("got IsNil() wrong")
+	}
+}
+
+func TestUUIDEncoding(t *testing.T) {
+	u, err := NewUUID()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	js, err := json.Marshal(map[string]UUID{"id": u})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := `{"id":"` + u.String() + `"}`; string(js) != want {
+		t.Errorf("got JSON %s; want %s", js, want)
+	}
+
+	var decoded map[string]UUID
+
+	err = json.Unmarshal(js, &decoded)
+	if err != nil || decoded["id"] != u {
+		t.Errorf("got %v and error %v decoding %s", decoded, err, js)
+	}
+
+	err = json.Unmarshal([]byte(`{"id":"nope"}`), &decoded)
+	if !errors.Is(err, ErrInvalidUUID) {
+		t.Errorf("got error %v decoding an invalid UUID; want ErrInvalidUUID", err)
+	}
+
+	// The driver may give us the column as a string or as bytes.
+	for _, src := range []interface{}{u.String(), []byte(u.String())} {
+		var scanned UUID
+
+		err := scanned.Scan(src)
+		if err != nil || scanned != u {
+			t.Errorf("got %s and error %v scanning %T", scanned, err, src)
+		}
+	}
+
+	var scanned UUID
+	if err := scanned.Scan(int64(1)); err == nil {
+		t.Error("got no error scanning an integer")
+	}
+}
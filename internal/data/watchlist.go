@@ -0,0 +1,240 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Define the error returned when a movie is added to a watchlist it's already on.
+var ErrAlreadyWatching = errors.New("movie is already on the watchlist")
+
+// Define a WatchlistEntry struct to hold a movie on a user's watchlist, and whether
+// the user is emailed when the movie is updated.
+type WatchlistEntry struct {
+	MovieID int64     `json:"movie_id"`
+	Title   string    `json:"title"`
+	Year    int32     `json:"year"`
+	Notify  bool      `json:"notify"`
+	AddedAt time.Time `json:"added_at"`
+}
+
+// Define a Watcher struct to hold a user to email about an update to a movie on their
+// watchlist.
+type Watcher struct {
+	UserID int64
+	Name   string
+	Email  string
+	Locale string
+}
+
+// Define the WatchlistModel type.
+type WatchlistModel struct {
+	DB      Querier
+	ReadDB  Querier
+	Dialect Dialect
+}
+
+// Add puts a movie on a user's watchlist. It returns ErrRecordNotFound if there's no
+// such movie, and ErrAlreadyWatching if it's already on the watchlist.
+func (m WatchlistModel) Add(userID, movieID int64, notify bool) (*WatchlistEntry, error) {
+	query := `
+		INSERT INTO watchlist (user_id, movie_id, notify)
+		VALUES ($1, $2, $3)
+		RETURNING movie_id, (SELECT title FROM movies WHERE movies.id = watchlist.movie_id),
+			(SELECT year FROM movies WHERE movies.id = watchlist.movie_id), notify, created_at`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var entry WatchlistEntry
+
+	err := m.DB.QueryRowContext(ctx, m.Dialect.Rebind(query), userID, movieID, notify).Scan(&entry.MovieID, &entry.Title, &entry.Year, &entry.Notify, &entry.AddedAt)
+	if err != nil {
+		switch {
+		case m.Dialect.UniqueViolation(err, "watchlist_pkey"):
+			return nil, ErrAlreadyWatching
+		case m.Dialect.ForeignKeyViolation(err, "watchlist", "watchlist_movie_id_fkey"):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &entry, nil
+}
+
+// GetAllForUser returns the movies on a user's watchlist, in the order they were added.
+func (m WatchlistModel) GetAllForUser(userID int64) ([]*WatchlistEntry, error) {
+	query := `
+		SELECT watchlist.movie_id, movies.title, movies.year, watchlist.notify, watchlist.created_at
+		FROM watchlist
+		INNER JOIN movies ON movies.id = watchlist.movie_id
+		WHERE watchlist.user_id = $1
+		ORDER BY watchlist.created_at, watchlist.movie_id`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.ReadDB.QueryContext(ctx, m.Dialect.Rebind(query), userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []*WatchlistEntry{}
+
+	for rows.Next() {
+		var entry WatchlistEntry
+
+		err := rows.Scan(&entry.MovieID, &entry.Title, &entry.Year, &entry.Notify, &entry.AddedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		entries = append(entries, &entry)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+// SetNotify sets whether a user is emailed when a movie on their watchlist is updated,
+// returning ErrRecordNotFound if the movie isn't on their watchlist.
+func (m WatchlistModel) SetNotify(userID, movieID int64, notify bool) (*WatchlistEntry, error) {
+	query := `
+		UPDATE watchlist
+		SET notify = $3
+		WHERE user_id = $1 AND movie_id = $2
+		RETURNING movie_id, (SELECT title FROM movies WHERE movies.id = watchlist.movie_id),
+			(SELECT year FROM movies WHERE movies.id = watchlist.movie_id), notify, created_at`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var entry WatchlistEntry
+
+	err := m.DB.QueryRowContext(ctx, m.Dialect.Rebind(query), userID, movieID, notify).Scan(&entry.MovieID, &entry.Title, &entry.Year, &entry.Notify, &entry.AddedAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &entry, nil
+}
+
+// Remove takes a movie off a user's watchlist, returning ErrRecordNotFound if it isn't
+// on it.
+func (m WatchlistModel) Remove(userID, movieID int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, m.Dialect.Rebind(`DELETE FROM watchlist WHERE user_id = $1 AND movie_id = $2`), userID, movieID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// GetWatchers returns up to limit of the activated users who have a movie on their
+// watchlist and asked to be emailed about it, with IDs greater than afterUserID, in
+// order of ID. Pass the last ID of each batch to get the next.
+func (m WatchlistModel) GetWatchers(movieID, afterUserID int64, limit int) ([]*Watcher, error) {
+	query := `
+		SELECT users.id, users.name, users.email, users.locale
+		FROM watchlist
+		INNER JOIN users ON users.id = watchlist.user_id
+		WHERE watchlist.movie_id = $1 AND watchlist.notify AND users.activated AND users.id > $2
+		ORDER BY users.id
+		LIMIT $3`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.ReadDB.QueryContext(ctx, m.Dialect.Rebind(query), movieID, afterUserID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	watchers := []*Watcher{}
+
+	for rows.Next() {
+		var watcher Watcher
+
+		err := rows.Scan(&watcher.UserID, &watcher.Name, &watcher.Email, &watcher.Locale)
+		if err != nil {
+			return nil, err
+		}
+
+		watchers = append(watchers, &watcher)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return watchers, nil
+}
+
+// ClaimNotification counts a watchlist email towards a user's daily limit, and returns
+// false without counting it if they've already had limit emails today (in UTC).
+func (m WatchlistModel) ClaimNotification(userID int64, limit int) (bool, error) {
+	query := fmt.Sprintf(`
+		INSERT INTO watchlist_notifications (user_id, day, sent)
+		VALUES ($1, %s, 1)
+		ON CONFLICT (user_id, day) DO UPDATE
+		SET sent = watchlist_notifications.sent + 1
+		WHERE watchlist_notifications.sent < $2
+		RETURNING sent`, m.Dialect.TodayUTC())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var sent int
+
+	err := m.DB.QueryRowContext(ctx, m.Dialect.Rebind(query), userID, limit).Scan(&sent)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return false, nil
+		default:
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+// DeleteOldNotifications removes the daily email counts from before today, which
+// aren't needed any more, and returns the number removed.
+func (m WatchlistModel) DeleteOldNotifications() (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, `DELETE FROM watchlist_notifications WHERE day < `+m.Dialect.TodayUTC())
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
@@ -0,0 +1,103 @@
+package data
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/petrostrak/an-open-movie-database/internal/testdb"
+)
+
+func TestWatchlistModel(t *testing.T) {
+	driverName, db := testdb.Open(t)
+
+	models, err := NewModelsForDriver(driverName, db, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var users []*User
+
+	for _, name := range []string{"alice", "bob", "carol"} {
+		user := &User{Name: name, Username: name, Email: name + "@example.com", Activated: name != "carol"}
+
+		err := user.Password.Set("pa55word1234")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = models.Users.Insert(user)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		users = append(users, user)
+	}
+
+	alice, bob, carol := users[0], users[1], users[2]
+
+	movie := &Movie{Title: "Moana", Year: 2016, Runtime: 107, Genres: []string{"animation"}}
+
+	err = models.Movies.Insert(movie)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entry, err := models.Watchlist.Add(alice.ID, movie.ID, true)
+	if err != nil || entry.Title != "Moana" || !entry.Notify {
+		t.Fatalf("got entry %+v and error %v; want the movie with notify on", entry, err)
+	}
+
+	if _, err := models.Watchlist.Add(alice.ID, movie.ID, false); !errors.Is(err, ErrAlreadyWatching) {
+		t.Errorf("got error %v; want ErrAlreadyWatching", err)
+	}
+
+	if _, err := models.Watchlist.Add(alice.ID, movie.ID+1000, false); !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("got error %v for a missing movie; want ErrRecordNotFound", err)
+	}
+
+	// Bob doesn't want emails, and carol isn't activated, so only alice is a watcher.
+	for _, user := range []*User{bob, carol} {
+		_, err := models.Watchlist.Add(user.ID, movie.ID, user == carol)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	watchers, err := models.Watchlist.GetWatchers(movie.ID, 0, 10)
+	if err != nil || len(watchers) != 1 || watchers[0].UserID != alice.ID {
+		t.Errorf("got watchers %+v and error %v; want only alice", watchers, err)
+	}
+
+	if watchers, _ := models.Watchlist.GetWatchers(movie.ID, alice.ID, 10); len(watchers) != 0 {
+		t.Errorf("got watchers %+v after alice; want none", watchers)
+	}
+
+	for i, want := range []bool{true, true, false} {
+		ok, err := models.Watchlist.ClaimNotification(alice.ID, 2)
+		if err != nil || ok != want {
+			t.Errorf("claim %d: got %t and error %v; want %t", i+1, ok, err, want)
+		}
+	}
+
+	entry, err = models.Watchlist.SetNotify(alice.ID, movie.ID, false)
+	if err != nil || entry.Notify {
+		t.Errorf("got entry %+v and error %v; want notify off", entry, err)
+	}
+
+	err = models.Watchlist.Remove(alice.ID, movie.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := models.Watchlist.SetNotify(alice.ID, movie.ID, true); !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("got error %v for a removed movie; want ErrRecordNotFound", err)
+	}
+
+	if err := models.Watchlist.Remove(alice.ID, movie.ID); !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("got error %v removing a movie twice; want ErrRecordNotFound", err)
+	}
+
+	if entries, _ := models.Watchlist.GetAllForUser(bob.ID); len(entries) != 1 {
+		t.Errorf("got %d entries for bob; want 1", len(entries))
+	}
+}
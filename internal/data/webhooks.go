@@ -0,0 +1,428 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/petrostrak/an-open-movie-database/internal/validator"
+)
+
+// The events which webhooks can subscribe to.
+const (
+	WebhookMovieCreated = "movie.created"
+	WebhookMovieUpdated = "movie.updated"
+	WebhookMovieDeleted = "movie.deleted"
+)
+
+var WebhookEvents = []string{WebhookMovieCreated, WebhookMovieUpdated, WebhookMovieDeleted}
+
+// Define a Webhook struct to represent an endpoint which is sent an HTTP POST request
+// for each of the events it subscribes to. The secret is used to sign the requests, and
+// is never included in JSON responses. It's encrypted in the database when a data
+// encryption key is set (see SetEncryptionKeyring()), and is always the plaintext here.
+type Webhook struct {
+	ID        int64     `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	URL       string    `json:"url"`
+	Secret    string    `json:"-"`
+	Events    []string  `json:"events"`
+	Active    bool      `json:"active"`
+	Version   int32     `json:"version"`
+}
+
+func ValidateWebhook(v *validator.Validator, webhook *Webhook) {
+	v.Check(webhook.URL != "", "url", validator.Msg("required"))
+	v.Check(validator.MaxBytes(webhook.URL, 2048), "url", validator.Msg("max_bytes", "n", 2048))
+
+	if webhook.URL != "" {
+		v.Check(validator.IsURL(webhook.URL, "http", "https"), "url", validator.Msg("http_url"))
+	}
+
+	v.Check(validator.MinBytes(webhook.Secret, 16), "secret", validator.Msg("min_bytes", "n", 16))
+	v.Check(validator.MaxBytes(webhook.Secret, 256), "secret", validator.Msg("max_bytes", "n", 256))
+
+	v.Check(len(webhook.Events) >= 1, "events", validator.Msg("events_min"))
+	v.Check(validator.Unique(webhook.Events), "events", validator.Msg("duplicate_values"))
+
+	for _, event := range webhook.Events {
+		v.Check(validator.In(event, WebhookEvents...), "events", validator.Msg("unknown_event", "event", event))
+	}
+}
+
+// Define the WebhookModel type.
+type WebhookModel struct {
+	DB      Querier
+	ReadDB  Querier
+	Dialect Dialect
+}
+
+// Insert adds a new webhook.
+func (m WebhookModel) Insert(webhook *Webhook) error {
+	query := `
+		INSERT INTO webhooks (url, secret, events, active)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, created_at, version`
+
+	secret, err := encryptColumn(webhook.Secret)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	args := []interface{}{webhook.URL, secret, m.Dialect.Array(webhook.Events), webhook.Active}
+
+	return m.DB.QueryRowContext(ctx, m.Dialect.Rebind(query), args...).Scan(&webhook.ID, &webhook.CreatedAt, &webhook.Version)
+}
+
+// Get returns a single webhook.
+func (m WebhookModel) Get(id int64) (*Webhook, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `
+		SELECT id, created_at, url, secret, events, active, version
+		FROM webhooks
+		WHERE id = $1`
+
+	var webhook Webhook
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.ReadDB.QueryRowContext(ctx, m.Dialect.Rebind(query), id).Scan(
+		&webhook.ID,
+		&webhook.CreatedAt,
+		&webhook.URL,
+		&webhook.Secret,
+		m.Dialect.ScanArray(&webhook.Events),
+		&webhook.Active,
+		&webhook.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	webhook.Secret, err = decryptColumn(webhook.Secret)
+	if err != nil {
+		return nil, fmt.Errorf("webhook %d secret: %w", webhook.ID, err)
+	}
+
+	return &webhook, nil
+}
+
+// GetAll returns every webhook.
+func (m WebhookModel) GetAll() ([]*Webhook, error) {
+	query := `
+		SELECT id, created_at, url, secret, events, active, version
+		FROM webhooks
+		ORDER BY id`
+
+	return m.query(query)
+}
+
+// GetAllActiveForEvent returns the active webhooks which subscribe to an event.
+func (m WebhookModel) GetAllActiveForEvent(event string) ([]*Webhook, error) {
+	query := fmt.Sprintf(`
+		SELECT id, created_at, url, secret, events, active, version
+		FROM webhooks
+		WHERE active AND %s
+		ORDER BY id`, m.Dialect.In("$1", "events"))
+
+	return m.query(query, event)
+}
+
+func (m WebhookModel) query(query string, args ...interface{}) ([]*Webhook, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.ReadDB.QueryContext(ctx, m.Dialect.Rebind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	webhooks := []*Webhook{}
+
+	for rows.Next() {
+		var webhook Webhook
+
+		err := rows.Scan(
+			&webhook.ID,
+			&webhook.CreatedAt,
+			&webhook.URL,
+			&webhook.Secret,
+			m.Dialect.ScanArray(&webhook.Events),
+			&webhook.Active,
+			&webhook.Version,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		webhook.Secret, err = decryptColumn(webhook.Secret)
+		if err != nil {
+			return nil, fmt.Errorf("webhook %d secret: %w", webhook.ID, err)
+		}
+
+		webhooks = append(webhooks, &webhook)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return webhooks, nil
+}
+
+// Update saves changes to a webhook, using the version number to detect edit
+// conflicts in the same way as MovieModel.Update().
+func (m WebhookModel) Update(webhook *Webhook) error {
+	query := `
+		UPDATE webhooks
+		SET url = $1, secret = $2, events = $3, active = $4, version = version + 1
+		WHERE id = $5 AND version = $6
+		RETURNING version`
+
+	secret, err := encryptColumn(webhook.Secret)
+	if err != nil {
+		return err
+	}
+
+	args := []interface{}{
+		webhook.URL,
+		secret,
+		m.Dialect.Array(webhook.Events),
+		webhook.Active,
+		webhook.ID,
+		webhook.Version,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err = m.DB.QueryRowContext(ctx, m.Dialect.Rebind(query), args...).Scan(&webhook.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ReencryptSecrets encrypts every secret which isn't encrypted with the current key,
+// including those stored before encryption was turned on, and returns how many were
+// changed. It's used by the rotate command, with the old keys in the keyring. The
+// version isn't changed, as the secret itself stays the same.
+func (m WebhookModel) ReencryptSecrets() (int, error) {
+	query := `
+		SELECT id, secret
+		FROM webhooks
+		ORDER BY id`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, m.Dialect.Rebind(query))
+	if err != nil {
+		return 0, err
+	}
+
+	defer rows.Close()
+
+	stored := make(map[int64]string)
+
+	for rows.Next() {
+		var id int64
+		var secret string
+
+		err := rows.Scan(&id, &secret)
+		if err != nil {
+			return 0, err
+		}
+
+		if needsRotation(secret) {
+			stored[id] = secret
+		}
+	}
+
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	changed := 0
+
+	for id, secret := range stored {
+		plaintext, err := decryptColumn(secret)
+		if err != nil {
+			return changed, fmt.Errorf("webhook %d secret: %w", id, err)
+		}
+
+		encrypted, err := encryptColumn(plaintext)
+		if err != nil {
+			return changed, err
+		}
+
+		// Only update the secret if it hasn't been changed since we read it, so that a
+		// concurrent update isn't lost. That secret is already under the current key.
+		result, err := m.DB.ExecContext(ctx, m.Dialect.Rebind(`UPDATE webhooks SET secret = $1 WHERE id = $2 AND secret = $3`), encrypted, id, secret)
+		if err != nil {
+			return changed, err
+		}
+
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			return changed, err
+		}
+
+		changed += int(rowsAffected)
+	}
+
+	return changed, nil
+}
+
+// Delete deletes a webhook, along with its deliveries.
+func (m WebhookModel) Delete(id int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	query := `
+		DELETE FROM webhooks
+		WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, m.Dialect.Rebind(query), id)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// Define a WebhookDelivery struct to represent one attempt to deliver an event to a
+// webhook. The status code is 0 if no response was received, in which case the error
+// says why.
+type WebhookDelivery struct {
+	ID         int64     `json:"id"`
+	CreatedAt  time.Time `json:"created_at"`
+	WebhookID  int64     `json:"webhook_id"`
+	EventID    string    `json:"event_id"`
+	EventType  string    `json:"event_type"`
+	Attempt    int       `json:"attempt"`
+	StatusCode int       `json:"status_code"`
+	Error      string    `json:"error,omitempty"`
+	Succeeded  bool      `json:"succeeded"`
+	DurationMS int64     `json:"duration_ms"`
+}
+
+// Define the WebhookDeliveryModel type.
+type WebhookDeliveryModel struct {
+	DB      Querier
+	ReadDB  Querier
+	Dialect Dialect
+}
+
+// Insert records a delivery attempt.
+func (m WebhookDeliveryModel) Insert(delivery *WebhookDelivery) error {
+	query := `
+		INSERT INTO webhook_deliveries (webhook_id, event_id, event_type, attempt, status_code, error, succeeded, duration_ms)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		RETURNING id, created_at`
+
+	args := []interface{}{
+		delivery.WebhookID,
+		delivery.EventID,
+		delivery.EventType,
+		delivery.Attempt,
+		delivery.StatusCode,
+		delivery.Error,
+		delivery.Succeeded,
+		delivery.DurationMS,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, m.Dialect.Rebind(query), args...).Scan(&delivery.ID, &delivery.CreatedAt)
+}
+
+// GetAllForWebhook returns a page of the delivery attempts for a webhook.
+func (m WebhookDeliveryModel) GetAllForWebhook(webhookID int64, filters Filters) ([]*WebhookDelivery, Metadata, error) {
+	query := fmt.Sprintf(`
+		SELECT count(*) OVER(), id, created_at, webhook_id, event_id, event_type, attempt, status_code, error, succeeded, duration_ms
+		FROM webhook_deliveries
+		WHERE webhook_id = $1
+		ORDER BY %s %s, id ASC
+		LIMIT $2 OFFSET $3`, filters.sortColumn(), filters.sortDirection())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.ReadDB.QueryContext(ctx, m.Dialect.Rebind(query), webhookID, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+
+	defer rows.Close()
+
+	totalRecords := 0
+	deliveries := []*WebhookDelivery{}
+
+	for rows.Next() {
+		var delivery WebhookDelivery
+
+		err := rows.Scan(
+			&totalRecords,
+			&delivery.ID,
+			&delivery.CreatedAt,
+			&delivery.WebhookID,
+			&delivery.EventID,
+			&delivery.EventType,
+			&delivery.Attempt,
+			&delivery.StatusCode,
+			&delivery.Error,
+			&delivery.Succeeded,
+			&delivery.DurationMS,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		deliveries = append(deliveries, &delivery)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.limit())
+
+	return deliveries, metadata, nil
+}
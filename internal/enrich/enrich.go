@@ -0,0 +1,71 @@
+// Package enrich looks movies up in an external catalog, such as OMDb, so that the
+// details a client leaves out when adding a movie can be filled in for them.
+package enrich
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// Define the errors a Provider returns when it has no match for a movie, and when no
+// provider is configured.
+var (
+	ErrNotFound = errors.New("enrich: movie not found")
+	ErrDisabled = errors.New("enrich: no provider is configured")
+)
+
+// Define an EnrichedMovie struct to hold the details a Provider found for a movie. Any
+// of them may be empty, if the provider doesn't know them.
+type EnrichedMovie struct {
+	Runtime int32
+	Genres  []string
+	Plot    string
+	Poster  string
+}
+
+// Define a Provider interface which is satisfied by each external catalog. Lookup()
+// returns the details of the movie with the title, released in the year, or any year
+// if it's 0. It returns ErrNotFound if there's no such movie.
+type Provider interface {
+	Lookup(ctx context.Context, title string, year int32) (*EnrichedMovie, error)
+}
+
+// Disabled is a Provider which looks nothing up. It's used when no provider is
+// configured, and always returns ErrDisabled.
+type Disabled struct{}
+
+func (Disabled) Lookup(ctx context.Context, title string, year int32) (*EnrichedMovie, error) {
+	return nil, ErrDisabled
+}
+
+// Stub is a Provider which looks movies up in a map, keyed by StubKey(title, year),
+// for the tests. If Err is set, every lookup returns it instead.
+type Stub struct {
+	Movies map[string]*EnrichedMovie
+	Err    error
+}
+
+func (s Stub) Lookup(ctx context.Context, title string, year int32) (*EnrichedMovie, error) {
+	if s.Err != nil {
+		return nil, s.Err
+	}
+
+	movie, ok := s.Movies[StubKey(title, year)]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	// Return a copy, so that the caller can't change the stub's movies.
+	c := *movie
+	c.Genres = append([]string(nil), movie.Genres...)
+
+	return &c, nil
+}
+
+// StubKey returns the key of a movie in Stub.Movies. Titles are matched without
+// regard to case, as they are by the real providers.
+func StubKey(title string, year int32) string {
+	return strings.ToLower(title) + "|" + strconv.Itoa(int(year))
+}
@@ -0,0 +1,130 @@
+package enrich
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/petrostrak/an-open-movie-database/internal/httpclient"
+)
+
+// Define the default OMDb API endpoint. It's configurable so that it can be pointed at
+// a stub server, or a mirror.
+const OMDbBaseURL = "https://www.omdbapi.com/"
+
+// Define an OMDb struct which looks movies up with the OMDb API
+// (https://www.omdbapi.com/), using the API key it was configured with.
+type OMDb struct {
+	APIKey  string
+	BaseURL string
+	timeout time.Duration
+	client  *httpclient.Client
+}
+
+// NewOMDb returns an OMDb provider which makes its requests with client. A lookup
+// which takes longer than timeout, including any retries, fails, so that a slow
+// response from OMDb can't hold up the request which is waiting for it.
+func NewOMDb(apiKey, baseURL string, timeout time.Duration, client *httpclient.Client) *OMDb {
+	if baseURL == "" {
+		baseURL = OMDbBaseURL
+	}
+
+	return &OMDb{
+		APIKey:  apiKey,
+		BaseURL: baseURL,
+		timeout: timeout,
+		client:  client,
+	}
+}
+
+// Lookup searches OMDb for a movie by its exact title and, unless it's 0, its year.
+// Fields which OMDb doesn't know are "N/A" in its responses, and are left empty.
+func (o *OMDb) Lookup(ctx context.Context, title string, year int32) (*EnrichedMovie, error) {
+	params := url.Values{}
+	params.Set("apikey", o.APIKey)
+	params.Set("t", title)
+	params.Set("type", "movie")
+	if year != 0 {
+		params.Set("y", strconv.Itoa(int(year)))
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, o.timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, o.BaseURL+"?"+params.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	res, err := o.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return nil, fmt.Errorf("enrich: %s responded with status %d", req.URL.Host, res.StatusCode)
+	}
+
+	// OMDb responds with a 200 status even when the lookup fails, and says so in the
+	// Response and Error fields.
+	var output struct {
+		Response string `json:"Response"`
+		Error    string `json:"Error"`
+		Runtime  string `json:"Runtime"`
+		Genre    string `json:"Genre"`
+		Plot     string `json:"Plot"`
+		Poster   string `json:"Poster"`
+	}
+
+	err = json.NewDecoder(res.Body).Decode(&output)
+	if err != nil {
+		return nil, fmt.Errorf("enrich: decoding the OMDb response: %w", err)
+	}
+
+	if output.Response != "True" {
+		if output.Error == "Movie not found!" {
+			return nil, ErrNotFound
+		}
+
+		return nil, fmt.Errorf("enrich: OMDb lookup failed: %s", output.Error)
+	}
+
+	movie := &EnrichedMovie{
+		Plot:   omdbValue(output.Plot),
+		Poster: omdbValue(output.Poster),
+	}
+
+	// The runtime is given as "142 min".
+	if runtime, err := strconv.ParseInt(strings.TrimSuffix(omdbValue(output.Runtime), " min"), 10, 32); err == nil && runtime > 0 {
+		movie.Runtime = int32(runtime)
+	}
+
+	// The genres are a comma-separated list, such as "Crime, Drama". They're lower
+	// cased to match the genres in our catalog.
+	if genres := omdbValue(output.Genre); genres != "" {
+		for _, genre := range strings.Split(genres, ",") {
+			if genre = strings.ToLower(strings.TrimSpace(genre)); genre != "" {
+				movie.Genres = append(movie.Genres, genre)
+			}
+		}
+	}
+
+	return movie, nil
+}
+
+// The omdbValue() helper returns the value of a field in an OMDb response, or "" if
+// it's "N/A".
+func omdbValue(s string) string {
+	if s == "N/A" {
+		return ""
+	}
+
+	return strings.TrimSpace(s)
+}
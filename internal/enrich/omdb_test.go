@@ -0,0 +1,90 @@
+package enrich
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/petrostrak/an-open-movie-database/internal/httpclient"
+)
+
+func TestOMDbLookup(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		qs := r.URL.Query()
+
+		switch {
+		case qs.Get("apikey") != "secret":
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{"Response": "False", "Error": "Invalid API key!"}`)
+		case qs.Get("t") == "The Godfather" && qs.Get("y") == "1972":
+			fmt.Fprint(w, `{"Response": "True", "Runtime": "175 min", "Genre": "Crime, Drama", "Plot": "The aging patriarch...", "Poster": "https://example.com/godfather.jpg"}`)
+		case qs.Get("t") == "Obscure":
+			fmt.Fprint(w, `{"Response": "True", "Runtime": "N/A", "Genre": "N/A", "Plot": "N/A", "Poster": "N/A"}`)
+		case qs.Get("t") == "Slow":
+			time.Sleep(100 * time.Millisecond)
+		default:
+			fmt.Fprint(w, `{"Response": "False", "Error": "Movie not found!"}`)
+		}
+	}))
+	defer ts.Close()
+
+	client := httpclient.New(httpclient.Options{})
+
+	omdb := NewOMDb("secret", ts.URL, 50*time.Millisecond, client)
+
+	movie, err := omdb.Lookup(context.Background(), "The Godfather", 1972)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := fmt.Sprintf("%+v", *movie); got != "{Runtime:175 Genres:[crime drama] Plot:The aging patriarch... Poster:https://example.com/godfather.jpg}" {
+		t.Errorf("got %s; want the movie's details", got)
+	}
+
+	movie, err = omdb.Lookup(context.Background(), "Obscure", 0)
+	if err != nil || movie.Runtime != 0 || movie.Genres != nil || movie.Plot != "" || movie.Poster != "" {
+		t.Errorf("got %+v and error %v; want no details", movie, err)
+	}
+
+	if _, err := omdb.Lookup(context.Background(), "The Godfather", 1990); !errors.Is(err, ErrNotFound) {
+		t.Errorf("got error %v; want ErrNotFound", err)
+	}
+
+	if _, err := omdb.Lookup(context.Background(), "Slow", 0); err == nil {
+		t.Error("got no error for a slow response; want a timeout")
+	}
+
+	omdb = NewOMDb("wrong", ts.URL, time.Second, client)
+
+	if _, err := omdb.Lookup(context.Background(), "The Godfather", 1972); err == nil || errors.Is(err, ErrNotFound) {
+		t.Errorf("got error %v for a bad API key; want a failure", err)
+	}
+}
+
+// OMDb being briefly overloaded doesn't fail the lookup, as it's retried.
+func TestOMDbLookupRetries(t *testing.T) {
+	var attempts int64
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt64(&attempts, 1) == 1 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+
+		fmt.Fprint(w, `{"Response": "True", "Runtime": "107 min", "Genre": "Animation", "Plot": "N/A", "Poster": "N/A"}`)
+	}))
+	defer ts.Close()
+
+	omdb := NewOMDb("secret", ts.URL, time.Second, httpclient.New(httpclient.Options{}))
+
+	movie, err := omdb.Lookup(context.Background(), "Moana", 2016)
+	if err != nil || movie.Runtime != 107 || attempts != 2 {
+		t.Errorf("got %+v and error %v after %d attempts; want the movie after 2", movie, err, attempts)
+	}
+}
@@ -0,0 +1,123 @@
+// Package errreport sends errors to an error tracking service, such as Sentry, so that
+// we hear about failures in production without waiting for users to complain.
+package errreport
+
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Define a Reporter interface which is satisfied by each error tracking service.
+// Report() sends an error along with details of where it happened, such as the request
+// method and ID. It must never block the caller, so implementations queue the error
+// and send it in the background. Flush() waits up to timeout for the queued errors to
+// be sent, and reports whether they all were.
+type Reporter interface {
+	Report(err error, context map[string]string)
+	Flush(timeout time.Duration) bool
+}
+
+// Nop is a Reporter which discards every error. It's used when no error tracking
+// service is configured.
+type Nop struct{}
+
+func (Nop) Report(err error, context map[string]string) {}
+
+func (Nop) Flush(timeout time.Duration) bool { return true }
+
+// The number of distinct errors a Deduplicator keeps track of. When it's reached, the
+// errors whose interval has passed are forgotten.
+const maxTracked = 1024
+
+// Deduplicator wraps a Reporter so that an error with the same message is reported at
+// most once per interval, so that a failing endpoint which is being hit hard doesn't
+// flood the tracking service. The number of reports suppressed in the meantime is added
+// to the context of the next one, as "suppressed".
+type Deduplicator struct {
+	next     Reporter
+	interval time.Duration
+
+	mu      sync.Mutex
+	tracked map[string]*tracked
+}
+
+type tracked struct {
+	reportedAt time.Time
+	suppressed int
+}
+
+func NewDeduplicator(next Reporter, interval time.Duration) *Deduplicator {
+	return &Deduplicator{
+		next:     next,
+		interval: interval,
+		tracked:  make(map[string]*tracked),
+	}
+}
+
+// Report passes the error on, unless one with the same message was reported within the
+// interval.
+func (d *Deduplicator) Report(err error, context map[string]string) {
+	now := time.Now()
+	key := err.Error()
+
+	d.mu.Lock()
+
+	t, found := d.tracked[key]
+	if found && now.Sub(t.reportedAt) < d.interval {
+		t.suppressed++
+		d.mu.Unlock()
+		return
+	}
+
+	if !found {
+		if len(d.tracked) >= maxTracked {
+			d.forget(now)
+		}
+
+		// If there are still too many distinct errors, pass this one on without
+		// keeping track of it, rather than growing the map without limit.
+		if len(d.tracked) >= maxTracked {
+			d.mu.Unlock()
+			d.next.Report(err, context)
+			return
+		}
+
+		t = &tracked{}
+		d.tracked[key] = t
+	}
+
+	suppressed := t.suppressed
+	t.reportedAt = now
+	t.suppressed = 0
+
+	d.mu.Unlock()
+
+	if suppressed > 0 {
+		// Copy the context, rather than changing the caller's map.
+		withCount := make(map[string]string, len(context)+1)
+		for k, v := range context {
+			withCount[k] = v
+		}
+		withCount["suppressed"] = strconv.Itoa(suppressed)
+		context = withCount
+	}
+
+	d.next.Report(err, context)
+}
+
+// Flush flushes the wrapped Reporter.
+func (d *Deduplicator) Flush(timeout time.Duration) bool {
+	return d.next.Flush(timeout)
+}
+
+// The forget() method removes the errors whose interval has passed. Any reports they
+// suppressed aren't counted in the next report of the same error. It must be called
+// with the mutex held.
+func (d *Deduplicator) forget(now time.Time) {
+	for key, t := range d.tracked {
+		if now.Sub(t.reportedAt) >= d.interval {
+			delete(d.tracked, key)
+		}
+	}
+}
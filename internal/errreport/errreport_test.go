@@ -0,0 +1,150 @@
+package errreport
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Define a recorder Reporter which keeps the reports it's given.
+type recorder struct {
+	mu      sync.Mutex
+	reports []map[string]string
+}
+
+func (r *recorder) Report(err error, context map[string]string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	report := map[string]string{"error": err.Error()}
+	for k, v := range context {
+		report[k] = v
+	}
+
+	r.reports = append(r.reports, report)
+}
+
+func (r *recorder) Flush(timeout time.Duration) bool { return true }
+
+func TestDeduplicator(t *testing.T) {
+	rec := &recorder{}
+	d := NewDeduplicator(rec, 50*time.Millisecond)
+
+	for i := 0; i < 3; i++ {
+		d.Report(errors.New("connection refused"), map[string]string{"request_id": "a"})
+	}
+	d.Report(errors.New("deadlock detected"), nil)
+
+	if len(rec.reports) != 2 {
+		t.Fatalf("got %d reports; want 2, one for each error", len(rec.reports))
+	}
+
+	time.Sleep(60 * time.Millisecond)
+
+	context := map[string]string{"request_id": "b"}
+	d.Report(errors.New("connection refused"), context)
+
+	if len(rec.reports) != 3 {
+		t.Fatalf("got %d reports after the interval; want 3", len(rec.reports))
+	}
+
+	if got := rec.reports[2]["suppressed"]; got != "2" {
+		t.Errorf("got suppressed %q; want 2", got)
+	}
+
+	if _, ok := context["suppressed"]; ok {
+		t.Error("got the caller's context changed")
+	}
+}
+
+func TestParseDSN(t *testing.T) {
+	tests := []struct {
+		dsn          string
+		wantEndpoint string
+		wantErr      bool
+	}{
+		{"https://abc123@o1.ingest.sentry.io/42", "https://o1.ingest.sentry.io/api/42/store/", false},
+		{"http://abc123@localhost:9000/sentry/7", "http://localhost:9000/sentry/api/7/store/", false},
+		{"https://o1.ingest.sentry.io/42", "", true},
+		{"https://abc123@o1.ingest.sentry.io/", "", true},
+		{"ftp://abc123@example.com/1", "", true},
+		{"not a dsn", "", true},
+	}
+
+	for _, tt := range tests {
+		endpoint, _, err := parseDSN(tt.dsn)
+		if (err != nil) != tt.wantErr || endpoint != tt.wantEndpoint {
+			t.Errorf("parseDSN(%q) = %q, %v; want %q and error %t", tt.dsn, endpoint, err, tt.wantEndpoint, tt.wantErr)
+		}
+	}
+}
+
+func TestSentryReport(t *testing.T) {
+	var (
+		mu     sync.Mutex
+		auth   string
+		events []sentryEvent
+	)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if r.URL.Path != "/api/42/store/" {
+			t.Errorf("got path %q; want /api/42/store/", r.URL.Path)
+		}
+
+		var event sentryEvent
+		err := json.NewDecoder(r.Body).Decode(&event)
+		if err != nil {
+			t.Error(err)
+		}
+
+		auth = r.Header.Get("X-Sentry-Auth")
+		events = append(events, event)
+	}))
+	defer ts.Close()
+
+	dsn := strings.Replace(ts.URL, "http://", "http://key123@", 1) + "/42"
+
+	s, err := NewSentry(dsn, "production", "1.0.0", 10, func(err error) { t.Error(err) })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.Report(errors.New("boom"), map[string]string{
+		"request_id": "abc",
+		"stack":      "goroutine 1 [running]:\nmain.main()",
+	})
+
+	if !s.Flush(time.Second) {
+		t.Fatal("got the flush timing out")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if len(events) != 1 {
+		t.Fatalf("got %d events; want 1", len(events))
+	}
+
+	event := events[0]
+
+	if !strings.Contains(auth, "sentry_key=key123") {
+		t.Errorf("got X-Sentry-Auth %q; want the public key", auth)
+	}
+	if event.Exception.Values[0].Value != "boom" || event.Environment != "production" || event.Release != "1.0.0" {
+		t.Errorf("got event %+v", event)
+	}
+	if event.Tags["request_id"] != "abc" || event.Extra["stack"] == "" || event.Tags["stack"] != "" {
+		t.Errorf("got tags %v and extra %v; want the request ID as a tag and the stack as extra", event.Tags, event.Extra)
+	}
+	if len(event.EventID) != 32 {
+		t.Errorf("got event ID %q; want 32 hex digits", event.EventID)
+	}
+}
@@ -0,0 +1,211 @@
+package errreport
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The maximum length of a Sentry tag value. Longer values, such as stack traces, are
+// sent as extra data instead.
+const maxTagLength = 200
+
+// Sentry is a Reporter which sends errors to Sentry's store API. The errors are queued
+// and sent by a single goroutine, so that reporting an error never slows down the
+// request it happened in; if the queue is full, the error is dropped.
+type Sentry struct {
+	client      *http.Client
+	endpoint    string
+	publicKey   string
+	environment string
+	release     string
+	onError     func(error)
+
+	queue   chan sentryEvent
+	pending sync.WaitGroup
+}
+
+// Define a sentryEvent struct to hold the fields of an event which we send.
+type sentryEvent struct {
+	EventID     string            `json:"event_id"`
+	Timestamp   string            `json:"timestamp"`
+	Level       string            `json:"level"`
+	Platform    string            `json:"platform"`
+	Environment string            `json:"environment,omitempty"`
+	Release     string            `json:"release,omitempty"`
+	Exception   sentryExceptions  `json:"exception"`
+	Tags        map[string]string `json:"tags,omitempty"`
+	Extra       map[string]string `json:"extra,omitempty"`
+}
+
+type sentryExceptions struct {
+	Values []sentryException `json:"values"`
+}
+
+type sentryException struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+// NewSentry returns a Sentry reporter for the project given by dsn, which has the form
+// https://<public key>@<host>/<project ID>, and starts its sending goroutine. The
+// environment and release are attached to every event. Errors sending an event are
+// passed to onError, which is usually a logger.
+func NewSentry(dsn, environment, release string, queueSize int, onError func(error)) (*Sentry, error) {
+	endpoint, publicKey, err := parseDSN(dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Sentry{
+		client:      &http.Client{Timeout: 10 * time.Second},
+		endpoint:    endpoint,
+		publicKey:   publicKey,
+		environment: environment,
+		release:     release,
+		onError:     onError,
+		queue:       make(chan sentryEvent, queueSize),
+	}
+
+	go s.run()
+
+	return s, nil
+}
+
+// The parseDSN() function returns the URL of the store endpoint, and the public key,
+// from a Sentry DSN. The DSN is never included in the error, as the key is a secret.
+func parseDSN(dsn string) (string, string, error) {
+	u, err := url.Parse(dsn)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.User == nil {
+		return "", "", errors.New("errreport: invalid sentry DSN")
+	}
+
+	publicKey := u.User.Username()
+
+	i := strings.LastIndex(u.Path, "/")
+	if publicKey == "" || i < 0 || u.Path[i+1:] == "" {
+		return "", "", errors.New("errreport: invalid sentry DSN")
+	}
+
+	prefix, projectID := u.Path[:i], u.Path[i+1:]
+	endpoint := fmt.Sprintf("%s://%s%s/api/%s/store/", u.Scheme, u.Host, prefix, url.PathEscape(projectID))
+
+	return endpoint, publicKey, nil
+}
+
+// Report queues an event for the error. The context is sent as tags, apart from values
+// which are too long for a tag, which are sent as extra data.
+func (s *Sentry) Report(err error, context map[string]string) {
+	event := sentryEvent{
+		EventID:     newEventID(),
+		Timestamp:   time.Now().UTC().Format(time.RFC3339),
+		Level:       "error",
+		Platform:    "go",
+		Environment: s.environment,
+		Release:     s.release,
+		Exception: sentryExceptions{Values: []sentryException{
+			{Type: fmt.Sprintf("%T", err), Value: err.Error()},
+		}},
+	}
+
+	for key, value := range context {
+		if len(value) > maxTagLength || strings.Contains(value, "\n") {
+			if event.Extra == nil {
+				event.Extra = make(map[string]string)
+			}
+			event.Extra[key] = value
+			continue
+		}
+
+		if event.Tags == nil {
+			event.Tags = make(map[string]string)
+		}
+		event.Tags[key] = value
+	}
+
+	s.pending.Add(1)
+
+	select {
+	case s.queue <- event:
+	default:
+		s.pending.Done()
+		s.onError(errors.New("errreport: sentry queue full, event dropped"))
+	}
+}
+
+// Flush waits for the queued events to be sent.
+func (s *Sentry) Flush(timeout time.Duration) bool {
+	done := make(chan struct{})
+
+	go func() {
+		s.pending.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// The run() method sends the queued events, one at a time.
+func (s *Sentry) run() {
+	for event := range s.queue {
+		err := s.send(event)
+		if err != nil {
+			s.onError(err)
+		}
+
+		s.pending.Done()
+	}
+}
+
+func (s *Sentry) send(event sentryEvent) error {
+	js, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, s.endpoint, bytes.NewReader(js))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Sentry-Auth", fmt.Sprintf("Sentry sentry_version=7, sentry_client=omdb/1.0, sentry_key=%s", s.publicKey))
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("errreport: sending to sentry: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		body, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+		return fmt.Errorf("errreport: sentry returned status %d: %s", res.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	// Drain the body, so that the connection can be reused.
+	io.Copy(io.Discard, res.Body)
+
+	return nil
+}
+
+// The newEventID() function returns a random event ID, as 32 hex digits.
+func newEventID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
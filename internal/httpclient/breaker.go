@@ -0,0 +1,140 @@
+package httpclient
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrUnavailable is returned, wrapped in an *UnavailableError, instead of making a
+// request while the host's circuit breaker is open.
+var ErrUnavailable = errors.New("host unavailable")
+
+// UnavailableError is the error returned while a host's circuit breaker is open.
+// RetryAfter is how long until the breaker lets a request through to test whether the
+// host has recovered.
+type UnavailableError struct {
+	Host       string
+	RetryAfter time.Duration
+}
+
+func (e *UnavailableError) Error() string {
+	return fmt.Sprintf("httpclient: %s unavailable, circuit breaker open", e.Host)
+}
+
+// Is makes errors.Is(err, ErrUnavailable) true for an *UnavailableError.
+func (e *UnavailableError) Is(target error) bool {
+	return target == ErrUnavailable
+}
+
+// Define a breakerState type for the three states of a breaker.
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// Define a breaker type which works as the database's circuit breaker does: after
+// threshold consecutive failed requests to the host it opens, and for the cool-down
+// period requests fail straight away. Then it's half-open, and lets a single request
+// through as a probe, which closes the breaker if it succeeds and opens it again if it
+// fails.
+type breaker struct {
+	host      string
+	threshold int
+	cooldown  time.Duration
+	// The now field is replaced in the tests, to move the clock forward.
+	now func() time.Time
+
+	mu       sync.Mutex
+	state    breakerState
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+func newBreaker(host string, threshold int, cooldown time.Duration) *breaker {
+	return &breaker{
+		host:      host,
+		threshold: threshold,
+		cooldown:  cooldown,
+		now:       time.Now,
+	}
+}
+
+// The allow() method returns nil if a request may go ahead, and an *UnavailableError
+// if it may not. Once the cool-down has passed, the first caller is let through as the
+// probe, and the rest are turned away until its result is known.
+func (b *breaker) allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.now()
+
+	if b.state == breakerOpen && now.Sub(b.openedAt) >= b.cooldown {
+		b.state = breakerHalfOpen
+	}
+
+	switch b.state {
+	case breakerOpen:
+		return &UnavailableError{Host: b.host, RetryAfter: b.cooldown - now.Sub(b.openedAt)}
+	case breakerHalfOpen:
+		if b.probing {
+			return &UnavailableError{Host: b.host, RetryAfter: time.Second}
+		}
+		b.probing = true
+	}
+
+	return nil
+}
+
+// The record() method updates the breaker with whether a request which allow() let
+// through failed.
+func (b *breaker) record(failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	probe := b.state == breakerHalfOpen
+	if probe {
+		b.probing = false
+	}
+
+	if !failed {
+		b.state = breakerClosed
+		b.failures = 0
+		return
+	}
+
+	b.failures++
+	if probe || b.failures >= b.threshold {
+		b.state = breakerOpen
+		b.openedAt = b.now()
+	}
+}
+
+// The current() method returns the current state of the breaker. An open breaker whose
+// cool-down has passed is reported as half-open, as the next request will be a probe.
+func (b *breaker) current() breakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == breakerOpen && b.now().Sub(b.openedAt) >= b.cooldown {
+		return breakerHalfOpen
+	}
+
+	return b.state
+}
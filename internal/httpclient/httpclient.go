@@ -0,0 +1,340 @@
+// Package httpclient provides the HTTP client shared by the features which call other
+// services, such as webhooks and movie enrichment. It sets timeouts for each stage of a
+// request, retries idempotent requests which fail in a way worth retrying, and stops
+// calling a host which keeps failing for a while, with a circuit breaker for each.
+package httpclient
+
+import (
+	"context"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The default delays before each retry. A request is retried up to twice, backing off
+// exponentially.
+var DefaultRetryDelays = []time.Duration{250 * time.Millisecond, time.Second}
+
+// The defaults used for the zero fields of Options.
+const (
+	DefaultTimeout               = 10 * time.Second
+	DefaultDialTimeout           = 5 * time.Second
+	DefaultTLSHandshakeTimeout   = 5 * time.Second
+	DefaultResponseHeaderTimeout = 10 * time.Second
+	DefaultMaxIdleConnsPerHost   = 16
+	DefaultMaxRetryAfter         = 10 * time.Second
+	DefaultBreakerThreshold      = 5
+	DefaultBreakerCooldown       = 30 * time.Second
+)
+
+// Define an Options struct to hold the settings of a Client. The zero fields take the
+// defaults above, and a nil RetryDelays takes DefaultRetryDelays; an empty one turns
+// retries off.
+//
+// Timeout limits each attempt, from dialing to reading the body. A Retry-After longer
+// than MaxRetryAfter isn't waited for, and the response is returned instead. A host's
+// breaker opens after BreakerThreshold consecutive failures, for BreakerCooldown.
+type Options struct {
+	Timeout               time.Duration
+	DialTimeout           time.Duration
+	TLSHandshakeTimeout   time.Duration
+	ResponseHeaderTimeout time.Duration
+	MaxIdleConnsPerHost   int
+	RetryDelays           []time.Duration
+	MaxRetryAfter         time.Duration
+	BreakerThreshold      int
+	BreakerCooldown       time.Duration
+}
+
+// Client is an HTTP client which retries and circuit breaks. It's safe for concurrent
+// use, and should be shared, so that connections to the same host are reused.
+type Client struct {
+	client        *http.Client
+	retryDelays   []time.Duration
+	maxRetryAfter time.Duration
+
+	threshold int
+	cooldown  time.Duration
+
+	mu    sync.Mutex
+	hosts map[string]*host
+}
+
+// Define a host struct to hold the breaker and counters for the requests to one host.
+type host struct {
+	breaker *breaker
+
+	mu    sync.Mutex
+	stats HostStats
+}
+
+// Define a HostStats struct to hold the counters for a host which we publish via
+// expvar. Requests counts every attempt, including retries, and Errors those which
+// failed without a response. Rejected counts the requests which weren't made because
+// the host's breaker was open.
+type HostStats struct {
+	Requests   int64  `json:"requests"`
+	Errors     int64  `json:"errors"`
+	Retries    int64  `json:"retries"`
+	Rejected   int64  `json:"rejected"`
+	DurationMS int64  `json:"duration_ms"`
+	Breaker    string `json:"breaker"`
+}
+
+// New returns a Client with the given options. Proxies are taken from the
+// HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables.
+func New(opts Options) *Client {
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultTimeout
+	}
+	if opts.DialTimeout <= 0 {
+		opts.DialTimeout = DefaultDialTimeout
+	}
+	if opts.TLSHandshakeTimeout <= 0 {
+		opts.TLSHandshakeTimeout = DefaultTLSHandshakeTimeout
+	}
+	if opts.ResponseHeaderTimeout <= 0 {
+		opts.ResponseHeaderTimeout = DefaultResponseHeaderTimeout
+	}
+	if opts.MaxIdleConnsPerHost <= 0 {
+		opts.MaxIdleConnsPerHost = DefaultMaxIdleConnsPerHost
+	}
+	if opts.RetryDelays == nil {
+		opts.RetryDelays = DefaultRetryDelays
+	}
+	if opts.MaxRetryAfter <= 0 {
+		opts.MaxRetryAfter = DefaultMaxRetryAfter
+	}
+	if opts.BreakerThreshold <= 0 {
+		opts.BreakerThreshold = DefaultBreakerThreshold
+	}
+	if opts.BreakerCooldown <= 0 {
+		opts.BreakerCooldown = DefaultBreakerCooldown
+	}
+
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   opts.DialTimeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   opts.MaxIdleConnsPerHost,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   opts.TLSHandshakeTimeout,
+		ResponseHeaderTimeout: opts.ResponseHeaderTimeout,
+		ExpectContinueTimeout: time.Second,
+	}
+
+	return &Client{
+		client:        &http.Client{Transport: transport, Timeout: opts.Timeout},
+		retryDelays:   opts.RetryDelays,
+		maxRetryAfter: opts.MaxRetryAfter,
+		threshold:     opts.BreakerThreshold,
+		cooldown:      opts.BreakerCooldown,
+		hosts:         make(map[string]*host),
+	}
+}
+
+// Define a retryableContextKey type for the context key which marks a request as safe
+// to retry.
+type retryableContextKey struct{}
+
+// MarkRetryable returns a copy of the request which Do() retries, even if its method
+// isn't idempotent, such as a POST which the receiver de-duplicates.
+func MarkRetryable(req *http.Request) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), retryableContextKey{}, true))
+}
+
+// Do sends the request, and returns the response or an error as http.Client.Do()
+// does. Idempotent requests, and those marked with MarkRetryable(), are retried after
+// a connection error or timeout, or a 429, 502, 503 or 504 response, waiting for the
+// Retry-After header if there is one. While the host's breaker is open, Do() returns
+// an *UnavailableError without making the request.
+func (c *Client) Do(req *http.Request) (*http.Response, error) {
+	h := c.host(req.URL.Host)
+
+	retryable := isIdempotent(req.Method) || req.Context().Value(retryableContextKey{}) == true
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		retryable = false
+	}
+
+	for attempt := 0; ; attempt++ {
+		err := h.breaker.allow()
+		if err != nil {
+			h.count(func(s *HostStats) { s.Rejected++ })
+			return nil, err
+		}
+
+		if attempt > 0 && req.GetBody != nil {
+			req.Body, err = req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		start := time.Now()
+		res, err := c.client.Do(req)
+		duration := time.Since(start)
+
+		h.count(func(s *HostStats) {
+			s.Requests++
+			s.DurationMS += duration.Milliseconds()
+			if err != nil {
+				s.Errors++
+			}
+		})
+
+		h.breaker.record(failed(req, res, err))
+
+		if !retryable || attempt >= len(c.retryDelays) || !shouldRetry(req, res, err) {
+			return res, err
+		}
+
+		delay := jitter(c.retryDelays[attempt])
+
+		if res != nil {
+			if retryAfter, ok := parseRetryAfter(res.Header.Get("Retry-After"), time.Now()); ok {
+				if retryAfter > c.maxRetryAfter {
+					return res, nil
+				}
+				delay = retryAfter
+			}
+
+			// Read (up to 1MB of) the body before closing it, so that the connection
+			// can be reused for the retry.
+			io.Copy(io.Discard, io.LimitReader(res.Body, 1<<20))
+			res.Body.Close()
+		}
+
+		timer := time.NewTimer(delay)
+
+		select {
+		case <-timer.C:
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		}
+
+		h.count(func(s *HostStats) { s.Retries++ })
+	}
+}
+
+// Stats returns the counters for each host which has been called, by its host name
+// and port, if it has one.
+func (c *Client) Stats() map[string]HostStats {
+	c.mu.Lock()
+	hosts := make(map[string]*host, len(c.hosts))
+	for name, h := range c.hosts {
+		hosts[name] = h
+	}
+	c.mu.Unlock()
+
+	stats := make(map[string]HostStats, len(hosts))
+	for name, h := range hosts {
+		h.mu.Lock()
+		s := h.stats
+		h.mu.Unlock()
+
+		s.Breaker = h.breaker.current().String()
+		stats[name] = s
+	}
+
+	return stats
+}
+
+// The host() method returns the breaker and counters for a host, adding them the first
+// time the host is called.
+func (c *Client) host(name string) *host {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	h, ok := c.hosts[name]
+	if !ok {
+		h = &host{breaker: newBreaker(name, c.threshold, c.cooldown)}
+		c.hosts[name] = h
+	}
+
+	return h
+}
+
+// The count() method updates the host's counters.
+func (h *host) count(update func(s *HostStats)) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	update(&h.stats)
+}
+
+// The isIdempotent() function reports whether requests with the given method can be
+// repeated without changing the result, and so are safe to retry.
+func isIdempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	default:
+		return false
+	}
+}
+
+// The shouldRetry() function reports whether an attempt failed in a way which another
+// attempt might not: an error other than the caller giving up, or a response saying
+// the server is busy or couldn't reach the service behind it.
+func shouldRetry(req *http.Request, res *http.Response, err error) bool {
+	if req.Context().Err() != nil {
+		return false
+	}
+
+	if err != nil {
+		return true
+	}
+
+	switch res.StatusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	default:
+		return false
+	}
+}
+
+// The failed() function reports whether an attempt counts against the host's breaker:
+// an error, unless the caller gave up, or a 5xx response.
+func failed(req *http.Request, res *http.Response, err error) bool {
+	if err != nil {
+		return req.Context().Err() == nil
+	}
+
+	return res.StatusCode >= 500
+}
+
+// The parseRetryAfter() function returns the delay given by a Retry-After header,
+// which is either a number of seconds or an HTTP date.
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+
+	if date, err := http.ParseTime(value); err == nil {
+		if delay := date.Sub(now); delay > 0 {
+			return delay, true
+		}
+		return 0, true
+	}
+
+	return 0, false
+}
+
+// The jitter() helper adds up to 20% to a delay in either direction, so that the
+// retries of requests which failed together are spread out.
+func jitter(d time.Duration) time.Duration {
+	return d + time.Duration((rand.Float64()*0.4-0.2)*float64(d))
+}
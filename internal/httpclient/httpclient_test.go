@@ -0,0 +1,286 @@
+package httpclient
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// The newTestClient() helper returns a Client which retries twice without waiting
+// long, and whose breakers don't open during a test unless it sets a threshold.
+func newTestClient(opts Options) *Client {
+	if opts.RetryDelays == nil {
+		opts.RetryDelays = []time.Duration{time.Millisecond, time.Millisecond}
+	}
+	if opts.BreakerThreshold == 0 {
+		opts.BreakerThreshold = 100
+	}
+
+	return New(opts)
+}
+
+func TestDoRetries(t *testing.T) {
+	tests := []struct {
+		name         string
+		method       string
+		retryable    bool
+		statuses     []int
+		retryAfter   string
+		wantStatus   int
+		wantAttempts int64
+	}{
+		{"success", http.MethodGet, false, []int{200}, "", 200, 1},
+		{"too many requests", http.MethodGet, false, []int{429, 200}, "0", 200, 2},
+		{"service unavailable", http.MethodGet, false, []int{503, 503, 200}, "", 200, 3},
+		{"gives up", http.MethodGet, false, []int{503, 503, 503, 200}, "", 503, 3},
+		{"server error", http.MethodGet, false, []int{500, 200}, "", 500, 1},
+		{"not found", http.MethodGet, false, []int{404, 200}, "", 404, 1},
+		{"retry after too long", http.MethodGet, false, []int{429, 200}, "3600", 429, 1},
+		{"post", http.MethodPost, false, []int{503, 200}, "", 503, 1},
+		{"marked post", http.MethodPost, true, []int{503, 200}, "", 200, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var attempts int64
+
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				attempt := atomic.AddInt64(&attempts, 1)
+
+				// Each attempt must send the whole body again.
+				if body, _ := io.ReadAll(r.Body); r.Method == http.MethodPost && string(body) != "payload" {
+					t.Errorf("attempt %d: got body %q; want payload", attempt, body)
+				}
+
+				if tt.retryAfter != "" {
+					w.Header().Set("Retry-After", tt.retryAfter)
+				}
+				w.WriteHeader(tt.statuses[attempt-1])
+			}))
+			defer ts.Close()
+
+			req, err := http.NewRequest(tt.method, ts.URL, strings.NewReader("payload"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if tt.retryable {
+				req = MarkRetryable(req)
+			}
+
+			res, err := newTestClient(Options{}).Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+
+			if res.StatusCode != tt.wantStatus || attempts != tt.wantAttempts {
+				t.Errorf("got status %d after %d attempts; want %d after %d", res.StatusCode, attempts, tt.wantStatus, tt.wantAttempts)
+			}
+		})
+	}
+}
+
+// A response which takes too long to start is retried, as is a connection which is
+// closed without a response.
+func TestDoRetriesFailures(t *testing.T) {
+	tests := []struct {
+		name string
+		fail func(w http.ResponseWriter)
+	}{
+		{"timeout", func(w http.ResponseWriter) {
+			time.Sleep(200 * time.Millisecond)
+		}},
+		{"connection reset", func(w http.ResponseWriter) {
+			conn, _, err := w.(http.Hijacker).Hijack()
+			if err == nil {
+				conn.Close()
+			}
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var attempts int64
+
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if atomic.AddInt64(&attempts, 1) == 1 {
+					tt.fail(w)
+				}
+			}))
+			defer ts.Close()
+
+			client := newTestClient(Options{ResponseHeaderTimeout: 50 * time.Millisecond})
+
+			req, err := http.NewRequest(http.MethodGet, ts.URL, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			res, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+
+			if res.StatusCode != http.StatusOK || attempts != 2 {
+				t.Errorf("got status %d after %d attempts; want 200 after 2", res.StatusCode, attempts)
+			}
+
+			stats := client.Stats()[req.URL.Host]
+			if stats.Requests != 2 || stats.Errors != 1 || stats.Retries != 1 {
+				t.Errorf("got stats %+v; want 2 requests, 1 error and 1 retry", stats)
+			}
+		})
+	}
+}
+
+// A caller which gives up while waiting to retry gets its context's error straight
+// away, and it doesn't count against the host.
+func TestDoCancelled(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "5")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+
+	client := newTestClient(Options{})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ts.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+
+	_, err = client.Do(req)
+	if !errors.Is(err, context.DeadlineExceeded) || time.Since(start) > time.Second {
+		t.Errorf("got error %v after %s; want the deadline straight away", err, time.Since(start))
+	}
+}
+
+// After BreakerThreshold failures in a row, requests to the host fail without being
+// made, while other hosts are unaffected.
+func TestDoBreaker(t *testing.T) {
+	var attempts int64
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&attempts, 1)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer failing.Close()
+
+	working := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer working.Close()
+
+	client := newTestClient(Options{BreakerThreshold: 3, BreakerCooldown: time.Hour})
+
+	get := func(url string) (*http.Response, error) {
+		req, err := http.NewRequest(http.MethodGet, url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		res, err := client.Do(req)
+		if err == nil {
+			res.Body.Close()
+		}
+
+		return res, err
+	}
+
+	// The first request is tried three times, which opens the breaker.
+	res, err := get(failing.URL)
+	if err != nil || res.StatusCode != http.StatusBadGateway {
+		t.Fatalf("got error %v; want the 502 response", err)
+	}
+
+	_, err = get(failing.URL)
+
+	var unavailable *UnavailableError
+	if !errors.As(err, &unavailable) || !errors.Is(err, ErrUnavailable) || unavailable.RetryAfter <= 0 {
+		t.Errorf("got error %v; want an *UnavailableError", err)
+	}
+
+	if attempts != 3 {
+		t.Errorf("got %d attempts; want 3", attempts)
+	}
+
+	res, err = get(working.URL)
+	if err != nil || res.StatusCode != http.StatusOK {
+		t.Errorf("got error %v for another host; want it to work", err)
+	}
+
+	stats := client.Stats()[strings.TrimPrefix(failing.URL, "http://")]
+	if stats.Rejected != 1 || stats.Breaker != "open" {
+		t.Errorf("got stats %+v; want 1 rejected and the breaker open", stats)
+	}
+}
+
+func TestBreaker(t *testing.T) {
+	now := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+
+	b := newBreaker("example.com", 2, time.Minute)
+	b.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		if err := b.allow(); err != nil {
+			t.Fatalf("failure %d: got %v; want the request allowed", i+1, err)
+		}
+		b.record(true)
+	}
+
+	if err := b.allow(); !errors.Is(err, ErrUnavailable) {
+		t.Fatalf("got %v; want the breaker open", err)
+	}
+
+	now = now.Add(time.Minute)
+
+	// A single probe is let through once the cool-down has passed.
+	if err := b.allow(); err != nil {
+		t.Fatalf("got %v; want the probe allowed", err)
+	}
+
+	if err := b.allow(); !errors.Is(err, ErrUnavailable) {
+		t.Errorf("got %v while probing; want another request turned away", err)
+	}
+
+	b.record(false)
+
+	if err := b.allow(); err != nil || b.current() != breakerClosed {
+		t.Errorf("got %v and state %s; want the breaker closed by the probe", err, b.current())
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		value  string
+		want   time.Duration
+		wantOK bool
+	}{
+		{"", 0, false},
+		{"120", 2 * time.Minute, true},
+		{"Fri, 16 Oct 2026 12:00:30 GMT", 30 * time.Second, true},
+		{"Fri, 16 Oct 2026 11:00:00 GMT", 0, true},
+		{"soon", 0, false},
+		{"-1", 0, false},
+	}
+
+	for _, tt := range tests {
+		got, ok := parseRetryAfter(tt.value, now)
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("%q: got %s and %t; want %s and %t", tt.value, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
@@ -2,9 +2,13 @@ package jsonlog
 
 import (
 	"encoding/json"
+	"fmt"
 	"io"
 	"os"
 	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
@@ -15,15 +19,18 @@ type Level int8
 // Initialize constants which represent a specific severity level. We use the iota
 // keyword as a shortcut to assign successive integer values to the constants.
 const (
-	LevelInfo  Level = iota // Has the value 0.
-	LevelError              // Has the value 1.
-	LevelFatal              // Has the value 2.
-	LevelOff                // Has the value 3.
+	LevelDebug Level = iota // Has the value 0.
+	LevelInfo               // Has the value 1.
+	LevelError              // Has the value 2.
+	LevelFatal              // Has the value 3.
+	LevelOff                // Has the value 4.
 )
 
 // Return a human-friendly string for the severity level.
 func (l Level) String() string {
 	switch l {
+	case LevelDebug:
+		return "[DEBUG]"
 	case LevelInfo:
 		return "[INFO]"
 	case LevelError:
@@ -35,12 +42,55 @@ func (l Level) String() string {
 	}
 }
 
+// ParseLevel returns the level with the given name, as used by the -log-level flag.
+func ParseLevel(name string) (Level, error) {
+	switch strings.ToLower(name) {
+	case "debug":
+		return LevelDebug, nil
+	case "info":
+		return LevelInfo, nil
+	case "error":
+		return LevelError, nil
+	case "fatal":
+		return LevelFatal, nil
+	case "off":
+		return LevelOff, nil
+	default:
+		return 0, fmt.Errorf("unknown log level %q", name)
+	}
+}
+
+// Define a Format type for the ways a log entry can be written. FormatJSON writes one
+// JSON object per line, for log aggregators; FormatText is easier to read in a terminal.
+type Format int8
+
+const (
+	FormatJSON Format = iota
+	FormatText
+)
+
+// ParseFormat returns the format with the given name, as used by the -log-format flag.
+func ParseFormat(name string) (Format, error) {
+	switch strings.ToLower(name) {
+	case "json":
+		return FormatJSON, nil
+	case "text":
+		return FormatText, nil
+	default:
+		return 0, fmt.Errorf("unknown log format %q", name)
+	}
+}
+
 // Define a custom Logger type. This holds the output destination that the log entries
 // will be written to, the minimum severity level that log entries will be written for,
-// plus a mutex for coordination the writes.
+// the format to write them in, plus a mutex for coordination the writes.
+//
+// The level and format can be changed with SetLevel() and SetFormat(), as the logger is
+// created before the command-line flags which set them are parsed.
 type Logger struct {
 	out      io.Writer
 	minLevel Level
+	format   Format
 	mu       sync.Mutex
 }
 
@@ -53,9 +103,54 @@ func New(out io.Writer, minLevel Level) *Logger {
 	}
 }
 
+// SetLevel changes the minimum severity level of the entries which are written.
+func (l *Logger) SetLevel(level Level) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.minLevel = level
+}
+
+// SetFormat changes the format the entries are written in.
+func (l *Logger) SetFormat(format Format) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.format = format
+}
+
+// Level returns the minimum severity level of the entries which are written.
+func (l *Logger) Level() Level {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.minLevel
+}
+
+// Format returns the format the entries are written in.
+func (l *Logger) Format() Format {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.format
+}
+
+// Enabled reports whether entries at the given level are written, so that callers can
+// skip building the properties of an entry which would be discarded.
+func (l *Logger) Enabled(level Level) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return level >= l.minLevel
+}
+
 // Declare some helper methods for writting log entries at the different levels.
 // Notice these all accept a map as the second parameter which can contain any
 // arbitrary 'properties' that you want to appear in the log entry.
+func (l *Logger) PrintDebug(message string, properties map[string]string) {
+	l.print(LevelDebug, message, properties)
+}
+
 func (l *Logger) PrintInfo(message string, properties map[string]string) {
 	l.print(LevelInfo, message, properties)
 }
@@ -73,18 +168,12 @@ func (l *Logger) PrintFatal(err error, properties map[string]string) {
 func (l *Logger) print(level Level, message string, properties map[string]string) (int, error) {
 	// If the severity level of the log entry is below the minimum severity for the
 	// logger, then return with no further action.
-	if level < l.minLevel {
+	if !l.Enabled(level) {
 		return 0, nil
 	}
 
-	// Declare an anonymous struct holding the data for the log entry.
-	aux := struct {
-		Level      string            `json:"level"`
-		Time       string            `json:"time"`
-		Message    string            `json:"message"`
-		Properties map[string]string `json:"properties,omitempty"`
-		Trace      string            `json:"trace,omitempty"`
-	}{
+	// Declare an entry struct holding the data for the log entry.
+	aux := entry{
 		Level:      level.String(),
 		Time:       time.Now().UTC().Format(time.RFC3339),
 		Message:    message,
@@ -96,30 +185,80 @@ func (l *Logger) print(level Level, message string, properties map[string]string
 		aux.Trace = string(debug.Stack())
 	}
 
-	// Declare a line variable for holding the actual log entry text.
-	var line []byte
-
-	// Marshal the anonymous struct to JSON and store it in the line variable.
-	// If there was a problem creating the JSON, set the contents of the log
-	// entry to be that plain-text error message instead.
-	line, err := json.Marshal(aux)
-	if err != nil {
-		line = []byte(LevelError.String() + ": unable to marshal log message: " + err.Error())
-	}
-
 	// Lock the mutext so that no two writes to the output destination cannot happen
 	// concurrently. If we don't do this, it's possible that the text for two or more
 	// log entries will be intermingled in the output.
 	l.mu.Lock()
 	defer l.mu.Unlock()
 
+	// Declare a line variable for holding the actual log entry text.
+	var line []byte
+
+	if l.format == FormatText {
+		line = aux.text()
+	} else {
+		// Marshal the entry struct to JSON and store it in the line variable.
+		// If there was a problem creating the JSON, set the contents of the log
+		// entry to be that plain-text error message instead.
+		var err error
+		line, err = json.Marshal(aux)
+		if err != nil {
+			line = []byte(LevelError.String() + ": unable to marshal log message: " + err.Error())
+		}
+	}
+
 	// Write the log entry followed by a newline.
 	return l.out.Write(append(line, '\n'))
 }
 
+// The entry struct holds the data for a log entry.
+type entry struct {
+	Level      string            `json:"level"`
+	Time       string            `json:"time"`
+	Message    string            `json:"message"`
+	Properties map[string]string `json:"properties,omitempty"`
+	Trace      string            `json:"trace,omitempty"`
+}
+
+// The text() method formats the entry as a line of text, with the properties as
+// key=value pairs in sorted order. Values containing spaces or quotes are quoted, and
+// the trace follows on the next lines.
+func (e entry) text() []byte {
+	var b strings.Builder
+
+	b.WriteString(e.Time + " " + e.Level + " " + e.Message)
+
+	keys := make([]string, 0, len(e.Properties))
+	for key := range e.Properties {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		value := e.Properties[key]
+		if value == "" || strings.ContainsAny(value, " \t\n\"=") {
+			value = strconv.Quote(value)
+		}
+
+		b.WriteString(" " + key + "=" + value)
+	}
+
+	if e.Trace != "" {
+		b.WriteString("\n" + strings.TrimRight(e.Trace, "\n"))
+	}
+
+	return []byte(b.String())
+}
+
 // We also implement a Write() method on our Logger type so that it satisfies the
 // io.Writer interface. This writes a log entry at the ERROR level with no additional
-// properties.
+// properties, so that the logger can be used for the http.Server's ErrorLog through
+// log.New(). The trailing newline which the log package adds is removed.
 func (l *Logger) Write(message []byte) (n int, err error) {
-	return l.print(LevelError, string(message), nil)
+	_, err = l.print(LevelError, strings.TrimRight(string(message), "\n"), nil)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(message), nil
 }
@@ -0,0 +1,173 @@
+package jsonlog
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLevelFiltering(t *testing.T) {
+	tests := []struct {
+		minLevel Level
+		want     []string
+	}{
+		{LevelDebug, []string{"[DEBUG]", "[INFO]", "[ERROR]"}},
+		{LevelInfo, []string{"[INFO]", "[ERROR]"}},
+		{LevelError, []string{"[ERROR]"}},
+		{LevelOff, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.minLevel.String(), func(t *testing.T) {
+			var buf bytes.Buffer
+			logger := New(&buf, tt.minLevel)
+
+			logger.PrintDebug("debug", nil)
+			logger.PrintInfo("info", nil)
+			logger.PrintError(errors.New("error"), nil)
+
+			var got []string
+			for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+				if line == "" {
+					continue
+				}
+
+				var e entry
+				err := json.Unmarshal([]byte(line), &e)
+				if err != nil {
+					t.Fatalf("%v decoding %q", err, line)
+				}
+
+				got = append(got, e.Level)
+			}
+
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("got levels %q; want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestJSONFields(t *testing.T) {
+	var buf bytes.Buffer
+	logger := New(&buf, LevelDebug)
+
+	logger.PrintInfo("starting server", map[string]string{"addr": ":4000"})
+	logger.PrintError(errors.New("connection refused"), map[string]string{"dsn": "postgres://"})
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("got %d lines; want 2:\n%s", len(lines), buf.String())
+	}
+
+	for i, tt := range []struct {
+		level, message, key string
+		wantTrace           bool
+	}{
+		{"[INFO]", "starting server", "addr", false},
+		{"[ERROR]", "connection refused", "dsn", true},
+	} {
+		var e entry
+		err := json.Unmarshal([]byte(lines[i]), &e)
+		if err != nil {
+			t.Fatalf("%v decoding %q", err, lines[i])
+		}
+
+		if e.Level != tt.level || e.Message != tt.message || e.Properties[tt.key] == "" {
+			t.Errorf("got %+v; want level %q, message %q and property %q", e, tt.level, tt.message, tt.key)
+		}
+
+		if _, err := time.Parse(time.RFC3339, e.Time); err != nil {
+			t.Errorf("got time %q: %v", e.Time, err)
+		}
+
+		if (e.Trace != "") != tt.wantTrace {
+			t.Errorf("got trace %q for %s; want a trace: %v", e.Trace, tt.level, tt.wantTrace)
+		}
+	}
+}
+
+func TestTextFormat(t *testing.T) {
+	var buf bytes.Buffer
+	logger := New(&buf, LevelInfo)
+	logger.SetFormat(FormatText)
+
+	logger.PrintInfo("request completed", map[string]string{"status": "200", "url": "/v1/movies?title=the club", "empty": ""})
+
+	line := strings.TrimSpace(buf.String())
+	want := ` [INFO] request completed empty="" status=200 url="/v1/movies?title=the club"`
+	if !strings.HasSuffix(line, want) {
+		t.Errorf("got %q; want it to end with %q", line, want)
+	}
+
+	buf.Reset()
+	logger.PrintError(errors.New("boom"), nil)
+
+	lines := strings.Split(buf.String(), "\n")
+	if !strings.HasSuffix(lines[0], " [ERROR] boom") || !strings.Contains(buf.String(), "goroutine") {
+		t.Errorf("got %q; want the message followed by a trace", buf.String())
+	}
+}
+
+func TestSetLevel(t *testing.T) {
+	var buf bytes.Buffer
+	logger := New(&buf, LevelInfo)
+
+	if logger.Enabled(LevelDebug) {
+		t.Error("debug is enabled at the info level")
+	}
+
+	logger.SetLevel(LevelDebug)
+	logger.PrintDebug("now visible", nil)
+
+	if !strings.Contains(buf.String(), "now visible") {
+		t.Errorf("got %q; want the debug entry", buf.String())
+	}
+}
+
+// The logger is used as the http.Server's ErrorLog through log.New(), which adds a
+// trailing newline to each message.
+func TestWriteAdapter(t *testing.T) {
+	var buf bytes.Buffer
+	errorLog := log.New(New(&buf, LevelInfo), "", 0)
+
+	errorLog.Printf("http: TLS handshake error from %s", "127.0.0.1:1234")
+
+	var e entry
+	err := json.Unmarshal(buf.Bytes(), &e)
+	if err != nil {
+		t.Fatalf("%v decoding %q", err, buf.String())
+	}
+
+	if e.Level != "[ERROR]" || e.Message != "http: TLS handshake error from 127.0.0.1:1234" {
+		t.Errorf("got %+v", e)
+	}
+}
+
+func TestParse(t *testing.T) {
+	for name, want := range map[string]Level{"debug": LevelDebug, "INFO": LevelInfo, "error": LevelError, "fatal": LevelFatal, "off": LevelOff} {
+		got, err := ParseLevel(name)
+		if err != nil || got != want {
+			t.Errorf("ParseLevel(%q) = %v, %v; want %v", name, got, err, want)
+		}
+	}
+
+	if _, err := ParseLevel("verbose"); err == nil {
+		t.Error("ParseLevel(\"verbose\") succeeded")
+	}
+
+	for name, want := range map[string]Format{"json": FormatJSON, "text": FormatText} {
+		got, err := ParseFormat(name)
+		if err != nil || got != want {
+			t.Errorf("ParseFormat(%q) = %v, %v; want %v", name, got, err, want)
+		}
+	}
+
+	if _, err := ParseFormat("yaml"); err == nil {
+		t.Error("ParseFormat(\"yaml\") succeeded")
+	}
+}
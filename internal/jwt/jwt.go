@@ -0,0 +1,166 @@
+package jwt
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+// Define the signing algorithms that we support, using the names from the JWA spec.
+const (
+	AlgHS256 = "HS256"
+	AlgEdDSA = "EdDSA"
+)
+
+// Define errors that Verify() returns when a token can't be trusted. Callers should
+// treat all of them as an invalid authentication token.
+var (
+	ErrMalformedToken    = errors.New("jwt: malformed token")
+	ErrInvalidSignature  = errors.New("jwt: invalid signature")
+	ErrExpiredToken      = errors.New("jwt: token has expired")
+	ErrUnsupportedAlg    = errors.New("jwt: unsupported signing algorithm")
+	ErrInvalidSigningKey = errors.New("jwt: invalid signing key")
+)
+
+// The encoding used for each of the three dot-separated parts of a token.
+var encoding = base64.RawURLEncoding
+
+// Define a Claims struct holding the registered claims that we put in our tokens.
+// Times are stored as Unix timestamps, as required by the spec.
+type Claims struct {
+	Subject   string `json:"sub"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+// Define a Signer type which signs and verifies tokens with a single key. Only the
+// fields relevant to the algorithm are set.
+type Signer struct {
+	alg        string
+	secret     []byte
+	privateKey ed25519.PrivateKey
+	publicKey  ed25519.PublicKey
+}
+
+// NewHS256 returns a Signer which uses HMAC-SHA256 with the given shared secret.
+func NewHS256(secret []byte) (*Signer, error) {
+	// A short secret would make it feasible to brute force the signature, so insist
+	// on at least 32 bytes (the size of the hash output).
+	if len(secret) < 32 {
+		return nil, ErrInvalidSigningKey
+	}
+
+	return &Signer{alg: AlgHS256, secret: secret}, nil
+}
+
+// NewEdDSA returns a Signer which uses Ed25519 with the private key derived from the
+// given 32-byte seed.
+func NewEdDSA(seed []byte) (*Signer, error) {
+	if len(seed) != ed25519.SeedSize {
+		return nil, ErrInvalidSigningKey
+	}
+
+	privateKey := ed25519.NewKeyFromSeed(seed)
+
+	return &Signer{
+		alg:        AlgEdDSA,
+		privateKey: privateKey,
+		publicKey:  privateKey.Public().(ed25519.PublicKey),
+	}, nil
+}
+
+// Sign encodes the claims and returns the compact serialized token.
+func (s *Signer) Sign(claims Claims) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": s.alg, "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signingInput := encoding.EncodeToString(header) + "." + encoding.EncodeToString(payload)
+
+	return signingInput + "." + encoding.EncodeToString(s.signature([]byte(signingInput))), nil
+}
+
+// Verify checks the token's signature and expiry and returns its claims.
+func (s *Signer) Verify(token string) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrMalformedToken
+	}
+
+	headerJSON, err := encoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, ErrMalformedToken
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+	}
+
+	if err := json.Unmarshal(headerJSON, &header); err != nil {
+		return nil, ErrMalformedToken
+	}
+
+	// Importantly, we never let the token choose the algorithm. Anything other than
+	// the algorithm this signer was configured with (including "none") is rejected.
+	if header.Alg != s.alg {
+		return nil, ErrUnsupportedAlg
+	}
+
+	signature, err := encoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrMalformedToken
+	}
+
+	signingInput := []byte(parts[0] + "." + parts[1])
+
+	switch s.alg {
+	case AlgHS256:
+		if !hmac.Equal(signature, s.signature(signingInput)) {
+			return nil, ErrInvalidSignature
+		}
+	case AlgEdDSA:
+		if !ed25519.Verify(s.publicKey, signingInput, signature) {
+			return nil, ErrInvalidSignature
+		}
+	}
+
+	payload, err := encoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrMalformedToken
+	}
+
+	var claims Claims
+
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, ErrMalformedToken
+	}
+
+	if claims.ExpiresAt == 0 || time.Now().Unix() >= claims.ExpiresAt {
+		return nil, ErrExpiredToken
+	}
+
+	return &claims, nil
+}
+
+// The signature() helper signs the input with the configured key.
+func (s *Signer) signature(input []byte) []byte {
+	switch s.alg {
+	case AlgEdDSA:
+		return ed25519.Sign(s.privateKey, input)
+	default:
+		mac := hmac.New(sha256.New, s.secret)
+		mac.Write(input)
+		return mac.Sum(nil)
+	}
+}
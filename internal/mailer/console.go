@@ -0,0 +1,37 @@
+package mailer
+
+import (
+	"github.com/petrostrak/an-open-movie-database/internal/jsonlog"
+)
+
+// Define a Console struct which doesn't send emails at all, and instead writes the
+// rendered plain-text email to the log. It's intended for development, where it saves
+// setting up an SMTP server just to get at activation tokens.
+type Console struct {
+	logger *jsonlog.Logger
+	sender string
+}
+
+func NewConsole(logger *jsonlog.Logger, sender string) *Console {
+	return &Console{
+		logger: logger,
+		sender: sender,
+	}
+}
+
+// Send renders the email and logs it.
+func (m *Console) Send(recipient, locale, templateFile string, data interface{}) error {
+	rendered, err := render(locale, templateFile, data)
+	if err != nil {
+		return err
+	}
+
+	m.logger.PrintInfo("email", map[string]string{
+		"to":      recipient,
+		"from":    m.sender,
+		"subject": rendered.subject,
+		"body":    rendered.plainBody,
+	})
+
+	return nil
+}
@@ -3,10 +3,12 @@ package mailer
 import (
 	"bytes"
 	"embed"
-	"html/template"
-	"time"
-
-	"github.com/go-mail/mail/v2"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"io/fs"
+	"path"
+	texttemplate "text/template"
 )
 
 // Below we declare a new variable with the type embed.FS (embedded file system) to hold
@@ -14,92 +16,131 @@ import (
 // IMMEDIATELY ABOVE it, which indicates to Go that we want to store the contents of the
 // ./templates directory in the templateFS embedded file system variable.
 
-// go:embed "templates"
+//go:embed "templates"
 var templateFS embed.FS
 
-// Define a Mailer struct which contains a mail.Dialer instance (used to connect to a
-// SMTP server) and the sender information for your emails (the name and address you
-// want the email to be from).
-type Mailer struct {
-	dialer *mail.Dialer
-	sender string
+// Define a Mailer interface which is satisfied by each of our email providers. Send()
+// takes the recipient email address as the first parameter, their locale, the name of
+// the file containing the templates, and any dynamic data for the templates as an
+// interface{} parameter.
+type Mailer interface {
+	Send(recipient, locale, templateFile string, data interface{}) error
 }
 
-func New(host string, port int, username, password, sender string) Mailer {
-	// Initialize a new mail.Dialer instance with the given SMTP server settings. We
-	// also configure this to use a 5 second timeout whenever we send an email.
-	dialer := mail.NewDialer(host, port, username, password)
-	dialer.Timeout = 5 * time.Second
+// The locale whose templates are used when there's no translation for the recipient's
+// locale. Every template file must exist for this locale.
+const DefaultLocale = "en"
 
-	// Return a Mailer instance containing the dialer and sender information.
-	return Mailer{
-		dialer: dialer,
-		sender: sender,
-	}
+// Define an error for a template file which hasn't been loaded.
+var ErrUnknownTemplate = errors.New("mailer: unknown template")
+
+// Define an emailTemplate struct to hold a parsed template file. The subject and plain
+// text body are executed with text/template, because html/template would escape
+// characters such as & in links. Only the HTML body uses html/template.
+type emailTemplate struct {
+	text *texttemplate.Template
+	html *htmltemplate.Template
 }
 
-// Define a Send() on the mailer type. This takes the recipient email address
-// as the first parameter, the name of the file containing the templates, and any
-// dynamic data from the template as an interface{} parameter.
-func (m Mailer) Send(recipient, templateFile string, data interface{}) error {
-	// Use the ParseFS() to parse the required template file from the embedded
-	// file system.
-	tmpl, err := template.New("email").ParseFS(templateFS, "templates/"+templateFile)
+// The parsed email templates, keyed by locale and file name (for example
+// "el/user_welcome.tmpl"). These are parsed once at startup by LoadTemplates(), rather
+// than every time an email is sent.
+var templates map[string]emailTemplate
+
+// LoadTemplates parses every template file for every locale, checking that each one
+// defines the "subject", "plainBody" and "htmlBody" templates and has a counterpart in
+// the default locale, and caches the results. It should be called once at startup, so
+// that a malformed template stops the application from starting rather than failing
+// when an email is sent.
+func LoadTemplates() error {
+	files, err := fs.Glob(templateFS, "templates/*/*.tmpl")
 	if err != nil {
 		return err
 	}
 
+	parsed := make(map[string]emailTemplate, len(files))
+
+	for _, file := range files {
+		// Use the ParseFS() to parse the template file from the embedded file system,
+		// once for each template package.
+		text, err := texttemplate.New("email").ParseFS(templateFS, file)
+		if err != nil {
+			return err
+		}
+
+		html, err := htmltemplate.New("email").ParseFS(templateFS, file)
+		if err != nil {
+			return err
+		}
+
+		for _, name := range []string{"subject", "plainBody", "htmlBody"} {
+			if text.Lookup(name) == nil {
+				return fmt.Errorf("mailer: %s does not define the %q template", file, name)
+			}
+		}
+
+		locale := path.Base(path.Dir(file))
+		parsed[locale+"/"+path.Base(file)] = emailTemplate{text: text, html: html}
+	}
+
+	for key := range parsed {
+		if _, ok := parsed[DefaultLocale+"/"+path.Base(key)]; !ok {
+			return fmt.Errorf("mailer: %s has no %q version", key, DefaultLocale)
+		}
+	}
+
+	templates = parsed
+
+	return nil
+}
+
+// Define a message struct to hold a rendered email, ready to be handed to a provider.
+type message struct {
+	subject   string
+	plainBody string
+	htmlBody  string
+}
+
+// The render() function executes the "subject", "plainBody" and "htmlBody" templates
+// from a template file, passing in the dynamic data. The data is usually a
+// map[string]interface{}, so that each email can pass whatever values it needs. If
+// there's no translation of the template for the locale, the default locale's version
+// is used.
+func render(locale, templateFile string, data interface{}) (*message, error) {
+	tmpl, ok := templates[locale+"/"+templateFile]
+	if !ok {
+		tmpl, ok = templates[DefaultLocale+"/"+templateFile]
+	}
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownTemplate, templateFile)
+	}
+
 	// Execute the named template "subject", passing in the dynamic data and storing the
 	// result in a bytes.Buffer variable.
 	subject := new(bytes.Buffer)
-	err = tmpl.ExecuteTemplate(subject, "subject", data)
+	err := tmpl.text.ExecuteTemplate(subject, "subject", data)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// Follow the same pattern to execute the "plainBody" template and store the result
 	// in the plainBody variabe.
 	plainBody := new(bytes.Buffer)
-	err = tmpl.ExecuteTemplate(plainBody, "plainBody", data)
+	err = tmpl.text.ExecuteTemplate(plainBody, "plainBody", data)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// And likewise with the "htmlBody" template.
 	htmlBody := new(bytes.Buffer)
-	err = tmpl.ExecuteTemplate(htmlBody, "htmlBody", data)
+	err = tmpl.html.ExecuteTemplate(htmlBody, "htmlBody", data)
 	if err != nil {
-		return err
-	}
-
-	// Use the mail.NewMessage() function to initialize a new mail.Message instance.
-	// Then we use the SetHeader() method to set the email recipient, sender and subject
-	// headers, the SetBody() method to set the plain-text body, and the AddAlternative()
-	// method to set the HTML body. It's important to note that AddAlternative() should
-	// always be called *after* SetBody().
-	msg := mail.NewMessage()
-	msg.SetHeader("To", recipient)
-	msg.SetHeader("From", m.sender)
-	msg.SetHeader("Subject", subject.String())
-	msg.SetBody("text/plain", plainBody.String())
-	msg.AddAlternative("text/html", htmlBody.String())
-
-	// Try sending the email up to three times before aborting and returning the final
-	// error. We sleep for 500 milliseconds between each attempt.
-	for i := 0; i <= 3; i++ {
-		// Call the DialAndSend() method on the dialer, passing in the message to send. This
-		// opens a connection to the SMTP server, sends the message, then closes the
-		// connection. If there is a timeout, it will return a "dial tcp: i/o timeout"
-		// error.
-		err = m.dialer.DialAndSend(msg)
-		// If everything worked, return nil.
-		if nil == err {
-			return nil
-		}
-
-		// If it didn't work, sleep for a short time and retry.
-		time.Sleep(500 * time.Millisecond)
+		return nil, err
 	}
 
-	return err
+	return &message{
+		subject:   subject.String(),
+		plainBody: plainBody.String(),
+		htmlBody:  htmlBody.String(),
+	}, nil
 }
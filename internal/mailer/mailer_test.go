@@ -0,0 +1,254 @@
+package mailer
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// Run the tests with -update to write the golden files from the templates as they are,
+// after changing a template on purpose.
+var update = flag.Bool("update", false, "update the golden files")
+
+// The sample data for each template, standing in for what the API passes when it sends
+// the email.
+var templateData = map[string]interface{}{
+	"user_welcome.tmpl": map[string]interface{}{
+		"activationToken":  "Y3QMGX3PJ3WLRL2YRTQGQ6KRHU",
+		"activationURL":    "https://omdb.example.com/activate?token=Y3QMGX3PJ3WLRL2YRTQGQ6KRHU",
+		"activationExpiry": "2027-01-02 15:04 UTC",
+		"userID":           42,
+	},
+	"user_password_reset.tmpl": map[string]interface{}{
+		"passwordResetToken":  "P4B3XJMVFGZWQRLGNQ6KRHU3YT",
+		"passwordResetURL":    "https://omdb.example.com/reset-password?token=P4B3XJMVFGZWQRLGNQ6KRHU3YT",
+		"passwordResetExpiry": "2027-01-02 15:04 UTC",
+	},
+	"watchlist_movie_updated.tmpl": map[string]interface{}{
+		"name":       "Alice",
+		"movieID":    7,
+		"movieTitle": "Black Panther",
+		"changes": []map[string]interface{}{
+			{"field": "runtime", "before": "134 mins", "after": "135 mins"},
+			{"field": "genres", "before": "action", "after": "action, adventure"},
+		},
+		"unsubscribeURL": "https://omdb.example.com/v1/watchlist/unsubscribe?token=U7JMVFGZWQRLGNQ6KRHU3YTP4B&movie_id=7",
+	},
+	"new_movies_digest.tmpl": map[string]interface{}{
+		"name":  "Alice",
+		"count": 2,
+		"movies": []map[string]interface{}{
+			{"title": "Moana", "year": 2016, "genres": "animation, adventure"},
+			{"title": "Deadpool", "year": 2016, "genres": "action, comedy"},
+		},
+	},
+}
+
+// Each template renders, for each locale, to what's in its golden file in testdata.
+func TestRenderGolden(t *testing.T) {
+	err := LoadTemplates()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var keys []string
+	for key := range templates {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		t.Run(key, func(t *testing.T) {
+			locale, file := path.Split(key)
+
+			data, ok := templateData[file]
+			if !ok {
+				t.Fatalf("no sample data for %s", file)
+			}
+
+			rendered, err := render(strings.TrimSuffix(locale, "/"), file, data)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := "subject: " + rendered.subject + "\n\n--- plainBody ---\n" + rendered.plainBody + "\n--- htmlBody ---\n" + rendered.htmlBody
+			golden := filepath.Join("testdata", strings.TrimSuffix(key, ".tmpl")+".golden")
+
+			if *update {
+				err := os.MkdirAll(filepath.Dir(golden), 0o755)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				err = os.WriteFile(golden, []byte(got), 0o644)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatalf("%v; run the tests with -update to create it", err)
+			}
+
+			if got != string(want) {
+				t.Errorf("%s doesn't match %s; run the tests with -update if the change is intended\ngot:\n%s", key, golden, got)
+			}
+		})
+	}
+}
+
+// The message sent by SMTP is multipart/alternative, with a text/plain part followed
+// by a text/html part.
+func TestNewMessageParts(t *testing.T) {
+	err := LoadTemplates()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rendered, err := render("en", "user_welcome.tmpl", templateData["user_welcome.tmpl"])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+
+	_, err = newMessage("Online Movie DB <no-reply@omdb.example.com>", "alice@example.com", rendered).WriteTo(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := mail.ReadMessage(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := msg.Header.Get("To"); got != "alice@example.com" {
+		t.Errorf("got To %q; want alice@example.com", got)
+	}
+
+	if got := msg.Header.Get("Subject"); got != rendered.subject {
+		t.Errorf("got Subject %q; want %q", got, rendered.subject)
+	}
+
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/alternative" {
+		t.Fatalf("got Content-Type %q and error %v; want multipart/alternative", msg.Header.Get("Content-Type"), err)
+	}
+
+	var types []string
+	bodies := make(map[string]string)
+
+	mr := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		partType, _, err := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// NextPart() decodes a quoted-printable part, whose lines end with CRLF.
+		body, err := io.ReadAll(part)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		types = append(types, partType)
+		bodies[partType] = strings.ReplaceAll(string(body), "\r\n", "\n")
+	}
+
+	if strings.Join(types, ",") != "text/plain,text/html" {
+		t.Fatalf("got parts %v; want text/plain and then text/html", types)
+	}
+
+	if bodies["text/plain"] != rendered.plainBody || bodies["text/html"] != rendered.htmlBody {
+		t.Errorf("got parts %q; want the rendered plain-text and HTML bodies", bodies)
+	}
+}
+
+// An email is rendered in the recipient's locale, and in English when there's no
+// translation of the template, or the locale isn't one we have at all.
+func TestRenderLocale(t *testing.T) {
+	err := LoadTemplates()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		locale      string
+		file        string
+		wantSubject string
+	}{
+		{"greek", "el", "user_welcome.tmpl", "Καλώς ήρθατε στο Online Movie DB!"},
+		{"english", "en", "user_welcome.tmpl", "Welcome to Online Movie DB!"},
+		{"no greek translation", "el", "user_password_reset.tmpl", "Reset your Online Movie DB password"},
+		{"unsupported locale", "fr", "user_welcome.tmpl", "Welcome to Online Movie DB!"},
+		{"no locale", "", "user_welcome.tmpl", "Welcome to Online Movie DB!"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rendered, err := render(tt.locale, tt.file, templateData[tt.file])
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if rendered.subject != tt.wantSubject {
+				t.Errorf("got subject %q; want %q", rendered.subject, tt.wantSubject)
+			}
+		})
+	}
+
+	_, err = render("el", "no_such_template.tmpl", nil)
+	if !errors.Is(err, ErrUnknownTemplate) {
+		t.Errorf("got error %v for a template which doesn't exist; want ErrUnknownTemplate", err)
+	}
+}
+
+// The Greek subject of the welcome email survives being encoded in the message header.
+func TestNewMessageGreekSubject(t *testing.T) {
+	err := LoadTemplates()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rendered, err := render("el", "user_welcome.tmpl", templateData["user_welcome.tmpl"])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+
+	_, err = newMessage("no-reply@omdb.example.com", "alice@example.com", rendered).WriteTo(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := mail.ReadMessage(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	subject, err := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil || subject != "Καλώς ήρθατε στο Online Movie DB!" {
+		t.Errorf("got subject %q and error %v; want the Greek subject", subject, err)
+	}
+}
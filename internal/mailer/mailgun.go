@@ -0,0 +1,81 @@
+package mailer
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// The base URL of Mailgun's US region API. Domains in the EU region use
+// https://api.eu.mailgun.net/v3 instead.
+const MailgunDefaultBaseURL = "https://api.mailgun.net/v3"
+
+// Define a Mailgun struct which sends emails via the Mailgun HTTP API. This works on
+// platforms which block outgoing SMTP connections.
+type Mailgun struct {
+	client  *http.Client
+	baseURL string
+	domain  string
+	apiKey  string
+	sender  string
+}
+
+func NewMailgun(baseURL, domain, apiKey, sender string) *Mailgun {
+	return &Mailgun{
+		client:  &http.Client{Timeout: 10 * time.Second},
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		domain:  domain,
+		apiKey:  apiKey,
+		sender:  sender,
+	}
+}
+
+// Send renders the email and posts it to Mailgun's messages endpoint.
+func (m *Mailgun) Send(recipient, locale, templateFile string, data interface{}) error {
+	rendered, err := render(locale, templateFile, data)
+	if err != nil {
+		return err
+	}
+
+	form := url.Values{
+		"from":    {m.sender},
+		"to":      {recipient},
+		"subject": {rendered.subject},
+		"text":    {rendered.plainBody},
+		"html":    {rendered.htmlBody},
+	}
+
+	endpoint := fmt.Sprintf("%s/%s/messages", m.baseURL, url.PathEscape(m.domain))
+
+	req, err := http.NewRequest(http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+
+	req.SetBasicAuth("api", m.apiKey)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	res, err := m.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		body, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+		err = fmt.Errorf("mailgun: unexpected status %d: %s", res.StatusCode, strings.TrimSpace(string(body)))
+
+		// Rate limiting and server errors are worth retrying.
+		if res.StatusCode == http.StatusTooManyRequests || res.StatusCode >= 500 {
+			return temporaryError{err}
+		}
+
+		return err
+	}
+
+	return nil
+}
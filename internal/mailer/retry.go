@@ -0,0 +1,138 @@
+package mailer
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"net/textproto"
+	"sync/atomic"
+	"time"
+)
+
+// The default delays before each retry. A failed send is retried up to three times,
+// backing off exponentially.
+var DefaultRetryDelays = []time.Duration{500 * time.Millisecond, 2 * time.Second, 8 * time.Second}
+
+// Define a Retry struct which wraps another Mailer, retrying sends which fail with a
+// temporary error. There's one retry for each delay in the delays slice. Once ctx is
+// cancelled, it stops backing off, and a send which fails isn't retried.
+type Retry struct {
+	ctx    context.Context
+	next   Mailer
+	delays []time.Duration
+
+	sent     int64
+	retries  int64
+	failures int64
+}
+
+// Define a RetryStats struct to hold the counters which we publish via expvar.
+type RetryStats struct {
+	Sent     int64 `json:"sent"`
+	Retries  int64 `json:"retries"`
+	Failures int64 `json:"failures"`
+}
+
+// Return a new Retry which wraps next, waiting for each of the delays (with jitter)
+// before the corresponding retry, until ctx is cancelled.
+func NewRetry(ctx context.Context, next Mailer, delays []time.Duration) *Retry {
+	return &Retry{
+		ctx:    ctx,
+		next:   next,
+		delays: delays,
+	}
+}
+
+// Send calls Send() on the wrapped Mailer, retrying temporary errors. Note that this
+// blocks for as long as the backoff takes, so it should only be called from a
+// background goroutine. If the context is cancelled while it's backing off, it returns
+// the last error straight away.
+func (m *Retry) Send(recipient, locale, templateFile string, data interface{}) error {
+	err := m.next.Send(recipient, locale, templateFile, data)
+
+	for _, d := range m.delays {
+		if err == nil || !IsTemporary(err) || !m.wait(jitter(d)) {
+			break
+		}
+
+		atomic.AddInt64(&m.retries, 1)
+
+		err = m.next.Send(recipient, locale, templateFile, data)
+	}
+
+	if err != nil {
+		atomic.AddInt64(&m.failures, 1)
+		return err
+	}
+
+	atomic.AddInt64(&m.sent, 1)
+
+	return nil
+}
+
+// The wait() method waits for the delay, returning false if the context is cancelled
+// first.
+func (m *Retry) wait(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-m.ctx.Done():
+		return false
+	}
+}
+
+// Stats returns the number of emails sent, retries made and emails which failed.
+func (m *Retry) Stats() RetryStats {
+	return RetryStats{
+		Sent:     atomic.LoadInt64(&m.sent),
+		Retries:  atomic.LoadInt64(&m.retries),
+		Failures: atomic.LoadInt64(&m.failures),
+	}
+}
+
+// The jitter() helper adds up to 20% to a delay in either direction, so that retries
+// from many goroutines don't line up.
+func jitter(d time.Duration) time.Duration {
+	if d <= 0 {
+		return 0
+	}
+
+	return d - d/5 + time.Duration(rand.Int63n(int64(d)/5*2+1))
+}
+
+// Define a temporaryError type for errors that a provider knows are worth retrying,
+// such as rate limiting or a server error from an HTTP API.
+type temporaryError struct {
+	err error
+}
+
+func (e temporaryError) Error() string {
+	return e.err.Error()
+}
+
+func (e temporaryError) Unwrap() error {
+	return e.err
+}
+
+// IsTemporary reports whether a send error is likely to go away if we try again: a
+// network error, a 4xx SMTP reply (which means "try again later"), or a provider error
+// marked as temporary. Anything else, such as a template error or a rejected
+// recipient, fails straight away.
+func IsTemporary(err error) bool {
+	var tempErr temporaryError
+	if errors.As(err, &tempErr) {
+		return true
+	}
+
+	var protoErr *textproto.Error
+	if errors.As(err, &protoErr) {
+		return protoErr.Code >= 400 && protoErr.Code < 500
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
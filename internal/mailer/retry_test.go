@@ -0,0 +1,139 @@
+package mailer
+
+import (
+	"context"
+	"errors"
+	"net/textproto"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Define a flakyMailer type which fails the first failures sends with err, and then
+// succeeds.
+type flakyMailer struct {
+	mu       sync.Mutex
+	failures int
+	err      error
+	calls    int
+}
+
+func (m *flakyMailer) Send(recipient, locale, templateFile string, data interface{}) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.calls++
+	if m.calls <= m.failures {
+		return m.err
+	}
+
+	return nil
+}
+
+func TestRetrySend(t *testing.T) {
+	temporary := &textproto.Error{Code: 421, Msg: "try again later"}
+	permanent := &textproto.Error{Code: 550, Msg: "no such user"}
+
+	tests := []struct {
+		name      string
+		failures  int
+		err       error
+		wantErr   error
+		wantCalls int
+		wantStats RetryStats
+	}{
+		{"first time", 0, temporary, nil, 1, RetryStats{Sent: 1}},
+		{"eventually", 2, temporary, nil, 3, RetryStats{Sent: 1, Retries: 2}},
+		{"on the last retry", 3, temporary, nil, 4, RetryStats{Sent: 1, Retries: 3}},
+		{"out of retries", 4, temporary, temporary, 4, RetryStats{Retries: 3, Failures: 1}},
+		{"permanent", 1, permanent, permanent, 1, RetryStats{Failures: 1}},
+		{"marked temporary", 1, temporaryError{errors.New("mailgun: unexpected status 503")}, nil, 2, RetryStats{Sent: 1, Retries: 1}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			flaky := &flakyMailer{failures: tt.failures, err: tt.err}
+			m := NewRetry(context.Background(), flaky, []time.Duration{0, 0, 0})
+
+			err := m.Send("alice@example.com", DefaultLocale, "user_welcome.tmpl", nil)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("got error %v; want %v", err, tt.wantErr)
+			}
+
+			if flaky.calls != tt.wantCalls {
+				t.Errorf("got %d calls; want %d", flaky.calls, tt.wantCalls)
+			}
+
+			if got := m.Stats(); got != tt.wantStats {
+				t.Errorf("got stats %+v; want %+v", got, tt.wantStats)
+			}
+		})
+	}
+}
+
+// Cancelling the context stops a send backing off, so that it doesn't hold up the
+// shutdown, and returns the last error.
+func TestRetrySendCancelled(t *testing.T) {
+	temporary := &textproto.Error{Code: 421, Msg: "try again later"}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	flaky := &flakyMailer{failures: 10, err: temporary}
+	m := NewRetry(ctx, flaky, []time.Duration{time.Hour, time.Hour})
+
+	done := make(chan error)
+	go func() {
+		done <- m.Send("alice@example.com", DefaultLocale, "user_welcome.tmpl", nil)
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, temporary) {
+			t.Errorf("got error %v; want the last send's error", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Send() was still backing off a second after the context was cancelled")
+	}
+
+	if flaky.calls != 1 {
+		t.Errorf("got %d calls; want 1", flaky.calls)
+	}
+
+	// Once the context is cancelled, a failed send isn't retried at all.
+	flaky.calls = 0
+
+	err := m.Send("alice@example.com", DefaultLocale, "user_welcome.tmpl", nil)
+	if !errors.Is(err, temporary) || flaky.calls != 1 {
+		t.Errorf("got error %v after %d calls; want the first send's error", err, flaky.calls)
+	}
+}
+
+func TestIsTemporary(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"smtp 4xx", &textproto.Error{Code: 451, Msg: "local error"}, true},
+		{"smtp 5xx", &textproto.Error{Code: 554, Msg: "rejected"}, false},
+		{"marked temporary", temporaryError{errors.New("rate limited")}, true},
+		{"network", &timeoutError{}, true},
+		{"other", errors.New("template: no such template"), false},
+	}
+
+	for _, tt := range tests {
+		if got := IsTemporary(tt.err); got != tt.want {
+			t.Errorf("%s: got %t; want %t", tt.name, got, tt.want)
+		}
+	}
+}
+
+// Define a timeoutError type which satisfies net.Error.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
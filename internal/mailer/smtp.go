@@ -0,0 +1,60 @@
+package mailer
+
+import (
+	"time"
+
+	"github.com/go-mail/mail/v2"
+)
+
+// Define a SMTP struct which contains a mail.Dialer instance (used to connect to a
+// SMTP server) and the sender information for your emails (the name and address you
+// want the email to be from).
+type SMTP struct {
+	dialer *mail.Dialer
+	sender string
+}
+
+func NewSMTP(host string, port int, username, password, sender string) *SMTP {
+	// Initialize a new mail.Dialer instance with the given SMTP server settings. We
+	// also configure this to use a 5 second timeout whenever we send an email.
+	dialer := mail.NewDialer(host, port, username, password)
+	dialer.Timeout = 5 * time.Second
+
+	// Return a SMTP instance containing the dialer and sender information.
+	return &SMTP{
+		dialer: dialer,
+		sender: sender,
+	}
+}
+
+// Send renders the email and sends it via the SMTP server.
+func (m *SMTP) Send(recipient, locale, templateFile string, data interface{}) error {
+	rendered, err := render(locale, templateFile, data)
+	if err != nil {
+		return err
+	}
+
+	// Call the DialAndSend() method on the dialer, passing in the message to send. This
+	// opens a connection to the SMTP server, sends the message, then closes the
+	// connection. If there is a timeout, it will return a "dial tcp: i/o timeout"
+	// error. Retrying is left to the Retry wrapper.
+	return m.dialer.DialAndSend(newMessage(m.sender, recipient, rendered))
+}
+
+// The newMessage() function builds the MIME message for a rendered email, with the
+// plain-text and HTML bodies as alternative parts.
+func newMessage(sender, recipient string, rendered *message) *mail.Message {
+	// Use the mail.NewMessage() function to initialize a new mail.Message instance.
+	// Then we use the SetHeader() method to set the email recipient, sender and subject
+	// headers, the SetBody() method to set the plain-text body, and the AddAlternative()
+	// method to set the HTML body. It's important to note that AddAlternative() should
+	// always be called *after* SetBody().
+	msg := mail.NewMessage()
+	msg.SetHeader("To", recipient)
+	msg.SetHeader("From", sender)
+	msg.SetHeader("Subject", rendered.subject)
+	msg.SetBody("text/plain", rendered.plainBody)
+	msg.AddAlternative("text/html", rendered.htmlBody)
+
+	return msg
+}
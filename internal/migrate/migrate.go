@@ -0,0 +1,375 @@
+// Package migrate applies the SQL migrations to the database. It keeps track of the
+// schema version in the same schema_migrations table, and takes the same advisory
+// lock, as the golang-migrate CLI, so the two can be used interchangeably.
+//
+// We don't use the golang-migrate library itself: we only need its postgres driver
+// and a source for embedded files, but its module requires the dependencies of every
+// database and source it supports. The behaviour we rely on (applying the up and down
+// files in order, the dirty flag and the lock) is small enough to keep here, and
+// migrate_test.go checks it against a real database.
+//
+// The migrations can also be applied to a SQLite database (see NewForDriver()), which
+// has no advisory locks, as it's only ever used by one process.
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/fs"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+var (
+	// ErrNoChange is returned when there are no migrations to apply.
+	ErrNoChange = errors.New("no change")
+	// ErrNilVersion is returned by Version() when no migrations have been applied.
+	ErrNilVersion = errors.New("no migration")
+)
+
+// A DirtyError is returned when a previous migration failed part way through. The
+// schema has to be repaired by hand, and the version then set with Force().
+type DirtyError struct {
+	Version uint
+}
+
+func (e DirtyError) Error() string {
+	return fmt.Sprintf("dirty database version %d, fix the schema and force the version", e.Version)
+}
+
+// The filenameRX matches the names of the files created by
+// `migrate create -seq -ext .sql`, such as "000001_create_movies_table.up.sql".
+var filenameRX = regexp.MustCompile(`^([0-9]+)_(.+)\.(up|down)\.sql$`)
+
+type migration struct {
+	version uint
+	name    string
+	up      string
+	down    string
+}
+
+// Define a Migrator type which applies the migrations in a file system to a database.
+type Migrator struct {
+	driverName string
+	db         *sql.DB
+	fsys       fs.FS
+	migrations []migration
+}
+
+// New reads the migration files from the root of fsys, for a PostgreSQL database.
+// Every migration must have both an up and a down file.
+func New(db *sql.DB, fsys fs.FS) (*Migrator, error) {
+	return NewForDriver("postgres", db, fsys)
+}
+
+// NewForDriver is like New(), for a database opened with the named driver, which is
+// either "postgres" or "sqlite".
+func NewForDriver(driverName string, db *sql.DB, fsys fs.FS) (*Migrator, error) {
+	if driverName != "postgres" && driverName != "sqlite" {
+		return nil, fmt.Errorf("unsupported database driver %q", driverName)
+	}
+
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[uint]*migration)
+
+	for _, entry := range entries {
+		matches := filenameRX.FindStringSubmatch(entry.Name())
+		if entry.IsDir() || matches == nil {
+			continue
+		}
+
+		version, err := strconv.ParseUint(matches[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("migration %s: %w", entry.Name(), err)
+		}
+
+		m, ok := byVersion[uint(version)]
+		if !ok {
+			m = &migration{version: uint(version), name: matches[2]}
+			byVersion[uint(version)] = m
+		}
+
+		if m.name != matches[2] {
+			return nil, fmt.Errorf("migration %d has more than one name", version)
+		}
+
+		if matches[3] == "up" {
+			m.up = entry.Name()
+		} else {
+			m.down = entry.Name()
+		}
+	}
+
+	migrator := &Migrator{driverName: driverName, db: db, fsys: fsys}
+
+	for _, m := range byVersion {
+		if m.up == "" || m.down == "" {
+			return nil, fmt.Errorf("migration %d_%s must have both an up and a down file", m.version, m.name)
+		}
+		migrator.migrations = append(migrator.migrations, *m)
+	}
+
+	sort.Slice(migrator.migrations, func(i, j int) bool {
+		return migrator.migrations[i].version < migrator.migrations[j].version
+	})
+
+	return migrator, nil
+}
+
+// Latest returns the version of the newest migration, or zero if there are none.
+func (m *Migrator) Latest() uint {
+	if len(m.migrations) == 0 {
+		return 0
+	}
+	return m.migrations[len(m.migrations)-1].version
+}
+
+// Version returns the current schema version, and whether the last migration failed
+// part way through. It returns ErrNilVersion if no migrations have been applied.
+//
+// Unlike the other methods, Version() doesn't wait for the advisory lock, so that it
+// can report the version while another instance is migrating the database.
+func (m *Migrator) Version() (uint, bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.currentVersion(ctx, m.db)
+}
+
+// Up applies every migration newer than the current version, returning ErrNoChange if
+// the schema is already up to date.
+func (m *Migrator) Up() error {
+	return m.withLock(func(ctx context.Context, conn *sql.Conn) error {
+		version, err := m.cleanVersion(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		applied := 0
+
+		for _, mig := range m.migrations {
+			if version != nil && mig.version <= *version {
+				continue
+			}
+
+			err = m.run(ctx, conn, mig.up, mig.version, &mig.version)
+			if err != nil {
+				return err
+			}
+
+			applied++
+		}
+
+		if applied == 0 {
+			return ErrNoChange
+		}
+
+		return nil
+	})
+}
+
+// Down rolls back the given number of migrations, or all of them if steps is zero or
+// less. It returns ErrNoChange if there is nothing to roll back.
+func (m *Migrator) Down(steps int) error {
+	return m.withLock(func(ctx context.Context, conn *sql.Conn) error {
+		version, err := m.cleanVersion(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		applied := 0
+
+		for i := len(m.migrations) - 1; i >= 0; i-- {
+			if steps > 0 && applied == steps {
+				break
+			}
+
+			mig := m.migrations[i]
+			if version == nil || mig.version > *version {
+				continue
+			}
+
+			// Rolling back a migration leaves the schema at the previous version, or
+			// at no version at all after the first.
+			var previous *uint
+			if i > 0 {
+				previous = &m.migrations[i-1].version
+			}
+
+			err = m.run(ctx, conn, mig.down, mig.version, previous)
+			if err != nil {
+				return err
+			}
+
+			applied++
+		}
+
+		if applied == 0 {
+			return ErrNoChange
+		}
+
+		return nil
+	})
+}
+
+// Force sets the schema version without running any migrations, and clears the dirty
+// flag. It's used to recover once a failed migration has been repaired by hand.
+func (m *Migrator) Force(version uint) error {
+	return m.withLock(func(ctx context.Context, conn *sql.Conn) error {
+		return setVersion(ctx, conn, &version, false)
+	})
+}
+
+// The run() method marks the schema as dirty at the migration's version, runs the
+// migration file, and then records the resulting version. If the file fails, the
+// dirty flag is left set, as the migration may have been partly applied.
+func (m *Migrator) run(ctx context.Context, conn *sql.Conn, filename string, version uint, result *uint) error {
+	script, err := fs.ReadFile(m.fsys, filename)
+	if err != nil {
+		return err
+	}
+
+	err = setVersion(ctx, conn, &version, true)
+	if err != nil {
+		return err
+	}
+
+	// Without any arguments, lib/pq uses the simple query protocol, which allows a
+	// file to contain more than one statement. go-sqlite3 runs each statement in turn.
+	_, err = conn.ExecContext(ctx, string(script))
+	if err != nil {
+		return fmt.Errorf("migration %s: %w", filename, err)
+	}
+
+	return setVersion(ctx, conn, result, false)
+}
+
+// The withLock() method runs fn on a single connection while holding the same advisory
+// lock as golang-migrate, so that two instances can't migrate the database at once.
+// A SQLite database is only used by one process, so it isn't locked.
+func (m *Migrator) withLock(fn func(ctx context.Context, conn *sql.Conn) error) error {
+	ctx := context.Background()
+
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if m.driverName == "postgres" {
+		var database, schema string
+
+		err = conn.QueryRowContext(ctx, `SELECT current_database(), current_schema()`).Scan(&database, &schema)
+		if err != nil {
+			return err
+		}
+
+		lockID := advisoryLockID(database, schema)
+
+		_, err = conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, lockID)
+		if err != nil {
+			return err
+		}
+		defer conn.ExecContext(ctx, `SELECT pg_advisory_unlock($1)`, lockID)
+	}
+
+	_, err = conn.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS schema_migrations (version bigint NOT NULL PRIMARY KEY, dirty boolean NOT NULL)`)
+	if err != nil {
+		return err
+	}
+
+	return fn(ctx, conn)
+}
+
+// The advisoryLockID() function derives the lock ID in the same way as golang-migrate.
+func advisoryLockID(database, schema string) string {
+	sum := crc32.ChecksumIEEE([]byte(strings.Join([]string{schema, database}, "\x00")))
+	sum = sum * uint32(1486364155)
+	return strconv.FormatUint(uint64(sum), 10)
+}
+
+// The queryer interface is satisfied by both *sql.DB and *sql.Conn.
+type queryer interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+func (m *Migrator) currentVersion(ctx context.Context, q queryer) (uint, bool, error) {
+	var version int64
+	var dirty bool
+
+	err := q.QueryRowContext(ctx, `SELECT version, dirty FROM schema_migrations LIMIT 1`).Scan(&version, &dirty)
+	if err != nil {
+		var pqErr *pq.Error
+
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return 0, false, ErrNilVersion
+		// The table doesn't exist until the first migration is applied.
+		case errors.As(err, &pqErr) && pqErr.Code == "42P01":
+			return 0, false, ErrNilVersion
+		case m.driverName == "sqlite" && strings.HasPrefix(err.Error(), "no such table"):
+			return 0, false, ErrNilVersion
+		default:
+			return 0, false, err
+		}
+	}
+
+	return uint(version), dirty, nil
+}
+
+// The cleanVersion() function returns the current version, or nil if no migrations
+// have been applied, and a DirtyError if the last migration failed.
+func (m *Migrator) cleanVersion(ctx context.Context, conn *sql.Conn) (*uint, error) {
+	version, dirty, err := m.currentVersion(ctx, conn)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrNilVersion):
+			return nil, nil
+		default:
+			return nil, err
+		}
+	}
+
+	if dirty {
+		return nil, DirtyError{Version: version}
+	}
+
+	return &version, nil
+}
+
+// The setVersion() function replaces the row in schema_migrations. A nil version
+// leaves the table empty, which means that no migrations have been applied.
+func setVersion(ctx context.Context, conn *sql.Conn, version *uint, dirty bool) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM schema_migrations`)
+	if err != nil {
+		return err
+	}
+
+	if version != nil {
+		_, err = tx.ExecContext(ctx, `INSERT INTO schema_migrations (version, dirty) VALUES ($1, $2)`, int64(*version), dirty)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
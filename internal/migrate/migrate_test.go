@@ -0,0 +1,259 @@
+package migrate_test
+
+import (
+	"database/sql"
+	"errors"
+	"sync"
+	"testing"
+	"testing/fstest"
+
+	"github.com/petrostrak/an-open-movie-database/internal/migrate"
+	"github.com/petrostrak/an-open-movie-database/internal/testdb"
+	"github.com/petrostrak/an-open-movie-database/migrations"
+)
+
+// The testMigrations() helper returns three migrations which create, alter and fill a
+// table. If broken is true, the third one fails part way through.
+func testMigrations(broken bool) fstest.MapFS {
+	third := `INSERT INTO things (name, size) VALUES ('a', 1);`
+	if broken {
+		third = `INSERT INTO things (name, size) VALUES ('a', 1); SELECT no_such_function();`
+	}
+
+	return fstest.MapFS{
+		"000001_create_things.up.sql":   {Data: []byte(`CREATE TABLE things (name text NOT NULL);`)},
+		"000001_create_things.down.sql": {Data: []byte(`DROP TABLE things;`)},
+		"000002_add_size.up.sql":        {Data: []byte(`ALTER TABLE things ADD COLUMN size integer;`)},
+		"000002_add_size.down.sql":      {Data: []byte(`ALTER TABLE things DROP COLUMN size;`)},
+		"000003_fill_things.up.sql":     {Data: []byte(third)},
+		"000003_fill_things.down.sql":   {Data: []byte(`DELETE FROM things;`)},
+		"README.md":                     {Data: []byte(`Not a migration.`)},
+	}
+}
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		name       string
+		fsys       fstest.MapFS
+		wantLatest uint
+		wantErr    bool
+	}{
+		{"valid", testMigrations(false), 3, false},
+		{"empty", fstest.MapFS{}, 0, false},
+		{"missing down", fstest.MapFS{"000001_a.up.sql": {}}, 0, true},
+		{"two names", fstest.MapFS{"000001_a.up.sql": {}, "000001_b.down.sql": {}}, 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := migrate.New(nil, tt.fsys)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v; want error %t", err, tt.wantErr)
+			}
+
+			if err == nil && m.Latest() != tt.wantLatest {
+				t.Errorf("got latest version %d; want %d", m.Latest(), tt.wantLatest)
+			}
+		})
+	}
+}
+
+// The checkVersion() helper fails the test unless the schema is at the given version
+// (0 for none), and clean.
+func checkVersion(t *testing.T, m *migrate.Migrator, want uint) {
+	t.Helper()
+
+	version, dirty, err := m.Version()
+	if want == 0 {
+		if !errors.Is(err, migrate.ErrNilVersion) {
+			t.Fatalf("got version %d and error %v; want %v", version, err, migrate.ErrNilVersion)
+		}
+		return
+	}
+
+	if err != nil || version != want || dirty {
+		t.Fatalf("got version %d, dirty %t and error %v; want version %d", version, dirty, err, want)
+	}
+}
+
+// The countThings() helper returns the number of rows in the things table.
+func countThings(t *testing.T, db *sql.DB) int {
+	t.Helper()
+
+	var n int
+
+	err := db.QueryRow(`SELECT COUNT(*) FROM things`).Scan(&n)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return n
+}
+
+// Applying the migrations again, or rolling back further than there is to go, changes
+// nothing.
+func TestUpDownIdempotent(t *testing.T) {
+	db := testdb.New(t)
+
+	m, err := migrate.New(db, testMigrations(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkVersion(t, m, 0)
+
+	err = m.Down(1)
+	if !errors.Is(err, migrate.ErrNoChange) {
+		t.Fatalf("got error %v rolling back with nothing applied; want %v", err, migrate.ErrNoChange)
+	}
+
+	err = m.Up()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkVersion(t, m, 3)
+
+	err = m.Up()
+	if !errors.Is(err, migrate.ErrNoChange) {
+		t.Fatalf("got error %v applying the migrations again; want %v", err, migrate.ErrNoChange)
+	}
+
+	// The third migration wasn't run twice.
+	if n := countThings(t, db); n != 1 {
+		t.Errorf("got %d rows; want 1", n)
+	}
+
+	err = m.Down(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkVersion(t, m, 1)
+
+	err = m.Up()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkVersion(t, m, 3)
+
+	err = m.Down(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkVersion(t, m, 0)
+
+	err = m.Down(0)
+	if !errors.Is(err, migrate.ErrNoChange) {
+		t.Fatalf("got error %v rolling back again; want %v", err, migrate.ErrNoChange)
+	}
+}
+
+// A migration which fails leaves the schema dirty, and nothing runs until the version
+// has been forced.
+func TestDirty(t *testing.T) {
+	db := testdb.New(t)
+
+	m, err := migrate.New(db, testMigrations(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = m.Up()
+	if err == nil {
+		t.Fatal("got no error from the broken migration")
+	}
+
+	version, dirty, err := m.Version()
+	if err != nil || version != 3 || !dirty {
+		t.Fatalf("got version %d, dirty %t and error %v; want version 3 dirty", version, dirty, err)
+	}
+
+	for name, fn := range map[string]func() error{"up": m.Up, "down": func() error { return m.Down(1) }} {
+		var dirtyErr migrate.DirtyError
+		if err := fn(); !errors.As(err, &dirtyErr) || dirtyErr.Version != 3 {
+			t.Errorf("got error %v from %s; want a DirtyError for version 3", err, name)
+		}
+	}
+
+	// The failed file ran in a single implicit transaction, so nothing was inserted.
+	err = m.Force(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkVersion(t, m, 2)
+
+	fixed, err := migrate.New(db, testMigrations(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = fixed.Up()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkVersion(t, fixed, 3)
+}
+
+// Instances which start at the same time wait for each other's lock, so each
+// migration is applied exactly once.
+func TestConcurrentUp(t *testing.T) {
+	db := testdb.New(t)
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		applied  int
+		failures []error
+	)
+
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			m, err := migrate.New(db, testMigrations(false))
+			if err == nil {
+				err = m.Up()
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			switch {
+			case err == nil:
+				applied++
+			case !errors.Is(err, migrate.ErrNoChange):
+				failures = append(failures, err)
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	if applied != 1 || len(failures) != 0 {
+		t.Fatalf("got %d instances applying the migrations and errors %v; want 1 and none", applied, failures)
+	}
+
+	if n := countThings(t, db); n != 1 {
+		t.Errorf("got %d rows; want 1", n)
+	}
+}
+
+// Every embedded migration can be applied, rolled back and applied again.
+func TestEmbeddedMigrations(t *testing.T) {
+	db := testdb.New(t)
+
+	m, err := migrate.New(db, migrations.FS)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, step := range []func() error{m.Up, func() error { return m.Down(0) }, m.Up} {
+		err = step()
+		if err != nil {
+			t.Fatalf("step %d: %v", i+1, err)
+		}
+	}
+
+	checkVersion(t, m, m.Latest())
+}
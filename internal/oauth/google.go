@@ -0,0 +1,147 @@
+package oauth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Define the default Google OAuth 2.0 endpoints. These are exported as package
+// variables (rather than constants) so that they can be pointed at a stub server.
+var (
+	GoogleAuthURL     = "https://accounts.google.com/o/oauth2/v2/auth"
+	GoogleTokenURL    = "https://oauth2.googleapis.com/token"
+	GoogleUserInfoURL = "https://openidconnect.googleapis.com/v1/userinfo"
+)
+
+// Define an error that we return if Google rejects the authorization code or the
+// access token, or responds with something we don't understand.
+var (
+	ErrExchangeFailed = errors.New("oauth: code exchange failed")
+)
+
+// Define a UserInfo struct to hold the identity details that Google returns for the
+// authenticated account. The Subject is Google's stable, unique ID for the account.
+type UserInfo struct {
+	Subject       string `json:"sub"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+	Name          string `json:"name"`
+}
+
+// Define a Google struct which holds the OAuth client credentials, the redirect URL
+// registered with Google, and the HTTP client used to talk to Google's endpoints.
+type Google struct {
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	AuthURL      string
+	TokenURL     string
+	UserInfoURL  string
+	client       *http.Client
+}
+
+func NewGoogle(clientID, clientSecret, redirectURL string) Google {
+	// Initialize a new http.Client with a 5 second timeout, so that a slow response
+	// from Google can't hold up the request indefinitely.
+	return Google{
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		RedirectURL:  redirectURL,
+		AuthURL:      GoogleAuthURL,
+		TokenURL:     GoogleTokenURL,
+		UserInfoURL:  GoogleUserInfoURL,
+		client:       &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+// Enabled reports whether the Google client credentials have been configured.
+func (g Google) Enabled() bool {
+	return g.ClientID != "" && g.ClientSecret != ""
+}
+
+// AuthCodeURL returns the URL of Google's consent screen. The state value is echoed
+// back to our callback by Google, which lets us detect forged callback requests.
+func (g Google) AuthCodeURL(state string) string {
+	params := url.Values{}
+	params.Set("client_id", g.ClientID)
+	params.Set("redirect_uri", g.RedirectURL)
+	params.Set("response_type", "code")
+	params.Set("scope", "openid email profile")
+	params.Set("state", state)
+
+	return g.AuthURL + "?" + params.Encode()
+}
+
+// Exchange trades the authorization code from the callback for an access token.
+func (g Google) Exchange(code string) (string, error) {
+	form := url.Values{}
+	form.Set("code", code)
+	form.Set("client_id", g.ClientID)
+	form.Set("client_secret", g.ClientSecret)
+	form.Set("redirect_uri", g.RedirectURL)
+	form.Set("grant_type", "authorization_code")
+
+	req, err := http.NewRequest(http.MethodPost, g.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	var output struct {
+		AccessToken string `json:"access_token"`
+	}
+
+	if err := g.do(req, &output); err != nil {
+		return "", err
+	}
+
+	if output.AccessToken == "" {
+		return "", ErrExchangeFailed
+	}
+
+	return output.AccessToken, nil
+}
+
+// UserInfo fetches the identity details for the account which owns the access token.
+func (g Google) UserInfo(accessToken string) (*UserInfo, error) {
+	req, err := http.NewRequest(http.MethodGet, g.UserInfoURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	req.Header.Set("Accept", "application/json")
+
+	var info UserInfo
+
+	if err := g.do(req, &info); err != nil {
+		return nil, err
+	}
+
+	if info.Subject == "" {
+		return nil, ErrExchangeFailed
+	}
+
+	return &info, nil
+}
+
+// The do() helper sends the request and decodes the JSON response body into dst. Any
+// non-2xx response is treated as a failed exchange.
+func (g Google) do(req *http.Request, dst interface{}) error {
+	res, err := g.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("%w: %s responded with status %d", ErrExchangeFailed, req.URL.Host, res.StatusCode)
+	}
+
+	return json.NewDecoder(res.Body).Decode(dst)
+}
@@ -0,0 +1,272 @@
+package ratelimit
+
+import (
+	"container/list"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// The number of shards the clients are split between, each with its own mutex, so that
+// requests from different clients rarely wait for each other.
+const memoryShards = 32
+
+// The default limits on the clients kept in memory, used for the zero fields of
+// MemoryOptions.
+const (
+	DefaultMaxEntries      = 100000
+	DefaultCleanupInterval = 10 * time.Second
+	DefaultMaxIdle         = time.Minute
+)
+
+// Define a MemoryOptions struct to hold the most clients a Memory limiter keeps, how
+// often it removes the idle ones, and how long a client may go unseen before it's
+// removed.
+type MemoryOptions struct {
+	MaxEntries      int
+	CleanupInterval time.Duration
+	MaxIdle         time.Duration
+}
+
+// Define a MemoryStats struct to hold the counters which we publish via expvar.
+// Evictions counts the clients removed to stay within MaxEntries, and Expired those
+// removed for being idle.
+type MemoryStats struct {
+	Entries   int   `json:"entries"`
+	Evictions int64 `json:"evictions"`
+	Expired   int64 `json:"expired"`
+}
+
+// Define a client struct to hold the rate limiter and last seen time for each client.
+type client struct {
+	key      string
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// Define a shard struct to hold a share of the clients, in a map for lookups and in a
+// list with the most recently seen at the front, for eviction. The shard keeps its own
+// copy of the limits, so that Allow() only ever takes the shard's mutex.
+type shard struct {
+	mu         sync.Mutex
+	rps        float64
+	burst      int
+	maxEntries int
+	clients    map[string]*list.Element
+	order      *list.List
+}
+
+// Memory is a RateLimiter which keeps a rate.Limiter for each key in memory. The
+// limits only apply to the current process.
+//
+// The clients are split between shards by a hash of their key, and each shard holds at
+// most its share of MaxEntries, evicting the least recently seen client to make room
+// for a new one. An evicted client starts again with a full bucket if it comes back.
+type Memory struct {
+	shards    []*shard
+	evictions int64
+	expired   int64
+}
+
+// NewMemory returns a Memory limiter, and launches a background goroutine which
+// removes the limiters of clients that haven't been seen within opts.MaxIdle, once
+// every opts.CleanupInterval. The zero fields of opts take the defaults. The rps must
+// be greater than zero, as rate.Limiter doesn't handle a zero rate in the version we
+// use.
+func NewMemory(rps float64, burst int, opts MemoryOptions) *Memory {
+	return newMemory(rps, burst, opts, memoryShards)
+}
+
+// The newMemory() function returns a Memory limiter with the given number of shards,
+// which the benchmarks set to 1 to compare against a single mutex. There are no more
+// shards than MaxEntries, so that every shard holds at least one client and together
+// they never hold more than MaxEntries.
+func newMemory(rps float64, burst int, opts MemoryOptions, shards int) *Memory {
+	if opts.MaxEntries <= 0 {
+		opts.MaxEntries = DefaultMaxEntries
+	}
+	if opts.CleanupInterval <= 0 {
+		opts.CleanupInterval = DefaultCleanupInterval
+	}
+	if opts.MaxIdle <= 0 {
+		opts.MaxIdle = DefaultMaxIdle
+	}
+
+	if shards > opts.MaxEntries {
+		shards = opts.MaxEntries
+	}
+
+	m := &Memory{shards: make([]*shard, shards)}
+
+	for i := range m.shards {
+		m.shards[i] = &shard{
+			rps:        rps,
+			burst:      burst,
+			maxEntries: opts.MaxEntries / shards,
+			clients:    make(map[string]*list.Element),
+			order:      list.New(),
+		}
+	}
+
+	go func() {
+		ticker := time.NewTicker(opts.CleanupInterval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			m.sweep(opts.MaxIdle)
+		}
+	}()
+
+	return m
+}
+
+// Allow takes a token from the limiter for key if there is one. It never returns an
+// error.
+//
+// The version of rate.Limiter we use can't report how many tokens it holds, which we
+// need for the rate limit headers. Instead, we reserve a token and cancel the
+// reservation if we would have to wait for it, and then work out how many tokens are
+// left from how long a reservation for a full bucket would have to wait. Both
+// reservations are made at the same instant, so cancelling them restores the limiter
+// exactly, and the shard's mutex stops other requests for the key interleaving with
+// them.
+func (m *Memory) Allow(key string) (bool, int, time.Duration, error) {
+	now := time.Now()
+
+	s := m.shard(key)
+
+	// Lock the shard's mutex to prevent this code from being executed concurrently for
+	// the clients in the same shard.
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Check to see if the key already exists in the shard. If it doesn't, then make
+	// room for it if the shard is full, and add a new rate limiter for it.
+	var c *client
+
+	element, found := s.clients[key]
+	if found {
+		c = element.Value.(*client)
+		s.order.MoveToFront(element)
+	} else {
+		for s.order.Len() >= s.maxEntries {
+			s.remove(s.order.Back())
+			atomic.AddInt64(&m.evictions, 1)
+		}
+
+		c = &client{key: key, limiter: rate.NewLimiter(rate.Limit(s.rps), s.burst)}
+		s.clients[key] = s.order.PushFront(c)
+	}
+
+	// Update the last seen time from the client.
+	c.lastSeen = now
+
+	r := c.limiter.ReserveN(now, 1)
+	if !r.OK() {
+		return false, 0, 0, nil
+	}
+
+	if delay := r.DelayFrom(now); delay > 0 {
+		r.CancelAt(now)
+		return false, 0, delay, nil
+	}
+
+	return true, s.remaining(c.limiter, now), 0, nil
+}
+
+// SetLimits changes the rate and burst of every client's limiter, and of the limiters
+// created for new clients.
+func (m *Memory) SetLimits(rps float64, burst int) {
+	now := time.Now()
+
+	for _, s := range m.shards {
+		s.mu.Lock()
+
+		s.rps = rps
+		s.burst = burst
+
+		for _, element := range s.clients {
+			c := element.Value.(*client)
+			c.limiter.SetLimitAt(now, rate.Limit(rps))
+			c.limiter.SetBurstAt(now, burst)
+		}
+
+		s.mu.Unlock()
+	}
+}
+
+// Stats returns the number of clients held and the eviction and expiry counters.
+func (m *Memory) Stats() MemoryStats {
+	var entries int
+
+	for _, s := range m.shards {
+		s.mu.Lock()
+		entries += s.order.Len()
+		s.mu.Unlock()
+	}
+
+	return MemoryStats{
+		Entries:   entries,
+		Evictions: atomic.LoadInt64(&m.evictions),
+		Expired:   atomic.LoadInt64(&m.expired),
+	}
+}
+
+// The shard() method returns the shard for key, by its 32-bit FNV-1a hash. We hash the
+// string in place, rather than with hash/fnv, so that Allow() doesn't allocate a byte
+// slice for it.
+func (m *Memory) shard(key string) *shard {
+	const (
+		offset = 2166136261
+		prime  = 16777619
+	)
+
+	h := uint32(offset)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= prime
+	}
+
+	return m.shards[h%uint32(len(m.shards))]
+}
+
+// The sweep() method removes the clients which haven't been seen within maxIdle. As
+// each shard's list is in the order the clients were last seen, it only has to look
+// at the back of the list, one shard at a time, so requests to the other shards carry
+// on while it runs.
+func (m *Memory) sweep(maxIdle time.Duration) {
+	cutoff := time.Now().Add(-maxIdle)
+
+	for _, s := range m.shards {
+		s.mu.Lock()
+
+		for element := s.order.Back(); element != nil && element.Value.(*client).lastSeen.Before(cutoff); element = s.order.Back() {
+			s.remove(element)
+			atomic.AddInt64(&m.expired, 1)
+		}
+
+		s.mu.Unlock()
+	}
+}
+
+// The remaining() method reports how many whole tokens lim holds at now. The mutex
+// must be held by the caller.
+func (s *shard) remaining(lim *rate.Limiter, now time.Time) int {
+	r := lim.ReserveN(now, s.burst)
+	defer r.CancelAt(now)
+
+	missing := r.DelayFrom(now).Seconds() * s.rps
+
+	// Round away the error from converting the delay to a whole number of nanoseconds.
+	return int(math.Floor(float64(s.burst) - missing + 1e-6))
+}
+
+// The remove() helper removes an element from both the list and the map. The mutex
+// must be held by the caller.
+func (s *shard) remove(element *list.Element) {
+	s.order.Remove(element)
+	delete(s.clients, element.Value.(*client).key)
+}
@@ -0,0 +1,212 @@
+package ratelimit
+
+import (
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMemoryAllow(t *testing.T) {
+	m := NewMemory(10, 3, MemoryOptions{})
+
+	tests := []struct {
+		key           string
+		wantAllowed   bool
+		wantRemaining int
+	}{
+		{"a", true, 2},
+		{"a", true, 1},
+		{"b", true, 2},
+		{"a", true, 0},
+		{"a", false, 0},
+		{"b", true, 1},
+	}
+
+	for i, tt := range tests {
+		allowed, remaining, retryAfter, err := m.Allow(tt.key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if allowed != tt.wantAllowed || remaining != tt.wantRemaining {
+			t.Errorf("request %d for %q: got allowed %t and %d remaining; want %t and %d", i+1, tt.key, allowed, remaining, tt.wantAllowed, tt.wantRemaining)
+		}
+
+		// At 10 tokens a second, the next token is due within 100ms.
+		if !allowed && (retryAfter <= 0 || retryAfter > 100*time.Millisecond) {
+			t.Errorf("request %d for %q: got retry after %v; want up to 100ms", i+1, tt.key, retryAfter)
+		}
+	}
+}
+
+// A rejected request mustn't use up any of the tokens which refill afterwards.
+func TestMemoryRefill(t *testing.T) {
+	m := NewMemory(20, 1, MemoryOptions{})
+
+	allowed, _, _, _ := m.Allow("a")
+	if !allowed {
+		t.Fatal("got the first request rejected")
+	}
+
+	allowed, _, retryAfter, _ := m.Allow("a")
+	if allowed {
+		t.Fatal("got the second request allowed with an empty bucket")
+	}
+
+	time.Sleep(retryAfter + 5*time.Millisecond)
+
+	allowed, _, _, _ = m.Allow("a")
+	if !allowed {
+		t.Error("got the request rejected after waiting for the retry after time")
+	}
+}
+
+// Changing the limits keeps the tokens in existing buckets, and new buckets start full
+// at the new burst.
+func TestMemorySetLimits(t *testing.T) {
+	m := NewMemory(0.001, 1, MemoryOptions{})
+
+	allowed, _, _, _ := m.Allow("a")
+	if !allowed {
+		t.Fatal("got the first request rejected")
+	}
+
+	m.SetLimits(0.001, 3)
+
+	allowed, _, _, _ = m.Allow("a")
+	if allowed {
+		t.Error("got a request allowed from the emptied bucket")
+	}
+
+	allowed, remaining, _, _ := m.Allow("b")
+	if !allowed || remaining != 2 {
+		t.Errorf("got allowed %t and %d remaining for a new key; want true and 2", allowed, remaining)
+	}
+}
+
+// Run with -race. Exactly burst requests should be allowed, however they interleave.
+func TestMemoryConcurrent(t *testing.T) {
+	m := NewMemory(0.001, 50, MemoryOptions{})
+
+	var (
+		wg      sync.WaitGroup
+		allowed int64
+	)
+
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for j := 0; j < 10; j++ {
+				ok, _, _, _ := m.Allow("a")
+				if ok {
+					atomic.AddInt64(&allowed, 1)
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	if allowed != 50 {
+		t.Errorf("got %d requests allowed; want 50", allowed)
+	}
+}
+
+// However many clients are seen, no more than MaxEntries are kept, and every client
+// added past the cap evicts another.
+func TestMemoryMaxEntries(t *testing.T) {
+	m := NewMemory(1, 1, MemoryOptions{MaxEntries: 64})
+
+	for i := 0; i < 1000; i++ {
+		m.Allow(strconv.Itoa(i))
+	}
+
+	stats := m.Stats()
+	if stats.Entries > 64 || stats.Entries+int(stats.Evictions) != 1000 {
+		t.Errorf("got %d entries and %d evictions; want at most 64 entries, and the rest evicted", stats.Entries, stats.Evictions)
+	}
+}
+
+// The client which was seen least recently is the one evicted, and starts again with
+// a full bucket when it comes back.
+func TestMemoryEvictsLeastRecentlySeen(t *testing.T) {
+	m := newMemory(0.001, 1, MemoryOptions{MaxEntries: 3}, 1)
+
+	for _, key := range []string{"a", "b", "c", "a", "d"} {
+		m.Allow(key)
+	}
+
+	// Adding d evicted b, and adding b back evicts c.
+	allowed, _, _, _ := m.Allow("b")
+	if !allowed {
+		t.Error("got the evicted client rejected; want a full bucket")
+	}
+
+	allowed, _, _, _ = m.Allow("a")
+	if allowed {
+		t.Error("got a request allowed from the emptied bucket of a recently seen client")
+	}
+
+	if stats := m.Stats(); stats.Entries != 3 || stats.Evictions != 2 {
+		t.Errorf("got %d entries and %d evictions; want 3 and 2", stats.Entries, stats.Evictions)
+	}
+}
+
+func TestMemorySweep(t *testing.T) {
+	m := NewMemory(1, 1, MemoryOptions{})
+
+	m.Allow("a")
+	time.Sleep(20 * time.Millisecond)
+	m.Allow("b")
+
+	m.sweep(10 * time.Millisecond)
+
+	if stats := m.Stats(); stats.Entries != 1 || stats.Expired != 1 {
+		t.Errorf("got %d entries and %d expired; want 1 and 1", stats.Entries, stats.Expired)
+	}
+}
+
+// Compare a single mutex, as the limiter used to have, with the shards, for clients
+// which have been seen before and for a scan from new clients, which each evict
+// another once the limiter is full. Run with -cpu to vary the number of goroutines.
+func BenchmarkMemoryAllow(b *testing.B) {
+	for _, bm := range []struct {
+		name   string
+		shards int
+	}{
+		{"single mutex", 1},
+		{"sharded", memoryShards},
+	} {
+		b.Run(bm.name+"/existing clients", func(b *testing.B) {
+			m := newMemory(1e9, 1e9, MemoryOptions{}, bm.shards)
+
+			keys := make([]string, 1024)
+			for i := range keys {
+				keys[i] = "198.51.100." + strconv.Itoa(i)
+			}
+
+			b.RunParallel(func(pb *testing.PB) {
+				for i := 0; pb.Next(); i++ {
+					m.Allow(keys[i%len(keys)])
+				}
+			})
+		})
+
+		b.Run(bm.name+"/new clients", func(b *testing.B) {
+			m := newMemory(1e9, 1e9, MemoryOptions{MaxEntries: 10000}, bm.shards)
+
+			var next int64
+
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					m.Allow(strconv.FormatInt(atomic.AddInt64(&next, 1), 10))
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,17 @@
+// Package ratelimit provides token bucket rate limiters which are kept either in
+// memory, for a single instance of the API, or in Redis, so that the limits are
+// shared between every instance behind a load balancer.
+package ratelimit
+
+import "time"
+
+// RateLimiter is implemented by each store. Allow() takes a token from the bucket
+// for key, and reports whether the request is allowed, how many tokens are left, and
+// (if it isn't allowed) how long until the next token is available.
+//
+// SetLimits() changes the rate and burst while the limiter is in use, keeping the
+// tokens which are already in each bucket.
+type RateLimiter interface {
+	Allow(key string) (allowed bool, remaining int, retryAfter time.Duration, err error)
+	SetLimits(rps float64, burst int)
+}
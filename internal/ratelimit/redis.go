@@ -0,0 +1,129 @@
+package ratelimit
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/petrostrak/an-open-movie-database/internal/redis"
+)
+
+// tokenBucketScript implements the same token bucket as Memory, atomically, in Redis.
+// The bucket is a hash holding the number of tokens and when it was last refilled.
+// The time comes from the Redis server rather than the API instances, so that clock
+// differences between instances don't matter. redis.replicate_commands() allows
+// writes after calling TIME on Redis versions before 5.
+//
+// Buckets expire once they would have refilled completely, which replaces the
+// cleanup goroutine of the memory store.
+const tokenBucketScript = `
+redis.replicate_commands()
+
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+
+local time = redis.call('TIME')
+local now = tonumber(time[1]) + tonumber(time[2]) / 1000000
+
+local bucket = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(bucket[1]) or burst
+local ts = tonumber(bucket[2]) or now
+
+if now > ts then
+	tokens = math.min(burst, tokens + (now - ts) * rate)
+end
+
+local allowed = 0
+local retry = 0
+
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+elseif rate > 0 then
+	retry = math.ceil((1 - tokens) / rate * 1000)
+end
+
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'ts', tostring(now))
+
+local ttl = 60000
+if rate > 0 then
+	ttl = math.ceil(burst / rate * 1000) + 1000
+end
+redis.call('PEXPIRE', KEYS[1], ttl)
+
+return {allowed, math.floor(tokens), retry}
+`
+
+var tokenBucketSHA = func() string {
+	sum := sha1.Sum([]byte(tokenBucketScript))
+	return hex.EncodeToString(sum[:])
+}()
+
+// Redis is a RateLimiter which keeps the token buckets in Redis, so that the limits
+// are shared by every instance of the API.
+type Redis struct {
+	client *redis.Client
+	prefix string
+
+	mu    sync.Mutex
+	rps   string
+	burst string
+}
+
+// NewRedis returns a Redis limiter. The prefix is prepended to each key, so that
+// limiters with different settings can share a server.
+func NewRedis(client *redis.Client, prefix string, rps float64, burst int) *Redis {
+	return &Redis{
+		client: client,
+		prefix: prefix,
+		rps:    strconv.FormatFloat(rps, 'f', -1, 64),
+		burst:  strconv.Itoa(burst),
+	}
+}
+
+// SetLimits changes the rate and burst passed to the token bucket script. The buckets
+// themselves are left alone, and are capped at the new burst when they're next used.
+func (l *Redis) SetLimits(rps float64, burst int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.rps = strconv.FormatFloat(rps, 'f', -1, 64)
+	l.burst = strconv.Itoa(burst)
+}
+
+// Allow runs the token bucket script for key. The script is called by its SHA1 digest,
+// and only sent in full if the server doesn't have it cached yet.
+func (l *Redis) Allow(key string) (bool, int, time.Duration, error) {
+	key = l.prefix + key
+
+	l.mu.Lock()
+	rps, burst := l.rps, l.burst
+	l.mu.Unlock()
+
+	reply, err := l.client.Do("EVALSHA", tokenBucketSHA, "1", key, rps, burst)
+	if err != nil && strings.HasPrefix(err.Error(), "NOSCRIPT") {
+		reply, err = l.client.Do("EVAL", tokenBucketScript, "1", key, rps, burst)
+	}
+	if err != nil {
+		return false, 0, 0, err
+	}
+
+	values, ok := reply.([]interface{})
+	if !ok || len(values) != 3 {
+		return false, 0, 0, fmt.Errorf("ratelimit: unexpected reply %v", reply)
+	}
+
+	var result [3]int64
+	for i, v := range values {
+		result[i], ok = v.(int64)
+		if !ok {
+			return false, 0, 0, fmt.Errorf("ratelimit: unexpected reply %v", reply)
+		}
+	}
+
+	return result[0] == 1, int(result[1]), time.Duration(result[2]) * time.Millisecond, nil
+}
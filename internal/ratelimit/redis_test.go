@@ -0,0 +1,143 @@
+package ratelimit
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/petrostrak/an-open-movie-database/internal/redis"
+	"github.com/petrostrak/an-open-movie-database/internal/redis/redistest"
+)
+
+// The fakeRedis type adds the token bucket script to the fake server from redistest.
+// It doesn't run Lua: EVAL and EVALSHA take a token from an in-memory bucket which
+// never refills, and reply in the same shape as the script.
+type fakeRedis struct {
+	*redistest.Server
+
+	scripts map[string]bool
+	tokens  map[string]int
+}
+
+func newFakeRedis(t *testing.T, password string) *fakeRedis {
+	t.Helper()
+
+	f := &fakeRedis{
+		Server:  redistest.NewServer(t, password),
+		scripts: make(map[string]bool),
+		tokens:  make(map[string]int),
+	}
+
+	f.Handle("EVAL", func(args []string) string {
+		sum := sha1.Sum([]byte(args[1]))
+		f.scripts[hex.EncodeToString(sum[:])] = true
+		return f.takeToken(args[3], args[4], args[5])
+	})
+
+	f.Handle("EVALSHA", func(args []string) string {
+		if !f.scripts[args[1]] {
+			return "-NOSCRIPT No matching script. Please use EVAL.\r\n"
+		}
+		return f.takeToken(args[3], args[4], args[5])
+	})
+
+	return f
+}
+
+// The takeToken() method replies with {allowed, remaining, retry in ms}, like the
+// token bucket script. It's called with the server's mutex held.
+func (f *fakeRedis) takeToken(key, rate, burst string) string {
+	rps, _ := strconv.ParseFloat(rate, 64)
+	size, _ := strconv.Atoi(burst)
+
+	tokens, found := f.tokens[key]
+	if !found {
+		tokens = size
+	}
+
+	allowed, retry := 0, 0
+	if tokens >= 1 {
+		tokens--
+		allowed = 1
+	} else {
+		retry = int(math.Ceil(1 / rps * 1000))
+	}
+
+	f.tokens[key] = tokens
+
+	return fmt.Sprintf("*3\r\n:%d\r\n:%d\r\n:%d\r\n", allowed, tokens, retry)
+}
+
+func TestRedisAllow(t *testing.T) {
+	f := newFakeRedis(t, "")
+	client := redis.NewClient(f.Addr(), "", 2, time.Second)
+	defer client.Close()
+
+	l := NewRedis(client, "test:", 2, 2)
+
+	tests := []struct {
+		key            string
+		wantAllowed    bool
+		wantRemaining  int
+		wantRetryAfter time.Duration
+	}{
+		{"a", true, 1, 0},
+		{"a", true, 0, 0},
+		{"a", false, 0, 500 * time.Millisecond},
+		{"b", true, 1, 0},
+	}
+
+	for i, tt := range tests {
+		allowed, remaining, retryAfter, err := l.Allow(tt.key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if allowed != tt.wantAllowed || remaining != tt.wantRemaining || retryAfter != tt.wantRetryAfter {
+			t.Errorf("request %d for %q: got %t, %d remaining and retry after %v; want %t, %d and %v", i+1, tt.key, allowed, remaining, retryAfter, tt.wantAllowed, tt.wantRemaining, tt.wantRetryAfter)
+		}
+	}
+
+	// The script is only sent in full once, after the server replies NOSCRIPT.
+	want := "[EVALSHA EVAL EVALSHA EVALSHA EVALSHA]"
+	if got := fmt.Sprint(f.Commands()); got != want {
+		t.Errorf("got commands %s; want %s", got, want)
+	}
+
+	// The keys are prefixed.
+	f.Handle("EXISTS", func(args []string) string {
+		if _, found := f.tokens[args[1]]; found {
+			return ":1\r\n"
+		}
+		return ":0\r\n"
+	})
+
+	reply, err := client.Do("EXISTS", "test:a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := reply == int64(1)
+
+	if !found {
+		t.Error("got no bucket for the prefixed key test:a")
+	}
+}
+
+// When the server is unreachable, Allow() returns an error, so that the middleware can
+// decide whether to fail open.
+func TestRedisUnavailable(t *testing.T) {
+	f := newFakeRedis(t, "")
+	f.Close()
+
+	client := redis.NewClient(f.Addr(), "", 1, 100*time.Millisecond)
+	defer client.Close()
+
+	_, _, _, err := NewRedis(client, "test:", 1, 1).Allow("a")
+	if err == nil {
+		t.Error("got no error from an unreachable server")
+	}
+}
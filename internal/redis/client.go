@@ -0,0 +1,232 @@
+// Package redis is a minimal Redis client speaking the RESP protocol. It supports just
+// enough of the protocol for the rate limiter's scripts and the movie cache, so we
+// don't take on a client library for it. It's tested against the fake server in the
+// redistest package.
+package redis
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Error is an error reply sent by the Redis server, such as NOSCRIPT. Unlike a network
+// error, it leaves the connection usable.
+type Error string
+
+func (e Error) Error() string {
+	return string(e)
+}
+
+// ErrNil is returned by Get() when the key doesn't exist.
+var ErrNil = errors.New("redis: nil")
+
+// Client is a Redis client with a small pool of connections.
+type Client struct {
+	addr     string
+	password string
+	timeout  time.Duration
+	idle     chan *redisConn
+}
+
+type redisConn struct {
+	conn net.Conn
+	rd   *bufio.Reader
+}
+
+// NewClient returns a client for the Redis server at addr, which keeps at most poolSize
+// idle connections. Each command must complete within timeout, so that an unresponsive
+// server doesn't hold up requests.
+func NewClient(addr, password string, poolSize int, timeout time.Duration) *Client {
+	return &Client{
+		addr:     addr,
+		password: password,
+		timeout:  timeout,
+		idle:     make(chan *redisConn, poolSize),
+	}
+}
+
+// Ping checks that the server is reachable, and that the password is accepted.
+func (c *Client) Ping() error {
+	_, err := c.Do("PING")
+	return err
+}
+
+// Get returns the value of a key, or ErrNil if it doesn't exist.
+func (c *Client) Get(key string) (string, error) {
+	reply, err := c.Do("GET", key)
+	if err != nil {
+		return "", err
+	}
+
+	if reply == nil {
+		return "", ErrNil
+	}
+
+	value, ok := reply.(string)
+	if !ok {
+		return "", fmt.Errorf("redis: unexpected reply %v", reply)
+	}
+
+	return value, nil
+}
+
+// Set sets the value of a key, which expires after ttl.
+func (c *Client) Set(key, value string, ttl time.Duration) error {
+	_, err := c.Do("SET", key, value, "PX", strconv.FormatInt(ttl.Milliseconds(), 10))
+	return err
+}
+
+// Del deletes keys. Keys which don't exist are ignored.
+func (c *Client) Del(keys ...string) error {
+	_, err := c.Do(append([]string{"DEL"}, keys...)...)
+	return err
+}
+
+// Close closes the idle connections.
+func (c *Client) Close() {
+	for {
+		select {
+		case rc := <-c.idle:
+			rc.conn.Close()
+		default:
+			return
+		}
+	}
+}
+
+// Do sends a command and returns the reply. Simple strings and bulk strings are returned
+// as a string, integers as an int64, arrays as a []interface{}, and null replies as
+// nil. An error reply is returned as an Error.
+//
+// Connections are returned to the pool unless a network or protocol error leaves them
+// in an unknown state.
+func (c *Client) Do(args ...string) (interface{}, error) {
+	rc, err := c.get()
+	if err != nil {
+		return nil, err
+	}
+
+	reply, err := rc.do(c.timeout, args...)
+	if err != nil {
+		var replyErr Error
+		if !errors.As(err, &replyErr) {
+			rc.conn.Close()
+			return nil, err
+		}
+	}
+
+	select {
+	case c.idle <- rc:
+	default:
+		rc.conn.Close()
+	}
+
+	return reply, err
+}
+
+// The get() method takes an idle connection from the pool, or dials a new one.
+func (c *Client) get() (*redisConn, error) {
+	select {
+	case rc := <-c.idle:
+		return rc, nil
+	default:
+	}
+
+	conn, err := net.DialTimeout("tcp", c.addr, c.timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	rc := &redisConn{conn: conn, rd: bufio.NewReader(conn)}
+
+	if c.password != "" {
+		_, err = rc.do(c.timeout, "AUTH", c.password)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	return rc, nil
+}
+
+func (rc *redisConn) do(timeout time.Duration, args ...string) (interface{}, error) {
+	err := rc.conn.SetDeadline(time.Now().Add(timeout))
+	if err != nil {
+		return nil, err
+	}
+
+	// Commands are sent as an array of bulk strings.
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+
+	_, err = io.WriteString(rc.conn, b.String())
+	if err != nil {
+		return nil, err
+	}
+
+	return rc.readReply()
+}
+
+// The readReply() method reads one reply. Simple strings and bulk strings are returned
+// as a string, integers as an int64, arrays as a []interface{}, and null replies as
+// nil.
+func (rc *redisConn) readReply() (interface{}, error) {
+	line, err := rc.rd.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("redis: empty reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, Error(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+
+		buf := make([]byte, n+2)
+		_, err = io.ReadFull(rc.rd, buf)
+		if err != nil {
+			return nil, err
+		}
+
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+
+		values := make([]interface{}, n)
+		for i := range values {
+			values[i], err = rc.readReply()
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		return values, nil
+	default:
+		return nil, fmt.Errorf("redis: unexpected reply %q", line)
+	}
+}
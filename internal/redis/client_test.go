@@ -0,0 +1,101 @@
+package redis_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/petrostrak/an-open-movie-database/internal/redis"
+	"github.com/petrostrak/an-open-movie-database/internal/redis/redistest"
+)
+
+func TestPing(t *testing.T) {
+	s := redistest.NewServer(t, "secret")
+
+	tests := []struct {
+		name     string
+		password string
+		wantErr  bool
+	}{
+		{"valid password", "secret", false},
+		{"wrong password", "wrong", true},
+		{"no password", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := redis.NewClient(s.Addr(), tt.password, 1, time.Second)
+			defer client.Close()
+
+			err := client.Ping()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("got error %v; want error %t", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestGetSetDel(t *testing.T) {
+	s := redistest.NewServer(t, "")
+	client := redis.NewClient(s.Addr(), "", 2, time.Second)
+	defer client.Close()
+
+	_, err := client.Get("a")
+	if !errors.Is(err, redis.ErrNil) {
+		t.Fatalf("got error %v getting a missing key; want ErrNil", err)
+	}
+
+	err = client.Set("a", "value\r\nwith a newline", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	value, err := client.Get("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != "value\r\nwith a newline" {
+		t.Errorf("got value %q", value)
+	}
+
+	err = client.Del("a", "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = client.Get("a")
+	if !errors.Is(err, redis.ErrNil) {
+		t.Errorf("got error %v getting a deleted key; want ErrNil", err)
+	}
+
+	// An error reply is returned as an Error, and leaves the connection usable.
+	_, err = client.Do("NOSUCHCOMMAND")
+
+	var replyErr redis.Error
+	if !errors.As(err, &replyErr) {
+		t.Errorf("got error %v; want a redis.Error", err)
+	}
+
+	err = client.Ping()
+	if err != nil {
+		t.Errorf("got error %v after an error reply", err)
+	}
+}
+
+func TestSetExpiry(t *testing.T) {
+	s := redistest.NewServer(t, "")
+	client := redis.NewClient(s.Addr(), "", 1, time.Second)
+	defer client.Close()
+
+	err := client.Set("a", "value", 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+
+	_, err = client.Get("a")
+	if !errors.Is(err, redis.ErrNil) {
+		t.Errorf("got error %v getting an expired key; want ErrNil", err)
+	}
+}
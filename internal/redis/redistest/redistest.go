@@ -0,0 +1,240 @@
+// Package redistest provides a fake Redis server for tests. It speaks enough RESP for
+// the redis package's client, and keeps the keys in memory.
+package redistest
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A HandlerFunc handles a command which the server doesn't support itself, such as
+// EVAL. It's passed the command's arguments, including the command name, and returns
+// the raw RESP reply. It's called with the server's mutex held.
+type HandlerFunc func(args []string) string
+
+// Server is a fake Redis server. It supports AUTH, PING, GET, SET (with PX), and DEL,
+// and any commands added with Handle().
+type Server struct {
+	ln       net.Listener
+	password string
+
+	mu       sync.Mutex
+	data     map[string]entry
+	handlers map[string]HandlerFunc
+	commands []string
+}
+
+type entry struct {
+	value  string
+	expiry time.Time
+}
+
+// NewServer starts a server, which is closed when the test finishes. Clients must send
+// AUTH with the password first, unless it's empty.
+func NewServer(t testing.TB, password string) *Server {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Server{
+		ln:       ln,
+		password: password,
+		data:     make(map[string]entry),
+		handlers: make(map[string]HandlerFunc),
+	}
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			go s.serve(conn)
+		}
+	}()
+
+	t.Cleanup(s.Close)
+
+	return s
+}
+
+// Addr returns the address the server is listening on.
+func (s *Server) Addr() string {
+	return s.ln.Addr().String()
+}
+
+// Close stops the server accepting connections, which makes it look unavailable to new
+// clients.
+func (s *Server) Close() {
+	s.ln.Close()
+}
+
+// Handle adds a handler for a command.
+func (s *Server) Handle(command string, fn HandlerFunc) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.handlers[command] = fn
+}
+
+// Commands returns the names of the commands received so far, in order.
+func (s *Server) Commands() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]string(nil), s.commands...)
+}
+
+// Get returns the value of a key, and whether it exists.
+func (s *Server) Get(key string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, found := s.lookup(key)
+	return e.value, found
+}
+
+// Set sets the value of a key, which never expires.
+func (s *Server) Set(key, value string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.data[key] = entry{value: value}
+}
+
+// The lookup() method returns a key's entry, removing it if it has expired. The mutex
+// must be held by the caller.
+func (s *Server) lookup(key string) (entry, bool) {
+	e, found := s.data[key]
+	if found && !e.expiry.IsZero() && time.Now().After(e.expiry) {
+		delete(s.data, key)
+		return entry{}, false
+	}
+
+	return e, found
+}
+
+func (s *Server) serve(conn net.Conn) {
+	defer conn.Close()
+
+	rd := bufio.NewReader(conn)
+	authed := s.password == ""
+
+	for {
+		args, err := readCommand(rd)
+		if err != nil {
+			return
+		}
+
+		s.mu.Lock()
+		s.commands = append(s.commands, args[0])
+
+		var reply string
+
+		switch {
+		case args[0] == "AUTH":
+			authed = len(args) == 2 && args[1] == s.password
+			if authed {
+				reply = "+OK\r\n"
+			} else {
+				reply = "-WRONGPASS invalid password\r\n"
+			}
+		case !authed:
+			reply = "-NOAUTH Authentication required.\r\n"
+		case s.handlers[args[0]] != nil:
+			reply = s.handlers[args[0]](args)
+		default:
+			reply = s.do(args)
+		}
+
+		s.mu.Unlock()
+
+		_, err = io.WriteString(conn, reply)
+		if err != nil {
+			return
+		}
+	}
+}
+
+// The do() method runs one of the built-in commands. The mutex must be held by the
+// caller.
+func (s *Server) do(args []string) string {
+	switch {
+	case args[0] == "PING":
+		return "+PONG\r\n"
+	case args[0] == "GET" && len(args) == 2:
+		e, found := s.lookup(args[1])
+		if !found {
+			return "$-1\r\n"
+		}
+		return fmt.Sprintf("$%d\r\n%s\r\n", len(e.value), e.value)
+	case args[0] == "SET" && len(args) == 3:
+		s.data[args[1]] = entry{value: args[2]}
+		return "+OK\r\n"
+	case args[0] == "SET" && len(args) == 5 && strings.EqualFold(args[3], "PX"):
+		ms, err := strconv.ParseInt(args[4], 10, 64)
+		if err != nil || ms <= 0 {
+			return "-ERR invalid expire time in 'set' command\r\n"
+		}
+		s.data[args[1]] = entry{value: args[2], expiry: time.Now().Add(time.Duration(ms) * time.Millisecond)}
+		return "+OK\r\n"
+	case args[0] == "DEL" && len(args) > 1:
+		deleted := 0
+		for _, key := range args[1:] {
+			if _, found := s.lookup(key); found {
+				delete(s.data, key)
+				deleted++
+			}
+		}
+		return fmt.Sprintf(":%d\r\n", deleted)
+	default:
+		return "-ERR unknown command\r\n"
+	}
+}
+
+// The readCommand() function reads a command sent as an array of bulk strings.
+func readCommand(rd *bufio.Reader) ([]string, error) {
+	line, err := rd.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+
+	n, err := strconv.Atoi(strings.TrimSuffix(line[1:], "\r\n"))
+	if err != nil || line[0] != '*' || n < 1 {
+		return nil, fmt.Errorf("bad command %q", line)
+	}
+
+	args := make([]string, n)
+	for i := range args {
+		line, err = rd.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+
+		size, err := strconv.Atoi(strings.TrimSuffix(line[1:], "\r\n"))
+		if err != nil {
+			return nil, err
+		}
+
+		buf := make([]byte, size+2)
+		_, err = io.ReadFull(rd, buf)
+		if err != nil {
+			return nil, err
+		}
+
+		args[i] = string(buf[:size])
+	}
+
+	return args, nil
+}
@@ -0,0 +1,181 @@
+// Package testdb provides PostgreSQL databases for tests. Each test gets its own
+// schema in the database given by the OMDB_TEST_DB_DSN environment variable, which is
+// dropped when the test finishes. Tests which need a database are skipped when the
+// variable isn't set, so `go test ./...` still works without PostgreSQL.
+//
+// The models' tests use Open() instead, which runs them against SQLite when
+// OMDB_TEST_DB_DRIVER=sqlite is set. The data package registers the SQLite driver only
+// with -tags sqlite, and only when cgo is enabled, as go-sqlite3 needs it:
+//
+//	OMDB_TEST_DB_DRIVER=sqlite go test -tags sqlite ./internal/data
+package testdb
+
+import (
+	"database/sql"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/petrostrak/an-open-movie-database/internal/migrate"
+	"github.com/petrostrak/an-open-movie-database/migrations"
+)
+
+// New returns a connection pool whose search path starts with a new, empty schema.
+func New(t testing.TB) *sql.DB {
+	t.Helper()
+
+	dsn := os.Getenv("OMDB_TEST_DB_DSN")
+	if dsn == "" {
+		t.Skip("OMDB_TEST_DB_DSN is not set")
+	}
+
+	admin, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { admin.Close() })
+
+	schema := fmt.Sprintf("test_%d", time.Now().UnixNano())
+
+	_, err = admin.Exec(`CREATE SCHEMA ` + pq.QuoteIdentifier(schema))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		_, err := admin.Exec(`DROP SCHEMA ` + pq.QuoteIdentifier(schema) + ` CASCADE`)
+		if err != nil {
+			t.Error(err)
+		}
+	})
+
+	// lib/pq passes parameters it doesn't recognise to the server as run-time
+	// parameters, so every connection in the pool uses the new schema.
+	db, err := sql.Open("postgres", withSearchPath(dsn, schema+",public"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	err = db.Ping()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return db
+}
+
+// Migrated returns a connection pool like New(), with every migration applied. The
+// test is skipped when OMDB_TEST_DB_DRIVER selects SQLite, as the migrations are
+// written for PostgreSQL.
+func Migrated(t testing.TB) *sql.DB {
+	t.Helper()
+
+	if Driver() == driverSQLite {
+		t.Skip("needs PostgreSQL")
+	}
+
+	db := New(t)
+
+	migrator, err := migrate.New(db, migrations.FS)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = migrator.Up()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return db
+}
+
+// The driver names, which match data.DriverPostgres and data.DriverSQLite. The data
+// package's tests import this one, so it can't import the data package.
+const (
+	driverPostgres = "postgres"
+	driverSQLite   = "sqlite"
+)
+
+// Driver returns the driver selected by OMDB_TEST_DB_DRIVER, which defaults to
+// PostgreSQL.
+func Driver() string {
+	driverName := os.Getenv("OMDB_TEST_DB_DRIVER")
+	if driverName == "" {
+		return driverPostgres
+	}
+
+	return driverName
+}
+
+// Open returns the name of the driver selected by OMDB_TEST_DB_DRIVER and a migrated
+// connection pool for it. For SQLite that's a new database file in the test's
+// temporary directory, with the SQLite migrations applied.
+func Open(t testing.TB) (string, *sql.DB) {
+	t.Helper()
+
+	switch driverName := Driver(); driverName {
+	case driverPostgres:
+		return driverName, Migrated(t)
+	case driverSQLite:
+		return driverName, newSQLite(t)
+	default:
+		t.Fatalf("unsupported OMDB_TEST_DB_DRIVER %q", driverName)
+		return "", nil
+	}
+}
+
+func newSQLite(t testing.TB) *sql.DB {
+	t.Helper()
+
+	registered := false
+	for _, name := range sql.Drivers() {
+		registered = registered || name == driverSQLite
+	}
+
+	if !registered {
+		t.Fatal("OMDB_TEST_DB_DRIVER=sqlite needs the tests to be built with -tags sqlite and cgo enabled")
+	}
+
+	db, err := sql.Open(driverSQLite, filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	migrator, err := migrate.NewForDriver(driverSQLite, db, migrations.SQLiteFS)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = migrator.Up()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return db
+}
+
+// The withSearchPath() helper adds a search_path parameter to a DSN in either the URL
+// or the key=value format.
+func withSearchPath(dsn, searchPath string) string {
+	if !strings.HasPrefix(dsn, "postgres://") && !strings.HasPrefix(dsn, "postgresql://") {
+		return dsn + " search_path='" + searchPath + "'"
+	}
+
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return dsn
+	}
+
+	q := u.Query()
+	q.Set("search_path", searchPath)
+	u.RawQuery = q.Encode()
+
+	return u.String()
+}
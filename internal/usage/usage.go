@@ -0,0 +1,177 @@
+// Package usage counts the requests each user makes per day, so that partners can see
+// how much of their quota they've used.
+package usage
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/petrostrak/an-open-movie-database/internal/data"
+	"github.com/petrostrak/an-open-movie-database/internal/jsonlog"
+)
+
+// The layout of the dates which the counts are kept by.
+const dateLayout = "2006-01-02"
+
+// Define a Meter type which counts requests in memory and adds the counts to the
+// store in batches, from a background goroutine, every flush interval. Counting a
+// request only touches an atomic counter, so it never waits for the database.
+type Meter struct {
+	store    data.UsageStore
+	logger   *jsonlog.Logger
+	interval time.Duration
+	// The now field is replaced in the tests, to move the clock forward.
+	now func() time.Time
+
+	// The counters map is swapped for an empty one by each flush. Increment() holds
+	// the read lock while it adds to a counter, so that nothing is added to a counter
+	// once it has been taken for flushing.
+	mu       sync.RWMutex
+	counters map[key]*atomic.Int64
+
+	stop chan struct{}
+	done chan struct{}
+	once sync.Once
+}
+
+type key struct {
+	userID int64
+	date   string
+}
+
+// New returns a Meter which adds its counts to the store every interval, and starts
+// its flushing goroutine.
+func New(store data.UsageStore, logger *jsonlog.Logger, interval time.Duration) *Meter {
+	m := &Meter{
+		store:    store,
+		logger:   logger,
+		interval: interval,
+		now:      time.Now,
+		counters: make(map[key]*atomic.Int64),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+
+	go m.run()
+
+	return m
+}
+
+// Increment counts a request made by the user today (in UTC).
+func (m *Meter) Increment(userID int64) {
+	k := key{userID: userID, date: m.now().UTC().Format(dateLayout)}
+
+	m.mu.RLock()
+	counter := m.counters[k]
+	if counter != nil {
+		counter.Add(1)
+		m.mu.RUnlock()
+		return
+	}
+	m.mu.RUnlock()
+
+	// This is the user's first request of the day since the last flush, so take the
+	// write lock to add a counter, unless another request got there first.
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.add(k, 1)
+}
+
+// Pending returns the user's counts which haven't been flushed yet, by date in the
+// format "2006-01-02".
+func (m *Meter) Pending(userID int64) map[string]int64 {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	pending := make(map[string]int64)
+	for k, counter := range m.counters {
+		if k.userID == userID {
+			pending[k.date] += counter.Load()
+		}
+	}
+
+	return pending
+}
+
+// Flush adds the counts so far to the store. If that fails, they're kept for the next
+// flush.
+func (m *Meter) Flush() error {
+	m.mu.Lock()
+	counters := m.counters
+	m.counters = make(map[key]*atomic.Int64)
+	m.mu.Unlock()
+
+	if len(counters) == 0 {
+		return nil
+	}
+
+	counts := make([]data.UsageCount, 0, len(counters))
+	for k, counter := range counters {
+		date, _ := time.Parse(dateLayout, k.date)
+		counts = append(counts, data.UsageCount{UserID: k.userID, Date: date, Requests: counter.Load()})
+	}
+
+	err := m.store.Add(counts)
+	if err != nil {
+		m.mu.Lock()
+		for k, counter := range counters {
+			m.add(k, counter.Load())
+		}
+		m.mu.Unlock()
+
+		return err
+	}
+
+	return nil
+}
+
+// Close stops the flushing goroutine, after a final flush of the counts so far. It
+// should be called during graceful shutdown, once the server has stopped handling
+// requests.
+func (m *Meter) Close() {
+	m.once.Do(func() {
+		close(m.stop)
+	})
+
+	<-m.done
+}
+
+// The add() method adds n to the counter for k, creating it if needed. It must be
+// called with the write lock held.
+func (m *Meter) add(k key, n int64) {
+	counter := m.counters[k]
+	if counter == nil {
+		counter = new(atomic.Int64)
+		m.counters[k] = counter
+	}
+
+	counter.Add(n)
+}
+
+// The run() method flushes the counts every interval until the Meter is closed.
+func (m *Meter) run() {
+	defer close(m.done)
+
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			m.flush()
+		case <-m.stop:
+			m.flush()
+			return
+		}
+	}
+}
+
+// The flush() method calls Flush(), and logs an error.
+func (m *Meter) flush() {
+	err := m.Flush()
+	if err != nil {
+		m.logger.PrintError(err, map[string]string{"job": "usage flush"})
+	}
+}
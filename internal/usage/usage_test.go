@@ -0,0 +1,199 @@
+package usage
+
+import (
+	"errors"
+	"io"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/petrostrak/an-open-movie-database/internal/data"
+	"github.com/petrostrak/an-open-movie-database/internal/jsonlog"
+)
+
+// Define a fakeStore which records each batch it's given, and fails while its err
+// field is set.
+type fakeStore struct {
+	mu      sync.Mutex
+	err     error
+	batches [][]data.UsageCount
+}
+
+func (s *fakeStore) Add(counts []data.UsageCount) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.err != nil {
+		return s.err
+	}
+
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].UserID != counts[j].UserID {
+			return counts[i].UserID < counts[j].UserID
+		}
+		return counts[i].Date.Before(counts[j].Date)
+	})
+
+	s.batches = append(s.batches, counts)
+	return nil
+}
+
+func (s *fakeStore) GetAllForUser(userID int64, since time.Time) ([]*data.Usage, error) {
+	return nil, nil
+}
+
+func (s *fakeStore) setErr(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.err = err
+}
+
+func (s *fakeStore) get() [][]data.UsageCount {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([][]data.UsageCount(nil), s.batches...)
+}
+
+// The newTestMeter() helper returns a Meter which only flushes when it's told to,
+// with its clock set to the given time.
+func newTestMeter(t *testing.T, store data.UsageStore, now *time.Time) *Meter {
+	t.Helper()
+
+	m := New(store, jsonlog.New(io.Discard, jsonlog.LevelOff), time.Hour)
+	m.now = func() time.Time { return *now }
+	t.Cleanup(m.Close)
+
+	return m
+}
+
+func TestMeterFlushBatches(t *testing.T) {
+	store := &fakeStore{}
+	now := time.Date(2024, 3, 1, 23, 59, 0, 0, time.UTC)
+	m := newTestMeter(t, store, &now)
+
+	// Count requests from several goroutines, for two users over two days.
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			m.Increment(1 + int64(i%2))
+		}(i)
+	}
+	wg.Wait()
+
+	now = now.Add(2 * time.Minute)
+	m.Increment(1)
+
+	if pending := m.Pending(1); pending["2024-03-01"] != 25 || pending["2024-03-02"] != 1 {
+		t.Errorf("got pending counts %v for user 1; want 25 and 1", pending)
+	}
+
+	err := m.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	batches := store.get()
+	if len(batches) != 1 {
+		t.Fatalf("got %d batches; want 1", len(batches))
+	}
+
+	want := []data.UsageCount{
+		{UserID: 1, Date: time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC), Requests: 25},
+		{UserID: 1, Date: time.Date(2024, 3, 2, 0, 0, 0, 0, time.UTC), Requests: 1},
+		{UserID: 2, Date: time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC), Requests: 25},
+	}
+
+	if len(batches[0]) != len(want) {
+		t.Fatalf("got batch %v; want %v", batches[0], want)
+	}
+
+	for i := range want {
+		got := batches[0][i]
+		if got.UserID != want[i].UserID || !got.Date.Equal(want[i].Date) || got.Requests != want[i].Requests {
+			t.Errorf("got count %d %+v; want %+v", i, got, want[i])
+		}
+	}
+
+	// The counts have been handed over, so there's nothing to flush next time.
+	if pending := m.Pending(1); len(pending) != 0 {
+		t.Errorf("got pending counts %v after the flush; want none", pending)
+	}
+
+	err = m.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n := len(store.get()); n != 1 {
+		t.Errorf("got %d batches after flushing nothing; want 1", n)
+	}
+}
+
+// A failed flush keeps the counts, so that they're added to the next one.
+func TestMeterFlushFailure(t *testing.T) {
+	store := &fakeStore{}
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	m := newTestMeter(t, store, &now)
+
+	m.Increment(1)
+	m.Increment(1)
+
+	store.setErr(errors.New("database unavailable"))
+
+	if err := m.Flush(); err == nil {
+		t.Fatal("got no error from the flush; want the store's error")
+	}
+
+	m.Increment(1)
+	store.setErr(nil)
+
+	if err := m.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	batches := store.get()
+	if len(batches) != 1 || len(batches[0]) != 1 || batches[0][0].Requests != 3 {
+		t.Errorf("got batches %v; want one count of 3", batches)
+	}
+}
+
+// Closing the meter flushes what's left.
+func TestMeterClose(t *testing.T) {
+	store := &fakeStore{}
+
+	m := New(store, jsonlog.New(io.Discard, jsonlog.LevelOff), time.Hour)
+	m.Increment(7)
+	m.Close()
+
+	batches := store.get()
+	if len(batches) != 1 || len(batches[0]) != 1 || batches[0][0].UserID != 7 || batches[0][0].Requests != 1 {
+		t.Errorf("got batches %v after closing; want one count for user 7", batches)
+	}
+
+	// Closing again doesn't panic.
+	m.Close()
+}
+
+// The counts are flushed every interval without being asked.
+func TestMeterInterval(t *testing.T) {
+	store := &fakeStore{}
+
+	m := New(store, jsonlog.New(io.Discard, jsonlog.LevelOff), 10*time.Millisecond)
+	defer m.Close()
+
+	m.Increment(1)
+
+	deadline := time.Now().Add(time.Second)
+	for len(store.get()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	if len(store.get()) == 0 {
+		t.Error("got no batch after the flush interval")
+	}
+}
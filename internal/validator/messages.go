@@ -0,0 +1,134 @@
+package validator
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+)
+
+// The message catalogs, one JSON file per locale, mapping each message ID to its text.
+// Parameters are written in braces, as in "must not be more than {n} bytes long".
+
+//go:embed "locales"
+var localeFS embed.FS
+
+// The locale whose messages are used when there's no translation for a locale. Every
+// message ID must exist in it.
+const DefaultLocale = "en"
+
+// The parsed catalogs, keyed by locale and then by message ID.
+var catalogs = mustLoadCatalogs()
+
+// The mustLoadCatalogs() function parses the embedded catalogs. They're part of the
+// binary, so a malformed one is a bug, and it panics rather than returning an error.
+func mustLoadCatalogs() map[string]map[string]string {
+	files, err := fs.Glob(localeFS, "locales/*.json")
+	if err != nil {
+		panic(err)
+	}
+
+	parsed := make(map[string]map[string]string, len(files))
+
+	for _, file := range files {
+		js, err := localeFS.ReadFile(file)
+		if err != nil {
+			panic(err)
+		}
+
+		var catalog map[string]string
+
+		err = json.Unmarshal(js, &catalog)
+		if err != nil {
+			panic(fmt.Sprintf("validator: %s: %v", file, err))
+		}
+
+		parsed[strings.TrimSuffix(path.Base(file), ".json")] = catalog
+	}
+
+	if parsed[DefaultLocale] == nil {
+		panic("validator: no catalog for the default locale " + DefaultLocale)
+	}
+
+	return parsed
+}
+
+// Locales returns the locales that validation messages are translated into, sorted.
+func Locales() []string {
+	locales := make([]string, 0, len(catalogs))
+	for locale := range catalogs {
+		locales = append(locales, locale)
+	}
+
+	sort.Strings(locales)
+
+	return locales
+}
+
+// Define a Message type to hold a validation error before it's rendered in the
+// client's language: the ID of its text in the catalogs, and the values of its
+// parameters.
+type Message struct {
+	ID     string
+	Params map[string]interface{}
+}
+
+// Msg returns the message with the given ID. The rest of the arguments are pairs of
+// parameter names and values, as in Msg("max_bytes", "n", 500).
+func Msg(id string, params ...interface{}) Message {
+	m := Message{ID: id}
+
+	if len(params) > 1 {
+		m.Params = make(map[string]interface{}, len(params)/2)
+		for i := 0; i+1 < len(params); i += 2 {
+			m.Params[fmt.Sprint(params[i])] = params[i+1]
+		}
+	}
+
+	return m
+}
+
+// Render returns the text of the message in the given locale, falling back to the
+// default locale if it isn't translated, and to the message ID if it isn't in any
+// catalog.
+func (m Message) Render(locale string) string {
+	text, ok := catalogs[locale][m.ID]
+	if !ok {
+		text, ok = catalogs[DefaultLocale][m.ID]
+	}
+	if !ok {
+		text = m.ID
+	}
+
+	if len(m.Params) == 0 {
+		return text
+	}
+
+	replacements := make([]string, 0, 2*len(m.Params))
+	for name, value := range m.Params {
+		replacements = append(replacements, "{"+name+"}", fmt.Sprint(value))
+	}
+
+	return strings.NewReplacer(replacements...).Replace(text)
+}
+
+// String returns the text of the message in the default locale.
+func (m Message) String() string {
+	return m.Render(DefaultLocale)
+}
+
+// Render returns the messages of a validator's errors in the given locale.
+func Render(errors map[string][]Message, locale string) map[string][]string {
+	rendered := make(map[string][]string, len(errors))
+
+	for key, messages := range errors {
+		for _, m := range messages {
+			rendered[key] = append(rendered[key], m.Render(locale))
+		}
+	}
+
+	return rendered
+}
@@ -0,0 +1,169 @@
+package validator
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io/fs"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// Every message must be translated into every supported locale, with the same
+// parameters, and the other catalogs mustn't have messages which English doesn't.
+func TestCatalogsComplete(t *testing.T) {
+	params := regexp.MustCompile(`\{[a-z_]+\}`)
+
+	placeholders := func(text string) []string {
+		found := params.FindAllString(text, -1)
+		sort.Strings(found)
+		return found
+	}
+
+	if len(catalogs) < 2 {
+		t.Fatalf("got locales %q; want en and at least one translation", Locales())
+	}
+
+	for locale, catalog := range catalogs {
+		for id, text := range catalogs[DefaultLocale] {
+			translated, ok := catalog[id]
+			if !ok {
+				t.Errorf("message %q is missing from the %s catalog", id, locale)
+				continue
+			}
+
+			if strings.TrimSpace(translated) == "" {
+				t.Errorf("message %q is empty in the %s catalog", id, locale)
+			}
+
+			if got, want := placeholders(translated), placeholders(text); !reflect.DeepEqual(got, want) {
+				t.Errorf("message %q has parameters %q in the %s catalog; want %q", id, got, locale, want)
+			}
+		}
+
+		for id := range catalog {
+			if _, ok := catalogs[DefaultLocale][id]; !ok {
+				t.Errorf("message %q in the %s catalog isn't in the %s catalog", id, locale, DefaultLocale)
+			}
+		}
+	}
+}
+
+// Every message ID passed to Msg() in the code base has a message in the default
+// catalog, as otherwise clients would be sent the ID.
+func TestMessageIDsExist(t *testing.T) {
+	root := filepath.Join("..", "..")
+	fset := token.NewFileSet()
+	count := 0
+
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if d.IsDir() {
+			if name := d.Name(); path != root && (strings.HasPrefix(name, ".") || name == "vendor") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if !strings.HasSuffix(path, ".go") || strings.HasSuffix(path, "_test.go") {
+			return nil
+		}
+
+		file, err := parser.ParseFile(fset, path, nil, 0)
+		if err != nil {
+			return err
+		}
+
+		ast.Inspect(file, func(n ast.Node) bool {
+			call, ok := n.(*ast.CallExpr)
+			if !ok || len(call.Args) == 0 {
+				return true
+			}
+
+			var name string
+			switch fun := call.Fun.(type) {
+			case *ast.Ident:
+				name = fun.Name
+			case *ast.SelectorExpr:
+				name = fun.Sel.Name
+			}
+			if name != "Msg" {
+				return true
+			}
+
+			lit, ok := call.Args[0].(*ast.BasicLit)
+			if !ok || lit.Kind != token.STRING {
+				return true
+			}
+
+			id, err := strconv.Unquote(lit.Value)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			count++
+			if _, ok := catalogs[DefaultLocale][id]; !ok {
+				t.Errorf("%s: message %q isn't in the %s catalog", fset.Position(lit.Pos()), id, DefaultLocale)
+			}
+
+			return true
+		})
+
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if count == 0 {
+		t.Error("found no calls to Msg()")
+	}
+}
+
+func TestMessageRender(t *testing.T) {
+	tests := []struct {
+		name    string
+		message Message
+		locale  string
+		want    string
+	}{
+		{"english", Msg("required"), "en", "must be provided"},
+		{"greek", Msg("required"), "el", "πρέπει να δοθεί"},
+		{"parameter", Msg("max_bytes", "n", 500), "en", "must not be more than 500 bytes long"},
+		{"greek parameter", Msg("max_bytes", "n", 500), "el", "δεν πρέπει να είναι μεγαλύτερο από 500 byte"},
+		{"string parameter", Msg("unknown_event", "event", "movie.deleted"), "en", `unknown event "movie.deleted"`},
+		{"unsupported locale", Msg("required"), "fr", "must be provided"},
+		{"unknown ID", Msg("no_such_message"), "el", "no_such_message"},
+		{"missing parameter", Msg("max_bytes"), "en", "must not be more than {n} bytes long"},
+		{"parameter with braces", Msg("unknown_roles", "roles", "{n}"), "en", "contains unknown roles: {n}"},
+	}
+
+	for _, tt := range tests {
+		if got := tt.message.Render(tt.locale); got != tt.want {
+			t.Errorf("%s: got %q; want %q", tt.name, got, tt.want)
+		}
+	}
+
+	if got := Msg("max_chars", "n", 30).String(); got != "must not be more than 30 characters long" {
+		t.Errorf("got %q from String(); want the English message", got)
+	}
+}
+
+func TestRender(t *testing.T) {
+	v := New()
+	v.Check(false, "title", Msg("required"))
+	v.Check(false, "title", Msg("max_bytes", "n", 500))
+
+	want := map[string][]string{"title": {"πρέπει να δοθεί", "δεν πρέπει να είναι μεγαλύτερο από 500 byte"}}
+	if got := Render(v.Errors, "el"); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v; want %v", got, want)
+	}
+}
@@ -1,21 +1,46 @@
 package validator
 
-import "regexp"
+import (
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
 
 var (
 	// Declare a regular expression for sanity checking the format of email addresses
 	EmailRX = regexp.MustCompile("^[a-zA-Z0-9.!#$%&'*+\\/=?^_`{|}~-]+@[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?(?:\\.[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)*$")
+
+	// Declare a regular expression for usernames, which are stored lowercased.
+	UsernameRX = regexp.MustCompile("^[a-z0-9_]{3,30}$")
+
+	// Declare a regular expression for request IDs sent by clients, which end up in
+	// our logs and response headers.
+	RequestIDRX = regexp.MustCompile("^[a-zA-Z0-9._-]{1,64}$")
 )
 
-// Define a new Validator type which contains a map of validation errors.
+// Define a new Validator type which contains a map of validation errors. Each key can
+// have more than one error message, in the order they were added. The messages are
+// rendered in the client's language when they're sent, by Render().
+//
+// The keys of nested fields are paths, such as "movies[3].genres", which are built up
+// by the validators returned by Child().
 type Validator struct {
-	Errors map[string]string
+	Errors map[string][]Message
+
+	// A validator returned by Child() also adds its errors to its parent, with the
+	// prefix applied to their keys.
+	parent *Validator
+	prefix string
 }
 
 // New is a helper which creates a new Validator instance with an empty error map
 func New() *Validator {
 	return &Validator{
-		Errors: make(map[string]string),
+		Errors: make(map[string][]Message),
 	}
 }
 
@@ -24,21 +49,67 @@ func (v *Validator) Valid() bool {
 	return len(v.Errors) == 0
 }
 
-// AddError adds an error message to the map (so long as no entry already exists for
-// the given key).
-func (v *Validator) AddError(key, message string) {
-	if _, exists := v.Errors[key]; !exists {
-		v.Errors[key] = message
+// AddError adds an error message to the map (so long as the same message hasn't
+// already been added for the given key).
+func (v *Validator) AddError(key string, message Message) {
+	for _, existing := range v.Errors[key] {
+		if existing.String() == message.String() {
+			return
+		}
+	}
+
+	v.Errors[key] = append(v.Errors[key], message)
+
+	if v.parent != nil {
+		v.parent.AddError(JoinKey(v.prefix, key), message)
 	}
 }
 
 // Check adds an error message to the map only if a validation check is not 'ok'.
-func (v *Validator) Check(ok bool, key, message string) {
+func (v *Validator) Check(ok bool, key string, message Message) {
 	if !ok {
 		v.AddError(key, message)
 	}
 }
 
+// Child returns a validator for a nested value, such as an element of a slice. The
+// errors added to it are also added to v, with their keys prefixed by the prefix, so a
+// "genres" error on v.Child("movies[3]") is reported as "movies[3].genres". The
+// child's own Errors and Valid() only cover the nested value.
+func (v *Validator) Child(prefix string) *Validator {
+	return &Validator{
+		Errors: make(map[string][]Message),
+		parent: v,
+		prefix: prefix,
+	}
+}
+
+// JoinKey returns the key of a field nested under prefix. An empty key refers to the
+// prefix itself, and a key starting with an index, such as "[2]", isn't separated from
+// the prefix by a dot.
+func JoinKey(prefix, key string) string {
+	switch {
+	case prefix == "":
+		return key
+	case key == "":
+		return prefix
+	case strings.HasPrefix(key, "["):
+		return prefix + key
+	default:
+		return prefix + "." + key
+	}
+}
+
+// ValidateEach calls validate for each element of a slice, with a child validator whose
+// errors are reported under the key and the element's index, as in "genres[2]". The
+// element's own errors use an empty key, and the errors of its fields use the fields'
+// names.
+func ValidateEach[T any](v *Validator, key string, values []T, validate func(v *Validator, value T)) {
+	for i, value := range values {
+		validate(v.Child(key+"["+strconv.Itoa(i)+"]"), value)
+	}
+}
+
 // In returns true if a specific value is in a list of strings.
 func In(value string, list ...string) bool {
 	for i := range list {
@@ -55,6 +126,69 @@ func Matches(value string, rx *regexp.Regexp) bool {
 	return rx.MatchString(value)
 }
 
+// Ordered is the set of types which can be compared with < and >, like the one in
+// golang.org/x/exp/constraints.
+type Ordered interface {
+	~int | ~int8 | ~int16 | ~int32 | ~int64 |
+		~uint | ~uint8 | ~uint16 | ~uint32 | ~uint64 | ~uintptr |
+		~float32 | ~float64 |
+		~string
+}
+
+// Between returns true if a value is between min and max, inclusive.
+func Between[T Ordered](value, min, max T) bool {
+	return value >= min && value <= max
+}
+
+// MinBytes returns true if a string is at least n bytes long.
+func MinBytes(s string, n int) bool {
+	return len(s) >= n
+}
+
+// MaxBytes returns true if a string is no more than n bytes long.
+func MaxBytes(s string, n int) bool {
+	return len(s) <= n
+}
+
+// MinRunes returns true if a string is at least n characters (runes) long. Invalid
+// UTF-8 counts as one character per byte.
+func MinRunes(s string, n int) bool {
+	return utf8.RuneCountInString(s) >= n
+}
+
+// MaxRunes returns true if a string is no more than n characters (runes) long.
+func MaxRunes(s string, n int) bool {
+	return utf8.RuneCountInString(s) <= n
+}
+
+// IsURL returns true if a string is an absolute URL with a host. If any schemes are
+// given, the URL's scheme must be one of them, ignoring case.
+func IsURL(s string, schemes ...string) bool {
+	u, err := url.Parse(s)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return false
+	}
+
+	if len(schemes) == 0 {
+		return true
+	}
+
+	for _, scheme := range schemes {
+		if strings.EqualFold(u.Scheme, scheme) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// IsDate returns true if a string is a valid date (or time) in the given layout, as
+// used by time.Parse(). Dates which don't exist, such as 2023-02-29, are invalid.
+func IsDate(s, layout string) bool {
+	_, err := time.Parse(layout, s)
+	return err == nil
+}
+
 // Unique returns true if all string values in a slice are unique.
 func Unique(values []string) bool {
 	uniqueValues := make(map[string]bool)
@@ -65,3 +199,40 @@ func Unique(values []string) bool {
 
 	return len(values) == len(uniqueValues)
 }
+
+// UniqueFold returns true if all string values in a slice are unique, ignoring case.
+// Values are compared the same way as strings.EqualFold() does, so "Drama" and "drama"
+// are duplicates, and so are "kelvin" and "\u212aelvin" (with a Kelvin sign).
+func UniqueFold(values []string) bool {
+	uniqueValues := make(map[string]bool)
+
+	for _, value := range values {
+		key := foldKey(value)
+		if uniqueValues[key] {
+			return false
+		}
+		uniqueValues[key] = true
+	}
+
+	return true
+}
+
+// The foldKey() function maps each rune of s to the smallest rune which is equal to it
+// under simple case folding, so that two strings have the same key exactly when
+// strings.EqualFold() reports that they're equal.
+func foldKey(s string) string {
+	var b strings.Builder
+	b.Grow(len(s))
+
+	for _, r := range s {
+		min := r
+		for f := unicode.SimpleFold(r); f != r; f = unicode.SimpleFold(f) {
+			if f < min {
+				min = f
+			}
+		}
+		b.WriteRune(min)
+	}
+
+	return b.String()
+}
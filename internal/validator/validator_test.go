@@ -0,0 +1,228 @@
+package validator
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAddError(t *testing.T) {
+	v := New()
+
+	v.AddError("title", Msg("required"))
+	v.AddError("title", Msg("max_bytes", "n", 500))
+	v.AddError("title", Msg("required"))
+
+	want := map[string][]string{"title": {"must be provided", "must not be more than 500 bytes long"}}
+	if got := Render(v.Errors, DefaultLocale); !reflect.DeepEqual(got, want) {
+		t.Errorf("got errors %v; want %v", got, want)
+	}
+}
+
+func TestChild(t *testing.T) {
+	v := New()
+
+	movie := v.Child("movies[3]")
+	movie.Check(false, "genres", Msg("duplicate_values"))
+	movie.Child("director").Check(false, "name", Msg("required"))
+	movie.Child("genres[0]").Check(false, "", Msg("empty"))
+
+	if movie.Valid() || len(movie.Errors) != 3 {
+		t.Errorf("got child errors %v; want 3", movie.Errors)
+	}
+
+	want := map[string][]string{
+		"movies[3].genres":        {"must not contain duplicate values"},
+		"movies[3].director.name": {"must be provided"},
+		"movies[3].genres[0]":     {"must not be empty"},
+	}
+	if got := Render(v.Errors, DefaultLocale); !reflect.DeepEqual(got, want) {
+		t.Errorf("got errors %v; want %v", got, want)
+	}
+}
+
+func TestJoinKey(t *testing.T) {
+	tests := []struct {
+		prefix, key, want string
+	}{
+		{"", "title", "title"},
+		{"movies[0]", "", "movies[0]"},
+		{"movies", "[2]", "movies[2]"},
+		{"movies[2]", "title", "movies[2].title"},
+	}
+
+	for _, tt := range tests {
+		if got := JoinKey(tt.prefix, tt.key); got != tt.want {
+			t.Errorf("got %q for JoinKey(%q, %q); want %q", got, tt.prefix, tt.key, tt.want)
+		}
+	}
+}
+
+func TestValidateEach(t *testing.T) {
+	v := New()
+
+	ValidateEach(v, "genres", []string{"drama", "", "comedy", ""}, func(v *Validator, genre string) {
+		v.Check(genre != "", "", Msg("empty"))
+	})
+
+	want := map[string][]string{
+		"genres[1]": {"must not be empty"},
+		"genres[3]": {"must not be empty"},
+	}
+	if got := Render(v.Errors, DefaultLocale); !reflect.DeepEqual(got, want) {
+		t.Errorf("got errors %v; want %v", got, want)
+	}
+}
+
+func TestBetween(t *testing.T) {
+	tests := []struct {
+		name string
+		got  bool
+		want bool
+	}{
+		{"int inside", Between(5, 1, 10), true},
+		{"int at min", Between(1, 1, 10), true},
+		{"int at max", Between(10, 1, 10), true},
+		{"int below", Between(0, 1, 10), false},
+		{"int above", Between(11, 1, 10), false},
+		{"negative", Between(-3, -5, -1), true},
+		{"int32", Between(int32(1888), 1888, 2024), true},
+		{"float", Between(0.5, 0.0, 1.0), true},
+		{"float above", Between(1.0000001, 0.0, 1.0), false},
+		{"string", Between("m", "a", "z"), true},
+		{"string above", Between("zz", "a", "z"), false},
+		{"min above max", Between(5, 10, 1), false},
+	}
+
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("%s: got %t; want %t", tt.name, tt.got, tt.want)
+		}
+	}
+}
+
+func TestLengths(t *testing.T) {
+	tests := []struct {
+		s     string
+		bytes int
+		runes int
+	}{
+		{"", 0, 0},
+		{"abc", 3, 3},
+		{"café", 5, 4},
+		{"日本語", 9, 3},
+		{"👍🏽", 8, 2},
+		{"e\u0301", 3, 2},
+		{"\xff\xfe", 2, 2},
+	}
+
+	for _, tt := range tests {
+		if !MinBytes(tt.s, tt.bytes) || MinBytes(tt.s, tt.bytes+1) {
+			t.Errorf("MinBytes(%q) doesn't agree with a length of %d bytes", tt.s, tt.bytes)
+		}
+		if !MaxBytes(tt.s, tt.bytes) || (tt.bytes > 0 && MaxBytes(tt.s, tt.bytes-1)) {
+			t.Errorf("MaxBytes(%q) doesn't agree with a length of %d bytes", tt.s, tt.bytes)
+		}
+		if !MinRunes(tt.s, tt.runes) || MinRunes(tt.s, tt.runes+1) {
+			t.Errorf("MinRunes(%q) doesn't agree with a length of %d characters", tt.s, tt.runes)
+		}
+		if !MaxRunes(tt.s, tt.runes) || (tt.runes > 0 && MaxRunes(tt.s, tt.runes-1)) {
+			t.Errorf("MaxRunes(%q) doesn't agree with a length of %d characters", tt.s, tt.runes)
+		}
+	}
+}
+
+func TestUniqueFold(t *testing.T) {
+	tests := []struct {
+		values []string
+		want   bool
+	}{
+		{nil, true},
+		{[]string{"drama"}, true},
+		{[]string{"drama", "comedy"}, true},
+		{[]string{"drama", "Drama"}, false},
+		{[]string{"DRAMA", "comedy", "drama"}, false},
+		{[]string{"sci-fi", "SCI-FI"}, false},
+		{[]string{"Ärger", "äRGER"}, false},
+		{[]string{"σίγμα", "ΣΊΓΜΑ"}, false},
+		{[]string{"kelvin", "\u212aelvin"}, false},
+		{[]string{"straße", "strasse"}, true},
+		{[]string{"ſ", "S"}, false},
+		{[]string{"é", "e\u0301"}, true},
+		{[]string{"drama", "drama "}, true},
+		{[]string{"", ""}, false},
+	}
+
+	for _, tt := range tests {
+		if got := UniqueFold(tt.values); got != tt.want {
+			t.Errorf("got %t for %q; want %t", got, tt.values, tt.want)
+		}
+	}
+}
+
+// The keys from foldKey() agree with strings.EqualFold().
+func TestFoldKey(t *testing.T) {
+	values := []string{"a", "A", "k", "K", "\u212a", "s", "S", "ſ", "σ", "Σ", "ς", "ǅ", "ǆ", "Ǆ", "ß", "ẞ", "\xff", "日"}
+
+	for _, a := range values {
+		for _, b := range values {
+			if got, want := foldKey(a) == foldKey(b), strings.EqualFold(a, b); got != want {
+				t.Errorf("got %t comparing the keys of %q and %q; want %t", got, a, b, want)
+			}
+		}
+	}
+}
+
+func TestIsURL(t *testing.T) {
+	tests := []struct {
+		s       string
+		schemes []string
+		want    bool
+	}{
+		{"https://example.com", nil, true},
+		{"https://example.com/hooks?x=1#top", nil, true},
+		{"ftp://example.com/file", nil, true},
+		{"http://localhost:4000", nil, true},
+		{"https://bücher.example/", nil, true},
+		{"HTTPS://EXAMPLE.COM", []string{"https"}, true},
+		{"ftp://example.com/file", []string{"http", "https"}, false},
+		{"example.com", nil, false},
+		{"/relative/path", nil, false},
+		{"mailto:someone@example.com", nil, false},
+		{"https://", nil, false},
+		{"https://exa mple.com", nil, false},
+		{"http://[::1", nil, false},
+		{"", nil, false},
+	}
+
+	for _, tt := range tests {
+		if got := IsURL(tt.s, tt.schemes...); got != tt.want {
+			t.Errorf("got %t for %q with schemes %q; want %t", got, tt.s, tt.schemes, tt.want)
+		}
+	}
+}
+
+func TestIsDate(t *testing.T) {
+	tests := []struct {
+		s      string
+		layout string
+		want   bool
+	}{
+		{"2024-02-29", "2006-01-02", true},
+		{"2023-02-29", "2006-01-02", false},
+		{"2024-13-01", "2006-01-02", false},
+		{"2024-1-5", "2006-01-02", false},
+		{"2024-01-05T10:00:00Z", time.RFC3339, true},
+		{"2024-01-05T10:00:00", time.RFC3339, false},
+		{"05/01/2024", "02/01/2006", true},
+		{"２０２４-01-05", "2006-01-02", false},
+		{"", "2006-01-02", false},
+	}
+
+	for _, tt := range tests {
+		if got := IsDate(tt.s, tt.layout); got != tt.want {
+			t.Errorf("got %t for %q in layout %q; want %t", got, tt.s, tt.layout, tt.want)
+		}
+	}
+}
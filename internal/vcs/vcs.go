@@ -0,0 +1,118 @@
+// Package vcs reports which version of the code the binary was built from, using the
+// build information which the Go toolchain embeds in every binary.
+package vcs
+
+import (
+	"fmt"
+	"runtime/debug"
+	"strings"
+)
+
+// These override the build information when set at build time with -ldflags, such as
+//
+//	go build -ldflags="-X github.com/petrostrak/an-open-movie-database/internal/vcs.version=1.2.0
+//	  -X github.com/petrostrak/an-open-movie-database/internal/vcs.buildTime=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+//
+// The Go toolchain doesn't record when a binary was built, so buildTime is only known
+// when it's set this way.
+var (
+	version   string
+	revision  string
+	buildTime string
+)
+
+// Unknown is reported for anything which the build information doesn't include, such
+// as the revision of a binary built outside a git checkout, or with -buildvcs=false.
+const Unknown = "unknown"
+
+// Info holds the details of the build.
+type Info struct {
+	Version    string `json:"version"`
+	Revision   string `json:"revision"`
+	Modified   bool   `json:"modified"`
+	CommitTime string `json:"commit_time"`
+	BuildTime  string `json:"build_time"`
+	GoVersion  string `json:"go_version"`
+}
+
+// Get returns the details of the running binary's build.
+func Get() Info {
+	// ReadBuildInfo() returns nil if the binary was built without module support.
+	bi, _ := debug.ReadBuildInfo()
+
+	return parse(bi, version, revision, buildTime)
+}
+
+// The parse() function builds the Info from the build information, which is nil if
+// there isn't any, and the values set with -ldflags, which take precedence when they
+// aren't empty.
+func parse(bi *debug.BuildInfo, version, revision, buildTime string) Info {
+	info := Info{
+		Version:    Unknown,
+		Revision:   Unknown,
+		CommitTime: Unknown,
+		BuildTime:  Unknown,
+		GoVersion:  Unknown,
+	}
+
+	if bi != nil {
+		// "go build" in a checkout reports the main module's version as "(devel)", and
+		// only "go install module@version" fills in a real one.
+		if v := bi.Main.Version; v != "" && v != "(devel)" {
+			info.Version = v
+		}
+
+		if bi.GoVersion != "" {
+			info.GoVersion = bi.GoVersion
+		}
+
+		for _, s := range bi.Settings {
+			switch s.Key {
+			case "vcs.revision":
+				info.Revision = s.Value
+			case "vcs.modified":
+				info.Modified = s.Value == "true"
+			case "vcs.time":
+				info.CommitTime = s.Value
+			}
+		}
+	}
+
+	if version != "" {
+		info.Version = version
+	}
+
+	if revision != "" {
+		info.Revision = revision
+	}
+
+	if buildTime != "" {
+		info.BuildTime = buildTime
+	}
+
+	return info
+}
+
+// String returns a one-line summary of the build, such as
+// "1.2.0 (rev 0123abcd, modified)".
+func (i Info) String() string {
+	var details []string
+
+	if i.Revision != Unknown {
+		revision := i.Revision
+		if len(revision) > 8 {
+			revision = revision[:8]
+		}
+		details = append(details, "rev "+revision)
+	}
+
+	if i.Modified {
+		details = append(details, "modified")
+	}
+
+	if len(details) == 0 {
+		return i.Version
+	}
+
+	return fmt.Sprintf("%s (%s)", i.Version, strings.Join(details, ", "))
+}
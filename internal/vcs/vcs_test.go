@@ -0,0 +1,103 @@
+package vcs
+
+import (
+	"runtime/debug"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	withVCS := &debug.BuildInfo{
+		GoVersion: "go1.19.4",
+		Main:      debug.Module{Path: "github.com/petrostrak/an-open-movie-database", Version: "(devel)"},
+		Settings: []debug.BuildSetting{
+			{Key: "-compiler", Value: "gc"},
+			{Key: "vcs", Value: "git"},
+			{Key: "vcs.revision", Value: "0123456789abcdef0123456789abcdef01234567"},
+			{Key: "vcs.time", Value: "2026-10-01T12:00:00Z"},
+			{Key: "vcs.modified", Value: "true"},
+		},
+	}
+
+	installed := &debug.BuildInfo{
+		GoVersion: "go1.19.4",
+		Main:      debug.Module{Path: "github.com/petrostrak/an-open-movie-database", Version: "v1.3.0"},
+	}
+
+	tests := []struct {
+		name                         string
+		bi                           *debug.BuildInfo
+		version, revision, buildTime string
+		want                         Info
+	}{
+		{
+			name: "no build info",
+			want: Info{Version: Unknown, Revision: Unknown, CommitTime: Unknown, BuildTime: Unknown, GoVersion: Unknown},
+		},
+		{
+			name: "checkout",
+			bi:   withVCS,
+			want: Info{
+				Version:    Unknown,
+				Revision:   "0123456789abcdef0123456789abcdef01234567",
+				Modified:   true,
+				CommitTime: "2026-10-01T12:00:00Z",
+				BuildTime:  Unknown,
+				GoVersion:  "go1.19.4",
+			},
+		},
+		{
+			name: "installed module",
+			bi:   installed,
+			want: Info{Version: "v1.3.0", Revision: Unknown, CommitTime: Unknown, BuildTime: Unknown, GoVersion: "go1.19.4"},
+		},
+		{
+			name:      "ldflags",
+			bi:        withVCS,
+			version:   "1.2.0",
+			revision:  "feedface",
+			buildTime: "2026-10-02T08:30:00Z",
+			want: Info{
+				Version:    "1.2.0",
+				Revision:   "feedface",
+				Modified:   true,
+				CommitTime: "2026-10-01T12:00:00Z",
+				BuildTime:  "2026-10-02T08:30:00Z",
+				GoVersion:  "go1.19.4",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := parse(tt.bi, tt.version, tt.revision, tt.buildTime)
+			if got != tt.want {
+				t.Errorf("got %+v; want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInfoString(t *testing.T) {
+	tests := []struct {
+		info Info
+		want string
+	}{
+		{Info{Version: Unknown, Revision: Unknown}, "unknown"},
+		{Info{Version: "1.2.0", Revision: "0123456789abcdef"}, "1.2.0 (rev 01234567)"},
+		{Info{Version: "1.2.0", Revision: "0123456789abcdef", Modified: true}, "1.2.0 (rev 01234567, modified)"},
+	}
+
+	for _, tt := range tests {
+		if got := tt.info.String(); got != tt.want {
+			t.Errorf("got %q; want %q", got, tt.want)
+		}
+	}
+}
+
+// Get() must work whether or not the test binary has VCS information.
+func TestGet(t *testing.T) {
+	info := Get()
+	if info.Version == "" || info.Revision == "" || info.GoVersion == "" {
+		t.Errorf("got %+v; want every field to be set", info)
+	}
+}
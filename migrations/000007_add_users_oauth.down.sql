@@ -0,0 +1,6 @@
+DROP INDEX IF EXISTS users_oauth_idx;
+
+ALTER TABLE users DROP COLUMN IF EXISTS oauth_subject;
+ALTER TABLE users DROP COLUMN IF EXISTS oauth_provider;
+
+ALTER TABLE users ALTER COLUMN password_hash SET NOT NULL;
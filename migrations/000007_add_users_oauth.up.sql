@@ -0,0 +1,7 @@
+/* migrate create -seq -ext .sql -dir ./migrations add_users_oauth */
+ALTER TABLE users ALTER COLUMN password_hash DROP NOT NULL;
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS oauth_provider text;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS oauth_subject text;
+
+CREATE UNIQUE INDEX IF NOT EXISTS users_oauth_idx ON users (oauth_provider, oauth_subject);
@@ -0,0 +1,32 @@
+/* migrate create -seq -ext .sql -dir ./migrations normalize_users_email */
+-- Report any emails which only differ by case or surrounding whitespace. These rows
+-- are left untouched by the backfill below and need to be merged by hand, otherwise
+-- creating the unique index at the end of this migration will fail.
+DO $$
+DECLARE
+    conflict record;
+BEGIN
+    FOR conflict IN
+        SELECT lower(trim(email::text)) AS normalized, array_agg(id ORDER BY id) AS ids
+        FROM users
+        GROUP BY lower(trim(email::text))
+        HAVING count(*) > 1
+    LOOP
+        RAISE WARNING 'duplicate email %: user ids %', conflict.normalized, conflict.ids;
+    END LOOP;
+END
+$$;
+
+-- Backfill the normalized form for every email which doesn't conflict.
+UPDATE users SET email = lower(trim(email::text))
+WHERE email::text <> lower(trim(email::text))
+AND lower(trim(email::text)) NOT IN (
+    SELECT lower(trim(email::text))
+    FROM users
+    GROUP BY lower(trim(email::text))
+    HAVING count(*) > 1
+);
+
+ALTER TABLE users DROP CONSTRAINT IF EXISTS users_email_key;
+
+CREATE UNIQUE INDEX IF NOT EXISTS users_email_lower_idx ON users (lower(email::text));
@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS logins;
+
+ALTER TABLE users DROP COLUMN IF EXISTS last_login_at;
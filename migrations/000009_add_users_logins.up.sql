@@ -0,0 +1,12 @@
+/* migrate create -seq -ext .sql -dir ./migrations add_users_logins */
+ALTER TABLE users ADD COLUMN IF NOT EXISTS last_login_at timestamp(0) with time zone;
+
+CREATE TABLE IF NOT EXISTS logins (
+    id bigserial PRIMARY KEY,
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    ip text NOT NULL,
+    user_agent text NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS logins_user_id_idx ON logins (user_id, created_at DESC);
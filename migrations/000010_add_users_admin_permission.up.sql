@@ -0,0 +1,4 @@
+/* migrate create -seq -ext .sql -dir ./migrations add_users_admin_permission */
+INSERT INTO permissions (code)
+VALUES
+    ('users:admin');
@@ -0,0 +1,16 @@
+/* migrate create -seq -ext .sql -dir ./migrations create_audit_log_table */
+CREATE TABLE IF NOT EXISTS audit_log (
+    id bigserial PRIMARY KEY,
+    occurred_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    user_id bigint REFERENCES users ON DELETE SET NULL,
+    action text NOT NULL,
+    resource_type text NOT NULL,
+    resource_id text NOT NULL,
+    metadata jsonb NOT NULL DEFAULT '{}',
+    request_id text NOT NULL DEFAULT '',
+    ip text NOT NULL DEFAULT ''
+);
+
+CREATE INDEX IF NOT EXISTS audit_log_occurred_at_idx ON audit_log (occurred_at);
+CREATE INDEX IF NOT EXISTS audit_log_user_id_idx ON audit_log (user_id);
+CREATE INDEX IF NOT EXISTS audit_log_action_idx ON audit_log (action);
@@ -0,0 +1,2 @@
+/* migrate create -seq -ext .sql -dir ./migrations add_users_preferences */
+ALTER TABLE users ADD COLUMN IF NOT EXISTS preferences jsonb NOT NULL DEFAULT '{}';
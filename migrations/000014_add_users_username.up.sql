@@ -0,0 +1,32 @@
+/* migrate create -seq -ext .sql -dir ./migrations add_users_username */
+ALTER TABLE users ADD COLUMN IF NOT EXISTS username text;
+
+-- Backfill a username for every existing user, derived from the local-part of their
+-- email address. Characters which aren't allowed are replaced with underscores, and a
+-- numeric suffix is appended on collision. Users are processed oldest first, so the
+-- earliest account keeps the unsuffixed name.
+DO $$
+DECLARE
+    u record;
+    base text;
+    candidate text;
+    suffix int;
+BEGIN
+    FOR u IN SELECT id, email FROM users WHERE username IS NULL ORDER BY id LOOP
+        base := left(regexp_replace(lower(split_part(u.email::text, '@', 1)), '[^a-z0-9_]', '_', 'g'), 24);
+        base := rpad(base, 3, '_');
+        candidate := base;
+        suffix := 1;
+
+        WHILE EXISTS (SELECT 1 FROM users WHERE username = candidate) LOOP
+            suffix := suffix + 1;
+            candidate := base || suffix;
+        END LOOP;
+
+        UPDATE users SET username = candidate WHERE id = u.id;
+    END LOOP;
+END $$;
+
+ALTER TABLE users ALTER COLUMN username SET NOT NULL;
+
+CREATE UNIQUE INDEX IF NOT EXISTS users_username_lower_idx ON users (lower(username));
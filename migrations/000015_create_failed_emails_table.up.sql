@@ -0,0 +1,8 @@
+/* migrate create -seq -ext .sql -dir ./migrations create_failed_emails_table */
+CREATE TABLE IF NOT EXISTS failed_emails (
+    id bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    recipient text NOT NULL,
+    template text NOT NULL,
+    error text NOT NULL
+);
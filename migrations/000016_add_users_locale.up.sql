@@ -0,0 +1,2 @@
+/* migrate create -seq -ext .sql -dir ./migrations add_users_locale */
+ALTER TABLE users ADD COLUMN IF NOT EXISTS locale text NOT NULL DEFAULT 'en';
@@ -0,0 +1,16 @@
+/* migrate create -seq -ext .sql -dir ./migrations create_email_jobs_table */
+CREATE TABLE IF NOT EXISTS email_jobs (
+    id bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    recipient text NOT NULL,
+    locale text NOT NULL,
+    template text NOT NULL,
+    payload jsonb NOT NULL DEFAULT '{}',
+    status text NOT NULL DEFAULT 'pending',
+    attempts integer NOT NULL DEFAULT 0,
+    next_retry_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    last_error text NOT NULL DEFAULT '',
+    sent_at timestamp(0) with time zone
+);
+
+CREATE INDEX IF NOT EXISTS email_jobs_pending_idx ON email_jobs (next_retry_at) WHERE status = 'pending';
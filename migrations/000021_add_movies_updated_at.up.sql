@@ -0,0 +1,8 @@
+/* migrate create -seq -ext .sql -dir ./migrations add_movies_updated_at */
+ALTER TABLE movies ADD COLUMN IF NOT EXISTS updated_at timestamp(0) with time zone;
+
+-- Movies which haven't been updated since this migration report their creation time.
+UPDATE movies SET updated_at = created_at WHERE updated_at IS NULL;
+
+ALTER TABLE movies ALTER COLUMN updated_at SET DEFAULT NOW();
+ALTER TABLE movies ALTER COLUMN updated_at SET NOT NULL;
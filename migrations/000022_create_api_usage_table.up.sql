@@ -0,0 +1,7 @@
+/* migrate create -seq -ext .sql -dir ./migrations create_api_usage_table */
+CREATE TABLE IF NOT EXISTS api_usage (
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    date date NOT NULL,
+    requests bigint NOT NULL DEFAULT 0,
+    PRIMARY KEY (user_id, date)
+);
@@ -0,0 +1,6 @@
+/* migrate create -seq -ext .sql -dir ./migrations add_users_public_id */
+-- The default fills in a public ID for each existing user, as well as for new ones.
+-- gen_random_uuid() is built in from PostgreSQL 13.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS public_id uuid NOT NULL DEFAULT gen_random_uuid();
+
+CREATE UNIQUE INDEX IF NOT EXISTS users_public_id_idx ON users (public_id);
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS movies_has_awards_idx;
+ALTER TABLE movies DROP COLUMN IF EXISTS external_ratings;
+ALTER TABLE movies DROP COLUMN IF EXISTS awards;
@@ -0,0 +1,11 @@
+/* migrate create -seq -ext .sql -dir ./migrations add_movies_awards_and_ratings */
+-- The awards and external ratings are JSON arrays of objects, which default to empty
+-- for the existing movies.
+ALTER TABLE movies ADD COLUMN IF NOT EXISTS awards jsonb NOT NULL DEFAULT '[]';
+ALTER TABLE movies ADD COLUMN IF NOT EXISTS external_ratings jsonb NOT NULL DEFAULT '[]';
+
+ALTER TABLE movies ADD CONSTRAINT movies_awards_check CHECK (jsonb_typeof(awards) = 'array');
+ALTER TABLE movies ADD CONSTRAINT movies_external_ratings_check CHECK (jsonb_typeof(external_ratings) = 'array');
+
+-- For listing the movies with or without awards (?has_awards=true).
+CREATE INDEX IF NOT EXISTS movies_has_awards_idx ON movies ((jsonb_array_length(awards) > 0));
@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS jobs;
+ALTER TABLE movies DROP COLUMN IF EXISTS ratings_count;
+ALTER TABLE movies DROP COLUMN IF EXISTS average_rating;
@@ -0,0 +1,21 @@
+/* migrate create -seq -ext .sql -dir ./migrations create_jobs_table */
+-- The movies' rating aggregates are denormalized from the ratings table, and are
+-- rebuilt by the re-index job.
+ALTER TABLE movies ADD COLUMN IF NOT EXISTS average_rating double precision NOT NULL DEFAULT 0;
+ALTER TABLE movies ADD COLUMN IF NOT EXISTS ratings_count integer NOT NULL DEFAULT 0;
+
+-- The long-running admin jobs. The cursor is the ID of the last record a job has
+-- finished with, so that an interrupted job can carry on from there.
+CREATE TABLE IF NOT EXISTS jobs (
+    id bigserial PRIMARY KEY,
+    kind text NOT NULL,
+    status text NOT NULL,
+    cursor bigint NOT NULL DEFAULT 0,
+    processed bigint NOT NULL DEFAULT 0,
+    errors text[] NOT NULL DEFAULT '{}',
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    updated_at timestamp(0) with time zone NOT NULL DEFAULT NOW()
+);
+
+-- Only one job of each kind can run at a time.
+CREATE UNIQUE INDEX IF NOT EXISTS jobs_running_idx ON jobs (kind) WHERE status = 'running';
@@ -0,0 +1,7 @@
+/* migrate create -seq -ext .sql -dir ./migrations add_movies_created_by */
+-- The users who added and last updated each movie. They're NULL for movies added
+-- before this was recorded, and when the user's account is deleted.
+ALTER TABLE movies ADD COLUMN IF NOT EXISTS created_by bigint REFERENCES users ON DELETE SET NULL;
+ALTER TABLE movies ADD COLUMN IF NOT EXISTS updated_by bigint REFERENCES users ON DELETE SET NULL;
+
+CREATE INDEX IF NOT EXISTS movies_created_by_idx ON movies (created_by);
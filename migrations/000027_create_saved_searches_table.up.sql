@@ -0,0 +1,13 @@
+/* migrate create -seq -ext .sql -dir ./migrations create_saved_searches_table */
+-- The query holds the query string parameters of a movie listing, as a jsonb object of
+-- strings.
+CREATE TABLE IF NOT EXISTS saved_searches (
+    id bigserial PRIMARY KEY,
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    name text NOT NULL,
+    query jsonb NOT NULL DEFAULT '{}',
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW()
+);
+
+-- A user's searches have different names, ignoring case.
+CREATE UNIQUE INDEX IF NOT EXISTS saved_searches_user_name_idx ON saved_searches (user_id, lower(name));
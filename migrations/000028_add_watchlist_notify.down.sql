@@ -0,0 +1,5 @@
+DROP TABLE IF EXISTS watchlist_notifications;
+
+DROP INDEX IF EXISTS watchlist_notify_idx;
+
+ALTER TABLE watchlist DROP COLUMN IF EXISTS notify;
@@ -0,0 +1,14 @@
+/* migrate create -seq -ext .sql -dir ./migrations add_watchlist_notify */
+-- Whether the user is emailed when the movie is updated.
+ALTER TABLE watchlist ADD COLUMN IF NOT EXISTS notify boolean NOT NULL DEFAULT false;
+
+CREATE INDEX IF NOT EXISTS watchlist_notify_idx ON watchlist (movie_id, user_id) WHERE notify;
+
+-- The number of watchlist emails queued for each user each day (in UTC), so that a
+-- burst of updates can't flood anyone's inbox.
+CREATE TABLE IF NOT EXISTS watchlist_notifications (
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    day date NOT NULL,
+    sent integer NOT NULL DEFAULT 0,
+    PRIMARY KEY (user_id, day)
+);
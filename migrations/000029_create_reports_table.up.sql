@@ -0,0 +1,17 @@
+/* migrate create -seq -ext .sql -dir ./migrations create_reports_table */
+-- Reports of incorrect data about a movie. The resolution is the note an editor leaves
+-- when closing a report, and closed_at is when it was resolved or dismissed.
+CREATE TABLE IF NOT EXISTS reports (
+    id bigserial PRIMARY KEY,
+    movie_id bigint NOT NULL REFERENCES movies ON DELETE CASCADE,
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    field text NOT NULL,
+    message text NOT NULL,
+    status text NOT NULL DEFAULT 'open' CHECK (status IN ('open', 'resolved', 'dismissed')),
+    resolution text NOT NULL DEFAULT '',
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    closed_at timestamp(0) with time zone
+);
+
+CREATE INDEX IF NOT EXISTS reports_status_idx ON reports (status, created_at);
+CREATE INDEX IF NOT EXISTS reports_user_id_idx ON reports (user_id);
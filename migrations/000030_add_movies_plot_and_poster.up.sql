@@ -0,0 +1,5 @@
+/* migrate create -seq -ext .sql -dir ./migrations add_movies_plot_and_poster */
+-- The plot is a short summary of the movie, and the poster is the URL of an image of
+-- its poster. Both are optional, and empty for the existing movies.
+ALTER TABLE movies ADD COLUMN IF NOT EXISTS plot text NOT NULL DEFAULT '';
+ALTER TABLE movies ADD COLUMN IF NOT EXISTS poster text NOT NULL DEFAULT '';
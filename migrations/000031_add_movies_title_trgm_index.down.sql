@@ -0,0 +1,3 @@
+-- The pg_trgm extension is left installed, as it may have been installed before this
+-- migration, and other objects may depend on it.
+DROP INDEX IF EXISTS movies_title_trgm_idx;
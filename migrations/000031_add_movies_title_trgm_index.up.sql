@@ -0,0 +1,8 @@
+/* migrate create -seq -ext .sql -dir ./migrations add_movies_title_trgm_index */
+-- The pg_trgm extension scores how alike two titles are, for finding movies which may
+-- be duplicates of a new one. It's a trusted extension, so the database owner can
+-- create it without being a superuser.
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+
+-- For the title % $1 condition in MovieModel.FindSimilarCandidates().
+CREATE INDEX IF NOT EXISTS movies_title_trgm_idx ON movies USING GIN (title gin_trgm_ops);
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS users_digest_idx;
+ALTER TABLE users DROP COLUMN IF EXISTS last_digest_sent_at;
@@ -0,0 +1,6 @@
+/* migrate create -seq -ext .sql -dir ./migrations add_users_last_digest_sent_at */
+-- The time of the last digest of new movies each user was sent, so that a digest isn't
+-- sent twice for the same day after a restart. Users subscribe to the digest with the
+-- "digest" key of their preferences, which the partial index finds.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS last_digest_sent_at timestamp(0) with time zone;
+CREATE INDEX IF NOT EXISTS users_digest_idx ON users (id) WHERE (preferences->>'digest')::boolean;
@@ -0,0 +1,7 @@
+/* migrate create -seq -ext .sql -dir ./migrations add_movies_popularity */
+-- How many times each movie has been viewed, and its popularity score, which the
+-- popularity job computes from the views, the rating aggregates and how recently the
+-- movie was added. The index serves the listing's default order, most popular first.
+ALTER TABLE movies ADD COLUMN IF NOT EXISTS views bigint NOT NULL DEFAULT 0;
+ALTER TABLE movies ADD COLUMN IF NOT EXISTS popularity double precision NOT NULL DEFAULT 0;
+CREATE INDEX IF NOT EXISTS movies_popularity_idx ON movies (popularity, id);
@@ -0,0 +1,39 @@
+// Package migrations embeds the SQL migration files, so that the API binary can apply
+// them without the migrations directory being deployed alongside it.
+package migrations
+
+import (
+	"embed"
+	"io/fs"
+)
+
+// FS holds the migration files, which are named in the format
+// "<version>_<name>.<up|down>.sql" by `migrate create -seq -ext .sql`.
+//
+//go:embed *.sql
+var FS embed.FS
+
+//go:embed sqlite/*.sql
+var sqliteFiles embed.FS
+
+// SQLiteFS holds the migration files for SQLite, from the sqlite directory, which
+// mirror those in FS.
+var SQLiteFS = mustSub(sqliteFiles, "sqlite")
+
+// ForDriver returns the migration files for the named database driver.
+func ForDriver(driverName string) fs.FS {
+	if driverName == "sqlite" {
+		return SQLiteFS
+	}
+
+	return FS
+}
+
+func mustSub(fsys fs.FS, dir string) fs.FS {
+	sub, err := fs.Sub(fsys, dir)
+	if err != nil {
+		panic(err)
+	}
+
+	return sub
+}
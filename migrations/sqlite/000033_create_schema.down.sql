@@ -0,0 +1,23 @@
+DROP TABLE IF EXISTS reports;
+DROP TABLE IF EXISTS saved_searches;
+DROP TABLE IF EXISTS jobs;
+DROP TABLE IF EXISTS api_usage;
+DROP TABLE IF EXISTS watchlist_notifications;
+DROP TABLE IF EXISTS watchlist;
+DROP TABLE IF EXISTS reviews;
+DROP TABLE IF EXISTS ratings;
+DROP TABLE IF EXISTS webhook_deliveries;
+DROP TABLE IF EXISTS webhooks;
+DROP TABLE IF EXISTS idempotency_keys;
+DROP TABLE IF EXISTS email_jobs;
+DROP TABLE IF EXISTS failed_emails;
+DROP TABLE IF EXISTS audit_log;
+DROP TABLE IF EXISTS logins;
+DROP TABLE IF EXISTS user_roles;
+DROP TABLE IF EXISTS role_permissions;
+DROP TABLE IF EXISTS roles;
+DROP TABLE IF EXISTS users_permissions;
+DROP TABLE IF EXISTS permissions;
+DROP TABLE IF EXISTS tokens;
+DROP TABLE IF EXISTS movies;
+DROP TABLE IF EXISTS users;
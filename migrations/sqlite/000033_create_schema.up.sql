@@ -0,0 +1,282 @@
+/* The SQLite schema, at the version of the PostgreSQL migrations it mirrors, so that
+   `migrate version` reports the same version for either database. A change to the
+   PostgreSQL schema needs a new migration here too.
+
+   SQLite has no array, jsonb or timestamp types: arrays and JSON are stored as JSON
+   text, and times as text in UTC (see data.Dialect). */
+CREATE TABLE IF NOT EXISTS users (
+    id integer PRIMARY KEY AUTOINCREMENT,
+    created_at timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    name text NOT NULL,
+    email text NOT NULL COLLATE NOCASE,
+    password_hash blob,
+    activated boolean NOT NULL,
+    version integer NOT NULL DEFAULT 1,
+    oauth_provider text,
+    oauth_subject text,
+    last_login_at timestamp,
+    preferences text NOT NULL DEFAULT '{}',
+    username text NOT NULL,
+    locale text NOT NULL DEFAULT 'en',
+    /* A random version 4 UUID. */
+    public_id text NOT NULL DEFAULT (lower(
+        hex(randomblob(4)) || '-' || hex(randomblob(2)) || '-4' || substr(hex(randomblob(2)), 2) || '-' ||
+        substr('89AB', 1 + abs(random()) % 4, 1) || substr(hex(randomblob(2)), 2) || '-' || hex(randomblob(6))
+    )),
+    last_digest_sent_at timestamp
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS users_oauth_idx ON users (oauth_provider, oauth_subject);
+CREATE UNIQUE INDEX IF NOT EXISTS users_email_lower_idx ON users (lower(email));
+CREATE UNIQUE INDEX IF NOT EXISTS users_username_lower_idx ON users (lower(username));
+CREATE UNIQUE INDEX IF NOT EXISTS users_public_id_idx ON users (public_id);
+CREATE INDEX IF NOT EXISTS users_digest_idx ON users (id) WHERE preferences->>'digest';
+
+CREATE TABLE IF NOT EXISTS movies (
+    id integer PRIMARY KEY AUTOINCREMENT,
+    created_at timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    title text NOT NULL,
+    year integer NOT NULL CHECK (year >= 1888),
+    runtime integer NOT NULL CHECK (runtime >= 0),
+    genres text NOT NULL CHECK (json_array_length(genres) BETWEEN 1 AND 5),
+    version integer NOT NULL DEFAULT 1,
+    updated_at timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    awards text NOT NULL DEFAULT '[]' CHECK (json_type(awards) = 'array'),
+    external_ratings text NOT NULL DEFAULT '[]' CHECK (json_type(external_ratings) = 'array'),
+    average_rating real NOT NULL DEFAULT 0,
+    ratings_count integer NOT NULL DEFAULT 0,
+    created_by integer REFERENCES users ON DELETE SET NULL,
+    updated_by integer REFERENCES users ON DELETE SET NULL,
+    plot text NOT NULL DEFAULT '',
+    poster text NOT NULL DEFAULT '',
+    views integer NOT NULL DEFAULT 0,
+    popularity real NOT NULL DEFAULT 0
+);
+
+CREATE INDEX IF NOT EXISTS movies_created_by_idx ON movies (created_by);
+CREATE INDEX IF NOT EXISTS movies_popularity_idx ON movies (popularity, id);
+
+CREATE TABLE IF NOT EXISTS tokens (
+    hash blob PRIMARY KEY,
+    user_id integer NOT NULL REFERENCES users ON DELETE CASCADE,
+    expiry timestamp NOT NULL,
+    scope text NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS permissions (
+    id integer PRIMARY KEY AUTOINCREMENT,
+    code text NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS users_permissions (
+    user_id integer NOT NULL REFERENCES users ON DELETE CASCADE,
+    permission_id integer NOT NULL REFERENCES permissions ON DELETE CASCADE,
+    PRIMARY KEY (user_id, permission_id)
+);
+
+INSERT INTO permissions (code)
+VALUES
+    ('movies:read'),
+    ('movies:write'),
+    ('users:admin');
+
+CREATE TABLE IF NOT EXISTS roles (
+    id integer PRIMARY KEY AUTOINCREMENT,
+    name text UNIQUE NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS role_permissions (
+    role_id integer NOT NULL REFERENCES roles ON DELETE CASCADE,
+    permission_id integer NOT NULL REFERENCES permissions ON DELETE CASCADE,
+    PRIMARY KEY (role_id, permission_id)
+);
+
+CREATE TABLE IF NOT EXISTS user_roles (
+    user_id integer NOT NULL REFERENCES users ON DELETE CASCADE,
+    role_id integer NOT NULL REFERENCES roles ON DELETE CASCADE,
+    PRIMARY KEY (user_id, role_id)
+);
+
+INSERT INTO roles (name)
+VALUES
+    ('reader'),
+    ('editor'),
+    ('admin');
+
+INSERT INTO role_permissions
+SELECT roles.id, permissions.id
+FROM roles, permissions
+WHERE (roles.name = 'reader' AND permissions.code = 'movies:read')
+OR (roles.name = 'editor' AND permissions.code IN ('movies:read', 'movies:write'))
+OR roles.name = 'admin';
+
+CREATE TABLE IF NOT EXISTS logins (
+    id integer PRIMARY KEY AUTOINCREMENT,
+    user_id integer NOT NULL REFERENCES users ON DELETE CASCADE,
+    created_at timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    ip text NOT NULL,
+    user_agent text NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS logins_user_id_idx ON logins (user_id, created_at DESC);
+
+CREATE TABLE IF NOT EXISTS audit_log (
+    id integer PRIMARY KEY AUTOINCREMENT,
+    occurred_at timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    user_id integer REFERENCES users ON DELETE SET NULL,
+    action text NOT NULL,
+    resource_type text NOT NULL,
+    resource_id text NOT NULL,
+    metadata text NOT NULL DEFAULT '{}',
+    request_id text NOT NULL DEFAULT '',
+    ip text NOT NULL DEFAULT ''
+);
+
+CREATE INDEX IF NOT EXISTS audit_log_occurred_at_idx ON audit_log (occurred_at);
+CREATE INDEX IF NOT EXISTS audit_log_user_id_idx ON audit_log (user_id);
+CREATE INDEX IF NOT EXISTS audit_log_action_idx ON audit_log (action);
+
+CREATE TABLE IF NOT EXISTS failed_emails (
+    id integer PRIMARY KEY AUTOINCREMENT,
+    created_at timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    recipient text NOT NULL,
+    template text NOT NULL,
+    error text NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS email_jobs (
+    id integer PRIMARY KEY AUTOINCREMENT,
+    created_at timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    recipient text NOT NULL,
+    locale text NOT NULL,
+    template text NOT NULL,
+    payload text NOT NULL DEFAULT '{}',
+    status text NOT NULL DEFAULT 'pending',
+    attempts integer NOT NULL DEFAULT 0,
+    next_retry_at timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    last_error text NOT NULL DEFAULT '',
+    sent_at timestamp
+);
+
+CREATE INDEX IF NOT EXISTS email_jobs_pending_idx ON email_jobs (next_retry_at) WHERE status = 'pending';
+
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+    user_id integer NOT NULL,
+    key text NOT NULL,
+    fingerprint blob NOT NULL,
+    status_code integer,
+    response_headers text NOT NULL DEFAULT '{}',
+    response_body blob,
+    created_at timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    expires_at timestamp NOT NULL,
+    PRIMARY KEY (user_id, key)
+);
+
+CREATE INDEX IF NOT EXISTS idempotency_keys_expires_at_idx ON idempotency_keys (expires_at);
+
+CREATE TABLE IF NOT EXISTS webhooks (
+    id integer PRIMARY KEY AUTOINCREMENT,
+    created_at timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    url text NOT NULL,
+    secret text NOT NULL,
+    events text NOT NULL,
+    active boolean NOT NULL DEFAULT true,
+    version integer NOT NULL DEFAULT 1
+);
+
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+    id integer PRIMARY KEY AUTOINCREMENT,
+    created_at timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    webhook_id integer NOT NULL REFERENCES webhooks ON DELETE CASCADE,
+    event_id text NOT NULL,
+    event_type text NOT NULL,
+    attempt integer NOT NULL,
+    status_code integer NOT NULL DEFAULT 0,
+    error text NOT NULL DEFAULT '',
+    succeeded boolean NOT NULL,
+    duration_ms integer NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS webhook_deliveries_webhook_id_idx ON webhook_deliveries (webhook_id);
+
+CREATE TABLE IF NOT EXISTS ratings (
+    user_id integer NOT NULL REFERENCES users ON DELETE CASCADE,
+    movie_id integer NOT NULL REFERENCES movies ON DELETE CASCADE,
+    rating integer NOT NULL CHECK (rating BETWEEN 1 AND 10),
+    created_at timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (user_id, movie_id)
+);
+
+CREATE TABLE IF NOT EXISTS reviews (
+    id integer PRIMARY KEY AUTOINCREMENT,
+    created_at timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    user_id integer REFERENCES users ON DELETE CASCADE,
+    movie_id integer NOT NULL REFERENCES movies ON DELETE CASCADE,
+    body text NOT NULL,
+    version integer NOT NULL DEFAULT 1
+);
+
+CREATE INDEX IF NOT EXISTS reviews_user_id_idx ON reviews (user_id);
+CREATE INDEX IF NOT EXISTS reviews_movie_id_idx ON reviews (movie_id);
+
+CREATE TABLE IF NOT EXISTS watchlist (
+    user_id integer NOT NULL REFERENCES users ON DELETE CASCADE,
+    movie_id integer NOT NULL REFERENCES movies ON DELETE CASCADE,
+    created_at timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    notify boolean NOT NULL DEFAULT false,
+    PRIMARY KEY (user_id, movie_id)
+);
+
+CREATE INDEX IF NOT EXISTS watchlist_notify_idx ON watchlist (movie_id, user_id) WHERE notify;
+
+CREATE TABLE IF NOT EXISTS watchlist_notifications (
+    user_id integer NOT NULL REFERENCES users ON DELETE CASCADE,
+    day date NOT NULL,
+    sent integer NOT NULL DEFAULT 0,
+    PRIMARY KEY (user_id, day)
+);
+
+CREATE TABLE IF NOT EXISTS api_usage (
+    user_id integer NOT NULL REFERENCES users ON DELETE CASCADE,
+    date date NOT NULL,
+    requests integer NOT NULL DEFAULT 0,
+    PRIMARY KEY (user_id, date)
+);
+
+CREATE TABLE IF NOT EXISTS jobs (
+    id integer PRIMARY KEY AUTOINCREMENT,
+    kind text NOT NULL,
+    status text NOT NULL,
+    cursor integer NOT NULL DEFAULT 0,
+    processed integer NOT NULL DEFAULT 0,
+    errors text NOT NULL DEFAULT '[]',
+    created_at timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS jobs_running_idx ON jobs (kind) WHERE status = 'running';
+
+CREATE TABLE IF NOT EXISTS saved_searches (
+    id integer PRIMARY KEY AUTOINCREMENT,
+    user_id integer NOT NULL REFERENCES users ON DELETE CASCADE,
+    name text NOT NULL,
+    query text NOT NULL DEFAULT '{}',
+    created_at timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS saved_searches_user_name_idx ON saved_searches (user_id, lower(name));
+
+CREATE TABLE IF NOT EXISTS reports (
+    id integer PRIMARY KEY AUTOINCREMENT,
+    movie_id integer NOT NULL REFERENCES movies ON DELETE CASCADE,
+    user_id integer NOT NULL REFERENCES users ON DELETE CASCADE,
+    field text NOT NULL,
+    message text NOT NULL,
+    status text NOT NULL DEFAULT 'open' CHECK (status IN ('open', 'resolved', 'dismissed')),
+    resolution text NOT NULL DEFAULT '',
+    created_at timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    closed_at timestamp
+);
+
+CREATE INDEX IF NOT EXISTS reports_status_idx ON reports (status, created_at);
+CREATE INDEX IF NOT EXISTS reports_user_id_idx ON reports (user_id);